@@ -0,0 +1,679 @@
+// Package client is a client for the HTTP API of docsrv, so the docs of the
+// projects it serves can be managed from other tools. Every client talks to
+// a single host of docsrv, that is, to a single project. The administrative
+// methods require the refresh token of the instance.
+//
+// The API is described by the OpenAPI definition served at
+// /api/openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a client for the docsrv host at BaseURL.
+type Client struct {
+	// BaseURL is the URL of the host, including its path prefix, if any,
+	// e.g. https://docs.foo.tld.
+	BaseURL string
+	// Token is the refresh token used by the administrative methods.
+	Token string
+	// HTTPClient is the client used to perform the requests.
+	// http.DefaultClient is used if it's nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the docsrv host with the given URL, which uses the
+// given token for the administrative methods.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// Error is the error returned when docsrv responds with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("docsrv: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("docsrv: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether the given error is a response of docsrv with a
+// 404 status, because the project or version does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Version is a version of the project.
+type Version struct {
+	Version    string     `json:"version"`
+	URL        string     `json:"url"`
+	Prerelease bool       `json:"prerelease"`
+	Installed  bool       `json:"installed"`
+	ReleasedAt *time.Time `json:"released-at"`
+}
+
+// VersionsOptions are the filters of the listed versions. The zero value
+// lists all of them in the order of docsrv, newest first.
+type VersionsOptions struct {
+	// Major only lists the versions of the given major version if it's set.
+	Major *int
+	// Limit is the maximum number of versions, if greater than 0.
+	Limit int
+	// Ascending lists the oldest versions first.
+	Ascending bool
+	// ExcludePrereleases leaves out the prereleases.
+	ExcludePrereleases bool
+}
+
+func (o VersionsOptions) query() url.Values {
+	q := url.Values{}
+	if o.Major != nil {
+		q.Set("major", strconv.Itoa(*o.Major))
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Ascending {
+		q.Set("order", "asc")
+	}
+	if o.ExcludePrereleases {
+		q.Set("include-prereleases", "false")
+	}
+	return q
+}
+
+// BuildRefOptions are the git ref to build and where its docs are installed.
+type BuildRefOptions struct {
+	// Ref is the tag, branch or SHA to build.
+	Ref string
+	// Label is the version the docs are installed under. It can not be the
+	// version of a release, a branch or a pull request.
+	Label string
+	// Owner and Project are the project to build, if it's not the one of
+	// the host of the client.
+	Owner   string
+	Project string
+}
+
+func (o BuildRefOptions) query() url.Values {
+	q := url.Values{"ref": {o.Ref}, "label": {o.Label}}
+	if o.Owner != "" {
+		q.Set("owner", o.Owner)
+	}
+	if o.Project != "" {
+		q.Set("project", o.Project)
+	}
+	return q
+}
+
+// Project is the metadata of the project.
+type Project struct {
+	Repository       string           `json:"repository"`
+	Latest           *string          `json:"latest"`
+	LatestPrerelease *string          `json:"latest-prerelease"`
+	Versions         []ProjectVersion `json:"versions"`
+}
+
+// ProjectVersion is a version in the metadata of the project.
+type ProjectVersion struct {
+	Text       string     `json:"text"`
+	URL        string     `json:"url"`
+	Installed  bool       `json:"installed"`
+	Prerelease bool       `json:"prerelease"`
+	ReleasedAt *time.Time `json:"released-at"`
+}
+
+// Manifest is the machine-readable manifest of the project of a host.
+type Manifest struct {
+	Host             string            `json:"host"`
+	URL              string            `json:"url"`
+	Owner            string            `json:"owner"`
+	Project          string            `json:"project"`
+	Repository       string            `json:"repository"`
+	DefaultVersion   *string           `json:"default-version"`
+	Latest           *string           `json:"latest"`
+	LatestPrerelease *string           `json:"latest-prerelease"`
+	RefreshedAt      *time.Time        `json:"refreshed-at"`
+	Versions         []ManifestVersion `json:"versions"`
+}
+
+// ManifestVersion is a version in the manifest of the project.
+type ManifestVersion struct {
+	Version    string     `json:"version"`
+	URL        string     `json:"url"`
+	Prerelease bool       `json:"prerelease"`
+	ReleasedAt *time.Time `json:"released-at"`
+	// Build is the build of the installed docs of the version, nil if it's
+	// not installed.
+	Build *ManifestBuild `json:"build"`
+}
+
+// ManifestBuild is the build of an installed version.
+type ManifestBuild struct {
+	BuiltAt  time.Time `json:"built-at"`
+	Builder  string    `json:"builder"`
+	SHA      *string   `json:"sha"`
+	Duration *float64  `json:"duration"`
+}
+
+// SearchHit is a page matching a search.
+type SearchHit struct {
+	Title string  `json:"title"`
+	URL   string  `json:"url"`
+	Score float64 `json:"score"`
+}
+
+// ReleaseNotes are the notes of a release.
+type ReleaseNotes struct {
+	Version    string     `json:"version"`
+	Name       string     `json:"name"`
+	Body       string     `json:"body"`
+	Author     string     `json:"author"`
+	URL        string     `json:"url"`
+	Prerelease bool       `json:"prerelease"`
+	ReleasedAt *time.Time `json:"released-at"`
+}
+
+// Diff is the summary of the pages that changed between two versions.
+type Diff struct {
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	Added     []DiffPage `json:"added"`
+	Removed   []DiffPage `json:"removed"`
+	Modified  []DiffPage `json:"modified"`
+	Unchanged int        `json:"unchanged"`
+}
+
+// DiffPage is a page of a Diff.
+type DiffPage struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+// VersionStatus is the build status of a version.
+type VersionStatus struct {
+	Version        string     `json:"version"`
+	Installed      bool       `json:"installed"`
+	BuiltAt        *time.Time `json:"built-at"`
+	Builder        *string    `json:"builder"`
+	SHA            *string    `json:"sha"`
+	RebuildPending bool       `json:"rebuild-pending"`
+	// LastFailure is the last failed build of the version since it was last
+	// built, if any.
+	LastFailure *BuildFailure `json:"last-failure"`
+}
+
+// BuildFailure is a failed build of a version. The version is not built
+// again by the requests until RetryAt.
+type BuildFailure struct {
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed-at"`
+	RetryAt  time.Time `json:"retry-at"`
+}
+
+// ProjectStats are the disk usage and builds of a project.
+type ProjectStats struct {
+	Repository        string         `json:"repository"`
+	Hosts             []string       `json:"hosts"`
+	RefreshedAt       *time.Time     `json:"refreshed-at"`
+	DiskUsage         int64          `json:"disk-usage"`
+	LastBuiltAt       *time.Time     `json:"last-built-at"`
+	LastBuildDuration *float64       `json:"last-build-duration"`
+	Versions          []VersionStats `json:"versions"`
+	// SkippedTags are the tags of the releases that are not served because
+	// they are not versions of the version scheme of the project.
+	SkippedTags []string `json:"skipped-tags"`
+}
+
+// VersionStats are the disk usage and build of an installed version.
+type VersionStats struct {
+	Version       string     `json:"version"`
+	DiskUsage     int64      `json:"disk-usage"`
+	BuiltAt       *time.Time `json:"built-at"`
+	BuildDuration *float64   `json:"build-duration"`
+	// Orphaned reports whether the release of the version was deleted
+	// upstream.
+	Orphaned bool `json:"orphaned"`
+}
+
+// State is the manifest of the docs installed in the instance.
+type State struct {
+	GeneratedAt time.Time   `json:"generated-at"`
+	Builder     string      `json:"builder"`
+	Layout      string      `json:"layout"`
+	Hosts       []HostState `json:"hosts"`
+}
+
+// HostState are the docs installed for a host.
+type HostState struct {
+	Host       string         `json:"host"`
+	Repository string         `json:"repository"`
+	Root       string         `json:"root"`
+	Target     string         `json:"target"`
+	Linked     bool           `json:"linked"`
+	Versions   []VersionState `json:"versions"`
+}
+
+// VersionState are the docs installed for a version.
+type VersionState struct {
+	Version string     `json:"version"`
+	Path    string     `json:"path"`
+	BuiltAt *time.Time `json:"built-at"`
+	SHA     *string    `json:"sha"`
+}
+
+// QuarantinedVersion is a version that won't be built again until it's
+// released from quarantine.
+type QuarantinedVersion struct {
+	Owner       string    `json:"owner"`
+	Project     string    `json:"project"`
+	Version     string    `json:"version"`
+	Reason      string    `json:"reason"`
+	Quarantined time.Time `json:"quarantined"`
+}
+
+// MinVersion is the minimum version of the project.
+type MinVersion struct {
+	MinVersion string `json:"min-version"`
+	// Overridden reports whether it was changed through the API.
+	Overridden bool `json:"overridden"`
+	// Deleted are the versions whose docs were deleted by the change.
+	Deleted []string `json:"deleted"`
+}
+
+// Maintenance is the maintenance mode of the host.
+type Maintenance struct {
+	Host    string `json:"host"`
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+	// Overridden reports whether it was set through the API.
+	Overridden bool `json:"overridden"`
+	// PausedBuilds are the versions whose builds are paused until the
+	// maintenance is over.
+	PausedBuilds []string `json:"paused-builds"`
+}
+
+// ConfigValidation is the result of validating a config.
+type ConfigValidation struct {
+	Valid  bool          `json:"valid"`
+	Errors []ConfigError `json:"errors"`
+}
+
+// ConfigError is a problem found in a config.
+type ConfigError struct {
+	Host    string `json:"host"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Bulk operations.
+const (
+	BulkRebuild          = "rebuild"
+	BulkPurgePrereleases = "purge-prereleases"
+	BulkRetryFailed      = "retry-failed"
+)
+
+// BulkProgress is the progress of a bulk operation.
+type BulkProgress struct {
+	Operation string `json:"operation"`
+	Version   string `json:"version"`
+	// Status is "planned" for the versions of a dry run, "running", "done"
+	// or "failed" for every version and "finished" once the operation is
+	// finished.
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Step   int    `json:"step"`
+	Total  int    `json:"total"`
+	Failed int    `json:"failed"`
+	DryRun bool   `json:"dry-run"`
+}
+
+// Versions returns the versions of the project matching the given options.
+func (c *Client) Versions(ctx context.Context, opts VersionsOptions) ([]Version, error) {
+	var versions []Version
+	err := c.getJSON(ctx, "/versions/v2.json", opts.query(), &versions)
+	return versions, err
+}
+
+// Project returns the metadata of the project.
+func (c *Client) Project(ctx context.Context) (*Project, error) {
+	var project Project
+	if err := c.getJSON(ctx, "/project.json", nil, &project); err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+// Manifest returns the machine-readable manifest of the project.
+func (c *Client) Manifest(ctx context.Context) (*Manifest, error) {
+	var manifest Manifest
+	if err := c.getJSON(ctx, "/.well-known/docsrv.json", nil, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Search returns the pages of the given version, or the latest one if it's
+// empty, matching the given query, up to the given limit if greater than 0.
+func (c *Client) Search(ctx context.Context, query, version string, limit int) ([]SearchHit, error) {
+	q := url.Values{"q": {query}}
+	if version != "" {
+		q.Set("version", version)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+
+	var hits []SearchHit
+	err := c.getJSON(ctx, "/search.json", q, &hits)
+	return hits, err
+}
+
+// ReleaseNotes returns the notes of the given release.
+func (c *Client) ReleaseNotes(ctx context.Context, version string) (*ReleaseNotes, error) {
+	var notes ReleaseNotes
+	path := "/" + url.PathEscape(version) + "/release-notes.json"
+	if err := c.getJSON(ctx, path, nil, &notes); err != nil {
+		return nil, err
+	}
+	return &notes, nil
+}
+
+// Diff returns the pages added, removed and modified between the given
+// installed versions.
+func (c *Client) Diff(ctx context.Context, from, to string) (*Diff, error) {
+	var diff Diff
+	q := url.Values{"from": {from}, "to": {to}}
+	if err := c.getJSON(ctx, "/api/diff", q, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// Changelog returns the notes of the releases matching the given options.
+func (c *Client) Changelog(ctx context.Context, opts VersionsOptions) ([]ReleaseNotes, error) {
+	var notes []ReleaseNotes
+	err := c.getJSON(ctx, "/changelog.json", opts.query(), &notes)
+	return notes, err
+}
+
+// VersionStatus returns the build status of the given version.
+func (c *Client) VersionStatus(ctx context.Context, version string) (*VersionStatus, error) {
+	var status VersionStatus
+	path := "/api/versions/" + url.PathEscape(version) + "/status"
+	if err := c.getJSON(ctx, path, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Rebuild builds the docs of the given version again and returns its build
+// status once it's finished.
+func (c *Client) Rebuild(ctx context.Context, version string) (*VersionStatus, error) {
+	var status VersionStatus
+	path := "/api/rebuild/" + url.PathEscape(version)
+	if err := c.doJSON(ctx, http.MethodPost, path, c.admin(nil), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// BuildRef builds the docs of the git ref in opts under its label and
+// returns their build status once they are built.
+func (c *Client) BuildRef(ctx context.Context, opts BuildRefOptions) (*VersionStatus, error) {
+	var status VersionStatus
+	if err := c.doJSON(ctx, http.MethodPost, "/api/build", c.admin(opts.query()), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Stats returns the disk usage and builds of all the projects.
+func (c *Client) Stats(ctx context.Context) ([]ProjectStats, error) {
+	var stats []ProjectStats
+	err := c.doJSON(ctx, http.MethodGet, "/api/stats", c.admin(nil), nil, &stats)
+	return stats, err
+}
+
+// State returns the manifest of the installed docs.
+func (c *Client) State(ctx context.Context) (*State, error) {
+	return c.state(ctx, http.MethodGet)
+}
+
+// ResyncState writes the manifest of the installed docs again from the docs
+// on disk and returns it.
+func (c *Client) ResyncState(ctx context.Context) (*State, error) {
+	return c.state(ctx, http.MethodPost)
+}
+
+func (c *Client) state(ctx context.Context, method string) (*State, error) {
+	var state State
+	if err := c.doJSON(ctx, method, "/api/state", c.admin(nil), nil, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Quarantined returns the quarantined versions of the project.
+func (c *Client) Quarantined(ctx context.Context) ([]QuarantinedVersion, error) {
+	var versions []QuarantinedVersion
+	err := c.doJSON(ctx, http.MethodGet, "/api/quarantine", c.admin(nil), nil, &versions)
+	return versions, err
+}
+
+// ReleaseFromQuarantine releases the given version from quarantine, so it's
+// built again the next time it's requested.
+func (c *Client) ReleaseFromQuarantine(ctx context.Context, version string) error {
+	q := c.admin(url.Values{"version": {version}})
+	return c.doJSON(ctx, http.MethodDelete, "/api/quarantine", q, nil, nil)
+}
+
+// MinVersion returns the minimum version of the project.
+func (c *Client) MinVersion(ctx context.Context) (*MinVersion, error) {
+	return c.minVersion(ctx, http.MethodGet, nil)
+}
+
+// SetMinVersion changes the minimum version of the project, which deletes
+// the docs of the older versions.
+func (c *Client) SetMinVersion(ctx context.Context, version string) (*MinVersion, error) {
+	return c.minVersion(ctx, http.MethodPut, url.Values{"version": {version}})
+}
+
+// ResetMinVersion restores the minimum version of the config.
+func (c *Client) ResetMinVersion(ctx context.Context) (*MinVersion, error) {
+	return c.minVersion(ctx, http.MethodDelete, nil)
+}
+
+func (c *Client) minVersion(ctx context.Context, method string, q url.Values) (*MinVersion, error) {
+	var v MinVersion
+	if err := c.doJSON(ctx, method, "/api/min-version", c.admin(q), nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Maintenance returns the maintenance mode of the host.
+func (c *Client) Maintenance(ctx context.Context) (*Maintenance, error) {
+	return c.maintenance(ctx, http.MethodGet, nil)
+}
+
+// StartMaintenance puts the host into maintenance mode, showing the given
+// message, or a default one if it's empty, to its users and pausing its
+// builds.
+func (c *Client) StartMaintenance(ctx context.Context, message string) (*Maintenance, error) {
+	q := url.Values{}
+	if message != "" {
+		q.Set("message", message)
+	}
+	return c.maintenance(ctx, http.MethodPut, q)
+}
+
+// EndMaintenance takes the host out of maintenance mode and resumes its
+// paused builds.
+func (c *Client) EndMaintenance(ctx context.Context) (*Maintenance, error) {
+	return c.maintenance(ctx, http.MethodDelete, nil)
+}
+
+func (c *Client) maintenance(ctx context.Context, method string, q url.Values) (*Maintenance, error) {
+	var m Maintenance
+	if err := c.doJSON(ctx, method, "/api/maintenance", c.admin(q), nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ValidateConfig validates the given config file. Invalid configs are not an
+// error, their problems are in the result.
+func (c *Client) ValidateConfig(ctx context.Context, config []byte) (*ConfigValidation, error) {
+	var v ConfigValidation
+	err := c.doJSON(ctx, http.MethodPost, "/api/config/validate", c.admin(nil), config, &v)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusUnprocessableEntity {
+		if jsonErr := json.Unmarshal([]byte(e.Message), &v); jsonErr == nil {
+			return &v, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Bulk runs the given bulk operation, or only lists the versions it would
+// run on if dryRun is true, calling the given function with every progress
+// update until it's finished.
+func (c *Client) Bulk(ctx context.Context, operation string, dryRun bool, progress func(BulkProgress)) error {
+	q := c.admin(nil)
+	if dryRun {
+		q.Set("dry-run", "true")
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/api/bulk/"+url.PathEscape(operation), q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var p BulkProgress
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return fmt.Errorf("docsrv: invalid bulk progress: %s", err)
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+	return scanner.Err()
+}
+
+// Export writes to the given writer a gzipped tarball with all the installed
+// versions of the project.
+func (c *Client) Export(ctx context.Context, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/api/export", c.admin(nil), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// admin returns the given query string with the token.
+func (c *Client) admin(q url.Values) url.Values {
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("token", c.Token)
+	return q
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, q url.Values, v interface{}) error {
+	return c.doJSON(ctx, http.MethodGet, path, q, nil, v)
+}
+
+// doJSON performs a request and decodes its response into the given value,
+// unless it's nil.
+func (c *Client) doJSON(ctx context.Context, method, path string, q url.Values, body []byte, v interface{}) error {
+	resp, err := c.do(ctx, method, path, q, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("docsrv: invalid response from %s: %s", path, err)
+	}
+	return nil
+}
+
+// do performs a request and returns its response, or an *Error if its status
+// is not successful.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body []byte) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		// the errors of the API have a JSON body with the message
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(msg, &body) == nil && body.Error != "" {
+			return nil, &Error{resp.StatusCode, body.Error}
+		}
+		return nil, &Error{resp.StatusCode, strings.TrimSpace(string(msg))}
+	}
+
+	return resp, nil
+}
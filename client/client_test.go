@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(handler http.HandlerFunc) (*Client, func()) {
+	srv := httptest.NewServer(handler)
+	return New(srv.URL+"/", "admin"), srv.Close
+}
+
+func TestVersions(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/versions/v2.json", r.URL.Path)
+		require.Equal("1", r.URL.Query().Get("major"))
+		require.Equal("2", r.URL.Query().Get("limit"))
+		require.Equal("asc", r.URL.Query().Get("order"))
+		require.Equal("false", r.URL.Query().Get("include-prereleases"))
+		require.Empty(r.URL.Query().Get("token"))
+		fmt.Fprint(w, `[{"version":"v1.0.0","url":"http://foo.bar/v1.0.0/","installed":true,"released-at":"2017-01-01T00:00:00Z"},{"version":"v1.1.0","url":"http://foo.bar/v1.1.0/","released-at":null}]`)
+	})
+	defer close()
+
+	major := 1
+	versions, err := client.Versions(context.Background(), VersionsOptions{
+		Major:              &major,
+		Limit:              2,
+		Ascending:          true,
+		ExcludePrereleases: true,
+	})
+	require.NoError(err)
+	require.Len(versions, 2)
+	require.Equal("v1.0.0", versions[0].Version)
+	require.True(versions[0].Installed)
+	require.Equal(2017, versions[0].ReleasedAt.Year())
+	require.Equal("v1.1.0", versions[1].Version)
+	require.Nil(versions[1].ReleasedAt)
+}
+
+func TestErrors(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/versions/v9.0.0/status":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"version not found","code":404}`)
+		case "/v9.0.0/release-notes.json":
+			http.Error(w, "no release notes", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	defer close()
+
+	_, err := client.VersionStatus(context.Background(), "v9.0.0")
+	require.True(IsNotFound(err))
+	require.Equal("docsrv: 404 Not Found: version not found", err.Error())
+
+	_, err = client.ReleaseNotes(context.Background(), "v9.0.0")
+	require.Equal(&Error{http.StatusNotFound, "no release notes"}, err)
+
+	_, err = client.Stats(context.Background())
+	require.False(IsNotFound(err))
+	require.Equal(&Error{StatusCode: http.StatusForbidden}, err)
+}
+
+func TestRebuild(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(http.MethodPost, r.Method)
+		require.Equal("/api/rebuild/v1.0.0", r.URL.Path)
+		require.Equal("admin", r.URL.Query().Get("token"))
+		fmt.Fprint(w, `{"version":"v1.0.0","installed":true,"built-at":"2017-01-01T00:00:00Z","builder":"foo","sha":null,"rebuild-pending":false}`)
+	})
+	defer close()
+
+	status, err := client.Rebuild(context.Background(), "v1.0.0")
+	require.NoError(err)
+	require.Equal("v1.0.0", status.Version)
+	require.True(status.Installed)
+	require.Equal("foo", *status.Builder)
+	require.Nil(status.SHA)
+}
+
+func TestBuildRef(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(http.MethodPost, r.Method)
+		require.Equal("/api/build", r.URL.Path)
+		require.Equal("admin", r.URL.Query().Get("token"))
+		require.Equal("hotfix", r.URL.Query().Get("ref"))
+		require.Equal("preview", r.URL.Query().Get("label"))
+		require.Equal("org", r.URL.Query().Get("owner"))
+		require.Equal("", r.URL.Query().Get("project"))
+		fmt.Fprint(w, `{"version":"preview","installed":true,"built-at":"2017-01-01T00:00:00Z","builder":"foo","sha":"abc","rebuild-pending":false}`)
+	})
+	defer close()
+
+	status, err := client.BuildRef(context.Background(), BuildRefOptions{Ref: "hotfix", Label: "preview", Owner: "org"})
+	require.NoError(err)
+	require.Equal("preview", status.Version)
+	require.Equal("abc", *status.SHA)
+}
+
+func TestMinVersion(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/api/min-version", r.URL.Path)
+		require.Equal("admin", r.URL.Query().Get("token"))
+		switch r.Method {
+		case http.MethodPut:
+			require.Equal("v2.0.0", r.URL.Query().Get("version"))
+			fmt.Fprint(w, `{"min-version":"v2.0.0","overridden":true,"deleted":["v1.0.0"]}`)
+		case http.MethodDelete:
+			fmt.Fprint(w, `{"min-version":"v1.0.0","overridden":false}`)
+		default:
+			t.Errorf("unexpected method %s", r.Method)
+		}
+	})
+	defer close()
+
+	v, err := client.SetMinVersion(context.Background(), "v2.0.0")
+	require.NoError(err)
+	require.Equal(&MinVersion{"v2.0.0", true, []string{"v1.0.0"}}, v)
+
+	v, err = client.ResetMinVersion(context.Background())
+	require.NoError(err)
+	require.Equal(&MinVersion{MinVersion: "v1.0.0"}, v)
+}
+
+func TestValidateConfig(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(http.MethodPost, r.Method)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, `{"valid":false,"errors":[{"host":"foo.bar","field":"repository","message":"repository is required"}]}`)
+	})
+	defer close()
+
+	v, err := client.ValidateConfig(context.Background(), []byte(`["foo.bar"]`))
+	require.NoError(err)
+	require.False(v.Valid)
+	require.Equal([]ConfigError{{"foo.bar", "repository", "repository is required"}}, v.Errors)
+}
+
+func TestBulk(t *testing.T) {
+	require := require.New(t)
+	client, close := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/api/bulk/rebuild", r.URL.Path)
+		require.Equal("true", r.URL.Query().Get("dry-run"))
+		fmt.Fprintln(w, `{"operation":"rebuild","status":"planned","version":"v1.0.0","step":1,"total":2,"dry-run":true}`)
+		fmt.Fprintln(w, `{"operation":"rebuild","status":"planned","version":"v1.1.0","step":2,"total":2,"dry-run":true}`)
+		fmt.Fprintln(w, `{"operation":"rebuild","status":"finished","step":2,"total":2,"dry-run":true}`)
+	})
+	defer close()
+
+	var statuses []string
+	err := client.Bulk(context.Background(), BulkRebuild, true, func(p BulkProgress) {
+		statuses = append(statuses, p.Version+" "+p.Status)
+	})
+	require.NoError(err)
+	require.Equal([]string{"v1.0.0 planned", "v1.1.0 planned", " finished"}, statuses)
+}
@@ -0,0 +1,121 @@
+// docsrv-loadgen performs requests to the hot paths of a running docsrv
+// instance from several concurrent workers and reports the throughput and
+// latencies, so changes in its performance can be measured.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func main() {
+	var (
+		addr        = flag.String("addr", "http://127.0.0.1:9091", "address of the docsrv instance")
+		hosts       = flag.String("hosts", "", "comma separated list of hosts to send requests to")
+		paths       = flag.String("paths", "/versions.json,/latest/", "comma separated list of paths to request")
+		concurrency = flag.Int("c", 10, "number of concurrent workers")
+		duration    = flag.Duration("d", 10*time.Second, "duration of the test")
+	)
+	flag.Parse()
+
+	if *hosts == "" {
+		fmt.Fprintln(os.Stderr, "at least one host is required")
+		os.Exit(1)
+	}
+
+	var targets [][2]string
+	for _, h := range strings.Split(*hosts, ",") {
+		for _, p := range strings.Split(*paths, ",") {
+			targets = append(targets, [2]string{h, p})
+		}
+	}
+
+	client := &http.Client{
+		// redirects to the latest version must not be followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+
+	var (
+		mut       sync.Mutex
+		latencies []time.Duration
+		errors    int
+		wg        sync.WaitGroup
+	)
+
+	deadline := time.Now().Add(*duration)
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			var local []time.Duration
+			var failed int
+			for n := worker; time.Now().Before(deadline); n++ {
+				target := targets[n%len(targets)]
+				start := time.Now()
+				if err := request(client, *addr, target[0], target[1]); err != nil {
+					failed++
+					continue
+				}
+				local = append(local, time.Since(start))
+			}
+
+			mut.Lock()
+			latencies = append(latencies, local...)
+			errors += failed
+			mut.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Sort(durations(latencies))
+	fmt.Printf("requests: %d\n", len(latencies))
+	fmt.Printf("errors:   %d\n", errors)
+	fmt.Printf("req/s:    %.2f\n", float64(len(latencies))/duration.Seconds())
+	for _, p := range []float64{50, 90, 99} {
+		fmt.Printf("p%.0f:      %s\n", p, percentile(latencies, p))
+	}
+}
+
+func request(client *http.Client, addr, host, path string) error {
+	req, err := http.NewRequest("GET", addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p/100)]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
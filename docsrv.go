@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -15,56 +20,402 @@ const (
 	sharedFolder = "/etc/shared"
 	baseFolder   = "/var/www/public"
 	configFile   = "/etc/docsrv/conf.d/config.toml"
+	certsFolder  = "/etc/docsrv/certs"
 )
 
+const usage = `Usage: docsrv [command] [flags]
+
+Commands:
+  serve             serve the docs of the configured projects (default)
+  build             build a version of a project locally:
+                    docsrv build <owner>/<project>@<version>
+  index             print the releases of the configured projects as JSON:
+                    docsrv index [<owner>/<project>...]
+  validate-config   check the config file before deploying it
+
+Run "docsrv <command> -h" to see the flags of a command.
+`
+
 func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		runServe(args)
+	case "build":
+		runBuild(args)
+	case "index":
+		runIndex(args)
+	case "validate-config":
+		runValidateConfig(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// newFlagSet returns the flag set of the given command, with the flag of the
+// config file, which is shared by all of them.
+func newFlagSet(command string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("docsrv "+command, flag.ExitOnError)
+	config := flags.String("config", configFile, "path of the config file")
+	return flags, config
+}
+
+// runServe serves the docs of the configured projects until the process is
+// stopped.
+func runServe(args []string) {
+	flags, configPath := newFlagSet("serve")
+	preheat := flags.Bool("preheat", os.Getenv("DOCSRV_PREHEAT") != "",
+		"build all the releases of all the projects in the background at startup")
+	flags.Parse(args)
+
 	var (
-		apiKey          = os.Getenv("GITHUB_API_KEY")
-		debug           = os.Getenv("DEBUG_LOG") != ""
-		refreshToken    = os.Getenv("REFRESH_TOKEN")
+		autocert        = os.Getenv("DOCSRV_AUTOCERT") != ""
+		autocertEmail   = os.Getenv("DOCSRV_AUTOCERT_EMAIL")
+		autocertCache   = getEnv("DOCSRV_AUTOCERT_CACHE", certsFolder)
+		minTLSVersion   = os.Getenv("DOCSRV_TLS_MIN_VERSION")
+		telemetryURL    = os.Getenv("DOCSRV_TELEMETRY_URL")
+		redisURL        = os.Getenv("DOCSRV_REDIS_URL")
 		refreshInterval = getRefreshInterval()
 	)
 
-	if debug {
-		logrus.SetLevel(logrus.DebugLevel)
-	}
+	setupLogging()
 
-	config, err := docsrv.LoadConfig(configFile)
+	config, err := docsrv.LoadConfig(*configPath)
 	if err != nil {
 		logrus.Fatalf("unable to load config: %s", err)
 	}
 
 	if len(config) == 0 {
-		logrus.Fatalf("there are no hosts configured in %s", configFile)
+		logrus.Fatalf("there are no hosts configured in %s", *configPath)
 	}
 
-	docsrv := docsrv.New(docsrv.Options{
-		GitHubAPIKey: apiKey,
-		BaseFolder:   baseFolder,
-		SharedFolder: sharedFolder,
-		RefreshToken: refreshToken,
-		Config:       config,
-	})
-	if err != nil {
+	opts := optionsFromEnv(config)
+	opts.Preheat = *preheat
+	if autocert && opts.PublicScheme == "" {
+		opts.PublicScheme = "https"
+	}
+
+	if redisURL != "" {
+		opts.Coordinator, err = docsrv.NewRedisCoordinator(redisURL)
+		if err != nil {
+			logrus.Fatalf("unable to use Redis: %s", err)
+		}
+	}
+
+	if err := opts.Validate(); err != nil {
 		logrus.Fatalf("unable to start a new docsrv: %s", err)
 	}
 
+	srv := docsrv.New(opts)
+
+	srv.LinkHosts()
+	go reloadOnSignal(srv, *configPath)
+
 	ctx, cancel := context.WithCancel(context.Background())
-	go docsrv.ManageIndex(refreshInterval, ctx)
+	go srv.ManageIndex(refreshInterval, ctx)
+	go cancelOnSignal(cancel)
 	defer cancel()
 
-	server := &http.Server{
-		Addr:         ":9091",
-		Handler:      docsrv,
-		WriteTimeout: 5 * time.Minute,
-		ReadTimeout:  1 * time.Minute,
+	// the key versions are available before the first request is served
+	srv.Preinstall(ctx)
+
+	if telemetryURL != "" {
+		go srv.ReportUsage(ctx, telemetryURL, getTelemetryInterval())
+	}
+
+	go srv.ExportTraces(ctx)
+
+	listen := getListEnv("DOCSRV_LISTEN")
+	if len(listen) == 0 {
+		listen = []string{":9091"}
+	}
+
+	serveOpts := docsrv.ServeOptions{
+		Addrs:             listen,
+		Autocert:          autocert,
+		AutocertCacheDir:  autocertCache,
+		AutocertEmail:     autocertEmail,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       1 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	if autocert {
+		serveOpts.Addr = getEnv("DOCSRV_HTTP_ADDR", ":80")
+		serveOpts.TLSAddr = getEnv("DOCSRV_HTTPS_ADDR", ":443")
+	}
+
+	if minTLSVersion != "" {
+		serveOpts.MinTLSVersion, err = docsrv.ParseTLSVersion(minTLSVersion)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if err := docsrv.Serve(ctx, srv, serveOpts); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// runBuild builds a version of a project into a local folder, without
+// serving nor installing it. The project does not need to be configured.
+func runBuild(args []string) {
+	flags, configPath := newFlagSet("build")
+	output := flags.String("output", "", "folder where the docs are built, ./<project>-<version> by default")
+	baseURL := flags.String("base-url", "", "base URL of the built docs, http://localhost/<version>/ by default")
+	shared := flags.String("shared", sharedFolder, "folder with the shared files of the docs")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: docsrv build [flags] <owner>/<project>@<version>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	owner, project, version, err := parseVersionRef(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *output == "" {
+		*output = project + "-" + version
+	}
+
+	if *baseURL == "" {
+		*baseURL = "http://localhost/" + version + "/"
+	}
+
+	srv := newLocalService(*configPath, func(opts *docsrv.Options) {
+		opts.SharedFolder = *shared
+	})
+
+	if err := srv.BuildVersion(owner, project, version, *baseURL, *output); err != nil {
+		logrus.Fatalf("unable to build %s/%s@%s: %s", owner, project, version, err)
 	}
 
-	if err := server.ListenAndServe(); err != nil {
+	logrus.Infof("docs of %s/%s@%s built in %s", owner, project, version, *output)
+}
+
+// runIndex prints the releases of the given projects, or all the configured
+// ones, as JSON.
+func runIndex(args []string) {
+	flags, configPath := newFlagSet("index")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: docsrv index [flags] [<owner>/<project>...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	srv := newLocalService(*configPath, nil)
+	releases, err := srv.Releases(flags.Args()...)
+	if err != nil {
+		logrus.Fatalf("unable to index releases: %s", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(releases); err != nil {
 		logrus.Fatal(err)
 	}
 }
 
+// runValidateConfig checks that the config file and the options in the
+// environment are valid, exiting with a non-zero status if they are not.
+func runValidateConfig(args []string) {
+	flags, configPath := newFlagSet("validate-config")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %s\n", err)
+		os.Exit(1)
+	}
+
+	config, err := docsrv.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(config) == 0 {
+		fmt.Fprintf(os.Stderr, "invalid config: there are no hosts configured in %s\n", *configPath)
+		os.Exit(1)
+	}
+
+	if errs := config.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "invalid config: %s\n", err)
+		}
+		os.Exit(1)
+	}
+
+	if err := optionsFromEnv(config).Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid options: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s is valid, %d hosts configured\n", *configPath, len(config))
+}
+
+// newLocalService returns a service to run commands outside of the server,
+// with the given config file and the options in the environment, which can
+// be changed with the given function.
+func newLocalService(configPath string, setOptions func(*docsrv.Options)) *docsrv.Service {
+	setupLogging()
+
+	config, err := docsrv.LoadConfig(configPath)
+	if err != nil {
+		logrus.Fatalf("unable to load config: %s", err)
+	}
+
+	opts := optionsFromEnv(config)
+	if setOptions != nil {
+		setOptions(&opts)
+	}
+
+	if err := opts.Validate(); err != nil {
+		logrus.Fatalf("invalid options: %s", err)
+	}
+
+	return docsrv.New(opts)
+}
+
+// parseVersionRef parses a version of a project in the form of
+// ${owner}/${project}@${version}.
+func parseVersionRef(ref string) (owner, project, version string, err error) {
+	// the projects in a subfolder of their repository have an @ in their
+	// name too.
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		repo := strings.Split(ref[:i], "/")
+		if len(repo) == 2 && repo[0] != "" && repo[1] != "" && ref[i+1:] != "" {
+			return repo[0], repo[1], ref[i+1:], nil
+		}
+	}
+
+	return "", "", "", fmt.Errorf("invalid version %q, expected <owner>/<project>@<version>", ref)
+}
+
+// setupLogging sets the level and format of the logs from the environment.
+func setupLogging() {
+	if os.Getenv("DEBUG_LOG") != "" {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if os.Getenv("DOCSRV_LOG_FORMAT") != "text" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
+
+// optionsFromEnv returns the options of docsrv set in the environment with
+// the given config.
+func optionsFromEnv(config docsrv.Config) docsrv.Options {
+	return docsrv.Options{
+		GitHubAPIKey:        os.Getenv("GITHUB_API_KEY"),
+		GitHubAppID:         int64(getIntEnv("GITHUB_APP_ID")),
+		GitHubInstallation:  int64(getIntEnv("GITHUB_APP_INSTALLATION_ID")),
+		GitHubAppKey:        os.Getenv("GITHUB_APP_PRIVATE_KEY"),
+		GitHubBaseURL:       os.Getenv("GITHUB_BASE_URL"),
+		BitbucketToken:      os.Getenv("BITBUCKET_TOKEN"),
+		ProxyURL:            os.Getenv("DOCSRV_PROXY"),
+		CABundle:            os.Getenv("DOCSRV_CA_BUNDLE"),
+		BaseFolder:          baseFolder,
+		SharedFolder:        sharedFolder,
+		RefreshToken:        os.Getenv("REFRESH_TOKEN"),
+		Config:              config,
+		WebhookSecret:       os.Getenv("WEBHOOK_SECRET"),
+		ServeStatic:         os.Getenv("DOCSRV_SERVE_STATIC") != "",
+		FallbackTheme:       os.Getenv("DOCSRV_FALLBACK_THEME") != "",
+		Search:              os.Getenv("DOCSRV_SEARCH") != "",
+		SessionSecret:       os.Getenv("DOCSRV_SESSION_SECRET"),
+		IndexShards:         getIntEnv("DOCSRV_INDEX_SHARDS"),
+		BufferSize:          getIntEnv("DOCSRV_BUFFER_SIZE"),
+		TraceSampleRate:     getFloatEnv("DOCSRV_TRACE_SAMPLE_RATE"),
+		TraceBuilds:         os.Getenv("DOCSRV_TRACE_BUILDS") != "",
+		RemapPolicy:         os.Getenv("DOCSRV_REMAP_POLICY"),
+		PDFCommand:          os.Getenv("DOCSRV_PDF_COMMAND"),
+		Precompress:         os.Getenv("DOCSRV_PRECOMPRESS") != "",
+		BrotliCommand:       os.Getenv("DOCSRV_BROTLI_COMMAND"),
+		RefreshConcurrency:  getIntEnv("DOCSRV_REFRESH_CONCURRENCY"),
+		RefreshTimeout:      time.Duration(getIntEnv("DOCSRV_REFRESH_TIMEOUT")) * time.Second,
+		MaxSymlinkDepth:     getIntEnv("DOCSRV_MAX_SYMLINK_DEPTH"),
+		ForbiddenFileTypes:  getListEnv("DOCSRV_FORBIDDEN_FILE_TYPES"),
+		ScanCommand:         os.Getenv("DOCSRV_SCAN_COMMAND"),
+		DefaultOwner:        os.Getenv("DOCSRV_DEFAULT_OWNER"),
+		DefaultHosts:        os.Getenv("DOCSRV_DEFAULT_HOSTS"),
+		UpstreamURL:         os.Getenv("DOCSRV_UPSTREAM"),
+		LandingHost:         os.Getenv("DOCSRV_LANDING_HOST"),
+		LatestCacheTTL:      time.Duration(getIntEnv("DOCSRV_LATEST_CACHE_TTL")) * time.Second,
+		ArtifactCacheDir:    os.Getenv("DOCSRV_ARTIFACT_CACHE"),
+		CacheBuilds:         os.Getenv("DOCSRV_CACHE_BUILDS") != "",
+		AutoBuildLatest:     os.Getenv("DOCSRV_AUTO_BUILD_LATEST") != "",
+		RequestTimeout:      time.Duration(getIntEnv("DOCSRV_REQUEST_TIMEOUT")) * time.Second,
+		BuildRequestTimeout: time.Duration(getIntEnv("DOCSRV_BUILD_REQUEST_TIMEOUT")) * time.Second,
+		MaxBodySize:         int64(getIntEnv("DOCSRV_MAX_BODY_SIZE")),
+		AuditLog:            os.Getenv("DOCSRV_AUDIT_LOG"),
+		AccessLog:           os.Getenv("DOCSRV_ACCESS_LOG"),
+		AccessLogFormat:     os.Getenv("DOCSRV_ACCESS_LOG_FORMAT"),
+		Layout:              os.Getenv("DOCSRV_LAYOUT"),
+		BuildUser:           os.Getenv("DOCSRV_BUILD_USER"),
+		BuildCgroup:         os.Getenv("DOCSRV_BUILD_CGROUP"),
+		BuildMemoryLimit:    int64(getIntEnv("DOCSRV_BUILD_MEMORY_LIMIT")),
+		BuildCPULimit:       getFloatEnv("DOCSRV_BUILD_CPU_LIMIT"),
+		MaxConcurrentBuilds: getIntEnv("DOCSRV_MAX_CONCURRENT_BUILDS"),
+		QueueFile:           os.Getenv("DOCSRV_QUEUE_FILE"),
+		PublicScheme:        os.Getenv("DOCSRV_PUBLIC_SCHEME"),
+		OTLPEndpoint:        getEnv("DOCSRV_OTLP_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		OTLPHeaders:         getMapEnv("DOCSRV_OTLP_HEADERS"),
+	}
+}
+
+// reloadOnSignal reloads the given config file every time the process receives a
+// SIGHUP signal.
+func reloadOnSignal(srv *docsrv.Service, configPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		config, err := docsrv.LoadConfig(configPath)
+		if err != nil {
+			logrus.Errorf("unable to reload config: %s", err)
+			continue
+		}
+
+		logrus.Info("reloading config")
+		srv.ReloadConfig(config)
+	}
+}
+
+// cancelOnSignal calls the given cancel function when the process receives a
+// SIGINT or SIGTERM signal, so the preinstall stops and the servers shut down
+// gracefully. A second signal kills the process right away.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	logrus.WithField("signal", sig).Info("shutting down")
+	cancel()
+}
+
+// getEnv returns the value of the given env variable or the given default
+// value if it's not set.
+func getEnv(name, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
 func getRefreshInterval() time.Duration {
 	n, err := strconv.Atoi(os.Getenv("DOCSRV_REFRESH"))
 	if err != nil || n < 1 {
@@ -73,3 +424,52 @@ func getRefreshInterval() time.Duration {
 
 	return time.Duration(n) * time.Minute
 }
+
+// getTelemetryInterval returns the interval between usage reports, which is
+// set in hours with DOCSRV_TELEMETRY_INTERVAL and defaults to a day.
+func getTelemetryInterval() time.Duration {
+	n := getIntEnv("DOCSRV_TELEMETRY_INTERVAL")
+	if n < 1 {
+		n = 24
+	}
+
+	return time.Duration(n) * time.Hour
+}
+
+// getIntEnv returns the value of the given env variable as an integer, or 0
+// if it's not set or not a valid integer.
+func getIntEnv(name string) int {
+	n, _ := strconv.Atoi(os.Getenv(name))
+	return n
+}
+
+// getFloatEnv returns the value of the given env variable as a float, or 0
+// if it's not set or not a valid number.
+func getFloatEnv(name string) float64 {
+	n, _ := strconv.ParseFloat(os.Getenv(name), 64)
+	return n
+}
+
+// getMapEnv returns the comma separated key=value pairs of the given env
+// variable. The pairs without a key are ignored.
+func getMapEnv(name string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range getListEnv(name) {
+		kv := strings.SplitN(pair, "=", 2)
+		if key := strings.TrimSpace(kv[0]); key != "" && len(kv) == 2 {
+			values[key] = strings.TrimSpace(kv[1])
+		}
+	}
+	return values
+}
+
+// getListEnv returns the comma separated values of the given env variable.
+func getListEnv(name string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
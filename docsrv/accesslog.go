@@ -0,0 +1,239 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// AccessLogCommon is the Common Log Format.
+	AccessLogCommon = "common"
+	// AccessLogCombined is the Combined Log Format, which is the Common Log
+	// Format with the referer and the user agent.
+	AccessLogCombined = "combined"
+	// AccessLogVhostCombined is the Combined Log Format prefixed by the host
+	// and port of the request, like the vhost_combined format of Apache.
+	AccessLogVhostCombined = "vhost_combined"
+	// AccessLogJSON writes a JSON object per request with all the fields,
+	// including the latency.
+	AccessLogJSON = "json"
+
+	// accessLogStdout is the path of the access log to write it to the
+	// standard output.
+	accessLogStdout = "stdout"
+	// clfTimeFormat is the format of the times in the Common Log Format.
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogFormats are the formats that can be used in the access log.
+var accessLogFormats = map[string]bool{
+	AccessLogCommon:        true,
+	AccessLogCombined:      true,
+	AccessLogVhostCombined: true,
+	AccessLogJSON:          true,
+}
+
+// accessEntry is an entry of the access log.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user-agent,omitempty"`
+	// Latency is the time spent serving the request, in seconds.
+	Latency   float64 `json:"latency"`
+	RequestID string  `json:"request-id"`
+	// tls is whether the request was made with TLS, to know the default
+	// port of its host.
+	tls bool
+}
+
+// accessLog writes every request served to a file or the standard output in
+// a format standard log analyzers can digest, separately from the logs of
+// docsrv. A nil log records nothing.
+type accessLog struct {
+	mut    sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// openAccessLog opens the access log in the given file, which is created if
+// it does not exist, or in the standard output if the path is "stdout". It
+// returns nil if the path is empty. The format defaults to combined.
+func openAccessLog(path, format string) (*accessLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if format == "" {
+		format = AccessLogCombined
+	}
+
+	if !accessLogFormats[format] {
+		return nil, fmt.Errorf("unknown access log format: %q", format)
+	}
+
+	if path == accessLogStdout {
+		return &accessLog{w: os.Stdout, format: format}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, wrap(err, "could not open access log %s", path)
+	}
+	return &accessLog{w: f, format: format}, nil
+}
+
+// close closes the file of the log, if any.
+func (l *accessLog) close() error {
+	if f, ok := l.w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// record writes the given entry to the log.
+func (l *accessLog) record(e accessEntry) {
+	if l == nil {
+		return
+	}
+
+	line, err := e.format(l.format)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("could not encode access log entry: %s", err)
+		return
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		logrus.WithField("alert", true).Errorf("could not write access log entry: %s", err)
+	}
+}
+
+// format returns the line of the entry in the given format.
+func (e accessEntry) format(format string) ([]byte, error) {
+	if format == AccessLogJSON {
+		return json.Marshal(e)
+	}
+
+	uri := e.Path
+	if e.Query != "" {
+		uri += "?" + e.Query
+	}
+
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+
+	line := fmt.Sprintf(
+		"%s - - [%s] %s %d %s",
+		e.IP,
+		e.Time.Format(clfTimeFormat),
+		clfQuote(e.Method+" "+uri+" "+e.Proto),
+		e.Status,
+		bytes,
+	)
+
+	if format == AccessLogCommon {
+		return []byte(line), nil
+	}
+
+	line += " " + clfQuote(e.Referer) + " " + clfQuote(e.UserAgent)
+	if format == AccessLogVhostCombined {
+		line = e.hostPort() + " " + line
+	}
+	return []byte(line), nil
+}
+
+// hostPort returns the host of the entry with its port, which is the default
+// port of the scheme of the request if the host has none.
+func (e accessEntry) hostPort() string {
+	if _, _, err := net.SplitHostPort(e.Host); err == nil {
+		return e.Host
+	}
+
+	if e.tls {
+		return e.Host + ":443"
+	}
+	return e.Host + ":80"
+}
+
+// clfQuote quotes the given value, escaping the quotes, backslashes and
+// non-printable characters, or returns "-" quoted if it's empty.
+func clfQuote(v string) string {
+	if v == "" {
+		return `"-"`
+	}
+	return strconv.Quote(v)
+}
+
+// redactQuery returns the given query string with the value of the token
+// parameter replaced, so the refresh token does not end up in the access log.
+func redactQuery(query string) string {
+	if !strings.Contains(query, "token=") {
+		return query
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "token=REDACTED"
+	}
+
+	if _, ok := values["token"]; ok {
+		values.Set("token", "REDACTED")
+	}
+	return values.Encode()
+}
+
+// logAccess records the given request, once served, in the access log.
+func (s *Service) logAccess(w *statusRecorder, r *http.Request, start time.Time) {
+	if s.access == nil {
+		return
+	}
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	s.access.record(accessEntry{
+		Time:      start,
+		IP:        ip,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.EscapedPath(),
+		Query:     redactQuery(r.URL.RawQuery),
+		Proto:     r.Proto,
+		Status:    status,
+		Bytes:     w.size,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Latency:   time.Since(start).Seconds(),
+		RequestID: requestID(r),
+		tls:       r.TLS != nil,
+	})
+}
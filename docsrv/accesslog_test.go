@@ -0,0 +1,100 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "access.log")
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	srv := New(Options{
+		Config:          Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}},
+		RefreshToken:    "admin",
+		AccessLog:       path,
+		AccessLogFormat: AccessLogJSON,
+	})
+	srv.fetcher = fetcher
+
+	r := httptest.NewRequest("GET", "http://foo.bar/versions.json?token=admin&x=1", nil)
+	r.Header.Set("Referer", "http://foo.bar/")
+	r.Header.Set("User-Agent", "test")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://baz.bar/", nil))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.NotContains(string(data), "admin")
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(lines, 2)
+
+	var e accessEntry
+	require.NoError(json.Unmarshal([]byte(lines[0]), &e))
+	require.Equal("192.0.2.1", e.IP)
+	require.Equal("foo.bar", e.Host)
+	require.Equal("/versions.json", e.Path)
+	require.Equal("token=REDACTED&x=1", e.Query)
+	require.Equal(200, e.Status)
+	require.True(e.Bytes > 0)
+	require.Equal("http://foo.bar/", e.Referer)
+	require.Equal("test", e.UserAgent)
+	require.True(e.Latency > 0)
+	require.NotEmpty(e.RequestID)
+
+	require.NoError(json.Unmarshal([]byte(lines[1]), &e))
+	require.Equal(404, e.Status)
+}
+
+func TestAccessEntryFormat(t *testing.T) {
+	require := require.New(t)
+	e := accessEntry{
+		Time:      time.Date(2017, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		IP:        "127.0.0.1",
+		Method:    "GET",
+		Host:      "foo.bar",
+		Path:      "/v1.0.0/",
+		Query:     "q=1",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     2326,
+		UserAgent: `Mozilla "5.0"`,
+	}
+
+	expected := `127.0.0.1 - - [10/Oct/2017:13:55:36 -0700] "GET /v1.0.0/?q=1 HTTP/1.1" 200 2326`
+	line, err := e.format(AccessLogCommon)
+	require.NoError(err)
+	require.Equal(expected, string(line))
+
+	line, err = e.format(AccessLogCombined)
+	require.NoError(err)
+	require.Equal(expected+` "-" "Mozilla \"5.0\""`, string(line))
+
+	e.Bytes = 0
+	e.tls = true
+	line, err = e.format(AccessLogVhostCombined)
+	require.NoError(err)
+	require.True(strings.HasPrefix(string(line), "foo.bar:443 127.0.0.1 "), string(line))
+	require.Contains(string(line), `" 200 - "`)
+}
+
+func TestOptionsValidate_AccessLog(t *testing.T) {
+	require := require.New(t)
+	require.NoError(Options{AccessLog: "stdout"}.Validate())
+	require.Error(Options{AccessLog: "stdout", AccessLogFormat: "apache"}.Validate())
+	require.Error(Options{AccessLog: "/missing/folder/access.log"}.Validate())
+}
@@ -0,0 +1,68 @@
+package docsrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// The aliases of a host serve the same project as the host, from the same
+// folder, so its versions are built and indexed once for all of them. The
+// host is their canonical one: the docs are always built with its URLs, and
+// the redirects and the URLs returned by the API of an alias point to it
+// too, so the links of the docs work no matter the host they are read from.
+
+// aliasHostKey is the key of the context of the requests to an alias that
+// contains the canonical host of the alias.
+type aliasHostKey struct{}
+
+// aliasOf returns the configured host the given host is an alias of. Will
+// also report whether or not there is any.
+func (c Config) aliasOf(host string) (string, bool) {
+	return newHostTable(c).aliasOf(host)
+}
+
+// servedHosts returns all the configured hosts and their aliases, which are
+// normalized as the hosts of the requests, sorted.
+func (c Config) servedHosts() []string {
+	var hosts []string
+	for host, conf := range c {
+		hosts = append(hosts, host)
+		for _, alias := range conf.Aliases {
+			hosts = append(hosts, normalizeHost(alias))
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// routeAlias returns the given request with its canonical host in the
+// context if it's made to an alias. Other requests are returned as they are.
+func (s *Service) routeAlias(r *http.Request) *http.Request {
+	_, hosts := s.hostConfig()
+	host, ok := hosts.aliasOf(r.Host)
+	if !ok {
+		return r
+	}
+
+	// the port of the request is kept, but the path prefix of the host, if
+	// any, goes after it.
+	host, prefix := splitPathPrefix(host)
+	requested, _ := splitPathPrefix(r.Host)
+	if _, port, err := net.SplitHostPort(requested); err == nil {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), aliasHostKey{}, host+prefix))
+}
+
+// publicHost returns the host of the URLs of the docs served to the given
+// request, which is the canonical host of the alias it's made to, if any,
+// or the host of the request otherwise.
+func publicHost(r *http.Request) string {
+	if host, ok := r.Context().Value(aliasHostKey{}).(string); ok {
+		return host
+	}
+	return r.Host
+}
@@ -0,0 +1,93 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeAlias(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", url)
+	fetcher.add("org", "foo", "v1.1.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "org/foo", Aliases: []string{"docs.foo.com", "Foo.Docs.Example.com"}},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.foo.com/versions.json", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	var versions []*version
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &versions))
+	require.Equal([]*version{
+		{Text: "v1.0.0", URL: "http://foo.bar/v1.0.0"},
+		{Text: "v1.1.0", URL: "http://foo.bar/v1.1.0"},
+	}, versions)
+
+	assertRedirect(t, srv, "http://foo.docs.example.com/latest/", "http://foo.bar/v1.1.0/")
+	assertRedirect(t, srv, "http://docs.foo.com:8080/latest/", "http://foo.bar:8080/v1.1.0/")
+
+	// the version is built once, with the URLs of the canonical host, and
+	// the folders of the aliases link to the same docs.
+	assertRedirect(t, srv, "http://docs.foo.com/v1.0.0/", "http://docs.foo.com/v1.0.0/")
+	assertMakefileOutput(t, srv.versionFolder("org", "foo", "v1.0.0"), "http://foo.bar/v1.0.0/", "foo", "org", "v1.0.0")
+	require.True(isDir(srv.hostFolder("docs.foo.com") + "/v1.0.0"))
+	require.Equal([]string{"v1.0.0"}, srv.index.installedVersions("org", "foo"))
+
+	srv.LinkHosts()
+	for _, host := range []string{"foo.bar", "docs.foo.com", "foo.docs.example.com"} {
+		link, err := os.Readlink(srv.hostFolder(host))
+		require.NoError(err, host)
+		require.Equal(srv.hostLinkTarget(host, "org", "foo"), link)
+	}
+
+	hosts := srv.stateManifest(srv.config()).Hosts
+	require.Len(hosts, 3)
+	require.Equal("docs.foo.com", hosts[0].Host)
+	require.Equal("org/foo", hosts[0].Repository)
+	require.True(hosts[0].Linked)
+
+	// the aliases are in maintenance mode along with their host
+	srv.maintenance.setOverride("foo.bar", maintenanceOverride{enabled: true})
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.foo.com/latest/", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+}
+
+func TestConfigValidate_Aliases(t *testing.T) {
+	require := require.New(t)
+	errs := Config{
+		"foo.bar": {Repository: "org/foo", Aliases: []string{"docs.foo.com", "Baz.bar", "docs.foo.com:8080"}},
+		"baz.bar": {Repository: "org/baz", Aliases: []string{"docs.foo.com.", "qux.bar/baz"}},
+	}.Validate()
+
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	require.Equal([]string{
+		`baz.bar: invalid aliases: "qux.bar/baz" is not a host name without port nor path`,
+		`baz.bar: invalid aliases: docs.foo.com. is also an alias of foo.bar`,
+		`foo.bar: invalid aliases: "docs.foo.com:8080" is not a host name without port nor path`,
+		`foo.bar: invalid aliases: docs.foo.com is also an alias of baz.bar`,
+		`foo.bar: invalid aliases: Baz.bar is configured as a host`,
+		`foo.bar: invalid aliases: docs.foo.com:8080 is also an alias of baz.bar`,
+	}, messages)
+}
@@ -0,0 +1,538 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// TarballArchive builds the docs from the .tar.gz archive of the sources
+	// generated by GitHub.
+	TarballArchive = "tarball"
+	// ZipballArchive builds the docs from the .zip archive of the sources
+	// generated by GitHub.
+	ZipballArchive = "zipball"
+)
+
+// maxChecksumsSize is the maximum size of a checksums file.
+const maxChecksumsSize = 1 << 20
+
+// setSource sets the URLs of the archive with the sources of the given
+// release and of its checksums according to the given project config.
+// Branches and pull requests have no assets, so they are always built from
+// their GitHub archive.
+func (c *buildConfig) setSource(conf ProjectConfig, r *release) {
+	c.tarballURL = r.url
+	c.archiveName = fmt.Sprintf("%s-%s.tar.gz", repositoryName(c.project), r.tag)
+	if conf.Archive == ZipballArchive && r.zipballURL != "" {
+		c.tarballURL = r.zipballURL
+		c.archiveName = fmt.Sprintf("%s-%s.zip", repositoryName(c.project), r.tag)
+	}
+
+	c.checksumAsset = ""
+	c.checksumURL = ""
+	if r.assets == nil {
+		return
+	}
+
+	if conf.SourceAsset != "" {
+		c.tarballURL = r.assets[conf.SourceAsset]
+		c.archiveName = conf.SourceAsset
+	} else if name, ok := matchingAsset(conf.AssetPattern, r.assets); ok {
+		c.tarballURL = r.assets[name]
+		c.archiveName = name
+	}
+
+	if conf.ChecksumAsset != "" {
+		c.checksumAsset = conf.ChecksumAsset
+		c.checksumURL = r.assets[conf.ChecksumAsset]
+	}
+}
+
+// matchingAsset returns the name of the first asset in alphabetical order
+// whose name matches the given pattern. Will also report whether or not there
+// is any.
+func matchingAsset(pattern string, assets map[string]string) (string, bool) {
+	if pattern == "" {
+		return "", false
+	}
+
+	names := make([]string, 0, len(assets))
+	for name := range assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// assets are matched the same way as the excluded versions.
+		if ok, _ := matchVersionPattern(pattern, name); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// downloadRetries is the number of times a download is retried after a
+// transient error, such as a network error or a 5xx status.
+const downloadRetries = 4
+
+var (
+	// downloadBackoff is the time waited before the first retry of a
+	// download, which doubles with every retry.
+	downloadBackoff = 500 * time.Millisecond
+	// maxDownloadBackoff is the maximum time waited between retries.
+	maxDownloadBackoff = 10 * time.Second
+)
+
+// download downloads the given URL to the given file with the given client.
+// Transient errors are retried with a jittered exponential backoff, resuming
+// the download where it stopped if the server supports range requests. A 404
+// status returns an error wrapping ErrNotFound right away, and transient
+// errors return an *ErrDownloadFailed once the retries are exhausted.
+func download(client *http.Client, url, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return wrap(err, "error creating %q", dst)
+	}
+	defer f.Close()
+
+	for attempt := 0; ; attempt++ {
+		err = downloadFrom(client, url, f)
+		failed, ok := err.(*ErrDownloadFailed)
+		if !ok || attempt == downloadRetries {
+			break
+		}
+
+		wait := backoff(attempt)
+		logrus.WithField("url", url).Warnf("retrying download in %s: %s", wait, failed.Err)
+		time.Sleep(wait)
+	}
+
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// downloadFrom downloads the given URL to the given file, requesting only
+// the bytes after the ones already in the file, if any. Errors that may not
+// happen again are returned as *ErrDownloadFailed.
+func downloadFrom(client *http.Client, url string, f *os.File) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return wrap(err, "error downloading %q", url)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return wrap(err, "error downloading %q", url)
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &ErrDownloadFailed{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return wrap(ErrNotFound, "error downloading %q", url)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &ErrDownloadFailed{
+			URL:    url,
+			Status: resp.StatusCode,
+			Err:    fmt.Errorf("unexpected status %d", resp.StatusCode),
+		}
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("error downloading %q: unexpected status %d", url, resp.StatusCode)
+	}
+
+	// the server sent the whole file instead of the range requested.
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		if err := f.Truncate(0); err != nil {
+			return wrap(err, "error downloading %q", url)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return wrap(err, "error downloading %q", url)
+		}
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return &ErrDownloadFailed{URL: url, Err: err}
+	}
+	return nil
+}
+
+// backoff returns the time to wait before the given retry, starting at 0,
+// with a random jitter so the retries of concurrent builds don't happen at
+// the same time.
+func backoff(attempt int) time.Duration {
+	wait := downloadBackoff << uint(attempt)
+	if wait <= 0 || wait > maxDownloadBackoff {
+		wait = maxDownloadBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// verifyChecksum checks that the SHA-256 checksum of the archive downloaded
+// to the given file matches the one of the checksums asset of the version.
+func verifyChecksum(conf buildConfig, file string) error {
+	if conf.checksumAsset == "" {
+		return nil
+	}
+
+	if conf.checksumURL == "" {
+		return wrap(ErrNotFound, "release has no checksums asset %q", conf.checksumAsset)
+	}
+
+	resp, err := conf.client().Get(conf.checksumURL)
+	if err != nil {
+		return wrap(err, "error downloading %q", conf.checksumURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("error downloading %q: unexpected status %d", conf.checksumURL, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxChecksumsSize))
+	if err != nil {
+		return wrap(err, "error downloading %q", conf.checksumURL)
+	}
+
+	expected, ok := findChecksum(data, conf.archiveName)
+	if !ok {
+		return fmt.Errorf("%s has no checksum of %s", conf.checksumAsset, conf.archiveName)
+	}
+
+	actual, err := fileChecksum(file)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("checksum mismatch of %s: expected %s, got %s", conf.archiveName, expected, actual)
+	}
+
+	return nil
+}
+
+// findChecksum returns the checksum of the file with the given name in the
+// given checksums file, with the format of sha256sum: one checksum per line
+// followed by the name of the file. A file with a single checksum and no
+// name is the checksum of any file.
+func findChecksum(data []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var lines [][]string
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+
+	if len(lines) == 1 && len(lines[0]) == 1 {
+		return lines[0][0], true
+	}
+
+	for _, fields := range lines {
+		// sha256sum prefixes the names of the files read in binary mode
+		// with "*".
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0], true
+		}
+	}
+
+	return "", false
+}
+
+// fileChecksum returns the hex SHA-256 checksum of the given file.
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", wrap(err, "error computing checksum of %q", file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// archiveFormat returns the format of the archive in the given file from its
+// magic number: "gzip", "bzip2" or "xz" for compressed tarballs or "zip".
+func archiveFormat(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "gzip", nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return "bzip2", nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return "xz", nil
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return "zip", nil
+	default:
+		return "", fmt.Errorf("unsupported archive format")
+	}
+}
+
+// unpack unpacks the archive in the given file, a .zip or a .tar compressed
+// with gzip, bzip2 or xz, into the given folder. Returns the folder with the
+// sources, which is the only folder at the root of the archive, if there is
+// just one, as in the archives generated by GitHub, or dst otherwise.
+func unpack(file, dst string) (string, error) {
+	format, err := archiveFormat(file)
+	if err != nil {
+		return "", err
+	}
+
+	if format == "zip" {
+		err = unzip(file, dst)
+	} else {
+		err = untarFile(file, format, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dst, entries[0].Name()), nil
+	}
+	return dst, nil
+}
+
+// untarFile unpacks the tarball compressed with the given format in the given
+// file into the given folder. xz tarballs are decompressed with the xz
+// command.
+func untarFile(file, format, dst string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case "gzip":
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return untar(r, dst)
+	case "bzip2":
+		return untar(bzip2.NewReader(f), dst)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("xz", "--decompress", "--stdout")
+	cmd.Stdin = f
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return wrap(err, "error running xz")
+	}
+
+	untarErr := untar(out, dst)
+	// the rest of the output must be read for xz to finish.
+	io.Copy(ioutil.Discard, out)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error decompressing xz: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return untarErr
+}
+
+// untar unpacks the given uncompressed tarball into the given folder.
+func untar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return wrap(err, "invalid tarball")
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		path, err := archivePath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeArchiveFile(path, os.FileMode(hdr.Mode), tr)
+		case tar.TypeSymlink:
+			err = writeSymlink(path, hdr.Linkname)
+		case tar.TypeLink:
+			var target string
+			target, err = archivePath(dst, hdr.Linkname)
+			if err == nil {
+				err = os.Link(target, path)
+			}
+		default:
+			return &ErrQuarantined{fmt.Sprintf("%s is not a regular file", hdr.Name)}
+		}
+
+		if err != nil {
+			return wrap(err, "error unpacking %s", hdr.Name)
+		}
+	}
+}
+
+// unzip unpacks the zip archive in the given file into the given folder.
+func unzip(file, dst string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return wrap(err, "invalid zip archive")
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		path, err := archivePath(dst, f.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := unzipFile(f, path); err != nil {
+			return wrap(err, "error unpacking %s", f.Name)
+		}
+	}
+
+	return nil
+}
+
+func unzipFile(f *zip.File, path string) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return os.MkdirAll(path, 0755)
+	}
+
+	if mode&os.ModeSymlink == 0 && !mode.IsRegular() {
+		return &ErrQuarantined{fmt.Sprintf("%s is not a regular file", f.Name)}
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+		if err != nil {
+			return err
+		}
+		return writeSymlink(path, string(target))
+	}
+
+	return writeArchiveFile(path, mode, r)
+}
+
+// archivePath returns the path in the given folder of the file with the
+// given name in an archive. Names can never point outside of the folder,
+// neither by themselves nor through the symlinks unpacked before them, which
+// are only screened once all the sources are unpacked, so no file is written
+// through a symlink.
+func archivePath(dst, name string) (string, error) {
+	dst = filepath.Clean(dst)
+	path := filepath.Join(dst, filepath.FromSlash(name))
+	if path != dst && !strings.HasPrefix(path, dst+string(filepath.Separator)) {
+		return "", &ErrQuarantined{fmt.Sprintf("%s points outside of the sources", name)}
+	}
+
+	current := dst
+	for _, part := range strings.Split(strings.TrimPrefix(path, dst), string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", &ErrQuarantined{fmt.Sprintf("%s is written through a symlink", name)}
+		}
+	}
+	return path, nil
+}
+
+func writeArchiveFile(path string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeSymlink creates the given symlink. Symlinks are screened once all the
+// sources are unpacked.
+func writeSymlink(path, target string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
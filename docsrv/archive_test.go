@@ -0,0 +1,439 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testTarball returns a tarball with a single folder containing a file and a
+// symlink to it.
+func testTarball(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("hello")
+	for _, hdr := range []*tar.Header{
+		{Name: "proj-v1.0.0/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "proj-v1.0.0/docs/index.md", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))},
+		{Name: "proj-v1.0.0/README.md", Typeflag: tar.TypeSymlink, Linkname: "docs/index.md"},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(content)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	_, err := zw.Create("proj-v1.0.0/")
+	require.NoError(t, err)
+
+	w, err := zw.Create("proj-v1.0.0/docs/index.md")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	hdr := &zip.FileHeader{Name: "proj-v1.0.0/README.md"}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, err = zw.CreateHeader(hdr)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("docs/index.md"))
+	require.NoError(t, err)
+
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// compressWith compresses the given data with the given command, skipping
+// the test if it's not installed.
+func compressWith(t *testing.T, command string, data []byte) []byte {
+	if _, err := exec.LookPath(command); err != nil {
+		t.Skipf("%s is not installed", command)
+	}
+
+	cmd := exec.Command(command, "--compress", "--stdout")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return out
+}
+
+func writeTempFile(t *testing.T, data []byte) (string, func()) {
+	f, err := ioutil.TempFile("", "docsrv-archive-")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+func TestUnpack(t *testing.T) {
+	cases := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+	}{
+		{"gzip", func(t *testing.T) []byte { return gzipData(t, testTarball(t)) }},
+		{"zip", testZip},
+		{"bzip2", func(t *testing.T) []byte { return compressWith(t, "bzip2", testTarball(t)) }},
+		{"xz", func(t *testing.T) []byte { return compressWith(t, "xz", testTarball(t)) }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+			file, remove := writeTempFile(t, c.archive(t))
+			defer remove()
+
+			format, err := archiveFormat(file)
+			require.NoError(err)
+			require.Equal(c.name, format)
+
+			tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+			require.NoError(err)
+			defer os.RemoveAll(tmpDir)
+
+			dir, err := unpack(file, tmpDir)
+			require.NoError(err)
+			require.Equal(filepath.Join(tmpDir, "proj-v1.0.0"), dir)
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, "README.md"))
+			require.NoError(err)
+			require.Equal("hello", string(data))
+
+			target, err := os.Readlink(filepath.Join(dir, "README.md"))
+			require.NoError(err)
+			require.Equal("docs/index.md", target)
+		})
+	}
+}
+
+func TestUnpack_Invalid(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	file, remove := writeTempFile(t, []byte("not an archive"))
+	defer remove()
+	_, err = unpack(file, tmpDir)
+	require.EqualError(err, "unsupported archive format")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}))
+	require.NoError(tw.Close())
+
+	file, remove = writeTempFile(t, gzipData(t, buf.Bytes()))
+	defer remove()
+	_, err = unpack(file, tmpDir)
+	require.IsType(&ErrQuarantined{}, err)
+
+	// files can not be written through the symlinks unpacked before them,
+	// nor replace them.
+	for name, target := range map[string]string{"l/evil": tmpDir, "l": filepath.Join(tmpDir, "evil")} {
+		buf.Reset()
+		tw = tar.NewWriter(&buf)
+		require.NoError(tw.WriteHeader(&tar.Header{Name: "l", Typeflag: tar.TypeSymlink, Linkname: target}))
+		require.NoError(tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}))
+		require.NoError(tw.Close())
+
+		dst := filepath.Join(tmpDir, "dst-"+filepath.Base(name))
+		file, remove = writeTempFile(t, gzipData(t, buf.Bytes()))
+		defer remove()
+		_, err = unpack(file, dst)
+		require.IsType(&ErrQuarantined{}, err, name)
+		_, err = os.Lstat(filepath.Join(tmpDir, "evil"))
+		require.True(os.IsNotExist(err))
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	require.NoError(tw.WriteHeader(&tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}))
+	require.NoError(tw.Close())
+
+	file, remove = writeTempFile(t, gzipData(t, buf.Bytes()))
+	defer remove()
+	_, err = unpack(file, tmpDir)
+	require.IsType(&ErrQuarantined{}, err)
+}
+
+func TestFindChecksum(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected string
+		ok       bool
+	}{
+		{"abc123\n", "abc123", true},
+		{"abc123  foo-v1.0.0.tar.gz\ndef456  foo-v1.0.0.zip\n", "def456", true},
+		{"abc123 *foo-v1.0.0.zip\n", "abc123", true},
+		{"abc123  foo-v0.9.0.zip\n", "", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		checksum, ok := findChecksum([]byte(c.data), "foo-v1.0.0.zip")
+		require.Equal(t, c.expected, checksum, c.data)
+		require.Equal(t, c.ok, ok, c.data)
+	}
+}
+
+func TestSetSource(t *testing.T) {
+	require := require.New(t)
+	r := &release{
+		tag:        "v1.0.0",
+		url:        "http://foo/tarball",
+		zipballURL: "http://foo/zipball",
+		assets: map[string]string{
+			"docs.tar.xz": "http://foo/docs.tar.xz",
+			"SHA256SUMS":  "http://foo/SHA256SUMS",
+		},
+	}
+
+	conf := buildConfig{project: "foo"}
+	conf.setSource(ProjectConfig{}, r)
+	require.Equal("http://foo/tarball", conf.tarballURL)
+	require.Equal("foo-v1.0.0.tar.gz", conf.archiveName)
+	require.Equal("", conf.checksumAsset)
+
+	conf.setSource(ProjectConfig{Archive: ZipballArchive, ChecksumAsset: "SHA256SUMS"}, r)
+	require.Equal("http://foo/zipball", conf.tarballURL)
+	require.Equal("foo-v1.0.0.zip", conf.archiveName)
+	require.Equal("http://foo/SHA256SUMS", conf.checksumURL)
+
+	conf.setSource(ProjectConfig{SourceAsset: "docs.tar.xz"}, r)
+	require.Equal("http://foo/docs.tar.xz", conf.tarballURL)
+	require.Equal("docs.tar.xz", conf.archiveName)
+	require.Equal("", conf.checksumURL)
+
+	r.assets["docs-v1.0.0.tar.gz"] = "http://foo/docs-v1.0.0.tar.gz"
+	r.assets["docs-v1.0.0.zip"] = "http://foo/docs-v1.0.0.zip"
+	conf.setSource(ProjectConfig{AssetPattern: "docs-*"}, r)
+	require.Equal("http://foo/docs-v1.0.0.tar.gz", conf.tarballURL)
+	require.Equal("docs-v1.0.0.tar.gz", conf.archiveName)
+
+	conf.setSource(ProjectConfig{AssetPattern: `/^docs-v[0-9.]+\.zip$/`}, r)
+	require.Equal("http://foo/docs-v1.0.0.zip", conf.tarballURL)
+	require.Equal("docs-v1.0.0.zip", conf.archiveName)
+
+	// releases without a matching asset are built from the GitHub archive
+	conf.setSource(ProjectConfig{AssetPattern: "site-*.tar.gz"}, r)
+	require.Equal("http://foo/tarball", conf.tarballURL)
+	require.Equal("foo-v1.0.0.tar.gz", conf.archiveName)
+
+	// branches have no assets
+	branch := &release{tag: "master", url: "http://foo/master"}
+	conf.setSource(ProjectConfig{SourceAsset: "docs.tar.xz", ChecksumAsset: "SHA256SUMS"}, branch)
+	require.Equal("http://foo/master", conf.tarballURL)
+	require.Equal("", conf.checksumAsset)
+
+	// the archives of the projects in a subfolder are the ones of their
+	// repository
+	conf = buildConfig{project: "foo@docs"}
+	conf.setSource(ProjectConfig{}, r)
+	require.Equal("foo-v1.0.0.tar.gz", conf.archiveName)
+}
+
+func TestBuildDocs_Checksum(t *testing.T) {
+	require := require.New(t)
+	rec := httptest.NewRecorder()
+	tarGzMakefileHandler(rec, testMakefile)
+	archive := rec.Body.Bytes()
+
+	sum := sha256.Sum256(archive)
+	checksums := fmt.Sprintf("%s  docs-v1.2.3.tar.gz\n", hex.EncodeToString(sum[:]))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	})
+	mux.HandleFunc("/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, checksums)
+	})
+	mux.HandleFunc("/BAD256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "0000  docs-v1.2.3.tar.gz\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	conf := buildConfig{
+		tarballURL:    server.URL + "/archive",
+		archiveName:   "docs-v1.2.3.tar.gz",
+		checksumAsset: "SHA256SUMS",
+		checksumURL:   server.URL + "/SHA256SUMS",
+		baseURL:       "http://foo.bar",
+		destination:   tmpDir,
+		sharedFolder:  testSharedFolder,
+		project:       "docsrv",
+		owner:         "src-d",
+		version:       "v1.2.3",
+	}
+	require.NoError(buildDocs(conf))
+	assertMakefileOutput(t, tmpDir, conf.baseURL, conf.project, conf.owner, conf.version)
+
+	conf.checksumURL = server.URL + "/BAD256SUMS"
+	err = buildDocs(conf)
+	require.Error(err)
+	require.Contains(err.Error(), "checksum mismatch of docs-v1.2.3.tar.gz")
+
+	conf.checksumURL = ""
+	err = buildDocs(conf)
+	require.Error(err)
+	require.Equal(ErrNotFound, Cause(err))
+}
+
+// fastRetries makes the downloads retry right away and returns a function
+// to restore the backoff.
+func fastRetries() func() {
+	backoff, maxBackoff := downloadBackoff, maxDownloadBackoff
+	downloadBackoff, maxDownloadBackoff = time.Millisecond, time.Millisecond
+	return func() {
+		downloadBackoff, maxDownloadBackoff = backoff, maxBackoff
+	}
+}
+
+func newDownloadTestDir(t *testing.T) (string, func()) {
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(t, err)
+	return filepath.Join(tmpDir, "archive"), func() { os.RemoveAll(tmpDir) }
+}
+
+func TestDownload_Retry(t *testing.T) {
+	require := require.New(t)
+	defer fastRetries()()
+
+	content := bytes.Repeat([]byte("docsrv"), 1000)
+	var requests int32
+	var rangeHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			// the connection is closed after half of the file
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:len(content)/2])
+			panic(http.ErrAbortHandler)
+		default:
+			rangeHeader = r.Header.Get("Range")
+			http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	dst, cleanup := newDownloadTestDir(t)
+	defer cleanup()
+	require.NoError(download(http.DefaultClient, server.URL, dst))
+	require.Equal(int32(3), atomic.LoadInt32(&requests))
+	require.Equal(fmt.Sprintf("bytes=%d-", len(content)/2), rangeHeader)
+
+	data, err := ioutil.ReadFile(dst)
+	require.NoError(err)
+	require.Equal(content, data)
+}
+
+func TestDownload_RangeNotSupported(t *testing.T) {
+	require := require.New(t)
+	defer fastRetries()()
+
+	content := bytes.Repeat([]byte("docsrv"), 1000)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write(content[:len(content)/2])
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dst, cleanup := newDownloadTestDir(t)
+	defer cleanup()
+	require.NoError(download(http.DefaultClient, server.URL, dst))
+
+	data, err := ioutil.ReadFile(dst)
+	require.NoError(err)
+	require.Equal(content, data)
+}
+
+func TestDownload_Errors(t *testing.T) {
+	require := require.New(t)
+	defer fastRetries()()
+
+	var requests int32
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dst, cleanup := newDownloadTestDir(t)
+	defer cleanup()
+
+	// missing archives are not retried
+	err := download(http.DefaultClient, server.URL, dst)
+	require.Equal(ErrNotFound, Cause(err))
+	require.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	status = http.StatusForbidden
+	err = download(http.DefaultClient, server.URL, dst)
+	require.Error(err)
+	require.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	status = http.StatusServiceUnavailable
+	err = download(http.DefaultClient, server.URL, dst)
+	e, ok := Cause(err).(*ErrDownloadFailed)
+	require.True(ok)
+	require.Equal(http.StatusServiceUnavailable, e.Status)
+	require.Equal(int32(downloadRetries+1), atomic.LoadInt32(&requests))
+}
+
+func TestBackoff(t *testing.T) {
+	require := require.New(t)
+	for attempt := 0; attempt < 10; attempt++ {
+		wait := downloadBackoff << uint(attempt)
+		if wait > maxDownloadBackoff {
+			wait = maxDownloadBackoff
+		}
+
+		b := backoff(attempt)
+		require.True(b >= wait/2 && b <= wait, "attempt %d: %s", attempt, b)
+	}
+}
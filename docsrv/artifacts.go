@@ -0,0 +1,204 @@
+package docsrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifactCache caches the archives downloaded to build the docs and,
+// optionally, the built docs, keyed by the commit they were built from, so
+// versions built again, e.g. after their docs were deleted or in a new
+// replica, don't need to be downloaded and built from scratch. Versions whose
+// commit is unknown are never cached. A nil cache caches nothing.
+type artifactCache struct {
+	dir string
+	// builds enables caching the built docs along with the archives.
+	builds bool
+}
+
+// newArtifactCache returns a cache in the given folder, or nil if it's empty.
+func newArtifactCache(dir string, builds bool) *artifactCache {
+	if dir == "" {
+		return nil
+	}
+	return &artifactCache{dir, builds}
+}
+
+// archivePath returns the path of the cached archive of the given build.
+func (c *artifactCache) archivePath(conf buildConfig) string {
+	return filepath.Join(c.dir, "archives", cacheKey(conf.sha, conf.archiveName))
+}
+
+// buildPath returns the path of the cached docs of the given build. Besides
+// the commit, the docs depend on the URLs they are built for, the contents of
+// the shared folder and the options that change their content.
+func (c *artifactCache) buildPath(conf buildConfig) string {
+	return filepath.Join(c.dir, "builds", cacheKey(
+		conf.owner, conf.project, conf.version, conf.sha, conf.archiveName,
+		conf.baseURL, conf.hostName, conf.canonicalBaseURL, conf.deprecationBanner,
+		conf.sharedFingerprint.hash,
+		fmt.Sprint(conf.assetHashes), fmt.Sprint(conf.noIndex), fmt.Sprint(conf.precompress),
+		strings.Join(conf.offlineBundles, ","), strings.Join(conf.env, "\n"),
+	))
+}
+
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		// the separator avoids collisions between different splits of the
+		// same string.
+		fmt.Fprintf(h, "%s\x00", p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getArchive copies the cached archive of the given build, if any, to the
+// given file. Reports whether it was cached.
+func (c *artifactCache) getArchive(conf buildConfig, dst string) bool {
+	if c == nil || conf.sha == "" {
+		return false
+	}
+
+	path := c.archivePath(conf)
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+
+	if err := copyFile(path, dst, 0644); err != nil {
+		conf.log().Warnf("could not use cached archive: %s", err)
+		return false
+	}
+	return true
+}
+
+// putArchive caches the given archive of the given build.
+func (c *artifactCache) putArchive(conf buildConfig, file string) {
+	if c == nil || conf.sha == "" {
+		return
+	}
+
+	if err := c.put(file, c.archivePath(conf), copyFile); err != nil {
+		conf.log().Warnf("could not cache archive: %s", err)
+	}
+}
+
+// getBuild copies the cached docs of the given build, if any, to its
+// destination. Reports whether they were cached.
+func (c *artifactCache) getBuild(conf buildConfig) bool {
+	if c == nil || !c.builds || conf.sha == "" {
+		return false
+	}
+
+	path := c.buildPath(conf)
+	if !isDir(path) {
+		return false
+	}
+
+	if err := copyTree(path, conf.destination); err != nil {
+		conf.log().Warnf("could not use cached docs: %s", err)
+		return false
+	}
+	return true
+}
+
+// putBuild caches the docs of the given build, once built in its
+// destination.
+func (c *artifactCache) putBuild(conf buildConfig) {
+	if c == nil || !c.builds || conf.sha == "" {
+		return
+	}
+
+	copyDir := func(src, dst string, _ os.FileMode) error {
+		return copyTree(src, dst)
+	}
+	if err := c.put(conf.destination, c.buildPath(conf), copyDir); err != nil {
+		conf.log().Warnf("could not cache docs: %s", err)
+	}
+}
+
+// put copies the given file or folder to the given path of the cache with
+// the given function. It's copied to a temporary path first and then
+// renamed, so other builds never see it half written.
+func (c *artifactCache) put(src, dst string, copy func(src, dst string, mode os.FileMode) error) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, filepath.Base(dst))
+	if err := copy(src, path, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, dst); err != nil {
+		// another build may have cached it in the meantime.
+		if _, statErr := os.Stat(dst); statErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// copyTree copies the given folder to the given path, keeping the symlinks.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, fi.Mode())
+		}
+	})
+}
+
+// copyFile copies the given file to the given path with the given mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,124 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newArtifactsTestConfig(t *testing.T, url string, cache *artifactCache) (buildConfig, func()) {
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(t, err)
+
+	return buildConfig{
+		tarballURL:   url,
+		archiveName:  "docs-v1.0.0.tar.gz",
+		sha:          "1234",
+		baseURL:      "http://foo.bar/v1.0.0/",
+		destination:  tmpDir,
+		sharedFolder: testSharedFolder,
+		project:      "docs",
+		owner:        "src-d",
+		version:      "v1.0.0",
+		cache:        cache,
+	}, func() { os.RemoveAll(tmpDir) }
+}
+
+func TestBuildDocs_ArchiveCache(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	cacheDir, err := ioutil.TempDir("", "docsrv-cache-")
+	require.NoError(err)
+	defer os.RemoveAll(cacheDir)
+	cache := newArtifactCache(cacheDir, false)
+
+	conf, cleanup := newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	require.NoError(buildDocs(conf))
+	require.Equal(int32(1), *downloads)
+
+	conf, cleanup = newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	require.NoError(buildDocs(conf))
+	require.Equal(int32(1), *downloads)
+	assertMakefileOutput(t, conf.destination, conf.baseURL, conf.project, conf.owner, conf.version)
+
+	// builds are not cached, so the docs are built with the new base URL
+	conf, cleanup = newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	conf.baseURL = "http://foo2.bar/v1.0.0/"
+	require.NoError(buildDocs(conf))
+	require.Equal(int32(1), *downloads)
+	assertMakefileOutput(t, conf.destination, conf.baseURL, conf.project, conf.owner, conf.version)
+
+	// versions with an unknown commit are not cached
+	conf, cleanup = newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	conf.sha = ""
+	require.NoError(buildDocs(conf))
+	require.NoError(buildDocs(conf))
+	require.Equal(int32(3), *downloads)
+}
+
+func TestBuildDocs_BuildCache(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	cacheDir, err := ioutil.TempDir("", "docsrv-cache-")
+	require.NoError(err)
+	defer os.RemoveAll(cacheDir)
+	cache := newArtifactCache(cacheDir, true)
+
+	conf, cleanup := newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	require.NoError(buildDocs(conf))
+	require.NoError(os.Symlink("out", filepath.Join(conf.destination, "link")))
+
+	// the cached docs are the ones built, not the ones changed later
+	conf, cleanup = newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	require.NoError(buildDocs(conf))
+	assertMakefileOutput(t, conf.destination, conf.baseURL, conf.project, conf.owner, conf.version)
+	require.Equal(int32(1), *downloads)
+	_, err = os.Lstat(filepath.Join(conf.destination, "link"))
+	require.True(os.IsNotExist(err))
+
+	// docs for another URL are built again from the cached archive
+	conf, cleanup = newArtifactsTestConfig(t, url, cache)
+	defer cleanup()
+	conf.baseURL = "http://foo2.bar/v1.0.0/"
+	require.NoError(buildDocs(conf))
+	assertMakefileOutput(t, conf.destination, conf.baseURL, conf.project, conf.owner, conf.version)
+	require.Equal(int32(1), *downloads)
+}
+
+func TestCopyTree(t *testing.T) {
+	require := require.New(t)
+	src, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(src)
+
+	require.NoError(os.MkdirAll(filepath.Join(src, "a", "b"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(src, "a", "b", "c.html"), []byte("c"), 0644))
+	require.NoError(os.Symlink("b/c.html", filepath.Join(src, "a", "d.html")))
+
+	dst, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(dst)
+
+	require.NoError(copyTree(src, filepath.Join(dst, "copy")))
+
+	data, err := ioutil.ReadFile(filepath.Join(dst, "copy", "a", "b", "c.html"))
+	require.NoError(err)
+	require.Equal("c", string(data))
+
+	link, err := os.Readlink(filepath.Join(dst, "copy", "a", "d.html"))
+	require.NoError(err)
+	require.Equal("b/c.html", link)
+}
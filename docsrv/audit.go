@@ -0,0 +1,187 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// auditActorToken is the actor of the audited requests made with the
+	// refresh token.
+	auditActorToken = "refresh-token"
+	// auditActorInvalidToken is the actor of the audited requests made with
+	// a token that is not the refresh token.
+	auditActorInvalidToken = "invalid-token"
+	// auditActorDocsrv is the actor of the actions docsrv takes on its own,
+	// such as the evictions of the docs of the deleted releases.
+	auditActorDocsrv = "docsrv"
+)
+
+// auditEntry is an entry of the audit log, written as a JSON object per line.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Action is the administrative action requested, e.g. "rebuild",
+	// "bulk/purge-prereleases" or "refresh".
+	Action string `json:"action"`
+	// Actor is the credential used, either "refresh-token" or
+	// "invalid-token", or "docsrv" for the actions it takes on its own,
+	// which have no request.
+	Actor string `json:"actor"`
+	IP    string `json:"ip,omitempty"`
+	// ForwardedFor is the X-Forwarded-For header of the request, if any.
+	// It's set by the client or the proxies, so it can't be trusted.
+	ForwardedFor string `json:"forwarded-for,omitempty"`
+	UserAgent    string `json:"user-agent,omitempty"`
+	Method       string `json:"method,omitempty"`
+	Host         string `json:"host,omitempty"`
+	// Path is the path of the request, without the query string, which
+	// contains the token.
+	Path      string `json:"path,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	RequestID string `json:"request-id,omitempty"`
+	// Repository and Version are the project and version affected by the
+	// actions docsrv takes on its own.
+	Repository string `json:"repository,omitempty"`
+	Version    string `json:"version,omitempty"`
+	// Reason is why docsrv took the action on its own.
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditLog appends the administrative actions and the uses of the refresh
+// token to a file, so it can be known who did what once several teams share
+// an instance. A nil log records nothing.
+type auditLog struct {
+	mut  sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens the audit log in the given file, which is created if it
+// does not exist, or returns nil if the path is empty.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, wrap(err, "could not open audit log %s", path)
+	}
+	return &auditLog{file: f}, nil
+}
+
+// record appends the given entry to the log.
+func (l *auditLog) record(e auditEntry) {
+	if l == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("could not encode audit log entry: %s", err)
+		return
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		logrus.WithField("alert", true).Errorf("could not write audit log entry: %s", err)
+	}
+}
+
+// auditRequest records the given request, once served, in the audit log if
+// it carries a token, whether it's the refresh token or not.
+func (s *Service) auditRequest(w *statusRecorder, r *http.Request) {
+	if s.audit == nil || r.URL.Query().Get("token") == "" {
+		return
+	}
+
+	actor := auditActorInvalidToken
+	if s.isAdmin(r) {
+		actor = auditActorToken
+	}
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	s.audit.record(auditEntry{
+		Time:         time.Now().UTC(),
+		Action:       auditAction(r.URL.Path),
+		Actor:        actor,
+		IP:           ip,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+		Method:       r.Method,
+		Host:         r.Host,
+		Path:         r.URL.Path,
+		Status:       status,
+		RequestID:    requestID(r),
+	})
+}
+
+// auditEvent records in the audit log the given action taken by docsrv on
+// its own on the given version, or the whole project if it's empty, for the
+// given reason, such as the evictions of docs and the refused builds.
+func (s *Service) auditEvent(action, owner, project, version, reason string) {
+	if s.audit == nil {
+		return
+	}
+
+	s.audit.record(auditEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Actor:      auditActorDocsrv,
+		Repository: repositoryKey(owner, project),
+		Version:    version,
+		Reason:     reason,
+	})
+}
+
+// auditAction returns the name of the action requested with the given path.
+// The requests to the docs made with the refresh token, which refresh the
+// releases of the project, are "refresh".
+func auditAction(path string) string {
+	switch {
+	case strings.HasPrefix(path, rebuildPrefix):
+		return "rebuild"
+	case strings.HasPrefix(path, mirrorPrefix):
+		return "mirror"
+	case strings.HasPrefix(path, bulkPath):
+		return "bulk/" + strings.TrimPrefix(path, bulkPath)
+	}
+
+	switch path {
+	case "/api/export":
+		return "export"
+	case statsPath:
+		return "stats"
+	case statePath:
+		return "state"
+	case quarantinePath:
+		return "quarantine"
+	case minVersionPath:
+		return "min-version"
+	case maintenancePath:
+		return "maintenance"
+	case validateConfigPath:
+		return "validate-config"
+	case buildReportPath:
+		return "build-report"
+	case buildRefPath:
+		return "build"
+	}
+	return "refresh"
+}
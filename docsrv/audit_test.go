@@ -0,0 +1,139 @@
+package docsrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, scanner.Err())
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "audit.log")
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	srv := New(Options{
+		Config:       Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}},
+		RefreshToken: "admin",
+		AuditLog:     path,
+	})
+	srv.fetcher = fetcher
+
+	requests := []struct {
+		method, url string
+	}{
+		{"GET", "http://foo.bar/versions.json?token=admin"},
+		{"GET", "http://foo.bar/versions.json"},
+		{"POST", "http://foo.bar/api/bulk/purge-prereleases?token=admin"},
+		{"POST", "http://foo.bar/api/rebuild/v1.0.0?token=guess"},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(req.method, req.url, nil)
+		r.Header.Set("X-Forwarded-For", "10.0.0.1")
+		srv.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	entries := readAuditLog(t, path)
+	require.Len(entries, 3)
+
+	require.Equal("refresh", entries[0].Action)
+	require.Equal(auditActorToken, entries[0].Actor)
+	require.Equal("192.0.2.1", entries[0].IP)
+	require.Equal("10.0.0.1", entries[0].ForwardedFor)
+	require.Equal("foo.bar", entries[0].Host)
+	require.Equal("/versions.json", entries[0].Path)
+	require.Equal(http.StatusOK, entries[0].Status)
+	require.NotEmpty(entries[0].RequestID)
+	require.False(entries[0].Time.IsZero())
+
+	require.Equal("bulk/purge-prereleases", entries[1].Action)
+	require.Equal("POST", entries[1].Method)
+
+	require.Equal("rebuild", entries[2].Action)
+	require.Equal(auditActorInvalidToken, entries[2].Actor)
+	require.Equal(http.StatusForbidden, entries[2].Status)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.NotContains(string(data), "admin")
+	require.NotContains(string(data), "guess")
+}
+
+func TestAuditEvent(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "audit.log")
+	srv := New(Options{
+		Config: Config{"foo.bar": ProjectConfig{
+			Repository:      "bar/foo",
+			DeletedReleases: EvictDeletedReleases,
+			Quota:           &QuotaConfig{BuildsPerHour: 1},
+		}},
+		BaseFolder: tmpDir,
+		AuditLog:   path,
+	})
+	srv.fetcher = newMockFetcher()
+
+	require.NoError(os.MkdirAll(srv.versionFolder("bar", "foo", "v1.0.0"), 0755))
+	srv.cleanDeletedReleases("bar", "foo", []string{"v1.0.0"})
+	require.False(isDir(srv.versionFolder("bar", "foo", "v1.0.0")))
+
+	require.NoError(srv.scheduler.admit("bar"))
+	err = srv.rebuild(buildConfig{owner: "bar", project: "foo", version: "v2.0.0"})
+	require.Equal(ErrQuotaExceeded, Cause(err))
+
+	entries := readAuditLog(t, path)
+	require.Len(entries, 2)
+
+	require.Equal("evict", entries[0].Action)
+	require.Equal(auditActorDocsrv, entries[0].Actor)
+	require.Equal("bar/foo", entries[0].Repository)
+	require.Equal("v1.0.0", entries[0].Version)
+	require.Equal("release deleted upstream", entries[0].Reason)
+	require.Empty(entries[0].Path)
+
+	require.Equal("refuse-build", entries[1].Action)
+	require.Equal("v2.0.0", entries[1].Version)
+	require.Contains(entries[1].Reason, "builds per hour")
+}
+
+func TestAuditAction(t *testing.T) {
+	require := require.New(t)
+	require.Equal("rebuild", auditAction("/api/rebuild/v1.0.0"))
+	require.Equal("bulk/rebuild", auditAction("/api/bulk/rebuild"))
+	require.Equal("quarantine", auditAction(quarantinePath))
+	require.Equal("refresh", auditAction("/v1.0.0/"))
+}
+
+func TestOptionsValidate_AuditLog(t *testing.T) {
+	require.Error(t, Options{AuditLog: "/missing/folder/audit.log"}.Validate())
+}
@@ -0,0 +1,365 @@
+package docsrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// authCallbackPath is the path the providers redirect to once the user
+	// has been authenticated.
+	authCallbackPath = "/_auth/callback"
+	// sessionCookie is the cookie that holds the session of the user.
+	sessionCookie = "docsrv_session"
+	// nonceCookie is the cookie that binds the authentication flow to the
+	// browser that started it.
+	nonceCookie = "docsrv_auth_nonce"
+	// sessionDuration is the time a session is valid for.
+	sessionDuration = 24 * time.Hour
+	// authFlowDuration is the time an user has to complete the
+	// authentication with the provider.
+	authFlowDuration = 10 * time.Minute
+
+	defaultGitHubAuthURL  = "https://github.com/login/oauth/authorize"
+	defaultGitHubTokenURL = "https://github.com/login/oauth/access_token"
+)
+
+// newSessionSecret generates a random secret to sign the sessions with.
+func newSessionSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("unable to generate session secret: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// sign returns the given values signed with the session secret. Values must
+// not contain line breaks.
+func (s *Service) sign(values ...string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join(values, "\n")))
+	return payload + "." + s.signature(payload)
+}
+
+// verify returns the values of the given signed value, if the signature is
+// valid.
+func (s *Service) verify(signed string) ([]string, bool) {
+	parts := strings.SplitN(signed, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	expected := s.signature(parts[0])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(parts[1])) != 1 {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	return strings.Split(string(payload), "\n"), true
+}
+
+func (s *Service) signature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(s.opts.SessionSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// notExpired reports whether the given unix timestamp is in the future.
+func notExpired(expiry string) bool {
+	n, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() < n
+}
+
+// authConfigForHost returns the authentication configuration of the project
+// at the given host, if the project requires authentication.
+func (s *Service) authConfigForHost(host string) (*AuthConfig, bool) {
+	owner, project, ok := s.projectForHost(host)
+	if !ok {
+		return nil, false
+	}
+
+	conf, ok := s.config().ForProject(owner, project)
+	if !ok || conf.Auth == nil {
+		return nil, false
+	}
+	return conf.Auth, true
+}
+
+// authorize checks that the user is allowed to access the docs of the host of
+// the request. If they are not authenticated, they will be redirected to the
+// provider to log in. Will report whether or not the request can be served.
+func (s *Service) authorize(w http.ResponseWriter, r *http.Request) bool {
+	conf, ok := s.authConfigForHost(r.Host)
+	if !ok || s.isAdmin(r) {
+		return true
+	}
+
+	if s.hasSession(r) {
+		return true
+	}
+
+	nonce := newSessionSecret()
+	http.SetCookie(w, &http.Cookie{
+		Name:     nonceCookie,
+		Value:    nonce,
+		Path:     localURL(r, authCallbackPath),
+		Expires:  time.Now().Add(authFlowDuration),
+		HttpOnly: true,
+		Secure:   reqScheme(r) == "https",
+	})
+
+	expiry := strconv.FormatInt(time.Now().Add(authFlowDuration).Unix(), 10)
+	state := s.sign(nonce, r.URL.RequestURI(), expiry)
+	var opts []oauth2.AuthCodeOption
+	if conf.Provider == OIDCAuth {
+		// the ID token must carry the nonce, so it can't be replayed.
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+	url := conf.oauth2Config(authCallbackURL(r)).AuthCodeURL(state, opts...)
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	return false
+}
+
+// hasSession reports whether the request carries a valid session for its
+// host.
+func (s *Service) hasSession(r *http.Request) bool {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+
+	values, ok := s.verify(c.Value)
+	return ok && len(values) == 3 && values[0] == stripPort(r.Host) && notExpired(values[2])
+}
+
+// authCallback is an HTTP handler that completes the authentication of the
+// user once the provider redirects them back to docsrv, starting a session
+// if they are allowed to access the docs of the host.
+func (s *Service) authCallback(w http.ResponseWriter, r *http.Request) {
+	conf, ok := s.authConfigForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := requestLog(r).WithField("host", r.Host)
+	query := r.URL.Query()
+	values, ok := s.verify(query.Get("state"))
+	if !ok || len(values) != 3 || !notExpired(values[2]) {
+		httpError(w, r, "invalid or expired authentication state", http.StatusBadRequest)
+		return
+	}
+
+	nonce, err := r.Cookie(nonceCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(nonce.Value), []byte(values[0])) != 1 {
+		httpError(w, r, "invalid authentication state", http.StatusBadRequest)
+		return
+	}
+
+	// the provider is reached through the proxy and with the CA bundle of
+	// the rest of requests of docsrv.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, s.httpClient)
+	oauthConf := conf.oauth2Config(authCallbackURL(r))
+	token, err := oauthConf.Exchange(ctx, query.Get("code"))
+	if err != nil {
+		log.Errorf("error exchanging authentication code: %s", err)
+		httpError(w, r, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	user, err := conf.authorizedUser(ctx, token, oauthConf.Client(ctx, token), nonce.Value)
+	if err != nil && Cause(err) == errInvalidIDToken {
+		log.Warnf("rejected user: %s", err)
+		httpError(w, r, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Errorf("error checking user: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	if user == "" {
+		log.Debug("user is not allowed to access the docs")
+		httpError(w, r, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	log.WithField("user", user).Debug("user authenticated")
+	expiry := time.Now().Add(sessionDuration)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.sign(stripPort(r.Host), user, strconv.FormatInt(expiry.Unix(), 10)),
+		Path:     localURL(r, "/"),
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   reqScheme(r) == "https",
+	})
+
+	redirect := values[1]
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	http.Redirect(w, r, localURL(r, redirect), http.StatusTemporaryRedirect)
+}
+
+// authCallbackURL returns the URL of the authentication callback in the host
+// of the request.
+func authCallbackURL(r *http.Request) string {
+	return fmt.Sprintf("%s://%s%s", reqScheme(r), r.Host, authCallbackPath)
+}
+
+// oauth2Config returns the OAuth2 configuration of the provider.
+func (c *AuthConfig) oauth2Config(redirectURL string) *oauth2.Config {
+	conf := &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  c.AuthURL,
+			TokenURL: c.TokenURL,
+		},
+	}
+
+	switch c.Provider {
+	case OIDCAuth:
+		conf.Scopes = []string{"openid", "email"}
+	default:
+		if conf.Endpoint.AuthURL == "" {
+			conf.Endpoint.AuthURL = defaultGitHubAuthURL
+		}
+		if conf.Endpoint.TokenURL == "" {
+			conf.Endpoint.TokenURL = defaultGitHubTokenURL
+		}
+		if c.Organization != "" {
+			conf.Scopes = []string{"read:org"}
+		}
+	}
+
+	return conf
+}
+
+// authorizedUser returns the name of the user authenticated with the given
+// token and the given client using it, or an empty string if they are not
+// allowed to access the docs. The ID tokens of OIDC must carry the given
+// nonce of the authentication flow.
+func (c *AuthConfig) authorizedUser(ctx context.Context, token *oauth2.Token, client *http.Client, nonce string) (string, error) {
+	if c.Provider == OIDCAuth {
+		return c.authorizedOIDCUser(ctx, token, client, nonce)
+	}
+	return c.authorizedGitHubUser(ctx, client)
+}
+
+func (c *AuthConfig) authorizedGitHubUser(ctx context.Context, client *http.Client) (string, error) {
+	gh := github.NewClient(client)
+	if c.APIURL != "" {
+		u, err := url.Parse(ensureEndingSlash(c.APIURL))
+		if err != nil {
+			return "", wrap(err, "invalid GitHub API URL")
+		}
+		gh.BaseURL = u
+	}
+
+	user, _, err := gh.Users.Get(ctx, "")
+	if err != nil {
+		return "", wrap(githubError(err), "error getting GitHub user")
+	}
+
+	if c.Organization == "" {
+		return user.GetLogin(), nil
+	}
+
+	membership, _, err := gh.Organizations.GetOrgMembership(ctx, "", c.Organization)
+	if err != nil {
+		if Cause(githubError(err)) == ErrNotFound {
+			return "", nil
+		}
+		return "", wrap(githubError(err), "error getting membership of organization %s", c.Organization)
+	}
+
+	if membership.GetState() != "active" {
+		return "", nil
+	}
+	return user.GetLogin(), nil
+}
+
+type oidcUserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// authorizedOIDCUser returns the user of the verified ID token of the given
+// token, with the claims of the userinfo endpoint, if any, which must be of
+// the same subject.
+func (c *AuthConfig) authorizedOIDCUser(ctx context.Context, token *oauth2.Token, client *http.Client, nonce string) (string, error) {
+	claims, err := c.verifiedIDToken(ctx, token, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	info := oidcUserInfo{claims.Subject, claims.Email, claims.EmailVerified}
+	if c.UserInfoURL != "" {
+		if info, err = c.fetchUserInfo(client); err != nil {
+			return "", err
+		}
+
+		if info.Subject != claims.Subject {
+			return "", wrap(errInvalidIDToken, "the user info is of subject %q instead of %q", info.Subject, claims.Subject)
+		}
+	}
+
+	if len(c.EmailDomains) == 0 {
+		if info.Email != "" {
+			return info.Email, nil
+		}
+		return info.Subject, nil
+	}
+
+	if !info.EmailVerified {
+		return "", nil
+	}
+
+	for _, d := range c.EmailDomains {
+		if strings.HasSuffix(strings.ToLower(info.Email), "@"+strings.ToLower(d)) {
+			return info.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// fetchUserInfo returns the claims of the userinfo endpoint of the provider
+// about the user authenticated with the given client.
+func (c *AuthConfig) fetchUserInfo(client *http.Client) (oidcUserInfo, error) {
+	var info oidcUserInfo
+	resp, err := client.Get(c.UserInfoURL)
+	if err != nil {
+		return info, wrap(err, "error getting user info")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("error getting user info: unexpected status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, wrap(err, "error decoding user info")
+	}
+	return info, nil
+}
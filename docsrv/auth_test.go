@@ -0,0 +1,315 @@
+package docsrv
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testIssuer   = "https://issuer.test"
+	testClientID = "docsrv"
+)
+
+var (
+	testProviderKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testForgedKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+)
+
+// signIDToken returns an ID token with the given claims signed with RS256 by
+// the given key.
+func signIDToken(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testIDToken returns the ID token issued by the test provider for the given
+// code, which is the kind of user followed by the nonce of the login, if any.
+func testIDToken(code string) string {
+	parts := strings.SplitN(code, "~", 2)
+	kind, nonce := parts[0], ""
+	if len(parts) == 2 {
+		nonce = parts[1]
+	}
+
+	email := "foo@example.com"
+	if kind == "outsider" {
+		email = "foo@other.com"
+	}
+
+	key := testProviderKey
+	claims := map[string]interface{}{
+		"iss":            testIssuer,
+		"sub":            "1",
+		"aud":            []string{testClientID},
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          email,
+		"email_verified": true,
+	}
+
+	switch kind {
+	case "forged":
+		key = testForgedKey
+	case "expired":
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	case "foreign":
+		claims["aud"] = "other"
+	case "impostor":
+		claims["iss"] = "https://impostor.test"
+	case "replayed":
+		claims["nonce"] = "other"
+	}
+	return signIDToken(key, claims)
+}
+
+func authProviderServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.FormValue("code")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"bearer","id_token":%q}`,
+			strings.SplitN(code, "~", 2)[0], testIDToken(code))
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub := testProviderKey.PublicKey
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"test","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()))
+	})
+	mux.HandleFunc("/api/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"login":"foo"}`)
+	})
+	mux.HandleFunc("/api/user/memberships/orgs/src-d", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer member" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"state":"active"}`)
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		email := "foo@example.com"
+		if r.Header.Get("Authorization") != "Bearer member" {
+			email = "foo@other.com"
+		}
+		fmt.Fprintf(w, `{"sub":"1","email":%q,"email_verified":true}`, email)
+	})
+	return httptest.NewServer(mux)
+}
+
+// login starts the authentication flow for the given URL and completes it
+// with the given code, returning the response of the callback.
+func login(t *testing.T, s *Service, requestURL, code string) *httptest.ResponseRecorder {
+	require := require.New(t)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", requestURL, nil)
+	require.NoError(err)
+	s.ServeHTTP(w, req)
+	require.Equal(http.StatusTemporaryRedirect, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(err)
+	require.Equal("/authorize", location.Path)
+	require.Equal("http://foo.bar/_auth/callback", location.Query().Get("redirect_uri"))
+
+	// the test provider puts the nonce of the login in its ID token
+	if nonce := location.Query().Get("nonce"); nonce != "" {
+		code += "~" + nonce
+	}
+
+	callback := fmt.Sprintf(
+		"http://foo.bar/_auth/callback?code=%s&state=%s",
+		url.QueryEscape(code), url.QueryEscape(location.Query().Get("state")),
+	)
+	req, err = http.NewRequest("GET", callback, nil)
+	require.NoError(err)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func newAuthTestSrv(provider *httptest.Server, auth AuthConfig) *Service {
+	auth.AuthURL = provider.URL + "/authorize"
+	auth.TokenURL = provider.URL + "/token"
+	fetcher := newMockFetcher()
+	fetcher.add("src-d", "foo", "v1.0.0", "")
+	return newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "src-d/foo", Auth: &auth},
+	})
+}
+
+func TestAuth_GitHub(t *testing.T) {
+	require := require.New(t)
+	provider := authProviderServer()
+	defer provider.Close()
+
+	s := newAuthTestSrv(provider, AuthConfig{
+		Provider:     GitHubAuth,
+		Organization: "src-d",
+		APIURL:       provider.URL + "/api",
+	})
+
+	w := login(t, s, "http://foo.bar/versions.json", "outsider")
+	require.Equal(http.StatusForbidden, w.Code)
+
+	w = login(t, s, "http://foo.bar/versions.json", "member")
+	require.Equal(http.StatusTemporaryRedirect, w.Code)
+	require.Equal("/versions.json", w.Header().Get("Location"))
+
+	cookies := w.Result().Cookies()
+	require.Len(cookies, 1)
+	require.Equal(sessionCookie, cookies[0].Name)
+
+	req, err := http.NewRequest("GET", "http://foo.bar/versions.json", nil)
+	require.NoError(err)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+
+	// the session is not valid for other hosts
+	s.opts.Config["baz.bar"] = s.opts.Config["foo.bar"]
+	req, err = http.NewRequest("GET", "http://baz.bar/versions.json", nil)
+	require.NoError(err)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	require.Equal(http.StatusTemporaryRedirect, w.Code)
+}
+
+func TestAuth_OIDC(t *testing.T) {
+	require := require.New(t)
+	provider := authProviderServer()
+	defer provider.Close()
+
+	for _, userInfoURL := range []string{provider.URL + "/userinfo", ""} {
+		s := newAuthTestSrv(provider, AuthConfig{
+			Provider:     OIDCAuth,
+			ClientID:     testClientID,
+			Issuer:       testIssuer,
+			JWKSURL:      provider.URL + "/jwks",
+			UserInfoURL:  userInfoURL,
+			EmailDomains: []string{"example.com"},
+		})
+
+		w := login(t, s, "http://foo.bar/v1.0.0/", "outsider")
+		require.Equal(http.StatusForbidden, w.Code, userInfoURL)
+
+		w = login(t, s, "http://foo.bar/v1.0.0/", "member")
+		require.Equal(http.StatusTemporaryRedirect, w.Code, userInfoURL)
+		require.Equal("/v1.0.0/", w.Header().Get("Location"))
+
+		// ID tokens that can not be trusted are rejected
+		for _, code := range []string{"forged", "expired", "foreign", "impostor", "replayed"} {
+			w = login(t, s, "http://foo.bar/v1.0.0/", code)
+			require.Equal(http.StatusForbidden, w.Code, code)
+			require.Empty(w.Result().Cookies(), code)
+		}
+	}
+}
+
+func TestAuth_OIDCClient(t *testing.T) {
+	require := require.New(t)
+	provider := authProviderServer()
+	defer provider.Close()
+
+	s := newAuthTestSrv(provider, AuthConfig{
+		Provider:     OIDCAuth,
+		ClientID:     testClientID,
+		Issuer:       testIssuer,
+		JWKSURL:      provider.URL + "/jwks",
+		EmailDomains: []string{"example.com"},
+	})
+
+	// the provider is reached with the client of the service
+	var mut sync.Mutex
+	var paths []string
+	s.httpClient = &http.Client{Transport: &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			mut.Lock()
+			defer mut.Unlock()
+			paths = append(paths, r.URL.Path)
+			return nil, nil
+		},
+	}}
+
+	w := login(t, s, "http://foo.bar/v1.0.0/", "member")
+	require.Equal(http.StatusTemporaryRedirect, w.Code)
+	require.Equal([]string{"/token", "/jwks"}, paths)
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	require := require.New(t)
+	require.Empty((&AuthConfig{}).validate())
+	require.Empty((&AuthConfig{Provider: GitHubAuth}).validate())
+	require.Len((&AuthConfig{Provider: "gitlab"}).validate(), 1)
+	require.Len((&AuthConfig{Provider: OIDCAuth}).validate(), 5)
+	require.Empty((&AuthConfig{
+		Provider: OIDCAuth,
+		ClientID: testClientID,
+		AuthURL:  "https://issuer.test/authorize",
+		TokenURL: "https://issuer.test/token",
+		Issuer:   testIssuer,
+		JWKSURL:  "https://issuer.test/jwks",
+	}).validate())
+}
+
+func TestAuthCallback_InvalidState(t *testing.T) {
+	require := require.New(t)
+	provider := authProviderServer()
+	defer provider.Close()
+
+	s := newAuthTestSrv(provider, AuthConfig{Provider: GitHubAuth})
+
+	state := s.sign("nonce", "/", "0")
+	req, err := http.NewRequest("GET", "http://foo.bar/_auth/callback?code=member&state="+url.QueryEscape(state), nil)
+	require.NoError(err)
+	req.AddCookie(&http.Cookie{Name: nonceCookie, Value: "nonce"})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	require.Equal(http.StatusBadRequest, w.Code)
+
+	req, err = http.NewRequest("GET", "http://foo.bar/_auth/callback?code=member&state=foo.bar", nil)
+	require.NoError(err)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	require.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAuth_Public(t *testing.T) {
+	fetcher := newMockFetcher()
+	fetcher.add("src-d", "foo", "v1.0.0", "")
+	s := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "src-d/foo"},
+	})
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar/versions.json", nil)
+	require.NoError(t, err)
+	s.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+}
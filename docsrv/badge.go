@@ -0,0 +1,170 @@
+package docsrv
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const (
+	// badgePrefix is the prefix of the paths of the badges of the versions,
+	// /badge/${VERSION}.svg.
+	badgePrefix = "/badge/"
+	// badgeSuffix is the suffix of the paths of the badges of the versions.
+	badgeSuffix = ".svg"
+	// badgeLabel is the text of the left side of the badges.
+	badgeLabel = "docs"
+)
+
+// Colors of the badges, the same ones shields.io uses.
+const (
+	badgeLabelColor  = "#555"
+	badgeBuiltColor  = "#4c1"
+	badgeFailedColor = "#e05d44"
+	badgeMissedColor = "#9f9f9f"
+)
+
+// badge is an SVG badge in the style of shields.io, with a label on the left
+// and a message on the right.
+type badge struct {
+	Label   string
+	Message string
+	Color   string
+}
+
+// newBadge returns the badge of the version with the given status: green if
+// it's built, red if its last build failed and grey if it's not built yet.
+func newBadge(status *versionStatusInfo) badge {
+	switch {
+	case status.LastFailure != nil:
+		return badge{badgeLabel, status.Version + " failed", badgeFailedColor}
+	case status.Installed:
+		return badge{badgeLabel, status.Version, badgeBuiltColor}
+	default:
+		return badge{badgeLabel, status.Version + " not built", badgeMissedColor}
+	}
+}
+
+// LabelWidth is the width in pixels of the label side of the badge.
+func (b badge) LabelWidth() int {
+	return textWidth(b.Label) + 10
+}
+
+// MessageWidth is the width in pixels of the message side of the badge.
+func (b badge) MessageWidth() int {
+	return textWidth(b.Message) + 10
+}
+
+// Width is the width in pixels of the whole badge.
+func (b badge) Width() int {
+	return b.LabelWidth() + b.MessageWidth()
+}
+
+// LabelX is the horizontal center of the label.
+func (b badge) LabelX() int {
+	return b.LabelWidth() / 2
+}
+
+// MessageX is the horizontal center of the message.
+func (b badge) MessageX() int {
+	return b.LabelWidth() + b.MessageWidth()/2
+}
+
+// textWidth returns the approximate width in pixels of the given text written
+// in 11px Verdana, the font of the badges, which is enough to fit it without
+// measuring it.
+func textWidth(text string) int {
+	var width int
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune("fijlrtI.,:;!|' ", r):
+			width += 4
+		case strings.ContainsRune("mwMW", r):
+			width += 11
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+var badgeTemplate = template.Must(template.New("badge").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{.Label}}: {{.Message}}">
+<title>{{.Label}}: {{.Message}}</title>
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{{.Width}}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="{{.LabelWidth}}" height="20" fill="` + badgeLabelColor + `"/>
+<rect x="{{.LabelWidth}}" width="{{.MessageWidth}}" height="20" fill="{{.Color}}"/>
+<rect width="{{.Width}}" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="15" fill="#010101" fill-opacity=".3">{{.Label}}</text>
+<text x="{{.LabelX}}" y="14">{{.Label}}</text>
+<text x="{{.MessageX}}" y="15" fill="#010101" fill-opacity=".3">{{.Message}}</text>
+<text x="{{.MessageX}}" y="14">{{.Message}}</text>
+</g>
+</svg>
+`))
+
+// isBadgePath reports whether the given path is the one of the badge of a
+// version.
+func isBadgePath(path string) bool {
+	_, ok := versionFromBadgePath(path)
+	return ok
+}
+
+// versionFromBadgePath returns the version in the given path of a badge,
+// which is "latest" for the badge of the latest version.
+func versionFromBadgePath(path string) (string, bool) {
+	if !strings.HasPrefix(path, badgePrefix) || !strings.HasSuffix(path, badgeSuffix) {
+		return "", false
+	}
+
+	version := strings.TrimSuffix(strings.TrimPrefix(path, badgePrefix), badgeSuffix)
+	if version == "" || strings.Contains(version, "/") {
+		return "", false
+	}
+	return version, true
+}
+
+// serveBadge is an HTTP handler that outputs an SVG badge with the version in
+// the path, or the latest one, and whether its docs are built or its last
+// build failed, so the READMEs of the projects can show and link to the
+// status of their docs.
+func (s *Service) serveBadge(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	version, _ := versionFromBadgePath(r.URL.Path)
+	log := projectLog(r, owner, project).WithField("version", version)
+
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	if version == "latest" {
+		if version, ok = s.latestForHost(r.Host, owner, project); !ok {
+			s.notFound(w, r)
+			return
+		}
+	}
+
+	status, ok := s.versionStatusInfo(owner, project, version)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	// the badges are cached by the proxies of the sites embedding them,
+	// such as the one of GitHub, so they must be revalidated every time.
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := badgeTemplate.Execute(w, newBadge(status)); err != nil {
+		log.Errorf("error serving badge: %s", err)
+	}
+}
@@ -0,0 +1,69 @@
+package docsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeBadge(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.add("bar", "foo", "v2.0.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.index.install(buildConfig{owner: "bar", project: "foo", version: "v1.0.0"})
+	srv.failures.add("bar", "foo", "v1.1.0", fmt.Errorf("make failed"))
+
+	cases := []struct {
+		url     string
+		message string
+		color   string
+	}{
+		{"http://foo.bar/badge/v1.0.0.svg", "v1.0.0", badgeBuiltColor},
+		{"http://foo.bar/badge/v1.1.0.svg", "v1.1.0 failed", badgeFailedColor},
+		{"http://foo.bar/badge/latest.svg", "v2.0.0 not built", badgeMissedColor},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		require.Equal(http.StatusOK, w.Code, c.url)
+		require.Equal("image/svg+xml", w.Header().Get("Content-Type"))
+		require.Equal("no-cache", w.Header().Get("Cache-Control"))
+
+		body := w.Body.String()
+		require.Contains(body, "<title>docs: "+c.message+"</title>", c.url)
+		require.Contains(body, `fill="`+c.color+`"`, c.url)
+		require.Contains(body, fmt.Sprintf(`width="%d"`, badge{badgeLabel, c.message, c.color}.Width()), c.url)
+	}
+
+	for _, url := range []string{
+		"http://foo.bar/badge/v3.0.0.svg",
+		"http://foo.bar/badge/.svg",
+		"http://baz.bar/badge/latest.svg",
+	} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		require.Equal(http.StatusNotFound, w.Code, url)
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	require := require.New(t)
+	require.Equal(0, textWidth(""))
+	require.Equal(28, textWidth("docs"))
+	require.True(textWidth("v1.0.0") < textWidth("v10.00.00"))
+	require.True(textWidth("mmm") > textWidth("iii"))
+}
@@ -0,0 +1,110 @@
+package docsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	benchProjects = 100
+	benchReleases = 50
+)
+
+// newBenchSrv creates a service with benchProjects projects, each of them with
+// benchReleases releases, already indexed.
+func newBenchSrv(b *testing.B, opts Options) *Service {
+	logrus.SetOutput(ioutil.Discard)
+	fetcher := newMockFetcher()
+	opts.Config = make(Config)
+	for i := 0; i < benchProjects; i++ {
+		project := fmt.Sprintf("proj%d", i)
+		opts.Config[project+".foo.bar"] = ProjectConfig{Repository: "org/" + project}
+		for j := 0; j < benchReleases; j++ {
+			fetcher.add("org", project, fmt.Sprintf("v1.%d.0", j), "")
+		}
+	}
+
+	s := New(opts)
+	s.fetcher = fetcher
+	for i := 0; i < benchProjects; i++ {
+		if err := s.indexProject("org", fmt.Sprintf("proj%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+func BenchmarkProjectForHost(b *testing.B) {
+	s := newBenchSrv(b, Options{})
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			s.projectForHost(fmt.Sprintf("proj%d.foo.bar:9091", i%benchProjects))
+			i++
+		}
+	})
+}
+
+func BenchmarkIndexGet(b *testing.B) {
+	for _, shards := range []int{1, defaultIndexShards, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newBenchSrv(b, Options{IndexShards: shards})
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					project := fmt.Sprintf("proj%d", i%benchProjects)
+					version := fmt.Sprintf("v1.%d.0", i%benchReleases)
+					if s.index.get("org", project, version) == nil {
+						b.Fatalf("release %s of %s not found", version, project)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkListVersions(b *testing.B) {
+	for _, size := range []int{512, defaultBufferSize} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			s := newBenchSrv(b, Options{BufferSize: size})
+			benchmarkRequests(b, s, "/versions.json", http.StatusOK)
+		})
+	}
+}
+
+func BenchmarkRedirectToLatest(b *testing.B) {
+	s := newBenchSrv(b, Options{})
+	benchmarkRequests(b, s, "/latest/foo/", http.StatusTemporaryRedirect)
+}
+
+// benchmarkRequests performs requests to the given path of all the projects
+// in parallel.
+func benchmarkRequests(b *testing.B, s *Service, path string, code int) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			url := fmt.Sprintf("http://proj%d.foo.bar%s", i%benchProjects, path)
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			if w.Code != code {
+				b.Fatalf("unexpected status code %d for %s", w.Code, url)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,465 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+const (
+	// GitHubProvider fetches the releases of the projects from GitHub. It's
+	// the default provider.
+	GitHubProvider = "github"
+	// BitbucketProvider fetches the releases of the projects from the tags
+	// and downloads of their Bitbucket Cloud repositories.
+	BitbucketProvider = "bitbucket"
+)
+
+const (
+	// bitbucketAPIURL is the URL of the Bitbucket Cloud API.
+	bitbucketAPIURL = "https://api.bitbucket.org/2.0/"
+	// bitbucketURL is the URL of the Bitbucket Cloud website, where the
+	// archives of the repositories are downloaded from.
+	bitbucketURL = "https://bitbucket.org/"
+	// bitbucketPageLen is the number of items of every page of the lists of
+	// the Bitbucket API, which is the maximum it allows.
+	bitbucketPageLen = 100
+	// defaultBitbucketRetryAfter is the time the calls to the Bitbucket API
+	// are skipped once it's rate limited, if it does not tell for how long.
+	defaultBitbucketRetryAfter = time.Minute
+)
+
+// provider returns the provider of the repository of the project.
+func (c ProjectConfig) provider() string {
+	if c.Provider == "" {
+		return GitHubProvider
+	}
+	return c.Provider
+}
+
+// bitbucketFetcher fetches the releases of the projects hosted in Bitbucket
+// Cloud. Bitbucket has no releases, so every tag is a release, which is a
+// prerelease if it's a semantic version with a prerelease part, and the
+// downloads of the repository are the assets of the release whose tag is the
+// longest one in their name, e.g. "docs-v1.0.0.tar.gz" of "v1.0.0".
+type bitbucketFetcher struct {
+	apiURL string
+	webURL string
+	client *http.Client
+	// token is the token used to fetch the projects without their own,
+	// either an access token or a username and an app password separated by
+	// a colon. If it's empty, the requests are not authenticated.
+	token string
+
+	tokensMut *sync.RWMutex
+	// tokens contains the tokens of the projects with their own, in the form
+	// of ${owner}/${project}.
+	tokens map[string]string
+	// tracer records a span for every call to the fetcher, if any.
+	tracer *otelTracer
+}
+
+// newBitbucketFetcher creates a new fetcher of the releases of the projects
+// hosted in Bitbucket Cloud authenticated with the given token, if any. If
+// httpClient is nil, http.DefaultClient will be used.
+func newBitbucketFetcher(token string, httpClient *http.Client) *bitbucketFetcher {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &bitbucketFetcher{
+		apiURL:    bitbucketAPIURL,
+		webURL:    bitbucketURL,
+		client:    httpClient,
+		token:     token,
+		tokensMut: new(sync.RWMutex),
+		tokens:    make(map[string]string),
+	}
+}
+
+func (b *bitbucketFetcher) setTokens(tokens map[string]string) error {
+	b.tokensMut.Lock()
+	defer b.tokensMut.Unlock()
+	b.tokens = tokens
+	return nil
+}
+
+// tokenFor returns the token of the given project, if it has one, or the
+// global one otherwise.
+func (b *bitbucketFetcher) tokenFor(owner, project string) string {
+	b.tokensMut.RLock()
+	defer b.tokensMut.RUnlock()
+	if token, ok := b.tokens[newKey(owner, project)]; ok {
+		return token
+	}
+	return b.token
+}
+
+// downloadClient returns the given client authenticated with the token of the
+// given project, or the global one, in the requests to Bitbucket, so the
+// sources and downloads of private repositories can be downloaded.
+func (b *bitbucketFetcher) downloadClient(owner, project string, client *http.Client) *http.Client {
+	token := b.tokenFor(owner, project)
+	if token == "" {
+		return withAuth(client, nil)
+	}
+
+	authenticate := func(req *http.Request) error {
+		setBitbucketAuth(req, token)
+		return nil
+	}
+	return withAuth(client, authenticate, hostOf(b.webURL), hostOf(b.apiURL))
+}
+
+// startSpan starts the span of a call to the fetcher for the given project,
+// like the ones of the GitHub fetcher.
+func (b *bitbucketFetcher) startSpan(name, owner, project string) *otelSpan {
+	span := b.tracer.start(spanContext{}, name, spanKindClient)
+	span.set("bitbucket.workspace", owner)
+	span.set("bitbucket.repository", project)
+	return span
+}
+
+// bitbucketRef is a tag or a branch of a repository.
+type bitbucketRef struct {
+	Name string `json:"name"`
+	// Message and Date are the message and the date of the annotated tags.
+	Message string     `json:"message"`
+	Date    *time.Time `json:"date"`
+	Target  struct {
+		Hash string    `json:"hash"`
+		Date time.Time `json:"date"`
+	} `json:"target"`
+}
+
+// bitbucketDownload is a file uploaded to the downloads of a repository.
+type bitbucketDownload struct {
+	Name  string `json:"name"`
+	Links struct {
+		Self struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+func (b *bitbucketFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) (result []*release, err error) {
+	span := b.startSpan("fetch releases", owner, project)
+	defer func() {
+		span.set("bitbucket.releases", len(result))
+		span.finish(err)
+	}()
+
+	var tags []bitbucketRef
+	err = b.list(owner, project, b.repoURL(owner, project, "refs/tags"), func(data []byte) error {
+		var page []bitbucketRef
+		err := json.Unmarshal(data, &page)
+		tags = append(tags, page...)
+		return err
+	})
+	if err != nil {
+		return nil, wrap(err, "error listing tags of %s/%s", owner, project)
+	}
+
+	var downloads []bitbucketDownload
+	err = b.list(owner, project, b.repoURL(owner, project, "downloads"), func(data []byte) error {
+		var page []bitbucketDownload
+		err := json.Unmarshal(data, &page)
+		downloads = append(downloads, page...)
+		return err
+	})
+	if err != nil {
+		return nil, wrap(err, "error listing downloads of %s/%s", owner, project)
+	}
+
+	for _, t := range tags {
+		v := newVersion(t.Name)
+		if v != nil && (v.LessThan(minVersion) || maxVersion.excludes(v)) {
+			continue
+		}
+		result = append(result, b.newRelease(owner, project, t, v))
+	}
+
+	for _, d := range downloads {
+		if r := releaseOfDownload(result, d.Name); r != nil {
+			r.assets[d.Name] = d.Links.Self.Href
+		}
+	}
+
+	sortReleases(result, semverScheme{})
+	return result, nil
+}
+
+// newRelease returns the release of the given tag of a project, whose
+// version is the given one, if it's a semantic version.
+func (b *bitbucketFetcher) newRelease(owner, project string, t bitbucketRef, v *semver.Version) *release {
+	r := &release{
+		tag:         t.Name,
+		url:         b.archiveURL(newKey(owner, project), t.Name, "tar.gz"),
+		zipballURL:  b.archiveURL(newKey(owner, project), t.Name, "zip"),
+		sha:         t.Target.Hash,
+		prerelease:  v != nil && v.Prerelease() != "",
+		assets:      make(map[string]string),
+		name:        t.Name,
+		notes:       strings.TrimSpace(t.Message),
+		htmlURL:     b.webURL + escapePath(newKey(owner, project)) + "/src/" + url.PathEscape(t.Name) + "/",
+		publishedAt: t.Target.Date,
+	}
+
+	if t.Date != nil {
+		r.publishedAt = *t.Date
+	}
+	return r
+}
+
+// releaseOfDownload returns the release of the given ones whose tag is the
+// longest one in the name of the given download, or nil if there is none.
+func releaseOfDownload(releases []*release, name string) *release {
+	var result *release
+	for _, r := range releases {
+		if strings.Contains(name, r.tag) && (result == nil || len(r.tag) > len(result.tag)) {
+			result = r
+		}
+	}
+	return result
+}
+
+func (b *bitbucketFetcher) branch(owner, project, name string) (_ *release, err error) {
+	span := b.startSpan("fetch branch", owner, project)
+	span.set("bitbucket.branch", name)
+	defer func() { span.finish(err) }()
+
+	var ref bitbucketRef
+	err = b.get(owner, project, b.repoURL(owner, project, "refs/branches/"+url.PathEscape(name)), &ref)
+	if err != nil {
+		return nil, wrap(err, "error getting branch %s of %s/%s", name, owner, project)
+	}
+
+	if ref.Target.Hash == "" {
+		return nil, wrap(ErrNotFound, "unable to find HEAD of branch %s", name)
+	}
+
+	return &release{
+		tag: name,
+		url: b.archiveURL(newKey(owner, project), ref.Target.Hash, "tar.gz"),
+		sha: ref.Target.Hash,
+	}, nil
+}
+
+func (b *bitbucketFetcher) file(owner, project, ref, path string) (_ []byte, err error) {
+	span := b.startSpan("fetch file", owner, project)
+	span.set("bitbucket.ref", ref)
+	span.set("bitbucket.path", path)
+	defer func() { span.finish(err) }()
+
+	resp, err := b.do(owner, project, b.repoURL(owner, project, "src/"+url.PathEscape(ref)+"/"+escapePath(path)))
+	if err != nil {
+		if Cause(err) == ErrNotFound {
+			return nil, nil
+		}
+		return nil, wrap(err, "error getting file %s of %s/%s", path, owner, project)
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *bitbucketFetcher) pullRequest(owner, project string, number int) (_ *release, _ bool, err error) {
+	span := b.startSpan("fetch pull request", owner, project)
+	span.set("bitbucket.pull_request", number)
+	defer func() { span.finish(err) }()
+
+	var pr struct {
+		State  string `json:"state"`
+		Author struct {
+			Nickname string `json:"nickname"`
+		} `json:"author"`
+		Source struct {
+			Commit struct {
+				Hash string `json:"hash"`
+			} `json:"commit"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"source"`
+	}
+	err = b.get(owner, project, b.repoURL(owner, project, "pullrequests/"+strconv.Itoa(number)), &pr)
+	if err != nil {
+		return nil, false, wrap(err, "error getting pull request %d of %s/%s", number, owner, project)
+	}
+
+	sha, repo := pr.Source.Commit.Hash, pr.Source.Repository.FullName
+	if sha == "" || repo == "" {
+		return nil, false, wrap(ErrNotFound, "unable to find HEAD of pull request %d", number)
+	}
+
+	return &release{
+		tag:            pullRequestVersion(number),
+		url:            b.archiveURL(repo, sha, "tar.gz"),
+		sha:            sha,
+		author:         pr.Author.Nickname,
+		headRepository: repo,
+	}, pr.State == "OPEN", nil
+}
+
+func (b *bitbucketFetcher) commit(owner, project, ref string) (_ *release, err error) {
+	span := b.startSpan("fetch commit", owner, project)
+	span.set("bitbucket.ref", ref)
+	defer func() { span.finish(err) }()
+
+	var commit struct {
+		Hash string `json:"hash"`
+	}
+	err = b.get(owner, project, b.repoURL(owner, project, "commit/"+url.PathEscape(ref)), &commit)
+	if err != nil {
+		return nil, wrap(err, "error getting commit of %s in %s/%s", ref, owner, project)
+	}
+
+	if commit.Hash == "" {
+		return nil, wrap(ErrNotFound, "unable to find commit of %s", ref)
+	}
+
+	return &release{
+		tag:        ref,
+		url:        b.archiveURL(newKey(owner, project), commit.Hash, "tar.gz"),
+		zipballURL: b.archiveURL(newKey(owner, project), commit.Hash, "zip"),
+		sha:        commit.Hash,
+	}, nil
+}
+
+func (b *bitbucketFetcher) checkRepository(owner, project, token string) error {
+	req, err := http.NewRequest("GET", b.repoURL(owner, project, ""), nil)
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		token = b.token
+	}
+
+	resp, err := b.send(req, token)
+	if err != nil {
+		return wrap(err, "error getting repository %s/%s", owner, project)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// repoURL returns the URL of the given path of the API of the repository of
+// the given project.
+func (b *bitbucketFetcher) repoURL(owner, project, path string) string {
+	u := b.apiURL + "repositories/" + escapePath(newKey(owner, project))
+	if path != "" {
+		u += "/" + path
+	}
+	return u
+}
+
+// archiveURL returns the URL of the archive with the given extension,
+// "tar.gz" or "zip", of the given ref of the given repository.
+func (b *bitbucketFetcher) archiveURL(repository, ref, ext string) string {
+	return fmt.Sprintf("%s%s/get/%s.%s", b.webURL, escapePath(repository), url.PathEscape(ref), ext)
+}
+
+// list calls the given function with the values of every page of the list
+// of the API at the given URL.
+func (b *bitbucketFetcher) list(owner, project, u string, values func([]byte) error) error {
+	u += "?pagelen=" + strconv.Itoa(bitbucketPageLen)
+	for u != "" {
+		var page struct {
+			Values json.RawMessage `json:"values"`
+			Next   string          `json:"next"`
+		}
+		if err := b.get(owner, project, u, &page); err != nil {
+			return err
+		}
+
+		if len(page.Values) > 0 {
+			if err := values(page.Values); err != nil {
+				return err
+			}
+		}
+		u = page.Next
+	}
+	return nil
+}
+
+// get decodes the JSON response of the API at the given URL for the given
+// project into v.
+func (b *bitbucketFetcher) get(owner, project, u string, v interface{}) error {
+	resp, err := b.do(owner, project, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return wrap(err, "error decoding response of %s", u)
+	}
+	return nil
+}
+
+// do requests the given URL of the API with the token of the given project.
+func (b *bitbucketFetcher) do(owner, project, u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.send(req, b.tokenFor(owner, project))
+}
+
+// send sends the given request authenticated with the given token, if any.
+// The responses with an error status are returned as errors: the 404 ones
+// wrap ErrNotFound and the 429 ones are an *ErrRateLimited.
+func (b *bitbucketFetcher) send(req *http.Request, token string) (*http.Response, error) {
+	setBitbucketAuth(req, token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, wrap(ErrNotFound, "%s not found", req.URL)
+	case http.StatusTooManyRequests:
+		retry := defaultBitbucketRetryAfter
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retry = time.Duration(seconds) * time.Second
+		}
+		return nil, &ErrRateLimited{Reset: time.Now().Add(retry)}
+	default:
+		return nil, fmt.Errorf("unexpected status %d requesting %s", resp.StatusCode, req.URL)
+	}
+}
+
+// setBitbucketAuth authenticates the given request with the given token, if
+// any, which is either an access token or a username and an app password
+// separated by a colon.
+func setBitbucketAuth(req *http.Request, token string) {
+	if parts := strings.SplitN(token, ":", 2); len(parts) == 2 {
+		req.SetBasicAuth(parts[0], parts[1])
+	} else if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// escapePath escapes every segment of the given slash-separated path.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,212 @@
+package docsrv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBitbucketFetcher(mux *http.ServeMux) (*bitbucketFetcher, func()) {
+	server := httptest.NewServer(mux)
+	fetcher := newBitbucketFetcher("", nil)
+	fetcher.apiURL = server.URL + "/2.0/"
+	fetcher.webURL = server.URL + "/"
+	return fetcher, server.Close
+}
+
+func TestBitbucketReleases(t *testing.T) {
+	require := require.New(t)
+	mux := http.NewServeMux()
+	var server string
+	mux.HandleFunc("/2.0/repositories/org/foo/refs/tags", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"values": [
+				{"name": "v0.9.0", "target": {"hash": "c"}},
+				{"name": "v1.1.0-beta.1", "target": {"hash": "d"}}
+			]}`)
+			return
+		}
+
+		fmt.Fprintf(w, `{"values": [
+			{"name": "v1.0.0", "message": "First release\n", "date": "2021-01-02T00:00:00Z", "target": {"hash": "a"}},
+			{"name": "v1.0.0-rc.1", "target": {"hash": "b", "date": "2021-01-01T00:00:00Z"}}
+		], "next": "%s/2.0/repositories/org/foo/refs/tags?page=2"}`, server)
+	})
+	mux.HandleFunc("/2.0/repositories/org/foo/downloads", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"values": [
+			{"name": "docs-v1.0.0.tar.gz", "links": {"self": {"href": "http://a/1"}}},
+			{"name": "docs-v1.0.0-rc.1.tar.gz", "links": {"self": {"href": "http://a/2"}}},
+			{"name": "notes.txt", "links": {"self": {"href": "http://a/3"}}}
+		]}`)
+	})
+
+	fetcher, close := newTestBitbucketFetcher(mux)
+	defer close()
+	server = fetcher.webURL[:len(fetcher.webURL)-1]
+
+	releases, err := fetcher.releases("org", "foo", newVersion("v1.0.0-alpha"), nil)
+	require.NoError(err)
+
+	var tags []string
+	for _, r := range releases {
+		tags = append(tags, r.tag)
+	}
+	require.Equal([]string{"v1.0.0-rc.1", "v1.0.0", "v1.1.0-beta.1"}, tags)
+
+	require.True(releases[0].prerelease)
+	require.False(releases[1].prerelease)
+	require.True(releases[2].prerelease)
+	require.Equal(server+"/org/foo/get/v1.0.0.tar.gz", releases[1].url)
+	require.Equal(server+"/org/foo/get/v1.0.0.zip", releases[1].zipballURL)
+	require.Equal("a", releases[1].sha)
+	require.Equal("First release", releases[1].notes)
+	require.Equal(2021, releases[1].publishedAt.Year())
+	require.Equal(map[string]string{"docs-v1.0.0.tar.gz": "http://a/1"}, releases[1].assets)
+	require.Equal(map[string]string{"docs-v1.0.0-rc.1.tar.gz": "http://a/2"}, releases[0].assets)
+}
+
+func TestBitbucketFile(t *testing.T) {
+	require := require.New(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2.0/repositories/org/foo/src/v1.0.0/docsrv.yml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hosts: [docs.bar]")
+	})
+
+	fetcher, close := newTestBitbucketFetcher(mux)
+	defer close()
+
+	data, err := fetcher.file("org", "foo", "v1.0.0", "docsrv.yml")
+	require.NoError(err)
+	require.Equal("hosts: [docs.bar]", string(data))
+
+	data, err = fetcher.file("org", "foo", "v1.0.0", "missing.yml")
+	require.NoError(err)
+	require.Nil(data)
+}
+
+func TestBitbucketPullRequest(t *testing.T) {
+	require := require.New(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2.0/repositories/org/foo/pullrequests/3", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"state": "OPEN", "source": {
+			"commit": {"hash": "abc"},
+			"repository": {"full_name": "someone/foo"}
+		}}`)
+	})
+
+	fetcher, close := newTestBitbucketFetcher(mux)
+	defer close()
+
+	pr, open, err := fetcher.pullRequest("org", "foo", 3)
+	require.NoError(err)
+	require.True(open)
+	require.Equal("pr-3", pr.tag)
+	require.Equal("abc", pr.sha)
+	require.Equal(fetcher.webURL+"someone/foo/get/abc.tar.gz", pr.url)
+
+	_, _, err = fetcher.pullRequest("org", "foo", 4)
+	require.Equal(ErrNotFound, Cause(err))
+}
+
+func TestBitbucketCommit(t *testing.T) {
+	require := require.New(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2.0/repositories/org/foo/commit/hotfix", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"hash": "abc"}`)
+	})
+
+	fetcher, close := newTestBitbucketFetcher(mux)
+	defer close()
+
+	commit, err := fetcher.commit("org", "foo", "hotfix")
+	require.NoError(err)
+	require.Equal("abc", commit.sha)
+	require.Equal(fetcher.webURL+"org/foo/get/abc.tar.gz", commit.url)
+	require.Equal(fetcher.webURL+"org/foo/get/abc.zip", commit.zipballURL)
+
+	_, err = fetcher.commit("org", "foo", "missing")
+	require.Equal(ErrNotFound, Cause(err))
+}
+
+func TestBitbucketAuth(t *testing.T) {
+	require := require.New(t)
+	auth := make(map[string]string)
+	mux := http.NewServeMux()
+	for _, project := range []string{"foo", "bar", "baz"} {
+		project := project
+		mux.HandleFunc("/2.0/repositories/org/"+project+"/refs/tags", func(w http.ResponseWriter, r *http.Request) {
+			auth[project] = r.Header.Get("Authorization")
+			fmt.Fprint(w, `{"values": []}`)
+		})
+		mux.HandleFunc("/2.0/repositories/org/"+project+"/downloads", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"values": []}`)
+		})
+	}
+
+	fetcher, close := newTestBitbucketFetcher(mux)
+	defer close()
+	fetcher.token = "global"
+	require.NoError(fetcher.setTokens(map[string]string{
+		"org/foo": "foo-token",
+		"org/baz": "user:password",
+	}))
+
+	for _, project := range []string{"foo", "bar", "baz"} {
+		_, err := fetcher.releases("org", project, newVersion("v0.0.0"), nil)
+		require.NoError(err)
+	}
+
+	require.Equal(map[string]string{
+		"foo": "Bearer foo-token",
+		"bar": "Bearer global",
+		"baz": "Basic dXNlcjpwYXNzd29yZA==",
+	}, auth)
+
+	// the downloads are authenticated the same way
+	mux.HandleFunc("/org/", func(w http.ResponseWriter, r *http.Request) {
+		auth[r.URL.Path] = r.Header.Get("Authorization")
+	})
+	for _, project := range []string{"foo", "baz"} {
+		url := fetcher.archiveURL("org/"+project, "v1.0.0", "tar.gz")
+		resp, err := fetcher.downloadClient("org", project, nil).Get(url)
+		require.NoError(err)
+		resp.Body.Close()
+	}
+	require.Equal("Bearer foo-token", auth["/org/foo/get/v1.0.0.tar.gz"])
+	require.Equal("Basic dXNlcjpwYXNzd29yZA==", auth["/org/baz/get/v1.0.0.tar.gz"])
+}
+
+func TestBitbucketRateLimited(t *testing.T) {
+	require := require.New(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2.0/repositories/org/foo/refs/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	fetcher, close := newTestBitbucketFetcher(mux)
+	defer close()
+
+	_, err := fetcher.releases("org", "foo", newVersion("v0.0.0"), nil)
+	limited, ok := Cause(err).(*ErrRateLimited)
+	require.True(ok, "unexpected error: %v", err)
+	require.False(limited.Reset.IsZero())
+}
+
+func TestServeBitbucketProject(t *testing.T) {
+	require := require.New(t)
+	github, bitbucket := newMockFetcher(), newMockFetcher()
+	srv := newTestSrv(github, Config{
+		"foo.bar": {Repository: "org/foo"},
+		"baz.bar": {Repository: "org/baz", Provider: BitbucketProvider},
+	})
+	srv.bitbucket = bitbucket
+
+	require.True(srv.fetcherFor("org", "foo") == github)
+	require.True(srv.fetcherFor("org", "baz") == bitbucket)
+	require.Equal("", srv.rateLimitKey("org", "foo"))
+	require.Equal(BitbucketProvider, srv.rateLimitKey("org", "baz"))
+}
@@ -6,11 +6,13 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/c4milo/unpackit"
 )
 
 // buildConfig contains all the configuration passed to the `build docs`
@@ -18,12 +20,28 @@ import (
 type buildConfig struct {
 	// owner is the name of the organization or user who owns the repository.
 	owner string
-	// project is the repository name.
+	// project is the repository name, followed by the docs path if any.
 	project string
+	// docsPath is the folder of the repository where the docs are built.
+	docsPath string
 	// version name.
 	version string
-	// tarballURL is the URL of the .tar.gz with the code of the version.
+	// tarballURL is the URL of the archive with the code of the version, a
+	// .tar.gz unless the project is configured otherwise.
 	tarballURL string
+	// archiveName is the name of the archive in the checksums asset.
+	archiveName string
+	// checksumAsset is the name of the release asset with the SHA-256
+	// checksum of the archive. If it's empty, the archive is not verified.
+	checksumAsset string
+	// checksumURL is the URL of the checksums asset, empty if the release
+	// does not have it.
+	checksumURL string
+	// sha is the commit the version was built from, if known.
+	sha string
+	// ref is the git ref the version was built from with the build API
+	// under a label instead of a release, empty otherwise.
+	ref string
 	// baseURL is the base URL for the documentation site. e.g. foo.mydomain.tld/v1.0.0.
 	baseURL string
 	// hostName is the host name of the documentation site. e.g. foo.mydomain.tld
@@ -33,62 +51,424 @@ type buildConfig struct {
 	destination string
 	// sharedFolder will contain all the shared assets needed in the generation.
 	sharedFolder string
+	// sharedVersion is the semver constraint of the version of the shared
+	// assets required by the project, if any. See resolveSharedFolder.
+	sharedVersion string
+	// sharedFingerprint identifies the contents of the shared folder the
+	// version is built with. See withSharedFingerprint.
+	sharedFingerprint sharedFingerprint
+	// assetHashes enables appending content hashes to the asset URLs.
+	assetHashes bool
+	// sharedFiles are the files that must exist in the shared folder for the
+	// docs to be built.
+	sharedFiles []string
+	// env are the environment variables of the project added to the build,
+	// in the form NAME=value.
+	env []string
+	// sandbox runs the build as an unprivileged user, if any.
+	sandbox *buildSandbox
+	// cgroups limit the resources of the build, if any.
+	cgroups *buildCgroups
+	// interactive marks the builds requested by users, which go before the
+	// background ones in the build queue.
+	interactive bool
+	// fallbackTheme enables building the docs with a minimal theme instead
+	// of failing if the shared folder is missing or incomplete.
+	fallbackTheme bool
+	// canonicalBaseURL is the base URL of the latest version, used to add
+	// canonical links to the pages of older versions. If it's empty, no
+	// canonical links are added.
+	canonicalBaseURL string
+	// deprecationBanner is the HTML of the banner added to the pages of the
+	// outdated versions. If it's empty, no banner is added.
+	deprecationBanner string
+	// offlineBundles are the kinds of offline bundles to generate.
+	offlineBundles []string
+	// pdfCommand is the command used to generate the PDF bundles.
+	pdfCommand string
+	// precompress enables writing gzip and brotli variants of the text
+	// files of the docs.
+	precompress bool
+	// brotliCommand is the command used to write the brotli variants.
+	brotliCommand string
+	// httpClient is the client used to download the sources. If it's nil,
+	// http.DefaultClient is used.
+	httpClient *http.Client
+	// noIndex enables excluding the pages from search engines.
+	noIndex bool
+	// requestID is the ID of the request that triggered the build, if any.
+	requestID string
+	// tracer records the spans of the steps of the build, if any.
+	tracer *otelTracer
+	// trace is the span of the request that triggered the build, if any,
+	// which is the parent of the span of the build.
+	trace spanContext
+	// builtAt is the time the build finished.
+	builtAt time.Time
+	// buildDuration is the time the build took.
+	buildDuration time.Duration
+	// builder is the name of the docsrv instance that built the docs.
+	builder string
+	// screening are the rules the sources must follow to be built.
+	screening screeningRules
+	// cache is the cache of the archives and built docs, if any.
+	cache *artifactCache
+	// upstreamURL is the URL of the instance the docs are pulled from,
+	// already built, instead of building them. If it's empty, they are
+	// built.
+	upstreamURL string
+	// upstreamToken is the refresh token of the upstream instance.
+	upstreamToken string
+	// redirects are the redirect rules of the missing pages of the version,
+	// loaded from its docs once they are installed.
+	redirects []redirectRule
+}
+
+// log returns a logger for the build.
+func (c buildConfig) log() *logrus.Entry {
+	fields := logrus.Fields{
+		"project": c.project,
+		"owner":   c.owner,
+		"version": c.version,
+	}
+	if c.requestID != "" {
+		fields["request_id"] = c.requestID
+	}
+	return logrus.WithFields(fields)
+}
+
+// client returns the HTTP client used to download the sources.
+func (c buildConfig) client() *http.Client {
+	if c.httpClient == nil {
+		return http.DefaultClient
+	}
+	return c.httpClient
+}
+
+// sharedFolderError is returned when the shared folder is missing or lacks
+// some of the files required to build the docs.
+type sharedFolderError struct {
+	folder  string
+	missing []string
+	// version is the version of the shared assets required, if none of the
+	// folders satisfy it.
+	version string
+}
+
+func (e *sharedFolderError) Error() string {
+	if e.version != "" {
+		return fmt.Sprintf("shared folder %s has no version that satisfies %q", e.folder, e.version)
+	}
+
+	if len(e.missing) == 0 {
+		return fmt.Sprintf("shared folder %s does not exist", e.folder)
+	}
+
+	return fmt.Sprintf(
+		"shared folder %s is incomplete, missing files: %s",
+		e.folder,
+		strings.Join(e.missing, ", "),
+	)
+}
+
+// checkSharedFolder checks that the shared folder exists and contains all
+// the given files.
+func checkSharedFolder(folder string, files []string) error {
+	if folder == "" {
+		return nil
+	}
+
+	if !isDir(folder) {
+		return &sharedFolderError{folder: folder}
+	}
+
+	var missing []string
+	for _, f := range files {
+		if _, err := os.Stat(filepath.Join(folder, f)); err != nil {
+			missing = append(missing, f)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &sharedFolderError{folder: folder, missing: missing}
+	}
+
+	return nil
+}
+
+// fallbackThemeCSS is the stylesheet of the minimal theme used when the
+// shared folder can not be used.
+const fallbackThemeCSS = `body {
+	font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif;
+	line-height: 1.5;
+	color: #24292e;
+	max-width: 860px;
+	margin: 0 auto;
+	padding: 1em;
+}
+
+pre, code {
+	font-family: SFMono-Regular, Consolas, "Liberation Mono", Menlo, monospace;
+	background: #f6f8fa;
+}
+
+pre {
+	padding: 1em;
+	overflow: auto;
+}
+`
+
+// writeFallbackTheme writes the minimal theme to a new temporary folder and
+// returns its path.
+func writeFallbackTheme() (string, error) {
+	dir, err := ioutil.TempDir("", "docsrv-theme-")
+	if err != nil {
+		return "", wrap(err, "error creating fallback theme dir")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte(fallbackThemeCSS), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", wrap(err, "error writing fallback theme")
+	}
+
+	return dir, nil
 }
 
 // buildDocs builds the documentation site for the given build configuration.
-func buildDocs(conf buildConfig) error {
+func buildDocs(conf buildConfig) (err error) {
+	span := conf.tracer.start(conf.trace, "build", spanKindInternal)
+	span.set("docsrv.owner", conf.owner)
+	span.set("docsrv.project", conf.project)
+	span.set("docsrv.version", conf.version)
+	defer func() { span.finish(err) }()
+
 	start := time.Now()
-	resp, err := http.Get(conf.tarballURL)
+	if conf.cache.getBuild(conf) {
+		conf.log().Debug("docs restored from the artifact cache")
+		span.set("docsrv.cached", true)
+		return nil
+	}
+
+	// the refs built with the build API under a label are only known by
+	// the instance they were requested to, so they are built locally.
+	if conf.upstreamURL != "" && conf.ref == "" {
+		conf.log().Debug("pulling docs from upstream")
+		span.set("docsrv.mirrored", true)
+		return pullDocs(conf)
+	}
+
+	fallbackTheme := false
+	sharedFolder, err := conf.resolveSharedFolder()
+	if err == nil {
+		err = checkSharedFolder(sharedFolder, conf.sharedFiles)
+	}
+
 	if err != nil {
-		return err
+		conf.log().WithField("alert", true).Errorf("unable to use the shared folder: %s", err)
+
+		if !conf.fallbackTheme {
+			return err
+		}
+
+		sharedFolder, err = writeFallbackTheme()
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(sharedFolder)
+		fallbackTheme = true
+
+		if conf.sandbox != nil {
+			if err := chownTree(sharedFolder, int(conf.sandbox.uid), int(conf.sandbox.gid)); err != nil {
+				return wrap(err, "error giving the fallback theme to the build user")
+			}
+		}
+	}
+
+	if conf.tarballURL == "" {
+		return wrap(ErrNotFound, "release has no source asset %q", conf.archiveName)
+	}
+
+	archiveDir, err := ioutil.TempDir("", "docsrv-archive-")
+	if err != nil {
+		return wrap(err, "error creating temp dir")
+	}
+	defer os.RemoveAll(archiveDir)
+
+	archive := filepath.Join(archiveDir, "archive")
+	if conf.cache.getArchive(conf, archive) {
+		conf.log().Debug("archive restored from the artifact cache")
+	} else {
+		downloadSpan := span.startChild("download")
+		downloadSpan.set("http.url", conf.tarballURL)
+		err = download(conf.client(), conf.tarballURL, archive)
+		if err == nil {
+			if err = verifyChecksum(conf, archive); err != nil {
+				conf.log().WithField("alert", true).Errorf("could not verify archive: %s", err)
+				err = wrap(err, "error verifying %q", conf.tarballURL)
+			}
+		}
+
+		downloadSpan.finish(err)
+		if err != nil {
+			return err
+		}
+
+		conf.cache.putArchive(conf, archive)
 	}
 
 	tmpDir, err := ioutil.TempDir("", "docsrv-")
 	if err != nil {
-		return fmt.Errorf("error creating temp dir: %s", err)
+		return wrap(err, "error creating temp dir")
 	}
 
-	defer resp.Body.Close()
-	dir, err := unpackit.Unpack(resp.Body, tmpDir)
+	unpackSpan := span.startChild("unpack")
+	dir, err := unpack(archive, tmpDir)
 	if err != nil {
-		return fmt.Errorf("error untarring %q: %s", conf.tarballURL, err)
+		unpackSpan.finish(err)
+		os.RemoveAll(tmpDir)
+		return wrap(err, "error unpacking %q", conf.tarballURL)
+	}
+
+	err = screenSources(tmpDir, conf.screening)
+	unpackSpan.finish(err)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	if conf.docsPath != "" {
+		dir = filepath.Join(dir, filepath.FromSlash(conf.docsPath))
+		if !isDir(dir) {
+			os.RemoveAll(tmpDir)
+			return wrap(ErrNotFound, "docs path %q not found", conf.docsPath)
+		}
+	}
+
+	destination := conf.destination
+	if conf.sandbox != nil {
+		destination, err = conf.sandbox.prepare(tmpDir)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+		defer os.RemoveAll(destination)
 	}
 
 	startBuild := time.Now()
 	cmd := exec.Command("make", "docs")
 	cmd.Dir = dir
-	cmd.Env = append(
-		os.Environ(),
-		"BASE_URL="+conf.baseURL,
-		"DESTINATION_PATH="+conf.destination,
-		"SHARED_PATH="+conf.sharedFolder,
-		"REPOSITORY_NAME="+conf.project,
-		"REPOSITORY_OWNER="+conf.owner,
-		"VERSION_NAME="+conf.version,
-		"HOST_NAME="+conf.hostName,
+	env := []string{
+		"BASE_URL=" + conf.baseURL,
+		"DESTINATION_PATH=" + destination,
+		"SHARED_PATH=" + sharedFolder,
+		"REPOSITORY_NAME=" + repositoryName(conf.project),
+		"REPOSITORY_OWNER=" + conf.owner,
+		"VERSION_NAME=" + conf.version,
+		"DOCS_PATH=" + conf.docsPath,
+		"HOST_NAME=" + conf.hostName,
 		"DOCSRV=true",
-	)
+		"DOCSRV_FALLBACK_THEME=" + fmt.Sprint(fallbackTheme),
+	}
+	if conf.sandbox != nil {
+		conf.sandbox.command(cmd, append(env, conf.env...), tmpDir)
+	} else {
+		cmd.Env = append(append(os.Environ(), env...), conf.env...)
+	}
 
-	logrus.Warnf("make docs: %#v", strings.Join(cmd.Env, " "))
+	// only the variables set by docsrv are logged, the rest of the
+	// environment may contain secrets.
+	conf.log().Debugf("make docs: %s", strings.Join(env, " "))
 
-	output, err := cmd.CombinedOutput()
+	command := strings.Join(cmd.Args, " ")
+	makeSpan := span.startChild("make")
+	output, err := conf.cgroups.run(cmd)
+	makeSpan.finish(err)
 	if err != nil {
-		return fmt.Errorf("error running `make docs` of docs folder at %q: %s. Full error: %s", dir, err, string(output))
+		os.RemoveAll(tmpDir)
+		// only the variables of the build itself are reported, the rest of
+		// the environment of docsrv may contain secrets.
+		return &ErrBuildFailed{
+			Log:     string(output),
+			Command: command,
+			Env:     append(env, conf.env...),
+			Err:     err,
+		}
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"project":     conf.project,
-		"owner":       conf.owner,
-		"version":     conf.version,
+	conf.log().WithFields(logrus.Fields{
 		"baseurl":     conf.baseURL,
 		"destination": conf.destination,
 		"total_time":  fmt.Sprint(time.Since(start)),
 		"build_time":  fmt.Sprint(time.Since(startBuild)),
 	}).Debugf("build output: %s", string(output))
 
-	if err := os.RemoveAll(dir); err != nil {
-		logrus.Warnf("could not delete temp files at %q: %s", dir, err)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		conf.log().Warnf("could not delete temp files at %q: %s", tmpDir, err)
+	}
+
+	installSpan := span.startChild("install")
+	if conf.sandbox != nil {
+		if err := conf.sandbox.install(destination, conf.destination); err != nil {
+			installSpan.finish(err)
+			return err
+		}
+	}
+
+	if err := postProcess(conf); err != nil {
+		installSpan.finish(err)
+		return wrap(err, "error post processing docs")
+	}
+	installSpan.finish(nil)
+
+	// the docs built with the fallback theme are built again once the shared
+	// folder is fixed.
+	if !fallbackTheme {
+		conf.cache.putBuild(conf)
 	}
 
 	return nil
 }
+
+// envNameRegexp matches the valid names of environment variables.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedBuildEnv are the environment variables set by docsrv for every
+// build, which can't be set by the projects.
+var reservedBuildEnv = map[string]bool{
+	"BASE_URL":              true,
+	"DESTINATION_PATH":      true,
+	"SHARED_PATH":           true,
+	"REPOSITORY_NAME":       true,
+	"REPOSITORY_OWNER":      true,
+	"VERSION_NAME":          true,
+	"DOCS_PATH":             true,
+	"HOST_NAME":             true,
+	"DOCSRV":                true,
+	"DOCSRV_FALLBACK_THEME": true,
+}
+
+// buildEnv returns the environment variables of the given project for the
+// build of the given version for the given host, sorted by name. The invalid
+// and reserved ones are left out.
+func buildEnv(conf ProjectConfig, version, host string) []string {
+	replacer := strings.NewReplacer("{version}", version, "{host}", host)
+	var env []string
+	for _, name := range sortedKeys(conf.BuildEnv) {
+		if !envNameRegexp.MatchString(name) || reservedBuildEnv[name] {
+			continue
+		}
+		env = append(env, name+"="+replacer.Replace(conf.BuildEnv[name]))
+	}
+	return env
+}
+
+// sortedKeys returns the keys of the given map sorted.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,6 +2,10 @@ package docsrv
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -19,7 +23,7 @@ func TestBuildDocs(t *testing.T) {
 		tarballURL:   url,
 		baseURL:      "http://foo.bar",
 		destination:  tmpDir,
-		sharedFolder: "/etc/shared",
+		sharedFolder: testSharedFolder,
 		project:      "docsrv",
 		owner:        "src-d",
 		version:      "v1.2.3",
@@ -27,3 +31,115 @@ func TestBuildDocs(t *testing.T) {
 	require.NoError(buildDocs(conf))
 	assertMakefileOutput(t, tmpDir, conf.baseURL, conf.project, conf.owner, conf.version)
 }
+
+func TestBuildDocs_SharedFolder(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	conf := buildConfig{
+		tarballURL:   url,
+		baseURL:      "http://foo.bar",
+		destination:  tmpDir,
+		sharedFolder: filepath.Join(tmpDir, "missing"),
+		project:      "docsrv",
+		owner:        "src-d",
+		version:      "v1.2.3",
+	}
+
+	err = buildDocs(conf)
+	require.Error(err)
+	require.IsType(&sharedFolderError{}, err)
+	require.Equal("shared folder "+conf.sharedFolder+" does not exist", err.Error())
+
+	conf.sharedFolder = testSharedFolder
+	conf.sharedFiles = []string{"template.html"}
+	err = buildDocs(conf)
+	require.Error(err)
+	require.Equal("shared folder "+testSharedFolder+" is incomplete, missing files: template.html", err.Error())
+
+	conf.fallbackTheme = true
+	require.NoError(buildDocs(conf))
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "out"))
+	require.NoError(err)
+	require.NotContains(string(data), testSharedFolder)
+}
+
+func TestDocsPath(t *testing.T) {
+	require := require.New(t)
+	makefile := func(name string) string {
+		return "docs:\n\t@echo \"" + name + " $(REPOSITORY_NAME) $(DOCS_PATH)\" > $(DESTINATION_PATH)/out\n"
+	}
+	url, close := tarGzServerWithFiles(map[string]string{
+		"mono-1234/Makefile":                   makefile("root"),
+		"mono-1234/services/foo/docs/Makefile": makefile("foo"),
+		"mono-1234/services/baz/Makefile":      makefile("baz"),
+	})
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "mono", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":     ProjectConfig{Repository: "bar/mono", DocsPath: "services/foo/docs"},
+		"baz.bar":     ProjectConfig{Repository: "bar/mono", DocsPath: "services/baz"},
+		"mono.bar":    ProjectConfig{Repository: "bar/mono"},
+		"missing.bar": ProjectConfig{Repository: "bar/mono", DocsPath: "services/missing"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	cases := map[string]string{
+		"foo.bar":  "foo mono services/foo/docs\n",
+		"baz.bar":  "baz mono services/baz\n",
+		"mono.bar": "root mono \n",
+	}
+	for host, expected := range cases {
+		assertRedirect(t, srv, "http://"+host+"/v1.0.0/", "http://"+host+"/v1.0.0/")
+
+		owner, project, _ := srv.config().ProjectForHost(host)
+		data, err := ioutil.ReadFile(filepath.Join(srv.versionFolder(owner, project, "v1.0.0"), "out"))
+		require.NoError(err, host)
+		require.Equal(expected, string(data), host)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://missing.bar/v1.0.0/", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestBuildEnv(t *testing.T) {
+	require := require.New(t)
+	makefile := "docs:\n\t@echo \"$(THEME) $(ANALYTICS_ID) $(BASE_URL)\" > $(DESTINATION_PATH)/out\n"
+	url, close := tarGzServerWithMakefile(makefile)
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", BuildEnv: map[string]string{
+			"THEME":        "dark",
+			"ANALYTICS_ID": "UA-{host}-{version}",
+			"BASE_URL":     "http://evil.bar/",
+		}},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	data, err := ioutil.ReadFile(filepath.Join(srv.versionFolder("bar", "foo", "v1.0.0"), "out"))
+	require.NoError(err)
+	require.Equal("dark UA-foo.bar-v1.0.0 http://foo.bar/v1.0.0/\n", string(data))
+}
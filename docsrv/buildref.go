@@ -0,0 +1,182 @@
+package docsrv
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// buildRefPath is the path of the API to build the docs of an arbitrary git
+// ref under a label.
+const buildRefPath = "/api/build"
+
+// labelRegexp matches the labels the docs of a ref can be installed under,
+// which are a single segment of the path of the docs.
+var labelRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// reservedLabels are the labels that are already routes of docsrv.
+var reservedLabels = map[string]bool{
+	"latest": true,
+	"next":   true,
+	"api":    true,
+	"pr":     true,
+	"badge":  true,
+}
+
+// buildRef is an HTTP handler that builds the docs of the git ref in the
+// "ref" query string parameter, either a tag, a branch or a SHA, and installs
+// them under the version in the "label" parameter, e.g. to publish the docs
+// of a hotfix or to try a change of the templates before tagging a release.
+// The project is the one of the requested host, unless the "owner" and
+// "project" parameters are given. The docs of a label are replaced by the ones
+// of the new ref if it's built again. Once the ref is built, the status of the
+// label is returned. Only available to administrators with a POST request.
+func (s *Service) buildRef(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	query := r.URL.Query()
+	if o, p := query.Get("owner"), query.Get("project"); o != "" || p != "" {
+		hosts := s.config().HostsForProject(o, p)
+		if len(hosts) == 0 {
+			s.notFound(w, r)
+			return
+		}
+
+		// the docs are built with the URLs of a host of the project, not
+		// the ones of the requested host if it serves another project.
+		if !ok || o != owner || p != project {
+			r = r.WithContext(r.Context())
+			r.Host = hosts[0]
+		}
+		owner, project = o, p
+	} else if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	ref, label := query.Get("ref"), query.Get("label")
+	log := projectLog(r, owner, project).WithFields(logrus.Fields{
+		"ref":     ref,
+		"version": label,
+	})
+
+	if ref == "" {
+		httpError(w, r, "missing ref", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.ensureIndexed("", owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	if err := s.validateLabel(owner, project, label); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.labelInUse(owner, project, label) {
+		httpError(w, r, "the label is the version of a release, a branch or a pull request", http.StatusConflict)
+		return
+	}
+
+	if _, ok := s.rebuilding.Load(newKey(owner, project, label)); ok {
+		httpError(w, r, "the label is already being built", http.StatusConflict)
+		return
+	}
+
+	if err := s.checkRateLimit(owner, project); err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	commit, err := s.fetcherFor(owner, project).commit(owner, repositoryName(project), ref)
+	if err != nil {
+		s.recordRateLimit(owner, project, err)
+		if Cause(err) == ErrNotFound {
+			httpError(w, r, fmt.Sprintf("ref %q not found", ref), http.StatusNotFound)
+			return
+		}
+
+		log.Errorf("error resolving ref: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	if err := s.linkHost(stripPort(r.Host), owner, project); err != nil {
+		log.Errorf("could not link host folder: %s", err)
+		s.internalError(w, r)
+		return
+	}
+
+	log.WithField("sha", commit.sha).Info("building ref")
+	markBuild(r)
+	commit.tag = label
+	conf := s.newBuildConfig(r, owner, project, commit)
+	conf.ref = ref
+	conf.interactive = true
+	if err := s.rebuild(conf); err != nil {
+		if e, ok := Cause(err).(*ErrBuildFailed); ok {
+			report := newBuildReport(conf, e)
+			s.reports.add(report)
+			s.buildFailed(w, r, report)
+			return
+		}
+
+		s.handleError(w, r, err)
+		return
+	}
+
+	status, _ := s.versionStatusInfo(owner, project, label)
+	if err := s.writeJSON(w, status); err != nil {
+		log.Errorf("error serving version status: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// validateLabel returns an error if the given label of the given project is
+// not valid. Labels must be a single path segment that is not a route of
+// docsrv nor a version of the scheme of the project, unless it's
+// lexicographic, so they never conflict with a future release.
+func (s *Service) validateLabel(owner, project, label string) error {
+	if label == "" {
+		return fmt.Errorf("missing label")
+	}
+
+	if !labelRegexp.MatchString(label) || reservedLabels[label] {
+		return fmt.Errorf("invalid label: %q", label)
+	}
+
+	conf, _ := s.config().ForProject(owner, project)
+	if conf.VersionScheme != LexicographicScheme && conf.versionScheme().valid(label) {
+		return fmt.Errorf("label %q is a version of the project", label)
+	}
+	return nil
+}
+
+// labelInUse reports whether the given label of the given project is the
+// version of a release, a branch or a pull request, or the one of installed
+// docs that were not built from a ref. The labels of other refs can be
+// reused, replacing their docs.
+func (s *Service) labelInUse(owner, project, label string) bool {
+	if installed, ok := s.index.installation(owner, project, label); ok {
+		return installed.ref == ""
+	}
+
+	conf, _ := s.config().ForProject(owner, project)
+	_, pr := pullRequestNumber(label)
+	return pr || conf.hasBranch(label) || s.index.get(owner, project, label) != nil
+}
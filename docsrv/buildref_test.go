@@ -0,0 +1,87 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRef(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.addBranch("bar", "foo", "master", url, "def")
+	fetcher.addCommit("bar", "foo", "hotfix", url, "abc")
+	fetcher.addCommit("bar", "foo", "def", url, "def")
+	fetcher.add("bar", "baz", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", Branches: []string{"master"}},
+		"baz.bar": ProjectConfig{Repository: "bar/baz"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=preview", nil))
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	var status versionStatusInfo
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal("preview", status.Version)
+	require.True(status.Installed)
+	require.Equal("abc", *status.SHA)
+	destination := filepath.Join(tmpDir, "bar", "foo", "preview")
+	assertMakefileOutput(t, destination, "http://foo.bar/preview/", "foo", "bar", "preview")
+
+	// the label of a ref can be built again from another ref, and the
+	// project can be given explicitly from another host.
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://baz.bar/api/build?token=admin&ref=def&label=preview&owner=bar&project=foo", nil))
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	conf, ok := srv.index.installation("bar", "foo", "preview")
+	require.True(ok)
+	require.Equal("def", conf.sha)
+	require.Equal("def", conf.ref)
+	assertMakefileOutput(t, destination, "http://foo.bar/preview/", "foo", "bar", "preview")
+
+	// refs built under a label are never deleted releases
+	require.Empty(srv.deletedReleases("bar", "foo", srv.index.forProject("bar", "foo")))
+
+	cases := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"POST", "http://foo.bar/api/build?ref=hotfix&label=preview", http.StatusForbidden},
+		{"GET", "http://foo.bar/api/build?token=admin&ref=hotfix&label=preview", http.StatusMethodNotAllowed},
+		{"POST", "http://foo.bar/api/build?token=admin&label=preview", http.StatusBadRequest},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix", http.StatusBadRequest},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=latest", http.StatusBadRequest},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=a/b", http.StatusBadRequest},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=v1.1.0-hotfix", http.StatusBadRequest},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=master", http.StatusConflict},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=pr-1", http.StatusConflict},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=missing&label=preview", http.StatusNotFound},
+		{"POST", "http://foo.bar/api/build?token=admin&ref=hotfix&label=preview&owner=bar&project=qux", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		require.Equal(c.code, w.Code, c.url)
+	}
+}
@@ -0,0 +1,310 @@
+package docsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// bulkPath is the prefix of the paths of the bulk operations, which are
+	// followed by the name of the operation.
+	bulkPath = "/api/bulk/"
+	// retryFailedPeriod is how old the failed builds retried by
+	// BulkRetryFailed can be.
+	retryFailedPeriod = 24 * time.Hour
+)
+
+const (
+	// BulkRebuild rebuilds all the installed versions of a project.
+	BulkRebuild = "rebuild"
+	// BulkPurgePrereleases removes the docs of all the installed
+	// prereleases of a project.
+	BulkPurgePrereleases = "purge-prereleases"
+	// BulkRetryFailed builds again the versions of a project whose build
+	// failed in the last 24 hours.
+	BulkRetryFailed = "retry-failed"
+	// BulkRebuildShared rebuilds the installed versions of a project built
+	// with an outdated shared folder.
+	BulkRebuildShared = "rebuild-shared"
+)
+
+// bulkProgress is the progress of a bulk operation, streamed to the client
+// as a JSON object per line.
+type bulkProgress struct {
+	Operation string `json:"operation"`
+	Version   string `json:"version,omitempty"`
+	// Status is "planned" for the versions of a dry run, "running", "done"
+	// or "failed" for every version and "finished" once the operation is
+	// finished.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Step   int    `json:"step"`
+	Total  int    `json:"total"`
+	Failed int    `json:"failed,omitempty"`
+	DryRun bool   `json:"dry-run,omitempty"`
+}
+
+// bulkStep is the operation done on a single version.
+type bulkStep struct {
+	version string
+	run     func() error
+}
+
+// bulkOperation is an HTTP handler that runs the bulk operation in the path,
+// one version at a time, on the project of the requested host. With the
+// "dry-run" query string parameter, the versions are listed without running
+// the operation. The progress is streamed as it happens. Only available to
+// administrators with a POST request.
+func (s *Service) bulkOperation(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	if err := s.ensureIndexed("", owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	operation := strings.TrimPrefix(r.URL.Path, bulkPath)
+	var steps []bulkStep
+	switch operation {
+	case BulkRebuild:
+		steps = s.rebuildSteps(owner, project)
+	case BulkPurgePrereleases:
+		steps = s.purgePrereleasesSteps(owner, project)
+	case BulkRetryFailed:
+		steps = s.retryFailedSteps(r, owner, project)
+	case BulkRebuildShared:
+		var before time.Time
+		if v := r.URL.Query().Get("before"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				httpError(w, r, fmt.Sprintf("invalid time: %q", v), http.StatusBadRequest)
+				return
+			}
+			before = t
+		}
+		steps = s.rebuildSharedSteps(r, owner, project, before)
+	default:
+		s.notFound(w, r)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry-run"))
+	log = log.WithField("operation", operation)
+	log.Infof("running bulk operation on %d versions, dry run: %t", len(steps), dryRun)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(p bulkProgress) {
+		p.Operation = operation
+		p.Total = len(steps)
+		p.DryRun = dryRun
+		// the operation goes on even if the client is gone
+		enc.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	var failed int
+	for i, step := range steps {
+		if dryRun {
+			send(bulkProgress{Version: step.version, Status: "planned", Step: i + 1})
+			continue
+		}
+
+		send(bulkProgress{Version: step.version, Status: "running", Step: i + 1})
+		if err := step.run(); err != nil {
+			failed++
+			send(bulkProgress{Version: step.version, Status: "failed", Error: err.Error(), Step: i + 1})
+			continue
+		}
+		send(bulkProgress{Version: step.version, Status: "done", Step: i + 1})
+	}
+
+	send(bulkProgress{Status: "finished", Step: len(steps), Failed: failed})
+	log.Infof("bulk operation finished, %d versions failed", failed)
+}
+
+// rebuildSteps returns the steps to rebuild all the installed versions of the
+// given project.
+func (s *Service) rebuildSteps(owner, project string) []bulkStep {
+	var steps []bulkStep
+	for _, version := range s.index.installedVersions(owner, project) {
+		conf, ok := s.index.installation(owner, project, version)
+		if !ok {
+			continue
+		}
+
+		steps = append(steps, s.rebuildStep(conf, always))
+	}
+	return steps
+}
+
+// rebuildStep returns the step that rebuilds the version with the given
+// configuration holding its lock, so a request or a webhook never builds it
+// at the same time, if the given condition still holds once it's taken.
+func (s *Service) rebuildStep(conf buildConfig, cond func() bool) bulkStep {
+	return bulkStep{conf.version, func() error {
+		_, err := s.rebuildIf(context.Background(), conf, cond)
+		return err
+	}}
+}
+
+// always is the condition of the rebuilds of a version that happen no matter
+// what, once its lock is held.
+func always() bool { return true }
+
+// rebuildSharedSteps returns the steps to rebuild the versions of the given
+// project installed on disk built with an outdated shared folder: the ones
+// whose shared folder had no file modified after the given time or, if it's
+// zero, the ones whose shared folder has changed since they were built. The
+// versions built without a known fingerprint are rebuilt too, except the
+// ones whose release no longer exists, which can not be built again.
+func (s *Service) rebuildSharedSteps(r *http.Request, owner, project string, before time.Time) []bulkStep {
+	// the versions built with the same shared folder have the same current
+	// fingerprint, so every folder is only fingerprinted once.
+	current := make(map[string]string)
+	outdated := func(conf buildConfig) bool {
+		if conf.sharedFingerprint.hash == "" {
+			return true
+		}
+
+		if !before.IsZero() {
+			return conf.sharedFingerprint.modTime.Before(before)
+		}
+
+		dir, err := conf.resolveSharedFolder()
+		if err != nil {
+			return false
+		}
+
+		fp, ok := current[dir]
+		if !ok {
+			fp = conf.withSharedFingerprint().sharedFingerprint.hash
+			current[dir] = fp
+		}
+		return fp != "" && fp != conf.sharedFingerprint.hash
+	}
+
+	var steps []bulkStep
+	for _, v := range s.versionsOnDisk(owner, project) {
+		conf, ok := s.index.installation(owner, project, v.Version)
+		if !ok {
+			release := s.index.get(owner, project, v.Version)
+			if release == nil {
+				continue
+			}
+			conf = s.newBuildConfig(r, owner, project, release)
+		}
+
+		// the fingerprints of the versions built before docsrv started are
+		// kept in their folders.
+		if conf.sharedFingerprint.hash == "" {
+			conf.sharedFingerprint, _ = readSharedFingerprint(conf.destination)
+		}
+
+		if !outdated(conf) {
+			continue
+		}
+
+		steps = append(steps, s.rebuildStep(conf, always))
+	}
+	return steps
+}
+
+// purgePrereleasesSteps returns the steps to remove the docs of all the
+// installed prereleases of the given project.
+func (s *Service) purgePrereleasesSteps(owner, project string) []bulkStep {
+	var steps []bulkStep
+	for _, version := range s.index.installedVersions(owner, project) {
+		conf, ok := s.index.installation(owner, project, version)
+		if !ok || !s.isPrerelease(owner, project, version) {
+			continue
+		}
+
+		steps = append(steps, bulkStep{version, func() error {
+			if err := s.deleteVersion(owner, project, conf.version); err != nil {
+				return wrap(err, "could not remove docs")
+			}
+
+			s.writeState()
+			return nil
+		}})
+	}
+	return steps
+}
+
+// isPrerelease reports whether the given version of the project is a
+// prerelease, either because it's marked as such on GitHub or because its
+// semantic version has a prerelease part.
+func (s *Service) isPrerelease(owner, project, version string) bool {
+	if r := s.index.get(owner, project, version); r != nil && r.prerelease {
+		return true
+	}
+
+	v := newVersion(version)
+	return v != nil && v.Prerelease() != ""
+}
+
+// retryFailedSteps returns the steps to build again the versions of the given
+// project whose build failed in the last 24 hours and have not been
+// installed since.
+func (s *Service) retryFailedSteps(r *http.Request, owner, project string) []bulkStep {
+	var steps []bulkStep
+	seen := make(map[string]bool)
+	reports := s.reports.forProject(owner, project, time.Now().Add(-retryFailedPeriod))
+	// the newest report of every version is the one that matters
+	for i := len(reports) - 1; i >= 0; i-- {
+		report := reports[i]
+		if seen[report.Version] {
+			continue
+		}
+		seen[report.Version] = true
+
+		conf, ok := s.index.installation(owner, project, report.Version)
+		if ok && conf.builtAt.After(report.Created) {
+			continue
+		}
+
+		release := s.index.get(owner, project, report.Version)
+		if release == nil {
+			continue
+		}
+
+		// the version may be installed by a request while the previous
+		// steps run.
+		created := report.Created
+		notRetried := func() bool {
+			installed, ok := s.index.installation(owner, project, release.tag)
+			return !ok || !installed.builtAt.After(created)
+		}
+
+		conf = s.newBuildConfig(r, owner, project, release)
+		steps = append(steps, s.rebuildStep(conf, notRetried))
+	}
+	return steps
+}
@@ -0,0 +1,197 @@
+package docsrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkOperation(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+	failingURL, closeFailing := tarGzServerWithMakefile(failingMakefile)
+	defer closeFailing()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", failingURL)
+	fetcher.addPrerelease("bar", "foo", "v2.0.0-beta.1", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo", Prereleases: true}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	assertRedirect(t, srv, "http://foo.bar/v2.0.0-beta.1/", "http://foo.bar/v2.0.0-beta.1/")
+	assertInternalError(t, srv, "http://foo.bar/v1.1.0/")
+
+	conf, ok := srv.index.installation("bar", "foo", "v1.0.0")
+	require.True(ok)
+	builtAt := conf.builtAt
+
+	progress := bulkRequest(t, srv, "http://foo.bar/api/bulk/rebuild?token=admin&dry-run=true")
+	require.Equal([]bulkProgress{
+		{Operation: BulkRebuild, Version: "v1.0.0", Status: "planned", Step: 1, Total: 2, DryRun: true},
+		{Operation: BulkRebuild, Version: "v2.0.0-beta.1", Status: "planned", Step: 2, Total: 2, DryRun: true},
+		{Operation: BulkRebuild, Status: "finished", Step: 2, Total: 2, DryRun: true},
+	}, progress)
+	conf, _ = srv.index.installation("bar", "foo", "v1.0.0")
+	require.Equal(builtAt, conf.builtAt, "dry runs do not rebuild")
+
+	time.Sleep(10 * time.Millisecond)
+	progress = bulkRequest(t, srv, "http://foo.bar/api/bulk/rebuild?token=admin")
+	require.Equal([]bulkProgress{
+		{Operation: BulkRebuild, Version: "v1.0.0", Status: "running", Step: 1, Total: 2},
+		{Operation: BulkRebuild, Version: "v1.0.0", Status: "done", Step: 1, Total: 2},
+		{Operation: BulkRebuild, Version: "v2.0.0-beta.1", Status: "running", Step: 2, Total: 2},
+		{Operation: BulkRebuild, Version: "v2.0.0-beta.1", Status: "done", Step: 2, Total: 2},
+		{Operation: BulkRebuild, Status: "finished", Step: 2, Total: 2},
+	}, progress)
+	conf, _ = srv.index.installation("bar", "foo", "v1.0.0")
+	require.True(conf.builtAt.After(builtAt))
+
+	progress = bulkRequest(t, srv, "http://foo.bar/api/bulk/purge-prereleases?token=admin")
+	require.Len(progress, 3)
+	require.Equal("done", progress[1].Status)
+	require.Equal("v2.0.0-beta.1", progress[1].Version)
+	require.False(srv.index.isInstalled("bar", "foo", "v2.0.0-beta.1"))
+	require.True(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	_, err = os.Stat(filepath.Join(tmpDir, "bar", "foo", "v2.0.0-beta.1"))
+	require.True(os.IsNotExist(err))
+	// the size of the purged version no longer counts for the quotas
+	srv.sizes.mut.Lock()
+	_, sized := srv.sizes.sizes[filepath.Join(tmpDir, "bar", "foo", "v2.0.0-beta.1")]
+	srv.sizes.mut.Unlock()
+	require.False(sized)
+
+	progress = bulkRequest(t, srv, "http://foo.bar/api/bulk/retry-failed?token=admin")
+	require.Len(progress, 3)
+	require.Equal("v1.1.0", progress[1].Version)
+	require.Equal("failed", progress[1].Status)
+	require.Contains(progress[1].Error, "make docs")
+	require.Equal(bulkProgress{Operation: BulkRetryFailed, Status: "finished", Step: 1, Total: 1, Failed: 1}, progress[2])
+}
+
+func TestBulkOperation_RebuildShared(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	shared := filepath.Join(tmpDir, "shared")
+	require.NoError(os.MkdirAll(filepath.Join(shared, "bar", "baz"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(shared, "style.css"), []byte("body {}"), 0644))
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = filepath.Join(tmpDir, "public")
+	srv.opts.SharedFolder = shared
+	srv.opts.RefreshToken = "admin"
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	assertRedirect(t, srv, "http://foo.bar/v1.1.0/", "http://foo.bar/v1.1.0/")
+
+	conf, ok := srv.index.installation("bar", "foo", "v1.0.0")
+	require.True(ok)
+	fp := conf.sharedFingerprint
+	require.NotEmpty(fp.hash)
+
+	progress := bulkRequest(t, srv, "http://foo.bar/api/bulk/rebuild-shared?token=admin")
+	require.Equal([]bulkProgress{
+		{Operation: BulkRebuildShared, Status: "finished"},
+	}, progress)
+
+	// only the versions built before the change are outdated
+	require.NoError(ioutil.WriteFile(filepath.Join(shared, "style.css"), []byte("body {color: red}"), 0644))
+	require.NoError(srv.rebuild(conf))
+	conf, _ = srv.index.installation("bar", "foo", "v1.0.0")
+	require.NotEqual(fp.hash, conf.sharedFingerprint.hash)
+
+	progress = bulkRequest(t, srv, "http://foo.bar/api/bulk/rebuild-shared?token=admin")
+	require.Equal([]bulkProgress{
+		{Operation: BulkRebuildShared, Version: "v1.1.0", Status: "running", Step: 1, Total: 1},
+		{Operation: BulkRebuildShared, Version: "v1.1.0", Status: "done", Step: 1, Total: 1},
+		{Operation: BulkRebuildShared, Status: "finished", Step: 1, Total: 1},
+	}, progress)
+	conf, _ = srv.index.installation("bar", "foo", "v1.1.0")
+	require.Equal(srv.stateManifest(srv.config()).Hosts[0].Versions[1].SharedFingerprint, &conf.sharedFingerprint.hash)
+
+	before := conf.sharedFingerprint.modTime.Add(time.Second).Format(time.RFC3339)
+	progress = bulkRequest(t, srv, "http://foo.bar/api/bulk/rebuild-shared?token=admin&dry-run=true&before="+before)
+	require.Len(progress, 3)
+
+	// the fingerprints are kept once docsrv restarts
+	restarted := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	restarted.opts.BaseFolder = srv.opts.BaseFolder
+	restarted.opts.SharedFolder = shared
+	restarted.opts.RefreshToken = "admin"
+	require.False(restarted.index.isInstalled("bar", "foo", "v1.0.0"))
+
+	progress = bulkRequest(t, restarted, "http://foo.bar/api/bulk/rebuild-shared?token=admin&dry-run=true")
+	require.Equal([]bulkProgress{
+		{Operation: BulkRebuildShared, Status: "finished", DryRun: true},
+	}, progress)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(shared, "style.css"), []byte("body {color: blue}"), 0644))
+	progress = bulkRequest(t, restarted, "http://foo.bar/api/bulk/rebuild-shared?token=admin&dry-run=true")
+	require.Len(progress, 3)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/bulk/rebuild-shared?token=admin&before=yesterday", nil))
+	require.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestBulkOperation_Errors(t *testing.T) {
+	srv := newTestSrv(newMockFetcher(), Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.RefreshToken = "admin"
+
+	cases := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"POST", "http://foo.bar/api/bulk/rebuild", http.StatusForbidden},
+		{"GET", "http://foo.bar/api/bulk/rebuild?token=admin", http.StatusMethodNotAllowed},
+		{"POST", "http://foo.bar/api/bulk/foo?token=admin", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		require.Equal(t, c.code, w.Code, c.url)
+	}
+}
+
+func bulkRequest(t *testing.T, handler http.Handler, url string) []bulkProgress {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", url, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	var progress []bulkProgress
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var p bulkProgress
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &p))
+		progress = append(progress, p)
+	}
+	return progress
+}
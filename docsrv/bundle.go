@@ -0,0 +1,344 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// ZipBundle is an offline bundle with the HTML docs in a zip file.
+	ZipBundle = "zip"
+	// TarGzBundle is an offline bundle with the HTML docs in a .tar.gz file.
+	TarGzBundle = "tar.gz"
+	// PDFBundle is an offline bundle with all the pages of the docs in a
+	// single PDF file.
+	PDFBundle = "pdf"
+)
+
+// bundlePaths are the kinds of the offline bundles served by docsrv in the
+// given paths of every version, e.g. /${VERSION}/docs.pdf.
+var bundlePaths = map[string]string{
+	"docs.pdf":       PDFBundle,
+	"offline.zip":    ZipBundle,
+	"offline.tar.gz": TarGzBundle,
+}
+
+const (
+	// downloadFolder is the folder inside a version where its offline
+	// bundles are placed.
+	downloadFolder = "download"
+	// defaultPDFCommand is the default command used to convert the HTML
+	// pages to PDF.
+	defaultPDFCommand = "wkhtmltopdf --enable-local-file-access"
+)
+
+// bundle is an offline bundle of a version.
+type bundle struct {
+	Kind string
+	Name string
+	Size int64
+}
+
+var downloadTemplate = template.Must(template.New("download").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Download {{.Project}} {{.Version}}</title>
+</head>
+<body>
+<h1>Download {{.Project}} {{.Version}}</h1>
+<ul>
+{{range .Bundles}}<li><a href="{{.Name}}">{{.Name}}</a> ({{.Size}} bytes)</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// generateBundles generates the offline bundles of the built documentation
+// site enabled in the given build configuration, along with a page listing
+// them in its download folder. A bundle that can not be generated is logged
+// and skipped instead of failing the build, since the docs can be served
+// without it.
+func generateBundles(conf buildConfig) error {
+	dir := filepath.Join(conf.destination, downloadFolder)
+	if err := os.RemoveAll(dir); err != nil {
+		return wrap(err, "error removing download folder")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return wrap(err, "error creating download folder")
+	}
+
+	var bundles []bundle
+	for _, kind := range conf.offlineBundles {
+		name := bundleName(conf.project, conf.version, kind)
+		file := filepath.Join(dir, name)
+
+		var err error
+		switch kind {
+		case ZipBundle:
+			err = zipSite(conf.destination, file, conf.project+"-"+conf.version)
+		case TarGzBundle:
+			err = tarGzSite(conf.destination, file, conf.project+"-"+conf.version)
+		case PDFBundle:
+			err = pdfSite(conf.destination, file, conf.pdfCommand)
+		default:
+			err = fmt.Errorf("unknown kind of bundle")
+		}
+
+		if err != nil {
+			conf.log().Errorf("could not generate %s bundle: %s", kind, err)
+			os.Remove(file)
+			continue
+		}
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			return wrap(err, "error reading %s bundle", kind)
+		}
+		bundles = append(bundles, bundle{kind, name, fi.Size()})
+	}
+
+	f, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return wrap(err, "error creating download page")
+	}
+	defer f.Close()
+
+	err = downloadTemplate.Execute(f, struct {
+		Project string
+		Version string
+		Bundles []bundle
+	}{conf.project, conf.version, bundles})
+	if err != nil {
+		return wrap(err, "error writing download page")
+	}
+
+	return f.Close()
+}
+
+// bundleName returns the name of the file of the offline bundle of the given
+// kind of a version.
+func bundleName(project, version, kind string) string {
+	return fmt.Sprintf("%s-%s.%s", project, version, kind)
+}
+
+// walkSite calls the given function with every regular file of the site in
+// the given root folder, except the ones in its download folder, along with
+// its path relative to the root.
+func walkSite(root string, fn func(path, rel string, fi os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == downloadFolder && fi.IsDir() {
+			return filepath.SkipDir
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		return fn(path, rel, fi)
+	})
+}
+
+// zipSite writes to the given file a zip with all the files of the site in
+// the given root folder, except its download folder, inside a folder with
+// the given name.
+func zipSite(root, file, name string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	err = walkSite(root, func(path, rel string, fi os.FileInfo) error {
+		return addFileToZip(zw, path, filepath.ToSlash(filepath.Join(name, rel)), fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func addFileToZip(zw *zip.Writer, path, name string, fi os.FileInfo) error {
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// tarGzSite writes to the given file a .tar.gz with all the files of the site
+// in the given root folder, except its download folder, inside a folder with
+// the given name.
+func tarGzSite(root, file, name string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	err = walkSite(root, func(path, rel string, fi os.FileInfo) error {
+		return addFileToTar(tw, path, filepath.ToSlash(filepath.Join(name, rel)), fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// pdfSite writes to the given file a PDF with all the HTML pages of the site
+// in the given root folder, except its download folder, using the given
+// command. The command receives the pages, starting with the index page of
+// the site, followed by the output file as arguments.
+func pdfSite(root, file, command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		args = strings.Fields(defaultPDFCommand)
+	}
+
+	var pages []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && path == filepath.Join(root, downloadFolder) {
+			return filepath.SkipDir
+		}
+
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".html") {
+			pages = append(pages, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(pages) == 0 {
+		return fmt.Errorf("there are no HTML pages")
+	}
+
+	index := filepath.Join(root, "index.html")
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i] == index && pages[j] != index
+	})
+
+	cmd := exec.Command(args[0], append(append(args[1:], pages...), file)...)
+	cmd.Dir = root
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running %s: %s: %s", args[0], err, tailLines(string(output), 5))
+	}
+
+	return nil
+}
+
+// pdfCommand returns the command used to generate the PDF bundles of the
+// given project.
+func (s *Service) pdfCommand(conf ProjectConfig) string {
+	if conf.PDFCommand != "" {
+		return conf.PDFCommand
+	}
+	return s.opts.PDFCommand
+}
+
+// bundleKindForPath returns the kind of the offline bundle served in the
+// given path, e.g. "pdf" for /v1.0.0/docs.pdf. Will also report whether or
+// not it's the path of a bundle.
+func bundleKindForPath(path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+
+	kind, ok := bundlePaths[parts[1]]
+	return kind, ok
+}
+
+// serveBundle serves the offline bundle of the given kind of the requested
+// version as a download. If the version is not installed yet, it's built
+// first, like any other page of its docs.
+func (s *Service) serveBundle(w http.ResponseWriter, r *http.Request, kind string) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	version := versionFromReq(r)
+	if !s.index.isInstalled(owner, project, version) {
+		s.prepareVersion(w, r)
+		return
+	}
+
+	name := bundleName(project, version, kind)
+	f, err := os.Open(filepath.Join(s.versionFolder(owner, project, version), downloadFolder, name))
+	if err != nil {
+		projectLog(r, owner, project).WithField("version", version).
+			Debugf("%s bundle was not generated", kind)
+		s.notFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		s.internalError(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("ETag", fileETag(fi))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
@@ -0,0 +1,168 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakePDFScript writes all its arguments to the file in the last one.
+const fakePDFScript = `#!/bin/sh
+for last; do :; done
+echo "$@" > "$last"
+`
+
+func TestGenerateBundles(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	site := filepath.Join(tmpDir, "site")
+	files := []string{"a.html", "index.html", "css/style.css", "guide/index.html"}
+	for _, name := range files {
+		path := filepath.Join(site, filepath.FromSlash(name))
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(name), 0644))
+	}
+
+	script := filepath.Join(tmpDir, "topdf")
+	require.NoError(ioutil.WriteFile(script, []byte(fakePDFScript), 0755))
+
+	conf := buildConfig{
+		project:        "foo",
+		version:        "v1.0.0",
+		destination:    site,
+		offlineBundles: []string{ZipBundle, TarGzBundle, PDFBundle},
+		pdfCommand:     script,
+	}
+	require.NoError(postProcess(conf))
+	// bundles of a previous build are not included in the new ones
+	require.NoError(postProcess(conf))
+
+	zr, err := zip.OpenReader(filepath.Join(site, "download", "foo-v1.0.0.zip"))
+	require.NoError(err)
+	defer zr.Close()
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	require.Equal([]string{
+		"foo-v1.0.0/a.html",
+		"foo-v1.0.0/css/style.css",
+		"foo-v1.0.0/guide/index.html",
+		"foo-v1.0.0/index.html",
+	}, names)
+
+	f, err := os.Open(filepath.Join(site, "download", "foo-v1.0.0.tar.gz"))
+	require.NoError(err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	require.NoError(err)
+
+	names = nil
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	require.Equal([]string{
+		"foo-v1.0.0/a.html",
+		"foo-v1.0.0/css/style.css",
+		"foo-v1.0.0/guide/index.html",
+		"foo-v1.0.0/index.html",
+	}, names)
+
+	pdf, err := ioutil.ReadFile(filepath.Join(site, "download", "foo-v1.0.0.pdf"))
+	require.NoError(err)
+	require.Equal(strings.Join([]string{
+		filepath.Join(site, "index.html"),
+		filepath.Join(site, "a.html"),
+		filepath.Join(site, "guide", "index.html"),
+		filepath.Join(site, "download", "foo-v1.0.0.pdf"),
+	}, " ")+"\n", string(pdf))
+
+	page, err := ioutil.ReadFile(filepath.Join(site, "download", "index.html"))
+	require.NoError(err)
+	require.Contains(string(page), `<a href="foo-v1.0.0.zip">`)
+	require.Contains(string(page), `<a href="foo-v1.0.0.pdf">`)
+
+	// failing bundles are skipped
+	conf.pdfCommand = "false"
+	require.NoError(postProcess(conf))
+	_, err = os.Stat(filepath.Join(site, "download", "foo-v1.0.0.pdf"))
+	require.True(os.IsNotExist(err))
+
+	page, err = ioutil.ReadFile(filepath.Join(site, "download", "index.html"))
+	require.NoError(err)
+	require.Contains(string(page), `<a href="foo-v1.0.0.zip">`)
+	require.NotContains(string(page), `<a href="foo-v1.0.0.pdf">`)
+}
+
+func TestServeBundle(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", OfflineBundles: []string{TarGzBundle}},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	// the version is built first
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/offline.tar.gz", "http://foo.bar/v1.0.0/offline.tar.gz")
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/offline.tar.gz", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(`attachment; filename="foo-v1.0.0.tar.gz"`, w.Header().Get("Content-Disposition"))
+	require.NotEmpty(w.Header().Get("ETag"))
+	gr, err := gzip.NewReader(w.Body)
+	require.NoError(err)
+	header, err := tar.NewReader(gr).Next()
+	require.NoError(err)
+	require.Equal("foo-v1.0.0/out", header.Name)
+
+	// the bundles that are not enabled are not found
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/docs.pdf", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+
+	for path, expected := range map[string]string{
+		"/v1.0.0/docs.pdf":       PDFBundle,
+		"/v1.0.0/offline.zip":    ZipBundle,
+		"/v1.0.0/offline.tar.gz": TarGzBundle,
+		"/v1.0.0/guide/docs.pdf": "",
+		"/docs.pdf":              "",
+		"//docs.pdf":             "",
+	} {
+		kind, _ := bundleKindForPath(path)
+		require.Equal(expected, kind, path)
+	}
+}
@@ -0,0 +1,195 @@
+package docsrv
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// defaultAssetsCacheControl is the default Cache-Control header of the
+	// assets of the docs of the releases, which only change when they are
+	// rebuilt, e.g. with a new shared folder.
+	defaultAssetsCacheControl = "public, max-age=600"
+	// defaultHashedAssetsCacheControl is the default Cache-Control header of
+	// the assets of the docs of the releases whose URLs contain the hash of
+	// their contents, such as the ones of AssetHashes, which never change.
+	defaultHashedAssetsCacheControl = "public, max-age=31536000, immutable"
+	// defaultRedirectsCacheControl is the default Cache-Control header of
+	// the redirects to the latest version, which change with every release.
+	defaultRedirectsCacheControl = "public, max-age=60"
+	// defaultVersionsCacheControl is the default Cache-Control header of
+	// the lists of versions, which change with every release and build.
+	defaultVersionsCacheControl = "public, max-age=60"
+	// noCacheControl is the value of the options of the Cache-Control
+	// header that disables it.
+	noCacheControl = "none"
+)
+
+// CacheControlConfig is the Cache-Control header of the responses of every
+// class of paths of a host. The classes that are not set use the default
+// ones, and the ones set to "none" are served without it.
+type CacheControlConfig struct {
+	// Assets is the header of the files of the docs of the releases served
+	// by docsrv that are not HTML pages, such as stylesheets, scripts and
+	// images, with or without the hash of their contents in a cache
+	// busting parameter, such as "?v=". The docs of branches, pull requests
+	// and refs change when they are rebuilt, so they are never cached this
+	// way.
+	Assets string `toml:"assets"`
+	// Redirects is the header of the redirects of the root of the host,
+	// /latest/ and /next/ to a version.
+	Redirects string `toml:"redirects"`
+	// Versions is the header of the lists of versions in /versions.json.
+	Versions string `toml:"versions"`
+}
+
+// cacheClass is a class of paths whose responses are cached the same way.
+type cacheClass int
+
+const (
+	uncachedClass cacheClass = iota
+	assetsClass
+	hashedAssetsClass
+	redirectsClass
+	versionsClass
+)
+
+// cacheControl returns the Cache-Control header of the responses of the
+// given class of paths of the host. The default ones are private for the
+// hosts with private docs, so shared caches never store them.
+func (c ProjectConfig) cacheControl(class cacheClass) string {
+	var value, def string
+	switch class {
+	case assetsClass:
+		value, def = c.CacheControl.Assets, defaultAssetsCacheControl
+	case hashedAssetsClass:
+		value, def = c.CacheControl.Assets, defaultHashedAssetsCacheControl
+	case redirectsClass:
+		value, def = c.CacheControl.Redirects, defaultRedirectsCacheControl
+	case versionsClass:
+		value, def = c.CacheControl.Versions, defaultVersionsCacheControl
+	default:
+		return ""
+	}
+
+	switch value {
+	case noCacheControl:
+		return ""
+	case "":
+		if c.Auth != nil {
+			return strings.Replace(def, "public", "private", 1)
+		}
+		return def
+	default:
+		return value
+	}
+}
+
+// cacheClassFor returns the class of the path of the given request to the
+// given project, whose URL had a cache busting parameter if busted is true.
+func (s *Service) cacheClassFor(r *http.Request, owner, project string, busted bool) cacheClass {
+	p := r.URL.Path
+	switch {
+	case p == "/versions.json" || p == versionsV2Path:
+		return versionsClass
+	case p == "/" || strings.HasPrefix(p, "/latest/") || strings.HasPrefix(p, "/next/"):
+		return redirectsClass
+	}
+
+	if ext := strings.ToLower(path.Ext(p)); ext == "" || ext == ".html" || ext == ".htm" {
+		return uncachedClass
+	}
+
+	if version := versionFromReq(r); !s.isImmutableVersion(owner, project, version) {
+		return uncachedClass
+	}
+
+	// the docs of releases can be rebuilt too, so only the URLs that change
+	// with the contents, such as the ones of AssetHashes, are immutable.
+	if busted {
+		return hashedAssetsClass
+	}
+	return assetsClass
+}
+
+// isImmutableVersion reports whether the docs of the given installed version
+// only change when they are rebuilt on purpose, unlike the ones of branches,
+// pull requests and refs, which are rebuilt as they change.
+func (s *Service) isImmutableVersion(owner, project, version string) bool {
+	conf, _ := s.config().ForProject(owner, project)
+	if _, ok := pullRequestNumber(version); ok || conf.hasBranch(version) {
+		return false
+	}
+
+	installed, ok := s.index.installation(owner, project, version)
+	return ok && installed.ref == ""
+}
+
+// withCacheControl returns the given response writer setting the
+// Cache-Control header of the class of the path of the given request, if it
+// has one, unless the handler sets its own. The request had a cache busting
+// parameter, already stripped, if busted is true.
+func (s *Service) withCacheControl(w http.ResponseWriter, r *http.Request, busted bool) http.ResponseWriter {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		return w
+	}
+
+	class := s.cacheClassFor(r, owner, project, busted)
+	value := s.forHost(r.Host).cacheControl(class)
+	if value == "" {
+		return w
+	}
+
+	return &cacheControlWriter{ResponseWriter: w, class: class, value: value}
+}
+
+// cacheControlWriter sets the Cache-Control header of a class of paths to
+// the responses that can be cached: the redirects of the redirects class and
+// the successful responses of the rest. Errors are never cached.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	class       cacheClass
+	value       string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Cache-Control") == "" && w.cacheable(status) {
+			w.Header().Set("Cache-Control", w.value)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// cacheable reports whether the response with the given status is cached.
+func (w *cacheControlWriter) cacheable(status int) bool {
+	if w.class == redirectsClass {
+		return status >= 300 && status < 400 && status != http.StatusNotModified
+	}
+	return status < 300 || status == http.StatusNotModified
+}
+
+// Flush sends any buffered data to the client, if the underlying response
+// writer supports it.
+func (w *cacheControlWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer, so the write deadline of the
+// connection can be set through it.
+func (w *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,84 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheControl(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.addBranch("bar", "foo", "master", "", "abc")
+	fetcher.add("bar", "baz", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", Branches: []string{"master"}},
+		"baz.bar": ProjectConfig{Repository: "bar/baz", CacheControl: CacheControlConfig{
+			Redirects: "no-cache",
+			Versions:  noCacheControl,
+		}},
+		"qux.bar": ProjectConfig{Repository: "bar/qux"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.ServeStatic = true
+
+	for _, v := range []string{"v1.0.0", "master"} {
+		folder := srv.versionFolder("bar", "foo", v)
+		require.NoError(os.MkdirAll(folder, 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(folder, "index.html"), []byte("foo"), 0644))
+		require.NoError(ioutil.WriteFile(filepath.Join(folder, "style.css"), []byte("foo"), 0644))
+		srv.index.install(buildConfig{owner: "bar", project: "foo", version: v})
+	}
+	srv.LinkHosts()
+
+	cases := []struct {
+		url    string
+		code   int
+		header string
+	}{
+		{"http://foo.bar/versions.json", http.StatusOK, defaultVersionsCacheControl},
+		{"http://foo.bar/latest/", http.StatusTemporaryRedirect, defaultRedirectsCacheControl},
+		{"http://foo.bar/", http.StatusTemporaryRedirect, defaultRedirectsCacheControl},
+		{"http://foo.bar/v1.0.0/style.css", http.StatusOK, defaultAssetsCacheControl},
+		{"http://foo.bar/v1.0.0/style.css?v=abc123", http.StatusOK, defaultHashedAssetsCacheControl},
+		{"http://foo.bar/v1.0.0/", http.StatusOK, ""},
+		{"http://foo.bar/master/style.css", http.StatusOK, ""},
+		{"http://foo.bar/master/style.css?v=abc123", http.StatusOK, ""},
+		{"http://foo.bar/api/versions/v1.0.0/status", http.StatusOK, "no-cache"},
+		{"http://baz.bar/latest/", http.StatusTemporaryRedirect, "no-cache"},
+		{"http://baz.bar/versions.json", http.StatusOK, ""},
+		// errors are never cached
+		{"http://qux.bar/latest/", http.StatusNotFound, "no-store"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		require.Equal(c.code, w.Code, c.url)
+		require.Equal(c.header, w.Header().Get("Cache-Control"), c.url)
+	}
+}
+
+func TestProjectConfigCacheControl(t *testing.T) {
+	require := require.New(t)
+	conf := ProjectConfig{CacheControl: CacheControlConfig{Assets: "public, max-age=3600"}}
+	require.Equal("public, max-age=3600", conf.cacheControl(assetsClass))
+	require.Equal("public, max-age=3600", conf.cacheControl(hashedAssetsClass))
+	require.Equal(defaultRedirectsCacheControl, conf.cacheControl(redirectsClass))
+	require.Equal("", conf.cacheControl(uncachedClass))
+
+	conf = ProjectConfig{Auth: &AuthConfig{}}
+	require.Equal("private, max-age=600", conf.cacheControl(assetsClass))
+	require.Equal("private, max-age=31536000, immutable", conf.cacheControl(hashedAssetsClass))
+	require.Equal("private, max-age=60", conf.cacheControl(versionsClass))
+}
@@ -0,0 +1,46 @@
+package docsrv
+
+import "net/http"
+
+// canonicalURL returns the URL the given request should be redirected to so
+// the docs are always served under the same host and scheme, or an empty
+// string if the request already uses them. Host names are case-insensitive,
+// so the canonical host is the normalized one, without the "www." prefix if
+// the host without it serves it, and the canonical scheme is HTTPS for the
+// hosts with the ForceHTTPS option.
+func (s *Service) canonicalURL(r *http.Request) string {
+	host := s.canonicalHost(r.Host)
+	scheme := reqScheme(r)
+	if s.forHost(host).ForceHTTPS && scheme != "https" {
+		scheme = "https"
+		// the port of the plain HTTP server is not the HTTPS one
+		host = stripPort(host)
+	}
+
+	if host == r.Host && scheme == reqScheme(r) {
+		return ""
+	}
+
+	// the host of the requests routed by path contains the path prefix, so
+	// it's not set in the URL, which would escape it.
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// redirectToCanonical redirects permanently the request to its canonical URL
+// if it does not use it already. Reports whether or not it was redirected.
+func (s *Service) redirectToCanonical(w http.ResponseWriter, r *http.Request) bool {
+	url := s.canonicalURL(r)
+	if url == "" {
+		return false
+	}
+
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// keep the method and body of the request
+		code = http.StatusPermanentRedirect
+	}
+
+	requestLog(r).Debugf("redirecting to canonical URL %s", url)
+	http.Redirect(w, r, url, code)
+	return true
+}
@@ -0,0 +1,63 @@
+package docsrv
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirectToCanonical(t *testing.T) {
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":    ProjectConfig{Repository: "org/foo"},
+		"safe.bar":   ProjectConfig{Repository: "org/foo", ForceHTTPS: true},
+		"www.bar":    ProjectConfig{Repository: "org/foo", AllowWWW: true},
+		"bücher.bar": ProjectConfig{Repository: "org/foo"},
+	})
+
+	cases := []struct {
+		method   string
+		url      string
+		header   string
+		tls      bool
+		code     int
+		location string
+	}{
+		{"GET", "http://Foo.BAR/latest/?a=b", "", false, http.StatusMovedPermanently, "http://foo.bar/latest/?a=b"},
+		{"GET", "http://FOO.bar:8080/v1.0.0/", "", false, http.StatusMovedPermanently, "http://foo.bar:8080/v1.0.0/"},
+		{"GET", "http://foo.bar/latest/", "", false, http.StatusTemporaryRedirect, "http://foo.bar/v1.0.0/"},
+		{"GET", "http://foo.bar.:8080/latest/", "", false, http.StatusMovedPermanently, "http://foo.bar:8080/latest/"},
+		{"GET", "http://www.www.bar/latest/", "", false, http.StatusMovedPermanently, "http://www.bar/latest/"},
+		{"GET", "http://www.foo.bar/latest/", "", false, http.StatusNotFound, ""},
+		{"GET", "http://BÜCHER.bar/latest/", "", false, http.StatusMovedPermanently, "http://xn--bcher-kva.bar/latest/"},
+		{"GET", "http://xn--bcher-kva.bar/latest/", "", false, http.StatusTemporaryRedirect, "http://xn--bcher-kva.bar/v1.0.0/"},
+		{"GET", "http://safe.bar/latest/", "", false, http.StatusMovedPermanently, "https://safe.bar/latest/"},
+		{"GET", "http://Safe.bar:8080/latest/", "", false, http.StatusMovedPermanently, "https://safe.bar/latest/"},
+		{"POST", "http://safe.bar/api/webhook", "", false, http.StatusPermanentRedirect, "https://safe.bar/api/webhook"},
+		{"GET", "http://safe.bar/latest/", "https", false, http.StatusTemporaryRedirect, "https://safe.bar/v1.0.0/"},
+		{"GET", "http://safe.bar/latest/", "", true, http.StatusTemporaryRedirect, "https://safe.bar/v1.0.0/"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		// requests received by a server have no scheme in the URL
+		req.URL.Scheme = ""
+		if c.header != "" {
+			req.Header.Set("X-Forwarded-Proto", c.header)
+		}
+		if !c.tls {
+			req.TLS = nil
+		} else {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		require.Equal(t, c.code, w.Code, c.url)
+		require.Equal(t, c.location, w.Header().Get("Location"), c.url)
+	}
+}
@@ -0,0 +1,231 @@
+package docsrv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupCPUPeriod is the period, in microseconds, of the CPU limit of
+	// the builds.
+	cgroupCPUPeriod = 100000
+	// cgroupRemoveTimeout is the time given to the processes of a finished
+	// build to exit once killed, before its cgroup is removed.
+	cgroupRemoveTimeout = time.Second
+)
+
+// buildCgroups limits the memory and CPU of the builds by running every one
+// of them in a cgroup v2 of its own, created inside a cgroup delegated to
+// docsrv, so a heavy build can not starve the server. The builds killed for
+// exceeding the memory limit are reported in their logs. A nil one runs the
+// builds without limits.
+type buildCgroups struct {
+	parent string
+	// memory is the maximum memory of a build, in bytes, if any.
+	memory int64
+	// cpus is the maximum number of CPUs used by a build, if any.
+	cpus float64
+}
+
+// newBuildCgroups returns the cgroups of the builds inside the given cgroup,
+// which is either an absolute path or a path relative to the cgroup v2
+// hierarchy, with the given limits. It returns nil if the parent cgroup is
+// empty.
+func newBuildCgroups(parent string, memory int64, cpus float64) (*buildCgroups, error) {
+	if memory < 0 {
+		return nil, fmt.Errorf("invalid build memory limit: %d", memory)
+	}
+
+	if cpus < 0 {
+		return nil, fmt.Errorf("invalid build CPU limit: %g", cpus)
+	}
+
+	if parent == "" {
+		if memory > 0 || cpus > 0 {
+			return nil, fmt.Errorf("a build cgroup is required to limit the resources of the builds")
+		}
+		return nil, nil
+	}
+
+	if !filepath.IsAbs(parent) {
+		parent = filepath.Join(cgroupRoot, parent)
+	}
+
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("invalid build cgroup %q: it's not a cgroup v2", parent)
+	}
+
+	return &buildCgroups{parent, memory, cpus}, nil
+}
+
+// controllers returns the controllers enabled in the cgroups of the builds,
+// in the format of cgroup.subtree_control.
+func (c *buildCgroups) controllers() string {
+	var controllers []string
+	if c.memory > 0 {
+		controllers = append(controllers, "+memory")
+	}
+
+	if c.cpus > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	return strings.Join(controllers, " ")
+}
+
+// create creates the cgroup of a new build with the limits and returns its
+// path.
+func (c *buildCgroups) create() (string, error) {
+	if controllers := c.controllers(); controllers != "" {
+		if err := writeCgroupFile(c.parent, "cgroup.subtree_control", controllers); err != nil {
+			return "", wrap(err, "error enabling the controllers of the build cgroup")
+		}
+	}
+
+	path, err := ioutil.TempDir(c.parent, "docsrv-build-")
+	if err != nil {
+		return "", wrap(err, "error creating build cgroup")
+	}
+
+	if c.memory > 0 {
+		err = writeCgroupFile(path, "memory.max", strconv.FormatInt(c.memory, 10))
+		// the swap is not limited if the kernel does not account it.
+		if err == nil {
+			writeCgroupFile(path, "memory.swap.max", "0")
+		}
+	}
+
+	if err == nil && c.cpus > 0 {
+		quota := int64(c.cpus * cgroupCPUPeriod)
+		err = writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod))
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return "", wrap(err, "error limiting build cgroup")
+	}
+
+	return path, nil
+}
+
+// run runs the given command in a new cgroup and returns its combined
+// output, like exec.Cmd.CombinedOutput. If the cgroups are nil, the command
+// is run without limits. If the command is killed for exceeding the memory
+// limit, it's explained at the end of the output.
+func (c *buildCgroups) run(cmd *exec.Cmd) ([]byte, error) {
+	if c == nil {
+		return cmd.CombinedOutput()
+	}
+
+	path, err := c.create()
+	if err != nil {
+		return nil, err
+	}
+	defer removeCgroup(path)
+
+	output, err := runInCgroup(cmd, path)
+	if err != nil && cgroupOOMKills(path) > 0 {
+		output = append(output, fmt.Sprintf(
+			"\ndocsrv: the build was killed because it exceeded its memory limit of %d bytes\n",
+			c.memory,
+		)...)
+	}
+	return output, err
+}
+
+// runInCgroup runs the given command in the cgroup with the given path and
+// returns its combined output. The command is run by a shell that waits
+// until it has been moved to the cgroup to start it, so none of its
+// processes escapes the limits.
+func runInCgroup(cmd *exec.Cmd, path string) ([]byte, error) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	cmd.Args = append([]string{"sh", "-c", `read -r _ && exec "$0" "$@"`, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = sh
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	err = writeCgroupFile(path, "cgroup.procs", strconv.Itoa(cmd.Process.Pid))
+	if err != nil {
+		// the shell exits without running the command once its input is
+		// closed.
+		stdin.Close()
+		cmd.Wait()
+		return output.Bytes(), wrap(err, "error moving the build to its cgroup")
+	}
+
+	io.WriteString(stdin, "\n")
+	stdin.Close()
+	err = cmd.Wait()
+	return output.Bytes(), err
+}
+
+// cgroupOOMKills returns the number of processes of the cgroup with the
+// given path killed for exceeding its memory limit.
+func cgroupOOMKills(path string) int {
+	f, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// removeCgroup kills the processes left in the cgroup with the given path by
+// a finished build, if any, and removes it.
+func removeCgroup(path string) {
+	writeCgroupFile(path, "cgroup.kill", "1")
+
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := os.Remove(path)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			logrus.Warnf("could not remove build cgroup %s: %s", path, err)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeCgroupFile writes the given value to the given interface file of the
+// cgroup with the given path.
+func writeCgroupFile(path, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+}
@@ -0,0 +1,94 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBuildCgroups(t *testing.T) {
+	require := require.New(t)
+	parent, err := ioutil.TempDir("", "docsrv-cgroup-")
+	require.NoError(err)
+	defer os.RemoveAll(parent)
+
+	cgroups, err := newBuildCgroups("", 0, 0)
+	require.NoError(err)
+	require.Nil(cgroups)
+
+	_, err = newBuildCgroups("", 1<<20, 0)
+	require.Error(err)
+
+	_, err = newBuildCgroups(parent, -1, 0)
+	require.Error(err)
+
+	_, err = newBuildCgroups(parent, 0, -1)
+	require.Error(err)
+
+	_, err = newBuildCgroups(parent, 1<<20, 1)
+	require.Error(err, "not a cgroup v2")
+
+	require.NoError(ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte("cpu memory"), 0644))
+	cgroups, err = newBuildCgroups(parent, 1<<20, 0.5)
+	require.NoError(err)
+	require.Equal(&buildCgroups{parent, 1 << 20, 0.5}, cgroups)
+
+	cgroups, err = newBuildCgroups("docsrv", 0, 0)
+	require.Error(err)
+	require.Nil(cgroups)
+}
+
+func TestBuildCgroupsRun(t *testing.T) {
+	require := require.New(t)
+	var cgroups *buildCgroups
+	output, err := cgroups.run(exec.Command("echo", "foo"))
+	require.NoError(err)
+	require.Equal("foo\n", string(output))
+
+	// a regular folder stands for the cgroup, whose interface files are
+	// written by the build.
+	parent, err := ioutil.TempDir("", "docsrv-cgroup-")
+	require.NoError(err)
+	defer os.RemoveAll(parent)
+	require.NoError(ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), nil, 0644))
+
+	cgroups, err = newBuildCgroups(parent, 1<<20, 0.5)
+	require.NoError(err)
+
+	output, err = cgroups.run(exec.Command("echo", "foo"))
+	require.NoError(err)
+	require.Equal("foo\n", string(output))
+
+	cmd := exec.Command("sh", "-c", `for d in "$0"/docsrv-build-*; do echo "oom_kill 1" > "$d/memory.events"; done; echo bar; exit 1`, parent)
+	output, err = cgroups.run(cmd)
+	require.Error(err)
+	require.Contains(string(output), "bar\n")
+	require.Contains(string(output), "killed because it exceeded its memory limit of 1048576 bytes")
+
+	content, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	require.NoError(err)
+	require.Equal("+memory +cpu", string(content))
+
+	builds, err := filepath.Glob(filepath.Join(parent, "docsrv-build-*"))
+	require.NoError(err)
+	require.Len(builds, 2)
+	for _, build := range builds {
+		content, err := ioutil.ReadFile(filepath.Join(build, "memory.max"))
+		require.NoError(err)
+		require.Equal("1048576", string(content))
+
+		content, err = ioutil.ReadFile(filepath.Join(build, "cpu.max"))
+		require.NoError(err)
+		require.Equal("50000 100000", string(content))
+
+		content, err = ioutil.ReadFile(filepath.Join(build, "cgroup.procs"))
+		require.NoError(err)
+		_, err = strconv.Atoi(string(content))
+		require.NoError(err)
+	}
+}
@@ -3,7 +3,11 @@ package docsrv
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -15,15 +19,84 @@ type Config map[string]ProjectConfig
 
 // ProjectForHost will returns the owner and repository name of the project
 // in the given host. Will also report whether or not the project could be found
-// with a boolean.
+// with a boolean. The name of the projects in a subfolder of their repository
+// is followed by their docs path, see ProjectConfig.DocsPath.
 // The host will have its port, if any, stripped.
 func (c Config) ProjectForHost(host string) (owner, repo string, ok bool) {
-	proj, ok := c[stripPort(host)]
+	key, ok := c.hostKey(host)
 	if !ok {
 		return "", "", false
 	}
+	proj := c[key]
 
-	parts := strings.Split(proj.Repository, "/")
+	return splitRepository(proj.projectKey())
+}
+
+// docsPathSeparator separates the name of the repository of a project from
+// its docs path in the name of the projects in a subfolder of their
+// repository, e.g. "monorepo@services%2Ffoo%2Fdocs". It can't be part of the
+// name of a repository.
+const docsPathSeparator = "@"
+
+// projectKey returns the project of the config in the format
+// "${OWNER}/${PROJECT}", where the project is the name of the repository
+// followed by the escaped docs path, if any, so every subfolder of a
+// repository is a project of its own.
+func (c ProjectConfig) projectKey() string {
+	docsPath := cleanDocsPath(c.DocsPath)
+	if docsPath == "" {
+		return c.Repository
+	}
+	return c.Repository + docsPathSeparator + url.PathEscape(docsPath)
+}
+
+// cleanDocsPath returns the given docs path without leading or trailing
+// slashes, and empty if it's the root of the repository.
+func cleanDocsPath(docsPath string) string {
+	docsPath = strings.Trim(path.Clean("/"+docsPath), "/")
+	if docsPath == "." {
+		return ""
+	}
+	return docsPath
+}
+
+// repositoryName returns the name of the repository of the given project,
+// without its docs path.
+func repositoryName(project string) string {
+	return strings.SplitN(project, docsPathSeparator, 2)[0]
+}
+
+// repositoryKey returns the repository of the given project in the format
+// "${OWNER}/${PROJECT}".
+func repositoryKey(owner, project string) string {
+	return newKey(owner, repositoryName(project))
+}
+
+// ProjectsForRepository returns the projects of the given repository, which
+// are several if their docs are in different folders of it.
+func (c Config) ProjectsForRepository(owner, repo string) []string {
+	seen := make(map[string]bool)
+	var projects []string
+	for _, conf := range c {
+		if conf.Repository != newKey(owner, repo) {
+			continue
+		}
+
+		_, project, ok := splitRepository(conf.projectKey())
+		if ok && !seen[project] {
+			seen[project] = true
+			projects = append(projects, project)
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// splitRepository returns the owner and name of the given repository in the
+// format "${OWNER}/${PROJECT}". Will also report whether or not the
+// repository has that format with a boolean.
+func splitRepository(repository string) (owner, repo string, ok bool) {
+	parts := strings.Split(repository, "/")
 	if len(parts) != 2 {
 		return "", "", false
 	}
@@ -33,25 +106,356 @@ func (c Config) ProjectForHost(host string) (owner, repo string, ok bool) {
 
 // MinVersionForHost will return the minimum version for a project at the
 // given host.
-// It will return nil if no such host can be found or if the version is not
-// valid or is missing.
+// It will return nil if no such host can be found, if the version is not
+// valid or is missing or if the project does not use semantic versions.
 // The host will have its port, if any, stripped.
 func (c Config) MinVersionForHost(host string) *semver.Version {
-	project, ok := c[stripPort(host)]
+	key, ok := c.hostKey(host)
+	if project := c[key]; !ok || !project.isSemver() {
+		return nil
+	}
+
+	return newVersion(c[key].MinVersion)
+}
+
+// MaxVersionForHost will return the maximum version for a project at the
+// given host.
+// It will return nil if no such host can be found, if the version is not
+// valid or is missing or if the project does not use semantic versions.
+// The host will have its port, if any, stripped.
+func (c Config) MaxVersionForHost(host string) *maxVersion {
+	key, ok := c.hostKey(host)
+	if !ok {
+		return nil
+	}
+	return c[key].maxVersion()
+}
+
+// maxVersion returns the maximum version of the project, or nil if it has
+// none or it does not use semantic versions.
+func (c ProjectConfig) maxVersion() *maxVersion {
+	if !c.isSemver() {
+		return nil
+	}
+	return newMaxVersion(c.MaxVersion)
+}
+
+// ForProject returns the configuration of the given project, the one of its
+// first host in alphabetical order if several serve it. Will also report
+// whether or not the project could be found with a boolean.
+func (c Config) ForProject(owner, project string) (ProjectConfig, bool) {
+	hosts := c.HostsForProject(owner, project)
+	if len(hosts) == 0 {
+		return ProjectConfig{}, false
+	}
+	return c[hosts[0]], true
+}
+
+// QuotaForOwner returns the quota of the projects of the given owner, set in
+// any of their hosts, or nil if there is none.
+func (c Config) QuotaForOwner(owner string) *QuotaConfig {
+	host, ok := c.quotaHost(owner)
 	if !ok {
 		return nil
 	}
+	return c[host].Quota
+}
+
+// quotaHost returns the first host, in alphabetical order, of the projects of
+// the given owner that sets their quota. Will also report whether or not
+// there is any.
+func (c Config) quotaHost(owner string) (string, bool) {
+	var hosts []string
+	for host, conf := range c {
+		if o, _, ok := splitRepository(conf.Repository); ok && o == owner && conf.Quota != nil {
+			hosts = append(hosts, host)
+		}
+	}
 
-	return newVersion(project.MinVersion)
+	if len(hosts) == 0 {
+		return "", false
+	}
+
+	sort.Strings(hosts)
+	return hosts[0], true
+}
+
+// HostsForProject returns all the hosts that serve the given project.
+func (c Config) HostsForProject(owner, project string) []string {
+	repository := newKey(owner, project)
+	var hosts []string
+	for host, conf := range c {
+		if conf.projectKey() == repository {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
 }
 
 // ProjectConfig represents a single project configuration.
 type ProjectConfig struct {
 	// Repository is the repository this project maps to in the format "${OWNER}/${PROJECT}".
 	Repository string `toml:"repository"`
+	// Provider is where the repository is hosted, GitHubProvider or
+	// BitbucketProvider. Defaults to GitHubProvider.
+	Provider string `toml:"provider"`
+	// DocsPath is the folder of the repository, e.g. "services/foo/docs",
+	// where "make docs" is run instead of its root, for the repositories
+	// with the docs of several projects. The hosts of the same repository
+	// with different docs paths serve different projects.
+	DocsPath string `toml:"docs-path"`
 	// MinVersion is the minimum version of this project for which documentation
 	// sites can be built.
 	MinVersion string `toml:"min-version"`
+	// VersionScheme is the scheme of the tags of the releases, SemverScheme,
+	// CalverScheme or LexicographicScheme, used to sort them, resolve the
+	// latest one and filter them by MinVersion. Defaults to SemverScheme.
+	VersionScheme string `toml:"version-scheme"`
+	// MaxVersion is the maximum version of this project for which
+	// documentation sites can be built in this host. Versions are compared
+	// with the precision of MaxVersion, so "v2" allows all the v2.x.x
+	// versions, "v2.1" all the v2.1.x ones and "v2.1.0" only up to v2.1.0.
+	MaxVersion string `toml:"max-version"`
+	// DeprecateBefore is the version before which the versions of the
+	// project are outdated. The pages of the older versions get a banner
+	// pointing to the latest version when they are built.
+	DeprecateBefore string `toml:"deprecate-before"`
+	// DeprecationMessage is the text of the banner of the outdated versions.
+	// "{version}" is replaced by the version of the docs and "{latest}" by
+	// a link to the latest version. Defaults to defaultDeprecationMessage.
+	DeprecationMessage string `toml:"deprecation-message"`
+	// DefaultVersion is the version the root of the host redirects to. It
+	// can be a release or one of the Branches. Defaults to the latest
+	// version.
+	DefaultVersion string `toml:"default-version"`
+	// AllowWWW also serves the docs at the host prefixed by "www.", whose
+	// requests are redirected permanently to the host without it.
+	AllowWWW bool `toml:"allow-www"`
+	// Aliases are other hosts that serve the same docs as the host, from the
+	// same installed versions, while the URLs of the docs keep using the
+	// host, which is their canonical one.
+	Aliases []string `toml:"aliases"`
+	// ExcludeVersions is a list of patterns of the tags of the releases that
+	// will not be served, e.g. broken or yanked releases. Patterns are globs,
+	// such as "v2.0.*", or regular expressions if they are enclosed in
+	// slashes, such as "/^v2\.0\.0-rc/".
+	ExcludeVersions []string `toml:"exclude-versions"`
+	// Languages are the languages of the docs of the project, if they are
+	// localized, e.g. ["en", "es"]. The docs of every language must be in a
+	// folder with its name at the root of the docs. The root of the site and
+	// of the latest version redirect to the language preferred by the user,
+	// or to the first one if none of them is.
+	Languages []string `toml:"languages"`
+	// TokenEnv is the name of the environment variable with the token of the
+	// provider used to fetch the releases of the project instead of the
+	// global one, e.g. a fine-grained token with access to its repository
+	// only.
+	TokenEnv string `toml:"token-env"`
+	// TokenFile is the path of the file with the token of the provider used
+	// to fetch the releases of the project instead of the global one. It can
+	// not be set along with TokenEnv.
+	TokenFile string `toml:"token-file"`
+	// Archive is the archive of the sources of the releases generated by
+	// GitHub the docs are built from, TarballArchive or ZipballArchive.
+	// Defaults to TarballArchive.
+	Archive string `toml:"archive"`
+	// SourceAsset is the name of the release asset with the sources the
+	// docs are built from instead of the archive generated by GitHub, e.g.
+	// "docs.tar.xz". It can be a .zip or a .tar compressed with gzip, bzip2
+	// or xz.
+	SourceAsset string `toml:"source-asset"`
+	// AssetPattern is the pattern of the name of the release asset with the
+	// sources the docs are built from, for releases with a different name
+	// for it in every release, e.g. "docs-*.tar.gz". It's a glob or a
+	// regular expression enclosed in slashes, and the first matching asset
+	// in alphabetical order is used. Releases without any matching asset are
+	// built from the archive generated by GitHub. It can not be used with
+	// SourceAsset.
+	AssetPattern string `toml:"asset-pattern"`
+	// ChecksumAsset is the name of the release asset with the SHA-256
+	// checksum of the sources, in the format of sha256sum, e.g.
+	// "SHA256SUMS". If it's set, the releases without it or whose sources
+	// do not match it are not built.
+	ChecksumAsset string `toml:"checksum-asset"`
+	// PruneOldVersions enables deleting the docs of the versions older than
+	// MinVersion when it's raised and the config is reloaded, the same way
+	// the min-version API does.
+	PruneOldVersions bool `toml:"prune-old-versions"`
+	// Branches is a list of branches of the repository whose documentation
+	// will be built and served along with the one of the releases. They will
+	// be rebuilt every time their HEAD changes.
+	Branches []string `toml:"branches"`
+	// CustomDomains enables the registration of the additional domains
+	// declared by the project in the docsrv.toml file at the root of its
+	// latest release.
+	CustomDomains bool `toml:"custom-domains"`
+	// AssetHashes enables appending the hash of their contents to the URLs
+	// of the CSS and JS files referenced in the built documentation.
+	AssetHashes bool `toml:"asset-hashes"`
+	// Prereleases enables serving the docs of the releases marked as
+	// prereleases. They are never considered the latest version, but the
+	// newest one is available at /next/.
+	Prereleases bool `toml:"prereleases"`
+	// Frozen disables fetching the releases of the project from GitHub, so
+	// archived projects are only served from the docs already installed and
+	// the versions that are not installed are never built, even if their
+	// tags are deleted upstream.
+	Frozen bool `toml:"frozen"`
+	// PullRequests enables building previews of the docs of open pull
+	// requests under /pr-${NUMBER}/.
+	PullRequests bool `toml:"pull-requests"`
+	// PullRequestAuthors and PullRequestLabels are the users and the labels
+	// of the pull requests opened from forks that are built too. Building a
+	// pull request runs its code, so the rest of pull requests from forks
+	// are never built.
+	PullRequestAuthors []string `toml:"pull-request-authors"`
+	PullRequestLabels  []string `toml:"pull-request-labels"`
+	// SharedFiles is a list of files, relative to the shared folder, that
+	// must exist for the docs of the project to be built.
+	SharedFiles []string `toml:"shared-files"`
+	// SharedVersion is a semver constraint, e.g. "^2.0", of the version of
+	// the shared assets required by the project. The docs are built with
+	// the folder of the greatest version that satisfies it, e.g. "v2.1.0",
+	// inside the folder of the project in the shared folder or, if it has
+	// none, inside the shared folder.
+	SharedVersion string `toml:"shared-version"`
+	// BuildEnv are environment variables added to the build of every
+	// version, e.g. theme flags or analytics IDs. "{version}" and "{host}"
+	// in their values are replaced by the version built and the host it's
+	// built for. They can not override the variables set by docsrv.
+	BuildEnv map[string]string `toml:"build-env"`
+	// CanonicalLinks enables adding to the pages of the versions older than
+	// the latest one a canonical link to the same page in the latest version.
+	CanonicalLinks bool `toml:"canonical-links"`
+	// OfflineBundles are the kinds of offline bundles, ZipBundle,
+	// TarGzBundle or PDFBundle, generated for every version and available
+	// for download under /${VERSION}/download/, as well as in
+	// /${VERSION}/offline.zip, /${VERSION}/offline.tar.gz and
+	// /${VERSION}/docs.pdf.
+	OfflineBundles []string `toml:"offline-bundles"`
+	// PDFCommand is the command used to convert the HTML pages of the docs
+	// of the project to the PDF bundles, overriding the global one.
+	PDFCommand string `toml:"pdf-command"`
+	// PrefetchAdjacent enables building in the background the versions right
+	// before and after a version once it's built.
+	PrefetchAdjacent bool `toml:"prefetch-adjacent"`
+	// Preinstall are the versions built at startup, before docsrv starts
+	// serving requests, so they are available as soon as it's deployed.
+	Preinstall []string `toml:"preinstall"`
+	// ForceHTTPS enables redirecting permanently the plain HTTP requests to
+	// the host to HTTPS.
+	ForceHTTPS bool `toml:"force-https"`
+	// BuildWebhooks are the webhooks notified when a version of the project
+	// is built or its build fails.
+	BuildWebhooks []WebhookConfig `toml:"build-webhooks"`
+	// NoIndex excludes the docs of the host from search engines.
+	NoIndex bool `toml:"no-index"`
+	// Auth is the authentication required to access the docs of the project.
+	// If it's nil, the docs are public.
+	Auth *AuthConfig `toml:"auth"`
+	// CacheControl overrides the default Cache-Control headers of the
+	// responses of the host.
+	CacheControl CacheControlConfig `toml:"cache-control"`
+	// TraceSampleRate is the fraction of the requests to the host that are
+	// traced, overriding the global sample rate.
+	TraceSampleRate *float64 `toml:"trace-sample-rate"`
+	// TraceBuilds overrides whether or not the requests to the host that
+	// trigger a build are always traced.
+	TraceBuilds *bool `toml:"trace-builds"`
+	// Maintenance puts the host into maintenance mode: its requests get a
+	// 503 page and its builds are paused until it's taken out of it.
+	Maintenance bool `toml:"maintenance"`
+	// MaintenanceMessage is the message shown to the users of the host while
+	// it's in maintenance mode, instead of the default one.
+	MaintenanceMessage string `toml:"maintenance-message"`
+	// Quota limits the resources used by all the projects of the owner of
+	// the repository. It only needs to be set in one of the hosts of the
+	// owner, and it must be the same in all the hosts that set it. If it's
+	// nil, the projects of the owner are not limited.
+	Quota *QuotaConfig `toml:"quota"`
+	// DeletedReleases is what is done with the installed docs of the
+	// releases deleted from GitHub, OrphanDeletedReleases or
+	// EvictDeletedReleases. Defaults to OrphanDeletedReleases.
+	DeletedReleases string `toml:"deleted-releases"`
+}
+
+// QuotaConfig is the quota of the projects of an owner, so a single noisy
+// project can't exhaust the instance. A limit of 0 means no limit.
+type QuotaConfig struct {
+	// BuildsPerHour is the maximum number of builds of the projects of the
+	// owner started in the last hour.
+	BuildsPerHour int `toml:"builds-per-hour"`
+	// MaxDiskUsage is the maximum size in bytes of the installed docs of the
+	// projects of the owner. No version is built once it's reached.
+	MaxDiskUsage int64 `toml:"max-disk-usage"`
+	// MaxConcurrentBuilds is the maximum number of builds of the projects of
+	// the owner running at the same time. The rest wait in the build queue.
+	MaxConcurrentBuilds int `toml:"max-concurrent-builds"`
+}
+
+const (
+	// GitHubAuth authenticates users with GitHub OAuth, optionally requiring
+	// them to be members of an organization.
+	GitHubAuth = "github"
+	// OIDCAuth authenticates users with a generic OpenID Connect provider.
+	OIDCAuth = "oidc"
+)
+
+// AuthConfig is the configuration of the authentication required to access
+// the docs of a project.
+type AuthConfig struct {
+	// Provider is the kind of authentication provider, GitHubAuth or OIDCAuth.
+	Provider string `toml:"provider"`
+	// ClientID is the OAuth client ID of docsrv in the provider.
+	ClientID string `toml:"client-id"`
+	// ClientSecret is the OAuth client secret of docsrv in the provider.
+	ClientSecret string `toml:"client-secret"`
+	// Organization is the GitHub organization users must be active members
+	// of. If it's empty, any GitHub user is allowed.
+	Organization string `toml:"organization"`
+	// AuthURL is the authorization endpoint of the provider. Defaults to the
+	// one of GitHub for the GitHub provider.
+	AuthURL string `toml:"auth-url"`
+	// TokenURL is the token endpoint of the provider. Defaults to the one of
+	// GitHub for the GitHub provider.
+	TokenURL string `toml:"token-url"`
+	// Issuer is the issuer of the ID tokens of the OIDC provider, which
+	// must match their "iss" claim.
+	Issuer string `toml:"issuer"`
+	// JWKSURL is the URL of the JWKS of the OIDC provider, with the keys
+	// the signatures of its ID tokens are verified with.
+	JWKSURL string `toml:"jwks-url"`
+	// UserInfoURL is the userinfo endpoint of the OIDC provider. If it's
+	// empty, the email of the users is taken from their ID token.
+	UserInfoURL string `toml:"userinfo-url"`
+	// APIURL is the URL of the GitHub API used to check the organization
+	// membership. Defaults to https://api.github.com/.
+	APIURL string `toml:"api-url"`
+	// EmailDomains is a list of domains the verified email of OIDC users
+	// must belong to. If it's empty, any user is allowed.
+	EmailDomains []string `toml:"email-domains"`
+}
+
+// repoConfigFile is the file at the root of a repository in which a project
+// can provide its own configuration.
+const repoConfigFile = "docsrv.toml"
+
+// repoConfig is the configuration provided by a project in its repository.
+type repoConfig struct {
+	// Domains is a list of additional domains the project docs will be served
+	// at. Each domain needs to have a TXT record in _docsrv.${DOMAIN} with
+	// the value "docsrv=${OWNER}/${PROJECT}" to be accepted.
+	Domains []string `toml:"domains"`
+}
+
+// parseRepoConfig parses the configuration provided by a project.
+func parseRepoConfig(data []byte) (*repoConfig, error) {
+	var conf repoConfig
+	if err := toml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %s: %s", repoConfigFile, err)
+	}
+	return &conf, nil
 }
 
 // LoadConfig loads the config from the given file.
@@ -68,10 +472,153 @@ func LoadConfig(file string) (Config, error) {
 		return nil, fmt.Errorf("unable to unmarshal yaml from config file: %s", err)
 	}
 
+	for host, conf := range config {
+		for _, p := range conf.ExcludeVersions {
+			if _, err := matchVersionPattern(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid exclude-versions pattern %q of %s: %s", p, host, err)
+			}
+		}
+
+		if _, err := conf.token(); err != nil {
+			return nil, fmt.Errorf("invalid token of %s: %s", host, err)
+		}
+
+		switch conf.Archive {
+		case "", TarballArchive, ZipballArchive:
+		default:
+			return nil, fmt.Errorf("invalid archive %q of %s", conf.Archive, host)
+		}
+
+		switch conf.Provider {
+		case "", GitHubProvider, BitbucketProvider:
+		default:
+			return nil, fmt.Errorf("invalid provider %q of %s", conf.Provider, host)
+		}
+
+		if conf.Auth != nil {
+			if errs := conf.Auth.validate(); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid auth of %s: %s", host, errs[0])
+			}
+		}
+
+		for _, hook := range conf.BuildWebhooks {
+			if err := hook.validate(); err != nil {
+				return nil, fmt.Errorf("invalid build webhook of %s: %s", host, err)
+			}
+		}
+	}
+
 	return config, nil
 }
 
+// token returns the token of the provider of the project from the
+// environment variable in TokenEnv or the file in TokenFile. If neither is
+// set, the token is empty.
+func (c ProjectConfig) token() (string, error) {
+	switch {
+	case c.TokenEnv != "" && c.TokenFile != "":
+		return "", fmt.Errorf("token-env and token-file can not be both set")
+	case c.TokenEnv != "":
+		token := os.Getenv(c.TokenEnv)
+		if token == "" {
+			return "", fmt.Errorf("environment variable %s is empty", c.TokenEnv)
+		}
+		return token, nil
+	case c.TokenFile != "":
+		data, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", err
+		}
+
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("token file %s is empty", c.TokenFile)
+		}
+		return token, nil
+	default:
+		return "", nil
+	}
+}
+
+// tokens returns the tokens of the projects hosted in the given provider that
+// have their own token, in the form of ${owner}/${project}. The tokens that
+// can not be read are returned as errors.
+func (c Config) tokens(provider string) (map[string]string, []error) {
+	var hosts []string
+	for host := range c {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	tokens := make(map[string]string)
+	var errs []error
+	for _, host := range hosts {
+		owner, project, ok := splitRepository(c[host].Repository)
+		if !ok || c[host].provider() != provider {
+			continue
+		}
+
+		token, err := c[host].token()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid token of %s: %s", host, err))
+			continue
+		}
+
+		// the projects served in several hosts use the token of the first
+		// one that has it.
+		key := newKey(owner, project)
+		if _, ok := tokens[key]; !ok && token != "" {
+			tokens[key] = token
+		}
+	}
+
+	return tokens, errs
+}
+
+// ExcludesVersion reports whether or not the given tag matches any of the
+// ExcludeVersions patterns of the project. Invalid patterns match nothing.
+func (c ProjectConfig) ExcludesVersion(tag string) bool {
+	for _, p := range c.ExcludeVersions {
+		if ok, _ := matchVersionPattern(p, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBranch reports whether or not the given branch is one of the Branches of
+// the project.
+func (c ProjectConfig) hasBranch(name string) bool {
+	for _, b := range c.Branches {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchVersionPattern reports whether the given tag matches the given
+// pattern, which is a regular expression if it's enclosed in slashes and a
+// glob otherwise.
+func matchVersionPattern(pattern, tag string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(tag), nil
+	}
+
+	return path.Match(pattern, tag)
+}
+
 func stripPort(hostport string) string {
+	// the hosts of the projects served under a path prefix are followed by
+	// it.
+	if host, prefix := splitPathPrefix(hostport); prefix != "" {
+		return stripPort(host) + prefix
+	}
+
 	colon := strings.IndexByte(hostport, ':')
 	if colon == -1 {
 		return hostport
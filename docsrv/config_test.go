@@ -2,6 +2,7 @@ package docsrv
 
 import (
 	"io/ioutil"
+	"os"
 	"testing"
 
 	toml "github.com/BurntSushi/toml"
@@ -11,10 +12,10 @@ import (
 func TestProjectForHost(t *testing.T) {
 	require := require.New(t)
 	conf := Config{
-		"foo.bar.baz": {"", ""},
-		"bar.bar.baz": {"foo", ""},
-		"baz.bar.baz": {"foo/bar", ""},
-		"qux.bar.baz": {"foo/b/ar", ""},
+		"foo.bar.baz": {},
+		"bar.bar.baz": {Repository: "foo"},
+		"baz.bar.baz": {Repository: "foo/bar"},
+		"qux.bar.baz": {Repository: "foo/b/ar"},
 	}
 
 	cases := []struct {
@@ -41,9 +42,9 @@ func TestProjectForHost(t *testing.T) {
 func TestMinVersionForHost(t *testing.T) {
 	require := require.New(t)
 	conf := Config{
-		"foo.bar.baz": {"", "notaversion"},
-		"bar.bar.baz": {"", ""},
-		"baz.bar.baz": {"", "v1.0.0"},
+		"foo.bar.baz": {MinVersion: "notaversion"},
+		"bar.bar.baz": {},
+		"baz.bar.baz": {MinVersion: "v1.0.0"},
 	}
 
 	cases := []struct {
@@ -70,8 +71,8 @@ func TestLoadConfig(t *testing.T) {
 	defer f.Close()
 
 	expected := Config{
-		"foo.bar.baz": {"bar/baz", "v1.0.0"},
-		"bar.bar.baz": {"bar/bar", "v1.1.0"},
+		"foo.bar.baz": {Repository: "bar/baz", MinVersion: "v1.0.0"},
+		"bar.bar.baz": {Repository: "bar/bar", MinVersion: "v1.1.0"},
 	}
 
 	require.NoError(toml.NewEncoder(f).Encode(expected))
@@ -82,6 +83,82 @@ func TestLoadConfig(t *testing.T) {
 	require.Equal(expected, config)
 }
 
+func TestLoadConfig_InvalidExcludeVersions(t *testing.T) {
+	require := require.New(t)
+	f, err := ioutil.TempFile("", "config")
+	require.NoError(err)
+	defer f.Close()
+
+	require.NoError(toml.NewEncoder(f).Encode(Config{
+		"foo.bar.baz": {Repository: "bar/baz", ExcludeVersions: []string{"/v1.(/"}},
+	}))
+
+	_, err = LoadConfig(f.Name())
+	require.Error(err)
+}
+
+func TestGitHubTokens(t *testing.T) {
+	require := require.New(t)
+	f, err := ioutil.TempFile("", "token")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("file-token\n")
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	os.Setenv("DOCSRV_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("DOCSRV_TEST_TOKEN")
+
+	config := Config{
+		"a.bar": {Repository: "bar/a", TokenEnv: "DOCSRV_TEST_TOKEN"},
+		"b.bar": {Repository: "bar/b", TokenFile: f.Name()},
+		"c.bar": {Repository: "bar/c"},
+		"d.bar": {Repository: "bar/d", TokenEnv: "DOCSRV_TEST_MISSING_TOKEN"},
+		"e.bar": {Repository: "bar/e", TokenEnv: "DOCSRV_TEST_TOKEN", TokenFile: f.Name()},
+		"f.bar": {Repository: "bar/f", TokenEnv: "DOCSRV_TEST_TOKEN", Provider: BitbucketProvider},
+	}
+	tokens, errs := config.tokens(GitHubProvider)
+	require.Equal(map[string]string{"bar/a": "env-token", "bar/b": "file-token"}, tokens)
+	require.Len(errs, 2)
+
+	tokens, errs = config.tokens(BitbucketProvider)
+	require.Equal(map[string]string{"bar/f": "env-token"}, tokens)
+	require.Empty(errs)
+}
+
+func TestLoadConfig_InvalidToken(t *testing.T) {
+	require := require.New(t)
+	f, err := ioutil.TempFile("", "config")
+	require.NoError(err)
+	defer f.Close()
+
+	require.NoError(toml.NewEncoder(f).Encode(Config{
+		"foo.bar.baz": {Repository: "bar/baz", TokenFile: "/missing/token"},
+	}))
+
+	_, err = LoadConfig(f.Name())
+	require.Error(err)
+}
+
+func TestExcludesVersion(t *testing.T) {
+	conf := ProjectConfig{ExcludeVersions: []string{"v2.0.*", `/-rc\.\d+$/`, "["}}
+	cases := []struct {
+		tag      string
+		excluded bool
+	}{
+		{"v2.0.0", true},
+		{"v2.0.1", true},
+		{"v2.1.0", false},
+		{"v1.0.0-rc.1", true},
+		{"v1.0.0-rc", false},
+		{"v1.0.0", false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.excluded, conf.ExcludesVersion(c.tag), c.tag)
+	}
+}
+
 func TestStripPort(t *testing.T) {
 	cases := []struct {
 		in, out string
@@ -94,3 +171,43 @@ func TestStripPort(t *testing.T) {
 		require.Equal(t, c.out, stripPort(c.in), c.in)
 	}
 }
+
+func TestConfig_DocsPath(t *testing.T) {
+	require := require.New(t)
+	config := Config{
+		"foo.bar":  ProjectConfig{Repository: "bar/mono", DocsPath: "services/foo/docs/"},
+		"foo2.bar": ProjectConfig{Repository: "bar/mono", DocsPath: "/services/foo/docs"},
+		"baz.bar":  ProjectConfig{Repository: "bar/mono", DocsPath: "services/baz"},
+		"mono.bar": ProjectConfig{Repository: "bar/mono"},
+		"qux.bar":  ProjectConfig{Repository: "bar/qux"},
+	}
+
+	owner, project, ok := config.ProjectForHost("foo.bar")
+	require.True(ok)
+	require.Equal("bar", owner)
+	require.Equal("mono@services%2Ffoo%2Fdocs", project)
+	require.Equal("mono", repositoryName(project))
+	require.Equal("bar/mono", repositoryKey(owner, project))
+
+	require.Equal([]string{"foo.bar", "foo2.bar"}, config.HostsForProject(owner, project))
+	require.Equal([]string{"mono.bar"}, config.HostsForProject("bar", "mono"))
+	require.Equal([]string{
+		"mono",
+		"mono@services%2Fbaz",
+		"mono@services%2Ffoo%2Fdocs",
+	}, config.ProjectsForRepository("bar", "mono"))
+
+	conf, ok := config.ForProject("bar", "mono@services%2Fbaz")
+	require.True(ok)
+	require.Equal("services/baz", conf.DocsPath)
+
+	// the projects served by several hosts use the config of the first one
+	for i := 0; i < 10; i++ {
+		conf, ok = config.ForProject(owner, project)
+		require.True(ok)
+		require.Equal("services/foo/docs/", conf.DocsPath)
+	}
+
+	require.Equal("", cleanDocsPath("./"))
+	require.Equal("docs", cleanDocsPath("../docs"))
+}
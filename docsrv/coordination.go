@@ -0,0 +1,80 @@
+package docsrv
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// Coordinator coordinates the builds of several docsrv instances serving the
+// same base folder, so a version is built only once and every instance knows
+// which versions are installed.
+type Coordinator interface {
+	// Lock blocks until the lock of the given key is acquired or the context
+	// is cancelled. The returned function releases the lock.
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+	// MarkInstalled records that the version with the given key is
+	// installed.
+	MarkInstalled(key string) error
+	// IsInstalled reports whether or not the version with the given key was
+	// installed by any instance.
+	IsInstalled(key string) (bool, error)
+}
+
+// localCoordinator is the Coordinator of a single instance. It only prevents
+// concurrent builds of the same version in this instance, since the installed
+// versions are already in its index.
+type localCoordinator struct {
+	mut   sync.Mutex
+	locks map[string]chan struct{}
+}
+
+func newLocalCoordinator() *localCoordinator {
+	return &localCoordinator{locks: make(map[string]chan struct{})}
+}
+
+func (c *localCoordinator) Lock(ctx context.Context, key string) (func(), error) {
+	c.mut.Lock()
+	lock, ok := c.locks[key]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		c.locks[key] = lock
+	}
+	c.mut.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *localCoordinator) MarkInstalled(key string) error { return nil }
+
+func (c *localCoordinator) IsInstalled(key string) (bool, error) { return false, nil }
+
+// installedByPeer reports whether or not the version with the given build
+// configuration was installed by another instance, in which case it's marked
+// as installed in this one too.
+func (s *Service) installedByPeer(conf buildConfig) bool {
+	key := newKey(conf.owner, conf.project, conf.version)
+	ok, err := s.coordinator.IsInstalled(key)
+	if err != nil {
+		conf.log().Errorf("could not check if the version was installed by another instance: %s", err)
+		return false
+	}
+
+	if !ok {
+		return false
+	}
+
+	if _, err := os.Stat(conf.destination); err != nil {
+		return false
+	}
+
+	conf.redirects = loadRedirectRules(conf)
+	s.index.install(conf)
+	s.indexForSearch(conf)
+	return true
+}
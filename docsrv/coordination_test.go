@@ -0,0 +1,88 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingTarGzServer serves the test tarball and counts the downloads.
+func countingTarGzServer() (string, *int32, func()) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		tarGzMakefileHandler(w, testMakefile)
+	}))
+	return server.URL, &downloads, server.Close
+}
+
+func TestPrepareVersion_ConcurrentBuilds(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(int32(1), atomic.LoadInt32(downloads))
+}
+
+func TestPrepareVersion_SharedInstalledVersions(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	redis := newFakeRedis(t, "")
+	defer redis.close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	var instances []*Service
+	for i := 0; i < 2; i++ {
+		coordinator, err := NewRedisCoordinator(redis.url())
+		require.NoError(err)
+
+		fetcher := newMockFetcher()
+		fetcher.add("bar", "foo", "v1.0.0", url)
+		srv := New(Options{
+			Config:       Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}},
+			BaseFolder:   tmpDir,
+			SharedFolder: testSharedFolder,
+			Coordinator:  coordinator,
+		})
+		srv.fetcher = fetcher
+		instances = append(instances, srv)
+	}
+
+	assertRedirect(t, instances[0], "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	require.Equal(int32(1), atomic.LoadInt32(downloads))
+
+	assertRedirect(t, instances[1], "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	require.Equal(int32(1), atomic.LoadInt32(downloads))
+	require.True(instances[1].index.isInstalled("bar", "foo", "v1.0.0"))
+}
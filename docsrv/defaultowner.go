@@ -0,0 +1,108 @@
+package docsrv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repositoryNameRegexp matches the names GitHub allows for repositories.
+var repositoryNameRegexp = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// missingProjectTTL is the time the projects of the default owner whose
+// repository was not found are remembered, so the requests to random hosts
+// matching DefaultHosts do not reach the provider every time.
+const missingProjectTTL = 10 * time.Minute
+
+// validateDefaultOwner returns an error if DefaultOwner is set without
+// DefaultHosts or the pattern of DefaultHosts is invalid.
+func (o Options) validateDefaultOwner() error {
+	if o.DefaultOwner == "" {
+		return nil
+	}
+
+	if o.DefaultHosts == "" {
+		return fmt.Errorf("the hosts of the default owner %s are required", o.DefaultOwner)
+	}
+
+	if _, err := matchVersionPattern(o.DefaultHosts, ""); err != nil {
+		return wrap(err, "invalid pattern of the hosts of the default owner: %q", o.DefaultHosts)
+	}
+	return nil
+}
+
+// defaultProject returns the name of the project of DefaultOwner served at the
+// given host, which is its first label, e.g. "foo" for "foo.docs.example.com",
+// if the host matches DefaultHosts. Will also report whether or not there is
+// any.
+func (o Options) defaultProject(host string) (string, bool) {
+	if o.DefaultOwner == "" || o.DefaultHosts == "" {
+		return "", false
+	}
+
+	host = normalizeHost(host)
+	dot := strings.IndexByte(host, '.')
+	if dot <= 0 || strings.Contains(host, "/") {
+		return "", false
+	}
+
+	// hosts are matched the same way as the excluded versions.
+	if ok, _ := matchVersionPattern(o.DefaultHosts, host); !ok {
+		return "", false
+	}
+
+	project := host[:dot]
+	if !repositoryNameRegexp.MatchString(project) {
+		return "", false
+	}
+	return project, true
+}
+
+// missingProjects remembers the projects of the default owner whose
+// repository was not found until their entries expire.
+type missingProjects struct {
+	mut     sync.Mutex
+	ttl     time.Duration
+	expires map[string]time.Time
+}
+
+func newMissingProjects(ttl time.Duration) *missingProjects {
+	return &missingProjects{ttl: ttl, expires: make(map[string]time.Time)}
+}
+
+// add remembers that the repository of the given project was not found. The
+// expired entries are forgotten, so random hosts do not fill the memory.
+func (m *missingProjects) add(project string) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	now := time.Now()
+	for p, expires := range m.expires {
+		if now.After(expires) {
+			delete(m.expires, p)
+		}
+	}
+	m.expires[project] = now.Add(m.ttl)
+}
+
+// has reports whether the repository of the given project was not found
+// recently.
+func (m *missingProjects) has(project string) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	expires, ok := m.expires[project]
+	return ok && time.Now().Before(expires)
+}
+
+// isDefaultProject reports whether the given project is served because it
+// belongs to the default owner, and not because it's configured.
+func (s *Service) isDefaultProject(owner, project string) bool {
+	if owner != s.opts.DefaultOwner {
+		return false
+	}
+
+	_, configured := s.config().ForProject(owner, project)
+	return !configured
+}
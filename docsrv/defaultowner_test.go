@@ -0,0 +1,116 @@
+package docsrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultOwner(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", "")
+	fetcher.add("org", "baz", "v2.0.0", "")
+	fetcher.add("other", "qux", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"qux.docs.bar": ProjectConfig{Repository: "other/qux"},
+	})
+	srv.opts.DefaultOwner = "org"
+	srv.opts.DefaultHosts = "*.docs.bar"
+
+	assertRedirect(t, srv, "http://foo.docs.bar/latest/", "http://foo.docs.bar/v1.0.0/")
+	assertRedirect(t, srv, "http://baz.docs.bar:8080/latest/", "http://baz.docs.bar:8080/v2.0.0/")
+
+	// configured hosts take precedence
+	assertRedirect(t, srv, "http://qux.docs.bar/latest/", "http://qux.docs.bar/v1.0.0/")
+
+	for _, url := range []string{
+		"http://foo.other.bar/latest/",
+		"http://docs.bar/latest/",
+		"http://missing.docs.bar/latest/",
+	} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		require.Equal(http.StatusNotFound, w.Code, url)
+	}
+
+	ctx := context.Background()
+	require.NoError(srv.hostPolicy(ctx, "foo.docs.bar"))
+	require.Error(srv.hostPolicy(ctx, "foo.other.bar"))
+}
+
+// missingReposFetcher is a mock fetcher that reports the repositories
+// without releases as not found and counts the listings of releases.
+type missingReposFetcher struct {
+	*mockFetcher
+	listings int
+}
+
+func (f *missingReposFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) ([]*release, error) {
+	f.listings++
+	if err := f.checkRepository(owner, project, ""); err != nil {
+		return nil, err
+	}
+	return f.mockFetcher.releases(owner, project, minVersion, maxVersion)
+}
+
+func TestDefaultOwner_MissingRepository(t *testing.T) {
+	require := require.New(t)
+	fetcher := &missingReposFetcher{mockFetcher: newMockFetcher()}
+	fetcher.add("org", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, nil)
+	srv.opts.DefaultOwner = "org"
+	srv.opts.DefaultHosts = "*.docs.bar"
+
+	for i := 0; i < 3; i++ {
+		assertNotFound(t, srv, "http://missing.docs.bar/latest/")
+	}
+	require.Equal(1, fetcher.listings, "missing repositories are not listed again")
+
+	ctx := context.Background()
+	require.Error(srv.hostPolicy(ctx, "missing.docs.bar"))
+	require.Error(srv.hostPolicy(ctx, "random.docs.bar"))
+	require.Equal(2, fetcher.listings)
+	require.Error(srv.hostPolicy(ctx, "random.docs.bar"))
+	require.Equal(2, fetcher.listings)
+
+	require.NoError(srv.hostPolicy(ctx, "foo.docs.bar"))
+	require.True(srv.index.isIndexed("org", "foo"))
+}
+
+func TestOptionsDefaultProject(t *testing.T) {
+	opts := Options{DefaultOwner: "org", DefaultHosts: `/^[a-z]+\.(docs|api)\.bar$/`}
+
+	cases := []struct {
+		host    string
+		project string
+		ok      bool
+	}{
+		{"foo.docs.bar", "foo", true},
+		{"Foo.API.bar.:8080", "foo", true},
+		{"foo.web.bar", "", false},
+		{"foo-1.docs.bar", "", false},
+		{"docs.bar", "", false},
+	}
+
+	for _, c := range cases {
+		project, ok := opts.defaultProject(c.host)
+		require.Equal(t, c.ok, ok, c.host)
+		require.Equal(t, c.project, project, c.host)
+	}
+
+	_, ok := Options{DefaultHosts: "*.docs.bar"}.defaultProject("foo.docs.bar")
+	require.False(t, ok)
+}
+
+func TestOptionsValidateDefaultOwner(t *testing.T) {
+	require := require.New(t)
+	require.NoError(Options{DefaultOwner: "org", DefaultHosts: "*.docs.bar"}.Validate())
+	require.Error(Options{DefaultOwner: "org"}.Validate())
+	require.Error(Options{DefaultOwner: "org", DefaultHosts: "[a-"}.Validate())
+	require.Error(Options{DefaultOwner: "org", DefaultHosts: "/(/"}.Validate())
+}
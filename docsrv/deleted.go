@@ -0,0 +1,137 @@
+package docsrv
+
+import (
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// OrphanDeletedReleases keeps serving the installed docs of the releases
+	// deleted upstream, which are reported as orphaned in the stats. It's
+	// the default.
+	OrphanDeletedReleases = "orphan"
+	// EvictDeletedReleases deletes the installed docs of the releases
+	// deleted upstream.
+	EvictDeletedReleases = "evict"
+)
+
+// deletedReleases returns the versions of the given project, either indexed
+// or on disk, whose releases are not among the given ones just fetched from
+// upstream, sorted. Branches, pull requests, refs built under a label, tags
+// that are not versions of the scheme of the project and versions out of its
+// bounds are never considered deleted, since they are not expected to be
+// among them.
+func (s *Service) deletedReleases(owner, project string, fetched []*release) []string {
+	conf, _ := s.config().ForProject(owner, project)
+	scheme := conf.versionScheme()
+	min := conf.MinVersion
+	if v := s.index.minVersion(owner, project); conf.isSemver() && v != nil {
+		min = v.Original()
+	}
+
+	var (
+		older = s.olderThan(owner, project, min)
+		max   = s.index.maxVersion(owner, project)
+		known = make(map[string]bool, len(fetched))
+		seen  = make(map[string]bool)
+	)
+	for _, r := range fetched {
+		known[r.tag] = true
+	}
+
+	var candidates []string
+	for _, r := range s.index.forProject(owner, project) {
+		candidates = append(candidates, r.tag)
+	}
+
+	for _, v := range s.versionsOnDisk(owner, project) {
+		candidates = append(candidates, v.Version)
+	}
+
+	var deleted []string
+	for _, tag := range candidates {
+		if seen[tag] || known[tag] || conf.hasBranch(tag) || !scheme.valid(tag) {
+			continue
+		}
+		seen[tag] = true
+
+		if _, ok := pullRequestNumber(tag); ok {
+			continue
+		}
+
+		if installed, ok := s.index.installation(owner, project, tag); ok && installed.ref != "" {
+			continue
+		}
+
+		if older(tag) || (conf.isSemver() && max.excludes(newVersion(tag))) {
+			continue
+		}
+		deleted = append(deleted, tag)
+	}
+
+	sort.Strings(deleted)
+	return deleted
+}
+
+// cleanDeletedReleases handles the installed docs of the given versions of
+// the given project, whose releases were deleted upstream, according to its
+// config: they are either deleted or reported as orphaned in the stats.
+func (s *Service) cleanDeletedReleases(owner, project string, deleted []string) {
+	onDisk := make(map[string]bool)
+	for _, v := range s.versionsOnDisk(owner, project) {
+		onDisk[v.Version] = true
+	}
+
+	var installed []string
+	for _, version := range deleted {
+		if onDisk[version] {
+			installed = append(installed, version)
+		}
+	}
+
+	conf, _ := s.config().ForProject(owner, project)
+	if conf.DeletedReleases != EvictDeletedReleases {
+		s.setOrphaned(owner, project, installed)
+		return
+	}
+
+	s.setOrphaned(owner, project, nil)
+	for _, version := range installed {
+		log := logrus.WithFields(logrus.Fields{
+			"project": project,
+			"owner":   owner,
+			"version": version,
+		})
+
+		if err := s.deleteVersion(owner, project, version); err != nil {
+			log.Errorf("could not delete docs of deleted release: %s", err)
+			continue
+		}
+		log.Info("release was deleted upstream, its docs were deleted")
+		s.auditEvent("evict", owner, project, version, "release deleted upstream")
+	}
+
+	if len(installed) > 0 {
+		s.writeState()
+	}
+}
+
+// setOrphaned sets the installed versions of the given project whose releases
+// were deleted upstream, logging the new ones.
+func (s *Service) setOrphaned(owner, project string, versions []string) {
+	prev := make(map[string]bool)
+	for _, version := range s.index.setOrphaned(owner, project, versions) {
+		prev[version] = true
+	}
+
+	for _, version := range versions {
+		if !prev[version] {
+			logrus.WithFields(logrus.Fields{
+				"project": project,
+				"owner":   owner,
+				"version": version,
+			}).Warn("release was deleted upstream, its docs are orphaned")
+		}
+	}
+}
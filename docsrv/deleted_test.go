@@ -0,0 +1,90 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexProject_DeletedReleases(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, dir := range []string{"v0.1.0", "v1.0.0", "v1.1.0", "master", "pr-1"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpDir, "bar", "foo", dir), 0755))
+	}
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.add("bar", "foo", "v1.2.0", "")
+	fetcher.addBranch("bar", "foo", "master", "", "1234")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", MinVersion: "v0.5.0", Branches: []string{"master"}},
+	})
+	srv.opts.BaseFolder = tmpDir
+
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.Empty(srv.index.orphanedForProject("bar", "foo"))
+
+	delete(fetcher.projectReleases["bar/foo"], "v1.1.0")
+	delete(fetcher.projectReleases["bar/foo"], "v1.2.0")
+	require.NoError(srv.indexProject("bar", "foo"))
+
+	// only the installed ones are orphaned, but none of them can be built
+	// anymore.
+	require.Equal([]string{"v1.1.0"}, srv.index.orphanedForProject("bar", "foo"))
+	require.Nil(srv.index.get("bar", "foo", "v1.1.0"))
+	require.Nil(srv.index.get("bar", "foo", "v1.2.0"))
+	require.NotNil(srv.index.get("bar", "foo", "master"))
+	require.DirExists(filepath.Join(tmpDir, "bar", "foo", "v1.1.0"))
+
+	stats := srv.projectStats(srv.config(), "bar", "foo")
+	orphaned := make(map[string]bool)
+	for _, v := range stats.Versions {
+		orphaned[v.Version] = v.Orphaned
+	}
+	require.Equal(map[string]bool{
+		"v0.1.0": false,
+		"v1.0.0": false,
+		"v1.1.0": true,
+		"master": false,
+		"pr-1":   false,
+	}, orphaned)
+
+	// the releases published again are no longer orphaned.
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.Empty(srv.index.orphanedForProject("bar", "foo"))
+}
+
+func TestIndexProject_EvictDeletedReleases(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, dir := range []string{"v1.0.0", "v1.1.0"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpDir, "bar", "foo", dir), 0755))
+	}
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", DeletedReleases: EvictDeletedReleases},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.index.install(buildConfig{owner: "bar", project: "foo", version: "v1.1.0"})
+
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.Empty(srv.index.orphanedForProject("bar", "foo"))
+	require.False(srv.index.isInstalled("bar", "foo", "v1.1.0"))
+	_, err = os.Stat(filepath.Join(tmpDir, "bar", "foo", "v1.1.0"))
+	require.True(os.IsNotExist(err))
+	require.DirExists(filepath.Join(tmpDir, "bar", "foo", "v1.0.0"))
+}
@@ -0,0 +1,65 @@
+package docsrv
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultDeprecationMessage is the default text of the banner of the
+// outdated versions.
+const defaultDeprecationMessage = "You are viewing outdated docs of {version}, the latest version is {latest}."
+
+const deprecationBannerTemplate = `<div class="docsrv-deprecation" role="note" style="padding:.75em 1em;background:#fff3cd;color:#664d03;border-bottom:1px solid #ffe69c;font-family:sans-serif;text-align:center">%s</div>`
+
+// deprecationBanner returns the HTML of the banner added to the pages of the
+// given version of a project requested with the given request, or an empty
+// string if the version is not older than the version before which the
+// versions of the project are outdated.
+func (s *Service) deprecationBanner(r *http.Request, owner, project, version string) string {
+	conf, _ := s.config().ForProject(owner, project)
+	if conf.DeprecateBefore == "" || !s.olderThan(owner, project, conf.DeprecateBefore)(version) {
+		return ""
+	}
+
+	latest := latestRelease(s.releasesForHost(r.Host, owner, project))
+	if latest == nil || latest.tag == version {
+		return ""
+	}
+
+	message := conf.DeprecationMessage
+	if message == "" {
+		message = defaultDeprecationMessage
+	}
+
+	// the link points to /latest/ instead of the latest version, so it's
+	// not outdated once there is a newer one.
+	link := `<a href="` + html.EscapeString(urlFor(r, "latest", "")+"/") + `">` +
+		html.EscapeString(latest.tag) + `</a>`
+	text := strings.NewReplacer(
+		"{version}", html.EscapeString(version),
+		"{latest}", link,
+	).Replace(html.EscapeString(message))
+	return fmt.Sprintf(deprecationBannerTemplate, text)
+}
+
+var bodyRegexp = regexp.MustCompile(`(?i)<body(\s[^>]*)?>`)
+
+// addDeprecationBanner adds the deprecation banner of the build right after
+// the opening body tag of every HTML page of the site. Pages without a body
+// tag are left unchanged.
+func addDeprecationBanner(conf buildConfig) error {
+	return rewriteHTMLFiles(conf.destination, func(_ string, content []byte) []byte {
+		loc := bodyRegexp.FindIndex(content)
+		if loc == nil {
+			return content
+		}
+
+		result := make([]byte, 0, len(content)+len(conf.deprecationBanner))
+		result = append(result, content[:loc[1]]...)
+		result = append(result, conf.deprecationBanner...)
+		return append(result, content[loc[1]:]...)
+	})
+}
@@ -0,0 +1,74 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeprecationBanner(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	for _, v := range []string{"v1.0.0", "v1.1.0", "v2.0.0"} {
+		fetcher.add("bar", "foo", v, "")
+	}
+	fetcher.add("bar", "baz", "v1.0.0", "")
+	fetcher.add("bar", "baz", "v2.0.0", "")
+
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", DeprecateBefore: "v1.1.0", Branches: []string{"master"}},
+		"baz.bar": ProjectConfig{
+			Repository:         "bar/baz",
+			DeprecateBefore:    "v3.0.0",
+			DeprecationMessage: "<Old> {version}, see {latest}",
+		},
+	})
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.NoError(srv.indexProject("bar", "baz"))
+
+	r := httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+	require.Equal(
+		`<div class="docsrv-deprecation" role="note" style="padding:.75em 1em;background:#fff3cd;color:#664d03;border-bottom:1px solid #ffe69c;font-family:sans-serif;text-align:center">`+
+			`You are viewing outdated docs of v1.0.0, the latest version is <a href="http://foo.bar/latest/">v2.0.0</a>.</div>`,
+		srv.deprecationBanner(r, "bar", "foo", "v1.0.0"),
+	)
+	require.Empty(srv.deprecationBanner(r, "bar", "foo", "v1.1.0"))
+	require.Empty(srv.deprecationBanner(r, "bar", "foo", "master"))
+
+	r = httptest.NewRequest("GET", "http://baz.bar/v1.0.0/", nil)
+	require.Contains(
+		srv.deprecationBanner(r, "bar", "baz", "v1.0.0"),
+		`&lt;Old&gt; v1.0.0, see <a href="http://baz.bar/latest/">v2.0.0</a></div>`,
+	)
+	// the latest version is never outdated
+	require.Empty(srv.deprecationBanner(r, "bar", "baz", "v2.0.0"))
+}
+
+func TestAddDeprecationBanner(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	pages := map[string]string{
+		"index.html":  `<html><BODY class="docs"><h1>Foo</h1></BODY></html>`,
+		"nobody.html": `<h1>Foo</h1>`,
+	}
+	for name, content := range pages {
+		require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	require.NoError(postProcess(buildConfig{destination: tmpDir, deprecationBanner: "<div>old</div>"}))
+
+	content, err := ioutil.ReadFile(filepath.Join(tmpDir, "index.html"))
+	require.NoError(err)
+	require.Equal(`<html><BODY class="docs"><div>old</div><h1>Foo</h1></BODY></html>`, string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(tmpDir, "nobody.html"))
+	require.NoError(err)
+	require.Equal(pages["nobody.html"], string(content))
+}
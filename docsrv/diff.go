@@ -0,0 +1,255 @@
+package docsrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diffPath is the path of the summary of the pages that changed between two
+// versions.
+const diffPath = "/api/diff"
+
+// versionsDiff is the summary of the pages that changed between two installed
+// versions, so the docs can link to what changed in them.
+type versionsDiff struct {
+	From     string     `json:"from"`
+	To       string     `json:"to"`
+	Added    []diffPage `json:"added"`
+	Removed  []diffPage `json:"removed"`
+	Modified []diffPage `json:"modified"`
+	// Unchanged is the number of pages that did not change.
+	Unchanged int `json:"unchanged"`
+}
+
+// diffPage is a page of a versionsDiff, with its URL in the newer version, or
+// in the older one if it was removed.
+type diffPage struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+// diffIgnoredRegexps match the parts of the pages added by docsrv, which
+// depend on the version they are in and not on the docs, so they are ignored
+// when the pages are compared: the deprecation banner, the canonical link and
+// the hashes of the assets. Only the first group of the matches, if any, is
+// kept.
+var diffIgnoredRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`<div class="docsrv-deprecation"[^>]*>.*?</div>`),
+	regexp.MustCompile(`(?i)<link[^>]+rel=["']?canonical[^>]*>`),
+	regexp.MustCompile(`(\.(?:css|js))\?v=[0-9a-f]+`),
+}
+
+// serveDiff is an HTTP handler that outputs the pages added, removed and
+// modified between the installed versions in the from and to parameters of
+// the query string.
+func (s *Service) serveDiff(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	log := projectLog(r, owner, project).WithField("from", from).WithField("to", to)
+	if from == "" || to == "" {
+		httpError(w, r, "the from and to versions are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.ensureIndexed(q.Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	for _, version := range []string{from, to} {
+		if _, ok := s.index.installation(owner, project, version); ok {
+			continue
+		}
+
+		if strings.Contains(version, "/") || s.index.get(owner, project, version) == nil {
+			s.notFound(w, r)
+		} else {
+			httpError(w, r, fmt.Sprintf("version %s is not built yet", version), http.StatusConflict)
+		}
+		return
+	}
+
+	diff, err := s.diffVersions(r, owner, project, from, to)
+	if err != nil {
+		log.Errorf("error comparing versions: %s", err)
+		s.internalError(w, r)
+		return
+	}
+
+	if err := s.writeJSON(w, diff); err != nil {
+		log.Errorf("error serving diff: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// diffVersions compares the HTML pages of the given installed versions.
+func (s *Service) diffVersions(r *http.Request, owner, project, from, to string) (*versionsDiff, error) {
+	fromPages, err := s.versionPageHashes(r, owner, project, from)
+	if err != nil {
+		return nil, err
+	}
+
+	toPages, err := s.versionPageHashes(r, owner, project, to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &versionsDiff{
+		From:     from,
+		To:       to,
+		Added:    []diffPage{},
+		Removed:  []diffPage{},
+		Modified: []diffPage{},
+	}
+
+	for path, hash := range toPages {
+		page := diffPage{path, urlFor(r, to, path)}
+		if prev, ok := fromPages[path]; !ok {
+			diff.Added = append(diff.Added, page)
+		} else if prev != hash {
+			diff.Modified = append(diff.Modified, page)
+		} else {
+			diff.Unchanged++
+		}
+	}
+
+	for path := range fromPages {
+		if _, ok := toPages[path]; !ok {
+			diff.Removed = append(diff.Removed, diffPage{path, urlFor(r, from, path)})
+		}
+	}
+
+	for _, pages := range [][]diffPage{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+	}
+	return diff, nil
+}
+
+// versionPageHashes returns the hashes of the HTML pages of the given
+// installed version, which are cached since it was installed. The versions
+// installed before docsrv started are hashed with the base URL of the host
+// of the request.
+func (s *Service) versionPageHashes(r *http.Request, owner, project, version string) (map[string]string, error) {
+	baseURL := urlFor(r, version, "") + "/"
+	if installed, ok := s.index.installation(owner, project, version); ok && installed.baseURL != "" {
+		baseURL = installed.baseURL
+	}
+	return s.hashes.get(s.versionFolder(owner, project, version), baseURL, version)
+}
+
+// hashVersion hashes the pages of the given version once it's installed, so
+// the first diffs that compare it do not wait for it.
+func (s *Service) hashVersion(conf buildConfig) {
+	if _, err := s.hashes.get(conf.destination, conf.baseURL, conf.version); err != nil {
+		conf.log().Warnf("could not hash the pages of the version: %s", err)
+	}
+}
+
+// pageHashes returns the hashes of the HTML pages of the site in the given
+// folder by their path relative to it. The pages are hashed without the
+// parts added by docsrv and with the given base URL and version replaced, so
+// the pages of different versions with the same content have the same hash.
+func pageHashes(root, baseURL, version string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := walkSite(root, func(path, rel string, _ os.FileInfo) error {
+		if !strings.HasSuffix(rel, ".html") {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		content = diffContent(content, baseURL, version)
+		hashes[filepath.ToSlash(rel)] = fmt.Sprintf("%x", sha256.Sum256(content))
+		return nil
+	})
+	return hashes, err
+}
+
+// diffContent returns the given content of a page of the given version as
+// it's compared: without the parts added by docsrv and with the base URL and
+// the version in the paths of the URLs, such as the ones of relative links,
+// replaced. The version is kept everywhere else, so the pages that mention
+// it, such as release notes, are still modified.
+func diffContent(content []byte, baseURL, version string) []byte {
+	for _, re := range diffIgnoredRegexps {
+		content = re.ReplaceAll(content, []byte("$1"))
+	}
+	content = bytes.Replace(content, []byte(baseURL), []byte("{base-url}"), -1)
+	return bytes.Replace(content, []byte("/"+version+"/"), []byte("/{version}/"), -1)
+}
+
+// diffHashes caches the hashes of the pages of the installed versions, so
+// their folders are not hashed on every diff. The hashes of a version are
+// computed when it's installed, and again when its folder is replaced
+// otherwise, such as by another instance sharing the base folder.
+type diffHashes struct {
+	mut    sync.Mutex
+	hashes map[string]versionHashes
+}
+
+// versionHashes are the hashes of the pages of the folder of a version with
+// the given modification time.
+type versionHashes struct {
+	modTime time.Time
+	hashes  map[string]string
+}
+
+func newDiffHashes() *diffHashes {
+	return &diffHashes{hashes: make(map[string]versionHashes)}
+}
+
+// get returns the hashes of the pages of the given folder of a version with
+// the given base URL, hashing them if they are not cached or the folder
+// changed.
+func (d *diffHashes) get(root, baseURL, version string) (map[string]string, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		d.forget(root)
+		return nil, err
+	}
+
+	d.mut.Lock()
+	cached, ok := d.hashes[root]
+	d.mut.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) {
+		return cached.hashes, nil
+	}
+
+	hashes, err := pageHashes(root, baseURL, version)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mut.Lock()
+	d.hashes[root] = versionHashes{fi.ModTime(), hashes}
+	d.mut.Unlock()
+	return hashes, nil
+}
+
+// forget removes the hashes of the given folder of a version, which was
+// deleted.
+func (d *diffHashes) forget(root string) {
+	d.mut.Lock()
+	delete(d.hashes, root)
+	d.mut.Unlock()
+}
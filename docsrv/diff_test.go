@@ -0,0 +1,104 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// diffMakefile writes the given pages, whose content is followed by the base
+// URL of the docs and a relative link to their version.
+func diffMakefile(pages map[string]string) string {
+	makefile := "docs:\n"
+	for name, content := range pages {
+		makefile += "\t@echo \"" + content + " $(BASE_URL) ../$(VERSION_NAME)/index.html\" > $(DESTINATION_PATH)/" + name + "\n"
+	}
+	return makefile
+}
+
+func TestDiff(t *testing.T) {
+	require := require.New(t)
+	v1, close1 := tarGzServerWithMakefile(diffMakefile(map[string]string{
+		"index.html": "home",
+		"guide.html": "guide",
+		"old.html":   "old",
+	}))
+	defer close1()
+
+	v2, close2 := tarGzServerWithMakefile(diffMakefile(map[string]string{
+		"index.html": "home",
+		"guide.html": "new guide",
+		"new.html":   "new",
+		"style.css":  "css",
+	}))
+	defer close2()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-diff-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", v1)
+	fetcher.add("bar", "foo", "v2.0.0", v2)
+	fetcher.add("bar", "foo", "v3.0.0", v2)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+
+	for _, version := range []string{"v1.0.0", "v2.0.0"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/"+version+"/", nil))
+		require.True(srv.index.isInstalled("bar", "foo", version), w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/diff?from=v1.0.0&to=v2.0.0", nil))
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	var diff versionsDiff
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &diff))
+	require.Equal(versionsDiff{
+		From:      "v1.0.0",
+		To:        "v2.0.0",
+		Added:     []diffPage{{"new.html", "http://foo.bar/v2.0.0/new.html"}},
+		Removed:   []diffPage{{"old.html", "http://foo.bar/v1.0.0/old.html"}},
+		Modified:  []diffPage{{"guide.html", "http://foo.bar/v2.0.0/guide.html"}},
+		Unchanged: 1,
+	}, diff)
+
+	cases := []struct {
+		url  string
+		code int
+	}{
+		{"http://foo.bar/api/diff?from=v1.0.0", http.StatusBadRequest},
+		{"http://foo.bar/api/diff?from=v1.0.0&to=v4.0.0", http.StatusNotFound},
+		{"http://foo.bar/api/diff?from=../v1.0.0&to=v2.0.0", http.StatusNotFound},
+		{"http://foo.bar/api/diff?from=v1.0.0&to=v3.0.0", http.StatusConflict},
+		{"http://baz.bar/api/diff?from=v1.0.0&to=v2.0.0", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		require.Equal(c.code, w.Code, c.url)
+	}
+
+	// the pages were hashed when the versions were installed
+	srv.hashes.mut.Lock()
+	require.Len(srv.hashes.hashes, 2)
+	srv.hashes.mut.Unlock()
+}
+
+func TestDiffContent(t *testing.T) {
+	require := require.New(t)
+	content := diffContent(
+		[]byte(`<a href="http://foo.bar/v1.0.0/guide.html">v1.0.0</a> <a href="../v1.0.0/">docs</a>`),
+		"http://foo.bar/v1.0.0/",
+		"v1.0.0",
+	)
+	require.Equal(`<a href="{base-url}guide.html">v1.0.0</a> <a href="../{version}/">docs</a>`, string(content))
+}
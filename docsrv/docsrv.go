@@ -1,16 +1,19 @@
 package docsrv
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/Masterminds/semver"
 	"github.com/Sirupsen/logrus"
 )
 
@@ -20,6 +23,18 @@ type Options struct {
 	// GitHubAPIKey is the API key used to retrieve releases from GitHub.
 	// If api key is empty the requests will be made without authentication.
 	GitHubAPIKey string
+	// GitHubAppID is the ID of the GitHub App docsrv authenticates as to
+	// fetch the releases instead of using GitHubAPIKey, with the tokens of
+	// its installation GitHubInstallation, which are renewed before they
+	// expire. GitHubAppID, GitHubInstallation and GitHubAppKey are required
+	// to use it.
+	GitHubAppID int64
+	// GitHubInstallation is the ID of the installation of the GitHub App in
+	// the account of the owner of the projects.
+	GitHubInstallation int64
+	// GitHubAppKey is the path of the PEM file with the private key of the
+	// GitHub App.
+	GitHubAppKey string
 	// BaseFolder is the path to the root folder of the webserver.
 	BaseFolder string
 	// SharedFolder is the path to the folder used to store all the common
@@ -30,13 +45,253 @@ type Options struct {
 	RefreshToken string
 	// Config is a mapping between hosts and project configurations.
 	Config Config
+	// WebhookSecret is the secret used to validate the payloads of the
+	// GitHub webhooks. If it's empty, webhooks will not be accepted.
+	WebhookSecret string
+	// ServeStatic enables serving the files in BaseFolder from docsrv, so
+	// it can run without a webserver in front of it.
+	ServeStatic bool
+	// FallbackTheme enables building the docs with a minimal built-in theme
+	// when SharedFolder is missing or incomplete instead of failing.
+	FallbackTheme bool
+	// Search enables the full-text search of the installed docs.
+	Search bool
+	// SessionSecret is the secret used to sign the sessions of the users of
+	// the projects that require authentication. If it's empty, a random one
+	// is generated, so sessions will not survive restarts.
+	SessionSecret string
+	// IndexShards is the number of shards the release index is split in to
+	// reduce lock contention. Defaults to 16.
+	IndexShards int
+	// RemapPolicy is what to do with the docs of a project once no host
+	// serves it after the config is reloaded. It can be RemapKeep,
+	// RemapPurge or RemapMigrate. Defaults to RemapKeep.
+	RemapPolicy string
+	// BufferSize is the initial size of the buffers used to encode the JSON
+	// responses. Defaults to 4KB.
+	BufferSize int
+	// TraceSampleRate is the fraction, between 0 and 1, of the requests that
+	// are traced. Can be overridden per host.
+	TraceSampleRate float64
+	// TraceBuilds enables always tracing the requests that trigger a build,
+	// regardless of the sample rate. Can be overridden per host.
+	TraceBuilds bool
+	// OTLPEndpoint is the endpoint of the OpenTelemetry collector the spans
+	// of the requests and the builds are exported to with OTLP over HTTP,
+	// e.g. "http://collector:4318". If it's empty, no spans are recorded.
+	OTLPEndpoint string
+	// OTLPHeaders are the headers sent to the collector, e.g. to
+	// authenticate.
+	OTLPHeaders map[string]string
+	// RefreshConcurrency is the maximum number of projects refreshed at the
+	// same time. Defaults to 4.
+	RefreshConcurrency int
+	// RefreshTimeout is the maximum time the refresh of a project can take
+	// before the refresh cycle moves on without it. Defaults to 1 minute.
+	RefreshTimeout time.Duration
+	// PDFCommand is the command used to convert the HTML pages of the docs
+	// to the PDF offline bundles. It receives the pages and the output file
+	// as arguments. Defaults to wkhtmltopdf.
+	PDFCommand string
+	// Precompress enables writing gzip and brotli variants, with the .gz and
+	// .br extensions, of the text files of the built docs, which are served
+	// to the clients that accept them.
+	Precompress bool
+	// BrotliCommand is the command used to write the brotli variants of the
+	// files. It receives the file as argument and must write it with the .br
+	// extension. Defaults to brotli.
+	BrotliCommand string
+	// MaxSymlinkDepth is the maximum number of symlinks that can be followed
+	// from a symlink in the sources of a version. Defaults to 8.
+	MaxSymlinkDepth int
+	// ForbiddenFileTypes are the extensions of the files that can not be in
+	// the sources of a version, e.g. ".exe".
+	ForbiddenFileTypes []string
+	// ScanCommand is the command, such as a virus scanner, run with the
+	// folder of the sources of a version as its last argument before
+	// building its docs. The version is quarantined if it exits with an
+	// error.
+	ScanCommand string
+	// Coordinator coordinates the builds with other instances serving the
+	// same base folder. If it's nil, this instance is assumed to be the only
+	// one.
+	Coordinator Coordinator
+	// Preheat enables building in the background all the releases of all
+	// the projects that are not installed yet once ManageIndex starts.
+	Preheat bool
+	// DefaultOwner is the owner of the projects served at the hosts that
+	// are not configured but match DefaultHosts, whose repository is the
+	// first label of the host, e.g. "foo" for "foo.docs.example.com". If
+	// it's empty, only the configured hosts are served.
+	DefaultOwner string
+	// DefaultHosts is the pattern of the hosts served for DefaultOwner, a
+	// glob such as "*.docs.example.com" or a regular expression enclosed in
+	// slashes. It's required with DefaultOwner.
+	DefaultHosts string
+	// UpstreamURL is the URL of the primary instance this one mirrors, e.g.
+	// in another region: the versions are pulled from it already built,
+	// building them there first if needed, instead of being built by this
+	// instance. Both instances must have the same RefreshToken.
+	UpstreamURL string
+	// LandingHost is the host, not configured for any project, whose root
+	// serves a page listing all the projects and their latest versions.
+	LandingHost string
+	// GitHubBaseURL is the URL of the GitHub Enterprise Server instance the
+	// releases are fetched from, e.g. "https://github.example.com". If it
+	// has no path, "/api/v3/" is used. Defaults to github.com.
+	GitHubBaseURL string
+	// BitbucketToken is the token used to fetch the releases of the projects
+	// hosted in Bitbucket Cloud without their own token, either an access
+	// token or a username and an app password separated by a colon. If it's
+	// empty, only their public repositories can be fetched.
+	BitbucketToken string
+	// ProxyURL is the URL of the proxy used to reach GitHub and download the
+	// sources of the versions. Defaults to the one in the HTTPS_PROXY and
+	// HTTP_PROXY environment variables, if any.
+	ProxyURL string
+	// CABundle is the path of a PEM file with the certificates of the
+	// certificate authorities trusted to reach GitHub and download the
+	// sources of the versions along with the ones of the system.
+	CABundle string
+	// LatestCacheTTL is the time the latest version of every host is cached
+	// before being resolved again from its releases. Defaults to 1 minute.
+	// A negative value disables the cache.
+	LatestCacheTTL time.Duration
+	// ArtifactCacheDir is the folder where the archives downloaded to build
+	// the docs are cached by commit, so they are not downloaded again. If
+	// it's empty, nothing is cached.
+	ArtifactCacheDir string
+	// CacheBuilds enables caching the built docs in ArtifactCacheDir too,
+	// so the docs of a commit are not built again for the same URL.
+	CacheBuilds bool
+	// AutoBuildLatest enables building in the background the new latest
+	// release of a project once the periodic refresh of the index finds it,
+	// so it's already installed when users visit /latest/.
+	AutoBuildLatest bool
+	// RequestTimeout is the maximum time to serve the requests of the API
+	// and the lists of versions, which never build a version. Slower ones
+	// get a 503 status. Defaults to 10 seconds.
+	RequestTimeout time.Duration
+	// BuildRequestTimeout is the maximum time to serve the rest of the
+	// requests, which may need to build a version or serve large files.
+	// Defaults to 5 minutes.
+	BuildRequestTimeout time.Duration
+	// MaxBodySize is the maximum size in bytes of the body of a request.
+	// Defaults to 5MB.
+	MaxBodySize int64
+	// AuditLog is the file where the administrative actions and the uses of
+	// the refresh token are appended, one JSON object per line. If it's
+	// empty, they are not recorded.
+	AuditLog string
+	// AccessLog is the file where every request served is appended, in
+	// AccessLogFormat, or "stdout" to write them to the standard output. If
+	// it's empty, they are not recorded.
+	AccessLog string
+	// AccessLogFormat is the format of the access log: common, combined,
+	// vhost_combined or json. Defaults to combined.
+	AccessLogFormat string
+	// Layout is the template of the folders where the versions of every
+	// project are installed, relative to BaseFolder, with the {owner},
+	// {project} and {version} placeholders. It must end with "/{version}".
+	// Defaults to "{owner}/{project}/{version}".
+	Layout string
+	// MaxConcurrentBuilds is the maximum number of builds running at the
+	// same time. The rest wait in a queue, where the builds requested by
+	// users go before the background ones. If it's 0, there is no limit.
+	MaxConcurrentBuilds int
+	// PublicScheme is the scheme of the URLs the versions built outside of
+	// any request are built with, such as the preheated, preinstalled and
+	// prefetched ones, "http" or "https". If it's empty, it's "https" for
+	// the hosts that force HTTPS and "http" for the rest.
+	PublicScheme string
+	// QueueFile is the path of the file where the pending builds are
+	// persisted, so they are resumed if docsrv restarts before they are
+	// finished. Defaults to a file in the base folder with the name of the
+	// instance, so the instances sharing it have their own.
+	QueueFile string
+	// BuildUser is the user that runs the builds, with the format "user",
+	// "user:group" or "uid:gid". Its builds don't inherit the environment of
+	// docsrv and can only write to a temporary folder, whose docs are
+	// installed once built. If it's empty, builds run as the docsrv user.
+	BuildUser string
+	// BuildCgroup is the cgroup v2, as a path or relative to /sys/fs/cgroup,
+	// where every build runs in a cgroup of its own limited to
+	// BuildMemoryLimit and BuildCPULimit. It must be writable by docsrv and
+	// must not contain its process. If it's empty, builds are not limited.
+	BuildCgroup string
+	// BuildMemoryLimit is the maximum memory of every build, in bytes. The
+	// builds exceeding it are killed. If it's 0, there is no limit.
+	BuildMemoryLimit int64
+	// BuildCPULimit is the maximum number of CPUs, which can be fractional,
+	// used by every build. If it's 0, there is no limit.
+	BuildCPULimit float64
 }
 
+// defaultBufferSize is the default initial size of the buffers used to encode
+// JSON responses.
+const defaultBufferSize = 4 << 10
+
 // Service is the main docsrv service.
 type Service struct {
-	opts    Options
-	fetcher releaseFetcher
-	index   *projectIndex
+	// configMut guards opts.Config, which is replaced when the config is
+	// reloaded, and hosts.
+	configMut *sync.RWMutex
+	opts      Options
+	// hosts is the table of the hosts of opts.Config.
+	hosts *hostTable
+	// stateMut serializes the writes of the state manifest.
+	stateMut *sync.Mutex
+	// refreshing contains the keys of the projects being refreshed.
+	refreshing *sync.Map
+	// rebuilding contains the keys of the versions being rebuilt.
+	rebuilding *sync.Map
+	// scheduled contains the scheduledBuild of the versions whose build was
+	// queued by a request.
+	scheduled *sync.Map
+	scheduler *buildScheduler
+	// pending are the builds queued or running, persisted so they are
+	// resumed after a restart.
+	pending *pendingBuilds
+	// builder is the name of this instance, recorded in the versions it
+	// builds.
+	builder     string
+	coordinator Coordinator
+	fetcher     releaseFetcher
+	// bitbucket is the fetcher of the projects hosted in Bitbucket.
+	bitbucket releaseFetcher
+	// httpClient is the client used to download the sources of the
+	// versions.
+	httpClient *http.Client
+	index      *projectIndex
+	aliases    *aliasRegistry
+	// missing are the projects of the default owner whose repository was
+	// recently not found.
+	missing    *missingProjects
+	search     *searchIndex
+	reports    *buildReports
+	quarantine *quarantine
+	// failures are the last failed builds of the versions.
+	failures *buildFailures
+	// maintenance keeps the hosts put into maintenance mode at runtime and
+	// their paused builds.
+	maintenance *maintenance
+	// rateLimits keeps the GitHub tokens that are rate limited.
+	rateLimits *rateLimits
+	prefetcher *prefetcher
+	stats      *usageStats
+	sizes      *folderSizes
+	pages      *pageLists
+	hashes     *diffHashes
+	latest     *latestCache
+	artifacts  *artifactCache
+	audit      *auditLog
+	access     *accessLog
+	sandbox    *buildSandbox
+	cgroups    *buildCgroups
+	// tracer exports the spans of the requests and the builds, if an
+	// OpenTelemetry collector is configured.
+	tracer  *otelTracer
+	buffers *sync.Pool
 }
 
 // New creates a new DocSrv service with the given options.
@@ -45,11 +300,222 @@ func New(opts Options) *Service {
 		opts.Config = make(Config)
 	}
 
-	return &Service{
-		opts:    opts,
-		fetcher: newReleaseFetcher(opts.GitHubAPIKey, 0),
-		index:   newProjectIndex(opts.Config),
+	if opts.SessionSecret == "" {
+		opts.SessionSecret = newSessionSecret()
+	}
+
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	bufferSize := opts.BufferSize
+
+	if opts.RefreshConcurrency <= 0 {
+		opts.RefreshConcurrency = defaultRefreshConcurrency
+	}
+
+	if opts.MaxSymlinkDepth <= 0 {
+		opts.MaxSymlinkDepth = defaultMaxSymlinkDepth
+	}
+
+	if opts.RefreshTimeout <= 0 {
+		opts.RefreshTimeout = defaultRefreshTimeout
+	}
+
+	if opts.LatestCacheTTL == 0 {
+		opts.LatestCacheTTL = defaultLatestCacheTTL
+	}
+
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+
+	if opts.BuildRequestTimeout <= 0 {
+		opts.BuildRequestTimeout = defaultBuildRequestTimeout
+	}
+
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = defaultMaxBodySize
+	}
+
+	if opts.Layout == "" {
+		opts.Layout = defaultLayout
+	} else if err := ValidateLayout(opts.Layout); err != nil {
+		logrus.WithField("alert", true).Errorf("using the default layout: %s", err)
+		opts.Layout = defaultLayout
+	}
+
+	coordinator := opts.Coordinator
+	if coordinator == nil {
+		coordinator = newLocalCoordinator()
+	}
+
+	// the options are validated with Validate, so these are not expected to
+	// fail.
+	httpClient, err := newHTTPClient(opts)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("using the default HTTP client: %s", err)
+		httpClient = http.DefaultClient
 	}
+
+	tokens := staticTokenSource(opts.GitHubAPIKey)
+	if opts.GitHubAppID != 0 {
+		appTokens, err := newGitHubAppTokenSource(opts, httpClient)
+		if err != nil {
+			logrus.WithField("alert", true).Errorf("not authenticating as the GitHub App: %s", err)
+		} else {
+			tokens = appTokens
+		}
+	}
+
+	fetcher, err := newReleaseFetcherWithTokens(tokens, 0, opts.GitHubBaseURL, httpClient)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("fetching releases from github.com: %s", err)
+		fetcher, _ = newReleaseFetcherWithTokens(tokens, 0, "", httpClient)
+	}
+
+	tracer := newOTelTracer(opts.OTLPEndpoint, opts.OTLPHeaders)
+	if g, ok := fetcher.(*githubFetcher); ok {
+		g.tracer = tracer
+	}
+
+	bitbucket := newBitbucketFetcher(opts.BitbucketToken, httpClient)
+	bitbucket.tracer = tracer
+
+	audit, err := openAuditLog(opts.AuditLog)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("not recording the audit log: %s", err)
+	}
+
+	access, err := openAccessLog(opts.AccessLog, opts.AccessLogFormat)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("not recording the access log: %s", err)
+	}
+
+	sandbox, err := newBuildSandbox(opts.BuildUser)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("running the builds as the docsrv user: %s", err)
+	}
+
+	for host, conf := range opts.Config {
+		if conf.PullRequests && sandbox == nil {
+			logrus.WithField("host", host).Warn("pull requests are only built with a build user, not building them")
+		}
+	}
+
+	cgroups, err := newBuildCgroups(opts.BuildCgroup, opts.BuildMemoryLimit, opts.BuildCPULimit)
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("running the builds without resource limits: %s", err)
+	}
+
+	s := &Service{
+		configMut:   new(sync.RWMutex),
+		stateMut:    new(sync.Mutex),
+		opts:        opts,
+		hosts:       newHostTable(opts.Config),
+		refreshing:  new(sync.Map),
+		rebuilding:  new(sync.Map),
+		scheduled:   new(sync.Map),
+		scheduler:   newBuildScheduler(opts.MaxConcurrentBuilds),
+		pending:     newPendingBuilds(opts.queueFile()),
+		builder:     builderName(),
+		coordinator: coordinator,
+		fetcher:     fetcher,
+		bitbucket:   bitbucket,
+		httpClient:  httpClient,
+		index:       newProjectIndex(opts.Config, opts.IndexShards),
+		aliases:     newAliasRegistry(),
+		missing:     newMissingProjects(missingProjectTTL),
+		search:      newSearchIndex(),
+		reports:     newBuildReports(),
+		quarantine:  newQuarantine(),
+		failures:    newBuildFailures(),
+		maintenance: newMaintenance(),
+		rateLimits:  newRateLimits(),
+		prefetcher:  newPrefetcher(),
+		stats:       new(usageStats),
+		sizes:       newFolderSizes(),
+		pages:       newPageLists(),
+		hashes:      newDiffHashes(),
+		latest:      newLatestCache(opts.LatestCacheTTL),
+		artifacts:   newArtifactCache(opts.ArtifactCacheDir, opts.CacheBuilds),
+		audit:       audit,
+		access:      access,
+		sandbox:     sandbox,
+		cgroups:     cgroups,
+		tracer:      tracer,
+		buffers: &sync.Pool{New: func() interface{} {
+			return bytes.NewBuffer(make([]byte, 0, bufferSize))
+		}},
+	}
+	s.scheduler.quota = func(owner string) *QuotaConfig {
+		return s.config().QuotaForOwner(owner)
+	}
+	s.scheduler.diskUsage = s.ownerDiskUsage
+	s.setTokens(opts.Config)
+	s.restoreState()
+	return s
+}
+
+// setTokens makes the fetchers use the tokens of the projects in the given
+// config that have their own. The projects whose token can not be read use
+// the global one of their provider.
+func (s *Service) setTokens(conf Config) {
+	for _, provider := range []string{GitHubProvider, BitbucketProvider} {
+		setter, ok := s.providerFetcher(provider).(tokenSetter)
+		if !ok {
+			continue
+		}
+
+		tokens, errs := conf.tokens(provider)
+		for _, err := range errs {
+			logrus.WithField("alert", true).Errorf("using the global %s token: %s", provider, err)
+		}
+
+		if err := setter.setTokens(tokens); err != nil {
+			logrus.WithField("alert", true).Errorf("could not use the %s tokens of the projects: %s", provider, err)
+		}
+	}
+}
+
+// providerFetcher returns the fetcher of the releases of the projects hosted
+// in the given provider.
+func (s *Service) providerFetcher(provider string) releaseFetcher {
+	if provider == BitbucketProvider {
+		return s.bitbucket
+	}
+	return s.fetcher
+}
+
+// downloadClient returns the HTTP client that downloads the sources of the
+// given project, authenticated with its token in the requests to its
+// provider if the fetcher of the provider supports it.
+func (s *Service) downloadClient(owner, project string) *http.Client {
+	if a, ok := s.fetcherFor(owner, project).(downloadAuthenticator); ok {
+		return a.downloadClient(owner, project, s.httpClient)
+	}
+	return s.httpClient
+}
+
+// fetcherFor returns the fetcher of the releases of the given project,
+// according to the provider of its repository.
+func (s *Service) fetcherFor(owner, project string) releaseFetcher {
+	conf, _ := s.config().ForProject(owner, project)
+	return s.providerFetcher(conf.provider())
+}
+
+// config returns the current configuration.
+func (s *Service) config() Config {
+	s.configMut.RLock()
+	defer s.configMut.RUnlock()
+	return s.opts.Config
+}
+
+// hostConfig returns the current configuration along with the table of its
+// hosts.
+func (s *Service) hostConfig() (Config, *hostTable) {
+	s.configMut.RLock()
+	defer s.configMut.RUnlock()
+	return s.opts.Config, s.hosts
 }
 
 // ensureIndexed checks if the project is indexed and if it's not, it indexes
@@ -69,44 +535,169 @@ func (s *Service) ensureIndexed(refreshToken, owner, project string) error {
 	return nil
 }
 
-// indexProject indexes the given project.
+// isAdmin reports whether the request carries the refresh token, which grants
+// access to the administrative operations.
+func (s *Service) isAdmin(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	return token != "" && token == s.opts.RefreshToken
+}
+
+// indexProject indexes the given project. Frozen projects are indexed with
+// the versions installed on disk instead.
 func (s *Service) indexProject(owner, project string) error {
+	conf, _ := s.config().ForProject(owner, project)
+	if conf.Frozen {
+		s.indexFrozen(owner, project, conf)
+		return nil
+	}
+
+	if err := s.checkRateLimit(owner, project); err != nil {
+		return err
+	}
+
 	minVersion := s.index.minVersion(owner, project)
-	releases, err := s.fetcher.releases(owner, project, minVersion)
-	if err != nil {
+	maxVersion := s.index.maxVersion(owner, project)
+	releases, err := s.fetcherFor(owner, project).releases(owner, repositoryName(project), minVersion, maxVersion)
+	if err != nil && Cause(err) == ErrNotFound && s.isDefaultProject(owner, project) {
+		s.missing.add(project)
+		return err
+	} else if err != nil {
+		s.recordRateLimit(owner, project, err)
+		s.index.refreshFailed(owner, project, err)
 		return err
 	}
 
+	deleted := s.deletedReleases(owner, project, releases)
+
+	// the releases are fetched sorted as semantic versions and filtered by
+	// the minimum version only if they are.
+	scheme := conf.versionScheme()
+	releases, skipped := validReleases(releases, scheme)
+	s.skipTags(owner, project, scheme, skipped)
+	if !conf.isSemver() {
+		sortReleases(releases, scheme)
+		if conf.MinVersion != "" {
+			releases = withoutOlder(releases, s.olderThan(owner, project, conf.MinVersion))
+		}
+	}
+
+	if !conf.Prereleases {
+		releases = withoutPrereleases(releases)
+	}
+
+	if len(conf.ExcludeVersions) > 0 {
+		releases = withoutExcluded(conf, releases)
+	}
+
 	s.index.set(owner, project, releases)
+	s.latest.invalidate(owner, project)
+	s.cleanDeletedReleases(owner, project, deleted)
+	s.rebuildRetagged(owner, project, releases)
+	s.indexBranches(owner, project)
+	s.indexDomains(owner, project, releases)
+	s.refreshPullRequests(owner, project)
 	return nil
 }
 
-// refreshIndex refreshes the version index of the projects already installed.
-func (s *Service) refreshIndex() {
-	for _, key := range s.index.getProjects() {
-		parts := splitKey(key)
-		if len(parts) != 2 {
-			logrus.WithField("key", key).Error("not a valid project key")
+// rebuildRetagged rebuilds in the background the installed versions of the
+// given releases whose tag now points to a different commit than the one they
+// were built from, holding their lock.
+func (s *Service) rebuildRetagged(owner, project string, releases []*release) {
+	projectConf, _ := s.config().ForProject(owner, project)
+	for _, r := range releases {
+		installed, ok := s.index.installation(owner, project, r.tag)
+		if !ok || r.sha == "" || installed.sha == r.sha {
 			continue
 		}
-		owner, project := parts[0], parts[1]
 
-		err := s.indexProject(owner, project)
+		if installed.sha == "" {
+			// the versions installed before the commit of their tag was
+			// known are assumed to be built from the current one.
+			installed.sha = r.sha
+			s.index.install(installed)
+			continue
+		}
+
+		if _, ok := s.rebuilding.Load(newKey(owner, project, r.tag)); ok {
+			continue
+		}
+
+		tag, sha := r.tag, r.sha
+		stillRetagged := func() bool {
+			installed, ok := s.index.installation(owner, project, tag)
+			return ok && installed.sha != sha
+		}
+
+		installed.log().Infof("release was re-tagged from %s to %s, rebuilding", installed.sha, r.sha)
+		installed.setSource(projectConf, r)
+		installed.sha = r.sha
+		go s.rebuildIf(context.Background(), installed, stillRetagged)
+	}
+}
+
+// indexBranches indexes the configured branches of the given project and
+// rebuilds in the background the installed ones whose HEAD has moved, unless
+// they are already being rebuilt. The rebuilds hold the lock of the branch,
+// so a request or another instance never builds it at the same time.
+func (s *Service) indexBranches(owner, project string) {
+	conf, ok := s.config().ForProject(owner, project)
+	if !ok || len(conf.Branches) == 0 {
+		return
+	}
+
+	var branches []*release
+	for _, name := range conf.Branches {
+		log := logrus.WithFields(logrus.Fields{
+			"project": project,
+			"owner":   owner,
+			"branch":  name,
+		})
+
+		b, err := s.fetcherFor(owner, project).branch(owner, repositoryName(project), name)
 		if err != nil {
-			logrus.WithField("owner", owner).
-				WithField("project", project).
-				Errorf("error refreshing project: %s", err)
+			log.Errorf("error fetching branch: %s", err)
+			if prev := s.index.get(owner, project, name); prev != nil {
+				branches = append(branches, prev)
+			}
+			continue
 		}
+		branches = append(branches, b)
+
+		moved := func() bool {
+			installed, ok := s.index.installation(owner, project, name)
+			return ok && installed.sha != b.sha
+		}
+
+		if _, ok := s.rebuilding.Load(newKey(owner, project, name)); ok || !moved() {
+			continue
+		}
+
+		installed, _ := s.index.installation(owner, project, name)
+		log.Debugf("branch HEAD moved from %s to %s, rebuilding", installed.sha, b.sha)
+		installed.tarballURL = b.url
+		installed.sha = b.sha
+		go s.rebuildIf(context.Background(), installed, moved)
 	}
+
+	s.index.setBranches(owner, project, branches)
 }
 
 // ManageIndex is in charge of refreshing the index of projects every
-// five minutes until the given context is cancelled.
+// five minutes until the given context is cancelled. It first resumes the
+// builds that were pending when docsrv stopped and, if Preheat is enabled,
+// it also starts building all the releases in the background.
 func (s *Service) ManageIndex(refreshInterval time.Duration, ctx context.Context) {
+	s.resumePendingBuilds()
+	if s.opts.Preheat {
+		go s.preheat(ctx)
+	}
+
 	for {
 		select {
 		case <-time.After(refreshInterval):
-			s.refreshIndex()
+			if err := s.refreshIndex(); err != nil {
+				logrus.Errorf("error refreshing index: %s", err)
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -115,26 +706,154 @@ func (s *Service) ManageIndex(refreshInterval time.Duration, ctx context.Context
 
 // projectVersions returns all the versions available for the given project.
 func (s *Service) projectVersions(req *http.Request, owner, project string) []*version {
-	releases := s.index.forProject(owner, project)
-	var versions []*version
+	return s.filteredVersions(req, owner, project, defaultVersionFilter)
+}
+
+// filteredVersions returns the versions available for the given project that
+// pass the given filter.
+func (s *Service) filteredVersions(req *http.Request, owner, project string, f versionFilter) []*version {
+	releases := s.filteredReleases(req, owner, project, f)
+	versions := make([]*version, 0, len(releases))
 	for _, r := range releases {
-		versions = append(versions, &version{
-			Text: r.tag,
-			URL:  urlFor(req, r.tag, ""),
-		})
+		versions = append(versions, s.versionOf(owner, project, r, urlFor(req, r.tag, "")))
 	}
 	return versions
 }
 
+// versionOf returns the version of the given release of the given project,
+// whose docs are at the given URL.
+func (s *Service) versionOf(owner, project string, r *release, url string) *version {
+	return &version{
+		Text:       r.tag,
+		URL:        url,
+		Installed:  s.index.isInstalled(owner, project, r.tag),
+		Prerelease: r.prerelease,
+		ReleasedAt: releasedAt(r),
+	}
+}
+
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer recoverFromPanic(w, r)
-	logrus.WithField("path", r.URL.Path).Debug("new request received")
+	start := time.Now()
+	r = withRequestID(r)
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	w.Header().Set(requestIDHeader, requestID(r))
+	defer logRequest(rec, r, start)
+	defer s.logAccess(rec, r, start)
+	defer s.stats.countRequest(rec)
+	defer s.recoverFromPanic(w, r)
+
+	r, trace := startTrace(r)
+	defer s.finishTrace(trace)
+	r, span := s.startRequestSpan(r)
+	defer finishRequestSpan(span, rec)
+	r = s.routeByPath(r)
+	r = s.routeAlias(r)
+	defer s.auditRequest(rec, r)
+	s.serveWithLimits(w, r, s.route)
+}
+
+// route serves the given request with the handler of its path.
+func (s *Service) route(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).WithField("path", r.URL.Path).Debug("new request received")
+	busted := stripCacheBusting(r)
+
+	if s.redirectToCanonical(w, r) {
+		return
+	}
+
+	if s.forHost(r.Host).NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	w = s.withCacheControl(w, r, busted)
+
+	if r.URL.Path == robotsPath {
+		s.serveRobots(w, r)
+		return
+	}
+
+	if r.URL.Path == authCallbackPath {
+		s.authCallback(w, r)
+		return
+	}
+
+	if r.URL.Path == buildReportPath {
+		s.serveBuildReport(w, r)
+		return
+	}
+
+	if isLandingPath(r.URL.Path) && s.isLandingHost(r.Host) {
+		s.landingPage(w, r)
+		return
+	}
+
+	if r.URL.Path != "/api/webhook" && !s.authorize(w, r) {
+		return
+	}
+
+	if message, ok := s.inMaintenance(r.Host); ok && !isMaintenanceExempt(r.URL.Path) {
+		s.underMaintenance(w, r, message)
+		return
+	}
 
 	if r.URL.Path == "/versions.json" {
 		s.listVersions(w, r)
+	} else if r.URL.Path == versionsV2Path {
+		s.listVersionsV2(w, r)
+	} else if r.URL.Path == "/search.json" {
+		s.searchDocs(w, r)
+	} else if r.URL.Path == "/api/export" {
+		s.exportSite(w, r)
+	} else if strings.HasPrefix(r.URL.Path, bulkPath) {
+		s.bulkOperation(w, r)
+	} else if strings.HasPrefix(r.URL.Path, rebuildPrefix) {
+		s.forceRebuild(w, r)
+	} else if r.URL.Path == buildRefPath {
+		s.buildRef(w, r)
+	} else if strings.HasPrefix(r.URL.Path, mirrorPrefix) {
+		s.serveMirror(w, r)
+	} else if r.URL.Path == openAPIPath {
+		s.serveOpenAPI(w, r)
+	} else if r.URL.Path == statsPath {
+		s.serveStats(w, r)
+	} else if r.URL.Path == statePath {
+		s.manageState(w, r)
+	} else if r.URL.Path == quarantinePath {
+		s.manageQuarantine(w, r)
+	} else if r.URL.Path == minVersionPath {
+		s.manageMinVersion(w, r)
+	} else if r.URL.Path == maintenancePath {
+		s.manageMaintenance(w, r)
+	} else if r.URL.Path == validateConfigPath {
+		s.validateConfig(w, r)
+	} else if r.URL.Path == "/api/webhook" {
+		s.pullRequestWebhook(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/pr/") {
+		s.redirectToPullRequest(w, r)
+	} else if r.URL.Path == "/project.json" {
+		s.projectMetadata(w, r)
+	} else if r.URL.Path == manifestPath {
+		s.serveManifest(w, r)
+	} else if isVersionStatusPath(r.URL.Path) {
+		s.versionStatus(w, r)
+	} else if isBadgePath(r.URL.Path) {
+		s.serveBadge(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/latest/") {
 		s.redirectToLatest(w, r)
-	} else {
+	} else if r.URL.Path == "/" {
+		s.redirectFromRoot(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/next/") && s.prereleasesEnabled(r.Host) {
+		s.redirectToNext(w, r)
+	} else if r.URL.Path == diffPath {
+		s.serveDiff(w, r)
+	} else if r.URL.Path == changelogPath {
+		s.serveChangelog(w, r)
+	} else if isReleaseNotesPath(r.URL.Path) {
+		s.serveReleaseNotes(w, r)
+	} else if kind, ok := bundleKindForPath(r.URL.Path); ok {
+		s.serveBundle(w, r, kind)
+	} else if !s.serveStatic(w, r) {
 		s.prepareVersion(w, r)
 	}
 }
@@ -142,68 +861,254 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type version struct {
 	Text string `json:"text"`
 	URL  string `json:"url"`
+	// Installed reports whether the docs of the version are already built,
+	// so the versions that require a build can be told apart.
+	Installed  bool       `json:"installed"`
+	Prerelease bool       `json:"prerelease"`
+	ReleasedAt *time.Time `json:"released-at"`
 }
 
 // listVersions is an HTTP handler that will output a JSON with all the versions
-// available for a project.
+// available for a project. The versions can be filtered by major version,
+// limited and sorted with the parameters of the query string.
 func (s *Service) listVersions(w http.ResponseWriter, r *http.Request) {
-	owner, project, ok := s.opts.Config.ProjectForHost(r.Host)
+	owner, project, ok := s.projectForHost(r.Host)
 	if !ok {
-		notFound(w, r)
+		s.notFound(w, r)
 		return
 	}
 
-	log := logrus.WithField("project", project).
-		WithField("owner", owner)
+	log := projectLog(r, owner, project)
 
-	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
-		log.Error("error indexing project: %s", err)
-		internalError(w, r)
+	filter, err := parseVersionFilter(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	versions := s.projectVersions(r, owner, project)
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
 
-	data, err := json.Marshal(versions)
-	if err != nil {
+	versions := s.filteredVersions(r, owner, project, filter)
+	if err := s.writeVersions(w, r, owner, project, versions); err != nil {
 		log.Errorf("error serving project versions: %s", err)
-		internalError(w, r)
-		return
+		s.internalError(w, r)
+	}
+}
+
+// writeJSON writes the given value encoded as JSON to the response using one
+// of the pooled buffers.
+func (s *Service) writeJSON(w http.ResponseWriter, v interface{}) error {
+	buf := s.buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer s.buffers.Put(buf)
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	// strip the newline added by the encoder
+	_, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return err
+}
+
+// projectInfo is the metadata of a project.
+type projectInfo struct {
+	Repository       string     `json:"repository"`
+	Latest           *string    `json:"latest"`
+	LatestPrerelease *string    `json:"latest-prerelease"`
+	Versions         []*version `json:"versions"`
+}
+
+// projectMetadata is an HTTP handler that will output a JSON with the
+// metadata of the project, including its latest version and latest
+// prerelease, if any.
+func (s *Service) projectMetadata(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	releases := s.releasesForHost(r.Host, owner, project)
+	meta := projectInfo{
+		Repository: repositoryKey(owner, project),
+		Versions:   s.projectVersions(r, owner, project),
+	}
+	if latest := latestRelease(releases); latest != nil {
+		meta.Latest = &latest.tag
+	}
+	if next := latestPrerelease(releases); next != nil {
+		meta.LatestPrerelease = &next.tag
+	}
+
+	if err := s.writeJSON(w, meta); err != nil {
+		log.Errorf("error serving project metadata: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// prereleasesEnabled reports whether or not the project in the given host
+// serves the docs of its prereleases.
+func (s *Service) prereleasesEnabled(host string) bool {
+	owner, project, ok := s.projectForHost(host)
+	if !ok {
+		return false
+	}
+
+	conf, _ := s.config().ForProject(owner, project)
+	return conf.Prereleases
+}
+
+// withoutExcluded returns the given releases except the ones excluded by
+// the given project configuration.
+func withoutExcluded(conf ProjectConfig, releases []*release) []*release {
+	result := make([]*release, 0, len(releases))
+	for _, r := range releases {
+		if !conf.ExcludesVersion(r.tag) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// releasesForHost returns the releases of the given project that are not
+// newer than the maximum version of the given host. Since the index holds the
+// releases up to the greatest maximum version of all the hosts of a project,
+// the hosts with a lower one need to filter them.
+func (s *Service) releasesForHost(host, owner, project string) []*release {
+	releases := s.index.forProject(owner, project)
+	maxVersion := s.forHost(host).maxVersion()
+	if maxVersion == nil {
+		return releases
+	}
+
+	result := make([]*release, 0, len(releases))
+	for _, r := range releases {
+		if !maxVersion.excludes(newVersion(r.tag)) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// withoutPrereleases returns the given releases except the prereleases.
+func withoutPrereleases(releases []*release) []*release {
+	result := make([]*release, 0, len(releases))
+	for _, r := range releases {
+		if !r.prerelease {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// redirectToNext is an HTTP handler that will redirect to the latest
+// prerelease of the project, or to the latest version if there is no
+// prerelease newer than it, preserving the path it had in the original
+// request.
+func (s *Service) redirectToNext(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	releases := s.releasesForHost(r.Host, owner, project)
+	next := latestPrerelease(releases)
+	if next == nil {
+		next = latestRelease(releases)
+	}
+
+	if next == nil {
+		log.Warn("no releases found for project")
+		s.notFound(w, r)
+		return
+	}
+
+	redirectToVersion(w, r, next.tag)
+}
+
+// redirectFromRoot is an HTTP handler that redirects the root of a host to the
+// default version of its project, if any, or to the latest version otherwise.
+func (s *Service) redirectFromRoot(w http.ResponseWriter, r *http.Request) {
+	version := s.forHost(r.Host).DefaultVersion
+	if version == "" {
+		s.redirectToLatest(w, r)
+		return
+	}
+
+	if _, _, ok := s.projectForHost(r.Host); !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	if languages := s.languagesForHost(r.Host); len(languages) > 0 {
+		w.Header().Add("Vary", "Accept-Language, Cookie")
+		http.Redirect(w, r, urlFor(r, version, preferredLanguage(r, languages))+"/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	redirectToVersion(w, r, version)
 }
 
 // redirectToLatest is an HTTP service that will redirect to the latest version
-// of the project preserving the path it had in the original request.
+// of the project preserving the path it had in the original request. The
+// root of the latest version of localized docs redirects to the language
+// preferred by the user.
 func (s *Service) redirectToLatest(w http.ResponseWriter, r *http.Request) {
-	owner, project, ok := s.opts.Config.ProjectForHost(r.Host)
+	owner, project, ok := s.projectForHost(r.Host)
 	if !ok {
-		logrus.Warnf("could not find suitable project config for host: %s", r.Host)
-		notFound(w, r)
+		requestLog(r).Warnf("could not find suitable project config for host: %s", r.Host)
+		s.notFound(w, r)
 		return
 	}
 
-	log := logrus.WithField("project", project).
-		WithField("owner", owner)
+	log := projectLog(r, owner, project)
 	defer log.Debug("correctly redirected to latest version")
 
 	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
 		log.Errorf("error indexing project: %s", err)
-		internalError(w, r)
+		s.handleError(w, r, err)
 		return
 	}
 
-	releases := s.index.forProject(owner, project)
-	if len(releases) == 0 {
+	latest, ok := s.latestForHost(r.Host, owner, project)
+	if !ok {
 		log.Warn("no releases found for project")
-		notFound(w, r)
+		s.notFound(w, r)
+		return
+	}
+
+	// the root of localized docs redirects to the language of the user.
+	if languages := s.languagesForHost(r.Host); len(languages) > 0 && (r.URL.Path == "/" || r.URL.Path == "/latest/") {
+		w.Header().Add("Vary", "Accept-Language, Cookie")
+		lang := preferredLanguage(r, languages)
+		http.Redirect(w, r, urlFor(r, latest, lang)+"/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	latest := releases[len(releases)-1]
-	redirectToVersion(w, r, latest.tag)
+	redirectToVersion(w, r, latest)
 }
 
 // prepareVersion is an HTTP handler that will fetch, download and build the
@@ -211,29 +1116,44 @@ func (s *Service) redirectToLatest(w http.ResponseWriter, r *http.Request) {
 // built and then redirect the user to the same visit so the webserver can
 // serve the static documentation.
 func (s *Service) prepareVersion(w http.ResponseWriter, r *http.Request) {
-	owner, project, ok := s.opts.Config.ProjectForHost(r.Host)
+	owner, project, ok := s.projectForHost(r.Host)
 	if !ok {
-		notFound(w, r)
+		s.notFound(w, r)
 		return
 	}
 
 	var (
 		version = versionFromReq(r)
-		log     = logrus.WithField("project", project).
-			WithField("owner", owner).
-			WithField("version", version)
+		log     = projectLog(r, owner, project).WithField("version", version)
 	)
 
-	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+	endIndex := startSpan(r, "index")
+	indexSpan := spanFromRequest(r).startChild("index")
+	err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project)
+	indexSpan.finish(err)
+	endIndex()
+	if err != nil {
 		log.Errorf("error indexing project: %s", err)
-		internalError(w, r)
+		s.handleError(w, r, err)
 		return
 	}
 
-	if s.index.isInstalled(owner, project, version) {
+	if conf, ok := s.index.installation(owner, project, version); ok {
+		if url, status, ok := redirectRulePage(r, conf); ok {
+			log.Debugf("page redirected to %s", url)
+			http.Redirect(w, r, url, status)
+			return
+		}
+
+		if url, ok := s.fallbackPage(r, owner, project, version); ok {
+			log.Debugf("page not found, redirecting to %s", url)
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+
 		// If the version is not a version, it's probably a file, so send just a basic 404 status
 		// code instead of the full not found page.
-		if _, err := semver.NewVersion(version); err != nil {
+		if projectConf, _ := s.config().ForProject(owner, project); !projectConf.versionScheme().valid(version) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -242,51 +1162,347 @@ func (s *Service) prepareVersion(w http.ResponseWriter, r *http.Request) {
 
 		// if docs for this version are installed but the request made it here
 		// it means the document being requested does not exist.
-		notFound(w, r)
+		s.notFound(w, r)
+		return
+	}
+
+	// partial versions, such as /v1/ or /1.4/, redirect to the greatest
+	// release they match.
+	if resolved, ok := s.resolveVersion(r.Host, owner, project, version); ok {
+		log.WithField("resolved", resolved).Debug("partial version resolved")
+		redirectToVersion(w, r, resolved)
+		return
+	}
+
+	// frozen projects are only served from the installed docs, so the page
+	// does not exist if it made it here.
+	if projectConf, _ := s.config().ForProject(owner, project); projectConf.Frozen {
+		log.Debug("project is frozen, not building the version")
+		s.notFound(w, r)
 		return
 	}
 
+	if n, ok := pullRequestNumber(version); ok {
+		// building a pull request runs its code, so the previews are only
+		// built by its webhook or by administrators, never by visitors.
+		if !s.isAdmin(r) {
+			log.Debug("pull request preview is not built yet")
+			s.notFound(w, r)
+			return
+		}
+
+		if _, err := s.indexPullRequest(owner, project, n); err != nil {
+			log.Errorf("error indexing pull request: %s", err)
+			s.handleError(w, r, err)
+			return
+		}
+	}
+
 	release := s.index.get(owner, project, version)
 	if release == nil {
 		log.Debug("release was not found")
-		notFound(w, r)
+		s.notFound(w, r)
+		return
+	}
+
+	if s.forHost(r.Host).maxVersion().excludes(newVersion(release.tag)) {
+		log.Debug("release is newer than the maximum version of the host")
+		s.notFound(w, r)
 		return
 	}
 
 	host := strings.Split(r.Host, ":")[0]
-	destination := filepath.Join(s.opts.BaseFolder, host, version)
+	if err := s.linkHost(host, owner, project); err != nil {
+		log.Errorf("could not link host folder for project %s: %s", project, err)
+		s.internalError(w, r)
+		return
+	}
+
+	if _, ok := s.quarantine.get(owner, project, version); ok {
+		log.Debug("version is quarantined")
+		quarantined(w, r, project, version)
+		return
+	}
+
+	// administrators can build again the versions that failed right away
+	if failure, ok := s.failures.get(owner, project, version); ok && failure.backingOff() && !s.isAdmin(r) {
+		log.Debug("version build failed recently, not building it again yet")
+		buildBackingOff(w, r, project, version, failure)
+		return
+	}
+
+	if s.serveScheduledBuild(w, r, owner, project, version) {
+		return
+	}
+
+	conf := s.newBuildConfig(r, owner, project, release)
+	unlock, err := s.coordinator.Lock(r.Context(), newKey(owner, project, version))
+	if err != nil {
+		log.Errorf("could not acquire the build lock: %s", err)
+		s.internalError(w, r)
+		return
+	}
+	defer unlock()
+
+	// the version may have been built while waiting for the lock
+	if s.index.isInstalled(owner, project, version) || s.installedByPeer(conf) {
+		log.Debug("version was installed while waiting for the build lock")
+		http.Redirect(w, r, selfURL(r), http.StatusTemporaryRedirect)
+		return
+	}
+
+	if err := s.scheduler.admit(owner); err != nil {
+		log.Warnf("build refused: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	releaseSlot, ok := s.scheduler.tryAcquire(owner)
+	if !ok {
+		s.scheduleBuild(conf)
+		buildQueued(w, r, project, version, s.scheduler.position(newKey(owner, project, version)))
+		return
+	}
+	defer releaseSlot()
+
+	destination := conf.destination
 	if err := os.MkdirAll(destination, 0740); err != nil {
 		log.Errorf("could not build folder structure for project %s: %s", project, err)
-		internalError(w, r)
+		s.internalError(w, r)
 		return
 	}
 
 	log.Debug("building documentation site")
-	conf := buildConfig{
-		tarballURL:   release.url,
-		baseURL:      urlFor(r, version, "") + "/",
-		hostName:     host,
-		destination:  destination,
-		sharedFolder: s.opts.SharedFolder,
-		version:      version,
-		project:      project,
-		owner:        owner,
-	}
-	if err := buildDocs(conf); err != nil {
+	conf = conf.withSharedFingerprint()
+	markBuild(r)
+	endBuild := startSpan(r, "build")
+	start := time.Now()
+	err = buildDocs(conf)
+	endBuild()
+	conf.buildDuration = time.Since(start)
+	s.buildFinished(conf, conf.buildDuration, err)
+	if err != nil {
 		log.Errorf("could not build docs for project %s: %s", project, err)
+		logBuildOutput(log, err)
 
 		if deleteErr := os.RemoveAll(destination); deleteErr != nil {
 			log.Errorf("could not remove output folder for project %s after failing its doc generation: %s", project, err)
 		}
 
-		internalError(w, r)
+		if e, ok := Cause(err).(*ErrQuarantined); ok {
+			s.quarantineVersion(conf, e)
+		}
+
+		if e, ok := Cause(err).(*ErrBuildFailed); ok {
+			report := newBuildReport(conf, e)
+			s.reports.add(report)
+			log.WithField("report_id", report.ID).Debug("build report created")
+			if s.isAdmin(r) {
+				s.buildFailed(w, r, report)
+				return
+			}
+		}
+
+		s.handleError(w, r, err)
 		return
 	}
 
-	s.index.install(owner, project, version)
+	s.markInstalled(conf)
+	if projectConf, _ := s.config().ForProject(owner, project); projectConf.PrefetchAdjacent {
+		s.prefetchAdjacent(r, owner, project, version)
+	}
 
 	log.Debug("version successfully installed and prepared")
-	http.Redirect(w, r, r.URL.String(), http.StatusTemporaryRedirect)
+	http.Redirect(w, r, selfURL(r), http.StatusTemporaryRedirect)
+}
+
+// newBuildConfig returns the configuration to build the given release of a
+// project requested with the given request.
+func (s *Service) newBuildConfig(r *http.Request, owner, project string, release *release) buildConfig {
+	projectConf, _ := s.config().ForProject(owner, project)
+	version := release.tag
+	conf := buildConfig{
+		sha:            release.sha,
+		baseURL:        urlFor(r, version, "") + "/",
+		hostName:       stripPort(publicHost(r)),
+		destination:    s.versionFolder(owner, project, version),
+		sharedFolder:   s.opts.SharedFolder,
+		sharedVersion:  projectConf.SharedVersion,
+		version:        version,
+		project:        project,
+		docsPath:       cleanDocsPath(projectConf.DocsPath),
+		owner:          owner,
+		assetHashes:    projectConf.AssetHashes,
+		sharedFiles:    projectConf.SharedFiles,
+		env:            buildEnv(projectConf, version, stripPort(publicHost(r))),
+		sandbox:        s.sandbox,
+		cgroups:        s.cgroups,
+		noIndex:        projectConf.NoIndex,
+		offlineBundles: projectConf.OfflineBundles,
+		pdfCommand:     s.pdfCommand(projectConf),
+		precompress:    s.opts.Precompress,
+		brotliCommand:  s.opts.BrotliCommand,
+		httpClient:     s.downloadClient(owner, project),
+		cache:          s.artifacts,
+		upstreamURL:    s.opts.UpstreamURL,
+		upstreamToken:  s.opts.RefreshToken,
+		fallbackTheme:  s.opts.FallbackTheme,
+		requestID:      requestID(r),
+		tracer:         s.tracer,
+		trace:          spanFromRequest(r).context(),
+		screening: screeningRules{
+			maxSymlinkDepth: s.opts.MaxSymlinkDepth,
+			forbiddenTypes:  s.opts.ForbiddenFileTypes,
+			scanCommand:     s.opts.ScanCommand,
+		},
+	}
+	conf.setSource(projectConf, release)
+	if projectConf.CanonicalLinks {
+		conf.canonicalBaseURL = s.canonicalBaseURL(r, owner, project, version)
+	}
+	conf.deprecationBanner = s.deprecationBanner(r, owner, project, version)
+	return conf
+}
+
+// canonicalBaseURL returns the base URL of the latest version of the project
+// if the given version is older than it, or an empty string otherwise.
+func (s *Service) canonicalBaseURL(r *http.Request, owner, project, version string) string {
+	latest := latestRelease(s.releasesForHost(r.Host, owner, project))
+	projectConf, _ := s.config().ForProject(owner, project)
+	scheme := projectConf.versionScheme()
+	if latest == nil || !scheme.valid(version) || !scheme.valid(latest.tag) ||
+		scheme.compare(version, latest.tag) >= 0 {
+		return ""
+	}
+	return urlFor(r, latest.tag, "") + "/"
+}
+
+// rebuild builds again an already installed version with the given
+// configuration, once the build scheduler lets it start. The new
+// documentation is built in a temporary folder that replaces the current one
+// once the build is finished, so the installed version keeps being served in
+// the meantime. Errors are logged, but also returned for the callers that
+// report them.
+func (s *Service) rebuild(conf buildConfig) error {
+	key := newKey(conf.owner, conf.project, conf.version)
+	defer s.trackPending(conf, isDir(conf.destination))()
+	release, err := s.scheduler.acquire(context.Background(), conf.owner, key, conf.interactive)
+	if err != nil {
+		if Cause(err) == ErrQuotaExceeded {
+			s.auditEvent("refuse-build", conf.owner, conf.project, conf.version, err.Error())
+		}
+		return err
+	}
+	defer release()
+
+	return s.replaceDocs(conf)
+}
+
+// rebuildIf rebuilds the version with the given configuration holding its
+// lock, so it's never built at the same time by a request or another
+// instance, if the given condition still holds once the lock is taken.
+// Reports whether or not it was rebuilt.
+func (s *Service) rebuildIf(ctx context.Context, conf buildConfig, cond func() bool) (bool, error) {
+	unlock, err := s.coordinator.Lock(ctx, newKey(conf.owner, conf.project, conf.version))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if !cond() {
+		return false, nil
+	}
+
+	if err := s.rebuild(conf); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// replaceDocs builds the version with the given configuration in a temporary
+// folder that replaces its docs once the build is finished. The build must
+// have been let to start by the build scheduler.
+func (s *Service) replaceDocs(conf buildConfig) error {
+	log := conf.log()
+	if q, ok := s.quarantine.get(conf.owner, conf.project, conf.version); ok {
+		log.Debug("version is quarantined, skipping rebuild")
+		return &ErrQuarantined{q.Reason}
+	}
+
+	if s.pauseBuild(conf) {
+		return ErrMaintenance
+	}
+
+	key := newKey(conf.owner, conf.project, conf.version)
+	s.rebuilding.Store(key, true)
+	defer s.rebuilding.Delete(key)
+
+	destination := conf.destination
+	tmpDir, err := ioutil.TempDir(filepath.Dir(destination), "."+conf.version+"-")
+	if err != nil {
+		log.Errorf("could not create temporary folder for rebuild: %s", err)
+		return wrap(err, "could not create temporary folder for rebuild")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf.destination = tmpDir
+	conf = conf.withSharedFingerprint()
+	start := time.Now()
+	err = buildDocs(conf)
+	conf.buildDuration = time.Since(start)
+	s.buildFinished(conf, conf.buildDuration, err)
+	if err != nil {
+		log.Errorf("could not rebuild docs: %s", err)
+		logBuildOutput(log, err)
+		if e, ok := Cause(err).(*ErrQuarantined); ok {
+			s.quarantineVersion(conf, e)
+		}
+		return err
+	}
+
+	// tmpDir is created with 0700, but the webserver needs to read it.
+	if err := os.Chmod(tmpDir, 0740); err != nil {
+		log.Errorf("could not set permissions of rebuilt docs: %s", err)
+		return wrap(err, "could not set permissions of rebuilt docs")
+	}
+
+	if err := os.RemoveAll(destination); err != nil {
+		log.Errorf("could not remove previous docs: %s", err)
+		return wrap(err, "could not remove previous docs")
+	}
+
+	if err := os.Rename(tmpDir, destination); err != nil {
+		log.Errorf("could not move rebuilt docs to their destination: %s", err)
+		return wrap(err, "could not move rebuilt docs to their destination")
+	}
+
+	conf.destination = destination
+	s.markInstalled(conf)
+	log.Debug("version successfully rebuilt")
+	return nil
+}
+
+// markInstalled marks as installed the version built with the given
+// configuration.
+func (s *Service) markInstalled(conf buildConfig) {
+	conf.builtAt = time.Now()
+	conf.builder = s.builder
+	conf.redirects = loadRedirectRules(conf)
+	if conf.sharedFingerprint.hash != "" {
+		if err := writeSharedFingerprint(conf.destination, conf.sharedFingerprint); err != nil {
+			conf.log().Warnf("could not write the shared fingerprint: %s", err)
+		}
+	}
+	s.index.install(conf)
+	s.indexForSearch(conf)
+	s.sizes.update(conf.destination)
+	s.hashVersion(conf)
+	s.writeState()
+
+	key := newKey(conf.owner, conf.project, conf.version)
+	if err := s.coordinator.MarkInstalled(key); err != nil {
+		conf.log().Errorf("could not share the installed version with other instances: %s", err)
+	}
 }
 
 func ensureEndingSlash(url string) string {
@@ -296,18 +1512,32 @@ func ensureEndingSlash(url string) string {
 	return url + "/"
 }
 
-func notFound(w http.ResponseWriter, r *http.Request) {
-	url := fmt.Sprintf("%s://%s/404/", reqScheme(r), r.Host)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+const sharedFolderMessage = `The documentation of %s %s can not be built right now because the shared assets needed to build it are missing.
+The administrators have been notified, please try again later.`
+
+const downloadFailedMessage = `The documentation of %s %s can not be built right now because its sources could not be downloaded from GitHub.
+Please try again in a few minutes.`
+
+// unavailable responds with a 503 status code and the given message, which is
+// meant to be read by the user.
+func unavailable(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("Retry-After", "300")
+	httpError(w, r, msg, http.StatusServiceUnavailable)
 }
 
-func internalError(w http.ResponseWriter, r *http.Request) {
-	url := fmt.Sprintf("%s://%s/500/", reqScheme(r), r.Host)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+// quarantined responds with a 403 status code explaining that the docs of the
+// given version can not be built because it's quarantined.
+func quarantined(w http.ResponseWriter, r *http.Request, project, version string) {
+	httpError(w, r, fmt.Sprintf(quarantinedMessage, project, version), http.StatusForbidden)
 }
 
+// redirectToVersion redirects to the given version preserving the path of the
+// request after its first segment, e.g. /latest/foo to /${VERSION}/foo.
 func redirectToVersion(w http.ResponseWriter, r *http.Request, version string) {
-	path := strings.Replace(r.URL.Path, "/latest/", "", 1)
+	var path string
+	if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2); len(parts) == 2 {
+		path = parts[1]
+	}
 	url := urlFor(r, version, path)
 	if path == "" {
 		url = ensureEndingSlash(url)
@@ -316,7 +1546,7 @@ func redirectToVersion(w http.ResponseWriter, r *http.Request, version string) {
 }
 
 func urlFor(r *http.Request, version, path string) string {
-	return reqScheme(r) + "://" + filepath.Join(r.Host, version, path)
+	return reqScheme(r) + "://" + filepath.Join(publicHost(r), version, path)
 }
 
 func projectNameFromReq(r *http.Request) string {
@@ -327,11 +1557,11 @@ func versionFromReq(r *http.Request) string {
 	return strings.Split(strings.TrimLeft(r.URL.Path, "/"), "/")[0]
 }
 
-func recoverFromPanic(w http.ResponseWriter, req *http.Request) {
+func (s *Service) recoverFromPanic(w http.ResponseWriter, req *http.Request) {
 	if r := recover(); r != nil {
-		logrus.WithField("URL", req.URL.String()).
+		requestLog(req).WithField("URL", req.URL.String()).
 			Errorf("recovered from panic: %v", r)
-		internalError(w, req)
+		s.internalError(w, req)
 	}
 }
 
@@ -339,9 +1569,55 @@ func reqScheme(r *http.Request) string {
 	scheme := r.URL.Scheme
 	if scheme == "" {
 		scheme = r.Header.Get("X-Forwarded-Proto")
-		if scheme == "" {
+		if scheme == "" && r.TLS != nil {
+			scheme = "https"
+		} else if scheme == "" {
 			scheme = "http"
 		}
 	}
 	return scheme
 }
+
+// cacheBustingParams are the query string parameters commonly used to bust
+// caches of static assets.
+var cacheBustingParams = map[string]struct{}{
+	"v":   {},
+	"ver": {},
+	"_":   {},
+	"cb":  {},
+}
+
+var bareHashRegexp = regexp.MustCompile(`^[0-9a-fA-F]{6,64}$`)
+
+// stripCacheBusting removes from the query string of the request the
+// parameters used to bust caches of static assets, both the named ones, such
+// as `?v=abc123`, and bare hashes, such as `?abc123`, so they don't affect
+// the routing or the serving of files. Will also report whether or not the
+// request had any of them.
+func stripCacheBusting(r *http.Request) bool {
+	if r.URL.RawQuery == "" {
+		return false
+	}
+
+	var parts []string
+	var busted bool
+	for _, p := range strings.Split(r.URL.RawQuery, "&") {
+		name := p
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			name = p[:i]
+		} else if bareHashRegexp.MatchString(p) {
+			busted = true
+			continue
+		}
+
+		if _, ok := cacheBustingParams[name]; ok {
+			busted = true
+			continue
+		}
+
+		parts = append(parts, p)
+	}
+
+	r.URL.RawQuery = strings.Join(parts, "&")
+	return busted
+}
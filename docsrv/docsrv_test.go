@@ -4,7 +4,10 @@ import (
 	"context"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,7 +18,8 @@ func TestRedirectToLatest(t *testing.T) {
 	fetcher := newMockFetcher()
 	srv := newTestSrv(fetcher, Config{
 		"proj1.foo.bar": ProjectConfig{
-			"org/proj1", "v0.9.0",
+			Repository: "org/proj1",
+			MinVersion: "v0.9.0",
 		},
 	})
 
@@ -46,17 +50,27 @@ func TestRedirectToLatest(t *testing.T) {
 	)
 
 	// no versions available
-	assertRedirect(
-		t, srv,
-		"http://proj2.foo.bar/latest/",
-		"http://proj2.foo.bar/404/",
-	)
+	assertNotFound(t, srv, "http://proj2.foo.bar/latest/")
+}
+
+func TestRedirectFromRoot(t *testing.T) {
+	fetcher := newMockFetcher()
+	fetcher.add("org", "proj1", "v1.0.0", "")
+	fetcher.add("org", "proj1", "v1.1.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"proj1.foo.bar": ProjectConfig{Repository: "org/proj1"},
+		"v1.foo.bar":    ProjectConfig{Repository: "org/proj1", DefaultVersion: "v1.0.0"},
+	})
+
+	assertRedirect(t, srv, "http://proj1.foo.bar/", "http://proj1.foo.bar/v1.1.0/")
+	assertRedirect(t, srv, "http://v1.foo.bar/", "http://v1.foo.bar/v1.0.0/")
+	assertNotFound(t, srv, "http://proj2.foo.bar/")
 }
 
 func TestRedirectToLatest_RefreshToken(t *testing.T) {
 	fetcher := newMockFetcher()
 	srv := newTestSrv(fetcher, Config{
-		"proj1.foo.bar": ProjectConfig{"org/proj1", "v1.0.0"},
+		"proj1.foo.bar": ProjectConfig{Repository: "org/proj1", MinVersion: "v1.0.0"},
 	})
 	srv.opts.RefreshToken = "foo"
 	fetcher.add("org", "proj1", "v1.0.0", "foo")
@@ -115,10 +129,10 @@ func TestPrepareVersion(t *testing.T) {
 
 	fetcher := newMockFetcher()
 	srv := newTestSrv(fetcher, Config{
-		"foo.bar.baz": ProjectConfig{"bar/foo", ""},
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo"},
 	})
 	srv.opts.BaseFolder = tmpDir
-	srv.opts.SharedFolder = "/etc/shared"
+	srv.opts.SharedFolder = testSharedFolder
 
 	fetcher.add("bar", "foo", "v1.0.0", url)
 
@@ -151,10 +165,10 @@ func TestPrepareVersion_RefreshToken(t *testing.T) {
 
 	fetcher := newMockFetcher()
 	srv := newTestSrv(fetcher, Config{
-		"foo.bar.baz": ProjectConfig{"bar/foo", ""},
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo"},
 	})
 	srv.opts.BaseFolder = tmpDir
-	srv.opts.SharedFolder = "/etc/shared"
+	srv.opts.SharedFolder = testSharedFolder
 	srv.opts.RefreshToken = "refresh"
 
 	fetcher.add("bar", "foo", "v1.0.0", url)
@@ -170,7 +184,7 @@ func TestPrepareVersion_RefreshToken(t *testing.T) {
 	fetcher.add("bar", "foo", "v1.1.0", url)
 
 	// without refresh token it's not updated
-	assertRedirect(t, srv, "http://foo.bar.baz/v1.1.0/", "http://foo.bar.baz/404/")
+	assertNotFound(t, srv, "http://foo.bar.baz/v1.1.0/")
 
 	// with refresh token it's updated
 	assertRedirect(
@@ -183,7 +197,7 @@ func TestPrepareVersion_RefreshToken(t *testing.T) {
 func TestListVersions(t *testing.T) {
 	fetcher := newMockFetcher()
 	srv := newTestSrv(fetcher, Config{
-		"foo.bar.baz": ProjectConfig{"org/foo", "v1.1.0"},
+		"foo.bar.baz": ProjectConfig{Repository: "org/foo", MinVersion: "v1.1.0"},
 	})
 	fetcher.add("org", "foo", "v1.0.0", "")
 	fetcher.add("org", "foo", "v1.1.0", "")
@@ -191,8 +205,8 @@ func TestListVersions(t *testing.T) {
 	fetcher.add("org", "bar", "v1.3.0", "")
 
 	assertJSON(t, srv, "http://foo.bar.baz/versions.json", []*version{
-		{"v1.1.0", "http://foo.bar.baz/v1.1.0"},
-		{"v1.2.0", "http://foo.bar.baz/v1.2.0"},
+		{Text: "v1.1.0", URL: "http://foo.bar.baz/v1.1.0"},
+		{Text: "v1.2.0", URL: "http://foo.bar.baz/v1.2.0"},
 	})
 }
 
@@ -200,9 +214,9 @@ func TestManageIndex(t *testing.T) {
 	require := require.New(t)
 	fetcher := newMockFetcher()
 	srv := newTestSrv(fetcher, Config{
-		"foo.bar.baz": ProjectConfig{"foo/bar", ""},
-		"baz.bar.baz": ProjectConfig{"foo/baz", ""},
-		"qux.bar.baz": ProjectConfig{"foo/qux", ""},
+		"foo.bar.baz": ProjectConfig{Repository: "foo/bar"},
+		"baz.bar.baz": ProjectConfig{Repository: "foo/baz"},
+		"qux.bar.baz": ProjectConfig{Repository: "foo/qux"},
 	})
 	fetcher.add("foo", "bar", "v1.0.0", "")
 	fetcher.add("foo", "bar", "v1.1.0", "")
@@ -235,3 +249,226 @@ func TestManageIndex(t *testing.T) {
 	require.Len(srv.index.projects[newKey("foo", "bar")], 3)
 	require.Len(srv.index.projects[newKey("foo", "baz")], 2)
 }
+
+func TestBranches(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{
+			Repository: "bar/foo",
+			Branches:   []string{"master"},
+		},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.addBranch("bar", "foo", "master", url, "1234")
+
+	assertJSON(t, srv, "http://foo.bar.baz/versions.json", []*version{
+		{Text: "v1.0.0", URL: "http://foo.bar.baz/v1.0.0"},
+		{Text: "master", URL: "http://foo.bar.baz/master"},
+	})
+
+	// branches are not taken into account for the latest version
+	assertRedirect(
+		t, srv,
+		"http://foo.bar.baz/latest/",
+		"http://foo.bar.baz/v1.0.0/",
+	)
+
+	assertRedirect(
+		t, srv,
+		"http://foo.bar.baz/master/",
+		"http://foo.bar.baz/master/",
+	)
+
+	destination := filepath.Join(tmpDir, "foo.bar.baz", "master")
+	assertMakefileOutput(t, destination, "http://foo.bar.baz/master/", "foo", "bar", "master")
+
+	conf, ok := srv.index.installation("bar", "foo", "master")
+	require.True(ok)
+	require.Equal("1234", conf.sha)
+
+	// refreshing without changes in the HEAD does not trigger a rebuild
+	require.NoError(srv.indexProject("bar", "foo"))
+	time.Sleep(50 * time.Millisecond)
+	conf, _ = srv.index.installation("bar", "foo", "master")
+	require.Equal("1234", conf.sha)
+
+	// nor does it while the branch is already being rebuilt
+	fetcher.addBranch("bar", "foo", "master", url, "5678")
+	srv.rebuilding.Store(newKey("bar", "foo", "master"), true)
+	require.NoError(srv.indexProject("bar", "foo"))
+	time.Sleep(50 * time.Millisecond)
+	conf, _ = srv.index.installation("bar", "foo", "master")
+	require.Equal("1234", conf.sha)
+
+	srv.rebuilding.Delete(newKey("bar", "foo", "master"))
+	require.NoError(srv.indexProject("bar", "foo"))
+
+	require.Eventually(func() bool {
+		conf, _ := srv.index.installation("bar", "foo", "master")
+		return conf.sha == "5678"
+	}, time.Second, 10*time.Millisecond)
+
+	assertMakefileOutput(t, destination, "http://foo.bar.baz/master/", "foo", "bar", "master")
+}
+
+func TestPrepareVersion_MissingSharedFolder(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = filepath.Join(tmpDir, "shared")
+
+	fetcher.add("bar", "foo", "v1.0.0", url)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar.baz/v1.0.0/", nil)
+	require.NoError(err)
+
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Contains(w.Body.String(), "shared assets needed to build it are missing")
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+}
+
+func TestPrereleases(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "org/foo", Prereleases: true},
+		"baz.bar": ProjectConfig{Repository: "org/baz"},
+	})
+
+	for _, p := range []string{"foo", "baz"} {
+		fetcher.add("org", p, "v1.0.0", "")
+		fetcher.addPrerelease("org", p, "v1.1.0-beta.1", "")
+	}
+
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v1.0.0/")
+	assertRedirect(t, srv, "http://foo.bar/next/", "http://foo.bar/v1.1.0-beta.1/")
+	assertRedirect(t, srv, "http://foo.bar/next/foo/bar.html", "http://foo.bar/v1.1.0-beta.1/foo/bar.html")
+
+	latest, next := "v1.0.0", "v1.1.0-beta.1"
+	assertJSON(t, srv, "http://foo.bar/project.json", projectInfo{
+		Repository:       "org/foo",
+		Latest:           &latest,
+		LatestPrerelease: &next,
+		Versions: []*version{
+			{Text: "v1.0.0", URL: "http://foo.bar/v1.0.0"},
+			{Text: "v1.1.0-beta.1", URL: "http://foo.bar/v1.1.0-beta.1", Prerelease: true},
+		},
+	})
+
+	// projects that do not opt in do not see their prereleases
+	assertRedirect(t, srv, "http://baz.bar/latest/", "http://baz.bar/v1.0.0/")
+	assertNotFound(t, srv, "http://baz.bar/next/")
+	assertJSON(t, srv, "http://baz.bar/project.json", projectInfo{
+		Repository: "org/baz",
+		Latest:     &latest,
+		Versions:   []*version{{Text: "v1.0.0", URL: "http://baz.bar/v1.0.0"}},
+	})
+
+	// once a stable version is released, /next/ points to it
+	fetcher.add("org", "foo", "v1.1.0", "")
+	require.NoError(srv.indexProject("org", "foo"))
+	assertRedirect(t, srv, "http://foo.bar/next/", "http://foo.bar/v1.1.0/")
+}
+
+func TestExcludeVersions(t *testing.T) {
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{
+			Repository:      "org/foo",
+			ExcludeVersions: []string{"v2.0.0", `/^v1\.1\.\d+$/`},
+		},
+	})
+
+	for _, v := range []string{"v1.0.0", "v1.1.0", "v1.1.1", "v1.2.0", "v2.0.0"} {
+		fetcher.add("org", "foo", v, "")
+	}
+
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v1.2.0/")
+	assertNotFound(t, srv, "http://foo.bar/v2.0.0/")
+	assertJSON(t, srv, "http://foo.bar/versions.json", []*version{
+		{Text: "v1.0.0", URL: "http://foo.bar/v1.0.0"},
+		{Text: "v1.2.0", URL: "http://foo.bar/v1.2.0"},
+	})
+}
+
+func TestMaxVersion(t *testing.T) {
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"docs.bar":    ProjectConfig{Repository: "org/foo"},
+		"v1.docs.bar": ProjectConfig{Repository: "org/foo", MaxVersion: "v1"},
+	})
+
+	for _, v := range []string{"v1.0.0", "v1.1.0", "v2.0.0"} {
+		fetcher.add("org", "foo", v, "")
+	}
+
+	assertRedirect(t, srv, "http://docs.bar/latest/", "http://docs.bar/v2.0.0/")
+	assertRedirect(t, srv, "http://v1.docs.bar/latest/", "http://v1.docs.bar/v1.1.0/")
+	assertNotFound(t, srv, "http://v1.docs.bar/v2.0.0/")
+	assertJSON(t, srv, "http://v1.docs.bar/versions.json", []*version{
+		{Text: "v1.0.0", URL: "http://v1.docs.bar/v1.0.0"},
+		{Text: "v1.1.0", URL: "http://v1.docs.bar/v1.1.0"},
+	})
+}
+
+func TestRebuildRetagged(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	fetcher.setSHA("bar", "foo", "v1.0.0", "1234")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	assertRedirect(t, srv, "http://foo.bar/v1.1.0/", "http://foo.bar/v1.1.0/")
+	conf, _ := srv.index.installation("bar", "foo", "v1.0.0")
+	require.Equal("1234", conf.sha)
+
+	// the commit of the versions installed without it is recorded
+	fetcher.setSHA("bar", "foo", "v1.1.0", "abcd")
+	require.NoError(srv.indexProject("bar", "foo"))
+	conf, _ = srv.index.installation("bar", "foo", "v1.1.0")
+	require.Equal("abcd", conf.sha)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(int32(2), atomic.LoadInt32(downloads))
+
+	fetcher.setSHA("bar", "foo", "v1.0.0", "5678")
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.Eventually(func() bool {
+		conf, _ := srv.index.installation("bar", "foo", "v1.0.0")
+		return conf.sha == "5678"
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(int32(3), atomic.LoadInt32(downloads))
+}
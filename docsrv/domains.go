@@ -0,0 +1,150 @@
+package docsrv
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// domainChallengePrefix is the subdomain of a custom domain that must contain
+// the TXT record validating it.
+const domainChallengePrefix = "_docsrv."
+
+// lookupTXT returns the TXT records of a domain. It's a variable so it can be
+// replaced in tests.
+var lookupTXT = net.LookupTXT
+
+// aliasRegistry keeps track of the additional hosts declared by the projects
+// themselves.
+type aliasRegistry struct {
+	mut *sync.RWMutex
+	// hosts is a map from an alias host to the ${owner}/${project} it
+	// serves.
+	hosts map[string]string
+}
+
+func newAliasRegistry() *aliasRegistry {
+	return &aliasRegistry{
+		mut:   new(sync.RWMutex),
+		hosts: make(map[string]string),
+	}
+}
+
+// set replaces all the aliases of the given project with the given hosts.
+func (a *aliasRegistry) set(owner, project string, hosts []string) {
+	key := newKey(owner, project)
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	for h, k := range a.hosts {
+		if k == key {
+			delete(a.hosts, h)
+		}
+	}
+
+	for _, h := range hosts {
+		a.hosts[normalizeHost(h)] = key
+	}
+}
+
+// projectForHost returns the owner and repository name of the project
+// registered for the given host.
+func (a *aliasRegistry) projectForHost(host string) (owner, project string, ok bool) {
+	a.mut.RLock()
+	key, ok := a.hosts[normalizeHost(host)]
+	a.mut.RUnlock()
+	if !ok {
+		return "", "", false
+	}
+
+	parts := splitKey(key)
+	return parts[0], parts[1], true
+}
+
+// projectForHost returns the owner and repository name of the project served
+// at the given host, either because it's configured, because it was declared
+// by the project itself or, for the rest of the hosts matching DefaultHosts,
+// because its name is the first label of the host and its owner is
+// DefaultOwner, unless its repository was recently not found.
+func (s *Service) projectForHost(host string) (owner, project string, ok bool) {
+	config, hosts := s.hostConfig()
+	if key, found := hosts.hostKey(config, host); found {
+		if owner, project, ok = splitRepository(config[key].projectKey()); ok {
+			return
+		}
+	}
+
+	owner, project, ok = s.aliases.projectForHost(host)
+	if ok {
+		return
+	}
+
+	if project, ok = s.opts.defaultProject(host); ok && !s.missing.has(project) {
+		return s.opts.DefaultOwner, project, true
+	}
+	return "", "", false
+}
+
+// indexDomains registers the custom domains declared by the project in the
+// docsrv.toml file of its latest release, as long as they are validated.
+func (s *Service) indexDomains(owner, project string, releases []*release) {
+	conf, ok := s.config().ForProject(owner, project)
+	latest := latestRelease(releases)
+	if !ok || !conf.CustomDomains || latest == nil {
+		return
+	}
+
+	log := logrus.WithField("project", project).
+		WithField("owner", owner)
+
+	data, err := s.fetcherFor(owner, project).file(owner, repositoryName(project), latest.tag, repoConfigFile)
+	if err != nil {
+		log.Errorf("error fetching %s: %s", repoConfigFile, err)
+		return
+	}
+
+	var domains []string
+	if data != nil {
+		repoConf, err := parseRepoConfig(data)
+		if err != nil {
+			log.Errorf("error reading project config: %s", err)
+			return
+		}
+
+		for _, d := range repoConf.Domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			if _, ok := s.config()[d]; ok {
+				log.Warnf("custom domain %s is already configured, ignoring it", d)
+				continue
+			}
+
+			if !validDomain(d, owner, project) {
+				log.Warnf("custom domain %s could not be validated, ignoring it", d)
+				continue
+			}
+
+			domains = append(domains, d)
+		}
+	}
+
+	s.aliases.set(owner, project, domains)
+}
+
+// validDomain reports whether the given domain has a TXT record proving that
+// it should serve the docs of the given project.
+func validDomain(domain, owner, project string) bool {
+	records, err := lookupTXT(domainChallengePrefix + domain)
+	if err != nil {
+		return false
+	}
+
+	expected := "docsrv=" + newKey(owner, project)
+	for _, r := range records {
+		if strings.TrimSpace(r) == expected {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package docsrv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexDomains(t *testing.T) {
+	require := require.New(t)
+
+	defer func(f func(string) ([]string, error)) {
+		lookupTXT = f
+	}(lookupTXT)
+
+	lookupTXT = func(name string) ([]string, error) {
+		switch name {
+		case "_docsrv.docs.foo.com":
+			return []string{"foo", "docsrv=bar/foo"}, nil
+		case "_docsrv.docs.other.com":
+			return []string{"docsrv=bar/other"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{
+			Repository:    "bar/foo",
+			CustomDomains: true,
+		},
+		"baz.bar.baz": ProjectConfig{Repository: "bar/baz"},
+	})
+
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.addFile("bar", "foo", "v1.1.0", repoConfigFile, []byte(`
+domains = ["docs.foo.com", "docs.other.com", "docs.unknown.com", "baz.bar.baz"]
+`))
+
+	require.NoError(srv.indexProject("bar", "foo"))
+
+	owner, project, ok := srv.projectForHost("docs.foo.com:8080")
+	require.True(ok)
+	require.Equal("bar", owner)
+	require.Equal("foo", project)
+
+	for _, host := range []string{"docs.other.com", "docs.unknown.com"} {
+		_, _, ok = srv.projectForHost(host)
+		require.False(ok, host)
+	}
+
+	owner, project, ok = srv.projectForHost("baz.bar.baz")
+	require.True(ok)
+	require.Equal("baz", project)
+
+	assertJSON(t, srv, "http://docs.foo.com/versions.json", []*version{
+		{Text: "v1.0.0", URL: "http://docs.foo.com/v1.0.0"},
+		{Text: "v1.1.0", URL: "http://docs.foo.com/v1.1.0"},
+	})
+
+	// domains no longer declared in the latest version are removed
+	fetcher.add("bar", "foo", "v1.2.0", "")
+	require.NoError(srv.indexProject("bar", "foo"))
+	_, _, ok = srv.projectForHost("docs.foo.com")
+	require.False(ok)
+}
@@ -0,0 +1,78 @@
+package docsrv
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// errorPage is the data of an error page.
+type errorPage struct {
+	Status int
+	Title  string
+	// Project and Version are the requested project and version, if known.
+	Project string
+	Version string
+	// Versions are the available versions of the project, if it's indexed.
+	Versions []*version
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if eq .Status 404}}<p>The page you are looking for does not exist{{if .Project}} in the documentation of {{.Project}}{{if .Version}} {{.Version}}{{end}}{{end}}.</p>
+{{else}}<p>Something went wrong serving the documentation{{if .Project}} of {{.Project}}{{if .Version}} {{.Version}}{{end}}{{end}}. Please, try again later.</p>
+{{end}}{{if .Versions}}<h2>Available versions</h2>
+<ul>
+{{range .Versions}}<li><a href="{{.URL}}/">{{.Text}}</a></li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// notFound responds with the 404 page.
+func (s *Service) notFound(w http.ResponseWriter, r *http.Request) {
+	s.errorPage(w, r, http.StatusNotFound)
+}
+
+// internalError responds with the 500 page.
+func (s *Service) internalError(w http.ResponseWriter, r *http.Request) {
+	s.errorPage(w, r, http.StatusInternalServerError)
+}
+
+// errorPage responds with the page of the given error status, which includes
+// the requested project and version and the available versions of the
+// project, if it's already indexed. The requests that want JSON get a JSON
+// error instead.
+func (s *Service) errorPage(w http.ResponseWriter, r *http.Request, status int) {
+	if wantsJSON(r) {
+		w.Header().Set("Cache-Control", "no-store")
+		httpError(w, r, http.StatusText(status), status)
+		return
+	}
+
+	page := errorPage{Status: status, Title: http.StatusText(status)}
+	if owner, project, ok := s.projectForHost(r.Host); ok {
+		page.Project = project
+		if version := versionFromReq(r); s.index.get(owner, project, version) != nil || newVersion(version) != nil {
+			page.Version = version
+		}
+
+		// indexing the project could fail again, so only indexed projects
+		// list their versions.
+		if s.index.isIndexed(owner, project) {
+			page.Versions = s.projectVersions(r, owner, project)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := errorPageTemplate.Execute(w, page); err != nil {
+		requestLog(r).Errorf("error rendering error page: %s", err)
+	}
+}
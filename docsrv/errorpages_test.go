@@ -0,0 +1,42 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorPage(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	require.NoError(srv.indexProject("bar", "foo"))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v2.0.0/", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+	require.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	require.Contains(body, "<h1>Not Found</h1>")
+	require.Contains(body, "the documentation of foo v2.0.0.")
+	require.Contains(body, `<li><a href="http://foo.bar/v1.0.0/">v1.0.0</a></li>`)
+	require.Contains(body, `<li><a href="http://foo.bar/v1.1.0/">v1.1.0</a></li>`)
+
+	w = httptest.NewRecorder()
+	srv.internalError(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	require.Equal(http.StatusInternalServerError, w.Code)
+	body = w.Body.String()
+	require.Contains(body, "<h1>Internal Server Error</h1>")
+	require.Contains(body, "the documentation of foo v1.0.0.")
+
+	// unknown hosts have no project or versions
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://baz.bar/v1.0.0/", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+	require.Contains(w.Body.String(), "The page you are looking for does not exist.")
+	require.NotContains(w.Body.String(), "Available versions")
+}
@@ -0,0 +1,223 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/google/go-github/github"
+)
+
+var (
+	// ErrNotFound is returned when a project, release or file could not be
+	// found.
+	ErrNotFound = errors.New("not found")
+	// ErrQuotaExceeded is returned when an operation can not be performed
+	// because it would exceed the quota of a project.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrMaintenance is returned when a version can not be built because its
+	// host is in maintenance mode. The build is paused until the maintenance
+	// is over.
+	ErrMaintenance = errors.New("host is in maintenance mode, the build will start once it's over")
+)
+
+// ErrRateLimited is returned when the GitHub API can not be used because the
+// rate limit has been exceeded.
+type ErrRateLimited struct {
+	// Reset is the time when the rate limit will be reset.
+	Reset time.Time
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("GitHub API rate limit exceeded until %s", e.Reset.Format(time.RFC3339))
+}
+
+// ErrDownloadFailed is returned when the sources of a version could not be
+// downloaded because of a transient error, such as a network error or a 5xx
+// status, even after retrying.
+type ErrDownloadFailed struct {
+	// URL is the URL of the sources.
+	URL string
+	// Status is the status code of the last response, if any.
+	Status int
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *ErrDownloadFailed) Error() string {
+	return fmt.Sprintf("error downloading %q: %s", e.URL, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *ErrDownloadFailed) Unwrap() error { return e.Err }
+
+// ErrBuildFailed is returned when the build of the documentation of a
+// version fails.
+type ErrBuildFailed struct {
+	// Log is the output of the build.
+	Log string
+	// Command is the command that was run to build the docs.
+	Command string
+	// Env is the environment the command was run with.
+	Env []string
+	// Err is the error that caused the build to fail.
+	Err error
+}
+
+func (e *ErrBuildFailed) Error() string {
+	return fmt.Sprintf("error running `make docs`: %s", e.Err)
+}
+
+// Unwrap returns the error that caused the build to fail.
+func (e *ErrBuildFailed) Unwrap() error { return e.Err }
+
+// wrappedError is an error with some context of the operation that caused
+// it.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string { return e.msg + ": " + e.err.Error() }
+
+// Cause returns the wrapped error.
+func (e *wrappedError) Cause() error { return e.err }
+
+// Unwrap returns the wrapped error.
+func (e *wrappedError) Unwrap() error { return e.err }
+
+// wrap adds the message with the given format to the error, keeping the
+// original error as its cause.
+func wrap(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &wrappedError{fmt.Sprintf(format, args...), err}
+}
+
+// Cause returns the underlying cause of the given error, that is, the first
+// error in the chain that does not wrap another error with context. The
+// result can be compared or type-asserted with the error kinds of docsrv,
+// such as ErrNotFound or *ErrBuildFailed.
+func Cause(err error) error {
+	for err != nil {
+		c, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return err
+}
+
+// githubError converts the errors returned by the GitHub client to the
+// corresponding docsrv error kinds.
+func githubError(err error) error {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return &ErrRateLimited{Reset: e.Rate.Reset.Time}
+	case *github.AbuseRateLimitError:
+		reset := time.Now().Add(time.Minute)
+		if e.RetryAfter != nil {
+			reset = time.Now().Add(*e.RetryAfter)
+		}
+		return &ErrRateLimited{Reset: reset}
+	case *github.ErrorResponse:
+		if e.Response != nil && e.Response.StatusCode == http.StatusNotFound {
+			return wrap(ErrNotFound, e.Error())
+		}
+	}
+	return err
+}
+
+// logBuildOutput logs the output of the build if the given error is caused
+// by a failed build.
+func logBuildOutput(log *logrus.Entry, err error) {
+	if e, ok := Cause(err).(*ErrBuildFailed); ok {
+		log.Errorf("build output: %s", e.Log)
+	}
+}
+
+// handleError responds to the request with the page corresponding to the
+// cause of the given error.
+func (s *Service) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch e := Cause(err).(type) {
+	case *ErrRateLimited:
+		s.rateLimited(w, r, e.Reset)
+	case *ErrQuarantined:
+		_, project, _ := s.projectForHost(r.Host)
+		quarantined(w, r, project, versionFromReq(r))
+	case *sharedFolderError:
+		_, project, _ := s.projectForHost(r.Host)
+		unavailable(w, r, fmt.Sprintf(sharedFolderMessage, project, versionFromReq(r)))
+	case *ErrDownloadFailed:
+		_, project, _ := s.projectForHost(r.Host)
+		unavailable(w, r, fmt.Sprintf(downloadFailedMessage, project, versionFromReq(r)))
+	default:
+		switch e {
+		case ErrNotFound:
+			s.notFound(w, r)
+		case ErrQuotaExceeded:
+			httpError(w, r, err.Error(), http.StatusTooManyRequests)
+		case ErrMaintenance:
+			message, _ := s.inMaintenance(r.Host)
+			s.underMaintenance(w, r, message)
+		default:
+			s.internalError(w, r)
+		}
+	}
+}
+
+// jsonError is the body of the error responses to the requests that want
+// JSON.
+type jsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// wantsJSON reports whether the errors of the given request are responded
+// with a JSON body instead of a page, that is, if it's made to the API or it
+// accepts application/json, so the scripts consuming docsrv get errors they
+// can parse.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType = strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0])
+			if strings.EqualFold(mediaType, "application/json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpError responds with the given message and status code, like
+// http.Error, as a JSON error if the request wants JSON.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !wantsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+
+	body, err := json.Marshal(jsonError{Error: msg, Code: code})
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+}
@@ -0,0 +1,142 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCause(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(Cause(nil))
+	require.Nil(wrap(nil, "foo"))
+
+	err := wrap(wrap(ErrNotFound, "bar"), "foo")
+	require.Equal("foo: bar: not found", err.Error())
+	require.Equal(ErrNotFound, Cause(err))
+
+	other := fmt.Errorf("other")
+	require.Equal(other, Cause(other))
+
+	build := &ErrBuildFailed{Log: "output", Err: other}
+	require.Equal(build, Cause(wrap(build, "foo")))
+	require.Equal(other, build.Unwrap())
+}
+
+func TestGitHubError(t *testing.T) {
+	require := require.New(t)
+
+	reset := time.Now().Add(time.Hour)
+	err := githubError(&github.RateLimitError{
+		Rate: github.Rate{Reset: github.Timestamp{Time: reset}},
+	})
+	require.Equal(&ErrRateLimited{Reset: reset}, err)
+
+	req, err := http.NewRequest("GET", "https://api.github.com/repos/foo/bar", nil)
+	require.NoError(err)
+
+	err = githubError(&github.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusNotFound, Request: req},
+	})
+	require.Equal(ErrNotFound, Cause(err))
+
+	resp := &github.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusInternalServerError, Request: req},
+	}
+	require.Equal(resp, githubError(resp))
+}
+
+func TestHandleError(t *testing.T) {
+	s := newTestSrv(newMockFetcher(), nil)
+
+	cases := []struct {
+		err      error
+		code     int
+		location string
+	}{
+		{wrap(ErrNotFound, "foo"), http.StatusNotFound, ""},
+		{fmt.Errorf("foo"), http.StatusInternalServerError, ""},
+		{&ErrBuildFailed{Err: fmt.Errorf("foo")}, http.StatusInternalServerError, ""},
+		{wrap(ErrQuotaExceeded, "foo"), http.StatusTooManyRequests, ""},
+		{wrap(&ErrRateLimited{Reset: time.Now().Add(time.Minute)}, "foo"), http.StatusTooManyRequests, ""},
+		{&sharedFolderError{folder: "/foo"}, http.StatusServiceUnavailable, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.err.Error(), func(t *testing.T) {
+			require := require.New(t)
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+			require.NoError(err)
+
+			s.handleError(w, req, c.err)
+			require.Equal(c.code, w.Code)
+			require.Equal(c.location, w.Header().Get("Location"))
+			if c.code == http.StatusServiceUnavailable {
+				require.NotEmpty(w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	s := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	s.opts.RefreshToken = "admin"
+
+	cases := []struct {
+		url    string
+		accept string
+		code   int
+		json   bool
+	}{
+		{"http://qux.bar/v1.0.0/", "", http.StatusNotFound, false},
+		{"http://qux.bar/v1.0.0/", "text/html,application/xhtml+xml,*/*;q=0.8", http.StatusNotFound, false},
+		{"http://qux.bar/v1.0.0/", "text/html, application/json;q=0.9", http.StatusNotFound, true},
+		{"http://foo.bar/v2.0.0/", "Application/JSON", http.StatusNotFound, true},
+		{"http://foo.bar/api/diff?from=v1.0.0", "", http.StatusBadRequest, true},
+		{"http://foo.bar/api/mirror/v2.0.0?token=admin", "", http.StatusNotFound, true},
+		{"http://foo.bar/versions.json?limit=foo", "", http.StatusBadRequest, false},
+		{"http://foo.bar/versions.json?limit=foo", "application/json", http.StatusBadRequest, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.url+" "+c.accept, func(t *testing.T) {
+			require := require.New(t)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", c.url, nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+
+			s.ServeHTTP(w, req)
+			require.Equal(c.code, w.Code)
+			if !c.json {
+				require.NotContains(w.Header().Get("Content-Type"), "json")
+				return
+			}
+
+			require.Equal("application/json", w.Header().Get("Content-Type"))
+			var body jsonError
+			require.NoError(json.Unmarshal(w.Body.Bytes(), &body), w.Body.String())
+			require.Equal(c.code, body.Code)
+			require.NotEmpty(body.Error)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+	req.Header.Set("Accept", "application/json")
+	s.rateLimited(w, req, time.Now().Add(time.Hour))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+	require.Contains(t, w.Body.String(), `"code":429`)
+}
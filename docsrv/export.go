@@ -0,0 +1,264 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+const redirectPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="0; url=%[1]s">
+<link rel="canonical" href="%[1]s">
+</head>
+<body><a href="%[1]s">%[1]s</a></body>
+</html>
+`
+
+// exportSite is an HTTP handler that will output a gzipped tarball with all
+// the installed versions of the project in the requested host, ready to be
+// uploaded to any static hosting.
+func (s *Service) exportSite(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	if err := s.ensureIndexed("", owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	baseURL, err := exportBaseURL(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	host := stripPort(r.Host)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", host+".tar.gz"),
+	)
+
+	if err := s.exportHost(w, r, baseURL, host, owner, project); err != nil {
+		// headers are already sent at this point, so there is nothing else
+		// we can do but log the error.
+		log.Errorf("error exporting host %s: %s", host, err)
+		return
+	}
+
+	log.Debug("host successfully exported")
+}
+
+// exportBaseURL returns the URL the exported site will be served from, with
+// an ending slash, which is the one in the base-url parameter of the request
+// or the one of the host otherwise.
+func exportBaseURL(r *http.Request) (string, error) {
+	raw := r.URL.Query().Get("base-url")
+	if raw == "" {
+		return ensureEndingSlash(urlFor(r, "", "")), nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid base-url %q, it must be an absolute http(s) URL", raw)
+	}
+	return ensureEndingSlash(raw), nil
+}
+
+// exportHost writes to w a gzipped tarball containing all the installed
+// versions of the given project, a snapshot of its versions.json, a sitemap
+// and redirect pages for the root, to the default version if any, and the
+// latest version, so the resulting site can be served without docsrv. The
+// redirect pages are relative, so they work wherever the site is served,
+// while the URLs of the sitemap and versions.json, which must be absolute,
+// start with the given base URL.
+func (s *Service) exportHost(w io.Writer, r *http.Request, baseURL, host, owner, project string) error {
+	root := s.projectFolder(owner, project)
+
+	var (
+		releases []*release
+		versions []*version
+	)
+	for _, rel := range s.filteredReleases(r, owner, project, defaultVersionFilter) {
+		if isDir(filepath.Join(root, rel.tag)) {
+			releases = append(releases, rel)
+			versions = append(versions, s.versionOf(owner, project, rel, baseURL+rel.tag))
+		}
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	var pages []sitemapURL
+	for _, v := range versions {
+		dir := filepath.Join(root, v.Text)
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			if strings.HasSuffix(fi.Name(), ".html") {
+				pages = append(pages, sitemapURL{baseURL + filepath.ToSlash(rel)})
+			}
+
+			return addFileToTar(tw, path, filepath.ToSlash(rel), fi)
+		})
+		if err != nil {
+			return fmt.Errorf("error adding version %s to tarball: %s", v.Text, err)
+		}
+	}
+
+	versionsJSON, err := json.Marshal(versions)
+	if err != nil {
+		return fmt.Errorf("error marshaling versions: %s", err)
+	}
+
+	var sitemapXML bytes.Buffer
+	sitemapXML.WriteString(xml.Header)
+	err = xml.NewEncoder(&sitemapXML).Encode(sitemap{
+		XMLNS: sitemapNamespace,
+		URLs:  pages,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding sitemap: %s", err)
+	}
+
+	files := map[string][]byte{
+		"versions.json": versionsJSON,
+		"sitemap.xml":   sitemapXML.Bytes(),
+	}
+
+	if len(releases) > 0 {
+		// the latest version is the latest release, or the newest
+		// prerelease if there are only prereleases.
+		latest := latestRelease(releases)
+		if latest == nil {
+			latest = releases[len(releases)-1]
+		}
+
+		files["index.html"] = []byte(fmt.Sprintf(redirectPage, latest.tag+"/"))
+		files["latest/index.html"] = []byte(fmt.Sprintf(redirectPage, "../"+latest.tag+"/"))
+
+		// the root redirects to the default version instead, if it's
+		// exported too.
+		if def := s.forHost(host).DefaultVersion; def != "" && isDir(filepath.Join(root, def)) {
+			files["index.html"] = []byte(fmt.Sprintf(redirectPage, def+"/"))
+		}
+	}
+
+	for _, name := range []string{"versions.json", "sitemap.xml", "index.html", "latest/index.html"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		if err := addBytesToTar(tw, name, data); err != nil {
+			return fmt.Errorf("error adding %s to tarball: %s", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+func addFileToTar(tw *tar.Writer, path, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if fi.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func addBytesToTar(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
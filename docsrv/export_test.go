@@ -0,0 +1,124 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportSite(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo", Prereleases: true},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.RefreshToken = "admin"
+
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.add("bar", "foo", "v1.2.0", "")
+
+	for _, v := range []string{"v1.0.0", "v1.1.0"} {
+		dir := filepath.Join(tmpDir, "bar", "foo", v)
+		require.NoError(os.MkdirAll(dir, 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(v), 0644))
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar.baz/api/export", nil)
+	require.NoError(err)
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusForbidden, w.Code)
+
+	files := exportedFiles(t, srv, "http://foo.bar.baz/api/export?token=admin")
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	require.Equal([]string{
+		"index.html",
+		"latest/index.html",
+		"sitemap.xml",
+		"v1.0.0/",
+		"v1.0.0/index.html",
+		"v1.1.0/",
+		"v1.1.0/index.html",
+		"versions.json",
+	}, names)
+
+	require.Equal("v1.1.0", files["v1.1.0/index.html"])
+	require.Contains(files["index.html"], `url=v1.1.0/"`)
+	require.Contains(files["latest/index.html"], `url=../v1.1.0/"`)
+	require.Contains(files["sitemap.xml"], "<loc>http://foo.bar.baz/v1.0.0/index.html</loc>")
+	require.Equal(
+		`[{"text":"v1.0.0","url":"http://foo.bar.baz/v1.0.0","installed":false,"prerelease":false,"released-at":null},`+
+			`{"text":"v1.1.0","url":"http://foo.bar.baz/v1.1.0","installed":false,"prerelease":false,"released-at":null}]`,
+		files["versions.json"],
+	)
+
+	// the absolute URLs use the base URL the site is exported to
+	files = exportedFiles(t, srv, "http://foo.bar.baz/api/export?token=admin&base-url=https://bar.github.io/foo")
+	require.Contains(files["index.html"], `url=v1.1.0/"`)
+	require.Contains(files["sitemap.xml"], "<loc>https://bar.github.io/foo/v1.0.0/index.html</loc>")
+	require.Contains(files["versions.json"], `"url":"https://bar.github.io/foo/v1.1.0"`)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar.baz/api/export?token=admin&base-url=/foo", nil))
+	require.Equal(http.StatusBadRequest, w.Code)
+
+	// the exported prereleases are not the latest version
+	fetcher.addPrerelease("bar", "foo", "v2.0.0-rc.1", "")
+	require.NoError(srv.indexProject("bar", "foo"))
+	dir := filepath.Join(tmpDir, "bar", "foo", "v2.0.0-rc.1")
+	require.NoError(os.MkdirAll(dir, 0755))
+
+	files = exportedFiles(t, srv, "http://foo.bar.baz/api/export?token=admin")
+	require.Contains(files, "v2.0.0-rc.1/")
+	require.Contains(files["index.html"], `url=v1.1.0/"`)
+	require.Contains(files["latest/index.html"], `url=../v1.1.0/"`)
+}
+
+// exportedFiles returns the contents of the files of the site exported with
+// the given request, by name.
+func exportedFiles(t *testing.T, srv *Service, url string) map[string]string {
+	require := require.New(t)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	gr, err := gzip.NewReader(w.Body)
+	require.NoError(err)
+	tr := tar.NewReader(gr)
+
+	files := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(err)
+		files[h.Name] = string(data)
+	}
+	return files
+}
@@ -0,0 +1,175 @@
+package docsrv
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// minBuildBackoff is the time a version whose build failed is not built
+	// again by the requests, which doubles with every consecutive failure.
+	minBuildBackoff = time.Minute
+	// maxBuildBackoff is the maximum time a version whose build failed is
+	// not built again by the requests.
+	maxBuildBackoff = time.Hour
+)
+
+// buildFailure is the last failed build of a version.
+type buildFailure struct {
+	// Error is the summary of the error of the build.
+	Error string `json:"error"`
+	// Attempts is the number of consecutive failed builds.
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed-at"`
+	// RetryAt is the time since which the requests build the version again.
+	RetryAt time.Time `json:"retry-at"`
+}
+
+// backingOff reports whether the version is not built again yet.
+func (f *buildFailure) backingOff() bool {
+	return time.Now().Before(f.RetryAt)
+}
+
+// buildFailures keeps the last failed build of the versions whose builds
+// failed, so the requests do not retry the whole build every time until
+// their backoff expires.
+type buildFailures struct {
+	mut      sync.RWMutex
+	versions map[string]*buildFailure
+}
+
+func newBuildFailures() *buildFailures {
+	return &buildFailures{versions: make(map[string]*buildFailure)}
+}
+
+// add records a failed build of the given version with the given error and
+// returns the failure, whose backoff is twice the one of the previous
+// failure, if any.
+func (f *buildFailures) add(owner, project, version string, err error) *buildFailure {
+	key := newKey(owner, project, version)
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	attempts := 1
+	if prev, ok := f.versions[key]; ok {
+		attempts = prev.Attempts + 1
+	}
+
+	now := time.Now()
+	failure := &buildFailure{
+		Error:    Cause(err).Error(),
+		Attempts: attempts,
+		FailedAt: now,
+		RetryAt:  now.Add(buildBackoff(attempts)),
+	}
+	f.versions[key] = failure
+	return failure
+}
+
+func (f *buildFailures) get(owner, project, version string) (*buildFailure, bool) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	failure, ok := f.versions[newKey(owner, project, version)]
+	return failure, ok
+}
+
+// remove forgets the failed builds of the given version.
+func (f *buildFailures) remove(owner, project, version string) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	delete(f.versions, newKey(owner, project, version))
+}
+
+// buildBackoff returns the backoff after the given number of consecutive
+// failed builds.
+func buildBackoff(attempts int) time.Duration {
+	backoff := minBuildBackoff
+	for i := 1; i < attempts && backoff < maxBuildBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBuildBackoff {
+		return maxBuildBackoff
+	}
+	return backoff
+}
+
+// isBuildFailure reports whether the given error of a build is a failure of
+// the build itself, which would fail again if it's retried right away. The
+// errors that have their own way of being retried, or that are not caused by
+// the version, are not.
+func isBuildFailure(err error) bool {
+	switch e := Cause(err).(type) {
+	case *ErrQuarantined, *ErrRateLimited, *sharedFolderError:
+		return false
+	default:
+		return e != ErrNotFound && e != ErrMaintenance && e != ErrQuotaExceeded
+	}
+}
+
+// trackBuild records the failure of the build with the given configuration,
+// or forgets the previous ones if it succeeded.
+func (s *Service) trackBuild(conf buildConfig, err error) {
+	if err == nil {
+		s.failures.remove(conf.owner, conf.project, conf.version)
+		return
+	}
+
+	if !isBuildFailure(err) {
+		return
+	}
+
+	failure := s.failures.add(conf.owner, conf.project, conf.version, err)
+	conf.log().WithFields(logrus.Fields{
+		"attempts": failure.Attempts,
+		"retry_at": failure.RetryAt,
+	}).Debug("build failure recorded")
+}
+
+var buildBackoffTemplate = template.Must(template.New("backoff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Build failed</title>
+</head>
+<body>
+<h1>Build failed</h1>
+<p>The documentation of {{.Project}} {{.Version}} could not be built: {{.Error}}.</p>
+<p>It will be built again after {{.RetryAt}}.</p>
+</body>
+</html>
+`))
+
+// buildBackingOff responds with a 503 status code and a page with the
+// summary of the given failed build of the given version, explaining when it
+// will be built again.
+func buildBackingOff(w http.ResponseWriter, r *http.Request, project, version string, failure *buildFailure) {
+	retry := int(time.Until(failure.RetryAt).Seconds()) + 1
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	retryAt := failure.RetryAt.UTC().Format("15:04:05 MST")
+	if wantsJSON(r) {
+		msg := fmt.Sprintf("the documentation of %s %s could not be built: %s, it will be built again after %s",
+			project, version, failure.Error, retryAt)
+		httpError(w, r, msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := buildBackoffTemplate.Execute(w, struct {
+		Project string
+		Version string
+		Error   string
+		RetryAt string
+	}{project, version, failure.Error, retryAt})
+	if err != nil {
+		requestLog(r).Errorf("error rendering build backoff page: %s", err)
+	}
+}
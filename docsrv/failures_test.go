@@ -0,0 +1,93 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildBackoff(t *testing.T) {
+	require := require.New(t)
+	require.Equal(time.Minute, buildBackoff(1))
+	require.Equal(2*time.Minute, buildBackoff(2))
+	require.Equal(32*time.Minute, buildBackoff(6))
+	require.Equal(time.Hour, buildBackoff(7))
+	require.Equal(time.Hour, buildBackoff(100))
+}
+
+func TestIsBuildFailure(t *testing.T) {
+	require := require.New(t)
+	require.True(isBuildFailure(&ErrBuildFailed{Err: fmt.Errorf("exit status 1")}))
+	require.True(isBuildFailure(wrap(&ErrDownloadFailed{Err: fmt.Errorf("EOF")}, "foo")))
+	require.False(isBuildFailure(wrap(ErrNotFound, "foo")))
+	require.False(isBuildFailure(ErrMaintenance))
+	require.False(isBuildFailure(&ErrQuarantined{}))
+	require.False(isBuildFailure(&sharedFolderError{folder: "/foo"}))
+}
+
+func TestBuildFailures(t *testing.T) {
+	require := require.New(t)
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		tarGzMakefileHandler(w, failingMakefile)
+	}))
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", server.URL)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	assertInternalError(t, srv, "http://foo.bar/v1.0.0/")
+	require.Equal(int32(1), atomic.LoadInt32(&downloads))
+
+	// the version is not built again until the backoff expires
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Contains(w.Body.String(), "error running `make docs`: exit status")
+	retry := w.Header().Get("Retry-After")
+	require.True(retry == "60" || retry == "59", retry)
+	require.Equal(int32(1), atomic.LoadInt32(&downloads))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/versions/v1.0.0/status", nil))
+	require.Equal(http.StatusOK, w.Code)
+	var status versionStatusInfo
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+	require.NotNil(status.LastFailure)
+	require.Equal(1, status.LastFailure.Attempts)
+
+	// the backoff doubles with every failure
+	failure, _ := srv.failures.get("bar", "foo", "v1.0.0")
+	failure.RetryAt = time.Now()
+	assertInternalError(t, srv, "http://foo.bar/v1.0.0/")
+	require.Equal(int32(2), atomic.LoadInt32(&downloads))
+	failure, _ = srv.failures.get("bar", "foo", "v1.0.0")
+	require.Equal(2, failure.Attempts)
+	require.InDelta(2*time.Minute, time.Until(failure.RetryAt), float64(time.Second))
+
+	// administrators can build it again right away
+	assertInternalError(t, srv, "http://foo.bar/v1.0.0/?token=admin")
+	require.Equal(int32(3), atomic.LoadInt32(&downloads))
+
+	// successful builds forget the failures
+	srv.trackBuild(buildConfig{owner: "bar", project: "foo", version: "v1.0.0"}, nil)
+	_, ok := srv.failures.get("bar", "foo", "v1.0.0")
+	require.False(ok)
+}
@@ -0,0 +1,217 @@
+package docsrv
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// missingPageParam is the query parameter added to the URL docsrv
+	// redirects to when the requested page does not exist in a version, so
+	// the docs can show a notice about it.
+	missingPageParam = "missing"
+	// maxFallbackFiles is the maximum number of files visited looking for a
+	// page with the same name in another path of the version.
+	maxFallbackFiles = 10000
+)
+
+var errTooManyFiles = errors.New("too many files")
+
+// fallbackPage returns the URL of the page that replaces the given missing
+// page in the installed version, if any. That is the page with the same name
+// closest to the requested path, e.g. when a page was moved between
+// versions, or else the closest of its parent folders with an index page.
+// Only pages are replaced, the missing assets are not found.
+func (s *Service) fallbackPage(r *http.Request, owner, project, version string) (string, bool) {
+	root := s.versionFolder(owner, project, version)
+	requested := path.Clean("/" + strings.TrimPrefix(strings.TrimLeft(r.URL.Path, "/"), version))
+	// requests that already come from a fallback are not redirected again to
+	// avoid loops
+	if requested == "/" || r.URL.Query().Get(missingPageParam) != "" {
+		return "", false
+	}
+
+	if ext := strings.ToLower(path.Ext(requested)); ext != "" && ext != ".html" && ext != ".htm" {
+		return "", false
+	}
+
+	page, ok := samePageName(s.pages.get(root), requested)
+	if !ok {
+		page, ok = closestIndex(root, requested)
+	}
+	if !ok || strings.TrimSuffix(page, "/") == requested {
+		return "", false
+	}
+
+	u := url.URL{
+		Path:     path.Join("/", version, page),
+		RawQuery: url.Values{missingPageParam: []string{requested}}.Encode(),
+	}
+	if strings.HasSuffix(page, "/") {
+		u.Path += "/"
+	}
+	return reqScheme(r) + "://" + publicHost(r) + u.String(), true
+}
+
+// samePageName returns the path of the page among the given ones with the
+// same name as the requested one that shares the most parent folders with
+// it.
+func samePageName(pages []string, requested string) (string, bool) {
+	name := strings.TrimSuffix(path.Base(requested), ".html")
+	if name == "index" || name == "/" {
+		return "", false
+	}
+
+	var (
+		best      string
+		bestScore = -1
+	)
+	for _, page := range pages {
+		base := path.Base(page)
+		if base != name && base != name+".html" {
+			continue
+		}
+
+		score := sharedSegments(strings.TrimSuffix(page, "/"), requested)
+		if score > bestScore || (score == bestScore && len(page) < len(best)) {
+			best, bestScore = page, score
+		}
+	}
+
+	return best, bestScore >= 0
+}
+
+// pageLists caches the pages of the installed versions the missing pages
+// fall back to, so their folders are not walked on every missing page. The
+// list of a version is listed again when its folder is replaced, which is
+// when it's rebuilt.
+type pageLists struct {
+	mut   sync.Mutex
+	lists map[string]pageList
+}
+
+// pageList are the pages of the folder of a version with the given
+// modification time.
+type pageList struct {
+	modTime time.Time
+	pages   []string
+}
+
+func newPageLists() *pageLists {
+	return &pageLists{lists: make(map[string]pageList)}
+}
+
+// get returns the pages of the given folder of a version, listing them if
+// they are not cached or the folder changed.
+func (l *pageLists) get(root string) []string {
+	fi, err := os.Stat(root)
+	if err != nil {
+		l.forget(root)
+		return nil
+	}
+
+	l.mut.Lock()
+	cached, ok := l.lists[root]
+	l.mut.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) {
+		return cached.pages
+	}
+
+	pages := listPages(root)
+	l.mut.Lock()
+	l.lists[root] = pageList{fi.ModTime(), pages}
+	l.mut.Unlock()
+	return pages
+}
+
+// forget removes the pages of the given folder of a version, which was
+// deleted.
+func (l *pageLists) forget(root string) {
+	l.mut.Lock()
+	delete(l.lists, root)
+	l.mut.Unlock()
+}
+
+// listPages returns the slash-separated paths, relative to the given root
+// folder, of the HTML pages in it and of the folders with an index page,
+// which end with a slash, instead of their index pages. Only the first files
+// are visited in the folders with too many of them.
+func listPages(root string) []string {
+	var (
+		pages   []string
+		visited int
+	)
+	filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		visited++
+		if visited > maxFallbackFiles {
+			return errTooManyFiles
+		}
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil || file == root {
+			return nil
+		}
+		rel = "/" + filepath.ToSlash(rel)
+
+		switch {
+		case fi.IsDir() && isFile(filepath.Join(file, "index.html")):
+			pages = append(pages, rel+"/")
+		case fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".html") && fi.Name() != "index.html":
+			pages = append(pages, rel)
+		}
+		return nil
+	})
+	return pages
+}
+
+// closestIndex returns the closest parent folder of the requested page in
+// the given root folder that has an index page.
+func closestIndex(root, requested string) (string, bool) {
+	dir := path.Dir(requested)
+	for {
+		if isFile(filepath.Join(root, filepath.FromSlash(dir), "index.html")) {
+			return ensureEndingSlash(dir), true
+		}
+
+		if dir == "/" {
+			return "", false
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// sharedSegments returns the number of leading folders the given paths have
+// in common.
+func sharedSegments(a, b string) int {
+	as, bs := folders(a), folders(b)
+	var n int
+	for n < len(as) && n < len(bs) && as[n] == bs[n] {
+		n++
+	}
+	return n
+}
+
+// folders returns the folders of the given slash-separated path.
+func folders(p string) []string {
+	dir := strings.Trim(path.Dir(p), "/")
+	if dir == "" {
+		return nil
+	}
+	return strings.Split(dir, "/")
+}
+
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
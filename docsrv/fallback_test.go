@@ -0,0 +1,94 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackPage(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	files := []string{
+		"bar/foo/v2.0.0/index.html",
+		"bar/foo/v2.0.0/guide/index.html",
+		"bar/foo/v2.0.0/guide/advanced/install.html",
+		"bar/foo/v2.0.0/reference/install.html",
+		"bar/foo/v2.0.0/api/index.html",
+		"bar/foo/v2.0.0/tutorial/basics/index.html",
+	}
+	for _, name := range files {
+		path := filepath.Join(tmpDir, filepath.FromSlash(name))
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte("page"), 0644))
+	}
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v2.0.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	require.NoError(srv.indexProject("bar", "foo"))
+	srv.index.install(buildConfig{
+		owner:       "bar",
+		project:     "foo",
+		version:     "v2.0.0",
+		destination: srv.versionFolder("bar", "foo", "v2.0.0"),
+	})
+
+	cases := []struct {
+		url      string
+		expected string
+	}{
+		// pages moved to another folder
+		{"http://foo.bar/v2.0.0/guide/install.html", "http://foo.bar/v2.0.0/guide/advanced/install.html?missing=%2Fguide%2Finstall.html"},
+		{"http://foo.bar/v2.0.0/reference/old/install", "http://foo.bar/v2.0.0/reference/install.html?missing=%2Freference%2Fold%2Finstall"},
+		{"http://foo.bar/v2.0.0/basics.html", "http://foo.bar/v2.0.0/tutorial/basics/?missing=%2Fbasics.html"},
+		// closest parent folder
+		{"http://foo.bar/v2.0.0/api/removed.html", "http://foo.bar/v2.0.0/api/?missing=%2Fapi%2Fremoved.html"},
+		{"http://foo.bar/v2.0.0/removed/page.html", "http://foo.bar/v2.0.0/?missing=%2Fremoved%2Fpage.html"},
+	}
+
+	for _, c := range cases {
+		assertRedirect(t, srv, c.url, c.expected)
+	}
+
+	// no loops, and missing assets are not pages
+	for _, url := range []string{
+		"http://foo.bar/v2.0.0/removed/page.html?missing=foo",
+		"http://foo.bar/v2.0.0/",
+		"http://foo.bar/v2.0.0/api/removed.css",
+		"http://foo.bar/v2.0.0/guide/install.png",
+	} {
+		assertNotFound(t, srv, url)
+	}
+
+	// the pages of the version are listed once
+	root := srv.versionFolder("bar", "foo", "v2.0.0")
+	require.Equal([]string{
+		"/api/",
+		"/guide/",
+		"/guide/advanced/install.html",
+		"/reference/install.html",
+		"/tutorial/basics/",
+	}, srv.pages.get(root))
+	require.NoError(os.Remove(filepath.Join(root, "reference", "install.html")))
+	require.Contains(srv.pages.get(root), "/reference/install.html")
+
+	srv.pages.forget(root)
+	require.NotContains(srv.pages.get(root), "/reference/install.html")
+}
+
+func TestSharedSegments(t *testing.T) {
+	require := require.New(t)
+	require.Equal(0, sharedSegments("/a.html", "/b.html"))
+	require.Equal(1, sharedSegments("/guide/a.html", "/guide/b/a.html"))
+	require.Equal(2, sharedSegments("/guide/b/c.html", "/guide/b/a.html"))
+	require.Equal(0, sharedSegments("/api/a.html", "/guide/a.html"))
+}
@@ -2,9 +2,16 @@ package docsrv
 
 import (
 	"context"
-	"sort"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
 )
@@ -16,46 +23,243 @@ type release struct {
 	tag string
 	// url is the url to the .tar.gz file with the repo files.
 	url string
+	// zipballURL is the url to the .zip file with the repo files, if known.
+	zipballURL string
+	// assets are the URLs of the assets of the release by name. Branches
+	// and pull requests have none, so it's nil for them.
+	assets map[string]string
+	// sha is the commit the release points to. It is known for branches,
+	// pull requests and the releases whose tag could be found.
+	sha string
+	// prerelease is true if the release is marked as a prerelease.
+	prerelease bool
+	// publishedAt is the time the release was published, if known.
+	publishedAt time.Time
+	// name, notes and author are the title, the body and the login of the
+	// author of the GitHub release. Branches have none, and pull requests
+	// only have the author.
+	name   string
+	notes  string
+	author string
+	// htmlURL is the URL of the page of the GitHub release.
+	htmlURL string
+	// headRepository and labels are the ${OWNER}/${REPO} the head of a pull
+	// request is in, which is not the one of the project for the ones opened
+	// from forks, and its labels.
+	headRepository string
+	labels         []string
 }
 
 // releaseFetcher fetches the releases for projects.
 type releaseFetcher interface {
 	// releases returns all the releases for a project.
-	releases(owner, project string, minVersion *semver.Version) ([]*release, error)
+	releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) ([]*release, error)
+	// branch returns a release pointing to the current HEAD of the given
+	// branch of a project.
+	branch(owner, project, name string) (*release, error)
+	// file returns the contents of the file at the given path in the given
+	// ref of a project. If the file does not exist, no error and no contents
+	// will be returned.
+	file(owner, project, ref, path string) ([]byte, error)
+	// pullRequest returns a release pointing to the current HEAD of the
+	// given pull request of a project. Will also report whether or not the
+	// pull request is open.
+	pullRequest(owner, project string, number int) (*release, bool, error)
+	// commit returns a release pointing to the commit the given ref of a
+	// project, either a tag, a branch or a SHA, resolves to.
+	commit(owner, project, ref string) (*release, error)
 }
 
 type githubFetcher struct {
-	apiKey  string
 	client  *github.Client
 	perPage int
+	// tokens is the source of the global token, if any.
+	tokens oauth2.TokenSource
+	// baseURL and httpClient are used to create the clients of the projects
+	// with their own tokens.
+	baseURL    string
+	httpClient *http.Client
+
+	clientsMut *sync.RWMutex
+	// clients contains the clients of the projects with their own token,
+	// in the form of ${owner}/${project}. The rest of the projects use
+	// client.
+	clients map[string]*github.Client
+	// projectTokens are the sources of the tokens of the projects with
+	// their own, by the same keys as clients.
+	projectTokens map[string]oauth2.TokenSource
+	// tracer records a span for every call to the fetcher, if any.
+	tracer *otelTracer
+}
+
+// tokenSetter is implemented by the release fetchers that can use a different
+// GitHub token for each project.
+type tokenSetter interface {
+	// setTokens replaces the tokens of the projects, in the form of
+	// ${owner}/${project}.
+	setTokens(tokens map[string]string) error
+}
+
+// downloadAuthenticator is implemented by the release fetchers that can
+// authenticate the downloads of the sources of the projects, which is
+// required for the private repositories.
+type downloadAuthenticator interface {
+	// downloadClient returns the given client authenticated with the token
+	// of the given project in the requests to the hosts of the provider.
+	downloadClient(owner, project string, client *http.Client) *http.Client
 }
 
 // newReleaseFetcher creates a new release fetcher service that will fetch
 // releases from GitHub.
 // Giving a `perPage` value of 0 or less will set the default perPage value,
 // which is 100 items per page.
-func newReleaseFetcher(apiKey string, perPage int) releaseFetcher {
-	var client *github.Client
+// If baseURL is not empty, releases are fetched from the GitHub Enterprise
+// Server instance at that URL instead of github.com. If httpClient is nil,
+// http.DefaultClient will be used.
+func newReleaseFetcher(apiKey string, perPage int, baseURL string, httpClient *http.Client) (releaseFetcher, error) {
+	return newReleaseFetcherWithTokens(staticTokenSource(apiKey), perPage, baseURL, httpClient)
+}
+
+// newReleaseFetcherWithTokens is like newReleaseFetcher, but authenticates
+// with the tokens of the given source, if any, such as the installation
+// tokens of a GitHub App, instead of a single API key.
+func newReleaseFetcherWithTokens(tokens oauth2.TokenSource, perPage int, baseURL string, httpClient *http.Client) (releaseFetcher, error) {
 	if perPage <= 0 {
 		perPage = 100
 	}
 
-	if apiKey != "" {
-		ctx := context.Background()
-		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: apiKey})
-		client = github.NewClient(oauth2.NewClient(ctx, ts))
-	} else {
-		client = github.NewClient(nil)
+	client, err := newGitHubClientWithTokens(tokens, baseURL, httpClient)
+	if err != nil {
+		return nil, err
 	}
 
-	return &githubFetcher{apiKey, client, perPage}
+	return &githubFetcher{
+		client:     client,
+		perPage:    perPage,
+		tokens:     tokens,
+		baseURL:    baseURL,
+		httpClient: httpClient,
+		clientsMut: new(sync.RWMutex),
+		clients:    make(map[string]*github.Client),
+	}, nil
 }
 
-func (g *githubFetcher) releases(owner, project string, minVersion *semver.Version) ([]*release, error) {
-	var result []*release
+func (g *githubFetcher) setTokens(tokens map[string]string) error {
+	clients := make(map[string]*github.Client, len(tokens))
+	sources := make(map[string]oauth2.TokenSource, len(tokens))
+	for key, token := range tokens {
+		client, err := newGitHubClient(token, g.baseURL, g.httpClient)
+		if err != nil {
+			return err
+		}
+		clients[key] = client
+		sources[key] = staticTokenSource(token)
+	}
+
+	g.clientsMut.Lock()
+	defer g.clientsMut.Unlock()
+	g.clients = clients
+	g.projectTokens = sources
+	return nil
+}
+
+// downloadClient returns the given client authenticated with the token of the
+// given project, or the global one, in the requests to GitHub, so the
+// sources of private repositories can be downloaded.
+func (g *githubFetcher) downloadClient(owner, project string, client *http.Client) *http.Client {
+	g.clientsMut.RLock()
+	tokens, ok := g.projectTokens[newKey(owner, project)]
+	g.clientsMut.RUnlock()
+	if !ok {
+		tokens = g.tokens
+	}
+
+	return withAuth(client, tokenAuth(tokens), githubHosts(g.baseURL)...)
+}
+
+// githubHosts returns the hosts of github.com, where the archives and
+// assets of the releases are downloaded from, or the one of the GitHub
+// Enterprise Server instance at the given URL, if it's not empty.
+func githubHosts(baseURL string) []string {
+	if baseURL == "" {
+		return []string{"github.com", "api.github.com", "codeload.github.com"}
+	}
+	return []string{hostOf(baseURL)}
+}
+
+// clientFor returns the client for the given project, authenticated with its
+// own token, if it has one, or with the global one otherwise.
+func (g *githubFetcher) clientFor(owner, project string) *github.Client {
+	g.clientsMut.RLock()
+	defer g.clientsMut.RUnlock()
+	if client, ok := g.clients[newKey(owner, project)]; ok {
+		return client
+	}
+	return g.client
+}
+
+// newGitHubClient creates a GitHub client authenticated with the given token,
+// if any, for github.com or the GitHub Enterprise Server instance at the
+// given URL, if it's not empty.
+func newGitHubClient(token, baseURL string, httpClient *http.Client) (*github.Client, error) {
+	return newGitHubClientWithTokens(staticTokenSource(token), baseURL, httpClient)
+}
+
+// staticTokenSource returns a source of the given token, or nil if it's
+// empty.
+func staticTokenSource(token string) oauth2.TokenSource {
+	if token == "" {
+		return nil
+	}
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+}
+
+// newGitHubClientWithTokens is like newGitHubClient, but authenticates with
+// the tokens of the given source, if any.
+func newGitHubClientWithTokens(tokens oauth2.TokenSource, baseURL string, httpClient *http.Client) (*github.Client, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	if tokens != nil {
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+		httpClient = oauth2.NewClient(ctx, tokens)
+	}
+
+	if baseURL == "" {
+		return github.NewClient(httpClient), nil
+	}
+
+	apiURL, err := githubAPIURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return github.NewEnterpriseClient(apiURL, apiURL, httpClient)
+}
+
+// startSpan starts the span of a call to the fetcher for the given project.
+// The calls are not made on behalf of a single request, since the projects
+// are indexed once for all of them, so the spans are roots of their own
+// traces.
+func (g *githubFetcher) startSpan(name, owner, project string) *otelSpan {
+	span := g.tracer.start(spanContext{}, name, spanKindClient)
+	span.set("github.owner", owner)
+	span.set("github.repository", project)
+	return span
+}
+
+func (g *githubFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) (result []*release, err error) {
+	span := g.startSpan("fetch releases", owner, project)
+	defer func() {
+		span.set("github.releases", len(result))
+		span.finish(err)
+	}()
+
+	client := g.clientFor(owner, project)
 	page := 1
 	for {
-		releases, resp, err := g.client.Repositories.ListReleases(
+		releases, resp, err := client.Repositories.ListReleases(
 			context.Background(),
 			owner,
 			project,
@@ -63,7 +267,7 @@ func (g *githubFetcher) releases(owner, project string, minVersion *semver.Versi
 		)
 
 		if err != nil {
-			return nil, err
+			return nil, wrap(githubError(err), "error listing releases of %s/%s", owner, project)
 		}
 
 		for _, r := range releases {
@@ -73,7 +277,7 @@ func (g *githubFetcher) releases(owner, project string, minVersion *semver.Versi
 			}
 
 			v := newVersion(release.tag)
-			if v != nil && v.LessThan(minVersion) {
+			if v != nil && (v.LessThan(minVersion) || maxVersion.excludes(v)) {
 				continue
 			}
 			result = append(result, release)
@@ -86,29 +290,243 @@ func (g *githubFetcher) releases(owner, project string, minVersion *semver.Versi
 		page = resp.NextPage
 	}
 
-	sort.Sort(byTag(result))
+	// the commits of the tags are only used to detect re-tagged releases,
+	// so the releases are still indexed without them if they can't be
+	// listed.
+	shas, err := g.tagSHAs(owner, project, result)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"project": project, "owner": owner}).
+			Warnf("could not get the commits of the tags: %s", err)
+	}
+
+	for _, r := range result {
+		r.sha = shas[r.tag]
+	}
+
+	sortReleases(result, semverScheme{})
 	return result, nil
 }
 
+// tagSHAs returns a map from the tags of the given releases of the given
+// project to their commits. The tags are listed until all of the releases
+// are found, so the projects with many more tags than releases don't list
+// them all on every refresh. The ones found are returned even if there is
+// an error.
+func (g *githubFetcher) tagSHAs(owner, project string, releases []*release) (map[string]string, error) {
+	wanted := make(map[string]bool, len(releases))
+	for _, r := range releases {
+		wanted[r.tag] = true
+	}
+
+	client := g.clientFor(owner, project)
+	shas := make(map[string]string)
+	page := 1
+	for len(shas) < len(wanted) {
+		tags, resp, err := client.Repositories.ListTags(
+			context.Background(),
+			owner,
+			project,
+			&github.ListOptions{Page: page, PerPage: g.perPage},
+		)
+
+		if err != nil {
+			return shas, wrap(githubError(err), "error listing tags of %s/%s", owner, project)
+		}
+
+		for _, t := range tags {
+			if t.Commit != nil && wanted[maybeStr(t.Name)] {
+				shas[maybeStr(t.Name)] = maybeStr(t.Commit.SHA)
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		page = resp.NextPage
+	}
+
+	return shas, nil
+}
+
+func (g *githubFetcher) branch(owner, project, name string) (_ *release, err error) {
+	span := g.startSpan("fetch branch", owner, project)
+	span.set("github.branch", name)
+	defer func() { span.finish(err) }()
+
+	client := g.clientFor(owner, project)
+	b, _, err := client.Repositories.GetBranch(
+		context.Background(),
+		owner,
+		project,
+		name,
+	)
+	if err != nil {
+		return nil, wrap(githubError(err), "error getting branch %s of %s/%s", name, owner, project)
+	}
+
+	var sha string
+	if b.Commit != nil {
+		sha = maybeStr(b.Commit.SHA)
+	}
+
+	if sha == "" {
+		return nil, wrap(ErrNotFound, "unable to find HEAD of branch %s", name)
+	}
+
+	return &release{
+		tag: name,
+		url: fmt.Sprintf("%srepos/%s/%s/tarball/%s", client.BaseURL, owner, project, sha),
+		sha: sha,
+	}, nil
+}
+
+func (g *githubFetcher) file(owner, project, ref, path string) (_ []byte, err error) {
+	span := g.startSpan("fetch file", owner, project)
+	span.set("github.ref", ref)
+	span.set("github.path", path)
+	defer func() { span.finish(err) }()
+
+	rc, err := g.clientFor(owner, project).Repositories.DownloadContents(
+		context.Background(),
+		owner,
+		project,
+		path,
+		&github.RepositoryContentGetOptions{Ref: ref},
+	)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, wrap(githubError(err), "error getting file %s of %s/%s", path, owner, project)
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+func isNotFound(err error) bool {
+	if e, ok := err.(*github.ErrorResponse); ok && e.Response != nil {
+		return e.Response.StatusCode == http.StatusNotFound
+	}
+	return strings.HasPrefix(err.Error(), "No file named")
+}
+
+func (g *githubFetcher) pullRequest(owner, project string, number int) (_ *release, _ bool, err error) {
+	span := g.startSpan("fetch pull request", owner, project)
+	span.set("github.pull_request", number)
+	defer func() { span.finish(err) }()
+
+	client := g.clientFor(owner, project)
+	pr, _, err := client.PullRequests.Get(
+		context.Background(),
+		owner,
+		project,
+		number,
+	)
+	if err != nil {
+		return nil, false, wrap(githubError(err), "error getting pull request %d of %s/%s", number, owner, project)
+	}
+
+	if pr.Head == nil || pr.Head.Repo == nil || pr.Head.SHA == nil {
+		return nil, false, wrap(ErrNotFound, "unable to find HEAD of pull request %d", number)
+	}
+
+	sha, repo := maybeStr(pr.Head.SHA), maybeStr(pr.Head.Repo.FullName)
+	release := &release{
+		tag:            pullRequestVersion(number),
+		url:            fmt.Sprintf("%srepos/%s/tarball/%s", client.BaseURL, repo, sha),
+		sha:            sha,
+		headRepository: repo,
+	}
+	if pr.User != nil {
+		release.author = maybeStr(pr.User.Login)
+	}
+	for _, l := range pr.Labels {
+		release.labels = append(release.labels, maybeStr(l.Name))
+	}
+	return release, maybeStr(pr.State) == "open", nil
+}
+
+func (g *githubFetcher) commit(owner, project, ref string) (_ *release, err error) {
+	span := g.startSpan("fetch commit", owner, project)
+	span.set("github.ref", ref)
+	defer func() { span.finish(err) }()
+
+	client := g.clientFor(owner, project)
+	sha, _, err := client.Repositories.GetCommitSHA1(
+		context.Background(),
+		owner,
+		project,
+		ref,
+		"",
+	)
+	if err != nil {
+		return nil, wrap(githubError(err), "error getting commit of %s in %s/%s", ref, owner, project)
+	}
+
+	if sha == "" {
+		return nil, wrap(ErrNotFound, "unable to find commit of %s", ref)
+	}
+
+	return &release{
+		tag:        ref,
+		url:        fmt.Sprintf("%srepos/%s/%s/tarball/%s", client.BaseURL, owner, project, sha),
+		zipballURL: fmt.Sprintf("%srepos/%s/%s/zipball/%s", client.BaseURL, owner, project, sha),
+		sha:        sha,
+	}, nil
+}
+
 func newRelease(r *github.RepositoryRelease) *release {
-	if r == nil || maybeBool(r.Draft) || maybeBool(r.Prerelease) {
+	if r == nil || maybeBool(r.Draft) {
 		return nil
 	}
 
-	return &release{
-		tag: maybeStr(r.TagName),
-		url: maybeStr(r.TarballURL),
+	release := &release{
+		tag:        maybeStr(r.TagName),
+		url:        maybeStr(r.TarballURL),
+		zipballURL: maybeStr(r.ZipballURL),
+		prerelease: maybeBool(r.Prerelease),
+		assets:     make(map[string]string),
+		name:       maybeStr(r.Name),
+		notes:      maybeStr(r.Body),
+		htmlURL:    maybeStr(r.HTMLURL),
+	}
+
+	if r.Author != nil {
+		release.author = maybeStr(r.Author.Login)
+	}
+
+	for _, a := range r.Assets {
+		release.assets[maybeStr(a.Name)] = maybeStr(a.BrowserDownloadURL)
+	}
+
+	if r.PublishedAt != nil {
+		release.publishedAt = r.PublishedAt.Time
 	}
+
+	return release
 }
 
-type byTag []*release
+// latestRelease returns the newest release that is not a prerelease from
+// the given releases sorted by tag, or nil if there is none.
+func latestRelease(releases []*release) *release {
+	for i := len(releases) - 1; i >= 0; i-- {
+		if !releases[i].prerelease {
+			return releases[i]
+		}
+	}
+	return nil
+}
 
-func (b byTag) Len() int      { return len(b) }
-func (b byTag) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
-func (b byTag) Less(i, j int) bool {
-	vi := newVersion(b[i].tag)
-	vj := newVersion(b[j].tag)
-	return vi.LessThan(vj)
+// latestPrerelease returns the newest prerelease from the given releases
+// sorted by tag, as long as it's newer than the latest release. Returns nil
+// otherwise.
+func latestPrerelease(releases []*release) *release {
+	if len(releases) == 0 || !releases[len(releases)-1].prerelease {
+		return nil
+	}
+	return releases[len(releases)-1]
 }
 
 func maybeBool(b *bool) bool {
@@ -125,6 +543,67 @@ func maybeStr(str *string) string {
 	return ""
 }
 
+// maxVersion is the maximum version allowed, compared with the precision it
+// was given with.
+type maxVersion struct {
+	version *semver.Version
+	// precision is the number of components of the version that are
+	// compared: 1 for the major, 2 for the minor and 3 for the whole version.
+	precision int
+}
+
+// newMaxVersion parses the given maximum version, which may omit the minor
+// and patch numbers. Returns nil if it's not a valid version.
+func newMaxVersion(s string) *maxVersion {
+	v := newVersion(s)
+	if v == nil {
+		return nil
+	}
+
+	core := strings.SplitN(strings.SplitN(strings.TrimPrefix(s, "v"), "-", 2)[0], "+", 2)[0]
+	precision := len(strings.Split(core, "."))
+	if precision > 3 || v.Prerelease() != "" {
+		precision = 3
+	}
+	return &maxVersion{v, precision}
+}
+
+// excludes reports whether the given version is greater than the maximum
+// version. A nil maximum version excludes nothing.
+func (m *maxVersion) excludes(v *semver.Version) bool {
+	if m == nil || v == nil {
+		return false
+	}
+
+	switch m.precision {
+	case 1:
+		return v.Major() > m.version.Major()
+	case 2:
+		return v.Major() > m.version.Major() ||
+			(v.Major() == m.version.Major() && v.Minor() > m.version.Minor())
+	default:
+		return v.GreaterThan(m.version)
+	}
+}
+
+// lessThan reports whether the maximum version excludes versions allowed by
+// the given one.
+func (m *maxVersion) lessThan(other *maxVersion) bool {
+	return m.excludes(other.greatest())
+}
+
+// greatest returns the greatest version allowed.
+func (m *maxVersion) greatest() *semver.Version {
+	switch m.precision {
+	case 1:
+		return semver.MustParse(fmt.Sprintf("%d.%d.%d", m.version.Major(), math.MaxInt32, math.MaxInt32))
+	case 2:
+		return semver.MustParse(fmt.Sprintf("%d.%d.%d", m.version.Major(), m.version.Minor(), math.MaxInt32))
+	default:
+		return m.version
+	}
+}
+
 func newVersion(v string) *semver.Version {
 	vers, err := semver.NewVersion(v)
 	if err != nil {
@@ -1,7 +1,11 @@
 package docsrv
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -15,9 +19,10 @@ const (
 func TestReleases(t *testing.T) {
 	apiKey := os.Getenv("GITHUB_API_KEY")
 	require := require.New(t)
-	fetcher := newReleaseFetcher(apiKey, 1)
+	fetcher, err := newReleaseFetcher(apiKey, 1, "", nil)
+	require.NoError(err)
 
-	releases, err := fetcher.releases(testOwner, testProject, newVersion("v1.4.0"))
+	releases, err := fetcher.releases(testOwner, testProject, newVersion("v1.4.0"), nil)
 	require.NoError(err)
 
 	expected := []string{"v1.4.0", "v1.5.0"}
@@ -28,3 +33,150 @@ func TestReleases(t *testing.T) {
 
 	require.Equal(expected, result)
 }
+
+func TestMaxVersionExcludes(t *testing.T) {
+	cases := []struct {
+		max      string
+		version  string
+		excluded bool
+	}{
+		{"v2", "v2.9.9", false},
+		{"v2", "v1.0.0", false},
+		{"v2", "v3.0.0", true},
+		{"v2", "v3.0.0-beta.1", true},
+		{"v2.1", "v2.1.5", false},
+		{"v2.1", "v2.2.0", true},
+		{"v2.1.0", "v2.1.0", false},
+		{"v2.1.0", "v2.1.1", true},
+		{"", "v9.0.0", false},
+		{"invalid", "v9.0.0", false},
+	}
+
+	for _, c := range cases {
+		max := newMaxVersion(c.max)
+		require.Equal(t, c.excluded, max.excludes(newVersion(c.version)), "%s < %s", c.version, c.max)
+	}
+}
+
+func TestMaxVersionLessThan(t *testing.T) {
+	require := require.New(t)
+	require.True(newMaxVersion("v1").lessThan(newMaxVersion("v2")))
+	require.True(newMaxVersion("v2.1").lessThan(newMaxVersion("v2")))
+	require.True(newMaxVersion("v2.1.0").lessThan(newMaxVersion("v2.1")))
+	require.False(newMaxVersion("v2").lessThan(newMaxVersion("v2.1")))
+	require.False(newMaxVersion("v2").lessThan(newMaxVersion("v2")))
+}
+
+func TestReleases_ProjectTokens(t *testing.T) {
+	require := require.New(t)
+	auth := make(map[string]string)
+	mux := http.NewServeMux()
+	for _, project := range []string{"foo", "bar"} {
+		project := project
+		mux.HandleFunc("/api/v3/repos/org/"+project+"/releases", func(w http.ResponseWriter, r *http.Request) {
+			auth[project] = r.Header.Get("Authorization")
+			fmt.Fprint(w, `[]`)
+		})
+		mux.HandleFunc("/api/v3/repos/org/"+project+"/tags", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[]`)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := newReleaseFetcher("global", 0, server.URL, nil)
+	require.NoError(err)
+	require.NoError(fetcher.(tokenSetter).setTokens(map[string]string{"org/foo": "foo-token"}))
+
+	for _, project := range []string{"foo", "bar"} {
+		_, err := fetcher.releases("org", project, newVersion("v0.0.0"), nil)
+		require.NoError(err)
+	}
+
+	require.Equal(map[string]string{
+		"foo": "Bearer foo-token",
+		"bar": "Bearer global",
+	}, auth)
+}
+
+func TestReleases_TagSHAs(t *testing.T) {
+	require := require.New(t)
+	var pages []string
+	failTags := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/repos/org/foo/releases", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"tag_name":"v2.0.0"},{"tag_name":"v1.0.0"}]`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/foo/tags", func(w http.ResponseWriter, r *http.Request) {
+		if failTags {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		switch page {
+		case "", "1":
+			w.Header().Set("Link", `<`+r.URL.Path+`?page=2>; rel="next"`)
+			fmt.Fprint(w, `[{"name":"v3.0.0-rc.1","commit":{"sha":"c"}},{"name":"v2.0.0","commit":{"sha":"b"}}]`)
+		case "2":
+			w.Header().Set("Link", `<`+r.URL.Path+`?page=3>; rel="next"`)
+			fmt.Fprint(w, `[{"name":"v1.0.0","commit":{"sha":"a"}}]`)
+		default:
+			fmt.Fprint(w, `[{"name":"v0.1.0","commit":{"sha":"0"}}]`)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := newReleaseFetcher("", 0, server.URL, nil)
+	require.NoError(err)
+
+	// the tags are listed until the ones of all the releases are found
+	releases, err := fetcher.releases("org", "foo", newVersion("v0.0.0"), nil)
+	require.NoError(err)
+	require.Len(releases, 2)
+	require.Equal("a", releases[0].sha)
+	require.Equal("b", releases[1].sha)
+	require.Len(pages, 2)
+
+	// the releases are indexed without their commits if the tags fail
+	failTags = true
+	releases, err = fetcher.releases("org", "foo", newVersion("v0.0.0"), nil)
+	require.NoError(err)
+	require.Len(releases, 2)
+	require.Equal("", releases[0].sha)
+}
+
+func TestDownloadClient(t *testing.T) {
+	require := require.New(t)
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	fetcher, err := newReleaseFetcher("global", 0, server.URL, nil)
+	require.NoError(err)
+	require.NoError(fetcher.(tokenSetter).setTokens(map[string]string{"org/foo": "foo-token"}))
+	downloads := fetcher.(downloadAuthenticator)
+
+	cases := []struct {
+		project string
+		url     string
+		auth    string
+	}{
+		{"foo", server.URL, "Bearer foo-token"},
+		{"bar", server.URL, "Bearer global"},
+		// the tokens are never sent to other hosts
+		{"foo", strings.Replace(server.URL, "127.0.0.1", "localhost", 1), ""},
+	}
+
+	for _, c := range cases {
+		auth = "unset"
+		resp, err := downloads.downloadClient("org", c.project, nil).Get(c.url)
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(c.auth, auth, c.url)
+	}
+}
@@ -0,0 +1,36 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// indexFrozen indexes the given frozen project with the versions installed on
+// disk, without calling the GitHub API. The releases already known are kept
+// as they are, so their notes and dates are still served.
+func (s *Service) indexFrozen(owner, project string, conf ProjectConfig) {
+	var releases []*release
+	entries, _ := ioutil.ReadDir(s.projectFolder(owner, project))
+	for _, e := range entries {
+		// hidden folders are rebuilds in progress
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		r := s.index.get(owner, project, e.Name())
+		if r == nil {
+			r = &release{tag: e.Name()}
+		}
+		releases = append(releases, r)
+	}
+
+	scheme := conf.versionScheme()
+	releases, _ = validReleases(releases, scheme)
+	sortReleases(releases, scheme)
+	if len(conf.ExcludeVersions) > 0 {
+		releases = withoutExcluded(conf, releases)
+	}
+
+	s.index.set(owner, project, releases)
+	s.latest.invalidate(owner, project)
+}
@@ -0,0 +1,54 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+)
+
+// failingFetcher is a mockFetcher that fails the test if the releases are
+// fetched.
+type failingFetcher struct {
+	*mockFetcher
+	t *testing.T
+}
+
+func (f *failingFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) ([]*release, error) {
+	f.t.Errorf("releases of %s/%s fetched", owner, project)
+	return f.mockFetcher.releases(owner, project, minVersion, maxVersion)
+}
+
+func TestFrozen(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, dir := range []string{"v1.1.0", "v1.0.0", ".v1.0.0-123", "foo"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpDir, "bar", "foo", dir), 0755))
+	}
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.add("bar", "foo", "v1.2.0", "")
+	srv := newTestSrv(&failingFetcher{fetcher, t}, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", Frozen: true},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.RefreshToken = "admin"
+
+	assertJSON(t, srv, "http://foo.bar/versions.json", []*version{
+		{Text: "v1.0.0", URL: "http://foo.bar/v1.0.0"},
+		{Text: "v1.1.0", URL: "http://foo.bar/v1.1.0"},
+	})
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v1.1.0/")
+	assertNotFound(t, srv, "http://foo.bar/v1.2.0/")
+	assertNotFound(t, srv, "http://foo.bar/v1.0.0/missing.html?token=admin")
+	require.NoError(srv.refreshProject(newKey("bar", "foo")))
+	require.False(srv.index.isInstalled("bar", "foo", "v1.2.0"))
+}
@@ -0,0 +1,180 @@
+package docsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// githubAppJWTTTL is the time the JWTs docsrv authenticates with as the
+	// GitHub App are valid for. GitHub accepts up to 10 minutes.
+	githubAppJWTTTL = 9 * time.Minute
+	// githubAppClockSkew is the time the JWTs are issued in the past, in
+	// case the clock of GitHub is behind.
+	githubAppClockSkew = time.Minute
+	// installationTokenRenewal is the time before their expiration the
+	// installation tokens are renewed, so they don't expire in the middle
+	// of a refresh.
+	installationTokenRenewal = 5 * time.Minute
+)
+
+// validateGitHubApp returns an error if the GitHub App is partially configured
+// or its private key can not be loaded.
+func (o Options) validateGitHubApp() error {
+	if o.GitHubAppID == 0 && o.GitHubInstallation == 0 && o.GitHubAppKey == "" {
+		return nil
+	}
+
+	if o.GitHubAppID == 0 || o.GitHubInstallation == 0 || o.GitHubAppKey == "" {
+		return fmt.Errorf("the ID, the installation ID and the private key of the GitHub App are required")
+	}
+
+	_, err := loadGitHubAppKey(o.GitHubAppKey)
+	return err
+}
+
+// loadGitHubAppKey reads the RSA private key of a GitHub App from the given
+// PEM file, in PKCS #1 or PKCS #8 form.
+func loadGitHubAppKey(file string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, wrap(err, "could not read GitHub App private key")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("GitHub App private key %s is not a PEM file", file)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, wrap(err, "invalid GitHub App private key %s", file)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GitHub App private key %s is not an RSA key", file)
+	}
+	return rsaKey, nil
+}
+
+// newGitHubAppTokenSource returns a source of installation tokens of the
+// GitHub App of the given options, which are renewed before they expire.
+func newGitHubAppTokenSource(opts Options, httpClient *http.Client) (oauth2.TokenSource, error) {
+	key, err := loadGitHubAppKey(opts.GitHubAppKey)
+	if err != nil {
+		return nil, err
+	}
+
+	jwts := oauth2.ReuseTokenSource(nil, &githubAppJWTSource{
+		appID: opts.GitHubAppID,
+		key:   key,
+		now:   time.Now,
+	})
+
+	client, err := newGitHubClientWithTokens(jwts, opts.GitHubBaseURL, httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	return oauth2.ReuseTokenSource(nil, &installationTokenSource{
+		client:         client,
+		installationID: opts.GitHubInstallation,
+	}), nil
+}
+
+// githubAppJWTSource is a source of the JWTs used to authenticate as a
+// GitHub App, which can only be used to get the tokens of its installations.
+type githubAppJWTSource struct {
+	appID int64
+	key   *rsa.PrivateKey
+	now   func() time.Time
+}
+
+func (s *githubAppJWTSource) Token() (*oauth2.Token, error) {
+	now := s.now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := now.Add(githubAppJWTTTL)
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-githubAppClockSkew).Unix(),
+		"exp": expiry.Unix(),
+		"iss": strconv.FormatInt(s.appID, 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, wrap(err, "could not sign GitHub App JWT")
+	}
+
+	return &oauth2.Token{
+		AccessToken: payload + "." + base64.RawURLEncoding.EncodeToString(signature),
+		TokenType:   "Bearer",
+		// renewed a minute before GitHub stops accepting it.
+		Expiry: expiry.Add(-time.Minute),
+	}, nil
+}
+
+// installationTokenSource is a source of the tokens of an installation of a
+// GitHub App, which are valid for an hour.
+type installationTokenSource struct {
+	// client is authenticated as the GitHub App.
+	client         *github.Client
+	installationID int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	url := fmt.Sprintf("app/installations/%d/access_tokens", s.installationID)
+	req, err := s.client.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token := new(github.InstallationToken)
+	if _, err := s.client.Do(context.Background(), req, token); err != nil {
+		return nil, wrap(githubError(err), "error getting token of GitHub App installation %d", s.installationID)
+	}
+
+	if token.GetToken() == "" {
+		return nil, fmt.Errorf("GitHub App installation %d got an empty token", s.installationID)
+	}
+
+	expiry := token.GetExpiresAt()
+	if !expiry.IsZero() {
+		expiry = expiry.Add(-installationTokenRenewal)
+	}
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package docsrv
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeGitHubAppKey writes a new RSA private key in PEM form to the given
+// folder and returns its path and the key.
+func writeGitHubAppKey(t *testing.T, dir string) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "app.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	return file, key
+}
+
+// verifyGitHubAppJWT checks the signature and claims of the JWT of the given
+// authorization header.
+func verifyGitHubAppJWT(t *testing.T, key *rsa.PublicKey, authorization string) {
+	require := require.New(t)
+	require.True(strings.HasPrefix(authorization, "Bearer "), authorization)
+	parts := strings.Split(strings.TrimPrefix(authorization, "Bearer "), ".")
+	require.Len(parts, 3)
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(err)
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature))
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(err)
+	var claims struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}
+	require.NoError(json.Unmarshal(data, &claims))
+	require.Equal("123", claims.Issuer)
+	require.True(claims.IssuedAt < time.Now().Unix())
+	require.True(claims.ExpiresAt-claims.IssuedAt <= int64((10 * time.Minute).Seconds()))
+}
+
+func TestGitHubApp(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "docsrv-app-")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	keyFile, key := writeGitHubAppKey(t, dir)
+
+	var tokens int
+	expiresIn := time.Hour
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("POST", r.Method)
+		verifyGitHubAppJWT(t, &key.PublicKey, r.Header.Get("Authorization"))
+		tokens++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "ghs_%d", "expires_at": %q}`, tokens, time.Now().Add(expiresIn).Format(time.RFC3339))
+	})
+	mux.HandleFunc("/api/v3/repos/org/foo/releases", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(fmt.Sprintf("Bearer ghs_%d", tokens), r.Header.Get("Authorization"))
+		fmt.Fprint(w, `[{"tag_name": "v1.0.0", "tarball_url": "https://github.example.com/tarball/v1.0.0"}]`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/foo/tags", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"name": "v1.0.0", "commit": {"sha": "1234"}}]`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	opts := Options{
+		GitHubBaseURL:      server.URL,
+		GitHubAppID:        123,
+		GitHubInstallation: 42,
+		GitHubAppKey:       keyFile,
+	}
+	require.NoError(opts.Validate())
+
+	source, err := newGitHubAppTokenSource(opts, nil)
+	require.NoError(err)
+	fetcher, err := newReleaseFetcherWithTokens(source, 0, server.URL, nil)
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		releases, err := fetcher.releases("org", "foo", newVersion("v0.0.0"), nil)
+		require.NoError(err)
+		require.Len(releases, 1)
+	}
+	require.Equal(1, tokens)
+
+	// tokens about to expire are renewed, in this case before every call to
+	// the API: the releases and the tags.
+	expiresIn = time.Minute
+	source, err = newGitHubAppTokenSource(opts, nil)
+	require.NoError(err)
+	fetcher, err = newReleaseFetcherWithTokens(source, 0, server.URL, nil)
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		_, err := fetcher.releases("org", "foo", newVersion("v0.0.0"), nil)
+		require.NoError(err)
+	}
+	require.Equal(5, tokens)
+}
+
+func TestOptionsValidateGitHubApp(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "docsrv-app-")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	keyFile, _ := writeGitHubAppKey(t, dir)
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	require.NoError(ioutil.WriteFile(invalid, []byte("not a key"), 0600))
+
+	require.NoError(Options{GitHubAppID: 1, GitHubInstallation: 2, GitHubAppKey: keyFile}.Validate())
+	require.Error(Options{GitHubAppID: 1, GitHubAppKey: keyFile}.Validate())
+	require.Error(Options{GitHubAppID: 1, GitHubInstallation: 2}.Validate())
+	require.Error(Options{GitHubAppID: 1, GitHubInstallation: 2, GitHubAppKey: invalid}.Validate())
+	require.Error(Options{GitHubAppID: 1, GitHubInstallation: 2, GitHubAppKey: filepath.Join(dir, "missing.pem")}.Validate())
+}
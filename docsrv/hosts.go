@@ -0,0 +1,180 @@
+package docsrv
+
+import (
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// wwwPrefix is the prefix of the hosts served by the hosts without it that
+// have the AllowWWW option.
+const wwwPrefix = "www."
+
+// normalizeHost returns the given host as it's matched against the requests:
+// lower case, without port, without the trailing dot of fully qualified
+// domain names and with its internationalized labels encoded with punycode.
+// The path prefix of the hosts of the projects served under one is kept as
+// it is.
+func normalizeHost(host string) string {
+	host, prefix := splitPathPrefix(host)
+	host = strings.TrimSuffix(strings.ToLower(stripPort(host)), ".")
+	return asciiHost(host) + prefix
+}
+
+// hostKey returns the host of the config that serves the given one, which is
+// matched case-insensitively, ignoring its port and trailing dot, and with its
+// internationalized labels in unicode or punycode. A host prefixed by "www."
+// is served by the host without it if it has the AllowWWW option, and the
+// aliases of a host are served by it. Will also report whether or not there
+// is any. The hosts of the config are normalized on every call, so the
+// service matches the hosts of the requests with its hostTable instead.
+func (c Config) hostKey(host string) (string, bool) {
+	if h := stripPort(host); c.has(h) {
+		return h, true
+	}
+	return newHostTable(c).hostKey(c, host)
+}
+
+// hostTable contains the normalized hosts and aliases of a config, so the
+// hosts of the requests are matched against it without normalizing all the
+// configured ones every time.
+type hostTable struct {
+	// hosts are the hosts of the config by their normalized host.
+	hosts map[string]string
+	// aliases are the hosts of the config by their normalized aliases.
+	aliases map[string]string
+}
+
+// newHostTable returns the table of the hosts and aliases of the given
+// config.
+func newHostTable(c Config) *hostTable {
+	t := &hostTable{
+		hosts:   make(map[string]string, len(c)),
+		aliases: make(map[string]string),
+	}
+
+	for host, conf := range c {
+		t.hosts[normalizeHost(host)] = host
+		for _, alias := range conf.Aliases {
+			t.aliases[normalizeHost(alias)] = host
+		}
+	}
+	return t
+}
+
+// hostKey returns the host of the given config, whose table this is, that
+// serves the given one, as Config.hostKey does.
+func (t *hostTable) hostKey(c Config, host string) (string, bool) {
+	if h := stripPort(host); c.has(h) {
+		return h, true
+	}
+
+	host = normalizeHost(host)
+	if key, ok := t.hosts[host]; ok {
+		return key, true
+	}
+
+	if key, ok := t.aliases[host]; ok {
+		return key, true
+	}
+
+	if bare := strings.TrimPrefix(host, wwwPrefix); bare != host {
+		if key, ok := t.hostKey(c, bare); ok && c[key].AllowWWW {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// aliasOf returns the host the given host is an alias of. Will also report
+// whether or not there is any.
+func (t *hostTable) aliasOf(host string) (string, bool) {
+	key, ok := t.aliases[normalizeHost(host)]
+	return key, ok
+}
+
+func (c Config) has(host string) bool {
+	_, ok := c[host]
+	return ok
+}
+
+// forHost returns the configuration of the project served at the given
+// host, or an empty one if there is none.
+func (c Config) forHost(host string) ProjectConfig {
+	key, _ := c.hostKey(host)
+	return c[key]
+}
+
+// forHost returns the configuration of the project served at the given
+// host, or an empty one if there is none.
+func (s *Service) forHost(host string) ProjectConfig {
+	config, hosts := s.hostConfig()
+	key, _ := hosts.hostKey(config, host)
+	return config[key]
+}
+
+// canonicalHost returns the given host as docsrv serves it, as
+// Config.canonicalHost does, with the table of the hosts of the current
+// config.
+func (s *Service) canonicalHost(hostport string) string {
+	config, hosts := s.hostConfig()
+	return hosts.canonicalHost(config, hostport)
+}
+
+// canonicalHost returns the given host, with its port, as docsrv serves it:
+// normalized and without the "www." prefix if it's served by the host
+// without it.
+func (c Config) canonicalHost(hostport string) string {
+	return newHostTable(c).canonicalHost(c, hostport)
+}
+
+// canonicalHost returns the given host as the given config, whose table this
+// is, serves it, as Config.canonicalHost does.
+func (t *hostTable) canonicalHost(c Config, hostport string) string {
+	hostport, prefix := splitPathPrefix(hostport)
+
+	var port string
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		hostport, port = h, ":"+p
+	}
+
+	// IPv6 addresses
+	if strings.Contains(hostport, ":") {
+		return "[" + strings.ToLower(strings.Trim(hostport, "[]")) + "]" + port + prefix
+	}
+
+	host := normalizeHost(hostport)
+	if bare := strings.TrimPrefix(host, wwwPrefix); bare != host {
+		if key, ok := t.hostKey(c, bare+prefix); ok && c[key].AllowWWW {
+			host = bare
+		}
+	}
+	return host + port + prefix
+}
+
+// asciiHost returns the given lowercase host with its non-ASCII labels
+// encoded with punycode, as in the "xn--" labels of IDNA. The hosts that are
+// not valid IDNA are kept as they are.
+func asciiHost(host string) string {
+	if isASCII(host) {
+		return host
+	}
+
+	encoded, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return host
+	}
+	return encoded
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
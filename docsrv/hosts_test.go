@@ -0,0 +1,102 @@
+package docsrv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	cases := []struct {
+		host     string
+		expected string
+	}{
+		{"foo.bar", "foo.bar"},
+		{"Foo.Bar.:80", "foo.bar"},
+		{"FOO.bar/Docs", "foo.bar/Docs"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"MÜNCHEN.de.", "xn--mnchen-3ya.de"},
+		{"españa.com:8080", "xn--espaa-rta.com"},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de"},
+		{"中文.com", "xn--fiq228c.com"},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, normalizeHost(c.host), c.host)
+	}
+}
+
+func TestConfigHostKey(t *testing.T) {
+	config := Config{
+		"foo.bar":       ProjectConfig{Repository: "org/foo"},
+		"Docs.Bar":      ProjectConfig{Repository: "org/docs", AllowWWW: true},
+		"bücher.bar":    ProjectConfig{Repository: "org/buecher"},
+		"paths.bar/qux": ProjectConfig{Repository: "org/qux"},
+	}
+
+	cases := []struct {
+		host string
+		key  string
+		ok   bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"FOO.Bar.:8080", "foo.bar", true},
+		{"www.foo.bar", "", false},
+		{"docs.bar", "Docs.Bar", true},
+		{"WWW.docs.bar.", "Docs.Bar", true},
+		{"xn--bcher-kva.bar", "bücher.bar", true},
+		{"Bücher.bar", "bücher.bar", true},
+		{"Paths.Bar:80/qux", "paths.bar/qux", true},
+		{"baz.bar", "", false},
+	}
+
+	for _, c := range cases {
+		key, ok := config.hostKey(c.host)
+		require.Equal(t, c.ok, ok, c.host)
+		require.Equal(t, c.key, key, c.host)
+	}
+
+	owner, project, ok := config.ProjectForHost("WWW.Docs.Bar")
+	require.True(t, ok)
+	require.Equal(t, "org", owner)
+	require.Equal(t, "docs", project)
+}
+
+func TestConfigCanonicalHost(t *testing.T) {
+	config := Config{
+		"foo.bar":  ProjectConfig{Repository: "org/foo"},
+		"docs.bar": ProjectConfig{Repository: "org/docs", AllowWWW: true},
+	}
+
+	cases := []struct {
+		host     string
+		expected string
+	}{
+		{"foo.bar", "foo.bar"},
+		{"FOO.bar.:8080", "foo.bar:8080"},
+		{"www.foo.bar", "www.foo.bar"},
+		{"www.Docs.bar:8080", "docs.bar:8080"},
+		{"Docs.Bar/Qux", "docs.bar/Qux"},
+		{"[::1]:8080", "[::1]:8080"},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, config.canonicalHost(c.host), c.host)
+	}
+}
+
+func TestServiceForHost(t *testing.T) {
+	require := require.New(t)
+	srv := newTestSrv(newMockFetcher(), Config{
+		"Docs.Bar": ProjectConfig{Repository: "org/docs", Aliases: []string{"Alias.Bar"}},
+	})
+
+	require.Equal("org/docs", srv.forHost("docs.bar:8080").Repository)
+	require.Equal("org/docs", srv.forHost("alias.bar").Repository)
+	require.Equal("", srv.forHost("foo.bar").Repository)
+
+	// the table of the hosts is replaced along with the config
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "org/foo"}})
+	require.Equal("org/foo", srv.forHost("FOO.bar").Repository)
+	require.Equal("", srv.forHost("docs.bar").Repository)
+}
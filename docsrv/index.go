@@ -1,32 +1,91 @@
 package docsrv
 
 import (
+	"hash/fnv"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Masterminds/semver"
 )
 
+// defaultIndexShards is the default number of shards of the release index.
+const defaultIndexShards = 16
+
 type projectIndex struct {
-	releasesMut *sync.RWMutex
 	// releases contains a map from ${owner}/${project}/${version} to a specific
 	// release.
-	releases map[string]*release
+	releases *releaseShards
 
 	projectsMut *sync.RWMutex
 	// projects contains a list of releases for each project in the form of
 	// ${owner}/${project}
 	projects map[string][]*release
+	// refreshedAt contains the last time the releases of each project were
+	// set, in the form of ${owner}/${project}. It's guarded by projectsMut.
+	refreshedAt map[string]time.Time
+	// refreshFailures contains the last failed refresh of each project
+	// since its releases were set, in the form of ${owner}/${project}. It's
+	// guarded by projectsMut.
+	refreshFailures map[string]refreshFailure
+	// skippedTags contains the tags of the releases of each project that
+	// were skipped because they are not versions of its version scheme, in
+	// the form of ${owner}/${project}. It's guarded by projectsMut.
+	skippedTags map[string][]string
+	// orphaned contains the installed versions of each project whose
+	// releases were deleted upstream, in the form of ${owner}/${project}.
+	// It's guarded by projectsMut.
+	orphaned map[string][]string
+
+	branchesMut *sync.RWMutex
+	// branches contains a list of the tracked branches for each project in
+	// the form of ${owner}/${project}
+	branches map[string][]*release
 
 	installedMut *sync.RWMutex
-	// installed is a set of installed versions in the format ${owner}/${project}/${version}.
-	installed map[string]struct{}
+	// installed is a map from installed versions in the format
+	// ${owner}/${project}/${version} to the configuration they were built with.
+	installed map[string]buildConfig
 
+	// minVersionsMut guards minVersions, minVersionOverrides and
+	// maxVersions.
 	minVersionsMut *sync.Mutex
 	minVersions    map[string]*semver.Version
+	// minVersionOverrides contains the minimum versions of the projects set
+	// at runtime, which take precedence over the ones in the config.
+	minVersionOverrides map[string]*semver.Version
+	// maxVersions contains the maximum version fetched for each project,
+	// which is nil if any of its hosts has no maximum version.
+	maxVersions map[string]*maxVersion
 }
 
-func newProjectIndex(conf Config) *projectIndex {
+// newProjectIndex creates a new index for the projects in the given config,
+// with the given number of shards for the release index. If shards is 0 or
+// less, defaultIndexShards will be used.
+func newProjectIndex(conf Config, shards int) *projectIndex {
+	return &projectIndex{
+		releases:            newReleaseShards(shards),
+		projectsMut:         new(sync.RWMutex),
+		projects:            make(map[string][]*release),
+		refreshedAt:         make(map[string]time.Time),
+		refreshFailures:     make(map[string]refreshFailure),
+		skippedTags:         make(map[string][]string),
+		orphaned:            make(map[string][]string),
+		branchesMut:         new(sync.RWMutex),
+		branches:            make(map[string][]*release),
+		installedMut:        new(sync.RWMutex),
+		installed:           make(map[string]buildConfig),
+		minVersionsMut:      new(sync.Mutex),
+		minVersions:         minVersionsFromConfig(conf),
+		minVersionOverrides: make(map[string]*semver.Version),
+		maxVersions:         maxVersionsFromConfig(conf),
+	}
+}
+
+// minVersionsFromConfig returns a map from ${owner}/${project} to the minimum
+// version of every project in the given config.
+func minVersionsFromConfig(conf Config) map[string]*semver.Version {
 	var minVersions = make(map[string]*semver.Version)
 	for host := range conf {
 		owner, repo, ok := conf.ProjectForHost(host)
@@ -41,58 +100,243 @@ func newProjectIndex(conf Config) *projectIndex {
 
 		minVersions[newKey(owner, repo)] = v
 	}
+	return minVersions
+}
 
-	return &projectIndex{
-		releasesMut:    new(sync.RWMutex),
-		releases:       make(map[string]*release),
-		projectsMut:    new(sync.RWMutex),
-		projects:       make(map[string][]*release),
-		installedMut:   new(sync.RWMutex),
-		installed:      make(map[string]struct{}),
-		minVersionsMut: new(sync.Mutex),
-		minVersions:    minVersions,
+// maxVersionsFromConfig returns a map from ${owner}/${project} to the
+// greatest maximum version of the hosts of every project in the given config,
+// or nil if any of them has no maximum version.
+func maxVersionsFromConfig(conf Config) map[string]*maxVersion {
+	var maxVersions = make(map[string]*maxVersion)
+	for host := range conf {
+		owner, repo, ok := conf.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		key := newKey(owner, repo)
+		v := conf.MaxVersionForHost(host)
+		prev, ok := maxVersions[key]
+		if !ok || (prev != nil && (v == nil || prev.lessThan(v))) {
+			maxVersions[key] = v
+		}
 	}
+	return maxVersions
 }
 
-func (p *projectIndex) getProjects() []string {
+// setVersionBounds replaces the minimum and maximum versions of the projects
+// with the ones in the given config. The minimum versions set at runtime are
+// kept.
+func (p *projectIndex) setVersionBounds(conf Config) {
+	minVersions := minVersionsFromConfig(conf)
+	maxVersions := maxVersionsFromConfig(conf)
+	p.minVersionsMut.Lock()
+	defer p.minVersionsMut.Unlock()
+	p.minVersions = minVersions
+	p.maxVersions = maxVersions
+}
+
+// unset removes the releases of the given project from the index, so it's
+// indexed again on the next request. Installed versions are kept.
+func (p *projectIndex) unset(owner, project string) {
+	key := newKey(owner, project)
 	p.projectsMut.Lock()
-	defer p.projectsMut.Unlock()
-	var projs []string
+	delete(p.projects, key)
+	p.projectsMut.Unlock()
+
+	p.branchesMut.Lock()
+	delete(p.branches, key)
+	p.branchesMut.Unlock()
+
+	p.releases.removePrefix(key + "/")
+}
+
+// removeProject removes the given project from the index, including its
+// installed versions.
+func (p *projectIndex) removeProject(owner, project string) {
+	p.unset(owner, project)
+	p.setOrphaned(owner, project, nil)
+
+	prefix := newKey(owner, project) + "/"
+	p.installedMut.Lock()
+	defer p.installedMut.Unlock()
+	for key := range p.installed {
+		if strings.HasPrefix(key, prefix) {
+			delete(p.installed, key)
+		}
+	}
+}
+
+func (p *projectIndex) getProjects() []string {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
+	projs := make([]string, 0, len(p.projects))
 	for key := range p.projects {
 		projs = append(projs, key)
 	}
 	return projs
 }
 
+// set sets the releases of the given project. The previous releases that
+// are not among them are removed from the index, except the tracked
+// branches, but their installations are kept.
 func (p *projectIndex) set(owner, project string, releases []*release) {
 	key := newKey(owner, project)
 	p.projectsMut.Lock()
+	prev := p.projects[key]
 	p.projects[key] = releases
+	p.refreshedAt[key] = time.Now()
+	delete(p.refreshFailures, key)
 	p.projectsMut.Unlock()
 
-	p.releasesMut.Lock()
-	defer p.releasesMut.Unlock()
+	tags := make(map[string]bool, len(releases))
 	for _, r := range releases {
-		key := newKey(owner, project, r.tag)
-		p.releases[key] = r
+		tags[r.tag] = true
+		p.releases.set(newKey(owner, project, r.tag), r)
+	}
+
+	branches := make(map[string]bool)
+	for _, b := range p.branchesForProject(owner, project) {
+		branches[b.tag] = true
+	}
+
+	for _, r := range prev {
+		if !tags[r.tag] && !branches[r.tag] {
+			p.releases.remove(newKey(owner, project, r.tag))
+		}
 	}
 }
 
-func (p *projectIndex) get(owner, project, version string) *release {
-	p.releasesMut.Lock()
-	defer p.releasesMut.Unlock()
-	return p.releases[newKey(owner, project, version)]
+// setSkippedTags sets the tags of the releases of the given project skipped
+// because they are not versions of its version scheme. Returns the previous
+// ones.
+func (p *projectIndex) setSkippedTags(owner, project string, tags []string) []string {
+	key := newKey(owner, project)
+	p.projectsMut.Lock()
+	defer p.projectsMut.Unlock()
+	prev := p.skippedTags[key]
+	if len(tags) == 0 {
+		delete(p.skippedTags, key)
+	} else {
+		p.skippedTags[key] = tags
+	}
+	return prev
 }
 
-func (p *projectIndex) forProject(owner, project string) []*release {
+// skippedTagsForProject returns the tags of the releases of the given project
+// skipped because they are not versions of its version scheme.
+func (p *projectIndex) skippedTagsForProject(owner, project string) []string {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
+	return p.skippedTags[newKey(owner, project)]
+}
+
+// setOrphaned sets the installed versions of the given project whose
+// releases were deleted upstream. Returns the previous ones.
+func (p *projectIndex) setOrphaned(owner, project string, versions []string) []string {
+	key := newKey(owner, project)
 	p.projectsMut.Lock()
 	defer p.projectsMut.Unlock()
+	prev := p.orphaned[key]
+	if len(versions) == 0 {
+		delete(p.orphaned, key)
+	} else {
+		p.orphaned[key] = versions
+	}
+	return prev
+}
+
+// orphanedForProject returns the installed versions of the given project
+// whose releases were deleted upstream.
+func (p *projectIndex) orphanedForProject(owner, project string) []string {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
+	return p.orphaned[newKey(owner, project)]
+}
+
+// setBranches sets the tracked branches of the given project. Branches are
+// available as any other release but they are not listed as project releases.
+func (p *projectIndex) setBranches(owner, project string, branches []*release) {
+	key := newKey(owner, project)
+	p.branchesMut.Lock()
+	p.branches[key] = branches
+	p.branchesMut.Unlock()
+
+	for _, b := range branches {
+		p.releases.set(newKey(owner, project, b.tag), b)
+	}
+}
+
+// branchesForProject returns the tracked branches of the given project.
+func (p *projectIndex) branchesForProject(owner, project string) []*release {
+	p.branchesMut.RLock()
+	defer p.branchesMut.RUnlock()
+	return p.branches[newKey(owner, project)]
+}
+
+// add adds a release of the given project to the index without listing it
+// as one of the project releases.
+func (p *projectIndex) add(owner, project string, r *release) {
+	p.releases.set(newKey(owner, project, r.tag), r)
+}
+
+// remove removes a release of the given project added with add from the
+// index, including its installation.
+func (p *projectIndex) remove(owner, project, version string) {
+	key := newKey(owner, project, version)
+	p.releases.remove(key)
+
+	p.installedMut.Lock()
+	defer p.installedMut.Unlock()
+	delete(p.installed, key)
+}
+
+func (p *projectIndex) get(owner, project, version string) *release {
+	return p.releases.get(newKey(owner, project, version))
+}
+
+func (p *projectIndex) forProject(owner, project string) []*release {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
 	return p.projects[newKey(owner, project)]
 }
 
-func (p *projectIndex) isIndexed(owner, project string) bool {
+// lastRefresh returns the last time the releases of the given project were
+// indexed. Will also report whether or not it was ever indexed.
+func (p *projectIndex) lastRefresh(owner, project string) (time.Time, bool) {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
+	t, ok := p.refreshedAt[newKey(owner, project)]
+	return t, ok
+}
+
+// refreshFailure is a failed refresh of the releases of a project.
+type refreshFailure struct {
+	at  time.Time
+	err error
+}
+
+// refreshFailed records that the releases of the given project could not be
+// refreshed because of the given error.
+func (p *projectIndex) refreshFailed(owner, project string, err error) {
 	p.projectsMut.Lock()
 	defer p.projectsMut.Unlock()
+	p.refreshFailures[newKey(owner, project)] = refreshFailure{time.Now(), err}
+}
+
+// lastRefreshFailure returns the last failed refresh of the given project
+// since its releases were last indexed. Will also report whether or not
+// there is any.
+func (p *projectIndex) lastRefreshFailure(owner, project string) (refreshFailure, bool) {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
+	f, ok := p.refreshFailures[newKey(owner, project)]
+	return f, ok
+}
+
+func (p *projectIndex) isIndexed(owner, project string) bool {
+	p.projectsMut.RLock()
+	defer p.projectsMut.RUnlock()
 	_, ok := p.projects[newKey(owner, project)]
 	return ok
 }
@@ -106,18 +350,233 @@ func (p *projectIndex) isInstalled(owner, project, version string) bool {
 	return ok
 }
 
-// install marks as installed the given project version.
-func (p *projectIndex) install(owner, project, version string) {
+// install marks as installed the project version built with the given
+// configuration.
+func (p *projectIndex) install(conf buildConfig) {
+	key := newKey(conf.owner, conf.project, conf.version)
+	p.installedMut.Lock()
+	defer p.installedMut.Unlock()
+	p.installed[key] = conf
+}
+
+// uninstall marks as not installed the given project version, which is kept
+// in the index.
+func (p *projectIndex) uninstall(owner, project, version string) {
 	key := newKey(owner, project, version)
 	p.installedMut.Lock()
 	defer p.installedMut.Unlock()
-	p.installed[key] = struct{}{}
+	delete(p.installed, key)
 }
 
+// installation returns the configuration the given project version was built
+// with. Will also report whether or not the version is installed with a
+// boolean.
+func (p *projectIndex) installation(owner, project, version string) (buildConfig, bool) {
+	key := newKey(owner, project, version)
+	p.installedMut.Lock()
+	defer p.installedMut.Unlock()
+	conf, ok := p.installed[key]
+	return conf, ok
+}
+
+// installedCount returns the number of installed versions of all the
+// projects.
+func (p *projectIndex) installedCount() int {
+	p.installedMut.RLock()
+	defer p.installedMut.RUnlock()
+	return len(p.installed)
+}
+
+// installedVersions returns all the installed versions of the given project.
+func (p *projectIndex) installedVersions(owner, project string) []string {
+	prefix := newKey(owner, project) + "/"
+	p.installedMut.Lock()
+	defer p.installedMut.Unlock()
+	var versions []string
+	for key := range p.installed {
+		if strings.HasPrefix(key, prefix) {
+			versions = append(versions, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// minVersion returns the minimum version of the given project, either the
+// one set at runtime or the one in the config. Projects that are not
+// configured, such as the ones of the default owner, have none.
 func (p *projectIndex) minVersion(owner, project string) *semver.Version {
+	key := newKey(owner, project)
+	p.minVersionsMut.Lock()
+	defer p.minVersionsMut.Unlock()
+	if v, ok := p.minVersionOverrides[key]; ok {
+		return v
+	}
+
+	if v, ok := p.minVersions[key]; ok {
+		return v
+	}
+	return new(semver.Version)
+}
+
+// setMinVersion overrides the minimum version of the given project in the
+// config. If v is nil, the one in the config is used again.
+func (p *projectIndex) setMinVersion(owner, project string, v *semver.Version) {
+	key := newKey(owner, project)
+	p.minVersionsMut.Lock()
+	defer p.minVersionsMut.Unlock()
+	if v == nil {
+		delete(p.minVersionOverrides, key)
+		return
+	}
+	p.minVersionOverrides[key] = v
+}
+
+// minVersionOverridesList returns the minimum versions of the projects set
+// at runtime, sorted by project.
+func (p *projectIndex) minVersionOverridesList() []*minVersionOverride {
+	p.minVersionsMut.Lock()
+	defer p.minVersionsMut.Unlock()
+
+	result := make([]*minVersionOverride, 0, len(p.minVersionOverrides))
+	for key, v := range p.minVersionOverrides {
+		parts := splitKey(key)
+		result = append(result, &minVersionOverride{
+			Owner:   parts[0],
+			Project: parts[1],
+			Version: v.Original(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return newKey(result[i].Owner, result[i].Project) < newKey(result[j].Owner, result[j].Project)
+	})
+	return result
+}
+
+// hasMinVersionOverride reports whether the minimum version of the given
+// project was set at runtime.
+func (p *projectIndex) hasMinVersionOverride(owner, project string) bool {
+	p.minVersionsMut.Lock()
+	defer p.minVersionsMut.Unlock()
+	_, ok := p.minVersionOverrides[newKey(owner, project)]
+	return ok
+}
+
+// prune removes from the index the releases of the given project that the
+// given function reports as older than the minimum version, including their
+// installations. Returns the removed versions.
+func (p *projectIndex) prune(owner, project string, older func(version string) bool) []string {
+	key := newKey(owner, project)
+	var pruned []string
+	p.projectsMut.Lock()
+	if releases, ok := p.projects[key]; ok {
+		kept := make([]*release, 0, len(releases))
+		for _, r := range releases {
+			if older(r.tag) {
+				pruned = append(pruned, r.tag)
+				continue
+			}
+			kept = append(kept, r)
+		}
+		p.projects[key] = kept
+	}
+	p.projectsMut.Unlock()
+
+	for _, version := range pruned {
+		p.releases.remove(newKey(owner, project, version))
+	}
+
+	prefix := key + "/"
+	p.installedMut.Lock()
+	defer p.installedMut.Unlock()
+	for k := range p.installed {
+		version := strings.TrimPrefix(k, prefix)
+		if version == k {
+			continue
+		}
+
+		if older(version) {
+			delete(p.installed, k)
+		}
+	}
+
+	return pruned
+}
+
+func (p *projectIndex) maxVersion(owner, project string) *maxVersion {
 	p.minVersionsMut.Lock()
 	defer p.minVersionsMut.Unlock()
-	return p.minVersions[newKey(owner, project)]
+	return p.maxVersions[newKey(owner, project)]
+}
+
+// releaseShards is a map from keys to releases split in several shards, each
+// one with its own lock, so concurrent lookups of different projects do not
+// contend with each other.
+type releaseShards struct {
+	shards []*releaseShard
+}
+
+type releaseShard struct {
+	mut      sync.RWMutex
+	releases map[string]*release
+}
+
+func newReleaseShards(n int) *releaseShards {
+	if n <= 0 {
+		n = defaultIndexShards
+	}
+
+	shards := make([]*releaseShard, n)
+	for i := range shards {
+		shards[i] = &releaseShard{releases: make(map[string]*release)}
+	}
+	return &releaseShards{shards}
+}
+
+func (r *releaseShards) shard(key string) *releaseShard {
+	if len(r.shards) == 1 {
+		return r.shards[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return r.shards[h.Sum32()%uint32(len(r.shards))]
+}
+
+func (r *releaseShards) get(key string) *release {
+	s := r.shard(key)
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.releases[key]
+}
+
+func (r *releaseShards) set(key string, rel *release) {
+	s := r.shard(key)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.releases[key] = rel
+}
+
+// removePrefix removes all the releases whose key starts with the given
+// prefix.
+func (r *releaseShards) removePrefix(prefix string) {
+	for _, s := range r.shards {
+		s.mut.Lock()
+		for key := range s.releases {
+			if strings.HasPrefix(key, prefix) {
+				delete(s.releases, key)
+			}
+		}
+		s.mut.Unlock()
+	}
+}
+
+func (r *releaseShards) remove(key string) {
+	s := r.shard(key)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.releases, key)
 }
 
 // newKey creates a new key for using in the index from the given set of
@@ -0,0 +1,91 @@
+package docsrv
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+// landingProject is a project listed in the landing page.
+type landingProject struct {
+	Host       string
+	Repository string
+	// Latest is the latest version of the project in the host, if known.
+	Latest string
+	URL    string
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Documentation</title>
+</head>
+<body>
+<h1>Documentation</h1>
+<ul>
+{{range .}}<li><a href="{{.URL}}">{{.Repository}}</a>{{if .Latest}} {{.Latest}}{{end}} <small>({{.Host}})</small></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// isLandingPath reports whether or not the given path is the root of the
+// landing host. The bundled Caddy configuration rewrites / to /latest/.
+func isLandingPath(path string) bool {
+	return path == "/" || path == "/latest/"
+}
+
+// isLandingHost reports whether or not the given host serves the landing page.
+func (s *Service) isLandingHost(host string) bool {
+	return s.opts.LandingHost != "" && stripPort(host) == s.opts.LandingHost
+}
+
+// landingPage is an HTTP handler that will output a page listing all the
+// projects configured in every host with their latest version. The projects
+// that require authentication are not listed. The projects that are not
+// indexed yet are listed without their latest version and indexed in the
+// background, so the page never waits for the GitHub API.
+func (s *Service) landingPage(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	var hosts []string
+	for host, projectConf := range conf {
+		if projectConf.Auth == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	projects := make([]landingProject, 0, len(hosts))
+	for _, host := range hosts {
+		owner, project, ok := conf.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		scheme := reqScheme(r)
+		if conf[host].ForceHTTPS {
+			scheme = "https"
+		}
+
+		p := landingProject{
+			Host:       host,
+			Repository: repositoryKey(owner, project),
+			URL:        scheme + "://" + host + "/",
+		}
+
+		if !s.index.isIndexed(owner, project) {
+			go s.refreshProject(newKey(owner, project))
+		} else if latest, ok := s.latestForHost(host, owner, project); ok {
+			p.Latest = latest
+			p.URL += latest + "/"
+		}
+
+		projects = append(projects, p)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, projects); err != nil {
+		requestLog(r).Errorf("error rendering landing page: %s", err)
+	}
+}
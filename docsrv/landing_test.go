@@ -0,0 +1,53 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLandingPage(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.add("bar", "baz", "v2.0.0", "")
+	fetcher.add("bar", "private", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":     ProjectConfig{Repository: "bar/foo"},
+		"v1.baz.bar":  ProjectConfig{Repository: "bar/baz", MaxVersion: "v1"},
+		"baz.bar":     ProjectConfig{Repository: "bar/baz", ForceHTTPS: true},
+		"private.bar": ProjectConfig{Repository: "bar/private", Auth: &AuthConfig{Provider: GitHubAuth}},
+	})
+	srv.opts.LandingHost = "docs.bar"
+
+	// the projects not indexed yet are listed right away and indexed in
+	// the background
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.bar/", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Contains(w.Body.String(), `<a href="http://foo.bar/">bar/foo</a> <small>(foo.bar)</small>`)
+
+	require.Eventually(func() bool {
+		return srv.index.isIndexed("bar", "foo") && srv.index.isIndexed("bar", "baz")
+	}, time.Second, 5*time.Millisecond)
+	require.False(srv.index.isIndexed("bar", "private"))
+
+	for _, path := range []string{"/", "/latest/"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.bar"+path, nil))
+		require.Equal(http.StatusOK, w.Code, path)
+
+		body := w.Body.String()
+		require.Contains(body, `<a href="http://foo.bar/v1.1.0/">bar/foo</a> v1.1.0`)
+		require.Contains(body, `<a href="https://baz.bar/v2.0.0/">bar/baz</a> v2.0.0`)
+		require.Contains(body, `<a href="http://v1.baz.bar/">bar/baz</a> <small>(v1.baz.bar)</small>`)
+		require.NotContains(body, "bar/private")
+	}
+
+	// the other hosts keep resolving the root as the latest version
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v1.1.0/")
+}
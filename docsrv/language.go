@@ -0,0 +1,115 @@
+package docsrv
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languageCookie is the cookie with the language chosen by the user, which
+// takes precedence over the Accept-Language header.
+const languageCookie = "docsrv_lang"
+
+// languagesForHost returns the languages of the docs of the project in the
+// given host, if its docs are localized.
+func (s *Service) languagesForHost(host string) []string {
+	return s.forHost(host).Languages
+}
+
+// preferredLanguage returns which one of the given languages the user prefers
+// according to the language cookie and the Accept-Language header of the
+// request. Defaults to the first one.
+func preferredLanguage(r *http.Request, languages []string) string {
+	if c, err := r.Cookie(languageCookie); err == nil {
+		if lang, ok := matchLanguage(c.Value, languages); ok {
+			return lang
+		}
+	}
+
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if lang, ok := matchLanguage(tag, languages); ok {
+			return lang
+		}
+	}
+
+	return languages[0]
+}
+
+// matchLanguage returns which one of the given languages matches the given
+// language tag. The tag itself, e.g. "pt-BR", is preferred over its primary
+// language, e.g. "pt", and this one over any other variant of it, e.g.
+// "pt-PT".
+func matchLanguage(tag string, languages []string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", false
+	}
+
+	primary := primaryLanguage(tag)
+	var primaryMatch, variantMatch string
+	for _, lang := range languages {
+		l := strings.ToLower(lang)
+		switch {
+		case l == tag:
+			return lang, true
+		case l == primary && primaryMatch == "":
+			primaryMatch = lang
+		case primaryLanguage(l) == primary && variantMatch == "":
+			variantMatch = lang
+		}
+	}
+
+	if primaryMatch != "" {
+		return primaryMatch, true
+	}
+	return variantMatch, variantMatch != ""
+}
+
+func primaryLanguage(tag string) string {
+	return strings.SplitN(tag, "-", 2)[0]
+}
+
+// acceptedLanguages returns the language tags of the given Accept-Language
+// header sorted by their quality, from the most to the least preferred. The
+// tags with quality 0 and the wildcard are ignored.
+func acceptedLanguages(header string) []string {
+	type accepted struct {
+		tag     string
+		quality float64
+	}
+
+	var langs []accepted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			langs = append(langs, accepted{tag, quality})
+		}
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].quality > langs[j].quality
+	})
+
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
@@ -0,0 +1,77 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	require.Equal(t,
+		[]string{"es-ES", "en", "fr"},
+		acceptedLanguages("fr;q=0.5, es-ES, de;q=0, en;q=0.8, *;q=0.1"),
+	)
+	require.Empty(t, acceptedLanguages(""))
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	languages := []string{"en", "es", "pt-BR"}
+	cases := []struct {
+		accept   string
+		cookie   string
+		expected string
+	}{
+		{"", "", "en"},
+		{"es-ES,es;q=0.9,en;q=0.8", "", "es"},
+		{"pt-br", "", "pt-BR"},
+		{"pt-PT, en;q=0.5", "", "pt-BR"},
+		{"de, fr;q=0.8", "", "en"},
+		{"es", "pt-BR", "pt-BR"},
+		{"es", "de", "es"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://foo.bar/", nil)
+		r.Header.Set("Accept-Language", c.accept)
+		if c.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: languageCookie, Value: c.cookie})
+		}
+		require.Equal(t, c.expected, preferredLanguage(r, languages), c.accept)
+	}
+}
+
+func TestRedirectToLatest_Languages(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("org", "proj", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"proj.foo.bar":  ProjectConfig{Repository: "org/proj", Languages: []string{"en", "es"}},
+		"proj2.foo.bar": ProjectConfig{Repository: "org/proj"},
+	})
+
+	cases := []struct {
+		url      string
+		accept   string
+		expected string
+	}{
+		{"http://proj.foo.bar/", "es-ES", "http://proj.foo.bar/v1.0.0/es/"},
+		{"http://proj.foo.bar/latest/", "fr", "http://proj.foo.bar/v1.0.0/en/"},
+		{"http://proj.foo.bar/latest/es/foo", "en", "http://proj.foo.bar/v1.0.0/es/foo"},
+		{"http://proj2.foo.bar/latest/", "es", "http://proj2.foo.bar/v1.0.0/"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Accept-Language", c.accept)
+		srv.ServeHTTP(w, r)
+		require.Equal(http.StatusTemporaryRedirect, w.Code, c.url)
+		require.Equal(c.expected, w.Header().Get("Location"), c.url)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://proj.foo.bar/", nil))
+	require.Equal("Accept-Language, Cookie", w.Header().Get("Vary"))
+}
@@ -0,0 +1,103 @@
+package docsrv
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultLatestCacheTTL is the default time the latest version of a host is
+// cached.
+const defaultLatestCacheTTL = 1 * time.Minute
+
+// latestEntry is the cached latest version of the project of a host.
+type latestEntry struct {
+	owner   string
+	project string
+	tag     string
+	expires time.Time
+}
+
+// isExpired reports whether the entry must be resolved again.
+func (e latestEntry) isExpired() bool {
+	return time.Now().After(e.expires)
+}
+
+// latestCache caches the latest version of the project of every host, so
+// it's not resolved from all its releases on every request to /latest/.
+// Entries expire after the TTL and are invalidated once the project is
+// indexed again.
+type latestCache struct {
+	mut     sync.RWMutex
+	ttl     time.Duration
+	entries map[string]latestEntry
+}
+
+// newLatestCache creates a new cache whose entries expire after the given
+// TTL. A negative TTL disables the cache.
+func newLatestCache(ttl time.Duration) *latestCache {
+	return &latestCache{ttl: ttl, entries: make(map[string]latestEntry)}
+}
+
+// get returns the cached latest version of the given host, if it has not
+// expired yet.
+func (c *latestCache) get(host string) (string, bool) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	entry, ok := c.entries[stripPort(host)]
+	if !ok || entry.isExpired() {
+		return "", false
+	}
+	return entry.tag, true
+}
+
+// set caches the latest version of the project of the given host.
+func (c *latestCache) set(host, owner, project, tag string) {
+	if c.ttl < 0 {
+		return
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.entries[stripPort(host)] = latestEntry{
+		owner:   owner,
+		project: project,
+		tag:     tag,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate removes the cached latest version of all the hosts serving the
+// given project.
+func (c *latestCache) invalidate(owner, project string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for host, entry := range c.entries {
+		if entry.owner == owner && entry.project == project {
+			delete(c.entries, host)
+		}
+	}
+}
+
+// clear removes all the cached versions.
+func (c *latestCache) clear() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.entries = make(map[string]latestEntry)
+}
+
+// latestForHost returns the latest release of the given project in the given
+// host, using the cached one if it has not expired.
+func (s *Service) latestForHost(host, owner, project string) (string, bool) {
+	if tag, ok := s.latest.get(host); ok {
+		return tag, true
+	}
+
+	latest := latestRelease(s.releasesForHost(host, owner, project))
+	if latest == nil {
+		return "", false
+	}
+
+	s.latest.set(host, owner, project, latest.tag)
+	return latest.tag, true
+}
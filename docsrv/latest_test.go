@@ -0,0 +1,91 @@
+package docsrv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestCache(t *testing.T) {
+	require := require.New(t)
+	cache := newLatestCache(time.Minute)
+
+	_, ok := cache.get("foo.bar")
+	require.False(ok)
+
+	cache.set("foo.bar:8080", "org", "proj1", "v1.0.0")
+	cache.set("baz.bar", "org", "proj2", "v2.0.0")
+
+	tag, ok := cache.get("foo.bar")
+	require.True(ok)
+	require.Equal("v1.0.0", tag)
+
+	cache.invalidate("org", "proj1")
+	_, ok = cache.get("foo.bar")
+	require.False(ok)
+
+	tag, ok = cache.get("baz.bar")
+	require.True(ok)
+	require.Equal("v2.0.0", tag)
+
+	cache.clear()
+	_, ok = cache.get("baz.bar")
+	require.False(ok)
+}
+
+func TestLatestCache_Expired(t *testing.T) {
+	require := require.New(t)
+	cache := newLatestCache(time.Minute)
+	cache.entries["foo.bar"] = latestEntry{
+		owner:   "org",
+		project: "proj1",
+		tag:     "v1.0.0",
+		expires: time.Now().Add(-time.Second),
+	}
+
+	_, ok := cache.get("foo.bar")
+	require.False(ok)
+}
+
+func TestLatestCache_Disabled(t *testing.T) {
+	cache := newLatestCache(-1)
+	cache.set("foo.bar", "org", "proj1", "v1.0.0")
+
+	_, ok := cache.get("foo.bar")
+	require.False(t, ok)
+}
+
+func TestRedirectToLatest_Cached(t *testing.T) {
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"proj1.foo.bar": ProjectConfig{Repository: "org/proj1"},
+	})
+	fetcher.add("org", "proj1", "v1.0.0", "foo")
+	require.NoError(t, srv.indexProject("org", "proj1"))
+
+	assertRedirect(t, srv, "http://proj1.foo.bar/latest/", "http://proj1.foo.bar/v1.0.0/")
+
+	// the index changes without the project being indexed again, so the
+	// cached version is still served.
+	srv.index.set("org", "proj1", []*release{
+		{tag: "v1.0.0"},
+		{tag: "v1.1.0"},
+	})
+	assertRedirect(t, srv, "http://proj1.foo.bar/latest/", "http://proj1.foo.bar/v1.0.0/")
+
+	// indexing the project again discards the cached version.
+	fetcher.add("org", "proj1", "v1.1.0", "foo")
+	require.NoError(t, srv.indexProject("org", "proj1"))
+	assertRedirect(t, srv, "http://proj1.foo.bar/latest/", "http://proj1.foo.bar/v1.1.0/")
+
+	// and so does reloading the config.
+	fetcher.add("org", "proj1", "v1.2.0", "foo")
+	srv.index.set("org", "proj1", []*release{
+		{tag: "v1.0.0"},
+		{tag: "v1.1.0"},
+		{tag: "v1.2.0"},
+	})
+	srv.ReloadConfig(srv.config())
+	assertRedirect(t, srv, "http://proj1.foo.bar/latest/", "http://proj1.foo.bar/v1.2.0/")
+}
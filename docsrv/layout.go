@@ -0,0 +1,265 @@
+package docsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The docs of every project version are installed in
+// ${BaseFolder}/${OWNER}/${PROJECT}/${VERSION}, or the folder given by the
+// layout in the options, and every host is a symlink in ${BaseFolder}/${HOST}
+// to the folder of its project, so the webserver can serve them by host, the
+// hosts of the same project share the same docs and renaming a host does not
+// require building the docs again.
+
+const (
+	// defaultLayout is the default template of the folders where the
+	// versions are installed.
+	defaultLayout = "{owner}/{project}/{version}"
+	// layoutVersionSuffix is the end of every layout, since the versions
+	// of a project are served from the same folder.
+	layoutVersionSuffix = "/{version}"
+)
+
+// layoutPlaceholders are the placeholders that can be used in a layout.
+var layoutPlaceholders = regexp.MustCompile(`\{[^}]*\}`)
+
+// ValidateLayout checks that the given template of the folders where the
+// versions are installed is relative to the base folder, contains the
+// {project} placeholder and ends with "/{version}".
+func ValidateLayout(layout string) error {
+	if !strings.HasSuffix(layout, layoutVersionSuffix) {
+		return fmt.Errorf("invalid layout %q: it must end with %s", layout, layoutVersionSuffix)
+	}
+
+	if filepath.IsAbs(layout) || strings.Contains(layout, "..") || strings.Contains(layout, "//") {
+		return fmt.Errorf("invalid layout %q: it must be a path relative to the base folder", layout)
+	}
+
+	for _, p := range layoutPlaceholders.FindAllString(layout, -1) {
+		if p != "{owner}" && p != "{project}" && p != "{version}" {
+			return fmt.Errorf("invalid layout %q: unknown placeholder %s", layout, p)
+		}
+	}
+
+	if !strings.Contains(layout, "{project}") {
+		return fmt.Errorf("invalid layout %q: it must contain {project}", layout)
+	}
+	return nil
+}
+
+// hostFolder returns the folder of the given host, which is a symlink to the
+// folder of its project.
+func (s *Service) hostFolder(host string) string {
+	return filepath.Join(s.opts.BaseFolder, stripPort(host))
+}
+
+// hostLinkTarget returns the target of the symlink of the given host to the
+// folder of the given project, relative to the folder that contains it.
+func (s *Service) hostLinkTarget(host, owner, project string) string {
+	target, err := filepath.Rel(filepath.Dir(s.hostFolder(host)), s.projectFolder(owner, project))
+	if err != nil {
+		return filepath.Join(owner, project)
+	}
+	return target
+}
+
+// projectFolder returns the folder where the versions of the given project are
+// installed.
+func (s *Service) projectFolder(owner, project string) string {
+	return s.layoutFolder(s.opts.Layout, owner, project)
+}
+
+// layoutFolder returns the folder where the versions of the given project are
+// installed with the given layout.
+func (s *Service) layoutFolder(layout, owner, project string) string {
+	folder := strings.NewReplacer(
+		"{owner}", owner,
+		"{project}", project,
+	).Replace(strings.TrimSuffix(layout, layoutVersionSuffix))
+	return filepath.Join(s.opts.BaseFolder, filepath.FromSlash(folder))
+}
+
+// versionFolder returns the folder where the given version of a project is
+// installed.
+func (s *Service) versionFolder(owner, project, version string) string {
+	return filepath.Join(s.projectFolder(owner, project), version)
+}
+
+// linkHost makes the folder of the given host a symlink to the folder of the
+// given project. If the host folder is a regular folder created with the
+// previous layout, the versions in it are moved to the project folder first.
+func (s *Service) linkHost(host, owner, project string) error {
+	hostFolder := s.hostFolder(host)
+	target := s.hostLinkTarget(host, owner, project)
+
+	if err := os.MkdirAll(s.projectFolder(owner, project), 0740); err != nil {
+		return wrap(err, "error creating project folder")
+	}
+
+	// the folders of the projects served under a path prefix are inside
+	// the one of their host.
+	if err := os.MkdirAll(filepath.Dir(hostFolder), 0755); err != nil {
+		return wrap(err, "error creating host folder")
+	}
+
+	fi, err := os.Lstat(hostFolder)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return wrap(err, "error reading host folder %s", hostFolder)
+	case fi.Mode()&os.ModeSymlink != 0:
+		current, err := os.Readlink(hostFolder)
+		if err != nil {
+			return wrap(err, "error reading host symlink %s", hostFolder)
+		}
+
+		if current == target {
+			return nil
+		}
+
+		if err := os.Remove(hostFolder); err != nil {
+			return wrap(err, "error removing host symlink %s", hostFolder)
+		}
+	case fi.IsDir():
+		if err := s.migrateHostFolder(hostFolder, owner, project); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("host folder %s is not a folder nor a symlink", hostFolder)
+	}
+
+	if err := os.Symlink(target, hostFolder); err != nil {
+		return wrap(err, "error creating host symlink %s", hostFolder)
+	}
+	return nil
+}
+
+// migrateHostFolder moves the versions installed in the given host folder
+// with the previous layout to the folder of the given project and removes
+// the host folder.
+func (s *Service) migrateHostFolder(hostFolder, owner, project string) error {
+	log := logrus.WithFields(logrus.Fields{
+		"project": project,
+		"owner":   owner,
+		"host":    filepath.Base(hostFolder),
+	})
+
+	entries, err := ioutil.ReadDir(hostFolder)
+	if err != nil {
+		return wrap(err, "error reading host folder %s", hostFolder)
+	}
+
+	for _, e := range entries {
+		src := filepath.Join(hostFolder, e.Name())
+		// hidden entries are leftovers of interrupted rebuilds
+		if strings.HasPrefix(e.Name(), ".") {
+			os.RemoveAll(src)
+			continue
+		}
+
+		dst := s.versionFolder(owner, project, e.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			log.Warnf("%s is already installed in the project folder, discarding the one in the host folder", e.Name())
+			os.RemoveAll(src)
+			continue
+		}
+
+		if err := os.Rename(src, dst); err != nil {
+			return wrap(err, "error moving %s to the project folder", src)
+		}
+		log.Debugf("moved %s to the project folder", e.Name())
+	}
+
+	if err := os.Remove(hostFolder); err != nil {
+		return wrap(err, "error removing host folder %s", hostFolder)
+	}
+	return nil
+}
+
+// LinkHosts makes the folders of all the configured hosts and their aliases
+// symlinks to the folders of their projects, moving the docs installed with
+// the previous layout if needed, so the webserver can serve them before any
+// request reaches docsrv. The state manifest is written afterwards.
+func (s *Service) LinkHosts() {
+	config := s.config()
+	s.migrateLayout(config)
+	for _, host := range config.servedHosts() {
+		owner, project, ok := config.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		if err := s.linkHost(host, owner, project); err != nil {
+			logrus.WithField("host", host).Errorf("error linking host folder: %s", err)
+		}
+	}
+
+	s.writeState()
+}
+
+// migrateLayout moves the folders of the projects of the given config to the
+// current layout if the state manifest was written with a different one, so
+// the versions installed before the layout changed are not built again.
+func (s *Service) migrateLayout(config Config) {
+	previous, ok := s.stateLayout()
+	if !ok || previous == s.opts.Layout {
+		return
+	}
+
+	log := logrus.WithFields(logrus.Fields{"from": previous, "to": s.opts.Layout})
+	log.Info("layout changed, moving the installed docs")
+	for host := range config {
+		owner, project, ok := config.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		src := s.layoutFolder(previous, owner, project)
+		dst := s.projectFolder(owner, project)
+		if !isDir(src) || !isEmptyOrMissing(dst) {
+			continue
+		}
+
+		if err := moveFolder(src, dst); err != nil {
+			log.WithFields(logrus.Fields{"project": project, "owner": owner}).
+				Errorf("error moving docs to the new layout: %s", err)
+		}
+	}
+}
+
+// stateLayout returns the layout of the state manifest in the base folder,
+// if there is one.
+func (s *Service) stateLayout() (string, bool) {
+	manifest, err := s.readStateFile()
+	if err != nil {
+		return "", false
+	}
+
+	// the manifests written before the layout was configurable don't have
+	// it.
+	if manifest.Layout == "" {
+		return defaultLayout, true
+	}
+	return manifest.Layout, true
+}
+
+// moveFolder moves the given folder to the given path, replacing it if it's
+// an empty folder.
+func moveFolder(src, dst string) error {
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0740); err != nil {
+		return err
+	}
+
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,166 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkHost(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	srv := newTestSrv(newMockFetcher(), nil)
+	srv.opts.BaseFolder = tmpDir
+
+	require.NoError(srv.linkHost("foo.bar:9091", "bar", "foo"))
+	target, err := os.Readlink(filepath.Join(tmpDir, "foo.bar"))
+	require.NoError(err)
+	require.Equal(filepath.Join("bar", "foo"), target)
+
+	// linking again is a noop
+	require.NoError(srv.linkHost("foo.bar", "bar", "foo"))
+
+	// hosts can be moved to another project
+	require.NoError(srv.linkHost("foo.bar", "bar", "baz"))
+	target, err = os.Readlink(filepath.Join(tmpDir, "foo.bar"))
+	require.NoError(err)
+	require.Equal(filepath.Join("bar", "baz"), target)
+}
+
+func TestLinkHost_Migrate(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"foo.bar/v1.0.0/index.html":   "old v1.0.0",
+		"foo.bar/v1.1.0/index.html":   "old v1.1.0",
+		"foo.bar/.v1.1.0-123/foo":     "leftover",
+		"bar/foo/v1.1.0/index.html":   "new v1.1.0",
+		"baz.bar/v1.0.0/index.html":   "other",
+		"errors/404/index.html":       "not found",
+		"bar/foo/v1.2.0/index.html":   "new v1.2.0",
+		"bar/foo/v1.2.0/css/app.css":  "body{}",
+		"other.bar/v2.0.0/index.html": "unconfigured",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, filepath.FromSlash(name))
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	srv := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+		"baz.bar": ProjectConfig{Repository: "bar/baz"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.LinkHosts()
+
+	expected := map[string]string{
+		"foo.bar/v1.0.0/index.html":   "old v1.0.0",
+		"foo.bar/v1.1.0/index.html":   "new v1.1.0",
+		"foo.bar/v1.2.0/index.html":   "new v1.2.0",
+		"bar/foo/v1.0.0/index.html":   "old v1.0.0",
+		"baz.bar/v1.0.0/index.html":   "other",
+		"bar/baz/v1.0.0/index.html":   "other",
+		"other.bar/v2.0.0/index.html": "unconfigured",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, filepath.FromSlash(name)))
+		require.NoError(err, name)
+		require.Equal(content, string(data), name)
+	}
+
+	_, err = os.Stat(filepath.Join(tmpDir, "bar", "foo", ".v1.1.0-123"))
+	require.True(os.IsNotExist(err))
+}
+
+func TestValidateLayout(t *testing.T) {
+	require := require.New(t)
+	require.NoError(ValidateLayout(defaultLayout))
+	require.NoError(ValidateLayout("projects/{owner}-{project}/{version}"))
+	require.NoError(ValidateLayout("{project}/{version}"))
+
+	for _, layout := range []string{
+		"{owner}/{project}",
+		"{owner}/{version}",
+		"/srv/{owner}/{project}/{version}",
+		"../{owner}/{project}/{version}",
+		"{owner}//{project}/{version}",
+		"{host}/{project}/{version}",
+	} {
+		require.Error(ValidateLayout(layout), layout)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":  ProjectConfig{Repository: "bar/foo"},
+		"foo2.bar": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.Layout = "projects/{owner}-{project}/{version}"
+
+	folder := filepath.Join(tmpDir, "projects", "bar-foo")
+	require.Equal(folder, srv.projectFolder("bar", "foo"))
+	require.Equal(filepath.Join(folder, "v1.0.0"), srv.versionFolder("bar", "foo", "v1.0.0"))
+
+	srv.LinkHosts()
+	for _, host := range []string{"foo.bar", "foo2.bar"} {
+		target, err := os.Readlink(filepath.Join(tmpDir, host))
+		require.NoError(err)
+		require.Equal(filepath.Join("projects", "bar-foo"), target)
+	}
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	assertMakefileOutput(t, filepath.Join(folder, "v1.0.0"), "http://foo.bar/v1.0.0/", "foo", "bar", "v1.0.0")
+	require.Equal(srv.opts.Layout, srv.stateManifest(srv.config()).Layout)
+}
+
+func TestLinkHosts_MigrateLayout(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "bar", "foo", "v1.0.0", "index.html")
+	require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(ioutil.WriteFile(path, []byte("foo"), 0644))
+
+	srv := newTestSrv(newMockFetcher(), Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.LinkHosts()
+
+	srv.opts.Layout = "projects/{project}/{version}"
+	srv.LinkHosts()
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "projects", "foo", "v1.0.0", "index.html"))
+	require.NoError(err)
+	require.Equal("foo", string(data))
+	require.False(isDir(filepath.Join(tmpDir, "bar", "foo")))
+
+	data, err = ioutil.ReadFile(filepath.Join(tmpDir, "foo.bar", "v1.0.0", "index.html"))
+	require.NoError(err)
+	require.Equal("foo", string(data))
+}
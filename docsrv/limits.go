@@ -0,0 +1,74 @@
+package docsrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultRequestTimeout is the default maximum time to serve a request
+	// that never builds a version.
+	defaultRequestTimeout = 10 * time.Second
+	// defaultBuildRequestTimeout is the default maximum time to serve a
+	// request that may build a version.
+	defaultBuildRequestTimeout = 5 * time.Minute
+	// defaultMaxBodySize is the default maximum size of the body of a
+	// request, enough for the payloads of the GitHub webhooks.
+	defaultMaxBodySize = 5 << 20
+	// writeDeadlineGrace is the time given to write the response after the
+	// timeout of its request, so a timeout can still be reported.
+	writeDeadlineGrace = 5 * time.Second
+)
+
+// requestTimeoutMessage is the body of the responses to the requests that
+// time out.
+const requestTimeoutMessage = "the request took too long to be served, try again later"
+
+// isQuickPath reports whether the given path is served without building any
+// version, so its requests are expected to be served quickly.
+func isQuickPath(path string) bool {
+	switch path {
+	case "/versions.json", versionsV2Path, "/search.json", "/project.json", changelogPath,
+		robotsPath, statsPath, quarantinePath, minVersionPath, validateConfigPath, openAPIPath,
+		maintenancePath:
+		return true
+	}
+	return isVersionStatusPath(path) || isReleaseNotesPath(path) || isBadgePath(path)
+}
+
+// serveWithLimits serves the given request with the given handler within the
+// limits of its route, so slow clients or a slow GitHub can't pile up
+// requests until the whole server degrades. The body of every request is
+// limited to MaxBodySize. The requests served quickly get a 503 status once
+// they take longer than RequestTimeout, and the rest, which may wait for a
+// version to be built, are cancelled after BuildRequestTimeout. Either way,
+// the connection is closed if the response can not be written in time.
+func (s *Service) serveWithLimits(w http.ResponseWriter, r *http.Request, h http.HandlerFunc) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize)
+	}
+
+	if isQuickPath(r.URL.Path) {
+		setWriteDeadline(w, s.opts.RequestTimeout+writeDeadlineGrace)
+		http.TimeoutHandler(h, s.opts.RequestTimeout, requestTimeoutMessage).ServeHTTP(w, r)
+		return
+	}
+
+	setWriteDeadline(w, s.opts.BuildRequestTimeout+writeDeadlineGrace)
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.BuildRequestTimeout)
+	defer cancel()
+	h(w, r.WithContext(ctx))
+}
+
+// setWriteDeadline sets the deadline to write the response of the given
+// writer, if its connection supports it.
+func setWriteDeadline(w http.ResponseWriter, timeout time.Duration) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logrus.Debugf("could not set write deadline: %s", err)
+	}
+}
@@ -0,0 +1,56 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeWithLimits_Timeout(t *testing.T) {
+	require := require.New(t)
+	fetcher := &slowFetcher{mockFetcher: newMockFetcher(), release: make(chan struct{})}
+	fetcher.add("bar", "slow", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{"slow.bar": ProjectConfig{Repository: "bar/slow"}})
+	srv.opts.RequestTimeout = 50 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://slow.bar/versions.json", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Equal(requestTimeoutMessage, w.Body.String())
+
+	close(fetcher.release)
+	require.Eventually(func() bool {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://slow.bar/versions.json", nil))
+		return w.Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServeWithLimits_BuildTimeout(t *testing.T) {
+	require := require.New(t)
+	srv := newTestSrv(newMockFetcher(), Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BuildRequestTimeout = time.Minute
+
+	var deadline time.Time
+	srv.serveWithLimits(httptest.NewRecorder(), httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil),
+		func(w http.ResponseWriter, r *http.Request) {
+			deadline, _ = r.Context().Deadline()
+		})
+	require.WithinDuration(time.Now().Add(time.Minute), deadline, 5*time.Second)
+}
+
+func TestServeWithLimits_MaxBodySize(t *testing.T) {
+	require := require.New(t)
+	srv := newTestSrv(newMockFetcher(), Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.RefreshToken = "admin"
+	srv.opts.MaxBodySize = 16
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`["foo.bar"]` + "\n" + `repository = "bar/foo"`)
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/config/validate?token=admin", body))
+	require.Equal(http.StatusRequestEntityTooLarge, w.Code)
+}
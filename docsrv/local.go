@@ -0,0 +1,154 @@
+package docsrv
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReleaseInfo is the information about a release of a project listed by
+// Releases.
+type ReleaseInfo struct {
+	Project     string     `json:"project"`
+	Version     string     `json:"version"`
+	SHA         string     `json:"sha,omitempty"`
+	URL         string     `json:"url"`
+	Prerelease  bool       `json:"prerelease"`
+	Branch      bool       `json:"branch,omitempty"`
+	Installed   bool       `json:"installed"`
+	PublishedAt *time.Time `json:"published-at,omitempty"`
+}
+
+// Releases indexes the given projects, or all the configured ones if none is
+// given, and returns their releases and configured branches. Projects are
+// given in the form of ${owner}/${project}.
+func (s *Service) Releases(projects ...string) ([]ReleaseInfo, error) {
+	if len(projects) == 0 {
+		projects = s.configuredProjects()
+	}
+
+	var result []ReleaseInfo
+	for _, p := range projects {
+		owner, project, ok := splitRepository(p)
+		if !ok {
+			return nil, fmt.Errorf("invalid project %q, expected owner/project", p)
+		}
+
+		if _, ok := s.config().ForProject(owner, project); !ok {
+			return nil, wrap(ErrNotFound, "project %s is not configured", p)
+		}
+
+		if err := s.indexProject(owner, project); err != nil {
+			return nil, wrap(err, "error indexing %s", p)
+		}
+
+		for _, r := range s.index.forProject(owner, project) {
+			result = append(result, s.releaseInfo(owner, project, r, false))
+		}
+
+		for _, r := range s.index.branchesForProject(owner, project) {
+			result = append(result, s.releaseInfo(owner, project, r, true))
+		}
+	}
+
+	return result, nil
+}
+
+func (s *Service) releaseInfo(owner, project string, r *release, branch bool) ReleaseInfo {
+	return ReleaseInfo{
+		Project:     newKey(owner, project),
+		Version:     r.tag,
+		SHA:         r.sha,
+		URL:         r.url,
+		Prerelease:  r.prerelease,
+		Branch:      branch,
+		Installed:   s.index.isInstalled(owner, project, r.tag),
+		PublishedAt: releasedAt(r),
+	}
+}
+
+// configuredProjects returns the projects served in any host, in the form of
+// ${owner}/${project}, sorted by name.
+func (s *Service) configuredProjects() []string {
+	conf := s.config()
+	seen := make(map[string]bool)
+	var projects []string
+	for host := range conf {
+		owner, project, ok := conf.ProjectForHost(host)
+		if !ok || seen[newKey(owner, project)] {
+			continue
+		}
+
+		seen[newKey(owner, project)] = true
+		projects = append(projects, newKey(owner, project))
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// BuildVersion builds the docs of the given version of a project into the
+// given folder with the given base URL, outside of the server and without
+// installing them. The version can be a release or a branch, and the project
+// does not need to be configured, although its config is used if it is.
+func (s *Service) BuildVersion(owner, project, version, baseURL, destination string) error {
+	r, err := http.NewRequest("GET", baseURL, nil)
+	if err != nil {
+		return wrap(err, "invalid base URL %q", baseURL)
+	}
+
+	release, err := s.findRelease(owner, project, version)
+	if err != nil {
+		return err
+	}
+
+	destination, err = filepath.Abs(destination)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return wrap(err, "error creating %q", destination)
+	}
+
+	conf := s.newBuildConfig(r, owner, project, release)
+	conf.baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+	conf.destination = destination
+	return buildDocs(conf)
+}
+
+// findRelease returns the release or branch of the given project with the
+// given name. Configured projects are looked up in the index, so their
+// version restrictions apply.
+func (s *Service) findRelease(owner, project, version string) (*release, error) {
+	if _, ok := s.config().ForProject(owner, project); ok {
+		if err := s.ensureIndexed("", owner, project); err != nil {
+			return nil, err
+		}
+
+		if r := s.index.get(owner, project, version); r != nil {
+			return r, nil
+		}
+		return nil, wrap(ErrNotFound, "%s has no version %s", newKey(owner, project), version)
+	}
+
+	releases, err := s.fetcher.releases(owner, project, newVersion("v0.0.0"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range releases {
+		if r.tag == version {
+			return r, nil
+		}
+	}
+
+	r, err := s.fetcher.branch(owner, project, version)
+	if err != nil {
+		return nil, wrap(err, "%s has no version %s", newKey(owner, project), version)
+	}
+	return r, nil
+}
@@ -0,0 +1,95 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceReleases(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", "http://foo/v1.0.0")
+	fetcher.add("org", "foo", "v1.1.0", "http://foo/v1.1.0")
+	fetcher.addPrerelease("org", "foo", "v2.0.0-beta.1", "http://foo/v2.0.0-beta.1")
+	fetcher.addBranch("org", "foo", "master", "http://foo/master", "1234")
+	fetcher.setPublishedAt("org", "foo", "v1.1.0", time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC))
+	fetcher.add("org", "bar", "v0.1.0", "http://bar/v0.1.0")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":  ProjectConfig{Repository: "org/foo", MinVersion: "v1.1.0", Prereleases: true, Branches: []string{"master"}},
+		"bar.bar":  ProjectConfig{Repository: "org/bar"},
+		"bar2.bar": ProjectConfig{Repository: "org/bar"},
+	})
+
+	releases, err := srv.Releases("org/foo")
+	require.NoError(err)
+	require.Len(releases, 3)
+	require.Equal("v1.1.0", releases[0].Version)
+	require.Equal("org/foo", releases[0].Project)
+	require.Equal("http://foo/v1.1.0", releases[0].URL)
+	require.Equal(time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC), *releases[0].PublishedAt)
+	require.Equal("v2.0.0-beta.1", releases[1].Version)
+	require.True(releases[1].Prerelease)
+	require.Nil(releases[1].PublishedAt)
+	require.Equal("master", releases[2].Version)
+	require.True(releases[2].Branch)
+	require.Equal("1234", releases[2].SHA)
+
+	releases, err = srv.Releases()
+	require.NoError(err)
+	require.Len(releases, 4)
+	require.Equal("org/bar", releases[0].Project)
+
+	_, err = srv.Releases("org/baz")
+	require.Equal(ErrNotFound, Cause(err))
+
+	_, err = srv.Releases("baz")
+	require.Error(err)
+}
+
+func TestBuildVersion(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", url)
+	fetcher.add("org", "foo", "v1.1.0", url)
+	fetcher.addBranch("org", "foo", "master", url, "1234")
+	fetcher.add("org", "bar", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "org/foo", MinVersion: "v1.1.0"},
+	})
+	srv.opts.BaseFolder = filepath.Join(tmpDir, "base")
+	srv.opts.SharedFolder = testSharedFolder
+
+	dst := filepath.Join(tmpDir, "foo")
+	require.NoError(srv.BuildVersion("org", "foo", "v1.1.0", "http://localhost:8080/v1.1.0", dst))
+	assertMakefileOutput(t, dst, "http://localhost:8080/v1.1.0/", "foo", "org", "v1.1.0")
+	require.False(srv.index.isInstalled("org", "foo", "v1.1.0"))
+	require.False(isDir(srv.opts.BaseFolder))
+
+	// the version restrictions of configured projects apply
+	err = srv.BuildVersion("org", "foo", "v1.0.0", "http://localhost/", filepath.Join(tmpDir, "old"))
+	require.Equal(ErrNotFound, Cause(err))
+
+	// projects not configured can be built, as well as their branches
+	dst = filepath.Join(tmpDir, "bar")
+	require.NoError(srv.BuildVersion("org", "bar", "v1.0.0", "http://localhost/", dst))
+	assertMakefileOutput(t, dst, "http://localhost/", "bar", "org", "v1.0.0")
+
+	fetcher.addBranch("org", "bar", "develop", url, "5678")
+	dst = filepath.Join(tmpDir, "develop")
+	require.NoError(srv.BuildVersion("org", "bar", "develop", "http://localhost/develop/", dst))
+	assertMakefileOutput(t, dst, "http://localhost/develop/", "bar", "org", "develop")
+
+	require.Error(srv.BuildVersion("org", "bar", "v9.9.9", "http://localhost/", filepath.Join(tmpDir, "missing")))
+}
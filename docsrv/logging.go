@@ -0,0 +1,102 @@
+package docsrv
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// requestIDHeader is the header with the ID of the request. If the webserver
+// in front of docsrv sets it, its value is used as the request ID.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// withRequestID returns the given request with an ID in its context, taken
+// from the X-Request-ID header if it's valid or generated otherwise.
+func withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestID returns the ID of the given request, if any.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns a logger for the given request with its ID.
+func requestLog(r *http.Request) *logrus.Entry {
+	return logrus.WithField("request_id", requestID(r))
+}
+
+// projectLog returns a logger for the given request and project.
+func projectLog(r *http.Request, owner, project string) *logrus.Entry {
+	return requestLog(r).WithFields(logrus.Fields{
+		"project": project,
+		"owner":   owner,
+	})
+}
+
+// statusRecorder is a response writer that records the status code and the
+// size of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if the underlying response
+// writer supports it.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer, so the write deadline of the
+// connection can be set through it.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequest logs the given request once it has been served.
+func logRequest(w *statusRecorder, r *http.Request, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	requestLog(r).WithFields(logrus.Fields{
+		"method":   r.Method,
+		"host":     r.Host,
+		"path":     r.URL.Path,
+		"status":   status,
+		"size":     w.size,
+		"duration": time.Since(start).Seconds(),
+	}).Info("request served")
+}
@@ -0,0 +1,65 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLog(t *testing.T) {
+	require := require.New(t)
+	hook, reset := newLogHook()
+	defer reset()
+
+	fetcher := newMockFetcher()
+	fetcher.add("src-d", "foo", "v1.0.0", "")
+	s := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "src-d/foo"},
+	})
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar/versions.json", nil)
+	require.NoError(err)
+	req.Header.Set(requestIDHeader, "abc-123")
+	s.ServeHTTP(w, req)
+	require.Equal("abc-123", w.Header().Get(requestIDHeader))
+
+	var served bool
+	for _, e := range hook.AllEntries() {
+		require.Equal("abc-123", e.Data["request_id"], e.Message)
+		if e.Message == "request served" {
+			served = true
+			require.Equal("GET", e.Data["method"])
+			require.Equal("foo.bar", e.Data["host"])
+			require.Equal("/versions.json", e.Data["path"])
+			require.Equal(http.StatusOK, e.Data["status"])
+			require.Equal(w.Body.Len(), e.Data["size"])
+		}
+	}
+	require.True(served)
+
+	// invalid IDs are replaced
+	w = httptest.NewRecorder()
+	req.Header.Set(requestIDHeader, "foo bar\n")
+	s.ServeHTTP(w, req)
+	require.Len(w.Header().Get(requestIDHeader), 16)
+}
+
+func TestBuildLog_RequestID(t *testing.T) {
+	require := require.New(t)
+	hook, reset := newLogHook()
+	defer reset()
+
+	conf := buildConfig{
+		tarballURL:   "http://127.0.0.1:0/foo.tar.gz",
+		sharedFolder: "/does/not/exist",
+		requestID:    "abc-123",
+	}
+	require.Error(buildDocs(conf))
+
+	entries := hook.AllEntries()
+	require.NotEmpty(entries)
+	require.Equal("abc-123", entries[0].Data["request_id"])
+}
@@ -0,0 +1,280 @@
+package docsrv
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// maintenancePath is the path of the API to put a host into maintenance mode
+// at runtime.
+const maintenancePath = "/api/maintenance"
+
+// maintenanceRetryAfter is the number of seconds after which the clients of a
+// host in maintenance are told to retry.
+const maintenanceRetryAfter = 300
+
+// maintenance keeps the hosts put into or out of maintenance mode at runtime,
+// which take precedence over the config, and the builds for the hosts in
+// maintenance, which are paused until the maintenance is over.
+type maintenance struct {
+	mut sync.Mutex
+	// overrides are the maintenance modes set at runtime by host.
+	overrides map[string]maintenanceOverride
+	// paused are the builds paused by host and version key.
+	paused map[string]map[string]buildConfig
+}
+
+// maintenanceOverride is the maintenance mode of a host set at runtime.
+type maintenanceOverride struct {
+	enabled bool
+	message string
+}
+
+func newMaintenance() *maintenance {
+	return &maintenance{
+		overrides: make(map[string]maintenanceOverride),
+		paused:    make(map[string]map[string]buildConfig),
+	}
+}
+
+// override returns the maintenance mode of the given host set at runtime, if
+// any.
+func (m *maintenance) override(host string) (maintenanceOverride, bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	o, ok := m.overrides[host]
+	return o, ok
+}
+
+func (m *maintenance) setOverride(host string, o maintenanceOverride) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.overrides[host] = o
+}
+
+func (m *maintenance) removeOverride(host string) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	delete(m.overrides, host)
+}
+
+// pause keeps the given build until the maintenance of its host is over.
+func (m *maintenance) pause(conf buildConfig) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	builds, ok := m.paused[conf.hostName]
+	if !ok {
+		builds = make(map[string]buildConfig)
+		m.paused[conf.hostName] = builds
+	}
+	builds[newKey(conf.owner, conf.project, conf.version)] = conf
+}
+
+// resume removes and returns the builds paused for the given host.
+func (m *maintenance) resume(host string) []buildConfig {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	builds := m.paused[host]
+	delete(m.paused, host)
+
+	confs := make([]buildConfig, 0, len(builds))
+	for _, conf := range builds {
+		confs = append(confs, conf)
+	}
+	sort.Slice(confs, func(i, j int) bool { return confs[i].version < confs[j].version })
+	return confs
+}
+
+// pausedVersions returns the versions whose builds are paused for the given
+// host.
+func (m *maintenance) pausedVersions(host string) []string {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	versions := make([]string, 0, len(m.paused[host]))
+	for _, conf := range m.paused[host] {
+		versions = append(versions, conf.version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// inMaintenance reports whether the given host is in maintenance mode, either
+// because it was put into it at runtime or by its config, and returns the
+// message shown to its users.
+func (s *Service) inMaintenance(host string) (string, bool) {
+	host = stripPort(host)
+	config, hosts := s.hostConfig()
+	// the aliases of a host are in maintenance mode along with it.
+	if key, ok := hosts.aliasOf(host); ok {
+		host = key
+	}
+
+	if o, ok := s.maintenance.override(host); ok {
+		return o.message, o.enabled
+	}
+
+	conf, ok := config[host]
+	return conf.MaintenanceMessage, ok && conf.Maintenance
+}
+
+// pauseBuild pauses the given build if its host is in maintenance mode, so it
+// starts once the maintenance is over. Reports whether it was paused.
+func (s *Service) pauseBuild(conf buildConfig) bool {
+	if _, ok := s.inMaintenance(conf.hostName); !ok {
+		return false
+	}
+
+	s.maintenance.pause(conf)
+	conf.log().Info("build paused until the maintenance of the host is over")
+	return true
+}
+
+// resumeBuilds starts in the background the builds paused for the given host,
+// unless it's still in maintenance mode. Each build holds the lock of its
+// version.
+func (s *Service) resumeBuilds(host string) {
+	if _, ok := s.inMaintenance(host); ok {
+		return
+	}
+
+	for _, conf := range s.maintenance.resume(host) {
+		conf.log().Info("resuming build paused by maintenance")
+		s.auditEvent("resume-build", conf.owner, conf.project, conf.version, "maintenance of "+host+" is over")
+		go s.rebuildIf(context.Background(), conf, always)
+	}
+}
+
+// maintenanceStatus is the response of the maintenance API.
+type maintenanceStatus struct {
+	Host    string `json:"host"`
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	// Overridden reports whether the maintenance mode was set at runtime
+	// instead of coming from the config.
+	Overridden bool `json:"overridden"`
+	// PausedBuilds are the versions whose builds are paused until the
+	// maintenance is over.
+	PausedBuilds []string `json:"paused-builds"`
+}
+
+// manageMaintenance is an HTTP handler that outputs whether the requested
+// host is in maintenance mode or, with a PUT request, puts it into
+// maintenance mode with the message in the "message" query string parameter,
+// if any. A DELETE request takes it out of maintenance mode and resumes its
+// paused builds. Only available to administrators.
+func (s *Service) manageMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	host := stripPort(publicHost(r))
+	log := projectLog(r, owner, project).WithField("host", host)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		message := r.URL.Query().Get("message")
+		s.maintenance.setOverride(host, maintenanceOverride{true, message})
+		log.Info("host put into maintenance mode")
+	case http.MethodDelete:
+		s.maintenance.setOverride(host, maintenanceOverride{enabled: false})
+		log.Info("host taken out of maintenance mode")
+		s.resumeBuilds(host)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	message, enabled := s.inMaintenance(host)
+	_, overridden := s.maintenance.override(host)
+	status := maintenanceStatus{
+		Host:         host,
+		Enabled:      enabled,
+		Overridden:   overridden,
+		PausedBuilds: s.maintenance.pausedVersions(host),
+	}
+	if enabled {
+		status.Message = message
+	}
+
+	if err := s.writeJSON(w, status); err != nil {
+		log.Errorf("error serving maintenance status: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// reloadMaintenance updates the maintenance mode of the given host after its
+// config changed from prev to next. The maintenance mode set at runtime is
+// discarded if the one in the config changed, and the paused builds are
+// resumed if the host is no longer in maintenance.
+func (s *Service) reloadMaintenance(host string, prev, next ProjectConfig) {
+	if prev.Maintenance != next.Maintenance {
+		s.maintenance.removeOverride(host)
+		logrus.WithFields(logrus.Fields{
+			"host":        host,
+			"maintenance": next.Maintenance,
+		}).Info("maintenance mode changed by config")
+	}
+	s.resumeBuilds(host)
+}
+
+// isMaintenanceExempt reports whether the given path is served even if the
+// host is in maintenance mode, which are the paths of the API, so
+// administrators can manage the host in the meantime.
+func isMaintenanceExempt(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+var maintenanceTemplate = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Project}}{{.Project}} documentation{{else}}Documentation{{end}} under maintenance</title>
+</head>
+<body>
+<h1>Under maintenance</h1>
+<p>{{if .Message}}{{.Message}}{{else}}The documentation{{if .Project}} of {{.Project}}{{end}} is under maintenance and will be back shortly.{{end}}</p>
+<p>Please, try again later.</p>
+</body>
+</html>
+`))
+
+// underMaintenance responds with a 503 status code and a page explaining that
+// the requested host is under maintenance, with the given message if any.
+func (s *Service) underMaintenance(w http.ResponseWriter, r *http.Request, message string) {
+	_, project, _ := s.projectForHost(r.Host)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", fmt.Sprint(maintenanceRetryAfter))
+	if wantsJSON(r) {
+		if message == "" {
+			message = "the documentation is under maintenance"
+		}
+		httpError(w, r, message, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := maintenanceTemplate.Execute(w, struct {
+		Project string
+		Message string
+	}{project, message})
+	if err != nil {
+		requestLog(r).Errorf("error rendering maintenance page: %s", err)
+	}
+}
@@ -0,0 +1,134 @@
+package docsrv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requestMaintenance(t *testing.T, srv *Service, method, url string) maintenanceStatus {
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var status maintenanceStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return status
+}
+
+func TestMaintenance(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{
+			Repository:         "bar/foo",
+			Maintenance:        true,
+			MaintenanceMessage: "Upgrading the theme",
+		},
+		"baz.bar": ProjectConfig{Repository: "bar/baz"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Equal("300", w.Header().Get("Retry-After"))
+	require.Contains(w.Body.String(), "Upgrading the theme")
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+
+	// other hosts are not affected
+	assertNotFound(t, srv, "http://baz.bar/v1.0.0/")
+
+	status := requestMaintenance(t, srv, "GET", "http://foo.bar/api/maintenance?token=admin")
+	require.Equal(maintenanceStatus{
+		Host:         "foo.bar",
+		Enabled:      true,
+		Message:      "Upgrading the theme",
+		PausedBuilds: []string{},
+	}, status)
+
+	status = requestMaintenance(t, srv, "DELETE", "http://foo.bar/api/maintenance?token=admin")
+	require.False(status.Enabled)
+	require.True(status.Overridden)
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	require.True(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	before, _ := srv.versionStatusInfo("bar", "foo", "v1.0.0")
+
+	status = requestMaintenance(t, srv, "PUT", "http://foo.bar/api/maintenance?token=admin&message=Back+soon")
+	require.True(status.Enabled)
+	require.Equal("Back soon", status.Message)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/index.html", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Contains(w.Body.String(), "Back soon")
+
+	// the builds are paused until the maintenance is over
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/rebuild/v1.0.0?token=admin", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+
+	status = requestMaintenance(t, srv, "GET", "http://foo.bar/api/maintenance?token=admin")
+	require.Equal([]string{"v1.0.0"}, status.PausedBuilds)
+
+	// the resumed builds wait for the lock of their version
+	unlock, err := srv.coordinator.Lock(context.Background(), newKey("bar", "foo", "v1.0.0"))
+	require.NoError(err)
+	status = requestMaintenance(t, srv, "DELETE", "http://foo.bar/api/maintenance?token=admin")
+	require.Empty(status.PausedBuilds)
+
+	time.Sleep(100 * time.Millisecond)
+	after, _ := srv.versionStatusInfo("bar", "foo", "v1.0.0")
+	require.Equal(*before.BuiltAt, *after.BuiltAt)
+	unlock()
+
+	require.Eventually(func() bool {
+		after, _ := srv.versionStatusInfo("bar", "foo", "v1.0.0")
+		return after.BuiltAt.After(*before.BuiltAt)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/maintenance", nil))
+	require.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestReloadMaintenance(t *testing.T) {
+	require := require.New(t)
+	srv := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+	})
+
+	srv.maintenance.setOverride("foo.bar", maintenanceOverride{enabled: true})
+	srv.maintenance.pause(buildConfig{owner: "bar", project: "foo", version: "v1.0.0", hostName: "foo.bar"})
+
+	// the runtime mode is kept while the config does not change
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	_, ok := srv.inMaintenance("foo.bar")
+	require.True(ok)
+	require.Equal([]string{"v1.0.0"}, srv.maintenance.pausedVersions("foo.bar"))
+
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "bar/foo", Maintenance: true}})
+	_, ok = srv.inMaintenance("foo.bar:8080")
+	require.True(ok)
+	_, overridden := srv.maintenance.override("foo.bar")
+	require.False(overridden)
+	require.Equal([]string{"v1.0.0"}, srv.maintenance.pausedVersions("foo.bar"))
+}
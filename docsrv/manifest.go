@@ -0,0 +1,128 @@
+package docsrv
+
+import (
+	"net/http"
+	"time"
+)
+
+// manifestPath is the path of the machine-readable manifest of the project
+// of a host, so the tools crawling several sites can discover the ones
+// served by docsrv.
+const manifestPath = "/.well-known/docsrv.json"
+
+// projectManifest is the manifest of the project served in a host.
+type projectManifest struct {
+	Host       string `json:"host"`
+	URL        string `json:"url"`
+	Owner      string `json:"owner"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// DefaultVersion is the version the root of the host redirects to
+	// instead of the latest one, if any.
+	DefaultVersion   *string `json:"default-version"`
+	Latest           *string `json:"latest"`
+	LatestPrerelease *string `json:"latest-prerelease"`
+	// RefreshedAt is the last time the releases of the project were
+	// indexed.
+	RefreshedAt *time.Time         `json:"refreshed-at"`
+	Versions    []*manifestVersion `json:"versions"`
+}
+
+// manifestVersion is a version in the manifest of a project.
+type manifestVersion struct {
+	Version    string     `json:"version"`
+	URL        string     `json:"url"`
+	Prerelease bool       `json:"prerelease"`
+	ReleasedAt *time.Time `json:"released-at"`
+	// Build is the build of the installed docs of the version, nil if it's
+	// not installed.
+	Build *manifestBuild `json:"build"`
+}
+
+// manifestBuild is the build of an installed version. The SHA and the
+// duration are not known for some builds, such as the ones installed before
+// docsrv started.
+type manifestBuild struct {
+	BuiltAt  time.Time `json:"built-at"`
+	Builder  string    `json:"builder"`
+	SHA      *string   `json:"sha"`
+	Duration *float64  `json:"duration"`
+}
+
+// serveManifest is an HTTP handler that will output the manifest of the
+// project served in the requested host: its repository, latest versions and
+// the available versions along with the builds of the installed ones. It can
+// be read from any origin.
+func (s *Service) serveManifest(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	releases := s.releasesForHost(r.Host, owner, project)
+	manifest := projectManifest{
+		Host:       s.canonicalHost(publicHost(r)),
+		URL:        urlFor(r, "", "") + "/",
+		Owner:      owner,
+		Project:    project,
+		Repository: repositoryKey(owner, project),
+		Versions:   make([]*manifestVersion, 0),
+	}
+
+	if version := s.forHost(r.Host).DefaultVersion; version != "" {
+		manifest.DefaultVersion = &version
+	}
+	if latest := latestRelease(releases); latest != nil {
+		manifest.Latest = &latest.tag
+	}
+	if next := latestPrerelease(releases); next != nil {
+		manifest.LatestPrerelease = &next.tag
+	}
+	if t, ok := s.index.lastRefresh(owner, project); ok {
+		manifest.RefreshedAt = &t
+	}
+
+	for _, v := range s.projectVersions(r, owner, project) {
+		mv := &manifestVersion{
+			Version:    v.Text,
+			URL:        v.URL,
+			Prerelease: v.Prerelease,
+			ReleasedAt: v.ReleasedAt,
+		}
+
+		if conf, ok := s.index.installation(owner, project, v.Text); ok {
+			mv.Build = newManifestBuild(conf)
+		}
+		manifest.Versions = append(manifest.Versions, mv)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := s.writeJSON(w, manifest); err != nil {
+		log.Errorf("error serving project manifest: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// newManifestBuild returns the build in the manifest of the version installed
+// with the given configuration.
+func newManifestBuild(conf buildConfig) *manifestBuild {
+	build := &manifestBuild{BuiltAt: conf.builtAt, Builder: conf.builder}
+	if conf.sha != "" {
+		sha := conf.sha
+		build.SHA = &sha
+	}
+
+	if conf.buildDuration > 0 {
+		duration := conf.buildDuration.Seconds()
+		build.Duration = &duration
+	}
+	return build
+}
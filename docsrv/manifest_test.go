@@ -0,0 +1,67 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.addPrerelease("bar", "foo", "v1.2.0-beta.1", "")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", Prereleases: true, DefaultVersion: "v1.0.0"},
+	})
+
+	builtAt := time.Date(2018, 7, 2, 9, 58, 0, 0, time.UTC)
+	srv.index.install(buildConfig{
+		owner:         "bar",
+		project:       "foo",
+		version:       "v1.0.0",
+		sha:           "1234",
+		builder:       "docsrv-1",
+		builtAt:       builtAt,
+		buildDuration: 2 * time.Second,
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar:8080/.well-known/docsrv.json", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("*", w.Header().Get("Access-Control-Allow-Origin"))
+
+	var manifest projectManifest
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &manifest))
+	require.Equal("foo.bar:8080", manifest.Host)
+	require.Equal("http://foo.bar:8080/", manifest.URL)
+	require.Equal("bar", manifest.Owner)
+	require.Equal("foo", manifest.Project)
+	require.Equal("bar/foo", manifest.Repository)
+	require.Equal("v1.0.0", *manifest.DefaultVersion)
+	require.Equal("v1.1.0", *manifest.Latest)
+	require.Equal("v1.2.0-beta.1", *manifest.LatestPrerelease)
+	require.NotNil(manifest.RefreshedAt)
+
+	versions := make(map[string]*manifestVersion)
+	for _, v := range manifest.Versions {
+		versions[v.Version] = v
+	}
+	require.Len(versions, 3)
+	require.True(versions["v1.2.0-beta.1"].Prerelease)
+	require.Nil(versions["v1.1.0"].Build)
+
+	build := versions["v1.0.0"].Build
+	require.NotNil(build)
+	require.Equal(builtAt, build.BuiltAt)
+	require.Equal("docsrv-1", build.Builder)
+	require.Equal("1234", *build.SHA)
+	require.Equal(2.0, *build.Duration)
+
+	assertNotFound(t, srv, "http://unknown.bar/.well-known/docsrv.json")
+}
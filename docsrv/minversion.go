@@ -0,0 +1,186 @@
+package docsrv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
+)
+
+// minVersionPath is the path of the API to change the minimum version of a
+// project at runtime.
+const minVersionPath = "/api/min-version"
+
+// minVersionResponse is the response of the min-version API.
+type minVersionResponse struct {
+	// MinVersion is the current minimum version of the project, empty if it
+	// has none.
+	MinVersion string `json:"min-version"`
+	// Overridden reports whether MinVersion was set at runtime instead of
+	// coming from the config.
+	Overridden bool `json:"overridden"`
+	// Deleted are the versions whose docs were deleted from disk.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// minVersionOverride is the minimum version of a project set at runtime.
+type minVersionOverride struct {
+	Owner   string `json:"owner"`
+	Project string `json:"project"`
+	Version string `json:"version"`
+}
+
+// setMinVersion changes the minimum version of the given project at runtime,
+// prunes the older releases from the index and deletes their docs. Lowering
+// it makes the project be indexed again on the next request. Returns the
+// versions whose docs were deleted.
+func (s *Service) setMinVersion(owner, project string, min *semver.Version) []string {
+	prev := s.index.minVersion(owner, project)
+	s.index.setMinVersion(owner, project, min)
+	if prev != nil && min.LessThan(prev) {
+		s.index.unset(owner, project)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"project": project,
+		"owner":   owner,
+		"version": min.Original(),
+	}).Info("minimum version changed")
+	return s.pruneVersions(owner, project, s.olderThan(owner, project, min.Original()))
+}
+
+// pruneVersions removes from the index the releases of the given project that
+// the given function reports as older than the minimum version and deletes
+// their docs from disk. Returns the versions whose docs were deleted.
+func (s *Service) pruneVersions(owner, project string, older func(version string) bool) []string {
+	// releases no longer in the index can not be built, so the docs are
+	// not installed again once deleted.
+	s.index.prune(owner, project, older)
+	s.latest.invalidate(owner, project)
+
+	var deleted []string
+	for _, installed := range s.versionsOnDisk(owner, project) {
+		if !older(installed.Version) {
+			continue
+		}
+
+		if err := s.deleteVersion(owner, project, installed.Version); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"project": project,
+				"owner":   owner,
+				"version": installed.Version,
+			}).Errorf("could not delete docs of pruned version: %s", err)
+			continue
+		}
+		deleted = append(deleted, installed.Version)
+	}
+
+	if len(deleted) > 0 {
+		s.writeState()
+	}
+	return deleted
+}
+
+// deleteVersion deletes the installed docs of the given version once the
+// builds of it in progress, if any, are finished.
+func (s *Service) deleteVersion(owner, project, version string) error {
+	unlock, err := s.coordinator.Lock(context.Background(), newKey(owner, project, version))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	folder := s.versionFolder(owner, project, version)
+	if err := os.RemoveAll(folder); err != nil {
+		return err
+	}
+
+	s.sizes.forget(folder)
+	s.pages.forget(folder)
+	s.hashes.forget(folder)
+	s.index.uninstall(owner, project, version)
+	s.search.remove(owner, project, version)
+	return nil
+}
+
+// manageMinVersion is an HTTP handler that outputs the minimum version of the
+// project in the requested host or, with a PUT request, changes it to the
+// one in the "version" query string parameter, deleting the docs of the
+// older versions. A DELETE request restores the minimum version in the
+// config. Only available to administrators.
+func (s *Service) manageMinVersion(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	var deleted []string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if projectConf, _ := s.config().ForProject(owner, project); !projectConf.isSemver() {
+			httpError(w, r, "the minimum version can only be changed for projects with semantic versions", http.StatusBadRequest)
+			return
+		}
+
+		version := r.URL.Query().Get("version")
+		min := newVersion(version)
+		if min == nil {
+			httpError(w, r, fmt.Sprintf("invalid version: %q", version), http.StatusBadRequest)
+			return
+		}
+
+		deleted = s.setMinVersion(owner, project, min)
+		s.writeState()
+	case http.MethodDelete:
+		s.index.setMinVersion(owner, project, nil)
+		// the releases older than the previous minimum version were never
+		// fetched, so the project is indexed again from scratch.
+		s.index.unset(owner, project)
+		s.latest.invalidate(owner, project)
+		s.writeState()
+		log.Info("minimum version restored from config")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.writeJSON(w, s.minVersionResponse(owner, project, deleted)); err != nil {
+		log.Errorf("error serving minimum version: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// minVersionResponse returns the current minimum version of the given
+// project.
+func (s *Service) minVersionResponse(owner, project string, deleted []string) minVersionResponse {
+	resp := minVersionResponse{
+		Overridden: s.index.hasMinVersionOverride(owner, project),
+		Deleted:    deleted,
+	}
+
+	// projects without minimum version in the config have an empty 0.0.0
+	// version, whose original string is empty.
+	if v := s.index.minVersion(owner, project); v != nil {
+		resp.MinVersion = v.Original()
+	}
+
+	// the minimum version of the projects that don't use semantic versions
+	// is only in the config.
+	if projectConf, _ := s.config().ForProject(owner, project); !projectConf.isSemver() {
+		resp.MinVersion = projectConf.MinVersion
+	}
+	return resp
+}
@@ -0,0 +1,137 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newMinVersionTestSrv(t *testing.T, conf ProjectConfig) (*Service, func()) {
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(t, err)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v0.9.0", "")
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": conf})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.RefreshToken = "admin"
+	require.NoError(t, srv.indexProject("bar", "foo"))
+
+	for _, version := range []string{"v0.9.0", "v1.0.0", "master"} {
+		require.NoError(t, os.MkdirAll(srv.versionFolder("bar", "foo", version), 0755))
+		srv.index.install(buildConfig{owner: "bar", project: "foo", version: version})
+	}
+
+	return srv, func() { os.RemoveAll(tmpDir) }
+}
+
+func requestMinVersion(t *testing.T, srv *Service, method, url string, expected int) minVersionResponse {
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	require.Equal(t, expected, w.Code)
+
+	var resp minVersionResponse
+	if expected == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return resp
+}
+
+func TestManageMinVersion(t *testing.T) {
+	require := require.New(t)
+	srv, cleanup := newMinVersionTestSrv(t, ProjectConfig{Repository: "bar/foo", MinVersion: "v0.9.0"})
+	defer cleanup()
+
+	resp := requestMinVersion(t, srv, "GET", "http://foo.bar/api/min-version?token=admin", http.StatusOK)
+	require.Equal(minVersionResponse{MinVersion: "v0.9.0"}, resp)
+
+	resp = requestMinVersion(t, srv, "PUT", "http://foo.bar/api/min-version?token=admin&version=v1.0.0", http.StatusOK)
+	require.Equal(minVersionResponse{
+		MinVersion: "v1.0.0",
+		Overridden: true,
+		Deleted:    []string{"v0.9.0"},
+	}, resp)
+
+	require.Nil(srv.index.get("bar", "foo", "v0.9.0"))
+	require.False(srv.index.isInstalled("bar", "foo", "v0.9.0"))
+	require.False(isDir(srv.versionFolder("bar", "foo", "v0.9.0")))
+	require.Len(srv.index.forProject("bar", "foo"), 2)
+
+	// versions that are not semver are never pruned
+	require.True(isDir(srv.versionFolder("bar", "foo", "v1.0.0")))
+	require.True(isDir(srv.versionFolder("bar", "foo", "master")))
+	require.True(srv.index.isInstalled("bar", "foo", "master"))
+
+	// the new minimum version is used when the project is indexed again
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.Nil(srv.index.get("bar", "foo", "v0.9.0"))
+
+	// and it's kept when docsrv restarts
+	restarted := func() *Service {
+		restarted := newTestSrv(newMockFetcher(), srv.config())
+		restarted.opts.BaseFolder = srv.opts.BaseFolder
+		restarted.restoreState()
+		return restarted
+	}
+	require.True(restarted().index.hasMinVersionOverride("bar", "foo"))
+	require.Equal("v1.0.0", restarted().index.minVersion("bar", "foo").Original())
+
+	resp = requestMinVersion(t, srv, "DELETE", "http://foo.bar/api/min-version?token=admin", http.StatusOK)
+	require.Equal(minVersionResponse{MinVersion: "v0.9.0"}, resp)
+	require.False(srv.index.isIndexed("bar", "foo"))
+	require.False(restarted().index.hasMinVersionOverride("bar", "foo"))
+
+	requestMinVersion(t, srv, "PUT", "http://foo.bar/api/min-version?token=admin&version=foo", http.StatusBadRequest)
+	requestMinVersion(t, srv, "POST", "http://foo.bar/api/min-version?token=admin", http.StatusMethodNotAllowed)
+	requestMinVersion(t, srv, "GET", "http://foo.bar/api/min-version", http.StatusForbidden)
+}
+
+func TestManageMinVersion_Lower(t *testing.T) {
+	require := require.New(t)
+	srv, cleanup := newMinVersionTestSrv(t, ProjectConfig{Repository: "bar/foo", MinVersion: "v1.0.0"})
+	defer cleanup()
+
+	resp := requestMinVersion(t, srv, "PUT", "http://foo.bar/api/min-version?token=admin&version=v0.5.0", http.StatusOK)
+	require.Equal(minVersionResponse{MinVersion: "v0.5.0", Overridden: true}, resp)
+
+	// the older releases were never fetched, so the project is indexed
+	// again.
+	require.False(srv.index.isIndexed("bar", "foo"))
+	require.True(isDir(srv.versionFolder("bar", "foo", "v0.9.0")))
+}
+
+func TestReloadConfig_PruneOldVersions(t *testing.T) {
+	require := require.New(t)
+	srv, cleanup := newMinVersionTestSrv(t, ProjectConfig{Repository: "bar/foo"})
+	defer cleanup()
+
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "bar/foo", MinVersion: "v1.0.0"}})
+	require.True(isDir(srv.versionFolder("bar", "foo", "v0.9.0")))
+
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{
+		Repository:       "bar/foo",
+		MinVersion:       "v1.1.0",
+		PruneOldVersions: true,
+	}})
+	require.False(isDir(srv.versionFolder("bar", "foo", "v0.9.0")))
+	require.False(isDir(srv.versionFolder("bar", "foo", "v1.0.0")))
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	require.True(isDir(srv.versionFolder("bar", "foo", "master")))
+
+	// lowering the minimum version deletes nothing
+	require.NoError(os.MkdirAll(filepath.Join(srv.projectFolder("bar", "foo"), "v1.0.0"), 0755))
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{
+		Repository:       "bar/foo",
+		MinVersion:       "v0.9.0",
+		PruneOldVersions: true,
+	}})
+	require.True(isDir(srv.versionFolder("bar", "foo", "v1.0.0")))
+}
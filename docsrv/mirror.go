@@ -0,0 +1,215 @@
+package docsrv
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// mirrorPrefix is the prefix of the path to download the built docs of
+	// a version, i.e. /api/mirror/${VERSION}, used by the mirrors of an
+	// instance.
+	mirrorPrefix = "/api/mirror/"
+	// mirrorSHAHeader is the header of the responses to the mirrors with the
+	// commit the docs were built from, if known.
+	mirrorSHAHeader = "X-Docsrv-SHA"
+)
+
+// serveMirror is an HTTP handler that will output a gzipped tarball with the
+// built docs of the version in the path, building it first if it's not
+// installed yet, so the mirrors of this instance don't need to build it. The
+// pull requests are indexed first if they are not yet. If the "sha" query
+// string parameter is the commit the mirror expects and the version was
+// built from another one, the project is refreshed and the version is built
+// again. Only available to administrators.
+func (s *Service) serveMirror(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	version := strings.TrimPrefix(r.URL.Path, mirrorPrefix)
+	log := projectLog(r, owner, project).WithField("version", version)
+
+	if err := s.ensureIndexed("", owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	if version == "" || strings.Contains(version, "/") {
+		s.notFound(w, r)
+		return
+	}
+
+	release := s.index.get(owner, project, version)
+	if number, ok := pullRequestNumber(version); ok && release == nil {
+		if _, err := s.indexPullRequest(owner, project, number); err != nil {
+			log.Errorf("error indexing pull request: %s", err)
+			s.handleError(w, r, err)
+			return
+		}
+		release = s.index.get(owner, project, version)
+	}
+
+	if sha := r.URL.Query().Get("sha"); sha != "" && release != nil && release.sha != sha {
+		log.Debugf("mirror expects commit %s instead of %s, refreshing project", sha, release.sha)
+		if err := s.indexProject(owner, project); err != nil {
+			log.Errorf("error indexing project: %s", err)
+			s.handleError(w, r, err)
+			return
+		}
+		release = s.index.get(owner, project, version)
+	}
+
+	if release == nil {
+		s.notFound(w, r)
+		return
+	}
+
+	if err := s.linkHost(stripPort(r.Host), owner, project); err != nil {
+		log.Errorf("could not link host folder: %s", err)
+		s.internalError(w, r)
+		return
+	}
+
+	conf := s.newBuildConfig(r, owner, project, release)
+	outdated := func() bool {
+		installed, ok := s.index.installation(owner, project, version)
+		return ok && release.sha != "" && installed.sha != release.sha
+	}
+
+	if !s.index.isInstalled(owner, project, version) {
+		log.Debug("building version to mirror it")
+		markBuild(r)
+		if _, err := s.preheatVersion(r.Context(), conf); err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+	} else if outdated() {
+		log.Debugf("rebuilding version to mirror commit %s", release.sha)
+		markBuild(r)
+		if _, err := s.rebuildIf(r.Context(), conf, outdated); err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+	}
+
+	if installed, ok := s.index.installation(owner, project, version); ok && installed.sha != "" {
+		w.Header().Set(mirrorSHAHeader, installed.sha)
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	if err := tarGzDir(w, conf.destination); err != nil {
+		// headers are already sent at this point, so there is nothing else
+		// we can do but log the error. The mirror will get an invalid
+		// tarball.
+		log.Errorf("error sending version to mirror: %s", err)
+		return
+	}
+
+	log.Debug("version sent to mirror")
+}
+
+// tarGzDir writes to w a gzipped tarball with all the files in the given
+// folder, relative to it.
+func tarGzDir(w io.Writer, root string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return addFileToTar(tw, path, filepath.ToSlash(rel), fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// pullDocs downloads the docs of the given build, already built by the
+// upstream instance, into its destination. The upstream builds them again if
+// they were built from another commit than the one of the build.
+func pullDocs(conf buildConfig) error {
+	base, err := url.Parse(conf.baseURL)
+	if err != nil {
+		return wrap(err, "invalid base URL %s", conf.baseURL)
+	}
+
+	// the hosts of the projects served under a path prefix are followed by
+	// it, which goes in the path of the request instead.
+	host, prefix := conf.hostName, ""
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		host, prefix = host[:i], host[i:]
+	}
+
+	u := strings.TrimSuffix(conf.upstreamURL, "/") + prefix + mirrorPrefix + url.PathEscape(conf.version) +
+		"?token=" + url.QueryEscape(conf.upstreamToken)
+	if conf.sha != "" {
+		u += "&sha=" + url.QueryEscape(conf.sha)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return wrap(err, "invalid upstream URL %s", conf.upstreamURL)
+	}
+
+	// the docs are built by the upstream for the same URL they are served
+	// at by this instance.
+	req.Host = host
+	req.Header.Set("X-Forwarded-Proto", base.Scheme)
+	if conf.requestID != "" {
+		req.Header.Set(requestIDHeader, conf.requestID)
+	}
+
+	resp, err := conf.client().Do(req)
+	if err != nil {
+		return wrap(err, "error pulling docs from upstream")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return wrap(ErrNotFound, "upstream has no version %s", conf.version)
+	default:
+		return fmt.Errorf("error pulling docs from upstream: status %d", resp.StatusCode)
+	}
+
+	if sha := resp.Header.Get(mirrorSHAHeader); conf.sha != "" && sha != "" && sha != conf.sha {
+		return fmt.Errorf("upstream has the docs of commit %s instead of %s", sha, conf.sha)
+	}
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return wrap(err, "invalid docs from upstream")
+	}
+	defer gr.Close()
+
+	if err := untar(gr, conf.destination); err != nil {
+		return wrap(err, "error unpacking docs from upstream")
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	primaryDir, err := ioutil.TempDir("", "docsrv-primary-")
+	require.NoError(err)
+	defer os.RemoveAll(primaryDir)
+
+	mirrorDir, err := ioutil.TempDir("", "docsrv-mirror-")
+	require.NoError(err)
+	defer os.RemoveAll(mirrorDir)
+
+	config := Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}}
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.setSHA("bar", "foo", "v1.0.0", "abc")
+	primary := newTestSrv(fetcher, config)
+	primary.opts.BaseFolder = primaryDir
+	primary.opts.SharedFolder = testSharedFolder
+	primary.opts.RefreshToken = "admin"
+	server := httptest.NewServer(primary)
+	defer server.Close()
+
+	// the mirror never builds the docs itself
+	mirrorFetcher := newMockFetcher()
+	mirrorFetcher.add("bar", "foo", "v1.0.0", "http://127.0.0.1:1/missing.tar.gz")
+	mirrorFetcher.add("bar", "foo", "v2.0.0", "http://127.0.0.1:1/missing.tar.gz")
+	mirrorFetcher.setSHA("bar", "foo", "v1.0.0", "abc")
+	mirror := newTestSrv(mirrorFetcher, config)
+	mirror.opts.BaseFolder = mirrorDir
+	mirror.opts.RefreshToken = "admin"
+	mirror.opts.UpstreamURL = server.URL
+
+	w := httptest.NewRecorder()
+	mirror.ServeHTTP(w, httptest.NewRequest("GET", "https://foo.bar/v1.0.0/", nil))
+	require.NotEqual(http.StatusInternalServerError, w.Code, w.Body.String())
+	require.True(mirror.index.isInstalled("bar", "foo", "v1.0.0"))
+	assertMakefileOutput(t, filepath.Join(mirrorDir, "bar", "foo", "v1.0.0"), "https://foo.bar/v1.0.0/", "foo", "bar", "v1.0.0")
+
+	// the upstream builds the versions it does not have yet
+	require.True(primary.index.isInstalled("bar", "foo", "v1.0.0"))
+	assertMakefileOutput(t, filepath.Join(primaryDir, "bar", "foo", "v1.0.0"), "https://foo.bar/v1.0.0/", "foo", "bar", "v1.0.0")
+
+	// the upstream builds again the versions re-tagged since it built them
+	fetcher.setSHA("bar", "foo", "v1.0.0", "def")
+	conf, ok := mirror.index.installation("bar", "foo", "v1.0.0")
+	require.True(ok)
+	conf.sha = "def"
+	require.NoError(mirror.rebuild(conf))
+	installed, ok := primary.index.installation("bar", "foo", "v1.0.0")
+	require.True(ok)
+	require.Equal("def", installed.sha)
+
+	// the versions the upstream does not know are not found
+	w = httptest.NewRecorder()
+	mirror.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v2.0.0/", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+	require.False(mirror.index.isInstalled("bar", "foo", "v2.0.0"))
+
+	cases := []struct {
+		url  string
+		code int
+	}{
+		{"http://foo.bar/api/mirror/v1.0.0", http.StatusForbidden},
+		{"http://foo.bar/api/mirror/v1.0.0?token=other", http.StatusForbidden},
+		{"http://foo.bar/api/mirror/v2.0.0?token=admin", http.StatusNotFound},
+		{"http://foo.bar/api/mirror/?token=admin", http.StatusNotFound},
+		{"http://foo.bar/api/mirror/v1.0.0?token=admin", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		primary.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		require.Equal(c.code, w.Code, c.url)
+	}
+}
+
+func TestOptionsValidateUpstream(t *testing.T) {
+	require := require.New(t)
+	require.NoError(Options{UpstreamURL: "https://docs.example.com", RefreshToken: "admin"}.Validate())
+	require.Error(Options{UpstreamURL: "https://docs.example.com"}.Validate())
+	require.Error(Options{UpstreamURL: "docs.example.com", RefreshToken: "admin"}.Validate())
+}
@@ -0,0 +1,183 @@
+package docsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// JSONWebhook is a webhook that receives the buildEvent as JSON.
+	JSONWebhook = "json"
+	// SlackWebhook is a Slack incoming webhook, or any other service
+	// compatible with it, that receives a message with the build result.
+	SlackWebhook = "slack"
+)
+
+const (
+	// BuildSucceeded is the event of a version whose docs were built.
+	BuildSucceeded = "success"
+	// BuildFailed is the event of a version whose docs could not be built.
+	BuildFailed = "failure"
+)
+
+const (
+	// webhookTimeout is the timeout of the requests to the webhooks.
+	webhookTimeout = 10 * time.Second
+	// webhookLogLines is the number of lines at the end of the build output
+	// sent to the webhooks.
+	webhookLogLines = 20
+)
+
+// WebhookConfig is the configuration of a webhook notified when a version of
+// a project is built.
+type WebhookConfig struct {
+	// URL is the URL the notifications are sent to with a POST request.
+	URL string `toml:"url"`
+	// Format is the kind of webhook, JSONWebhook or SlackWebhook. Defaults
+	// to JSONWebhook.
+	Format string `toml:"format"`
+	// Events are the build results notified, BuildSucceeded or BuildFailed.
+	// If it's empty, both are notified.
+	Events []string `toml:"events"`
+}
+
+// validate returns an error if the webhook has an unknown format or event.
+func (c WebhookConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+
+	switch c.Format {
+	case "", JSONWebhook, SlackWebhook:
+	default:
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+
+	for _, e := range c.Events {
+		if e != BuildSucceeded && e != BuildFailed {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	return nil
+}
+
+// notifies reports whether or not the webhook is notified of the given event.
+func (c WebhookConfig) notifies(event string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// buildEvent is the notification sent to the webhooks when a build finishes.
+type buildEvent struct {
+	Event      string  `json:"event"`
+	Repository string  `json:"repository"`
+	Owner      string  `json:"owner"`
+	Project    string  `json:"project"`
+	Version    string  `json:"version"`
+	URL        string  `json:"url"`
+	Duration   float64 `json:"duration"`
+	Error      string  `json:"error,omitempty"`
+	// Log is the end of the build output, only for failed builds.
+	Log string `json:"log,omitempty"`
+}
+
+func newBuildEvent(conf buildConfig, duration time.Duration, err error) *buildEvent {
+	e := &buildEvent{
+		Event:      BuildSucceeded,
+		Repository: repositoryKey(conf.owner, conf.project),
+		Owner:      conf.owner,
+		Project:    conf.project,
+		Version:    conf.version,
+		URL:        conf.baseURL,
+		Duration:   duration.Seconds(),
+	}
+
+	if err != nil {
+		e.Event = BuildFailed
+		e.Error = err.Error()
+		if failed, ok := Cause(err).(*ErrBuildFailed); ok {
+			e.Log = tailLines(failed.Log, webhookLogLines)
+		}
+	}
+
+	return e
+}
+
+// slackMessage returns the message of the event for a Slack webhook.
+func (e *buildEvent) slackMessage() map[string]string {
+	var text string
+	if e.Event == BuildSucceeded {
+		text = fmt.Sprintf("Docs of %s %s built in %.1fs: %s", e.Repository, e.Version, e.Duration, e.URL)
+	} else {
+		text = fmt.Sprintf("Docs of %s %s failed to build after %.1fs: %s", e.Repository, e.Version, e.Duration, e.Error)
+		if e.Log != "" {
+			text += "\n```\n" + e.Log + "\n```"
+		}
+	}
+	return map[string]string{"text": text}
+}
+
+// buildFinished records a build of the version with the given configuration
+// that took the given time and finished with the given error, and notifies
+// the webhooks of its project in the background.
+func (s *Service) buildFinished(conf buildConfig, duration time.Duration, err error) {
+	s.stats.countBuild(err)
+	s.trackBuild(conf, err)
+
+	projectConf, _ := s.config().ForProject(conf.owner, conf.project)
+	if len(projectConf.BuildWebhooks) == 0 {
+		return
+	}
+
+	event := newBuildEvent(conf, duration, err)
+	for _, hook := range projectConf.BuildWebhooks {
+		if !hook.notifies(event.Event) {
+			continue
+		}
+
+		go func(hook WebhookConfig) {
+			if err := s.notifyWebhook(hook, event); err != nil {
+				conf.log().WithField("webhook", hook.URL).
+					Errorf("could not notify build webhook: %s", err)
+			}
+		}(hook)
+	}
+}
+
+// notifyWebhook sends the given event to the given webhook.
+func (s *Service) notifyWebhook(hook WebhookConfig, event *buildEvent) error {
+	var payload interface{} = event
+	if hook.Format == SlackWebhook {
+		payload = event.slackMessage()
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(hook.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
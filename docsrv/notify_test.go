@@ -0,0 +1,113 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildWebhooks(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+	failingURL, closeFailing := tarGzServerWithMakefile(failingMakefile)
+	defer closeFailing()
+
+	events := make(chan *buildEvent, 10)
+	messages := make(chan map[string]string, 10)
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("POST", r.Method)
+		if r.URL.Path == "/slack" {
+			var msg map[string]string
+			require.NoError(json.NewDecoder(r.Body).Decode(&msg))
+			messages <- msg
+			return
+		}
+
+		var e buildEvent
+		require.NoError(json.NewDecoder(r.Body).Decode(&e))
+		events <- &e
+	}))
+	defer hooks.Close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", failingURL)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{
+		Repository: "bar/foo",
+		BuildWebhooks: []WebhookConfig{
+			{URL: hooks.URL + "/json"},
+			{URL: hooks.URL + "/slack", Format: SlackWebhook, Events: []string{BuildFailed}},
+		},
+	}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	e := receiveEvent(t, events)
+	require.Equal(BuildSucceeded, e.Event)
+	require.Equal("bar/foo", e.Repository)
+	require.Equal("v1.0.0", e.Version)
+	require.Equal("http://foo.bar/v1.0.0/", e.URL)
+	require.Empty(e.Error)
+	require.Empty(e.Log)
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://foo.bar/v1.1.0/", nil))
+	e = receiveEvent(t, events)
+	require.Equal(BuildFailed, e.Event)
+	require.Equal("v1.1.0", e.Version)
+	require.NotEmpty(e.Error)
+	require.NotEmpty(e.Log)
+
+	select {
+	case msg := <-messages:
+		require.Contains(msg["text"], "bar/foo v1.1.0 failed to build")
+	case <-time.After(5 * time.Second):
+		require.FailNow("slack webhook was not notified")
+	}
+
+	// the slack webhook is only notified of failures
+	require.Len(messages, 0)
+}
+
+func receiveEvent(t *testing.T, events <-chan *buildEvent) *buildEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "webhook was not notified")
+		return nil
+	}
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	cases := []struct {
+		conf  WebhookConfig
+		valid bool
+	}{
+		{WebhookConfig{URL: "http://hook"}, true},
+		{WebhookConfig{URL: "http://hook", Format: SlackWebhook, Events: []string{BuildFailed}}, true},
+		{WebhookConfig{}, false},
+		{WebhookConfig{URL: "http://hook", Format: "xml"}, false},
+		{WebhookConfig{URL: "http://hook", Events: []string{"started"}}, false},
+	}
+
+	for _, c := range cases {
+		err := c.conf.validate()
+		if c.valid {
+			require.NoError(t, err, c.conf.URL)
+		} else {
+			require.Error(t, err, c.conf.URL)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package docsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// idTokenLeeway is the clock skew allowed when checking the expiration of the
+// ID tokens.
+const idTokenLeeway = time.Minute
+
+// errInvalidIDToken is returned when the ID token returned by the provider
+// can not be trusted, so the user is not allowed in.
+var errInvalidIDToken = errors.New("invalid ID token")
+
+// idTokenClaims are the claims of an OpenID Connect ID token docsrv checks.
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      idTokenAudience `json:"aud"`
+	Expiry        int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+}
+
+// idTokenAudience is the audience of an ID token, which can be either a
+// single client ID or a list of them.
+type idTokenAudience []string
+
+func (a *idTokenAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = idTokenAudience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a idTokenAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// idTokenHeader is the header of a JWS.
+type idTokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jsonWebKey is a public key of a JWKS. Only RSA and EC keys are supported.
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	// N and E are the modulus and exponent of RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+	// Curve, X and Y are the curve and coordinates of EC keys.
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// idTokenAlgorithms are the supported signature algorithms of the ID tokens,
+// with the hash they use.
+var idTokenAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+// verifiedIDToken returns the claims of the ID token of the given OAuth2
+// token once its signature is verified with the keys of the JWKS of the
+// provider and its issuer, audience, expiration and nonce are checked.
+func (c *AuthConfig) verifiedIDToken(ctx context.Context, token *oauth2.Token, nonce string) (*idTokenClaims, error) {
+	raw, _ := token.Extra("id_token").(string)
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, wrap(errInvalidIDToken, "the provider did not return one")
+	}
+
+	var header idTokenHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, wrap(errInvalidIDToken, "invalid header: %s", err)
+	}
+
+	hash, ok := idTokenAlgorithms[header.Algorithm]
+	if !ok {
+		return nil, wrap(errInvalidIDToken, "unsupported algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, wrap(errInvalidIDToken, "invalid signature: %s", err)
+	}
+
+	keys, err := c.fetchJWKS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	var verified bool
+	for _, key := range keys {
+		if (header.KeyID != "" && key.KeyID != header.KeyID) || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+
+		if verifySignature(key, header.Algorithm, hash, digest, signature) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, wrap(errInvalidIDToken, "its signature can not be verified with the keys of the provider")
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, wrap(errInvalidIDToken, "invalid claims: %s", err)
+	}
+
+	switch {
+	case claims.Issuer != c.Issuer:
+		return nil, wrap(errInvalidIDToken, "issued by %q instead of %q", claims.Issuer, c.Issuer)
+	case !claims.Audience.contains(c.ClientID):
+		return nil, wrap(errInvalidIDToken, "not meant for client %q", c.ClientID)
+	case time.Now().Add(-idTokenLeeway).Unix() >= claims.Expiry:
+		return nil, wrap(errInvalidIDToken, "expired")
+	case claims.Nonce != nonce:
+		return nil, wrap(errInvalidIDToken, "not issued for this authentication")
+	case claims.Subject == "":
+		return nil, wrap(errInvalidIDToken, "no subject")
+	}
+
+	return &claims, nil
+}
+
+// contextClient returns the HTTP client of the given context, set for the
+// oauth2 package, or the default one if there is none.
+func contextClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// fetchJWKS returns the keys of the JWKS of the provider with the HTTP client
+// of the given context.
+func (c *AuthConfig) fetchJWKS(ctx context.Context) ([]jsonWebKey, error) {
+	req, err := http.NewRequest("GET", c.JWKSURL, nil)
+	if err != nil {
+		return nil, wrap(err, "invalid JWKS URL")
+	}
+
+	resp, err := contextClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, wrap(err, "error getting JWKS")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, wrap(err, "error decoding JWKS")
+	}
+	return jwks.Keys, nil
+}
+
+// verifySignature reports whether the given signature of the given digest,
+// made with the given algorithm and hash, is valid for the given key.
+func verifySignature(key jsonWebKey, alg string, hash crypto.Hash, digest, signature []byte) bool {
+	switch {
+	case strings.HasPrefix(alg, "RS") && key.KeyType == "RSA":
+		n, errN := decodeBigInt(key.N)
+		e, errE := decodeBigInt(key.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return false
+		}
+
+		pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+	case strings.HasPrefix(alg, "ES") && key.KeyType == "EC":
+		var curve elliptic.Curve
+		switch {
+		case alg == "ES256" && key.Curve == "P-256":
+			curve = elliptic.P256()
+		case alg == "ES384" && key.Curve == "P-384":
+			curve = elliptic.P384()
+		default:
+			return false
+		}
+
+		x, errX := decodeBigInt(key.X)
+		y, errY := decodeBigInt(key.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if errX != nil || errY != nil || len(signature) != 2*size {
+			return false
+		}
+
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// decodeJWTPart decodes the given base64url encoded JSON part of a JWT into
+// the given value.
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeBigInt decodes the given base64url encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
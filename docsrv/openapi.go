@@ -0,0 +1,658 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// openAPIPath is the path of the OpenAPI definition of the HTTP API.
+const openAPIPath = "/api/openapi.json"
+
+// serveOpenAPI is an HTTP handler that will output the OpenAPI definition of
+// the HTTP API of docsrv, with the requested host as its server, so it can be
+// used to generate clients or explore the API of the project in that host.
+func (s *Service) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(openAPISpec), &spec); err != nil {
+		requestLog(r).Errorf("error parsing OpenAPI definition: %s", err)
+		s.internalError(w, r)
+		return
+	}
+
+	spec["servers"] = []map[string]string{{"url": reqScheme(r) + "://" + r.Host}}
+	if err := s.writeJSON(w, spec); err != nil {
+		requestLog(r).Errorf("error serving OpenAPI definition: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// openAPISpec is the OpenAPI definition of the HTTP API. The servers are
+// added when it's served.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "docsrv",
+    "description": "API of the documentation of the project served in the host. The administrative endpoints require the refresh token in the token query string parameter.",
+    "version": "1"
+  },
+  "paths": {
+    "/versions.json": {
+      "get": {
+        "operationId": "listVersions",
+        "summary": "List the versions of the project",
+        "parameters": [
+          {"$ref": "#/components/parameters/major"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/order"},
+          {"$ref": "#/components/parameters/includePrereleases"}
+        ],
+        "responses": {
+          "200": {"description": "The versions.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Version"}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/versions/v2.json": {
+      "get": {
+        "operationId": "listVersionsV2",
+        "summary": "List the versions of the project with the v2 schema",
+        "parameters": [
+          {"$ref": "#/components/parameters/major"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/order"},
+          {"$ref": "#/components/parameters/includePrereleases"}
+        ],
+        "responses": {
+          "200": {"description": "The versions.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/VersionV2"}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/project.json": {
+      "get": {
+        "operationId": "getProject",
+        "summary": "Get the metadata of the project",
+        "responses": {
+          "200": {"description": "The metadata of the project.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Project"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/.well-known/docsrv.json": {
+      "get": {
+        "operationId": "getManifest",
+        "summary": "Get the machine-readable manifest of the project",
+        "responses": {
+          "200": {"description": "The manifest of the project.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Manifest"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/search.json": {
+      "get": {
+        "operationId": "search",
+        "summary": "Search the docs of a version",
+        "parameters": [
+          {"name": "q", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "version", "in": "query", "description": "Version to search, the latest by default.", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "The pages matching the query, sorted by relevance.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SearchHit"}}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/diff": {
+      "get": {
+        "operationId": "getDiff",
+        "summary": "Get the pages added, removed and modified between two versions",
+        "parameters": [
+          {"name": "from", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "to", "in": "query", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The pages that changed.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Diff"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"description": "One of the versions is not built yet."}
+        }
+      }
+    },
+    "/changelog.json": {
+      "get": {
+        "operationId": "getChangelog",
+        "summary": "Get the release notes of all the releases",
+        "parameters": [
+          {"$ref": "#/components/parameters/major"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/order"},
+          {"$ref": "#/components/parameters/includePrereleases"}
+        ],
+        "responses": {
+          "200": {"description": "The release notes, newest first by default.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ReleaseNotes"}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/{version}/release-notes.json": {
+      "get": {
+        "operationId": "getReleaseNotes",
+        "summary": "Get the release notes of a release",
+        "parameters": [{"$ref": "#/components/parameters/version"}],
+        "responses": {
+          "200": {"description": "The release notes.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReleaseNotes"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/versions/{version}/status": {
+      "get": {
+        "operationId": "getVersionStatus",
+        "summary": "Get the build status of a version",
+        "parameters": [{"$ref": "#/components/parameters/version"}],
+        "responses": {
+          "200": {"description": "The build status.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VersionStatus"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/badge/{version}.svg": {
+      "get": {
+        "operationId": "getBadge",
+        "summary": "Get a badge with the build status of a version, or of the latest one with latest",
+        "parameters": [{"$ref": "#/components/parameters/version"}],
+        "responses": {
+          "200": {"description": "The SVG badge.", "content": {"image/svg+xml": {"schema": {"type": "string"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/rebuild/{version}": {
+      "post": {
+        "operationId": "rebuildVersion",
+        "summary": "Build a version again",
+        "security": [{"token": []}],
+        "parameters": [{"$ref": "#/components/parameters/version"}],
+        "responses": {
+          "200": {"description": "The build status of the rebuilt version.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VersionStatus"}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"description": "The version is already being rebuilt."},
+          "500": {"description": "The build failed."}
+        }
+      }
+    },
+    "/api/build": {
+      "post": {
+        "operationId": "buildRef",
+        "summary": "Build the docs of a git ref under a label",
+        "security": [{"token": []}],
+        "parameters": [
+          {"name": "ref", "in": "query", "required": true, "description": "Tag, branch or SHA to build.", "schema": {"type": "string"}},
+          {"name": "label", "in": "query", "required": true, "description": "Version the docs are installed under.", "schema": {"type": "string"}},
+          {"name": "owner", "in": "query", "description": "Owner of the project, defaults to the one of the host.", "schema": {"type": "string"}},
+          {"name": "project", "in": "query", "description": "Project, defaults to the one of the host.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The build status of the label.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VersionStatus"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"description": "The label is in use or already being built."},
+          "500": {"description": "The build failed."}
+        }
+      }
+    },
+    "/api/stats": {
+      "get": {
+        "operationId": "getStats",
+        "summary": "Get the disk usage and builds of all the projects",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"description": "The stats of every project.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ProjectStats"}}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/api/state": {
+      "get": {
+        "operationId": "getState",
+        "summary": "Get the state manifest of all the hosts",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"description": "The state manifest.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "post": {
+        "operationId": "resyncState",
+        "summary": "Resync the state manifest with the installed docs",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"description": "The resynced state manifest.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/api/quarantine": {
+      "get": {
+        "operationId": "listQuarantined",
+        "summary": "List the quarantined versions of the project",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"description": "The quarantined versions.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/QuarantinedVersion"}}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "delete": {
+        "operationId": "releaseQuarantined",
+        "summary": "Release a version from quarantine",
+        "security": [{"token": []}],
+        "parameters": [{"name": "version", "in": "query", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "204": {"description": "The version was released."},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/min-version": {
+      "get": {
+        "operationId": "getMinVersion",
+        "summary": "Get the minimum version of the project",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/MinVersion"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "put": {
+        "operationId": "setMinVersion",
+        "summary": "Change the minimum version of the project, deleting the docs of the older versions",
+        "security": [{"token": []}],
+        "parameters": [{"name": "version", "in": "query", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/MinVersion"},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "delete": {
+        "operationId": "resetMinVersion",
+        "summary": "Restore the minimum version of the config",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/MinVersion"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/api/maintenance": {
+      "get": {
+        "operationId": "getMaintenance",
+        "summary": "Get whether the host is in maintenance mode",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Maintenance"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "put": {
+        "operationId": "startMaintenance",
+        "summary": "Put the host into maintenance mode, pausing its builds",
+        "security": [{"token": []}],
+        "parameters": [{"name": "message", "in": "query", "description": "Message shown to the users of the host.", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Maintenance"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "delete": {
+        "operationId": "endMaintenance",
+        "summary": "Take the host out of maintenance mode, resuming its paused builds",
+        "security": [{"token": []}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Maintenance"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/api/config/validate": {
+      "post": {
+        "operationId": "validateConfig",
+        "summary": "Validate a config file",
+        "security": [{"token": []}],
+        "requestBody": {"required": true, "content": {"application/toml": {"schema": {"type": "string"}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/ConfigValidation"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "413": {"description": "The config is too large."},
+          "422": {"$ref": "#/components/responses/ConfigValidation"}
+        }
+      }
+    },
+    "/api/bulk/{operation}": {
+      "post": {
+        "operationId": "bulkOperation",
+        "summary": "Run an operation on all the matching versions of the project",
+        "security": [{"token": []}],
+        "parameters": [
+          {"name": "operation", "in": "path", "required": true, "schema": {"type": "string", "enum": ["rebuild", "purge-prereleases", "retry-failed"]}},
+          {"name": "dry-run", "in": "query", "description": "List the versions without running the operation.", "schema": {"type": "boolean"}}
+        ],
+        "responses": {
+          "200": {"description": "The progress of the operation, streamed as a JSON object per line.", "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/BulkProgress"}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/export": {
+      "get": {
+        "operationId": "exportSite",
+        "summary": "Download all the installed versions of the project",
+        "security": [{"token": []}],
+        "parameters": [
+          {"name": "base-url", "in": "query", "description": "URL the site will be served from, used in the sitemap and versions.json, the one of the host by default.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "A gzipped tarball with the docs.", "content": {"application/gzip": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/api/mirror/{version}": {
+      "get": {
+        "operationId": "mirrorVersion",
+        "summary": "Download the built docs of a version, building it first if needed",
+        "security": [{"token": []}],
+        "parameters": [{"$ref": "#/components/parameters/version"}],
+        "responses": {
+          "200": {"description": "A gzipped tarball with the docs of the version.", "content": {"application/gzip": {"schema": {"type": "string", "format": "binary"}}}},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"description": "The build failed."}
+        }
+      }
+    },
+    "/api/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "Get this definition",
+        "responses": {
+          "200": {"description": "The OpenAPI definition.", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "apiKey", "in": "query", "name": "token"}
+    },
+    "parameters": {
+      "version": {"name": "version", "in": "path", "required": true, "schema": {"type": "string"}},
+      "major": {"name": "major", "in": "query", "description": "Only list the releases of this major version.", "schema": {"type": "integer", "minimum": 0}},
+      "limit": {"name": "limit", "in": "query", "description": "Maximum number of results.", "schema": {"type": "integer", "minimum": 0}},
+      "order": {"name": "order", "in": "query", "schema": {"type": "string", "enum": ["asc", "desc"]}},
+      "includePrereleases": {"name": "include-prereleases", "in": "query", "schema": {"type": "boolean", "default": true}}
+    },
+    "responses": {
+      "BadRequest": {"description": "Invalid parameters.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Forbidden": {"description": "The token is missing or invalid."},
+      "NotFound": {"description": "The project or version does not exist.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "MinVersion": {"description": "The minimum version.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MinVersion"}}}},
+      "Maintenance": {"description": "The maintenance mode of the host.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Maintenance"}}}},
+      "ConfigValidation": {"description": "The result of the validation.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ConfigValidation"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"type": "integer"}
+        }
+      },
+      "Version": {
+        "type": "object",
+        "properties": {
+          "text": {"type": "string"},
+          "url": {"type": "string"},
+          "installed": {"type": "boolean"},
+          "prerelease": {"type": "boolean"},
+          "released-at": {"type": "string", "format": "date-time", "nullable": true}
+        }
+      },
+      "VersionV2": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "url": {"type": "string"},
+          "prerelease": {"type": "boolean"},
+          "installed": {"type": "boolean"},
+          "released-at": {"type": "string", "format": "date-time", "nullable": true}
+        }
+      },
+      "Project": {
+        "type": "object",
+        "properties": {
+          "repository": {"type": "string"},
+          "latest": {"type": "string", "nullable": true},
+          "latest-prerelease": {"type": "string", "nullable": true},
+          "versions": {"type": "array", "items": {"$ref": "#/components/schemas/Version"}}
+        }
+      },
+      "Manifest": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "url": {"type": "string"},
+          "owner": {"type": "string"},
+          "project": {"type": "string"},
+          "repository": {"type": "string"},
+          "default-version": {"type": "string", "nullable": true},
+          "latest": {"type": "string", "nullable": true},
+          "latest-prerelease": {"type": "string", "nullable": true},
+          "refreshed-at": {"type": "string", "format": "date-time", "nullable": true},
+          "versions": {"type": "array", "items": {"$ref": "#/components/schemas/ManifestVersion"}}
+        }
+      },
+      "ManifestVersion": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "url": {"type": "string"},
+          "prerelease": {"type": "boolean"},
+          "released-at": {"type": "string", "format": "date-time", "nullable": true},
+          "build": {
+            "type": "object",
+            "nullable": true,
+            "properties": {
+              "built-at": {"type": "string", "format": "date-time"},
+              "builder": {"type": "string"},
+              "sha": {"type": "string", "nullable": true},
+              "duration": {"type": "number", "nullable": true}
+            }
+          }
+        }
+      },
+      "SearchHit": {
+        "type": "object",
+        "properties": {
+          "title": {"type": "string"},
+          "url": {"type": "string"},
+          "score": {"type": "number"}
+        }
+      },
+      "ReleaseNotes": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "name": {"type": "string"},
+          "body": {"type": "string"},
+          "author": {"type": "string"},
+          "url": {"type": "string"},
+          "prerelease": {"type": "boolean"},
+          "released-at": {"type": "string", "format": "date-time", "nullable": true}
+        }
+      },
+      "Diff": {
+        "type": "object",
+        "properties": {
+          "from": {"type": "string"},
+          "to": {"type": "string"},
+          "added": {"type": "array", "items": {"$ref": "#/components/schemas/DiffPage"}},
+          "removed": {"type": "array", "items": {"$ref": "#/components/schemas/DiffPage"}},
+          "modified": {"type": "array", "items": {"$ref": "#/components/schemas/DiffPage"}},
+          "unchanged": {"type": "integer"}
+        }
+      },
+      "DiffPage": {
+        "type": "object",
+        "properties": {
+          "path": {"type": "string"},
+          "url": {"type": "string"}
+        }
+      },
+      "VersionStatus": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "installed": {"type": "boolean"},
+          "built-at": {"type": "string", "format": "date-time", "nullable": true},
+          "builder": {"type": "string", "nullable": true},
+          "sha": {"type": "string", "nullable": true},
+          "rebuild-pending": {"type": "boolean"},
+          "last-failure": {
+            "type": "object",
+            "nullable": true,
+            "properties": {
+              "error": {"type": "string"},
+              "attempts": {"type": "integer"},
+              "failed-at": {"type": "string", "format": "date-time"},
+              "retry-at": {"type": "string", "format": "date-time"}
+            }
+          }
+        }
+      },
+      "ProjectStats": {
+        "type": "object",
+        "properties": {
+          "repository": {"type": "string"},
+          "hosts": {"type": "array", "items": {"type": "string"}},
+          "refreshed-at": {"type": "string", "format": "date-time", "nullable": true},
+          "disk-usage": {"type": "integer"},
+          "last-built-at": {"type": "string", "format": "date-time", "nullable": true},
+          "last-build-duration": {"type": "number", "nullable": true},
+          "versions": {"type": "array", "items": {"$ref": "#/components/schemas/VersionStats"}},
+          "skipped-tags": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "VersionStats": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "disk-usage": {"type": "integer"},
+          "built-at": {"type": "string", "format": "date-time", "nullable": true},
+          "build-duration": {"type": "number", "nullable": true},
+          "orphaned": {"type": "boolean"}
+        }
+      },
+      "State": {
+        "type": "object",
+        "properties": {
+          "generated-at": {"type": "string", "format": "date-time"},
+          "builder": {"type": "string"},
+          "layout": {"type": "string"},
+          "hosts": {"type": "array", "items": {"$ref": "#/components/schemas/HostState"}}
+        }
+      },
+      "HostState": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "repository": {"type": "string"},
+          "root": {"type": "string"},
+          "target": {"type": "string"},
+          "linked": {"type": "boolean"},
+          "versions": {"type": "array", "items": {"$ref": "#/components/schemas/VersionState"}}
+        }
+      },
+      "VersionState": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "path": {"type": "string"},
+          "built-at": {"type": "string", "format": "date-time", "nullable": true},
+          "sha": {"type": "string", "nullable": true}
+        }
+      },
+      "QuarantinedVersion": {
+        "type": "object",
+        "properties": {
+          "owner": {"type": "string"},
+          "project": {"type": "string"},
+          "version": {"type": "string"},
+          "reason": {"type": "string"},
+          "quarantined": {"type": "string", "format": "date-time"}
+        }
+      },
+      "MinVersion": {
+        "type": "object",
+        "properties": {
+          "min-version": {"type": "string"},
+          "overridden": {"type": "boolean"},
+          "deleted": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "Maintenance": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "enabled": {"type": "boolean"},
+          "message": {"type": "string"},
+          "overridden": {"type": "boolean"},
+          "paused-builds": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "ConfigValidation": {
+        "type": "object",
+        "properties": {
+          "valid": {"type": "boolean"},
+          "errors": {"type": "array", "items": {"$ref": "#/components/schemas/ConfigError"}}
+        }
+      },
+      "ConfigError": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "field": {"type": "string"},
+          "message": {"type": "string"}
+        }
+      },
+      "BulkProgress": {
+        "type": "object",
+        "properties": {
+          "operation": {"type": "string"},
+          "version": {"type": "string"},
+          "status": {"type": "string", "enum": ["planned", "running", "done", "failed", "finished"]},
+          "error": {"type": "string"},
+          "step": {"type": "integer"},
+          "total": {"type": "integer"},
+          "failed": {"type": "integer"},
+          "dry-run": {"type": "boolean"}
+        }
+      }
+    }
+  }
+}`
@@ -0,0 +1,64 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeOpenAPI(t *testing.T) {
+	require := require.New(t)
+	srv := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/openapi.json", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &spec))
+	require.Equal("3.0.3", spec.OpenAPI)
+	require.Len(spec.Servers, 1)
+	require.Equal("http://foo.bar", spec.Servers[0].URL)
+
+	for _, path := range []string{
+		"/versions.json", versionsV2Path, "/search.json", "/project.json", manifestPath,
+		changelogPath, statsPath, statePath, quarantinePath, minVersionPath,
+		validateConfigPath, maintenancePath, "/api/export", openAPIPath, diffPath,
+	} {
+		require.Contains(spec.Paths, path)
+	}
+	require.Contains(spec.Paths["/api/rebuild/{version}"], "post")
+	require.Contains(spec.Paths[buildRefPath], "post")
+	require.Contains(spec.Paths["/badge/{version}.svg"], "get")
+	require.Contains(spec.Paths["/api/min-version"], "put")
+	require.Contains(spec.Paths["/api/mirror/{version}"], "get")
+
+	// every reference must point to a defined component.
+	var components map[string]map[string]json.RawMessage
+	require.NoError(json.Unmarshal([]byte(openAPISpec), &struct {
+		Components *map[string]map[string]json.RawMessage `json:"components"`
+	}{&components}))
+	refs := regexp.MustCompile(`"#/components/([^/]+)/([^"]+)"`).FindAllStringSubmatch(openAPISpec, -1)
+	require.NotEmpty(refs)
+	for _, ref := range refs {
+		require.Contains(components[ref[1]], ref[2], strings.Trim(ref[0], `"`))
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/openapi.json", nil))
+	require.Equal(http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,429 @@
+package docsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// otelTracesPath is the path of the OTLP/HTTP endpoint of the traces,
+	// relative to the endpoint of the collector.
+	otelTracesPath = "/v1/traces"
+	// otelServiceName is the name of the service in the exported spans.
+	otelServiceName = "docsrv"
+	// otelBatchSize is the number of finished spans that triggers an export
+	// before the export interval is over.
+	otelBatchSize = 256
+	// otelMaxQueue is the maximum number of finished spans waiting to be
+	// exported. The spans finished once it's full are dropped.
+	otelMaxQueue = 4096
+	// otelExportInterval is the time between exports of the finished spans.
+	otelExportInterval = 5 * time.Second
+	// traceparentHeader is the W3C Trace Context header with the trace and
+	// the span of the caller.
+	traceparentHeader = "traceparent"
+)
+
+// Kinds of the spans, as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Status codes of the spans, as defined by OTLP.
+const (
+	spanStatusUnset = 0
+	spanStatusError = 2
+)
+
+// spanContext identifies a span and the trace it belongs to.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// isValid reports whether the context identifies a span.
+func (c spanContext) isValid() bool {
+	return c.traceID != [16]byte{} && c.spanID != [8]byte{}
+}
+
+// parseTraceparent returns the span context in the given traceparent
+// header. Will also report whether or not it's a valid header.
+func parseTraceparent(header string) (spanContext, bool) {
+	var c spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return c, false
+	}
+
+	if _, err := hex.Decode(c.traceID[:], []byte(parts[1])); err != nil {
+		return c, false
+	}
+
+	if _, err := hex.Decode(c.spanID[:], []byte(parts[2])); err != nil {
+		return c, false
+	}
+	return c, c.isValid()
+}
+
+// otelSpan is an operation exported to an OpenTelemetry collector. All its
+// methods can be called on a nil span, which is what tracers return when
+// tracing is disabled, and do nothing.
+type otelSpan struct {
+	tracer *otelTracer
+	ctx    spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+
+	mut        sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+// context returns the context of the span, which is empty if it's nil.
+func (s *otelSpan) context() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.ctx
+}
+
+// startChild starts a span with the given name as a child of this one.
+func (s *otelSpan) startChild(name string) *otelSpan {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.start(s.ctx, name, spanKindInternal)
+}
+
+// set sets the given attribute of the span, which must be a string, a bool,
+// an int or a float.
+func (s *otelSpan) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.attributes[key] = value
+}
+
+// finish ends the span, marking it as failed if an error is given, and
+// queues it to be exported. Finishing a span more than once has no effect.
+func (s *otelSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	if !s.end.IsZero() {
+		s.mut.Unlock()
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mut.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+type otelSpanKey struct{}
+
+// withSpan returns the given request with the given span as the span of its
+// context.
+func withSpan(r *http.Request, span *otelSpan) *http.Request {
+	if span == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), otelSpanKey{}, span))
+}
+
+// spanFromRequest returns the span of the given request, if any.
+func spanFromRequest(r *http.Request) *otelSpan {
+	span, _ := r.Context().Value(otelSpanKey{}).(*otelSpan)
+	return span
+}
+
+// otelTracer records the spans of the requests and the builds and exports
+// them to an OpenTelemetry collector with OTLP over HTTP, encoded as JSON.
+type otelTracer struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mut     sync.Mutex
+	queue   []*otelSpan
+	dropped int
+	// full receives a value when the queue reaches the size of a batch.
+	full chan struct{}
+}
+
+// newOTelTracer returns a tracer that exports the spans to the collector
+// with the given endpoint, e.g. "http://collector:4318", sending the given
+// headers with every export. It returns nil, which records nothing, if the
+// endpoint is empty.
+func newOTelTracer(endpoint string, headers map[string]string) *otelTracer {
+	if endpoint == "" {
+		return nil
+	}
+
+	return &otelTracer{
+		url:     strings.TrimSuffix(endpoint, "/") + otelTracesPath,
+		headers: headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		full:    make(chan struct{}, 1),
+	}
+}
+
+// start starts a span with the given name and kind as a child of the given
+// span or, if it's empty, as the root of a new trace.
+func (t *otelTracer) start(parent spanContext, name string, kind int) *otelSpan {
+	if t == nil {
+		return nil
+	}
+
+	span := &otelSpan{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+
+	if parent.isValid() {
+		span.ctx.traceID = parent.traceID
+		span.parent = parent.spanID
+	} else {
+		rand.Read(span.ctx.traceID[:])
+	}
+	rand.Read(span.ctx.spanID[:])
+	return span
+}
+
+func (t *otelTracer) enqueue(span *otelSpan) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if len(t.queue) >= otelMaxQueue {
+		t.dropped++
+		return
+	}
+
+	t.queue = append(t.queue, span)
+	if len(t.queue) == otelBatchSize {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the finished spans every export interval, or as soon as there
+// is a batch of them, until the given context is cancelled, when the ones
+// left are exported.
+func (t *otelTracer) run(ctx context.Context) {
+	ticker := time.NewTicker(otelExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.full:
+		case <-ctx.Done():
+			t.exportQueued()
+			return
+		}
+		t.exportQueued()
+	}
+}
+
+// exportQueued exports the finished spans in batches, logging the spans
+// that could not be exported.
+func (t *otelTracer) exportQueued() {
+	t.mut.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mut.Unlock()
+
+	if dropped > 0 {
+		logrus.Warnf("dropped %d spans because the export queue was full", dropped)
+	}
+
+	for len(spans) > 0 {
+		n := otelBatchSize
+		if n > len(spans) {
+			n = len(spans)
+		}
+
+		if err := t.export(spans[:n]); err != nil {
+			logrus.Warnf("unable to export %d spans: %s", n, err)
+		}
+		spans = spans[n:]
+	}
+}
+
+// export sends the given spans to the collector.
+func (t *otelTracer) export(spans []*otelSpan) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ExportTraces exports the spans of the requests and the builds to the
+// OpenTelemetry collector in the options until the given context is
+// cancelled. It returns right away if there is no collector.
+func (s *Service) ExportTraces(ctx context.Context) {
+	if s.tracer != nil {
+		s.tracer.run(ctx)
+	}
+}
+
+// startRequestSpan starts the server span of the given request, joining the
+// trace in its traceparent header if any, and returns the request with the
+// span in its context.
+func (s *Service) startRequestSpan(r *http.Request) (*http.Request, *otelSpan) {
+	parent, _ := parseTraceparent(r.Header.Get(traceparentHeader))
+	span := s.tracer.start(parent, r.Method+" "+r.URL.Path, spanKindServer)
+	span.set("http.method", r.Method)
+	span.set("http.host", stripPort(r.Host))
+	span.set("http.target", r.URL.Path)
+	span.set("docsrv.request_id", requestID(r))
+	return withSpan(r, span), span
+}
+
+// finishRequestSpan ends the server span of a request served with the given
+// response, marking it as failed if it's a server error.
+func finishRequestSpan(span *otelSpan, w *statusRecorder) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	span.set("http.status_code", status)
+	if status >= 500 {
+		span.finish(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	} else {
+		span.finish(nil)
+	}
+}
+
+// otlpRequest returns the body of the OTLP/HTTP request that exports the
+// given spans, following the JSON mapping of the protobuf messages.
+func otlpRequest(spans []*otelSpan) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.otlp()
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name": otelServiceName,
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/src-d/docsrv"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func (s *otelSpan) otlp() map[string]interface{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.ctx.traceID[:]),
+		"spanId":            hex.EncodeToString(s.ctx.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+		"status":            map[string]interface{}{"code": spanStatusUnset},
+	}
+
+	if s.parent != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+
+	if s.err != "" {
+		span["status"] = map[string]interface{}{
+			"code":    spanStatusError,
+			"message": s.err,
+		}
+	}
+	return span
+}
+
+// otlpAttributes returns the given attributes as OTLP key values, sorted by
+// key.
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		var value map[string]interface{}
+		switch v := attrs[k].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": k, "value": value})
+	}
+	return result
+}
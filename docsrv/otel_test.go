@@ -0,0 +1,171 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s otlpSpan) attribute(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// otlpCollector returns a server that records the spans exported to it.
+func otlpCollector(t *testing.T) (*httptest.Server, func() map[string]otlpSpan) {
+	var mut sync.Mutex
+	spans := make(map[string]otlpSpan)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "secret", r.Header.Get("Authorization"))
+
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		mut.Lock()
+		defer mut.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}))
+
+	return server, func() map[string]otlpSpan {
+		mut.Lock()
+		defer mut.Unlock()
+		return spans
+	}
+}
+
+func TestExportSpans(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	collector, spans := otlpCollector(t)
+	defer collector.Close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.tracer = newOTelTracer(collector.URL+"/", map[string]string{"Authorization": "secret"})
+
+	req := httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+	srv.tracer.exportQueued()
+
+	exported := spans()
+	request := exported["GET /v1.0.0/"]
+	require.Equal("4bf92f3577b34da6a3ce929d0e0e4736", request.TraceID)
+	require.Equal("00f067aa0ba902b7", request.ParentSpanID)
+	require.Equal(spanKindServer, request.Kind)
+	require.Equal("307", request.attribute("http.status_code"))
+	require.Equal("foo.bar", request.attribute("http.host"))
+
+	require.Equal(request.SpanID, exported["index"].ParentSpanID)
+	build := exported["build"]
+	require.Equal(request.SpanID, build.ParentSpanID)
+	require.Equal("v1.0.0", build.attribute("docsrv.version"))
+
+	for _, name := range []string{"download", "unpack", "make", "install"} {
+		span, ok := exported[name]
+		require.True(ok, name)
+		require.Equal(request.TraceID, span.TraceID, name)
+		require.Equal(build.SpanID, span.ParentSpanID, name)
+		require.Equal(spanStatusUnset, span.Status.Code, name)
+	}
+}
+
+func TestExportSpans_Failure(t *testing.T) {
+	require := require.New(t)
+	collector, spans := otlpCollector(t)
+	defer collector.Close()
+
+	tracer := newOTelTracer(collector.URL, map[string]string{"Authorization": "secret"})
+	err := buildDocs(buildConfig{
+		owner:   "bar",
+		project: "foo",
+		version: "v1.0.0",
+		tracer:  tracer,
+	})
+	require.Error(err)
+	tracer.exportQueued()
+
+	build := spans()["build"]
+	require.Equal(spanStatusError, build.Status.Code)
+	require.Empty(build.ParentSpanID)
+	require.Len(build.TraceID, 32)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	require := require.New(t)
+
+	c, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(ok)
+	require.Equal(byte(0x4b), c.traceID[0])
+	require.Equal(byte(0xb7), c.spanID[7])
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(h)
+		require.False(ok, h)
+	}
+
+	// no spans are recorded without a collector
+	var tracer *otelTracer
+	span := tracer.start(c, "foo", spanKindInternal)
+	require.Nil(span)
+	span.set("foo", 1)
+	span.startChild("bar").finish(nil)
+	require.False(span.context().isValid())
+}
@@ -0,0 +1,92 @@
+package docsrv
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Projects can be served under a path prefix of a host shared with other
+// projects instead of a host of their own, configuring them for the host
+// followed by the prefix, e.g. "docs.example.com/foo", for the organizations
+// that can not create a DNS entry for every project. Their requests are
+// rewritten as if they were made to a host named like that, so the rest of
+// docsrv serves them as any other and the URLs built from the host of the
+// request keep the prefix.
+
+// pathPrefixKey is the key of the context of the requests routed by path
+// that contains their path prefix.
+type pathPrefixKey struct{}
+
+// routeByPath returns the given request rewritten to the host of its project,
+// e.g. "docs.example.com/foo" with the path "/v1.0.0/" for a request to
+// "docs.example.com/foo/v1.0.0/", if the project is served under a path
+// prefix. Other requests are returned as they are.
+func (s *Service) routeByPath(r *http.Request) *http.Request {
+	config, hosts := s.hostConfig()
+	host := stripPort(r.Host)
+	if config.has(host) {
+		return r
+	}
+
+	segment := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	if segment == "" {
+		return r
+	}
+
+	if _, ok := hosts.hostKey(config, host+"/"+segment); !ok {
+		return r
+	}
+
+	prefix := "/" + segment
+	routed := r.WithContext(context.WithValue(r.Context(), pathPrefixKey{}, prefix))
+	u := *r.URL
+	u.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = ""
+	routed.URL = &u
+	// the port, if any, stays before the prefix, so the host is split with
+	// splitPathPrefix before parsing its port.
+	routed.Host = r.Host + prefix
+	return routed
+}
+
+// splitPathPrefix splits the given host of a request, which is followed by
+// the path prefix of its project if it's routed by path, into the host, with
+// its port if any, and the prefix.
+func splitPathPrefix(host string) (string, string) {
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		return host[:i], host[i:]
+	}
+	return host, ""
+}
+
+// localURL returns the given absolute path of the host of the request with
+// the path prefix of its project, if it's routed by path, so it can be used
+// as a relative URL.
+func localURL(r *http.Request, path string) string {
+	prefix, _ := r.Context().Value(pathPrefixKey{}).(string)
+	return prefix + path
+}
+
+// selfURL returns the URL to redirect the given request to itself.
+func selfURL(r *http.Request) string {
+	if _, ok := r.Context().Value(pathPrefixKey{}).(string); ok {
+		return localURL(r, r.URL.RequestURI())
+	}
+	return r.URL.String()
+}
+
+// hasPathPrefixes reports whether any project is served under a path prefix
+// of the given host.
+func (c Config) hasPathPrefixes(host string) bool {
+	host = stripPort(host)
+	for h := range c {
+		if strings.HasPrefix(h, host+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newPathPrefixTestSrv(t *testing.T) (*Service, func()) {
+	url, closeServer := tarGzServer()
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(t, err)
+
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", url)
+	fetcher.add("org", "foo", "v1.1.0", url)
+	fetcher.add("org", "bar", "v2.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"docs.bar/foo": ProjectConfig{Repository: "org/foo"},
+		"docs.bar/bar": ProjectConfig{Repository: "org/bar"},
+		"baz.bar":      ProjectConfig{Repository: "org/bar"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	return srv, func() {
+		closeServer()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestRouteByPath(t *testing.T) {
+	require := require.New(t)
+	srv, cleanup := newPathPrefixTestSrv(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.bar/foo/versions.json", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	var versions []*version
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &versions))
+	require.Equal([]*version{
+		{Text: "v1.0.0", URL: "http://docs.bar/foo/v1.0.0"},
+		{Text: "v1.1.0", URL: "http://docs.bar/foo/v1.1.0"},
+	}, versions)
+
+	assertRedirect(t, srv, "http://docs.bar/foo/latest/", "http://docs.bar/foo/v1.1.0/")
+	assertRedirect(t, srv, "http://docs.bar:8080/bar/latest/", "http://docs.bar:8080/bar/v2.0.0/")
+	assertRedirect(t, srv, "http://baz.bar/latest/", "http://baz.bar/v2.0.0/")
+
+	// once built, the version is requested again with its prefix
+	assertRedirect(t, srv, "http://docs.bar/foo/v1.0.0/", "/foo/v1.0.0/")
+	assertMakefileOutput(t, srv.versionFolder("org", "foo", "v1.0.0"), "http://docs.bar/foo/v1.0.0/", "foo", "org", "v1.0.0")
+
+	// prefixes of other hosts and unknown prefixes are not routed
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://baz.bar/foo/versions.json", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.bar/qux/versions.json", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+
+	// the aliases under a path prefix keep the port of the request
+	config := srv.config()
+	foo := config["docs.bar/foo"]
+	foo.Aliases = []string{"old.bar/foo"}
+	config["docs.bar/foo"] = foo
+	srv.ReloadConfig(config)
+	assertRedirect(t, srv, "http://old.bar/foo/latest/", "http://docs.bar/foo/v1.1.0/")
+	assertRedirect(t, srv, "http://old.bar:8080/foo/latest/", "http://docs.bar:8080/foo/v1.1.0/")
+}
+
+func TestRouteByPath_Static(t *testing.T) {
+	require := require.New(t)
+	srv, cleanup := newPathPrefixTestSrv(t)
+	defer cleanup()
+	srv.opts.ServeStatic = true
+
+	folder := srv.versionFolder("org", "foo", "v1.0.0")
+	require.NoError(os.MkdirAll(folder, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(folder, "index.html"), []byte("foo"), 0644))
+	srv.LinkHosts()
+
+	link, err := os.Readlink(filepath.Join(srv.opts.BaseFolder, "docs.bar", "foo"))
+	require.NoError(err)
+	require.Equal(filepath.Join("..", "org", "foo"), link)
+
+	link, err = os.Readlink(filepath.Join(srv.opts.BaseFolder, "baz.bar"))
+	require.NoError(err)
+	require.Equal(filepath.Join("org", "bar"), link)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.bar/foo/v1.0.0/", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("foo", w.Body.String())
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://docs.bar/foo/v1.0.0", nil))
+	require.Equal(http.StatusMovedPermanently, w.Code)
+	require.Equal("/foo/v1.0.0/", w.Header().Get("Location"))
+
+	for _, h := range srv.stateManifest(srv.config()).Hosts {
+		require.True(h.Linked, h.Host)
+	}
+}
+
+func TestStripPort_PathPrefix(t *testing.T) {
+	require.Equal(t, "docs.bar/foo", stripPort("docs.bar:8080/foo"))
+	require.Equal(t, "docs.bar/foo", stripPort("docs.bar/foo"))
+
+	host, prefix := splitPathPrefix("docs.bar:8080/foo")
+	require.Equal(t, "docs.bar:8080", host)
+	require.Equal(t, "/foo", prefix)
+}
+
+func TestConfigValidate_PathPrefix(t *testing.T) {
+	require := require.New(t)
+	require.Empty(Config{
+		"docs.bar/foo": {Repository: "org/foo"},
+		"docs.bar/bar": {Repository: "org/bar"},
+	}.Validate())
+
+	errs := Config{
+		"docs.bar":         {Repository: "org/docs"},
+		"docs.bar/foo":     {Repository: "org/foo"},
+		"docs.bar/foo/bar": {Repository: "org/bar"},
+		"/baz":             {Repository: "org/baz"},
+	}.Validate()
+	require.Len(errs, 3)
+	require.Equal("/baz", errs[0].Host)
+	require.Equal("docs.bar/foo", errs[1].Host)
+	require.Contains(errs[1].Message, "docs.bar serves a project of its own")
+	require.Equal("docs.bar/foo/bar", errs[2].Host)
+}
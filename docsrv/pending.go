@@ -0,0 +1,277 @@
+package docsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// queueFile is the format of the name of the file in the base folder where
+// the pending builds of an instance are persisted, unless another one is set
+// in the options, with the name of the instance in place of %s, so the
+// instances sharing the base folder never resume the builds of each other.
+const queueFile = ".docsrv-queue-%s.json"
+
+// queueFile returns the path of the file where the pending builds are
+// persisted, or an empty one if they are not.
+func (o Options) queueFile() string {
+	if o.QueueFile != "" || o.BaseFolder == "" {
+		return o.QueueFile
+	}
+	return filepath.Join(o.BaseFolder, fmt.Sprintf(queueFile, builderName()))
+}
+
+// pendingBuild is a build that is queued or running, persisted so it's
+// resumed if docsrv stops before it's finished.
+type pendingBuild struct {
+	Owner   string `json:"owner"`
+	Project string `json:"project"`
+	Version string `json:"version"`
+	// BaseURL is the base URL of the docs of the version, whose host is the
+	// one the version is built for.
+	BaseURL string `json:"base-url"`
+	// URL and SHA are the archive and the commit the version is built from,
+	// used for the pull requests and refs, which are not in the index once
+	// docsrv starts again.
+	URL string `json:"url"`
+	SHA string `json:"sha,omitempty"`
+	// Ref is the git ref built under the version with the build API, if any.
+	Ref string `json:"ref,omitempty"`
+	// Rebuild reports whether the version was already installed when the
+	// build was queued, so it's built again even if it's installed.
+	Rebuild     bool      `json:"rebuild"`
+	Interactive bool      `json:"interactive"`
+	QueuedAt    time.Time `json:"queued-at"`
+}
+
+// pendingBuilds keeps track of the pending builds, writing them to a file
+// every time one is added or finished.
+type pendingBuilds struct {
+	mut sync.Mutex
+	// path is the file where the builds are persisted. If it's empty, they
+	// are not persisted.
+	path   string
+	next   int
+	builds map[int]pendingBuild
+}
+
+func newPendingBuilds(path string) *pendingBuilds {
+	return &pendingBuilds{path: path, builds: make(map[int]pendingBuild)}
+}
+
+// track adds the given build to the pending ones. The returned function must
+// be called once the build is finished, either successfully or not.
+func (p *pendingBuilds) track(build pendingBuild) func() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	id := p.next
+	p.next++
+	p.builds[id] = build
+	p.writeLocked()
+
+	return func() {
+		p.mut.Lock()
+		defer p.mut.Unlock()
+		delete(p.builds, id)
+		p.writeLocked()
+	}
+}
+
+// list returns the pending builds in the order they were queued.
+func (p *pendingBuilds) list() []pendingBuild {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.listLocked()
+}
+
+func (p *pendingBuilds) listLocked() []pendingBuild {
+	ids := make([]int, 0, len(p.builds))
+	for id := range p.builds {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	builds := make([]pendingBuild, 0, len(ids))
+	for _, id := range ids {
+		builds = append(builds, p.builds[id])
+	}
+	return builds
+}
+
+// writeLocked writes the pending builds to their file, if any. Errors are
+// logged, since the builds go on anyway.
+func (p *pendingBuilds) writeLocked() {
+	if p.path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(p.listLocked(), "", "  ")
+	if err == nil {
+		err = writeFileAtomic(p.path, data)
+	}
+
+	if err != nil {
+		logrus.Errorf("could not write pending builds: %s", err)
+	}
+}
+
+// load returns the builds persisted in the file of the pending builds, which
+// were pending when docsrv stopped.
+func (p *pendingBuilds) load() ([]pendingBuild, error) {
+	if p.path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var builds []pendingBuild
+	if err := json.Unmarshal(data, &builds); err != nil {
+		return nil, wrap(err, "invalid pending builds file %s", p.path)
+	}
+	return builds, nil
+}
+
+// trackPending records the build with the given configuration as pending
+// until the returned function is called. If rebuild is true, the version is
+// built again if docsrv stops before, even if it's installed.
+func (s *Service) trackPending(conf buildConfig, rebuild bool) func() {
+	return s.pending.track(pendingBuild{
+		Owner:       conf.owner,
+		Project:     conf.project,
+		Version:     conf.version,
+		BaseURL:     conf.baseURL,
+		URL:         conf.tarballURL,
+		SHA:         conf.sha,
+		Ref:         conf.ref,
+		Rebuild:     rebuild,
+		Interactive: conf.interactive,
+		QueuedAt:    time.Now(),
+	})
+}
+
+// resumePendingBuilds queues again, in the same order, the builds that were
+// pending when docsrv stopped. The versions that are no longer available and
+// the ones installed in the meantime, unless they were being rebuilt, are
+// skipped.
+func (s *Service) resumePendingBuilds() {
+	builds, err := s.pending.load()
+	if err != nil {
+		logrus.WithField("alert", true).Errorf("could not resume the pending builds: %s", err)
+		return
+	}
+
+	if len(builds) == 0 {
+		return
+	}
+
+	logrus.Infof("resuming %d pending builds", len(builds))
+	for _, b := range builds {
+		log := logrus.WithFields(logrus.Fields{
+			"project": b.Project,
+			"owner":   b.Owner,
+			"version": b.Version,
+		})
+
+		conf, err := s.pendingBuildConfig(b)
+		if err != nil {
+			log.Warnf("not resuming pending build: %s", err)
+			continue
+		}
+
+		if !b.Rebuild && isDir(conf.destination) {
+			continue
+		}
+
+		// the builds requested by users are shown as queued to them again.
+		if b.Interactive && !b.Rebuild {
+			s.scheduleBuild(conf)
+			continue
+		}
+
+		// the tickets are reserved right away, so the builds keep their
+		// order in the queue.
+		ticket := s.scheduler.reserve(conf.owner, newKey(conf.owner, conf.project, conf.version), conf.interactive)
+		done := s.trackPending(conf, b.Rebuild)
+		go func(conf buildConfig, ticket *buildTicket, rebuild bool) {
+			defer done()
+			if err := s.buildResumed(conf, ticket, rebuild); err != nil {
+				conf.log().Errorf("resumed build failed: %s", err)
+			}
+		}(conf, ticket, b.Rebuild)
+	}
+}
+
+// buildResumed builds the version with the given configuration resumed after
+// a restart once the given ticket is ready, holding the lock of the version.
+func (s *Service) buildResumed(conf buildConfig, ticket *buildTicket, rebuild bool) error {
+	if !rebuild {
+		return s.buildScheduled(conf, ticket)
+	}
+
+	release, err := s.scheduler.wait(context.Background(), ticket)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlock, err := s.coordinator.Lock(context.Background(), newKey(conf.owner, conf.project, conf.version))
+	if err != nil {
+		conf.log().Errorf("could not acquire the build lock: %s", err)
+		return err
+	}
+	defer unlock()
+	return s.replaceDocs(conf)
+}
+
+// pendingBuildConfig returns the configuration of the given pending build,
+// using the current release of its version if it's still available.
+func (s *Service) pendingBuildConfig(b pendingBuild) (buildConfig, error) {
+	if _, ok := s.config().ForProject(b.Owner, b.Project); !ok {
+		return buildConfig{}, wrap(ErrNotFound, "project %s is no longer configured", newKey(b.Owner, b.Project))
+	}
+
+	u, err := url.Parse(b.BaseURL)
+	if err != nil || u.Host == "" {
+		return buildConfig{}, fmt.Errorf("invalid base URL %q", b.BaseURL)
+	}
+
+	req, err := http.NewRequest("GET", u.Scheme+"://"+u.Host+"/", nil)
+	if err != nil {
+		return buildConfig{}, err
+	}
+
+	if err := s.ensureIndexed("", b.Owner, b.Project); err != nil {
+		return buildConfig{}, wrap(err, "error indexing project")
+	}
+
+	// the pull requests and the refs are built from the commit and the
+	// archive they were queued with, the rest of versions must still be in
+	// the index. The archive is the one chosen by the project config then,
+	// so there is no zipball to choose again.
+	r := s.index.get(b.Owner, b.Project, b.Version)
+	if _, ok := pullRequestNumber(b.Version); b.Ref != "" || ok {
+		r = &release{tag: b.Version, url: b.URL, sha: b.SHA}
+	} else if r == nil {
+		return buildConfig{}, wrap(ErrNotFound, "release not found")
+	}
+
+	conf := s.newBuildConfig(req, b.Owner, b.Project, r)
+	conf.ref = b.Ref
+	conf.interactive = b.Interactive
+	return conf, nil
+}
@@ -0,0 +1,178 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingBuilds(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "queue.json")
+	pending := newPendingBuilds(path)
+	builds, err := pending.load()
+	require.NoError(err)
+	require.Empty(builds)
+
+	doneA := pending.track(pendingBuild{Owner: "bar", Project: "foo", Version: "v1.0.0"})
+	doneB := pending.track(pendingBuild{Owner: "bar", Project: "foo", Version: "v2.0.0", Rebuild: true})
+
+	builds, err = pending.load()
+	require.NoError(err)
+	require.Len(builds, 2)
+	require.Equal("v1.0.0", builds[0].Version)
+	require.Equal("v2.0.0", builds[1].Version)
+	require.True(builds[1].Rebuild)
+
+	doneA()
+	builds, err = newPendingBuilds(path).load()
+	require.NoError(err)
+	require.Len(builds, 1)
+	require.Equal("v2.0.0", builds[0].Version)
+
+	doneB()
+	require.Empty(pending.list())
+
+	require.NoError(ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = pending.load()
+	require.Error(err)
+}
+
+func TestOptionsQueueFile(t *testing.T) {
+	require := require.New(t)
+	require.Equal("", Options{}.queueFile())
+	require.Equal("/queue.json", Options{BaseFolder: "/docs", QueueFile: "/queue.json"}.queueFile())
+	require.Equal(
+		filepath.Join("/docs", ".docsrv-queue-"+builderName()+".json"),
+		Options{BaseFolder: "/docs"}.queueFile(),
+	)
+}
+
+func TestResumePendingBuilds(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	for _, v := range []string{"v1.0.0", "v2.0.0", "v3.0.0"} {
+		fetcher.add("bar", "foo", v, url)
+	}
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.pending = newPendingBuilds(filepath.Join(tmpDir, "queue.json"))
+
+	// v2.0.0 was installed before the restart and v4.0.0 was deleted, so
+	// only v1.0.0, the rebuild of v3.0.0 and the ref are built.
+	for _, v := range []string{"v2.0.0", "v3.0.0"} {
+		require.NoError(os.MkdirAll(srv.versionFolder("bar", "foo", v), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(srv.versionFolder("bar", "foo", v), "out"), []byte("stale"), 0644))
+	}
+
+	builds := []pendingBuild{
+		{Owner: "bar", Project: "foo", Version: "v1.0.0", BaseURL: "http://foo.bar/v1.0.0/", Interactive: true},
+		{Owner: "bar", Project: "foo", Version: "v2.0.0", BaseURL: "http://foo.bar/v2.0.0/"},
+		{Owner: "bar", Project: "foo", Version: "v3.0.0", BaseURL: "http://foo.bar/v3.0.0/", Rebuild: true},
+		{Owner: "bar", Project: "foo", Version: "v4.0.0", BaseURL: "http://foo.bar/v4.0.0/"},
+		{Owner: "bar", Project: "foo", Version: "preview", BaseURL: "http://foo.bar/preview/", URL: url, SHA: "abc", Ref: "hotfix"},
+		{Owner: "bar", Project: "qux", Version: "v1.0.0", BaseURL: "http://qux.bar/v1.0.0/"},
+	}
+	data, err := json.Marshal(builds)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(srv.pending.path, data, 0644))
+
+	srv.resumePendingBuilds()
+	require.Eventually(func() bool {
+		return len(srv.pending.list()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, v := range []string{"v1.0.0", "v3.0.0", "preview"} {
+		require.True(srv.index.isInstalled("bar", "foo", v), v)
+		assertMakefileOutput(t, srv.versionFolder("bar", "foo", v), "http://foo.bar/"+v+"/", "foo", "bar", v)
+	}
+	require.False(srv.index.isInstalled("bar", "foo", "v2.0.0"))
+	conf, _ := srv.index.installation("bar", "foo", "preview")
+	require.Equal("hotfix", conf.ref)
+	require.Equal("abc", conf.sha)
+
+	builds, err = srv.pending.load()
+	require.NoError(err)
+	require.Empty(builds)
+}
+
+func TestPendingBuildConfig(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "http://foo/tarball")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo", Archive: ZipballArchive}})
+
+	// the refs are built from the archive they were queued with
+	conf, err := srv.pendingBuildConfig(pendingBuild{
+		Owner:   "bar",
+		Project: "foo",
+		Version: "preview",
+		BaseURL: "http://foo.bar/preview/",
+		URL:     "http://foo/zipball",
+		SHA:     "abc",
+		Ref:     "hotfix",
+	})
+	require.NoError(err)
+	require.Equal("http://foo/zipball", conf.tarballURL)
+	require.Equal("abc", conf.sha)
+}
+
+func TestScheduleBuild_Pending(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.pending = newPendingBuilds(filepath.Join(tmpDir, "queue.json"))
+	srv.scheduler = newBuildScheduler(1)
+
+	release, ok := srv.scheduler.tryAcquire("bar")
+	require.True(ok)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+
+	// the queued build is persisted until it's finished
+	builds, err := srv.pending.load()
+	require.NoError(err)
+	require.Len(builds, 1)
+	require.Equal("v1.0.0", builds[0].Version)
+	require.Equal("http://foo.bar/v1.0.0/", builds[0].BaseURL)
+	require.True(builds[0].Interactive)
+	require.False(builds[0].Rebuild)
+
+	release()
+	require.Eventually(func() bool {
+		builds, err := srv.pending.load()
+		return err == nil && len(builds) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+}
@@ -0,0 +1,188 @@
+package docsrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// postProcess applies to the built documentation site all the post
+// processing steps enabled in the given build configuration.
+func postProcess(conf buildConfig) error {
+	if conf.assetHashes {
+		if err := appendAssetHashes(conf); err != nil {
+			return err
+		}
+	}
+
+	if conf.canonicalBaseURL != "" {
+		if err := addCanonicalLinks(conf); err != nil {
+			return err
+		}
+	}
+
+	if conf.noIndex {
+		if err := addNoIndexMeta(conf); err != nil {
+			return err
+		}
+	}
+
+	if conf.deprecationBanner != "" {
+		if err := addDeprecationBanner(conf); err != nil {
+			return err
+		}
+	}
+
+	if len(conf.offlineBundles) > 0 {
+		if err := generateBundles(conf); err != nil {
+			return err
+		}
+	}
+
+	// the files are compressed once they are not going to change anymore.
+	if conf.precompress {
+		if err := precompressSite(conf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var headRegexp = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+
+// injectIntoHead inserts the given tag right after the opening head tag of
+// the given HTML page. Pages without a head tag are left unchanged.
+func injectIntoHead(content []byte, tag string) []byte {
+	loc := headRegexp.FindIndex(content)
+	if loc == nil {
+		return content
+	}
+
+	result := make([]byte, 0, len(content)+len(tag))
+	result = append(result, content[:loc[1]]...)
+	result = append(result, tag...)
+	return append(result, content[loc[1]:]...)
+}
+
+var canonicalRegexp = regexp.MustCompile(`(?i)<link[^>]+rel=["']?canonical`)
+
+// addCanonicalLinks adds to every HTML page of the site without one a
+// canonical link pointing to the same page in the latest version, so search
+// engines rank the latest docs above the older ones.
+func addCanonicalLinks(conf buildConfig) error {
+	return rewriteHTMLFiles(conf.destination, func(path string, content []byte) []byte {
+		if canonicalRegexp.Match(content) {
+			return content
+		}
+
+		rel, err := filepath.Rel(conf.destination, path)
+		if err != nil {
+			return content
+		}
+
+		rel = filepath.ToSlash(rel)
+		if rel == "index.html" {
+			rel = ""
+		} else if strings.HasSuffix(rel, "/index.html") {
+			rel = strings.TrimSuffix(rel, "index.html")
+		}
+
+		url := html.EscapeString(ensureEndingSlash(conf.canonicalBaseURL) + rel)
+		return injectIntoHead(content, `<link rel="canonical" href="`+url+`">`)
+	})
+}
+
+const noIndexMeta = `<meta name="robots" content="noindex, nofollow">`
+
+// addNoIndexMeta adds a robots meta tag to every HTML page of the site to
+// exclude them from search engines, even if they are served without the
+// X-Robots-Tag header.
+func addNoIndexMeta(conf buildConfig) error {
+	return rewriteHTMLFiles(conf.destination, func(_ string, content []byte) []byte {
+		return injectIntoHead(content, noIndexMeta)
+	})
+}
+
+// rewriteHTMLFiles calls fn with the path and contents of every HTML file
+// inside root and replaces the file contents with the result.
+func rewriteHTMLFiles(root string, fn func(path string, content []byte) []byte) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".html") {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(path, fn(path, content), fi.Mode())
+	})
+}
+
+var assetRegexp = regexp.MustCompile(`((?:href|src)=["'])([^"'?#]+\.(?:css|js))(["'])`)
+
+// appendAssetHashes appends a query string with the hash of the contents of
+// every local CSS and JS file referenced in the HTML files of the site, so
+// browsers and caches fetch them again when they change after a rebuild.
+func appendAssetHashes(conf buildConfig) error {
+	hashes := make(map[string]string)
+	return rewriteHTMLFiles(conf.destination, func(path string, content []byte) []byte {
+		return assetRegexp.ReplaceAllFunc(content, func(m []byte) []byte {
+			parts := assetRegexp.FindSubmatch(m)
+			file := assetPath(conf, filepath.Dir(path), string(parts[2]))
+			if file == "" {
+				return m
+			}
+
+			hash, ok := hashes[file]
+			if !ok {
+				hash = fileHash(file)
+				hashes[file] = hash
+			}
+
+			if hash == "" {
+				return m
+			}
+
+			return []byte(string(parts[1]) + string(parts[2]) + "?v=" + hash + string(parts[3]))
+		})
+	})
+}
+
+// assetPath returns the path in disk of the asset referenced by the given URL
+// in a page at dir, or an empty string if it's not a local asset.
+func assetPath(conf buildConfig, dir, url string) string {
+	switch {
+	case conf.baseURL != "" && strings.HasPrefix(url, conf.baseURL):
+		return filepath.Join(conf.destination, strings.TrimPrefix(url, conf.baseURL))
+	case strings.HasPrefix(url, "//") || strings.Contains(url, "://"):
+		return ""
+	case strings.HasPrefix(url, "/"):
+		return filepath.Join(filepath.Dir(conf.destination), url)
+	default:
+		return filepath.Join(dir, url)
+	}
+}
+
+// fileHash returns the first 8 characters of the hex-encoded SHA-256 of the
+// given file contents, or an empty string if it can't be read.
+func fileHash(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:8]
+}
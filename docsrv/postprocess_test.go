@@ -0,0 +1,165 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPage = `<html>
+<head>
+<link rel="stylesheet" href="css/style.css">
+<link rel="stylesheet" href="/v1.0.0/css/style.css">
+<link rel="stylesheet" href="http://foo.bar/v1.0.0/css/style.css">
+<link rel="stylesheet" href="https://cdn.tld/lib.css">
+<script src='js/missing.js'></script>
+<script src="js/app.js?v=1"></script>
+</head>
+</html>`
+
+const expectedTestPage = `<html>
+<head>
+<link rel="stylesheet" href="css/style.css?v=62368a1a">
+<link rel="stylesheet" href="/v1.0.0/css/style.css?v=62368a1a">
+<link rel="stylesheet" href="http://foo.bar/v1.0.0/css/style.css?v=62368a1a">
+<link rel="stylesheet" href="https://cdn.tld/lib.css">
+<script src='js/missing.js'></script>
+<script src="js/app.js?v=1"></script>
+</head>
+</html>`
+
+func TestAppendAssetHashes(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	destination := filepath.Join(tmpDir, "foo.bar", "v1.0.0")
+	require.NoError(os.MkdirAll(filepath.Join(destination, "css"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(destination, "css", "style.css"), []byte("body {}"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(destination, "index.html"), []byte(testPage), 0644))
+
+	require.NoError(postProcess(buildConfig{
+		baseURL:     "http://foo.bar/v1.0.0/",
+		destination: destination,
+		assetHashes: true,
+	}))
+
+	content, err := ioutil.ReadFile(filepath.Join(destination, "index.html"))
+	require.NoError(err)
+	require.Equal(expectedTestPage, string(content))
+}
+
+func TestInjectIntoHead(t *testing.T) {
+	cases := []struct {
+		page     string
+		expected string
+	}{
+		{"<html><head><title>a</title></head></html>", "<html><head><x><title>a</title></head></html>"},
+		{`<HTML><HEAD lang="en"></HEAD></HTML>`, `<HTML><HEAD lang="en"><x></HEAD></HTML>`},
+		{"<html><header></header></html>", "<html><header></header></html>"},
+		{"no head", "no head"},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, string(injectIntoHead([]byte(c.page), "<x>")))
+	}
+}
+
+func TestAddNoIndexMeta(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	page := filepath.Join(tmpDir, "index.html")
+	require.NoError(ioutil.WriteFile(page, []byte("<html><head></head></html>"), 0644))
+	require.NoError(postProcess(buildConfig{destination: tmpDir, noIndex: true}))
+
+	content, err := ioutil.ReadFile(page)
+	require.NoError(err)
+	require.Equal("<html><head>"+noIndexMeta+"</head></html>", string(content))
+}
+
+func TestAddCanonicalLinks(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"index.html":         "<html><head></head></html>",
+		"guide/index.html":   "<html><head></head></html>",
+		"guide/install.html": "<html><head></head></html>",
+		"api.html":           `<html><head><link rel="canonical" href="http://foo.bar/api"></head></html>`,
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, filepath.FromSlash(name))
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	require.NoError(postProcess(buildConfig{
+		destination:      tmpDir,
+		canonicalBaseURL: "http://foo.bar/v2.0.0/",
+	}))
+
+	expected := map[string]string{
+		"index.html":         `<html><head><link rel="canonical" href="http://foo.bar/v2.0.0/"></head></html>`,
+		"guide/index.html":   `<html><head><link rel="canonical" href="http://foo.bar/v2.0.0/guide/"></head></html>`,
+		"guide/install.html": `<html><head><link rel="canonical" href="http://foo.bar/v2.0.0/guide/install.html"></head></html>`,
+		"api.html":           files["api.html"],
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, filepath.FromSlash(name)))
+		require.NoError(err)
+		require.Equal(content, string(data), name)
+	}
+}
+
+func TestCanonicalBaseURL(t *testing.T) {
+	require := require.New(t)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v2.0.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	require.NoError(srv.indexProject("bar", "foo"))
+
+	req, err := http.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+	require.NoError(err)
+
+	require.Equal("http://foo.bar/v2.0.0/", srv.canonicalBaseURL(req, "bar", "foo", "v1.0.0"))
+	require.Equal("", srv.canonicalBaseURL(req, "bar", "foo", "v2.0.0"))
+	require.Equal("", srv.canonicalBaseURL(req, "bar", "foo", "master"))
+}
+
+func TestStripCacheBusting(t *testing.T) {
+	cases := []struct {
+		url      string
+		expected string
+		busted   bool
+	}{
+		{"http://foo/v1.0.0/style.css", "", false},
+		{"http://foo/v1.0.0/style.css?v=1234", "", true},
+		{"http://foo/v1.0.0/style.css?62368a1a", "", true},
+		{"http://foo/v1.0.0/style.css?_=1500000000&cb=2", "", true},
+		{"http://foo/v1.0.0/?token=foo&v=2", "token=foo", true},
+		{"http://foo/v1.0.0/?foo", "foo", false},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", c.url, nil)
+		require.NoError(t, err, c.url)
+
+		require.Equal(t, c.busted, stripCacheBusting(req), c.url)
+		require.Equal(t, c.expected, req.URL.RawQuery, c.url)
+	}
+}
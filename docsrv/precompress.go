@@ -0,0 +1,202 @@
+package docsrv
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// defaultBrotliCommand is the default command used to compress the
+	// files with brotli.
+	defaultBrotliCommand = "brotli --best --keep --force"
+	// minPrecompressSize is the minimum size of the files that are
+	// precompressed, since compressing smaller ones saves nothing.
+	minPrecompressSize = 1 << 10
+)
+
+// precompressedExtensions are the extensions of the files that are
+// precompressed. The rest of files, such as images or fonts, are already
+// compressed.
+var precompressedExtensions = map[string]bool{
+	".html": true,
+	".htm":  true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".svg":  true,
+	".xml":  true,
+	".txt":  true,
+}
+
+// precompressedEncodings are the encodings of the precompressed variants of
+// the files, in order of preference, along with their extensions.
+var precompressedEncodings = []struct {
+	name, ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressSite writes a gzip and a brotli variant, with the .gz and .br
+// extensions, of every text file of the site in the given root folder,
+// except its download folder, so they can be served compressed without
+// compressing them on every request. The brotli variants are written with
+// the given command, which receives the file as argument, and are skipped
+// if it fails. Variants that are not smaller than the file are removed.
+func precompressSite(conf buildConfig) error {
+	root := conf.destination
+	args := strings.Fields(conf.brotliCommand)
+	if len(args) == 0 {
+		args = strings.Fields(defaultBrotliCommand)
+	}
+
+	brotli := true
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		// the variants removed while walking the folder are skipped.
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && path == filepath.Join(root, downloadFolder) {
+			return filepath.SkipDir
+		}
+
+		if !fi.Mode().IsRegular() || fi.Size() < minPrecompressSize ||
+			!precompressedExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		if err := gzipFile(path); err != nil {
+			return wrap(err, "error compressing %q", path)
+		}
+		keepIfSmaller(path+".gz", fi)
+
+		if brotli {
+			if err := os.Remove(path + ".br"); err != nil && !os.IsNotExist(err) {
+				return wrap(err, "error compressing %q", path)
+			}
+
+			cmd := exec.Command(args[0], append(args[1:], path)...)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				conf.log().Warnf("could not compress files with brotli: %s: %s", err, output)
+				os.Remove(path + ".br")
+				brotli = false
+				return nil
+			}
+			keepIfSmaller(path+".br", fi)
+		}
+
+		return nil
+	})
+}
+
+// gzipFile writes the given file compressed with gzip to a file with the
+// same name and the .gz extension.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// the variant is always a new file, so a symlink left in its place by
+	// the build is replaced instead of followed.
+	if err := os.Remove(path + ".gz"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(gw, in); err != nil {
+		return err
+	}
+
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// keepIfSmaller removes the given compressed variant of the file with the
+// given info unless it's smaller, and gives it the same modification time
+// otherwise.
+func keepIfSmaller(variant string, fi os.FileInfo) {
+	vfi, err := os.Stat(variant)
+	if err != nil {
+		return
+	}
+
+	if vfi.Size() >= fi.Size() {
+		os.Remove(variant)
+		return
+	}
+
+	os.Chtimes(variant, fi.ModTime(), fi.ModTime())
+}
+
+// precompressedVariant returns the path, encoding and info of the
+// precompressed variant of the given file accepted by the request. The info
+// is nil if there is none.
+func precompressedVariant(r *http.Request, file string) (string, string, os.FileInfo) {
+	for _, enc := range precompressedEncodings {
+		if !acceptsEncoding(r, enc.name) {
+			continue
+		}
+
+		if fi, err := os.Stat(file + enc.ext); err == nil && fi.Mode().IsRegular() {
+			return file + enc.ext, enc.name, fi
+		}
+	}
+
+	return "", "", nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// accepts the given encoding with a quality greater than 0.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name != encoding && name != "*" {
+				continue
+			}
+
+			accepted := true
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// contentType returns the content type of the given file according to its
+// extension, or an empty string if it's unknown.
+func contentType(file string) string {
+	return mime.TypeByExtension(filepath.Ext(file))
+}
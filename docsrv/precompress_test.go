@@ -0,0 +1,147 @@
+package docsrv
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBrotli is a brotli command that just copies the file, with some bytes
+// less so it's smaller.
+const fakeBrotli = `#!/bin/sh
+head -c 100 "$1" > "$1.br"
+`
+
+func TestPrecompressSite(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	site := filepath.Join(tmpDir, "site")
+	page := strings.Repeat("<p>docsrv</p>", 200)
+	files := map[string]string{
+		"index.html":          page,
+		"css/main.css":        strings.Repeat("p { color: red; }\n", 100),
+		"small.js":            "var a = 1;",
+		"logo.png":            page,
+		"download/index.html": page,
+	}
+	for name, content := range files {
+		path := filepath.Join(site, name)
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	brotli := filepath.Join(tmpDir, "brotli")
+	require.NoError(ioutil.WriteFile(brotli, []byte(fakeBrotli), 0755))
+
+	// the variants left by the build are replaced, not followed
+	victim := filepath.Join(tmpDir, "victim")
+	require.NoError(ioutil.WriteFile(victim, []byte("victim"), 0644))
+	require.NoError(os.Symlink(victim, filepath.Join(site, "css/main.css.gz")))
+
+	conf := buildConfig{destination: site, brotliCommand: brotli}
+	require.NoError(precompressSite(conf))
+
+	data, err := ioutil.ReadFile(victim)
+	require.NoError(err)
+	require.Equal("victim", string(data))
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(site, name))
+		return err == nil
+	}
+	require.True(exists("index.html.gz"))
+	require.True(exists("index.html.br"))
+	require.True(exists("css/main.css.gz"))
+	require.True(exists("css/main.css.br"))
+	require.False(exists("small.js.gz"))
+	require.False(exists("logo.png.gz"))
+	require.False(exists("download/index.html.gz"))
+
+	f, err := os.Open(filepath.Join(site, "index.html.gz"))
+	require.NoError(err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	require.NoError(err)
+	data, err = ioutil.ReadAll(gr)
+	require.NoError(err)
+	require.Equal(page, string(data))
+
+	// the brotli variants are skipped if the command fails
+	require.NoError(os.Remove(filepath.Join(site, "index.html.br")))
+	conf.brotliCommand = "false"
+	require.NoError(precompressSite(conf))
+	require.True(exists("index.html.gz"))
+	require.False(exists("index.html.br"))
+}
+
+func TestServeStatic_Precompressed(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "foo.bar", "v1.0.0")
+	require.NoError(os.MkdirAll(dir, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("plain"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "index.html.gz"), []byte("gzip"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "index.html.br"), []byte("br"), 0644))
+
+	srv := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.ServeStatic = true
+
+	cases := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"", "", "plain"},
+		{"gzip, deflate", "gzip", "gzip"},
+		{"gzip, deflate, br", "br", "br"},
+		{"br;q=0, gzip", "gzip", "gzip"},
+		{"identity", "", "plain"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+		if c.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		require.Equal(http.StatusOK, w.Code, c.acceptEncoding)
+		require.Equal(c.encoding, w.Header().Get("Content-Encoding"), c.acceptEncoding)
+		require.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"), c.acceptEncoding)
+		require.Equal("Accept-Encoding", w.Header().Get("Vary"), c.acceptEncoding)
+		require.Equal(c.body, w.Body.String(), c.acceptEncoding)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	require := require.New(t)
+	req := func(header string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		return r
+	}
+
+	require.True(acceptsEncoding(req("gzip"), "gzip"))
+	require.True(acceptsEncoding(req("deflate, GZIP;q=0.5"), "gzip"))
+	require.True(acceptsEncoding(req("*"), "br"))
+	require.False(acceptsEncoding(req("gzip;q=0"), "gzip"))
+	require.False(acceptsEncoding(req("deflate"), "gzip"))
+	require.False(acceptsEncoding(httptest.NewRequest("GET", "/", nil), "gzip"))
+}
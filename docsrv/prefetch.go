@@ -0,0 +1,89 @@
+package docsrv
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// prefetchQueueSize is the maximum number of versions waiting to be
+// prefetched. Versions are discarded once the queue is full.
+const prefetchQueueSize = 16
+
+// prefetcher builds versions in the background one at a time, so they are
+// already installed when users visit them.
+type prefetcher struct {
+	once    sync.Once
+	queue   chan buildConfig
+	pending sync.Map
+}
+
+func newPrefetcher() *prefetcher {
+	return &prefetcher{queue: make(chan buildConfig, prefetchQueueSize)}
+}
+
+// prefetchAdjacent schedules the background build of the versions right
+// before and after the given one, if they are not installed yet.
+func (s *Service) prefetchAdjacent(r *http.Request, owner, project, version string) {
+	releases := s.releasesForHost(r.Host, owner, project)
+	for i, rel := range releases {
+		if rel.tag != version {
+			continue
+		}
+
+		if i > 0 {
+			s.prefetch(s.newBuildConfig(r, owner, project, releases[i-1]))
+		}
+
+		if i < len(releases)-1 {
+			s.prefetch(s.newBuildConfig(r, owner, project, releases[i+1]))
+		}
+		return
+	}
+}
+
+// prefetch schedules the background build of the version with the given
+// configuration, unless it's already installed or scheduled, or its project
+// is frozen.
+func (s *Service) prefetch(conf buildConfig) {
+	p := s.prefetcher
+	p.once.Do(func() { go s.runPrefetcher() })
+
+	key := newKey(conf.owner, conf.project, conf.version)
+	if s.index.isInstalled(conf.owner, conf.project, conf.version) {
+		return
+	}
+
+	if projectConf, _ := s.config().ForProject(conf.owner, conf.project); projectConf.Frozen {
+		return
+	}
+
+	if failure, ok := s.failures.get(conf.owner, conf.project, conf.version); ok && failure.backingOff() {
+		return
+	}
+
+	if _, ok := p.pending.LoadOrStore(key, true); ok {
+		return
+	}
+
+	select {
+	case p.queue <- conf:
+		conf.log().Debug("version scheduled for prefetch")
+	default:
+		p.pending.Delete(key)
+		conf.log().Debug("prefetch queue is full, version discarded")
+	}
+}
+
+// runPrefetcher builds the scheduled versions one at a time. They are built
+// the same way as the preheated ones, holding the lock of the version, so
+// they are never built at the same time as by a request or another instance.
+func (s *Service) runPrefetcher() {
+	for conf := range s.prefetcher.queue {
+		conf.log().Debug("prefetching version")
+		if _, err := s.preheatVersion(context.Background(), conf); err != nil {
+			conf.log().Errorf("error prefetching version: %s", err)
+		}
+		s.prefetcher.pending.Delete(newKey(conf.owner, conf.project, conf.version))
+	}
+}
@@ -0,0 +1,104 @@
+package docsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchAdjacent(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	for _, v := range []string{"v1.0.0", "v1.1.0", "v1.2.0", "v1.3.0"} {
+		fetcher.add("bar", "foo", v, url)
+	}
+
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", PrefetchAdjacent: true},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	assertRedirect(t, srv, "http://foo.bar/v1.1.0/", "http://foo.bar/v1.1.0/")
+
+	require.Eventually(func() bool {
+		return srv.index.isInstalled("bar", "foo", "v1.0.0") &&
+			srv.index.isInstalled("bar", "foo", "v1.2.0")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(srv.index.isInstalled("bar", "foo", "v1.3.0"))
+
+	assertMakefileOutput(t,
+		srv.versionFolder("bar", "foo", "v1.2.0"),
+		"http://foo.bar/v1.2.0/",
+		"foo",
+		"bar",
+		"v1.2.0",
+	)
+}
+
+func TestPrefetchAdjacent_Disabled(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", url)
+
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	assertRedirect(t, srv, "http://foo.bar/v1.1.0/", "http://foo.bar/v1.1.0/")
+	time.Sleep(50 * time.Millisecond)
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+}
+
+func TestPrefetch_Locked(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	r, err := srv.preheatRequest("foo.bar", ProjectConfig{})
+	require.NoError(err)
+	conf := srv.newBuildConfig(r, "bar", "foo", &release{tag: "v1.0.0", url: url})
+
+	// the version is installed while the prefetcher waits for its lock
+	unlock, err := srv.coordinator.Lock(context.Background(), newKey("bar", "foo", "v1.0.0"))
+	require.NoError(err)
+	srv.prefetch(conf)
+	srv.index.install(conf)
+	unlock()
+
+	require.Eventually(func() bool {
+		_, ok := srv.prefetcher.pending.Load(newKey("bar", "foo", "v1.0.0"))
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(int32(0), atomic.LoadInt32(downloads), "installed versions are not prefetched")
+}
@@ -0,0 +1,106 @@
+package docsrv
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// preheat builds in the background, one at a time, all the releases of all
+// the configured projects that are not installed yet, so users never have to
+// wait for a build. It stops once all of them are built or the given context
+// is cancelled.
+func (s *Service) preheat(ctx context.Context) {
+	conf := s.config()
+	var hosts []string
+	for host := range conf {
+		hosts = append(hosts, host)
+	}
+	// the projects served in several hosts are built with the base URL of
+	// the first one.
+	sort.Strings(hosts)
+
+	logrus.Info("preheating the docs of all the releases")
+	var built, failed int
+	for _, host := range hosts {
+		owner, project, ok := conf.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		log := logrus.WithFields(logrus.Fields{"project": project, "owner": owner})
+		if err := s.ensureIndexed("", owner, project); err != nil {
+			log.Errorf("error indexing project to preheat it: %s", err)
+			continue
+		}
+
+		r, err := s.preheatRequest(host, conf[host])
+		if err != nil {
+			log.Errorf("error preheating project: %s", err)
+			continue
+		}
+
+		for _, release := range s.releasesForHost(host, owner, project) {
+			if ctx.Err() != nil {
+				logrus.Info("preheat cancelled")
+				return
+			}
+
+			ok, err := s.preheatVersion(ctx, s.newBuildConfig(r, owner, project, release))
+			if err != nil {
+				failed++
+			} else if ok {
+				built++
+			}
+		}
+	}
+
+	logrus.Infof("preheat finished, %d versions built, %d failed", built, failed)
+}
+
+// preheatRequest returns a request to the given host with the given config,
+// used to build the versions of its project outside of any request with the
+// public scheme of the host.
+func (s *Service) preheatRequest(host string, conf ProjectConfig) (*http.Request, error) {
+	scheme := s.opts.PublicScheme
+	if conf.ForceHTTPS {
+		scheme = "https"
+	} else if scheme == "" {
+		scheme = "http"
+	}
+	return http.NewRequest("GET", scheme+"://"+host+"/", nil)
+}
+
+// preheatVersion builds the version with the given configuration unless it's
+// already installed, either by this instance, another one or before docsrv
+// started, or it's being built by a request. Reports whether or not it was
+// built.
+func (s *Service) preheatVersion(ctx context.Context, conf buildConfig) (bool, error) {
+	unlock, err := s.coordinator.Lock(ctx, newKey(conf.owner, conf.project, conf.version))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if s.index.isInstalled(conf.owner, conf.project, conf.version) ||
+		s.installedByPeer(conf) || isDir(conf.destination) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(conf.destination), 0740); err != nil {
+		conf.log().Errorf("could not build folder structure for project: %s", err)
+		return false, err
+	}
+
+	conf.log().Debug("preheating version")
+	// the version is built in a temporary folder as a rebuild, so it's not
+	// served until it's finished.
+	if err := s.rebuild(conf); err != nil {
+		return false, err
+	}
+	return true, nil
+}
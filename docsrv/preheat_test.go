@@ -0,0 +1,78 @@
+package docsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreheatRequest(t *testing.T) {
+	require := require.New(t)
+	srv := newTestSrv(newMockFetcher(), Config{})
+
+	cases := []struct {
+		publicScheme string
+		forceHTTPS   bool
+		expected     string
+	}{
+		{"", false, "http://foo.bar/"},
+		{"", true, "https://foo.bar/"},
+		{"https", false, "https://foo.bar/"},
+		{"http", true, "https://foo.bar/"},
+	}
+
+	for _, c := range cases {
+		srv.opts.PublicScheme = c.publicScheme
+		r, err := srv.preheatRequest("foo.bar", ProjectConfig{ForceHTTPS: c.forceHTTPS})
+		require.NoError(err)
+		require.Equal(c.expected, r.URL.String())
+		require.Equal(strings.TrimSuffix(c.expected, "foo.bar/"), reqScheme(r)+"://")
+	}
+}
+
+func TestPreheat(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+	failingURL, closeFailing := tarGzServerWithMakefile(failingMakefile)
+	defer closeFailing()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	fetcher.add("bar", "foo", "v1.2.0", failingURL)
+	fetcher.add("bar", "baz", "v2.0.0", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo", MinVersion: "v1.1.0"},
+		"baz.bar": ProjectConfig{Repository: "bar/baz", ForceHTTPS: true},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	// versions installed before a restart are not built again
+	installed := filepath.Join(tmpDir, "bar", "baz", "v2.0.0")
+	require.NoError(os.MkdirAll(installed, 0755))
+
+	srv.preheat(context.Background())
+
+	require.Equal(int32(1), *downloads)
+	require.True(srv.index.isInstalled("bar", "foo", "v1.1.0"))
+	assertMakefileOutput(t, filepath.Join(tmpDir, "bar", "foo", "v1.1.0"), "http://foo.bar/v1.1.0/", "foo", "bar", "v1.1.0")
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	require.False(srv.index.isInstalled("bar", "foo", "v1.2.0"))
+	require.False(isDir(filepath.Join(tmpDir, "bar", "foo", "v1.2.0")))
+	require.False(srv.index.isInstalled("bar", "baz", "v2.0.0"))
+
+	// once preheated, nothing is built again
+	srv.preheat(context.Background())
+	require.Equal(int32(1), *downloads)
+}
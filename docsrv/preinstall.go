@@ -0,0 +1,93 @@
+package docsrv
+
+import (
+	"context"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Preinstall builds, one at a time, the versions in the Preinstall option of
+// the configured projects that are not installed yet, which are either
+// releases or branches. It's meant to be called before docsrv starts serving
+// requests, so the key versions of the projects are available as soon as
+// it's deployed. The versions that can not be built are logged and skipped,
+// so they are built on demand later. It stops if the given context is
+// cancelled.
+func (s *Service) Preinstall(ctx context.Context) {
+	conf := s.config()
+	var hosts []string
+	for host, projectConf := range conf {
+		if len(projectConf.Preinstall) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	if len(hosts) == 0 {
+		return
+	}
+
+	logrus.Info("preinstalling versions")
+	var built, failed int
+	for _, host := range hosts {
+		owner, project, ok := conf.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		log := logrus.WithFields(logrus.Fields{"project": project, "owner": owner})
+		if err := s.ensureIndexed("", owner, project); err != nil {
+			log.WithField("alert", true).Errorf("error indexing project to preinstall its versions: %s", err)
+			failed += len(conf[host].Preinstall)
+			continue
+		}
+
+		r, err := s.preheatRequest(host, conf[host])
+		if err != nil {
+			log.Errorf("error preinstalling versions of project: %s", err)
+			continue
+		}
+
+		releases := s.releasesForHost(host, owner, project)
+		for _, version := range conf[host].Preinstall {
+			if ctx.Err() != nil {
+				logrus.Info("preinstall cancelled")
+				return
+			}
+
+			release := findRelease(releases, version)
+			if release == nil && conf[host].hasBranch(version) {
+				release = findRelease(s.index.branchesForProject(owner, project), version)
+			}
+
+			if release == nil {
+				log.WithField("version", version).Warn("version to preinstall not found")
+				failed++
+				continue
+			}
+
+			ok, err := s.preheatVersion(ctx, s.newBuildConfig(r, owner, project, release))
+			if err != nil {
+				log.WithField("version", version).WithField("alert", true).
+					Errorf("error preinstalling version: %s", err)
+				failed++
+			} else if ok {
+				built++
+			}
+		}
+	}
+
+	logrus.Infof("preinstall finished, %d versions built, %d failed", built, failed)
+}
+
+// findRelease returns the release with the given tag, or nil if there is
+// none.
+func findRelease(releases []*release, tag string) *release {
+	for _, r := range releases {
+		if r.tag == tag {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package docsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreinstall(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	fetcher.add("bar", "foo", "v2.0.0", url)
+	fetcher.add("bar", "baz", "v1.0.0", url)
+	fetcher.addBranch("bar", "foo", "master", url, "abc")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{
+			Repository: "bar/foo",
+			Branches:   []string{"master"},
+			Preinstall: []string{"v1.1.0", "v2.0.0", "v3.0.0", "master"},
+		},
+		"baz.bar": ProjectConfig{Repository: "bar/baz"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	srv.Preinstall(context.Background())
+
+	require.Equal(int32(3), *downloads)
+	require.True(srv.index.isInstalled("bar", "foo", "v1.1.0"))
+	require.True(srv.index.isInstalled("bar", "foo", "v2.0.0"))
+	require.True(srv.index.isInstalled("bar", "foo", "master"))
+	assertMakefileOutput(t, filepath.Join(tmpDir, "bar", "foo", "v2.0.0"), "http://foo.bar/v2.0.0/", "foo", "bar", "v2.0.0")
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	require.False(srv.index.isInstalled("bar", "baz", "v1.0.0"))
+
+	// once preinstalled, nothing is built again
+	srv.Preinstall(context.Background())
+	require.Equal(int32(3), *downloads)
+}
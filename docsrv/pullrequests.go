@@ -0,0 +1,278 @@
+package docsrv
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/google/go-github/github"
+)
+
+const pullRequestPrefix = "pr-"
+
+var pullRequestVersionRegexp = regexp.MustCompile(`^pr-([0-9]+)$`)
+
+// pullRequestVersion returns the version name under which the documentation
+// of the given pull request is served.
+func pullRequestVersion(number int) string {
+	return pullRequestPrefix + strconv.Itoa(number)
+}
+
+// pullRequestNumber returns the number of the pull request whose docs are
+// served under the given version name, if any.
+func pullRequestNumber(version string) (int, bool) {
+	m := pullRequestVersionRegexp.FindStringSubmatch(version)
+	if m == nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// redirectToPullRequest is an HTTP handler that will redirect requests to
+// /pr/${NUMBER}/${PATH} to /pr-${NUMBER}/${PATH}, which is where the preview
+// of the docs of a pull request are installed.
+func (s *Service) redirectToPullRequest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/pr/"), "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	var path string
+	if len(parts) > 1 {
+		path = parts[1]
+	}
+
+	url := urlFor(r, pullRequestVersion(n), path)
+	if path == "" {
+		url = ensureEndingSlash(url)
+	}
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+// trustsPullRequest reports whether the docs of the given pull request of
+// the given project can be built: its head must be in the repository of the
+// project, or its author or any of its labels must be allowed.
+func (c ProjectConfig) trustsPullRequest(owner, project string, pr *release) bool {
+	if strings.EqualFold(pr.headRepository, owner+"/"+repositoryName(project)) {
+		return true
+	}
+
+	for _, author := range c.PullRequestAuthors {
+		if pr.author != "" && strings.EqualFold(author, pr.author) {
+			return true
+		}
+	}
+
+	for _, label := range c.PullRequestLabels {
+		for _, l := range pr.labels {
+			if l == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pullRequestsEnabled reports whether the previews of the pull requests of
+// the given project are built. They run the code of the pull requests, so
+// they are only built as the BuildUser.
+func (s *Service) pullRequestsEnabled(owner, project string) bool {
+	conf, ok := s.config().ForProject(owner, project)
+	return ok && conf.PullRequests && s.sandbox != nil
+}
+
+// indexPullRequest fetches the given pull request and adds it to the index
+// if it's open and trusted. Will report whether or not the pull request is
+// open and trusted.
+func (s *Service) indexPullRequest(owner, project string, number int) (bool, error) {
+	if !s.pullRequestsEnabled(owner, project) {
+		return false, nil
+	}
+
+	if err := s.checkRateLimit(owner, project); err != nil {
+		return false, err
+	}
+
+	pr, open, err := s.fetcherFor(owner, project).pullRequest(owner, repositoryName(project), number)
+	if err != nil {
+		s.recordRateLimit(owner, project, err)
+		return false, err
+	}
+
+	if !open {
+		s.removePullRequest(owner, project, number)
+		return false, nil
+	}
+
+	if conf, _ := s.config().ForProject(owner, project); !conf.trustsPullRequest(owner, project, pr) {
+		logrus.WithFields(logrus.Fields{
+			"project": project,
+			"owner":   owner,
+			"pr":      number,
+			"head":    pr.headRepository,
+			"author":  pr.author,
+		}).Warn("pull request from a fork that is not allowed, not building it")
+		s.removePullRequest(owner, project, number)
+		return false, nil
+	}
+
+	s.index.add(owner, project, pr)
+	_, rebuilding := s.rebuilding.Load(newKey(owner, project, pr.tag))
+	if installed, ok := s.index.installation(owner, project, pr.tag); ok && installed.sha != pr.sha && !rebuilding {
+		installed.tarballURL = pr.url
+		installed.sha = pr.sha
+		go s.rebuildIf(context.Background(), installed, s.pullRequestOutdated(owner, project, pr))
+	}
+
+	return true, nil
+}
+
+// pullRequestOutdated returns a condition that reports whether the docs of
+// the given pull request are not built from its head yet, which is checked
+// again once the lock of the version is taken, so a webhook and a refresh
+// never build it at the same time.
+func (s *Service) pullRequestOutdated(owner, project string, pr *release) func() bool {
+	return func() bool {
+		installed, ok := s.index.installation(owner, project, pr.tag)
+		return !ok || installed.sha != pr.sha
+	}
+}
+
+// buildPullRequest builds in the background the docs of the given indexed
+// pull request for the first host of its project, unless they are already
+// installed.
+func (s *Service) buildPullRequest(owner, project string, number int) {
+	version := pullRequestVersion(number)
+	pr := s.index.get(owner, project, version)
+	hosts := s.config().HostsForProject(owner, project)
+	if pr == nil || len(hosts) == 0 || s.index.isInstalled(owner, project, version) {
+		return
+	}
+
+	r, err := s.preheatRequest(hosts[0], s.config()[hosts[0]])
+	if err == nil {
+		err = s.linkHost(hosts[0], owner, project)
+	}
+
+	if err != nil {
+		logrus.Errorf("error building pull request %d of %s/%s: %s", number, owner, project, err)
+		return
+	}
+
+	conf := s.newBuildConfig(r, owner, project, pr)
+	go func() {
+		if _, err := s.rebuildIf(context.Background(), conf, s.pullRequestOutdated(owner, project, pr)); err != nil {
+			conf.log().Errorf("error building pull request: %s", err)
+		}
+	}()
+}
+
+// refreshPullRequests refreshes the installed pull requests of the given
+// project, so their docs are rebuilt if they changed or removed if they were
+// closed even if no webhook is received.
+func (s *Service) refreshPullRequests(owner, project string) {
+	for _, v := range s.index.installedVersions(owner, project) {
+		n, ok := pullRequestNumber(v)
+		if !ok {
+			continue
+		}
+
+		if _, err := s.indexPullRequest(owner, project, n); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"project": project,
+				"owner":   owner,
+				"pr":      n,
+			}).Errorf("error refreshing pull request: %s", err)
+		}
+	}
+}
+
+// removePullRequest removes the given pull request from the index along with
+// its installed docs, if any.
+func (s *Service) removePullRequest(owner, project string, number int) {
+	version := pullRequestVersion(number)
+	if conf, ok := s.index.installation(owner, project, version); ok {
+		if err := os.RemoveAll(conf.destination); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"project": project,
+				"owner":   owner,
+				"version": version,
+			}).Errorf("could not remove docs of closed pull request: %s", err)
+		}
+		s.sizes.forget(conf.destination)
+		s.pages.forget(conf.destination)
+		s.hashes.forget(conf.destination)
+	}
+
+	s.index.remove(owner, project, version)
+	s.search.remove(owner, project, version)
+	s.writeState()
+}
+
+// pullRequestWebhook is an HTTP handler that receives the pull request events
+// of GitHub webhooks to build the previews of pull requests, keep them up to
+// date and remove them once the pull requests are closed.
+func (s *Service) pullRequestWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || s.opts.WebhookSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	payload, err := github.ValidatePayload(r, []byte(s.opts.WebhookSecret))
+	if err != nil {
+		requestLog(r).Warnf("received an invalid webhook payload: %s", err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	e, ok := event.(*github.PullRequestEvent)
+	if !ok || e.Repo == nil || e.Number == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	parts := strings.Split(maybeStr(e.Repo.FullName), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	owner, repo := parts[0], parts[1]
+
+	// the repositories with the docs of several projects update all of them.
+	status := http.StatusNoContent
+	for _, project := range s.config().ProjectsForRepository(owner, repo) {
+		log := projectLog(r, owner, project).WithFields(logrus.Fields{
+			"pr":     *e.Number,
+			"action": maybeStr(e.Action),
+		})
+
+		if maybeStr(e.Action) == "closed" {
+			log.Debug("pull request closed, removing its docs")
+			s.removePullRequest(owner, project, *e.Number)
+		} else if ok, err := s.indexPullRequest(owner, project, *e.Number); err != nil {
+			log.Errorf("error indexing pull request: %s", err)
+			status = http.StatusInternalServerError
+		} else if ok {
+			s.buildPullRequest(owner, project, *e.Number)
+		}
+	}
+
+	w.WriteHeader(status)
+}
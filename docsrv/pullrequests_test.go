@@ -0,0 +1,208 @@
+package docsrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullRequestNumber(t *testing.T) {
+	cases := []struct {
+		version string
+		number  int
+		ok      bool
+	}{
+		{"pr-123", 123, true},
+		{"pr-1", 1, true},
+		{"pr-", 0, false},
+		{"pr-12a", 0, false},
+		{"v1.0.0", 0, false},
+	}
+
+	for _, c := range cases {
+		n, ok := pullRequestNumber(c.version)
+		require.Equal(t, c.ok, ok, c.version)
+		require.Equal(t, c.number, n, c.version)
+	}
+}
+
+func newPullRequestTestSrv(t *testing.T, fetcher *mockFetcher, tmpDir string) *Service {
+	if os.Getuid() != 0 {
+		t.Skip("pull requests are only built as another user, which requires root")
+	}
+
+	sandbox, err := newBuildSandbox("65000:65000")
+	require.NoError(t, err)
+
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{
+			Repository:        "bar/foo",
+			PullRequests:      true,
+			PullRequestLabels: []string{"safe to build"},
+		},
+		"baz.bar.baz": ProjectConfig{Repository: "bar/baz"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.WebhookSecret = "secret"
+	srv.opts.RefreshToken = "admin"
+	srv.sandbox = sandbox
+	return srv
+}
+
+func TestPullRequests(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	srv := newPullRequestTestSrv(t, fetcher, tmpDir)
+
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.addPullRequest("bar", "foo", 12, url, "1234", true)
+	fetcher.addPullRequest("bar", "baz", 12, url, "1234", true)
+
+	assertRedirect(
+		t, srv,
+		"http://foo.bar.baz/pr/12/",
+		"http://foo.bar.baz/pr-12/",
+	)
+
+	// visitors never build the previews, only administrators and webhooks
+	assertNotFound(t, srv, "http://foo.bar.baz/pr-12/")
+	require.False(srv.index.isInstalled("bar", "foo", "pr-12"))
+
+	assertRedirect(
+		t, srv,
+		"http://foo.bar.baz/pr-12/?token=admin",
+		"http://foo.bar.baz/pr-12/?token=admin",
+	)
+
+	destination := filepath.Join(tmpDir, "foo.bar.baz", "pr-12")
+	assertMakefileOutput(t, destination, "http://foo.bar.baz/pr-12/", "foo", "bar", "pr-12")
+
+	// projects without pull requests enabled don't build them
+	assertNotFound(t, srv, "http://baz.bar.baz/pr-12/?token=admin")
+
+	// a new head is not built while the pull request is being rebuilt
+	fetcher.addPullRequest("bar", "foo", 12, url, "5678", true)
+	srv.rebuilding.Store(newKey("bar", "foo", "pr-12"), true)
+	_, err = srv.indexPullRequest("bar", "foo", 12)
+	require.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	conf, _ := srv.index.installation("bar", "foo", "pr-12")
+	require.Equal("1234", conf.sha)
+
+	srv.rebuilding.Delete(newKey("bar", "foo", "pr-12"))
+	_, err = srv.indexPullRequest("bar", "foo", 12)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		conf, _ := srv.index.installation("bar", "foo", "pr-12")
+		return conf.sha == "5678"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	payload := []byte(`{"action":"closed","number":12,"repository":{"full_name":"bar/foo"}}`)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, newWebhookRequest(t, payload, "wrong"))
+	require.Equal(http.StatusForbidden, w.Code)
+	require.True(isDir(destination))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, newWebhookRequest(t, payload, "secret"))
+	require.Equal(http.StatusNoContent, w.Code)
+	require.False(isDir(destination))
+	require.Nil(srv.index.get("bar", "foo", "pr-12"))
+	require.False(srv.index.isInstalled("bar", "foo", "pr-12"))
+}
+
+func TestPullRequestWebhook_Forks(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	srv := newPullRequestTestSrv(t, fetcher, tmpDir)
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.addPullRequest("bar", "foo", 12, url, "1234", true)
+	fetcher.addPullRequest("bar", "foo", 13, url, "5678", true)
+	fetcher.addPullRequest("bar", "foo", 14, url, "9abc", true)
+	fetcher.pullRequests["bar/foo/13"].release.headRepository = "someone/foo"
+	fetcher.pullRequests["bar/foo/14"].release.headRepository = "someone/foo"
+	fetcher.pullRequests["bar/foo/14"].release.labels = []string{"docs", "safe to build"}
+
+	for _, n := range []string{"12", "13", "14"} {
+		payload := []byte(`{"action":"opened","number":` + n + `,"repository":{"full_name":"bar/foo"}}`)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, newWebhookRequest(t, payload, "secret"))
+		require.Equal(http.StatusNoContent, w.Code)
+	}
+
+	require.Eventually(func() bool {
+		return srv.index.isInstalled("bar", "foo", "pr-12") && srv.index.isInstalled("bar", "foo", "pr-14")
+	}, 10*time.Second, 10*time.Millisecond)
+	require.False(srv.index.isInstalled("bar", "foo", "pr-13"))
+	require.Nil(srv.index.get("bar", "foo", "pr-13"))
+
+	// the forks are not built by administrators either
+	assertNotFound(t, srv, "http://foo.bar.baz/pr-13/?token=admin")
+}
+
+func TestRefreshPullRequests(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo", PullRequests: true},
+	})
+	srv.sandbox = &buildSandbox{uid: 65000, gid: 65000}
+
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.addPullRequest("bar", "foo", 12, "", "1234", false)
+	srv.index.add("bar", "foo", &release{tag: "pr-12", sha: "1234"})
+	srv.index.install(buildConfig{
+		owner:       "bar",
+		project:     "foo",
+		version:     "pr-12",
+		sha:         "1234",
+		destination: tmpDir,
+	})
+
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.False(srv.index.isInstalled("bar", "foo", "pr-12"))
+	require.False(isDir(tmpDir))
+}
+
+func newWebhookRequest(t *testing.T, payload []byte, secret string) *http.Request {
+	req, err := http.NewRequest("POST", "http://foo.bar.baz/api/webhook", bytes.NewReader(payload))
+	require.NoError(t, err)
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(payload)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "pull_request")
+	req.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
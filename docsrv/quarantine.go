@@ -0,0 +1,302 @@
+package docsrv
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// quarantinePath is the path of the API to manage the quarantined
+	// versions of a project.
+	quarantinePath = "/api/quarantine"
+	// defaultMaxSymlinkDepth is the default maximum number of symlinks that
+	// can be followed from a symlink in the sources of a version.
+	defaultMaxSymlinkDepth = 8
+)
+
+const quarantinedMessage = `The documentation of %s %s can not be built because its sources did not pass the security screening.
+The administrators have been notified.`
+
+// ErrQuarantined is returned when the sources of a version do not pass the
+// screening done before building its docs.
+type ErrQuarantined struct {
+	// Reason is the rule the sources broke.
+	Reason string
+}
+
+func (e *ErrQuarantined) Error() string {
+	return fmt.Sprintf("sources quarantined: %s", e.Reason)
+}
+
+// screeningRules are the rules the sources of a version must follow before
+// its docs are built.
+type screeningRules struct {
+	// maxSymlinkDepth is the maximum number of symlinks that can be followed
+	// from any symlink.
+	maxSymlinkDepth int
+	// forbiddenTypes are the extensions of the files that can not be in the
+	// sources, e.g. ".exe".
+	forbiddenTypes []string
+	// scanCommand is the command, such as a virus scanner, run with the
+	// folder of the sources as its last argument. The sources are
+	// quarantined if it exits with an error.
+	scanCommand string
+}
+
+// screenSources checks that the sources of a version unpacked in the given
+// folder follow the given rules. Symlinks can never point outside of the
+// folder. Returns an *ErrQuarantined if they do not follow them.
+func screenSources(root string, rules screeningRules) error {
+	root = filepath.Clean(root)
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return wrap(err, "error resolving sources folder")
+	}
+
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		mode := fi.Mode()
+		switch {
+		case mode&os.ModeSymlink != 0:
+			return screenSymlink(root, resolvedRoot, path, rel, rules.maxSymlinkDepth)
+		case mode.IsDir():
+			return nil
+		case !mode.IsRegular():
+			return &ErrQuarantined{fmt.Sprintf("%s is not a regular file", rel)}
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		for _, t := range rules.forbiddenTypes {
+			t = strings.ToLower(t)
+			if !strings.HasPrefix(t, ".") {
+				t = "." + t
+			}
+
+			if ext == t {
+				return &ErrQuarantined{fmt.Sprintf("%s has a forbidden file type", rel)}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return scanSources(root, rules.scanCommand)
+}
+
+// screenSymlink follows the symlink at the given path, reporting whether it
+// points outside of the root folder, whose path with its symlinks resolved
+// is the given one, or is followed by too many symlinks.
+func screenSymlink(root, resolvedRoot, path, rel string, maxDepth int) error {
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxSymlinkDepth
+	}
+
+	// the symlinks in the folders of its target can take it anywhere no
+	// matter how its path looks, so it is resolved for real too.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil && !isWithin(resolvedRoot, resolved) {
+		return &ErrQuarantined{fmt.Sprintf("symlink %s points outside of the sources", rel)}
+	}
+
+	for depth := 1; ; depth++ {
+		if depth > maxDepth {
+			return &ErrQuarantined{fmt.Sprintf("symlink %s is followed by more than %d symlinks", rel, maxDepth)}
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+
+		target = filepath.Clean(target)
+		if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return &ErrQuarantined{fmt.Sprintf("symlink %s points outside of the sources", rel)}
+		}
+
+		fi, err := os.Lstat(target)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// dangling symlinks can not be followed outside of the sources
+			return nil
+		}
+		path = target
+	}
+}
+
+// scanSources runs the given scan command on the sources in the given folder.
+func scanSources(root, command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(args[0], append(args[1:], root)...)
+	output, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); ok {
+		return &ErrQuarantined{fmt.Sprintf("%s failed: %s", args[0], tailLines(string(output), 5))}
+	}
+
+	if err != nil {
+		return wrap(err, "error running %s", args[0])
+	}
+
+	return nil
+}
+
+// quarantinedVersion is a version whose sources did not pass the screening.
+type quarantinedVersion struct {
+	Owner       string    `json:"owner"`
+	Project     string    `json:"project"`
+	Version     string    `json:"version"`
+	Reason      string    `json:"reason"`
+	Quarantined time.Time `json:"quarantined"`
+}
+
+// quarantine contains the versions that will not be built until an
+// administrator releases them.
+type quarantine struct {
+	mut      sync.RWMutex
+	versions map[string]*quarantinedVersion
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{versions: make(map[string]*quarantinedVersion)}
+}
+
+func (q *quarantine) add(v *quarantinedVersion) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.versions[newKey(v.Owner, v.Project, v.Version)] = v
+}
+
+func (q *quarantine) get(owner, project, version string) (*quarantinedVersion, bool) {
+	q.mut.RLock()
+	defer q.mut.RUnlock()
+	v, ok := q.versions[newKey(owner, project, version)]
+	return v, ok
+}
+
+// release removes the given version from the quarantine. Reports whether or
+// not it was quarantined.
+func (q *quarantine) release(owner, project, version string) bool {
+	key := newKey(owner, project, version)
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	_, ok := q.versions[key]
+	delete(q.versions, key)
+	return ok
+}
+
+// all returns all the quarantined versions sorted by project and version.
+func (q *quarantine) all() []*quarantinedVersion {
+	q.mut.RLock()
+	defer q.mut.RUnlock()
+
+	result := make([]*quarantinedVersion, 0, len(q.versions))
+	for _, v := range q.versions {
+		result = append(result, v)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return newKey(result[i].Owner, result[i].Project, result[i].Version) <
+			newKey(result[j].Owner, result[j].Project, result[j].Version)
+	})
+	return result
+}
+
+// forProject returns the quarantined versions of the given project sorted by
+// version.
+func (q *quarantine) forProject(owner, project string) []*quarantinedVersion {
+	q.mut.RLock()
+	defer q.mut.RUnlock()
+
+	result := make([]*quarantinedVersion, 0)
+	for _, v := range q.versions {
+		if v.Owner == owner && v.Project == project {
+			result = append(result, v)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+	return result
+}
+
+// quarantineVersion quarantines the version with the given build
+// configuration, whose sources did not pass the screening with the given
+// error, and alerts the administrators. The quarantine is kept in the state
+// manifest, so the version is not built again when docsrv restarts.
+func (s *Service) quarantineVersion(conf buildConfig, err *ErrQuarantined) {
+	s.quarantine.add(&quarantinedVersion{
+		Owner:       conf.owner,
+		Project:     conf.project,
+		Version:     conf.version,
+		Reason:      err.Reason,
+		Quarantined: time.Now(),
+	})
+	s.writeState()
+
+	conf.log().WithFields(logrus.Fields{
+		"alert":       true,
+		"tarball_url": conf.tarballURL,
+	}).Warnf("version quarantined: %s", err.Reason)
+}
+
+// manageQuarantine is an HTTP handler that lists the quarantined versions of
+// the project in the requested host or, with a DELETE request, releases the
+// version in the "version" query string parameter from the quarantine, so it
+// can be built again. Only available to administrators.
+func (s *Service) manageQuarantine(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	switch r.Method {
+	case http.MethodGet:
+		if err := s.writeJSON(w, s.quarantine.forProject(owner, project)); err != nil {
+			log.Errorf("error serving quarantined versions: %s", err)
+			s.internalError(w, r)
+		}
+	case http.MethodDelete:
+		version := r.URL.Query().Get("version")
+		if !s.quarantine.release(owner, project, version) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		s.writeState()
+		log.WithField("version", version).Info("version released from quarantine")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
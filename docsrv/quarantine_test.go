@@ -0,0 +1,179 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScreenSources(t *testing.T) {
+	cases := []struct {
+		name   string
+		setup  func(root string) error
+		rules  screeningRules
+		reason string
+	}{
+		{
+			"valid sources",
+			func(root string) error {
+				return os.Symlink("docs/index.md", filepath.Join(root, "README.md"))
+			},
+			screeningRules{forbiddenTypes: []string{"exe"}},
+			"",
+		},
+		{
+			"absolute symlink outside",
+			func(root string) error {
+				return os.Symlink("/etc/passwd", filepath.Join(root, "docs", "passwd"))
+			},
+			screeningRules{},
+			"symlink docs/passwd points outside of the sources",
+		},
+		{
+			"relative symlink outside",
+			func(root string) error {
+				return os.Symlink("../../secret", filepath.Join(root, "docs", "secret"))
+			},
+			screeningRules{},
+			"symlink docs/secret points outside of the sources",
+		},
+		{
+			"symlink outside through symlinks",
+			func(root string) error {
+				if err := os.Symlink("..", filepath.Join(root, "docs", "up")); err != nil {
+					return err
+				}
+				return os.Symlink("docs/up/docs/up/..", filepath.Join(root, "escape"))
+			},
+			screeningRules{},
+			"symlink escape points outside of the sources",
+		},
+		{
+			"symlink chain",
+			func(root string) error {
+				for _, l := range [][2]string{{"b.link", "a.link"}, {"c.link", "b.link"}, {"docs/index.md", "c.link"}} {
+					if err := os.Symlink(l[0], filepath.Join(root, l[1])); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			screeningRules{maxSymlinkDepth: 2},
+			"symlink a.link is followed by more than 2 symlinks",
+		},
+		{
+			"forbidden file type",
+			func(root string) error {
+				return ioutil.WriteFile(filepath.Join(root, "docs", "setup.EXE"), nil, 0644)
+			},
+			screeningRules{forbiddenTypes: []string{".exe"}},
+			"docs/setup.EXE has a forbidden file type",
+		},
+		{
+			"scan command",
+			func(root string) error { return nil },
+			screeningRules{scanCommand: "false"},
+			"false failed: ",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+			root, err := ioutil.TempDir("", "docsrv-test-")
+			require.NoError(err)
+			defer os.RemoveAll(root)
+
+			require.NoError(os.MkdirAll(filepath.Join(root, "docs"), 0755))
+			require.NoError(ioutil.WriteFile(filepath.Join(root, "docs", "index.md"), nil, 0644))
+			require.NoError(c.setup(root))
+
+			err = screenSources(root, c.rules)
+			if c.reason == "" {
+				require.NoError(err)
+				return
+			}
+
+			require.Equal(&ErrQuarantined{c.reason}, err)
+		})
+	}
+}
+
+func TestScanSources(t *testing.T) {
+	require := require.New(t)
+	require.NoError(scanSources("/tmp", "true"))
+	require.Equal(&ErrQuarantined{"false failed: "}, scanSources("/tmp", "false"))
+
+	err := scanSources("/tmp", "docsrv-missing-scanner")
+	require.Error(err)
+	_, ok := err.(*ErrQuarantined)
+	require.False(ok, "scanners that can not be run do not quarantine the version")
+}
+
+func TestQuarantine(t *testing.T) {
+	require := require.New(t)
+	url, downloads, close := countingTarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+	srv.opts.ScanCommand = "false"
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+		require.Equal(http.StatusForbidden, w.Code)
+		require.Contains(w.Body.String(), "did not pass the security screening")
+	}
+	require.Equal(int32(1), atomic.LoadInt32(downloads), "quarantined versions are not downloaded again")
+
+	restored := func() bool {
+		restarted := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+		restarted.opts.BaseFolder = tmpDir
+		restarted.restoreState()
+		_, ok := restarted.quarantine.get("bar", "foo", "v1.0.0")
+		return ok
+	}
+	require.True(restored(), "the quarantine is kept when docsrv restarts")
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/quarantine", nil))
+	require.Equal(http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/quarantine?token=admin", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	var versions []*quarantinedVersion
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &versions))
+	require.Len(versions, 1)
+	require.Equal("v1.0.0", versions[0].Version)
+	require.Equal("false failed: ", versions[0].Reason)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("DELETE", "http://foo.bar/api/quarantine?token=admin&version=v2.0.0", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("DELETE", "http://foo.bar/api/quarantine?token=admin&version=v1.0.0", nil))
+	require.Equal(http.StatusNoContent, w.Code)
+	require.False(restored())
+
+	srv.opts.ScanCommand = "true"
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+}
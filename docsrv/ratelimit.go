@@ -0,0 +1,141 @@
+package docsrv
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// rateLimits keeps the time until which the GitHub tokens are rate limited,
+// so the GitHub API is not called again before the limits are reset.
+type rateLimits struct {
+	mut sync.Mutex
+	// resets are the times the rate limits will be reset, by the key of the
+	// project whose own token is limited, or by "" for the global token.
+	resets map[string]time.Time
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{resets: make(map[string]time.Time)}
+}
+
+// until returns the time until which the token with the given key is rate
+// limited. Will also report whether or not it's still limited.
+func (l *rateLimits) until(key string) (time.Time, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	reset, ok := l.resets[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if !time.Now().Before(reset) {
+		delete(l.resets, key)
+		return time.Time{}, false
+	}
+	return reset, true
+}
+
+// limit records that the token with the given key is rate limited until the
+// given time. Will also report whether or not it was not limited already.
+func (l *rateLimits) limit(key string, reset time.Time) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	prev, ok := l.resets[key]
+	l.resets[key] = reset
+	return !ok || !time.Now().Before(prev)
+}
+
+// rateLimitKey returns the key of the token used to fetch the given project:
+// the key of the project if it has its own token, "" if it uses the global
+// GitHub one or the name of its provider if it uses the global one of
+// another provider.
+func (s *Service) rateLimitKey(owner, project string) string {
+	conf, _ := s.config().ForProject(owner, project)
+	if conf.TokenEnv != "" || conf.TokenFile != "" {
+		return newKey(owner, project)
+	}
+
+	if provider := conf.provider(); provider != GitHubProvider {
+		return provider
+	}
+	return ""
+}
+
+// checkRateLimit returns an ErrRateLimited if the token used to fetch the
+// given project is rate limited, so the call to the GitHub API can be
+// skipped until the limit is reset.
+func (s *Service) checkRateLimit(owner, project string) error {
+	if reset, ok := s.rateLimits.until(s.rateLimitKey(owner, project)); ok {
+		return &ErrRateLimited{Reset: reset}
+	}
+	return nil
+}
+
+// recordRateLimit records the rate limit of the token used to fetch the given
+// project if the given error is caused by it, logging it the first time.
+func (s *Service) recordRateLimit(owner, project string, err error) {
+	e, ok := Cause(err).(*ErrRateLimited)
+	if !ok {
+		return
+	}
+
+	key := s.rateLimitKey(owner, project)
+	if s.rateLimits.limit(key, e.Reset) {
+		log := logrus.WithField("reset", e.Reset.Format(time.RFC3339))
+		if key != "" {
+			log = log.WithFields(logrus.Fields{"project": project, "owner": owner})
+		}
+		log.Warn("GitHub API rate limit exceeded, skipping the calls to the API until it's reset")
+	}
+}
+
+var rateLimitedTemplate = template.Must(template.New("ratelimited").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Temporarily unavailable</title>
+</head>
+<body>
+<h1>Temporarily unavailable</h1>
+<p>The documentation{{if .Project}} of {{.Project}}{{end}} can not be fetched right now because the GitHub API rate limit has been exceeded.</p>
+<p>Please retry at {{.RetryAt}}.</p>
+</body>
+</html>
+`))
+
+// rateLimited responds with a 429 status code and a page explaining that the
+// docs can not be fetched until the GitHub API rate limit is reset at the
+// given time.
+func (s *Service) rateLimited(w http.ResponseWriter, r *http.Request, reset time.Time) {
+	retry := int(time.Until(reset).Seconds()) + 1
+	if retry < 1 {
+		retry = 1
+	}
+
+	_, project, _ := s.projectForHost(r.Host)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	if wantsJSON(r) {
+		msg := fmt.Sprintf("the GitHub API rate limit has been exceeded, retry at %s", reset.UTC().Format("15:04 MST"))
+		httpError(w, r, msg, http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	err := rateLimitedTemplate.Execute(w, struct {
+		Project string
+		RetryAt string
+	}{project, reset.UTC().Format("15:04 MST")})
+	if err != nil {
+		requestLog(r).Errorf("error rendering rate limited page: %s", err)
+	}
+}
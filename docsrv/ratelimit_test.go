@@ -0,0 +1,74 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+)
+
+// rateLimitedFetcher is a mockFetcher whose releases are rate limited until
+// the given time, counting the calls made.
+type rateLimitedFetcher struct {
+	*mockFetcher
+	reset time.Time
+	calls int
+}
+
+func (f *rateLimitedFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) ([]*release, error) {
+	f.calls++
+	if time.Now().Before(f.reset) {
+		return nil, wrap(&ErrRateLimited{Reset: f.reset}, "error listing releases of %s/%s", owner, project)
+	}
+	return f.mockFetcher.releases(owner, project, minVersion, maxVersion)
+}
+
+func TestRateLimited(t *testing.T) {
+	require := require.New(t)
+	reset := time.Now().Add(time.Hour)
+	fetcher := &rateLimitedFetcher{mockFetcher: newMockFetcher(), reset: reset}
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "baz", "v1.0.0", "")
+
+	os.Setenv("DOCSRV_TEST_BAZ_TOKEN", "baz")
+	defer os.Unsetenv("DOCSRV_TEST_BAZ_TOKEN")
+
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+		"qux.bar": ProjectConfig{Repository: "bar/qux"},
+		"baz.bar": ProjectConfig{Repository: "bar/baz", TokenEnv: "DOCSRV_TEST_BAZ_TOKEN"},
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	require.Equal(http.StatusTooManyRequests, w.Code)
+	require.Equal("no-store", w.Header().Get("Cache-Control"))
+	retry := w.Header().Get("Retry-After")
+	require.True(retry == "3600" || retry == "3599", retry)
+	require.Contains(w.Body.String(), "retry at "+reset.UTC().Format("15:04 MST"))
+	require.Equal(1, fetcher.calls)
+
+	// the API is not called again until the limit is reset, neither by the
+	// requests nor by the refreshes.
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://qux.bar/v1.0.0/", nil))
+	require.Equal(http.StatusTooManyRequests, w.Code)
+	require.NoError(srv.refreshProject(newKey("bar", "foo")))
+	require.Equal(1, fetcher.calls)
+
+	// the projects with their own token have their own limit
+	require.Error(srv.indexProject("bar", "baz"))
+	require.Equal(2, fetcher.calls)
+
+	fetcher.reset = time.Now()
+	for _, key := range []string{"", newKey("bar", "baz")} {
+		srv.rateLimits.limit(key, time.Now().Add(-time.Second))
+	}
+	require.NoError(srv.indexProject("bar", "foo"))
+	require.NoError(srv.indexProject("bar", "baz"))
+	require.Equal(4, fetcher.calls)
+}
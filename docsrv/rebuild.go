@@ -0,0 +1,94 @@
+package docsrv
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rebuildPrefix is the prefix of the path to force the rebuild of a version,
+// i.e. /api/rebuild/${VERSION}.
+const rebuildPrefix = "/api/rebuild/"
+
+// forceRebuild is an HTTP handler that builds again the version in the path,
+// even if it's already installed, e.g. to apply a fix of the shared templates.
+// The previous docs keep being served until the new ones replace them, and
+// they are kept if the build fails. Once the version is rebuilt, its status
+// is returned. The rebuild holds the lock of the version, so concurrent
+// requests for it are built one after the other. Only available to
+// administrators with a POST request.
+func (s *Service) forceRebuild(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	version := strings.TrimPrefix(r.URL.Path, rebuildPrefix)
+	log := projectLog(r, owner, project).WithField("version", version)
+
+	if err := s.ensureIndexed("", owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	release := s.index.get(owner, project, version)
+	if version == "" || strings.Contains(version, "/") || release == nil {
+		s.notFound(w, r)
+		return
+	}
+
+	if _, ok := s.rebuilding.Load(newKey(owner, project, version)); ok {
+		httpError(w, r, "the version is already being rebuilt", http.StatusConflict)
+		return
+	}
+
+	if err := s.linkHost(stripPort(r.Host), owner, project); err != nil {
+		log.Errorf("could not link host folder: %s", err)
+		s.internalError(w, r)
+		return
+	}
+
+	log.Info("forcing rebuild")
+	markBuild(r)
+	conf := s.newBuildConfig(r, owner, project, release)
+	conf.interactive = true
+	stillReleased := func() bool {
+		return s.index.get(owner, project, version) != nil
+	}
+
+	rebuilt, err := s.rebuildIf(r.Context(), conf, stillReleased)
+	if err != nil {
+		if e, ok := Cause(err).(*ErrBuildFailed); ok {
+			report := newBuildReport(conf, e)
+			s.reports.add(report)
+			s.buildFailed(w, r, report)
+			return
+		}
+
+		s.handleError(w, r, err)
+		return
+	}
+
+	if !rebuilt {
+		s.notFound(w, r)
+		return
+	}
+
+	status, _ := s.versionStatusInfo(owner, project, version)
+	if err := s.writeJSON(w, status); err != nil {
+		log.Errorf("error serving version status: %s", err)
+		s.internalError(w, r)
+	}
+}
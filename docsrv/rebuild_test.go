@@ -0,0 +1,97 @@
+package docsrv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForceRebuild(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+	failingURL, closeFailing := tarGzServerWithMakefile(failingMakefile)
+	defer closeFailing()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	// versions built before a restart are not in the index
+	destination := filepath.Join(tmpDir, "bar", "foo", "v1.0.0")
+	require.NoError(os.MkdirAll(destination, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(destination, "out"), []byte("stale"), 0644))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/rebuild/v1.0.0?token=admin", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	var status versionStatusInfo
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal("v1.0.0", status.Version)
+	require.True(status.Installed)
+	assertMakefileOutput(t, destination, "http://foo.bar/v1.0.0/", "foo", "bar", "v1.0.0")
+
+	// the docs are kept if the rebuild fails
+	fetcher.add("bar", "foo", "v1.0.0", failingURL)
+	require.NoError(srv.indexProject("bar", "foo"))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/rebuild/v1.0.0?token=admin", nil))
+	require.Equal(http.StatusInternalServerError, w.Code)
+	require.Contains(w.Body.String(), "/_build/report")
+	assertMakefileOutput(t, destination, "http://foo.bar/v1.0.0/", "foo", "bar", "v1.0.0")
+
+	cases := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"POST", "http://foo.bar/api/rebuild/v1.0.0", http.StatusForbidden},
+		{"GET", "http://foo.bar/api/rebuild/v1.0.0?token=admin", http.StatusMethodNotAllowed},
+		{"POST", "http://foo.bar/api/rebuild/v2.0.0?token=admin", http.StatusNotFound},
+		{"POST", "http://foo.bar/api/rebuild/?token=admin", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		require.Equal(c.code, w.Code, c.url)
+	}
+
+	// the rebuild waits for the lock of the version
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	require.NoError(srv.indexProject("bar", "foo"))
+	unlock, err := srv.coordinator.Lock(context.Background(), newKey("bar", "foo", "v1.0.0"))
+	require.NoError(err)
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/rebuild/v1.0.0?token=admin", nil))
+		done <- w.Code
+	}()
+
+	select {
+	case <-done:
+		require.FailNow("the rebuild did not wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	require.Equal(http.StatusOK, <-done)
+}
@@ -0,0 +1,208 @@
+package docsrv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// redirectsFile is the file at the root of the built docs of a version
+	// with its redirect rules in TOML.
+	redirectsFile = "redirects.toml"
+	// netlifyRedirectsFile is the file at the root of the built docs of a
+	// version with its redirect rules in the format of Netlify, one rule
+	// per line with the old path, the new path and an optional status.
+	netlifyRedirectsFile = "_redirects"
+	// splat is the placeholder of the target of a rule replaced by the part
+	// of the path matched by the trailing "*" of its source.
+	splat = ":splat"
+)
+
+// redirectRule redirects the requests of a page of a version that does not
+// exist anymore to its new path.
+type redirectRule struct {
+	// From is the old path of the page, relative to the root of the version.
+	// If it ends with "/*", it matches all the paths under it.
+	From string `toml:"from"`
+	// To is the new path of the page, relative to the root of the version,
+	// or an absolute URL.
+	To string `toml:"to"`
+	// Status is the status code of the redirect. Defaults to 301.
+	Status int `toml:"status"`
+}
+
+// validate returns an error if the rule is incomplete or its status is not
+// a redirect, and sets its default status.
+func (r *redirectRule) validate() error {
+	if !strings.HasPrefix(r.From, "/") {
+		return fmt.Errorf("from must be an absolute path: %q", r.From)
+	}
+
+	if r.To == "" {
+		return fmt.Errorf("missing target of %q", r.From)
+	}
+
+	switch r.Status {
+	case 0:
+		r.Status = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid status %d of %q", r.Status, r.From)
+	}
+
+	return nil
+}
+
+// match returns the target of the rule for the given path, relative to the
+// root of the version, if it matches it.
+func (r redirectRule) match(requested string) (string, bool) {
+	if prefix := strings.TrimSuffix(r.From, "*"); prefix != r.From {
+		if !strings.HasPrefix(requested, prefix) {
+			return "", false
+		}
+		return strings.Replace(r.To, splat, strings.TrimPrefix(requested, prefix), -1), true
+	}
+
+	if trimSlash(path.Clean(r.From)) != trimSlash(requested) {
+		return "", false
+	}
+	return r.To, true
+}
+
+func trimSlash(p string) string {
+	if p == "/" {
+		return p
+	}
+	return strings.TrimSuffix(p, "/")
+}
+
+// loadRedirects loads the redirect rules of the docs in the given folder from
+// its redirects.toml and _redirects files. The rules of redirects.toml come
+// first. Invalid rules are skipped and returned as errors along with the
+// valid ones.
+func loadRedirects(root string) ([]redirectRule, []error) {
+	var (
+		rules []redirectRule
+		errs  []error
+	)
+
+	data, err := ioutil.ReadFile(filepath.Join(root, redirectsFile))
+	if err == nil {
+		var file struct {
+			Redirects []redirectRule `toml:"redirects"`
+		}
+		if err := toml.Unmarshal(data, &file); err != nil {
+			errs = append(errs, wrap(err, "invalid %s", redirectsFile))
+		} else {
+			rules = append(rules, file.Redirects...)
+		}
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, wrap(err, "could not read %s", redirectsFile))
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(root, netlifyRedirectsFile))
+	if err == nil {
+		netlifyRules, netlifyErrs := parseNetlifyRedirects(data)
+		rules = append(rules, netlifyRules...)
+		errs = append(errs, netlifyErrs...)
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, wrap(err, "could not read %s", netlifyRedirectsFile))
+	}
+
+	valid := rules[:0]
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		valid = append(valid, r)
+	}
+
+	return valid, errs
+}
+
+// parseNetlifyRedirects parses the rules of a _redirects file. Empty lines and
+// lines starting with # are ignored.
+func parseNetlifyRedirects(data []byte) ([]redirectRule, []error) {
+	var (
+		rules []redirectRule
+		errs  []error
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			errs = append(errs, fmt.Errorf("invalid rule in line %d of %s", n, netlifyRedirectsFile))
+			continue
+		}
+
+		rule := redirectRule{From: fields[0], To: fields[1]}
+		if len(fields) == 3 {
+			status, err := strconv.Atoi(strings.TrimSuffix(fields[2], "!"))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid status in line %d of %s", n, netlifyRedirectsFile))
+				continue
+			}
+			rule.Status = status
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, errs
+}
+
+// loadRedirectRules loads the redirect rules of the version with the given
+// build configuration from its docs, logging the invalid ones.
+func loadRedirectRules(conf buildConfig) []redirectRule {
+	rules, errs := loadRedirects(conf.destination)
+	for _, err := range errs {
+		conf.log().Warnf("skipping redirect rule: %s", err)
+	}
+	return rules
+}
+
+// redirectRulePage returns the URL and status the given missing page of the
+// installed version with the given configuration is redirected to by its
+// redirect rules, if any.
+func redirectRulePage(r *http.Request, conf buildConfig) (string, int, bool) {
+	requested := path.Clean("/" + strings.TrimPrefix(strings.TrimLeft(r.URL.Path, "/"), conf.version))
+	if strings.HasSuffix(r.URL.Path, "/") && requested != "/" {
+		requested += "/"
+	}
+
+	for _, rule := range conf.redirects {
+		target, ok := rule.match(requested)
+		if !ok {
+			continue
+		}
+
+		if strings.Contains(target, "://") {
+			return target, rule.Status, true
+		}
+
+		url := urlFor(r, conf.version, target)
+		if strings.HasSuffix(target, "/") {
+			url = ensureEndingSlash(url)
+		}
+		return url, rule.Status, true
+	}
+
+	return "", 0, false
+}
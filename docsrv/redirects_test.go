@@ -0,0 +1,100 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRedirectsTOML = `
+[[redirects]]
+from = "/guide/install.html"
+to = "/getting-started/install.html"
+
+[[redirects]]
+from = "/old-api/*"
+to = "/api/:splat"
+status = 302
+
+[[redirects]]
+from = "/broken.html"
+to = "/fixed.html"
+status = 200
+`
+
+const testNetlifyRedirects = `
+# moved to the blog
+/changelog.html https://blog.bar/changelog 308
+/faq/ /help/
+/invalid
+`
+
+func TestLoadRedirects(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	rules, errs := loadRedirects(tmpDir)
+	require.Empty(rules)
+	require.Empty(errs)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, redirectsFile), []byte(testRedirectsTOML), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, netlifyRedirectsFile), []byte(testNetlifyRedirects), 0644))
+
+	rules, errs = loadRedirects(tmpDir)
+	require.Equal([]redirectRule{
+		{"/guide/install.html", "/getting-started/install.html", http.StatusMovedPermanently},
+		{"/old-api/*", "/api/:splat", http.StatusFound},
+		{"/changelog.html", "https://blog.bar/changelog", http.StatusPermanentRedirect},
+		{"/faq/", "/help/", http.StatusMovedPermanently},
+	}, rules)
+	require.Len(errs, 2)
+}
+
+func TestRedirectRules(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	srv := newTestSrv(newMockFetcher(), Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	require.NoError(srv.indexProject("bar", "foo"))
+
+	destination := srv.versionFolder("bar", "foo", "v1.0.0")
+	require.NoError(os.MkdirAll(destination, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(destination, redirectsFile), []byte(testRedirectsTOML), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(destination, netlifyRedirectsFile), []byte(testNetlifyRedirects), 0644))
+	srv.markInstalled(buildConfig{
+		owner:       "bar",
+		project:     "foo",
+		version:     "v1.0.0",
+		destination: destination,
+	})
+
+	cases := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"http://foo.bar/v1.0.0/guide/install.html", http.StatusMovedPermanently, "http://foo.bar/v1.0.0/getting-started/install.html"},
+		{"http://foo.bar/v1.0.0/old-api/types/index.html", http.StatusFound, "http://foo.bar/v1.0.0/api/types/index.html"},
+		{"http://foo.bar/v1.0.0/old-api/types/", http.StatusFound, "http://foo.bar/v1.0.0/api/types/"},
+		{"http://foo.bar/v1.0.0/changelog.html", http.StatusPermanentRedirect, "https://blog.bar/changelog"},
+		{"http://foo.bar/v1.0.0/faq", http.StatusMovedPermanently, "http://foo.bar/v1.0.0/help/"},
+		{"http://foo.bar/v1.0.0/broken.html", http.StatusNotFound, ""},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		require.Equal(c.code, w.Code, c.url)
+		require.Equal(c.location, w.Header().Get("Location"), c.url)
+	}
+}
@@ -0,0 +1,296 @@
+package docsrv
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisKeyPrefix is the prefix of all the keys docsrv stores in Redis.
+	redisKeyPrefix = "docsrv:"
+	// redisInstalledKey is the key of the set of installed versions.
+	redisInstalledKey = redisKeyPrefix + "installed"
+	// redisLockTTL is the time a build lock is held if the instance holding
+	// it dies. It's renewed while the build is running.
+	redisLockTTL = 30 * time.Second
+	// redisLockRetry is the time between attempts to acquire a lock.
+	redisLockRetry = 250 * time.Millisecond
+	// redisTimeout is the timeout of every command sent to Redis.
+	redisTimeout = 5 * time.Second
+)
+
+const (
+	// redisUnlockScript deletes the lock only if it's still held with the
+	// given token, so an expired lock acquired by another instance is not
+	// released.
+	redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	// redisRenewScript extends the lock only if it's still held with the
+	// given token.
+	redisRenewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// redisCoordinator is a Coordinator that keeps the locks and the installed
+// versions in Redis.
+type redisCoordinator struct {
+	client *redisClient
+}
+
+// NewRedisCoordinator returns a Coordinator backed by the Redis server at the
+// given URL, e.g. redis://:password@localhost:6379/0.
+func NewRedisCoordinator(rawurl string) (Coordinator, error) {
+	client, err := newRedisClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisCoordinator{client}, nil
+}
+
+func (c *redisCoordinator) Lock(ctx context.Context, key string) (func(), error) {
+	key = redisKeyPrefix + "lock:" + key
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := strconv.FormatInt(int64(redisLockTTL/time.Millisecond), 10)
+	for {
+		reply, err := c.client.do("SET", key, token, "NX", "PX", ttl)
+		if err != nil {
+			return nil, wrap(err, "error acquiring lock")
+		}
+
+		if reply != nil {
+			break
+		}
+
+		select {
+		case <-time.After(redisLockRetry):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(redisLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.client.do("EVAL", redisRenewScript, "1", key, token, ttl)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			c.client.do("EVAL", redisUnlockScript, "1", key, token)
+		})
+	}, nil
+}
+
+func (c *redisCoordinator) MarkInstalled(key string) error {
+	_, err := c.client.do("SADD", redisInstalledKey, key)
+	return err
+}
+
+func (c *redisCoordinator) IsInstalled(key string) (bool, error) {
+	reply, err := c.client.do("SISMEMBER", redisInstalledKey, key)
+	if err != nil {
+		return false, err
+	}
+
+	return reply == int64(1), nil
+}
+
+func newLockToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// redisError is an error reply sent by Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient is a minimal Redis client that sends commands over a single
+// connection, which is reopened when it fails.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	mut  sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisClient(rawurl string) (*redisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, wrap(err, "invalid Redis URL")
+	}
+
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid Redis URL: unsupported scheme %q", u.Scheme)
+	}
+
+	c := &redisClient{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis URL: invalid database %q", db)
+		}
+	}
+
+	return c, nil
+}
+
+// do sends the given command and returns its reply, which is nil, a string,
+// an int64 or a []interface{} of those.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return wrap(err, "error connecting to Redis")
+	}
+
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			conn.Close()
+			c.conn = nil
+			return wrap(err, "error setting up Redis connection")
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.rd)
+}
+
+// readRedisReply reads a reply encoded with the Redis protocol.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = readRedisReply(rd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply %q", line)
+	}
+}
@@ -0,0 +1,203 @@
+package docsrv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is an in-memory server that speaks the subset of the Redis
+// protocol used by redisCoordinator. Keys never expire.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mut  sync.Mutex
+	keys map[string]string
+	sets map[string]map[string]bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	r := &fakeRedis{
+		ln:       ln,
+		password: password,
+		keys:     make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) url() string {
+	if r.password != "" {
+		return fmt.Sprintf("redis://:%s@%s/1", r.password, r.ln.Addr())
+	}
+	return "redis://" + r.ln.Addr().String()
+}
+
+func (r *fakeRedis) close() { r.ln.Close() }
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+
+		if args[0] == "AUTH" {
+			authenticated = args[1] == r.password
+		} else if !authenticated {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		io.WriteString(conn, r.exec(args))
+	}
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	switch args[0] {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		if _, ok := r.keys[args[1]]; ok && len(args) > 3 && args[3] == "NX" {
+			return "$-1\r\n"
+		}
+		r.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EVAL":
+		if r.keys[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		if args[1] == redisUnlockScript {
+			delete(r.keys, args[3])
+		}
+		return ":1\r\n"
+	case "SADD":
+		if r.sets[args[1]] == nil {
+			r.sets[args[1]] = make(map[string]bool)
+		}
+		r.sets[args[1]][args[2]] = true
+		return ":1\r\n"
+	case "SISMEMBER":
+		if r.sets[args[1]][args[2]] {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command '" + strings.ToLower(args[0]) + "'\r\n"
+	}
+}
+
+func TestRedisCoordinator(t *testing.T) {
+	require := require.New(t)
+	server := newFakeRedis(t, "secret")
+	defer server.close()
+
+	c, err := NewRedisCoordinator(server.url())
+	require.NoError(err)
+	other, err := NewRedisCoordinator(server.url())
+	require.NoError(err)
+
+	unlock, err := c.Lock(context.Background(), "bar/foo/v1.0.0")
+	require.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = other.Lock(ctx, "bar/foo/v1.0.0")
+	require.Equal(context.DeadlineExceeded, err)
+
+	otherUnlock, err := other.Lock(context.Background(), "bar/foo/v2.0.0")
+	require.NoError(err)
+	otherUnlock()
+
+	unlock()
+	// unlocking twice does not release the lock of another instance
+	otherUnlock, err = other.Lock(context.Background(), "bar/foo/v1.0.0")
+	require.NoError(err)
+	unlock()
+	server.mut.Lock()
+	require.Len(server.keys, 1)
+	server.mut.Unlock()
+	otherUnlock()
+
+	ok, err := other.IsInstalled("bar/foo/v1.0.0")
+	require.NoError(err)
+	require.False(ok)
+
+	require.NoError(c.MarkInstalled("bar/foo/v1.0.0"))
+	ok, err = other.IsInstalled("bar/foo/v1.0.0")
+	require.NoError(err)
+	require.True(ok)
+}
+
+func TestRedisCoordinator_WrongPassword(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.close()
+
+	c, err := NewRedisCoordinator(strings.Replace(server.url(), "secret", "wrong", 1))
+	require.NoError(t, err)
+
+	_, err = c.IsInstalled("bar/foo/v1.0.0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "NOAUTH")
+}
+
+func TestNewRedisClient(t *testing.T) {
+	cases := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+		err      bool
+	}{
+		{"redis://localhost", "localhost:6379", "", 0, false},
+		{"redis://:pass@redis:6380/2", "redis:6380", "pass", 2, false},
+		{"http://localhost", "", "", 0, true},
+		{"redis://localhost/foo", "", "", 0, true},
+	}
+
+	for _, c := range cases {
+		client, err := newRedisClient(c.url)
+		if c.err {
+			require.Error(t, err, c.url)
+			continue
+		}
+
+		require.NoError(t, err, c.url)
+		require.Equal(t, c.addr, client.addr, c.url)
+		require.Equal(t, c.password, client.password, c.url)
+		require.Equal(t, c.db, client.db, c.url)
+	}
+}
@@ -0,0 +1,177 @@
+package docsrv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultRefreshConcurrency is the default maximum number of projects
+	// refreshed at the same time.
+	defaultRefreshConcurrency = 4
+	// defaultRefreshTimeout is the default maximum time the refresh of a
+	// project can take.
+	defaultRefreshTimeout = time.Minute
+)
+
+// errRefreshTimeout is returned when the refresh of a project takes longer
+// than the refresh timeout.
+type errRefreshTimeout struct {
+	timeout time.Duration
+}
+
+func (e *errRefreshTimeout) Error() string {
+	return fmt.Sprintf("refresh timed out after %s", e.timeout)
+}
+
+// refreshError contains the errors of the projects that could not be
+// refreshed, by project key.
+type refreshError map[string]error
+
+func (e refreshError) Error() string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("%s: %s", k, e[k])
+	}
+
+	return fmt.Sprintf("%d projects could not be refreshed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// refreshIndex refreshes the version index of the projects already installed
+// using a bounded number of workers. A project that takes longer than the
+// refresh timeout does not delay the rest, it keeps being refreshed in the
+// background and is skipped by the next refreshes until it finishes. Will
+// return a refreshError with the errors of all the projects that could not
+// be refreshed, if any.
+func (s *Service) refreshIndex() error {
+	keys := s.index.getProjects()
+	jobs := make(chan string)
+	var (
+		wg   sync.WaitGroup
+		mut  sync.Mutex
+		errs = make(refreshError)
+	)
+
+	for i := 0; i < s.opts.RefreshConcurrency && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				if err := s.refreshProject(key); err != nil {
+					mut.Lock()
+					errs[key] = err
+					mut.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// refreshProject refreshes the project with the given key, waiting for it
+// at most the refresh timeout.
+func (s *Service) refreshProject(key string) error {
+	parts := splitKey(key)
+	if len(parts) != 2 {
+		return fmt.Errorf("not a valid project key")
+	}
+	owner, project := parts[0], parts[1]
+	log := logrus.WithFields(logrus.Fields{"project": project, "owner": owner})
+
+	// the index is kept as it is until the rate limit is reset.
+	if err := s.checkRateLimit(owner, project); err != nil {
+		log.Debugf("skipping refresh: %s", err)
+		return nil
+	}
+
+	if _, running := s.refreshing.LoadOrStore(key, true); running {
+		return fmt.Errorf("the previous refresh has not finished yet")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer s.refreshing.Delete(key)
+		start := time.Now()
+		// the project indexed again from scratch, e.g. after a reload of
+		// the config, has no previous latest releases to compare with.
+		warm := s.index.isIndexed(owner, project)
+		previous := s.latestReleases(owner, project)
+		err := s.indexProject(owner, project)
+		log.WithField("duration", time.Since(start).Seconds()).Debug("project refreshed")
+		if err == nil && warm && s.opts.AutoBuildLatest {
+			s.buildNewLatest(owner, project, previous)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf("error refreshing project: %s", err)
+		}
+		return err
+	case <-time.After(s.opts.RefreshTimeout):
+		log.Warnf("refresh of project is taking longer than %s", s.opts.RefreshTimeout)
+		return &errRefreshTimeout{s.opts.RefreshTimeout}
+	}
+}
+
+// latestReleases returns the latest release of the given project in every
+// host that serves it, by host.
+func (s *Service) latestReleases(owner, project string) map[string]string {
+	result := make(map[string]string)
+	for _, host := range s.config().HostsForProject(owner, project) {
+		if latest := latestRelease(s.releasesForHost(host, owner, project)); latest != nil {
+			result[host] = latest.tag
+		}
+	}
+	return result
+}
+
+// buildNewLatest schedules the background build of the latest release of the
+// given project in every host where it's not the same as in the given ones
+// anymore, so the first users visiting /latest/ after a new release don't
+// need to wait for it to be built. They are built by the prefetcher, holding
+// the lock of the version, so they are never built at the same time by a
+// request or another instance.
+func (s *Service) buildNewLatest(owner, project string, previous map[string]string) {
+	conf := s.config()
+	for _, host := range conf.HostsForProject(owner, project) {
+		latest := latestRelease(s.releasesForHost(host, owner, project))
+		if latest == nil || previous[host] == latest.tag {
+			continue
+		}
+
+		r, err := s.preheatRequest(host, conf[host])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"project": project, "owner": owner}).
+				Errorf("error building new latest release: %s", err)
+			continue
+		}
+
+		build := s.newBuildConfig(r, owner, project, latest)
+		build.log().Infof("new latest release in %s, building it in the background", host)
+		s.prefetch(build)
+	}
+}
@@ -0,0 +1,189 @@
+package docsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+)
+
+// slowFetcher is a mockFetcher that blocks the releases of the "slow"
+// projects until it's released and keeps track of the concurrent calls.
+type slowFetcher struct {
+	*mockFetcher
+	release chan struct{}
+
+	mut        sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (f *slowFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) ([]*release, error) {
+	f.mut.Lock()
+	f.running++
+	if f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+	f.mut.Unlock()
+
+	defer func() {
+		f.mut.Lock()
+		f.running--
+		f.mut.Unlock()
+	}()
+
+	if project == "slow" {
+		<-f.release
+	} else {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return f.mockFetcher.releases(owner, project, minVersion, maxVersion)
+}
+
+func TestRefreshIndex(t *testing.T) {
+	require := require.New(t)
+
+	fetcher := &slowFetcher{mockFetcher: newMockFetcher(), release: make(chan struct{})}
+	config := make(Config)
+	for i := 0; i < 10; i++ {
+		project := fmt.Sprintf("p%d", i)
+		fetcher.add("foo", project, "v1.0.0", "")
+		config[project+".bar"] = ProjectConfig{Repository: "foo/" + project}
+	}
+	fetcher.add("foo", "slow", "v1.0.0", "")
+	config["slow.bar"] = ProjectConfig{Repository: "foo/slow"}
+
+	srv := newTestSrv(fetcher, config)
+	srv.opts.RefreshConcurrency = 3
+	srv.opts.RefreshTimeout = 50 * time.Millisecond
+
+	for host := range config {
+		owner, project, _ := config.ProjectForHost(host)
+		srv.index.set(owner, project, nil)
+	}
+
+	for i := 0; i < 10; i++ {
+		fetcher.add("foo", fmt.Sprintf("p%d", i), "v1.1.0", "")
+	}
+
+	start := time.Now()
+	err := srv.refreshIndex()
+	require.True(time.Since(start) < time.Second, "slow projects do not delay the refresh")
+	require.Error(err)
+	require.Equal(refreshError{"foo/slow": &errRefreshTimeout{50 * time.Millisecond}}, err)
+	require.Equal("1 projects could not be refreshed: foo/slow: refresh timed out after 50ms", err.Error())
+
+	for i := 0; i < 10; i++ {
+		require.Len(srv.index.forProject("foo", fmt.Sprintf("p%d", i)), 2)
+	}
+
+	fetcher.mut.Lock()
+	require.Equal(3, fetcher.maxRunning)
+	fetcher.mut.Unlock()
+
+	// the slow project is still being refreshed, so it's skipped
+	err = srv.refreshIndex()
+	require.Error(err)
+	require.Contains(err.Error(), "foo/slow: the previous refresh has not finished yet")
+
+	close(fetcher.release)
+	require.Eventually(func() bool {
+		return len(srv.index.forProject("foo", "slow")) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Eventually(func() bool {
+		return srv.refreshIndex() == nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestRefreshIndex_AutoBuildLatest(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.AutoBuildLatest = true
+	require.NoError(srv.ensureIndexed("", "bar", "foo"))
+
+	// the latest release did not change
+	require.NoError(srv.refreshIndex())
+	time.Sleep(50 * time.Millisecond)
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	require.NoError(srv.refreshIndex())
+	require.Eventually(func() bool {
+		return srv.index.isInstalled("bar", "foo", "v1.1.0")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+
+	assertMakefileOutput(t,
+		srv.versionFolder("bar", "foo", "v1.1.0"),
+		"http://foo.bar/v1.1.0/",
+		"foo",
+		"bar",
+		"v1.1.0",
+	)
+}
+
+func TestRefreshIndex_AutoBuildLatestCold(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.AutoBuildLatest = true
+	require.NoError(srv.ensureIndexed("", "bar", "foo"))
+
+	// a project indexed again from scratch, e.g. after a reload of the
+	// config, has no previous latest release to compare with.
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	srv.index.unset("bar", "foo")
+	require.NoError(srv.refreshProject(newKey("bar", "foo")))
+	time.Sleep(50 * time.Millisecond)
+	require.True(srv.index.isIndexed("bar", "foo"))
+	require.False(srv.index.isInstalled("bar", "foo", "v1.1.0"))
+}
+
+func TestRefreshIndex_AutoBuildLatestDisabled(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	require.NoError(srv.ensureIndexed("", "bar", "foo"))
+
+	fetcher.add("bar", "foo", "v1.1.0", url)
+	require.NoError(srv.refreshIndex())
+	time.Sleep(50 * time.Millisecond)
+	require.False(srv.index.isInstalled("bar", "foo", "v1.1.0"))
+}
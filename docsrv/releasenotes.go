@@ -0,0 +1,130 @@
+package docsrv
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// releaseNotesFile is the name of the notes of a version, served in
+	// /${VERSION}/release-notes.json.
+	releaseNotesFile = "release-notes.json"
+	// changelogPath is the path of the notes of all the releases.
+	changelogPath = "/changelog.json"
+)
+
+// releaseNotes are the notes of a GitHub release, so the docs can link a
+// "What's new" page without calling the GitHub API from the browser.
+type releaseNotes struct {
+	Version    string     `json:"version"`
+	Name       string     `json:"name"`
+	Body       string     `json:"body"`
+	Author     string     `json:"author"`
+	URL        string     `json:"url"`
+	Prerelease bool       `json:"prerelease"`
+	ReleasedAt *time.Time `json:"released-at"`
+}
+
+func newReleaseNotes(r *release) releaseNotes {
+	return releaseNotes{
+		Version:    r.tag,
+		Name:       r.name,
+		Body:       r.notes,
+		Author:     r.author,
+		URL:        r.htmlURL,
+		Prerelease: r.prerelease,
+		ReleasedAt: releasedAt(r),
+	}
+}
+
+// isReleaseNotesPath reports whether the given path is the one of the notes
+// of a version.
+func isReleaseNotesPath(path string) bool {
+	_, ok := versionFromReleaseNotesPath(path)
+	return ok
+}
+
+// versionFromReleaseNotesPath returns the version in the given path of the
+// notes of a version.
+func versionFromReleaseNotesPath(path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != releaseNotesFile {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// serveReleaseNotes is an HTTP handler that outputs the notes of the release
+// of the version in the path. Branches have no notes, so they are not found.
+func (s *Service) serveReleaseNotes(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	version, _ := versionFromReleaseNotesPath(r.URL.Path)
+	log := projectLog(r, owner, project).WithField("version", version)
+
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	for _, rel := range s.releasesForHost(r.Host, owner, project) {
+		if rel.tag != version {
+			continue
+		}
+
+		if err := s.writeJSON(w, newReleaseNotes(rel)); err != nil {
+			log.Errorf("error serving release notes: %s", err)
+			s.internalError(w, r)
+		}
+		return
+	}
+
+	s.notFound(w, r)
+}
+
+// serveChangelog is an HTTP handler that outputs the notes of all the
+// releases of a project, from the newest to the oldest unless the order is
+// given. Accepts the same filters as listVersions.
+func (s *Service) serveChangelog(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	q := r.URL.Query()
+	filter, err := parseVersionFilter(q)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.withoutBranches = true
+	if q.Get("order") == "" {
+		filter.descending = true
+	}
+
+	if err := s.ensureIndexed(q.Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	releases := s.filteredReleases(r, owner, project, filter)
+	notes := make([]releaseNotes, 0, len(releases))
+	for _, rel := range releases {
+		notes = append(notes, newReleaseNotes(rel))
+	}
+
+	if err := s.writeJSON(w, notes); err != nil {
+		log.Errorf("error serving changelog: %s", err)
+		s.internalError(w, r)
+	}
+}
@@ -0,0 +1,92 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReleaseNotesTestSrv() *Service {
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+	fetcher.addPrerelease("bar", "foo", "v2.0.0-beta.1", "")
+	fetcher.addBranch("bar", "foo", "master", "", "1234")
+	fetcher.setNotes("bar", "foo", "v1.0.0", "First release", "Initial docs.", "alice")
+	fetcher.setNotes("bar", "foo", "v1.1.0", "Search", "Adds the search.", "bob")
+	fetcher.setPublishedAt("bar", "foo", "v1.1.0", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	return newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{
+		Repository:  "bar/foo",
+		Prereleases: true,
+		Branches:    []string{"master"},
+	}})
+}
+
+func TestReleaseNotes(t *testing.T) {
+	require := require.New(t)
+	srv := newReleaseNotesTestSrv()
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.1.0/release-notes.json", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	var notes releaseNotes
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &notes))
+	releasedAt := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(releaseNotes{
+		Version:    "v1.1.0",
+		Name:       "Search",
+		Body:       "Adds the search.",
+		Author:     "bob",
+		URL:        "https://github.com/bar/foo/releases/tag/v1.1.0",
+		ReleasedAt: &releasedAt,
+	}, notes)
+
+	assertRedirect(t, srv, "http://foo.bar/latest/release-notes.json", "http://foo.bar/v1.1.0/release-notes.json")
+
+	for _, path := range []string{"/v3.0.0/release-notes.json", "/master/release-notes.json"} {
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar"+path, nil))
+		require.Equal(http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	require := require.New(t)
+	srv := newReleaseNotesTestSrv()
+
+	changelog := func(query string) []string {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/changelog.json"+query, nil))
+		require.Equal(http.StatusOK, w.Code)
+
+		var notes []releaseNotes
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &notes))
+		var versions []string
+		for _, n := range notes {
+			versions = append(versions, n.Version)
+		}
+		return versions
+	}
+
+	require.Equal([]string{"v2.0.0-beta.1", "v1.1.0", "v1.0.0"}, changelog(""))
+	require.Equal([]string{"v1.0.0", "v1.1.0"}, changelog("?order=asc&include-prereleases=false"))
+	require.Equal([]string{"v2.0.0-beta.1"}, changelog("?limit=1"))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/changelog.json?limit=-1", nil))
+	require.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestIsReleaseNotesPath(t *testing.T) {
+	require := require.New(t)
+	require.True(isReleaseNotesPath("/v1.0.0/release-notes.json"))
+	require.False(isReleaseNotesPath("/release-notes.json"))
+	require.False(isReleaseNotesPath("/v1.0.0/en/release-notes.json"))
+	require.False(isReleaseNotesPath("//release-notes.json"))
+}
@@ -0,0 +1,155 @@
+package docsrv
+
+import (
+	"os"
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// RemapKeep keeps the docs of the projects no longer served by any host.
+	RemapKeep = "keep"
+	// RemapPurge removes the docs of the projects no longer served by any
+	// host.
+	RemapPurge = "purge"
+	// RemapMigrate moves the docs of the project previously served by a host
+	// to the project it serves now, as long as the new one has no docs yet.
+	// This is meant for repositories that have been renamed.
+	RemapMigrate = "migrate"
+)
+
+// ReloadConfig replaces the configuration of the service with the given one.
+// The hosts that were removed or now map to a different repository stop
+// serving the docs of the previous one, which are handled according to the
+// remap policy if no other host serves that project.
+func (s *Service) ReloadConfig(conf Config) {
+	if conf == nil {
+		conf = make(Config)
+	}
+
+	s.configMut.Lock()
+	old := s.opts.Config
+	s.opts.Config = conf
+	s.hosts = newHostTable(conf)
+	s.configMut.Unlock()
+
+	s.index.setVersionBounds(conf)
+	s.latest.clear()
+	s.setTokens(conf)
+
+	for host, prev := range old {
+		next, ok := conf[host]
+		if ok {
+			s.reloadMaintenance(host, prev, next)
+		}
+
+		if ok && next.projectKey() == prev.projectKey() {
+			if next.MinVersion != prev.MinVersion || next.MaxVersion != prev.MaxVersion ||
+				next.VersionScheme != prev.VersionScheme ||
+				!reflect.DeepEqual(next.ExcludeVersions, prev.ExcludeVersions) {
+				if owner, project, ok := conf.ProjectForHost(host); ok {
+					s.index.unset(owner, project)
+					if next.PruneOldVersions && !s.index.hasMinVersionOverride(owner, project) {
+						s.pruneRaisedMinVersion(owner, project, prev, next)
+					}
+				}
+			}
+			continue
+		}
+
+		s.remapHost(host, old, conf)
+	}
+
+	s.writeState()
+}
+
+// pruneRaisedMinVersion deletes the docs of the versions of the given project
+// older than the minimum version of the next config of a host, if it's
+// greater than the previous one.
+func (s *Service) pruneRaisedMinVersion(owner, project string, prev, next ProjectConfig) {
+	scheme := next.versionScheme()
+	if !scheme.valid(next.MinVersion) {
+		return
+	}
+
+	if prev.VersionScheme == next.VersionScheme && scheme.valid(prev.MinVersion) &&
+		scheme.compare(prev.MinVersion, next.MinVersion) >= 0 {
+		return
+	}
+
+	for _, version := range s.pruneVersions(owner, project, s.olderThan(owner, project, next.MinVersion)) {
+		s.auditEvent("evict", owner, project, version, "older than the min-version "+next.MinVersion+" of the config")
+	}
+}
+
+// remapHost stops serving in the given host the project it served in the old
+// configuration and starts serving the one in the new configuration, if any.
+func (s *Service) remapHost(host string, old, conf Config) {
+	log := logrus.WithField("host", host)
+	prevOwner, prevProject, hadProject := old.ProjectForHost(host)
+	owner, project, hasProject := conf.ProjectForHost(host)
+	log.WithFields(logrus.Fields{
+		"from": old[host].Repository,
+		"to":   conf[host].Repository,
+	}).Info("host repository changed")
+
+	if hadProject && len(conf.HostsForProject(prevOwner, prevProject)) == 0 {
+		s.index.removeProject(prevOwner, prevProject)
+		s.search.removeProject(prevOwner, prevProject)
+		s.aliases.set(prevOwner, prevProject, nil)
+
+		folder := s.projectFolder(prevOwner, prevProject)
+		switch s.opts.RemapPolicy {
+		case RemapPurge:
+			if err := os.RemoveAll(folder); err != nil {
+				log.Errorf("error purging docs of %s/%s: %s", prevOwner, prevProject, err)
+			} else {
+				s.auditEvent("purge", prevOwner, prevProject, "", "no longer served by any host")
+			}
+		case RemapMigrate:
+			if hasProject && isDir(folder) && isEmptyOrMissing(s.projectFolder(owner, project)) {
+				if err := s.migrateProjectFolder(prevOwner, prevProject, owner, project); err != nil {
+					log.Errorf("error migrating docs of %s/%s: %s", prevOwner, prevProject, err)
+				} else {
+					s.auditEvent("migrate", prevOwner, prevProject, "", "moved to "+repositoryKey(owner, project))
+				}
+			}
+		}
+	}
+
+	if !hasProject {
+		hostFolder := s.hostFolder(host)
+		if fi, err := os.Lstat(hostFolder); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(hostFolder); err != nil {
+				log.Errorf("error removing host symlink: %s", err)
+			}
+		}
+		return
+	}
+
+	if err := s.linkHost(host, owner, project); err != nil {
+		log.Errorf("error linking host folder: %s", err)
+	}
+}
+
+// migrateProjectFolder moves the installed docs of a project to the folder of
+// another one.
+func (s *Service) migrateProjectFolder(fromOwner, fromProject, owner, project string) error {
+	return moveFolder(s.projectFolder(fromOwner, fromProject), s.projectFolder(owner, project))
+}
+
+// isEmptyOrMissing reports whether the given folder does not exist or is
+// empty.
+func isEmptyOrMissing(dir string) bool {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	names, _ := f.Readdirnames(1)
+	return len(names) == 0
+}
@@ -0,0 +1,104 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReloadTestSrv(t *testing.T, policy string) (*Service, *mockFetcher, string) {
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(t, err)
+
+	fetcher := newMockFetcher()
+	fetcher.add("org", "a", "v1.0.0", "")
+	fetcher.add("org", "b", "v2.0.0", "")
+
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "org/a"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.RemapPolicy = policy
+
+	dir := srv.versionFolder("org", "a", "v1.0.0")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("a"), 0644))
+	require.NoError(t, srv.linkHost("foo.bar", "org", "a"))
+	require.NoError(t, srv.indexProject("org", "a"))
+	srv.index.install(buildConfig{owner: "org", project: "a", version: "v1.0.0", destination: dir})
+
+	return srv, fetcher, tmpDir
+}
+
+func TestReloadConfig_Remap(t *testing.T) {
+	require := require.New(t)
+	srv, _, tmpDir := newReloadTestSrv(t, RemapKeep)
+	defer os.RemoveAll(tmpDir)
+
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v1.0.0/")
+
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "org/b"}})
+
+	require.False(srv.index.isIndexed("org", "a"))
+	require.False(srv.index.isInstalled("org", "a", "v1.0.0"))
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v2.0.0/")
+
+	target, err := os.Readlink(filepath.Join(tmpDir, "foo.bar"))
+	require.NoError(err)
+	require.Equal(filepath.Join("org", "b"), target)
+	require.True(isDir(srv.versionFolder("org", "a", "v1.0.0")))
+
+	// removed hosts lose their symlink
+	srv.ReloadConfig(Config{})
+	_, err = os.Lstat(filepath.Join(tmpDir, "foo.bar"))
+	require.True(os.IsNotExist(err))
+	assertNotFound(t, srv, "http://foo.bar/latest/")
+}
+
+func TestReloadConfig_Purge(t *testing.T) {
+	require := require.New(t)
+	srv, _, tmpDir := newReloadTestSrv(t, RemapPurge)
+	defer os.RemoveAll(tmpDir)
+
+	// the project is still served by other host, so it's kept
+	srv.ReloadConfig(Config{
+		"foo.bar": ProjectConfig{Repository: "org/b"},
+		"baz.bar": ProjectConfig{Repository: "org/a"},
+	})
+	require.True(isDir(srv.versionFolder("org", "a", "v1.0.0")))
+	require.True(srv.index.isIndexed("org", "a"))
+
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "org/b"}})
+	require.False(isDir(srv.projectFolder("org", "a")))
+}
+
+func TestReloadConfig_Migrate(t *testing.T) {
+	require := require.New(t)
+	srv, _, tmpDir := newReloadTestSrv(t, RemapMigrate)
+	defer os.RemoveAll(tmpDir)
+
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "org/b"}})
+	require.False(isDir(srv.projectFolder("org", "a")))
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "foo.bar", "v1.0.0", "index.html"))
+	require.NoError(err)
+	require.Equal("a", string(data))
+}
+
+func TestReloadConfig_MinVersion(t *testing.T) {
+	require := require.New(t)
+	srv, fetcher, tmpDir := newReloadTestSrv(t, RemapKeep)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher.add("org", "a", "v0.9.0", "")
+	srv.ReloadConfig(Config{"foo.bar": ProjectConfig{Repository: "org/a", MinVersion: "v1.0.0"}})
+	require.False(srv.index.isIndexed("org", "a"))
+	require.True(srv.index.isInstalled("org", "a", "v1.0.0"))
+
+	assertJSON(t, srv, "http://foo.bar/versions.json", []*version{
+		{Text: "v1.0.0", URL: "http://foo.bar/v1.0.0", Installed: true},
+	})
+}
@@ -0,0 +1,240 @@
+package docsrv
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// buildReportPath is the path where the reports of the failed builds are
+	// served.
+	buildReportPath = "/_build/report"
+	// buildReportDuration is the time the link to a build report is valid
+	// for.
+	buildReportDuration = 24 * time.Hour
+	// maxBuildReports is the number of reports kept in memory. The oldest
+	// ones are discarded first.
+	maxBuildReports = 100
+	// buildReportLogLines is the number of lines at the end of the build
+	// output included in the report.
+	buildReportLogLines = 100
+	// redactedValue replaces the value of the sensitive environment
+	// variables in the reports.
+	redactedValue = "[redacted]"
+)
+
+// buildReport contains everything a doc author needs to know to fix a failed
+// build without access to the server.
+type buildReport struct {
+	ID         string
+	Owner      string
+	Project    string
+	Version    string
+	Command    string
+	Env        []string
+	Log        string
+	Error      string
+	TarballURL string
+	SHA        string
+	Created    time.Time
+}
+
+// newBuildReport creates the report of a build with the given configuration
+// that failed with the given error.
+func newBuildReport(conf buildConfig, err *ErrBuildFailed) *buildReport {
+	return &buildReport{
+		ID:         newID(),
+		Owner:      conf.owner,
+		Project:    conf.project,
+		Version:    conf.version,
+		Command:    err.Command,
+		Env:        sanitizeEnv(err.Env),
+		Log:        tailLines(err.Log, buildReportLogLines),
+		Error:      err.Err.Error(),
+		TarballURL: conf.tarballURL,
+		SHA:        conf.sha,
+		Created:    time.Now(),
+	}
+}
+
+var sensitiveEnvRegexp = regexp.MustCompile(`(?i)(token|secret|key|pass|credential|auth)`)
+
+// sanitizeEnv returns the given environment with the values of the variables
+// that may contain secrets redacted.
+func sanitizeEnv(env []string) []string {
+	result := make([]string, 0, len(env))
+	for _, v := range env {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 && sensitiveEnvRegexp.MatchString(parts[0]) {
+			v = parts[0] + "=" + redactedValue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// tailLines returns the last n lines of the given text.
+func tailLines(text string, n int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// buildReports keeps the most recent reports of failed builds in memory.
+type buildReports struct {
+	mut     sync.RWMutex
+	reports map[string]*buildReport
+	order   []string
+}
+
+func newBuildReports() *buildReports {
+	return &buildReports{reports: make(map[string]*buildReport)}
+}
+
+// add stores the given report, discarding the oldest one if there are too
+// many.
+func (b *buildReports) add(report *buildReport) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if len(b.order) >= maxBuildReports {
+		delete(b.reports, b.order[0])
+		b.order = b.order[1:]
+	}
+
+	b.reports[report.ID] = report
+	b.order = append(b.order, report.ID)
+}
+
+// get returns the report with the given ID, if it exists and has not expired.
+func (b *buildReports) get(id string) (*buildReport, bool) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	report, ok := b.reports[id]
+	if !ok || time.Since(report.Created) > buildReportDuration {
+		return nil, false
+	}
+	return report, true
+}
+
+// forProject returns the reports of the given project created after the given
+// time, from the oldest to the newest.
+func (b *buildReports) forProject(owner, project string, since time.Time) []*buildReport {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	var reports []*buildReport
+	for _, id := range b.order {
+		report := b.reports[id]
+		if report.Owner == owner && report.Project == project && report.Created.After(since) {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// buildReportURL returns the URL of the given report in the host of the
+// request. The URL contains a token that grants access to the report until
+// it expires, so it can be shared with anyone.
+func (s *Service) buildReportURL(r *http.Request, report *buildReport) string {
+	expiry := strconv.FormatInt(report.Created.Add(buildReportDuration).Unix(), 10)
+	token := s.sign("build-report", report.ID, stripPort(r.Host), expiry)
+	return fmt.Sprintf("%s://%s%s?token=%s", reqScheme(r), r.Host, buildReportPath, url.QueryEscape(token))
+}
+
+var buildReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Build report of {{.Owner}}/{{.Project}} {{.Version}}</title>
+</head>
+<body>
+<h1>Build of {{.Owner}}/{{.Project}} {{.Version}} failed</h1>
+<p>{{.Error}}</p>
+<h2>Tarball</h2>
+<ul>
+<li>URL: <code>{{.TarballURL}}</code></li>
+{{if .SHA}}<li>Commit: <code>{{.SHA}}</code></li>{{end}}
+<li>Built at: {{.Created.Format "2006-01-02T15:04:05Z07:00"}}</li>
+</ul>
+<h2>Command</h2>
+<pre>{{.Command}}</pre>
+<h2>Environment</h2>
+<pre>{{range .Env}}{{.}}
+{{end}}</pre>
+<h2>Output</h2>
+<pre>{{.Log}}</pre>
+</body>
+</html>
+`))
+
+// serveBuildReport is an HTTP handler that will output the report of a failed
+// build if the token of the request grants access to it.
+func (s *Service) serveBuildReport(w http.ResponseWriter, r *http.Request) {
+	values, ok := s.verify(r.URL.Query().Get("token"))
+	if !ok || len(values) != 4 || values[0] != "build-report" ||
+		values[2] != stripPort(r.Host) || !notExpired(values[3]) {
+		httpError(w, r, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	report, ok := s.reports.get(values[1])
+	if !ok {
+		httpError(w, r, "the build report does not exist or has expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := buildReportTemplate.Execute(w, report); err != nil {
+		requestLog(r).Errorf("error rendering build report: %s", err)
+	}
+}
+
+var buildFailedTemplate = template.Must(template.New("failed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Internal Server Error</title>
+</head>
+<body>
+<h1>Internal Server Error</h1>
+<p>The documentation of {{.Project}} {{.Version}} could not be built.</p>
+<p>See the <a href="{{.URL}}">build report</a> for the details. Anyone with the link can see it until it expires in {{.Duration}}.</p>
+</body>
+</html>
+`))
+
+// buildFailed responds with a 500 page containing the link to the given
+// report of the failed build.
+func (s *Service) buildFailed(w http.ResponseWriter, r *http.Request, report *buildReport) {
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		msg := fmt.Sprintf("the documentation of %s %s could not be built, see the build report at %s",
+			report.Project, report.Version, s.buildReportURL(r, report))
+		httpError(w, r, msg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	err := buildFailedTemplate.Execute(w, struct {
+		Project  string
+		Version  string
+		URL      string
+		Duration time.Duration
+	}{report.Project, report.Version, s.buildReportURL(r, report), buildReportDuration})
+	if err != nil {
+		requestLog(r).Errorf("error rendering build failed page: %s", err)
+	}
+}
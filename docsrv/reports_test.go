@@ -0,0 +1,129 @@
+package docsrv
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const failingMakefile = `
+docs:
+	@echo "building the docs"; \
+	echo "missing template" >&2; \
+	exit 1
+`
+
+func TestBuildReport(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServerWithMakefile(failingMakefile)
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	os.Setenv("DOCSRV_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("DOCSRV_TEST_SECRET")
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{
+		Repository: "bar/foo",
+		BuildEnv:   map[string]string{"DOCSRV_TEST_API_TOKEN": "t0k3n", "THEME": "dark"},
+	}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	// anonymous users get the regular error page
+	assertInternalError(t, srv, "http://foo.bar/v1.0.0/")
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar/v1.0.0/?token=admin", nil)
+	require.NoError(err)
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusInternalServerError, w.Code)
+
+	match := regexp.MustCompile(`href="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	require.Len(match, 2)
+	reportURL := html.UnescapeString(match[1])
+
+	// the report can be seen by anyone with the link
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", reportURL, nil)
+	require.NoError(err)
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	require.Contains(body, "bar/foo v1.0.0")
+	require.Contains(body, "make docs")
+	require.Contains(body, "VERSION_NAME=v1.0.0")
+	require.Contains(body, "THEME=dark")
+	require.Contains(body, "DOCSRV_TEST_API_TOKEN="+redactedValue)
+	require.NotContains(body, "t0k3n")
+	// the environment of docsrv is never reported
+	require.NotContains(body, "DOCSRV_TEST_SECRET")
+	require.NotContains(body, "s3cr3t")
+	require.Contains(body, "missing template")
+	require.Contains(body, url)
+
+	// the token is only valid in the host of the project
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", reportURL, nil)
+	require.NoError(err)
+	req.Host = "baz.bar"
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "http://foo.bar"+buildReportPath+"?token=invalid", nil)
+	require.NoError(err)
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestBuildReports(t *testing.T) {
+	require := require.New(t)
+
+	reports := newBuildReports()
+	first := &buildReport{ID: "first"}
+	reports.add(first)
+	_, ok := reports.get("first")
+	require.False(ok, "expired reports are not returned")
+
+	for i := 0; i < maxBuildReports; i++ {
+		report := newBuildReport(buildConfig{}, &ErrBuildFailed{Err: os.ErrNotExist})
+		reports.add(report)
+	}
+	require.Len(reports.reports, maxBuildReports)
+	require.NotContains(reports.reports, "first")
+}
+
+func TestSanitizeEnv(t *testing.T) {
+	require.Equal(t, []string{
+		"PATH=/bin",
+		"GITHUB_API_KEY=" + redactedValue,
+		"DOCSRV_REFRESH_TOKEN=" + redactedValue,
+		"DB_PASSWORD=" + redactedValue,
+		"EMPTY",
+	}, sanitizeEnv([]string{
+		"PATH=/bin",
+		"GITHUB_API_KEY=foo",
+		"DOCSRV_REFRESH_TOKEN=bar",
+		"DB_PASSWORD=baz",
+		"EMPTY",
+	}))
+}
+
+func TestTailLines(t *testing.T) {
+	require := require.New(t)
+	require.Equal("b\nc", tailLines("a\nb\nc\n", 2))
+	require.Equal("a\nb", tailLines("a\nb", 5))
+}
@@ -0,0 +1,82 @@
+package docsrv
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// versionPrefix is a partial version requested in the path, such as /v1/ or
+// /1.4/, which stands for the greatest release with the same major, or major
+// and minor, numbers.
+type versionPrefix struct {
+	major int64
+	// minor is the minor number of the prefix, or -1 if it only has a major.
+	minor int64
+}
+
+// parseVersionPrefix parses the given partial version, with an optional "v"
+// prefix and without patch, prerelease or metadata. Will also report whether
+// or not it's one.
+func parseVersionPrefix(s string) (versionPrefix, bool) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > 2 {
+		return versionPrefix{}, false
+	}
+
+	nums := []int64{-1, -1}
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 || strings.HasPrefix(part, "+") {
+			return versionPrefix{}, false
+		}
+		nums[i] = n
+	}
+
+	return versionPrefix{major: nums[0], minor: nums[1]}, true
+}
+
+// matches reports whether the given version starts with the prefix.
+func (p versionPrefix) matches(v *semver.Version) bool {
+	if v == nil || v.Major() != p.major {
+		return false
+	}
+	return p.minor < 0 || v.Minor() == p.minor
+}
+
+// resolveVersion returns the greatest release of the given project served in
+// the given host matching the given partial version, except prereleases, so
+// the installed versions that are no longer served, such as the excluded or
+// orphaned ones, are never resolved. Frozen projects only serve, and
+// resolve, the installed versions, since they can not build the rest.
+// Versions that are releases themselves are not resolved. Will also report
+// whether or not there is any.
+func (s *Service) resolveVersion(host, owner, project, version string) (string, bool) {
+	projectConf, _ := s.config().ForProject(owner, project)
+	if !projectConf.isSemver() || s.index.get(owner, project, version) != nil {
+		return "", false
+	}
+
+	prefix, ok := parseVersionPrefix(version)
+	if !ok {
+		return "", false
+	}
+
+	var (
+		resolved string
+		greatest *semver.Version
+	)
+	for _, r := range s.releasesForHost(host, owner, project) {
+		v := newVersion(r.tag)
+		if r.prerelease || !prefix.matches(v) || v.Prerelease() != "" {
+			continue
+		}
+
+		if greatest == nil || v.GreaterThan(greatest) {
+			resolved, greatest = r.tag, v
+		}
+	}
+
+	return resolved, greatest != nil
+}
@@ -0,0 +1,99 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersionPrefix(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected versionPrefix
+		ok       bool
+	}{
+		{"v1", versionPrefix{1, -1}, true},
+		{"1", versionPrefix{1, -1}, true},
+		{"1.4", versionPrefix{1, 4}, true},
+		{"v0.10", versionPrefix{0, 10}, true},
+		{"v1.4.0", versionPrefix{}, false},
+		{"v1-beta", versionPrefix{}, false},
+		{"v+1", versionPrefix{}, false},
+		{"v", versionPrefix{}, false},
+		{"latest", versionPrefix{}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			prefix, ok := parseVersionPrefix(c.input)
+			require.Equal(t, c.ok, ok)
+			require.Equal(t, c.expected, prefix)
+		})
+	}
+}
+
+func TestPrepareVersion_PartialVersion(t *testing.T) {
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"docs.bar":    ProjectConfig{Repository: "org/foo"},
+		"v1.docs.bar": ProjectConfig{Repository: "org/foo", MaxVersion: "v1.3"},
+	})
+
+	for _, v := range []string{"v1.0.0", "v1.4.0", "v1.4.2", "v1.10.0", "v2.0.0"} {
+		fetcher.add("org", "foo", v, "")
+	}
+	fetcher.addPrerelease("org", "foo", "v1.11.0-beta.1", "")
+
+	assertRedirect(t, srv, "http://docs.bar/v1/", "http://docs.bar/v1.10.0/")
+	assertRedirect(t, srv, "http://docs.bar/1.4/foo/bar.html", "http://docs.bar/v1.4.2/foo/bar.html")
+	assertRedirect(t, srv, "http://docs.bar/v2", "http://docs.bar/v2.0.0/")
+	assertRedirect(t, srv, "http://v1.docs.bar/v1/", "http://v1.docs.bar/v1.0.0/")
+	assertNotFound(t, srv, "http://docs.bar/v3/")
+	assertNotFound(t, srv, "http://docs.bar/v1.5/")
+	assertNotFound(t, srv, "http://v1.docs.bar/v1.4/")
+}
+
+func TestPrepareVersion_PartialVersionInstalled(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"frozen.bar": ProjectConfig{Repository: "org/foo", Frozen: true},
+	})
+	srv.opts.BaseFolder = tmpDir
+	require.NoError(os.MkdirAll(srv.versionFolder("org", "foo", "v1.1.0"), 0755))
+	srv.index.install(buildConfig{owner: "org", project: "foo", version: "v1.1.0"})
+
+	// frozen projects only resolve the installed versions.
+	assertRedirect(t, srv, "http://frozen.bar/v1/", "http://frozen.bar/v1.1.0/")
+}
+
+func TestPrepareVersion_PartialVersionNotServed(t *testing.T) {
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", "")
+	fetcher.add("org", "foo", "v1.2.0", "")
+	fetcher.add("org", "foo", "v2.1.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"docs.bar": ProjectConfig{
+			Repository:      "org/foo",
+			MinVersion:      "v1.1.0",
+			ExcludeVersions: []string{"v1.2.*"},
+		},
+	})
+
+	// installed versions that are excluded, older than the minimum version
+	// or deleted upstream are not served, so they are not resolved either.
+	for _, v := range []string{"v1.0.0", "v1.2.0", "v2.0.0"} {
+		srv.index.install(buildConfig{owner: "org", project: "foo", version: v})
+	}
+
+	assertRedirect(t, srv, "http://docs.bar/v2/", "http://docs.bar/v2.1.0/")
+	assertNotFound(t, srv, "http://docs.bar/v1/")
+	assertNotFound(t, srv, "http://docs.bar/v2.0/")
+}
@@ -0,0 +1,26 @@
+package docsrv
+
+import (
+	"io"
+	"net/http"
+)
+
+const robotsPath = "/robots.txt"
+
+const (
+	robotsAllow    = "User-agent: *\nDisallow:\n"
+	robotsDisallow = "User-agent: *\nDisallow: /\n"
+)
+
+// serveRobots is an HTTP handler that will output the robots.txt of the
+// host, which excludes all the pages from search engines if the project has
+// the NoIndex option.
+func (s *Service) serveRobots(w http.ResponseWriter, r *http.Request) {
+	robots := robotsAllow
+	if s.forHost(r.Host).NoIndex {
+		robots = robotsDisallow
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, robots)
+}
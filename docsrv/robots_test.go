@@ -0,0 +1,46 @@
+package docsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRobots(t *testing.T) {
+	srv := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "org/foo", NoIndex: true},
+		"baz.bar": ProjectConfig{Repository: "org/baz"},
+	})
+
+	cases := []struct {
+		url    string
+		robots string
+		header string
+	}{
+		{"http://foo.bar/robots.txt", robotsDisallow, "noindex, nofollow"},
+		{"http://foo.bar:9091/robots.txt", robotsDisallow, "noindex, nofollow"},
+		{"http://baz.bar/robots.txt", robotsAllow, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			require := require.New(t)
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", c.url, nil)
+			require.NoError(err)
+
+			srv.ServeHTTP(w, req)
+			require.Equal(http.StatusOK, w.Code)
+			require.Equal(c.robots, w.Body.String())
+			require.Equal(c.header, w.Header().Get("X-Robots-Tag"))
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar/latest/", nil)
+	require.NoError(t, err)
+	srv.ServeHTTP(w, req)
+	require.Equal(t, "noindex, nofollow", w.Header().Get("X-Robots-Tag"))
+}
@@ -0,0 +1,224 @@
+package docsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sandboxPath is the PATH of the builds run by the build user, which only
+// contains the system folders.
+const sandboxPath = "/usr/local/bin:/usr/bin:/bin"
+
+// buildSandbox runs the builds as an unprivileged user, so a compromised
+// repository can not write outside of the folder where its docs are built
+// nor read the files of docsrv, such as its tokens. The build does not
+// inherit the environment of docsrv, which may contain secrets, and its docs
+// are built in a temporary folder owned by the build user and copied to
+// their destination once built, so it can not tamper with the docs of other
+// versions. The builds run with no_new_privs, so they can not regain
+// privileges through setuid binaries. A nil sandbox runs the builds as the
+// docsrv user.
+type buildSandbox struct {
+	uid, gid uint32
+	// setpriv is the path of the setpriv binary that runs the builds with
+	// no_new_privs, which the standard library can not set on its own.
+	setpriv string
+}
+
+// newBuildSandbox returns a sandbox for the given user, with the format
+// "user", "user:group" or "uid:gid", or nil if it's empty. A user without
+// group uses its primary group. The setpriv binary of util-linux must be in
+// the PATH.
+func newBuildSandbox(buildUser string) (*buildSandbox, error) {
+	if buildUser == "" {
+		return nil, nil
+	}
+
+	name, group := buildUser, ""
+	if idx := strings.Index(buildUser, ":"); idx >= 0 {
+		name, group = buildUser[:idx], buildUser[idx+1:]
+	}
+
+	uid, primaryGID, err := lookupUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	gid := primaryGID
+	if group != "" {
+		if gid, err = lookupGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
+	if uid == 0 {
+		return nil, fmt.Errorf("invalid build user %q: builds can not run as root", buildUser)
+	}
+
+	setpriv, err := exec.LookPath("setpriv")
+	if err != nil {
+		return nil, wrap(err, "setpriv is required to run the builds as %q", buildUser)
+	}
+
+	return &buildSandbox{uid, gid, setpriv}, nil
+}
+
+// lookupUser returns the uid and the primary gid of the user with the given
+// name or uid.
+func lookupUser(name string) (uint32, uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u, err := user.LookupId(name)
+		if err != nil {
+			// users unknown to the system can be used with an explicit
+			// group.
+			return uint32(uid), uint32(uid), nil
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		return uint32(uid), uint32(gid), err
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, wrap(err, "invalid build user %q", name)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, wrap(err, "invalid uid of build user %q", name)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, wrap(err, "invalid gid of build user %q", name)
+	}
+
+	return uint32(uid), uint32(gid), nil
+}
+
+// lookupGroup returns the gid of the group with the given name or gid.
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, wrap(err, "invalid build group %q", name)
+	}
+
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, wrap(err, "invalid gid of build group %q", name)
+	}
+
+	return uint32(gid), nil
+}
+
+// prepare gives the build user the given folder with the sources and returns
+// a temporary folder, owned by the build user too, where the docs must be
+// built.
+func (b *buildSandbox) prepare(sources string) (string, error) {
+	if err := chownTree(sources, int(b.uid), int(b.gid)); err != nil {
+		return "", wrap(err, "error giving the sources to the build user")
+	}
+
+	output, err := ioutil.TempDir("", "docsrv-output-")
+	if err != nil {
+		return "", wrap(err, "error creating output dir")
+	}
+
+	if err := os.Chown(output, int(b.uid), int(b.gid)); err != nil {
+		os.RemoveAll(output)
+		return "", wrap(err, "error giving the output dir to the build user")
+	}
+
+	return output, nil
+}
+
+// command makes the given command run as the build user with the given
+// variables, instead of the environment of docsrv, and the given home, and
+// with no_new_privs.
+func (b *buildSandbox) command(cmd *exec.Cmd, env []string, home string) {
+	cmd.Args = append([]string{"setpriv", "--no-new-privs", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = b.setpriv
+	cmd.Env = append([]string{"PATH=" + sandboxPath, "HOME=" + home}, env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid: b.uid,
+			Gid: b.gid,
+			// the supplementary groups of docsrv are dropped.
+			Groups: []uint32{},
+		},
+	}
+}
+
+// install copies the docs built in the given output folder to the given
+// destination, owned by the docsrv user. The symlinks that do not resolve to
+// a path inside the output folder are left out, since docsrv would follow
+// them.
+func (b *buildSandbox) install(output, destination string) error {
+	// the output is taken back from the build user first, so no process
+	// left behind by the build can change it while it's checked.
+	if err := chownTree(output, os.Getuid(), os.Getgid()); err != nil {
+		return wrap(err, "error taking the built docs from the build user")
+	}
+
+	root, err := filepath.EvalSymlinks(output)
+	if err != nil {
+		return wrap(err, "error resolving the output dir")
+	}
+
+	err = filepath.Walk(output, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		// the links are resolved for real, since the ones they go through
+		// can take them anywhere no matter how their paths look.
+		if !filepath.IsAbs(link) {
+			if resolved, err := filepath.EvalSymlinks(path); err == nil && isWithin(root, resolved) {
+				return nil
+			}
+		}
+
+		return os.Remove(path)
+	})
+	if err != nil {
+		return wrap(err, "error checking the built docs")
+	}
+
+	if err := copyTree(output, destination); err != nil {
+		return wrap(err, "error installing the built docs")
+	}
+
+	return nil
+}
+
+// isWithin reports whether the given path is the given folder or inside it.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// chownTree changes the owner of the given folder and everything inside it,
+// without following the symlinks.
+func chownTree(root string, uid, gid int) error {
+	return filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
@@ -0,0 +1,108 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBuildSandbox(t *testing.T) {
+	require := require.New(t)
+
+	sandbox, err := newBuildSandbox("")
+	require.NoError(err)
+	require.Nil(sandbox)
+
+	sandbox, err = newBuildSandbox("65000:65001")
+	require.NoError(err)
+	require.Equal(uint32(65000), sandbox.uid)
+	require.Equal(uint32(65001), sandbox.gid)
+	require.NotEmpty(sandbox.setpriv)
+
+	_, err = newBuildSandbox("0:0")
+	require.Error(err)
+
+	_, err = newBuildSandbox("docsrv-missing-user")
+	require.Error(err)
+
+	_, err = newBuildSandbox("65000:docsrv-missing-group")
+	require.Error(err)
+}
+
+const sandboxTestMakefile = `
+docs:
+	@id -u > $(DESTINATION_PATH)/uid
+	@grep NoNewPrivs /proc/self/status | cut -f 2 > $(DESTINATION_PATH)/nnp
+	@echo "$(DOCSRV_TEST_SECRET)" > $(DESTINATION_PATH)/secret
+	@echo "$(BASE_URL)" > $(DESTINATION_PATH)/out
+	@ln -s out $(DESTINATION_PATH)/inside
+	@ln -s /etc/hostname $(DESTINATION_PATH)/outside
+	@mkdir $(DESTINATION_PATH)/sub && ln -s .. $(DESTINATION_PATH)/sub/up
+	@ln -s sub/up/sub/up/.. $(DESTINATION_PATH)/escape
+	@touch $(SHARED_PATH)/written || true
+`
+
+func TestBuildDocs_Sandbox(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("builds can only run as another user as root")
+	}
+
+	require := require.New(t)
+	url, close := tarGzServerWithMakefile(sandboxTestMakefile)
+	defer close()
+
+	os.Setenv("DOCSRV_TEST_SECRET", "secret")
+	defer os.Unsetenv("DOCSRV_TEST_SECRET")
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	shared, err := ioutil.TempDir("", "docsrv-shared-")
+	require.NoError(err)
+	defer os.RemoveAll(shared)
+
+	sandbox, err := newBuildSandbox("65000:65000")
+	require.NoError(err)
+
+	conf := buildConfig{
+		tarballURL:   url,
+		baseURL:      "http://foo.bar/v1.0.0/",
+		destination:  tmpDir,
+		sharedFolder: shared,
+		project:      "foo",
+		owner:        "bar",
+		version:      "v1.0.0",
+		sandbox:      sandbox,
+	}
+	require.NoError(buildDocs(conf))
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, name))
+		require.NoError(err, name)
+		return string(data)
+	}
+	require.Equal("65000\n", read("uid"))
+	require.Equal("1\n", read("nnp"))
+	require.Equal("\n", read("secret"))
+	require.Equal("http://foo.bar/v1.0.0/\n", read("out"))
+	require.Equal("http://foo.bar/v1.0.0/\n", read("inside"))
+
+	_, err = os.Lstat(filepath.Join(tmpDir, "outside"))
+	require.True(os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(tmpDir, "escape"))
+	require.True(os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(tmpDir, "sub", "up"))
+	require.NoError(err)
+	_, err = os.Stat(filepath.Join(shared, "written"))
+	require.True(os.IsNotExist(err))
+
+	// the installed docs are owned by docsrv
+	fi, err := os.Stat(filepath.Join(tmpDir, "out"))
+	require.NoError(err)
+	require.Equal(os.Getuid(), int(fi.Sys().(*syscall.Stat_t).Uid))
+}
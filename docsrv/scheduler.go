@@ -0,0 +1,384 @@
+package docsrv
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// buildScheduler limits the number of builds running at the same time, so
+// they don't exhaust the CPU and memory of the instance. The builds that
+// can't start right away wait in a queue, where the interactive ones, those
+// requested by users, go before the background ones, such as prefetches,
+// preheats or refreshes. A scheduler with no limit never queues builds.
+//
+// The scheduler also enforces the quotas of the owners of the projects, if
+// any, so a single noisy project can't exhaust the instance: the builds of an
+// owner running at the same time beyond its limit wait in the queue too,
+// letting the builds of other owners go first, and the builds that would
+// exceed its builds per hour or its disk usage are refused.
+type buildScheduler struct {
+	mut     sync.Mutex
+	max     int
+	running int
+	queue   []*buildTicket
+	// quota returns the quota of the given owner, if any. If it's nil, no
+	// quotas are enforced.
+	quota func(owner string) *QuotaConfig
+	// diskUsage returns the size in bytes of the installed docs of the given
+	// owner.
+	diskUsage func(owner string) int64
+	// ownerRunning is the number of running builds of every owner.
+	ownerRunning map[string]int
+	// ownerStarts are the times the builds of every owner admitted in the
+	// last hour were admitted.
+	ownerStarts map[string][]time.Time
+}
+
+// buildTicket is a build waiting in the queue of the scheduler.
+type buildTicket struct {
+	owner       string
+	key         string
+	interactive bool
+	// ready is closed once the build can start.
+	ready chan struct{}
+}
+
+func newBuildScheduler(max int) *buildScheduler {
+	return &buildScheduler{
+		max:          max,
+		ownerRunning: make(map[string]int),
+		ownerStarts:  make(map[string][]time.Time),
+	}
+}
+
+// acquire waits until the build of the given owner with the given key can
+// start or the given context is cancelled. The returned function must be
+// called once the build is finished. Returns ErrQuotaExceeded if the build is
+// not admitted by the quota of the owner.
+func (b *buildScheduler) acquire(ctx context.Context, owner, key string, interactive bool) (func(), error) {
+	if err := b.admit(owner); err != nil {
+		return nil, err
+	}
+	return b.wait(ctx, b.reserve(owner, key, interactive))
+}
+
+// admit checks that a new build of the given owner does not exceed its
+// quota of builds per hour nor its quota of disk usage, and counts it.
+// Returns ErrQuotaExceeded otherwise.
+func (b *buildScheduler) admit(owner string) error {
+	quota := b.ownerQuota(owner)
+	if quota == nil {
+		return nil
+	}
+
+	if quota.MaxDiskUsage > 0 && b.diskUsage != nil {
+		if usage := b.diskUsage(owner); usage >= quota.MaxDiskUsage {
+			return wrap(ErrQuotaExceeded, "the docs of %s use %d bytes of its %d bytes of disk", owner, usage, quota.MaxDiskUsage)
+		}
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	now := time.Now()
+	starts := b.ownerStarts[owner]
+	for len(starts) > 0 && now.Sub(starts[0]) >= time.Hour {
+		starts = starts[1:]
+	}
+
+	if quota.BuildsPerHour > 0 && len(starts) >= quota.BuildsPerHour {
+		b.ownerStarts[owner] = starts
+		return wrap(ErrQuotaExceeded, "%s has reached its quota of %d builds per hour", owner, quota.BuildsPerHour)
+	}
+
+	b.ownerStarts[owner] = append(starts, now)
+	return nil
+}
+
+func (b *buildScheduler) ownerQuota(owner string) *QuotaConfig {
+	if b.quota == nil {
+		return nil
+	}
+	return b.quota(owner)
+}
+
+// tryAcquire starts a build of the given owner if it can start right away.
+// The returned function must be called once the build is finished.
+func (b *buildScheduler) tryAcquire(owner string) (func(), bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if !b.canStart(owner) {
+		return nil, false
+	}
+
+	b.start(owner)
+	return b.releaser(owner), true
+}
+
+// canStart reports whether a build of the given owner can start right away.
+func (b *buildScheduler) canStart(owner string) bool {
+	if b.max > 0 && b.running >= b.max {
+		return false
+	}
+
+	if quota := b.ownerQuota(owner); quota != nil && quota.MaxConcurrentBuilds > 0 {
+		return b.ownerRunning[owner] < quota.MaxConcurrentBuilds
+	}
+	return true
+}
+
+func (b *buildScheduler) start(owner string) {
+	b.running++
+	b.ownerRunning[owner]++
+}
+
+// releaser returns the function that releases the slot of a build of the
+// given owner.
+func (b *buildScheduler) releaser(owner string) func() {
+	return func() { b.release(owner) }
+}
+
+// reserve returns a ticket for the build of the given owner with the given
+// key, which is ready right away if the build can start or queued otherwise.
+func (b *buildScheduler) reserve(owner, key string, interactive bool) *buildTicket {
+	ticket := &buildTicket{owner, key, interactive, make(chan struct{})}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.canStart(owner) {
+		b.start(owner)
+		close(ticket.ready)
+		return ticket
+	}
+
+	b.enqueue(ticket)
+	return ticket
+}
+
+// wait waits until the given ticket is ready or the given context is
+// cancelled. The returned function must be called once the build is
+// finished.
+func (b *buildScheduler) wait(ctx context.Context, ticket *buildTicket) (func(), error) {
+	select {
+	case <-ticket.ready:
+		return b.releaser(ticket.owner), nil
+	case <-ctx.Done():
+		b.mut.Lock()
+		defer b.mut.Unlock()
+		if !b.remove(ticket) {
+			// the build was given a slot in the meantime, which is passed
+			// to the next one.
+			b.releaseLocked(ticket.owner)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// enqueue adds the given ticket to the queue, after the ones with the same
+// or higher priority.
+func (b *buildScheduler) enqueue(ticket *buildTicket) {
+	i := len(b.queue)
+	if ticket.interactive {
+		for i > 0 && !b.queue[i-1].interactive {
+			i--
+		}
+	}
+
+	b.queue = append(b.queue, nil)
+	copy(b.queue[i+1:], b.queue[i:])
+	b.queue[i] = ticket
+}
+
+// remove removes the given ticket from the queue. Reports whether it was
+// still queued.
+func (b *buildScheduler) remove(ticket *buildTicket) bool {
+	for i, t := range b.queue {
+		if t == ticket {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *buildScheduler) release(owner string) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.releaseLocked(owner)
+}
+
+// releaseLocked frees the slot of a finished build of the given owner and
+// starts the first builds in the queue that can start, if any.
+func (b *buildScheduler) releaseLocked(owner string) {
+	b.running--
+	if b.ownerRunning[owner]--; b.ownerRunning[owner] <= 0 {
+		delete(b.ownerRunning, owner)
+	}
+
+	for i := 0; i < len(b.queue); {
+		ticket := b.queue[i]
+		if !b.canStart(ticket.owner) {
+			i++
+			continue
+		}
+
+		b.start(ticket.owner)
+		b.queue = append(b.queue[:i], b.queue[i+1:]...)
+		close(ticket.ready)
+	}
+}
+
+// position returns the position, starting at 1, of the build with the given
+// key in the queue, or 0 if it's not queued.
+func (b *buildScheduler) position(key string) int {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for i, t := range b.queue {
+		if t.key == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// scheduledBuild is the state of a build scheduled by a request because it
+// could not start right away. Failed builds are kept until a request gets
+// their error.
+type scheduledBuild struct {
+	err error
+}
+
+// scheduleBuild builds in the background the version with the given
+// configuration, requested by a user, once the scheduler lets it start. The
+// users requesting it in the meantime get a page with its position in the
+// queue. Reports whether it was scheduled now, or false if it already was.
+func (s *Service) scheduleBuild(conf buildConfig) bool {
+	key := newKey(conf.owner, conf.project, conf.version)
+	if _, loaded := s.scheduled.LoadOrStore(key, scheduledBuild{}); loaded {
+		return false
+	}
+
+	// the ticket is reserved right away, so the position of the build in the
+	// queue is known by the time the request is answered.
+	ticket := s.scheduler.reserve(conf.owner, key, true)
+	conf.interactive = true
+	done := s.trackPending(conf, false)
+	conf.log().Debug("build queued")
+	go func() {
+		defer done()
+		// the builds paused by maintenance are started again once it's
+		// over, so they are not failed.
+		if err := s.buildScheduled(conf, ticket); err != nil && Cause(err) != ErrMaintenance {
+			s.scheduled.Store(key, scheduledBuild{err})
+		} else {
+			s.scheduled.Delete(key)
+		}
+	}()
+	return true
+}
+
+// buildScheduled builds the version with the given configuration scheduled
+// by a request once the given ticket is ready, unless it's installed in the
+// meantime.
+func (s *Service) buildScheduled(conf buildConfig, ticket *buildTicket) error {
+	release, err := s.scheduler.wait(context.Background(), ticket)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlock, err := s.coordinator.Lock(context.Background(), newKey(conf.owner, conf.project, conf.version))
+	if err != nil {
+		conf.log().Errorf("could not acquire the build lock: %s", err)
+		return err
+	}
+	defer unlock()
+
+	if s.index.isInstalled(conf.owner, conf.project, conf.version) || s.installedByPeer(conf) {
+		return nil
+	}
+
+	// the version is built in a temporary folder as a rebuild, so it's not
+	// served until it's finished.
+	if err := os.MkdirAll(filepath.Dir(conf.destination), 0740); err != nil {
+		conf.log().Errorf("could not build folder structure for project: %s", err)
+		return err
+	}
+
+	return s.replaceDocs(conf)
+}
+
+// serveScheduledBuild responds to a request of a version whose build was
+// scheduled by a previous request, if any: with a page with its position in
+// the queue while it's not finished, or with its error if it failed. Reports
+// whether the request was served.
+func (s *Service) serveScheduledBuild(w http.ResponseWriter, r *http.Request, owner, project, version string) bool {
+	key := newKey(owner, project, version)
+	v, ok := s.scheduled.Load(key)
+	if !ok {
+		return false
+	}
+
+	build := v.(scheduledBuild)
+	if build.err == nil {
+		buildQueued(w, r, project, version, s.scheduler.position(key))
+		return true
+	}
+
+	s.scheduled.Delete(key)
+	s.handleError(w, r, build.err)
+	return true
+}
+
+// buildQueuedRefresh is the number of seconds after which the page of a
+// queued build reloads itself.
+const buildQueuedRefresh = 5
+
+var buildQueuedTemplate = template.Must(template.New("queued").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Building {{.Project}} {{.Version}}</title>
+</head>
+<body>
+<h1>Building {{.Project}} {{.Version}}</h1>
+{{if .Position}}<p>The documentation of {{.Project}} {{.Version}} is queued to be built, {{if eq .Position 1}}it will be the next one{{else}}there are {{.Ahead}} builds ahead of it{{end}}.</p>
+{{else}}<p>The documentation of {{.Project}} {{.Version}} is being built.</p>
+{{end}}<p>This page will reload automatically once it's ready.</p>
+</body>
+</html>
+`))
+
+// buildQueued responds with a 503 status code and a page that reloads itself,
+// explaining that the given version is queued at the given position, or
+// being built if it's 0.
+func buildQueued(w http.ResponseWriter, r *http.Request, project, version string, position int) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", fmt.Sprint(buildQueuedRefresh))
+	if wantsJSON(r) {
+		msg := fmt.Sprintf("the documentation of %s %s is being built", project, version)
+		if position > 0 {
+			msg = fmt.Sprintf("the documentation of %s %s is queued to be built at position %d", project, version, position)
+		}
+		httpError(w, r, msg, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := buildQueuedTemplate.Execute(w, struct {
+		Project  string
+		Version  string
+		Position int
+		Ahead    int
+		Refresh  int
+	}{project, version, position, position - 1, buildQueuedRefresh})
+	if err != nil {
+		requestLog(r).Errorf("error rendering build queued page: %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package docsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildScheduler(t *testing.T) {
+	require := require.New(t)
+	b := newBuildScheduler(1)
+
+	release, ok := b.tryAcquire("bar")
+	require.True(ok)
+	_, ok = b.tryAcquire("bar")
+	require.False(ok)
+
+	background := b.reserve("bar", "a", false)
+	b.reserve("bar", "b", false)
+	interactive := b.reserve("bar", "c", true)
+
+	// interactive builds go before the background ones
+	require.Equal(1, b.position("c"))
+	require.Equal(2, b.position("a"))
+	require.Equal(3, b.position("b"))
+	require.Equal(0, b.position("d"))
+
+	// cancelled builds leave the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := b.wait(ctx, background)
+	require.Equal(context.Canceled, err)
+	require.Equal(0, b.position("a"))
+	require.Equal(2, b.position("b"))
+
+	release()
+	release, err = b.wait(context.Background(), interactive)
+	require.NoError(err)
+	require.Equal(1, b.position("b"))
+	release()
+
+	require.Equal(0, b.position("b"))
+	_, ok = b.tryAcquire("bar")
+	require.False(ok)
+}
+
+func TestBuildScheduler_Unlimited(t *testing.T) {
+	require := require.New(t)
+	b := newBuildScheduler(0)
+
+	for i := 0; i < 10; i++ {
+		_, ok := b.tryAcquire("bar")
+		require.True(ok)
+	}
+
+	_, err := b.acquire(context.Background(), "bar", "a", false)
+	require.NoError(err)
+	require.Equal(0, b.position("a"))
+}
+
+func TestBuildScheduler_Quotas(t *testing.T) {
+	require := require.New(t)
+	b := newBuildScheduler(2)
+	var usage int64
+	b.quota = func(owner string) *QuotaConfig {
+		if owner == "bar" {
+			return &QuotaConfig{BuildsPerHour: 3, MaxDiskUsage: 100, MaxConcurrentBuilds: 1}
+		}
+		return nil
+	}
+	b.diskUsage = func(owner string) int64 { return usage }
+
+	require.NoError(b.admit("bar"))
+	releaseBar, ok := b.tryAcquire("bar")
+	require.True(ok)
+
+	// the owner can only run one build at a time, so its builds wait while
+	// the ones of other owners start.
+	_, ok = b.tryAcquire("bar")
+	require.False(ok)
+	queued := b.reserve("bar", "bar/foo/v1.0.0", true)
+	require.Equal(1, b.position("bar/foo/v1.0.0"))
+
+	releaseBaz, ok := b.tryAcquire("baz")
+	require.True(ok)
+	_, ok = b.tryAcquire("qux")
+	require.False(ok)
+
+	releaseBar()
+	release, err := b.wait(context.Background(), queued)
+	require.NoError(err)
+	releaseBaz()
+	release()
+
+	// builds per hour
+	require.NoError(b.admit("bar"))
+	require.NoError(b.admit("bar"))
+	err = b.admit("bar")
+	require.Equal(ErrQuotaExceeded, Cause(err))
+	require.Contains(err.Error(), "3 builds per hour")
+	b.ownerStarts["bar"][0] = time.Now().Add(-time.Hour)
+	require.NoError(b.admit("bar"))
+	require.NoError(b.admit("baz"))
+
+	// disk usage
+	b.ownerStarts = make(map[string][]time.Time)
+	usage = 100
+	_, err = b.acquire(context.Background(), "bar", "bar/foo/v2.0.0", false)
+	require.Equal(ErrQuotaExceeded, Cause(err))
+	require.Empty(b.ownerRunning)
+}
+
+func TestBuildQueued(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.scheduler = newBuildScheduler(1)
+
+	release, ok := srv.scheduler.tryAcquire("bar")
+	require.True(ok)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+		require.Equal(http.StatusServiceUnavailable, w.Code)
+		require.Equal("5", w.Header().Get("Retry-After"))
+		require.Contains(w.Body.String(), "is queued to be built, it will be the next one")
+	}
+
+	release()
+	require.Eventually(func() bool {
+		_, scheduled := srv.scheduled.Load(newKey("bar", "foo", "v1.0.0"))
+		return !scheduled
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.True(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	assertMakefileOutput(t, srv.versionFolder("bar", "foo", "v1.0.0"), "http://foo.bar/v1.0.0/", "foo", "bar", "v1.0.0")
+}
@@ -0,0 +1,256 @@
+package docsrv
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// SemverScheme sorts the tags of the releases as semantic versions,
+	// e.g. "v1.2.0". It's the default scheme.
+	SemverScheme = "semver"
+	// CalverScheme sorts the tags of the releases as calendar versions, that
+	// is, numbers separated by dots, e.g. "2021.04" or "v2021.04.1", with an
+	// optional prerelease part after a dash, e.g. "2021.04-rc1".
+	CalverScheme = "calver"
+	// LexicographicScheme sorts the tags of the releases alphabetically,
+	// e.g. "release-a" before "release-b".
+	LexicographicScheme = "lexicographic"
+)
+
+// versionScheme defines how the tags of the releases of a project are
+// compared to sort them, resolve the latest one and filter them by their
+// minimum version.
+type versionScheme interface {
+	// String returns the name of the scheme.
+	String() string
+	// valid reports whether the given tag is a version of the scheme.
+	valid(tag string) bool
+	// compare returns -1, 0 or 1 if the version a is older than, the same as
+	// or newer than the version b. Both must be valid.
+	compare(a, b string) int
+}
+
+// newVersionScheme returns the scheme with the given name, or the semver one
+// if it's empty. Will also report whether or not the scheme exists with a
+// boolean.
+func newVersionScheme(name string) (versionScheme, bool) {
+	switch name {
+	case "", SemverScheme:
+		return semverScheme{}, true
+	case CalverScheme:
+		return calverScheme{}, true
+	case LexicographicScheme:
+		return lexicographicScheme{}, true
+	}
+	return semverScheme{}, false
+}
+
+// versionScheme returns the version scheme of the project, which is the
+// semver one unless other is configured.
+func (c ProjectConfig) versionScheme() versionScheme {
+	scheme, _ := newVersionScheme(c.VersionScheme)
+	return scheme
+}
+
+// isSemver reports whether the tags of the project are semantic versions.
+func (c ProjectConfig) isSemver() bool {
+	_, ok := c.versionScheme().(semverScheme)
+	return ok
+}
+
+type semverScheme struct{}
+
+func (semverScheme) String() string { return SemverScheme }
+
+func (semverScheme) valid(tag string) bool { return newVersion(tag) != nil }
+
+func (semverScheme) compare(a, b string) int {
+	return newVersion(a).Compare(newVersion(b))
+}
+
+type calverScheme struct{}
+
+func (calverScheme) String() string { return CalverScheme }
+
+func (calverScheme) valid(tag string) bool {
+	_, _, ok := parseCalver(tag)
+	return ok
+}
+
+func (calverScheme) compare(a, b string) int {
+	ac, apre, _ := parseCalver(a)
+	bc, bpre, _ := parseCalver(b)
+	for i := 0; i < len(ac) || i < len(bc); i++ {
+		var x, y int
+		if i < len(ac) {
+			x = ac[i]
+		}
+		if i < len(bc) {
+			y = bc[i]
+		}
+
+		if x != y {
+			return compareInts(x, y)
+		}
+	}
+
+	// a version with a prerelease part is older than the version without it.
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	}
+	return strings.Compare(apre, bpre)
+}
+
+// parseCalver returns the numbers and the prerelease part of the given
+// calendar version. Will also report whether or not it's a valid calendar
+// version with a boolean.
+func parseCalver(tag string) ([]int, string, bool) {
+	tag = strings.TrimPrefix(tag, "v")
+	tag = strings.SplitN(tag, "+", 2)[0]
+	var prerelease string
+	if idx := strings.Index(tag, "-"); idx >= 0 {
+		tag, prerelease = tag[:idx], tag[idx+1:]
+	}
+
+	parts := strings.Split(tag, ".")
+	numbers := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || strings.HasPrefix(p, "+") {
+			return nil, "", false
+		}
+		numbers[i] = n
+	}
+	return numbers, prerelease, true
+}
+
+func compareInts(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+type lexicographicScheme struct{}
+
+func (lexicographicScheme) String() string { return LexicographicScheme }
+
+func (lexicographicScheme) valid(tag string) bool { return tag != "" }
+
+func (lexicographicScheme) compare(a, b string) int { return strings.Compare(a, b) }
+
+// sortReleases sorts the given releases from the oldest to the newest
+// according to the given scheme. The releases whose tag is not a version of
+// the scheme go first, sorted alphabetically, so they are never the latest
+// one unless all of them are.
+func sortReleases(releases []*release, scheme versionScheme) {
+	sort.SliceStable(releases, func(i, j int) bool {
+		return lessTag(scheme, releases[i].tag, releases[j].tag)
+	})
+}
+
+// lessTag reports whether the tag a goes before the tag b according to the
+// given scheme.
+func lessTag(scheme versionScheme, a, b string) bool {
+	av, bv := scheme.valid(a), scheme.valid(b)
+	if !av || !bv {
+		if av == bv {
+			return a < b
+		}
+		return bv
+	}
+
+	if c := scheme.compare(a, b); c != 0 {
+		return c < 0
+	}
+	// equivalent versions, such as "2021.4" and "2021.04", are sorted by
+	// their tag, so the order does not depend on the order of the input.
+	return a < b
+}
+
+// olderThan returns a function that reports whether a version of the given
+// project is a release older than the given minimum version according to the
+// version scheme of the project. Branches and pull requests are never older.
+func (s *Service) olderThan(owner, project, min string) func(version string) bool {
+	conf, _ := s.config().ForProject(owner, project)
+	scheme := conf.versionScheme()
+	if !scheme.valid(min) {
+		return func(string) bool { return false }
+	}
+
+	branches := make(map[string]bool, len(conf.Branches))
+	for _, b := range conf.Branches {
+		branches[b] = true
+	}
+
+	return func(version string) bool {
+		if branches[version] || !scheme.valid(version) {
+			return false
+		}
+
+		if _, ok := pullRequestNumber(version); ok {
+			return false
+		}
+		return scheme.compare(version, min) < 0
+	}
+}
+
+// validReleases returns the given releases whose tag is a version of the
+// given scheme, along with the tags of the rest, which can not be sorted.
+func validReleases(releases []*release, scheme versionScheme) ([]*release, []string) {
+	valid := make([]*release, 0, len(releases))
+	var skipped []string
+	for _, r := range releases {
+		if scheme.valid(r.tag) {
+			valid = append(valid, r)
+		} else {
+			skipped = append(skipped, r.tag)
+		}
+	}
+	sort.Strings(skipped)
+	return valid, skipped
+}
+
+// skipTags records the given tags of the releases of the given project as
+// skipped because they are not versions of the given scheme, logging the
+// ones that were not skipped already.
+func (s *Service) skipTags(owner, project string, scheme versionScheme, tags []string) {
+	prev := make(map[string]bool)
+	for _, tag := range s.index.setSkippedTags(owner, project, tags) {
+		prev[tag] = true
+	}
+
+	for _, tag := range tags {
+		if !prev[tag] {
+			logrus.WithFields(logrus.Fields{
+				"project": project,
+				"owner":   owner,
+				"tag":     tag,
+			}).Warnf("skipping release whose tag is not a version of the %s scheme", scheme)
+		}
+	}
+}
+
+// withoutOlder returns the given releases except the ones the given function
+// reports as older than the minimum version.
+func withoutOlder(releases []*release, older func(string) bool) []*release {
+	result := make([]*release, 0, len(releases))
+	for _, r := range releases {
+		if !older(r.tag) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
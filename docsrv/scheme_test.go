@@ -0,0 +1,92 @@
+package docsrv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sortedTags(scheme versionScheme, tags ...string) []string {
+	releases := make([]*release, len(tags))
+	for i, tag := range tags {
+		releases[i] = &release{tag: tag}
+	}
+
+	sortReleases(releases, scheme)
+	result := make([]string, len(releases))
+	for i, r := range releases {
+		result[i] = r.tag
+	}
+	return result
+}
+
+func TestSortReleases(t *testing.T) {
+	require := require.New(t)
+
+	// tags that are not versions of the scheme go first instead of panicking
+	require.Equal(
+		[]string{"release-5", "v1.0.0-rc1", "v1.0.0", "v1.2.0", "v1.10.0"},
+		sortedTags(semverScheme{}, "v1.10.0", "release-5", "v1.0.0", "v1.2.0", "v1.0.0-rc1"),
+	)
+
+	require.Equal(
+		[]string{"latest", "2020.12", "2021.04", "2021.4", "2021.04.1", "2021.10-rc1", "2021.10", "v2021.11"},
+		sortedTags(calverScheme{}, "2021.10", "2021.04.1", "latest", "v2021.11", "2021.04", "2020.12", "2021.10-rc1", "2021.4"),
+	)
+
+	require.Equal(
+		[]string{"release-10", "release-5", "release-a"},
+		sortedTags(lexicographicScheme{}, "release-a", "release-5", "release-10"),
+	)
+}
+
+func TestCalverScheme(t *testing.T) {
+	require := require.New(t)
+	scheme := calverScheme{}
+
+	for _, tag := range []string{"2021", "2021.04", "v2021.04.01", "2021.04-rc1", "2021.04+build"} {
+		require.True(scheme.valid(tag), tag)
+	}
+
+	for _, tag := range []string{"", "release-5", "2021..04", "2021.+4", "v", "2021.04a"} {
+		require.False(scheme.valid(tag), tag)
+	}
+
+	require.Equal(0, scheme.compare("2021.04", "2021.4.0"))
+	require.Equal(-1, scheme.compare("2021.04-beta", "2021.04-rc"))
+	require.Equal(1, scheme.compare("2021.04.1", "2021.04.1-rc"))
+	require.Equal(-1, scheme.compare("2021.9", "2021.10"))
+}
+
+func TestVersionScheme(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "org/foo", VersionScheme: CalverScheme, MinVersion: "2021.01", Branches: []string{"master"}},
+		"baz.bar": ProjectConfig{Repository: "org/baz", VersionScheme: LexicographicScheme},
+	})
+
+	for _, v := range []string{"2020.12", "2021.04", "2021.10", "2021.9"} {
+		fetcher.add("org", "foo", v, "")
+	}
+	fetcher.addPrerelease("org", "foo", "2021.11-rc1", "")
+	fetcher.add("org", "foo", "nightly", "")
+	fetcher.add("org", "baz", "release-a", "")
+	fetcher.add("org", "baz", "release-b", "")
+
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/2021.10/")
+	require.Nil(srv.index.get("org", "foo", "2020.12"))
+	require.Nil(srv.index.get("org", "foo", "2021.11-rc1"))
+	require.NotNil(srv.index.get("org", "foo", "2021.9"))
+	require.Nil(srv.index.get("org", "foo", "nightly"))
+	require.Equal([]string{"nightly"}, srv.index.skippedTagsForProject("org", "foo"))
+
+	assertRedirect(t, srv, "http://baz.bar/latest/", "http://baz.bar/release-b/")
+
+	older := srv.olderThan("org", "foo", "2021.05")
+	require.True(older("2021.04"))
+	require.False(older("2021.10"))
+	require.False(older("master"))
+	require.False(older("pr-1"))
+	require.False(older("foo.html"))
+}
@@ -0,0 +1,284 @@
+package docsrv
+
+import (
+	"html"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultSearchLimit is the maximum number of hits returned by a search if no
+// limit is given.
+const defaultSearchLimit = 20
+
+// searchIndex is a full-text index of the pages of the installed versions.
+type searchIndex struct {
+	mut *sync.RWMutex
+	// versions is a map from ${owner}/${project}/${version} to the index of
+	// that version.
+	versions map[string]*versionSearchIndex
+}
+
+// versionSearchIndex is a full-text index of the pages of a single version.
+type versionSearchIndex struct {
+	pages []searchPage
+	// terms is a map from a term to the number of occurrences in every page
+	// that contains it, indexed by page.
+	terms map[string]map[int]int
+}
+
+type searchPage struct {
+	path  string
+	title string
+}
+
+type searchHit struct {
+	Title string  `json:"title"`
+	URL   string  `json:"url"`
+	Score float64 `json:"score"`
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		mut:      new(sync.RWMutex),
+		versions: make(map[string]*versionSearchIndex),
+	}
+}
+
+func (i *searchIndex) get(owner, project, version string) *versionSearchIndex {
+	i.mut.RLock()
+	defer i.mut.RUnlock()
+	return i.versions[newKey(owner, project, version)]
+}
+
+func (i *searchIndex) set(owner, project, version string, idx *versionSearchIndex) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	i.versions[newKey(owner, project, version)] = idx
+}
+
+func (i *searchIndex) remove(owner, project, version string) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	delete(i.versions, newKey(owner, project, version))
+}
+
+// removeProject removes the indexes of all the versions of the given project.
+func (i *searchIndex) removeProject(owner, project string) {
+	prefix := newKey(owner, project) + "/"
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	for key := range i.versions {
+		if strings.HasPrefix(key, prefix) {
+			delete(i.versions, key)
+		}
+	}
+}
+
+var (
+	titleRegexp   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	ignoredRegexp = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	tagRegexp     = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// indexVersionForSearch builds the full-text index of all the HTML pages in
+// the given folder.
+func indexVersionForSearch(root string) (*versionSearchIndex, error) {
+	idx := &versionSearchIndex{terms: make(map[string]map[int]int)}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".html") {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		page := searchPage{path: filepath.ToSlash(rel)}
+		if m := titleRegexp.FindSubmatch(content); m != nil {
+			page.title = strings.TrimSpace(html.UnescapeString(string(m[1])))
+		}
+		if page.title == "" {
+			page.title = page.path
+		}
+
+		n := len(idx.pages)
+		idx.pages = append(idx.pages, page)
+
+		text := ignoredRegexp.ReplaceAll(content, nil)
+		text = tagRegexp.ReplaceAll(text, []byte(" "))
+		terms := searchTerms(page.title + " " + html.UnescapeString(string(text)))
+		for _, t := range terms {
+			if idx.terms[t] == nil {
+				idx.terms[t] = make(map[int]int)
+			}
+			idx.terms[t][n]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// searchTerms splits the given text into lowercase terms.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// search returns the pages matching any of the terms of the query, ranked by
+// TF-IDF.
+func (idx *versionSearchIndex) search(query string) []searchPageScore {
+	scores := make(map[int]float64)
+	for _, t := range searchTerms(query) {
+		pages := idx.terms[t]
+		if len(pages) == 0 {
+			continue
+		}
+
+		idf := math.Log(1 + float64(len(idx.pages))/float64(len(pages)))
+		for p, freq := range pages {
+			scores[p] += float64(freq) * idf
+		}
+	}
+
+	var result []searchPageScore
+	for p, score := range scores {
+		result = append(result, searchPageScore{idx.pages[p], score})
+	}
+
+	sort.Sort(byScore(result))
+	return result
+}
+
+type searchPageScore struct {
+	page  searchPage
+	score float64
+}
+
+type byScore []searchPageScore
+
+func (b byScore) Len() int      { return len(b) }
+func (b byScore) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byScore) Less(i, j int) bool {
+	if b[i].score == b[j].score {
+		return b[i].page.path < b[j].page.path
+	}
+	return b[i].score > b[j].score
+}
+
+// indexForSearch indexes the installed documentation of the given version,
+// if search is enabled.
+func (s *Service) indexForSearch(conf buildConfig) {
+	if !s.opts.Search {
+		return
+	}
+
+	idx, err := indexVersionForSearch(conf.destination)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"project": conf.project,
+			"owner":   conf.owner,
+			"version": conf.version,
+		}).Errorf("error indexing docs for search: %s", err)
+		return
+	}
+
+	s.search.set(conf.owner, conf.project, conf.version, idx)
+}
+
+// searchDocs is an HTTP handler that will output a JSON with the pages of a
+// version of the project matching the given query, sorted by relevance. If
+// no version is given, the latest will be used.
+func (s *Service) searchDocs(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !s.opts.Search || !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	if err := s.ensureIndexed("", owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	version := query.Get("version")
+	if version == "" {
+		latest := latestRelease(s.releasesForHost(r.Host, owner, project))
+		if latest == nil {
+			s.notFound(w, r)
+			return
+		}
+		version = latest.tag
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultSearchLimit
+	}
+
+	idx := s.search.get(owner, project, version)
+	if idx == nil {
+		// the version may have been installed before docsrv was started.
+		dir := s.versionFolder(owner, project, version)
+		if s.index.get(owner, project, version) == nil || !isDir(dir) {
+			s.notFound(w, r)
+			return
+		}
+
+		idx, err = indexVersionForSearch(dir)
+		if err != nil {
+			log.Errorf("error indexing docs for search: %s", err)
+			s.internalError(w, r)
+			return
+		}
+		s.search.set(owner, project, version, idx)
+	}
+
+	hits := []searchHit{}
+	for _, p := range idx.search(query.Get("q")) {
+		if len(hits) == limit {
+			break
+		}
+
+		hits = append(hits, searchHit{
+			Title: p.page.title,
+			URL:   urlFor(r, version, p.page.path),
+			Score: p.score,
+		})
+	}
+
+	if err := s.writeJSON(w, hits); err != nil {
+		log.Errorf("error serving search results: %s", err)
+		s.internalError(w, r)
+	}
+}
@@ -0,0 +1,93 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchDocs(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	pages := map[string]string{
+		"v1.0.0/index.html":        `<html><head><title>Home</title></head><body>Welcome to the docs</body></html>`,
+		"v1.1.0/index.html":        `<html><head><title>Home</title></head><body>Welcome to the new docs</body></html>`,
+		"v1.1.0/install.html":      `<html><head><title>Installing &amp; running</title><style>.install{}</style></head><body><p>Install the <b>binary</b>. Install it now.</p></body></html>`,
+		"v1.1.0/guide/config.html": `<html><head><title>Config</title></head><body><script>install()</script>Configure the binary after you install it.</body></html>`,
+	}
+
+	for name, content := range pages {
+		path := filepath.Join(tmpDir, "bar", "foo", name)
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.Search = true
+
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	fetcher.add("bar", "foo", "v1.1.0", "")
+
+	srv.indexForSearch(buildConfig{
+		owner:       "bar",
+		project:     "foo",
+		version:     "v1.1.0",
+		destination: filepath.Join(tmpDir, "bar", "foo", "v1.1.0"),
+	})
+
+	require.Equal([]string{
+		"http://foo.bar.baz/v1.1.0/install.html",
+		"http://foo.bar.baz/v1.1.0/guide/config.html",
+	}, searchURLs(t, srv, "http://foo.bar.baz/search.json?q=install"))
+
+	require.Equal([]string{
+		"http://foo.bar.baz/v1.1.0/install.html",
+	}, searchURLs(t, srv, "http://foo.bar.baz/search.json?q=install&limit=1"))
+
+	require.Equal([]string{
+		"http://foo.bar.baz/v1.1.0/guide/config.html",
+		"http://foo.bar.baz/v1.1.0/install.html",
+	}, searchURLs(t, srv, "http://foo.bar.baz/search.json?q=configure+binary"))
+
+	// versions not indexed yet are indexed from disk
+	assertJSON(t, srv, "http://foo.bar.baz/search.json?q=welcome&version=v1.0.0", []searchHit{
+		{"Home", "http://foo.bar.baz/v1.0.0/index.html", math.Log(2)},
+	})
+
+	assertJSON(t, srv, "http://foo.bar.baz/search.json?q=nothing", []searchHit{})
+
+	assertNotFound(t, srv, "http://foo.bar.baz/search.json?q=welcome&version=v2.0.0")
+}
+
+func searchURLs(t *testing.T, handler http.Handler, url string) []string {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var hits []searchHit
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hits))
+
+	var urls []string
+	for _, h := range hits {
+		urls = append(urls, h.URL)
+	}
+	return urls
+}
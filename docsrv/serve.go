@@ -0,0 +1,222 @@
+package docsrv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ServeOptions contains the options to serve docsrv with Serve.
+type ServeOptions struct {
+	// Addr is the address of the HTTP server. If TLS is enabled, it only
+	// serves the ACME challenges and redirects to HTTPS.
+	Addr string
+	// Addrs are the addresses the service is served on if TLS is not
+	// enabled, with the same handler, instead of Addr. Every address is
+	// either a TCP address, such as ":9091" or "[::1]:9091", or the path of
+	// a Unix socket prefixed by "unix:".
+	Addrs []string
+	// TLSAddr is the address of the HTTPS server. Only used if TLS is
+	// enabled.
+	TLSAddr string
+	// Autocert enables TLS with certificates obtained from Let's Encrypt for
+	// the configured hosts.
+	Autocert bool
+	// AutocertCacheDir is the folder where the certificates are stored.
+	AutocertCacheDir string
+	// AutocertEmail is the contact email of the Let's Encrypt account.
+	AutocertEmail string
+	// MinTLSVersion is the minimum version of TLS accepted. Defaults to
+	// TLS 1.2.
+	MinTLSVersion uint16
+	// ReadHeaderTimeout is the maximum duration for reading the headers of
+	// a request.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is the maximum duration for reading a request.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration before timing out the writes of
+	// a response. The service already limits the time to write the responses
+	// of every route, so it's only needed to limit the other handlers.
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum duration a keep-alive connection waits for
+	// the next request.
+	IdleTimeout time.Duration
+}
+
+// tlsVersions are the TLS versions that can be given to ParseTLSVersion.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version with the given name, e.g. "1.2".
+func ParseTLSVersion(name string) (uint16, error) {
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %q", name)
+	}
+	return v, nil
+}
+
+// hostPolicy only allows obtaining certificates for the hosts of the
+// configured projects, including the custom domains they declared, the hosts
+// of the default owner whose repository exists and the landing host.
+func (s *Service) hostPolicy(_ context.Context, host string) error {
+	if s.isLandingHost(host) || s.config().hasPathPrefixes(host) {
+		return nil
+	}
+
+	owner, project, ok := s.projectForHost(host)
+	if !ok {
+		return fmt.Errorf("host %q is not configured", host)
+	}
+
+	// the repositories of the hosts of the default owner must have been
+	// found once, so certificates are never requested for random hosts.
+	if s.isDefaultProject(owner, project) {
+		if err := s.ensureIndexed("", owner, project); err != nil {
+			return wrap(err, "host %q does not serve any project", host)
+		}
+	}
+	return nil
+}
+
+// Serve serves the given service until the given context is cancelled. If
+// autocert is enabled, it serves HTTPS with certificates from Let's Encrypt
+// and redirects HTTP requests to HTTPS.
+func Serve(ctx context.Context, s *Service, opts ServeOptions) error {
+	if opts.MinTLSVersion == 0 {
+		opts.MinTLSVersion = tls.VersionTLS12
+	}
+
+	var servers []*http.Server
+	if !opts.Autocert {
+		addrs := opts.Addrs
+		if len(addrs) == 0 {
+			addrs = []string{opts.Addr}
+		}
+
+		for _, addr := range addrs {
+			servers = append(servers, newServer(opts, addr, s))
+		}
+	} else {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: s.hostPolicy,
+			Cache:      autocert.DirCache(opts.AutocertCacheDir),
+			Email:      opts.AutocertEmail,
+		}
+
+		tlsConf := m.TLSConfig()
+		tlsConf.MinVersion = opts.MinTLSVersion
+		httpsServer := newServer(opts, opts.TLSAddr, s)
+		httpsServer.TLSConfig = tlsConf
+
+		servers = append(
+			servers,
+			newServer(opts, opts.Addr, m.HTTPHandler(nil)),
+			httpsServer,
+		)
+	}
+
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		l, err := listen(srv.Addr)
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return err
+		}
+		listeners[i] = l
+	}
+
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, l net.Listener) {
+			logrus.WithField("addr", srv.Addr).Info("listening")
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			errs <- err
+		}(srv, listeners[i])
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// unixPrefix is the prefix of the addresses that are Unix sockets.
+const unixPrefix = "unix:"
+
+// listen listens on the given address, which is either a TCP address or the
+// path of a Unix socket prefixed by "unix:". The socket is removed when the
+// listener is closed.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen on %s: %s", addr, err)
+		}
+		return l, nil
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	// the socket of a previous process that was not shut down gracefully
+	// would prevent listening again on the same path
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %s", path, err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %s", addr, err)
+	}
+
+	// the reverse proxy usually runs as a different user
+	if err := os.Chmod(path, 0666); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to change the mode of socket %s: %s", path, err)
+	}
+	return l, nil
+}
+
+func newServer(opts ServeOptions, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+	}
+}
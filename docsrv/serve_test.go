@@ -0,0 +1,124 @@
+package docsrv
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	require := require.New(t)
+
+	v, err := ParseTLSVersion("1.2")
+	require.NoError(err)
+	require.Equal(uint16(tls.VersionTLS12), v)
+
+	_, err = ParseTLSVersion("2.0")
+	require.Error(err)
+}
+
+func TestHostPolicy(t *testing.T) {
+	require := require.New(t)
+	s := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "src-d/foo"},
+	})
+	s.aliases.set("src-d", "foo", []string{"docs.foo.tld"})
+	s.opts.LandingHost = "docs.bar"
+
+	ctx := context.Background()
+	require.NoError(s.hostPolicy(ctx, "foo.bar"))
+	require.NoError(s.hostPolicy(ctx, "docs.foo.tld"))
+	require.NoError(s.hostPolicy(ctx, "docs.bar"))
+	require.Error(s.hostPolicy(ctx, "baz.bar"))
+}
+
+func TestServe(t *testing.T) {
+	s := newTestSrv(newMockFetcher(), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ctx, s, ServeOptions{Addr: "127.0.0.1:0"})
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was not shut down")
+	}
+}
+
+func TestServe_Addrs(t *testing.T) {
+	require := require.New(t)
+	s := newTestSrv(newMockFetcher(), nil)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	socket := filepath.Join(tmpDir, "docsrv.sock")
+	// a stale socket left by a previous process is replaced
+	stale, err := net.Listen("unix", socket)
+	require.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ctx, s, ServeOptions{
+			Addrs: []string{"127.0.0.1:0", "unix:" + socket},
+		})
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://foo.bar/"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusNotFound, resp.StatusCode)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was not shut down")
+	}
+
+	_, err = os.Stat(socket)
+	require.True(os.IsNotExist(err))
+}
+
+func TestServe_ListenError(t *testing.T) {
+	s := newTestSrv(newMockFetcher(), nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	err = Serve(context.Background(), s, ServeOptions{
+		Addrs: []string{"127.0.0.1:0", l.Addr().String()},
+	})
+	require.Error(t, err)
+}
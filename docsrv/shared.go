@@ -0,0 +1,217 @@
+package docsrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// resolveSharedFolder returns the folder with the shared assets used to build
+// the docs of the given build: the folder of its project in the shared
+// folder, ${SHARED_FOLDER}/${OWNER}/${PROJECT}, if it exists, or the shared
+// folder otherwise. If the project requires a version of the shared assets,
+// it's the folder of the greatest version that satisfies it, e.g.
+// ${SHARED_FOLDER}/v2.1.0 for "^2.0", looking in the shared folder if the
+// folder of the project has none. The symlinks in the path are resolved, so a
+// build keeps using the same folder even if they are changed to point to a
+// new version of the assets in the meantime.
+func (c buildConfig) resolveSharedFolder() (string, error) {
+	if c.sharedFolder == "" {
+		return "", nil
+	}
+
+	bases := []string{c.sharedFolder}
+	if project := filepath.Join(c.sharedFolder, c.owner, c.project); isDir(project) {
+		bases = append([]string{project}, bases...)
+	}
+
+	if c.sharedVersion == "" {
+		return evalSharedFolder(bases[0]), nil
+	}
+
+	constraint, err := semver.NewConstraint(c.sharedVersion)
+	if err != nil {
+		return "", wrap(err, "invalid shared version %q", c.sharedVersion)
+	}
+
+	for _, base := range bases {
+		if dir, ok := greatestSharedVersion(base, constraint); ok {
+			c.log().Debugf("using shared folder %s", dir)
+			return evalSharedFolder(dir), nil
+		}
+	}
+
+	return "", &sharedFolderError{folder: c.sharedFolder, version: c.sharedVersion}
+}
+
+// greatestSharedVersion returns the folder inside the given one named after
+// the greatest semantic version that satisfies the given constraint. Will
+// also report whether or not there is any with a boolean.
+func greatestSharedVersion(base string, constraint *semver.Constraints) (string, bool) {
+	files, err := ioutil.ReadDir(base)
+	if err != nil {
+		return "", false
+	}
+
+	var greatest *semver.Version
+	var dir string
+	for _, fi := range files {
+		v := newVersion(fi.Name())
+		if v == nil || !constraint.Check(v) || (greatest != nil && !v.GreaterThan(greatest)) {
+			continue
+		}
+
+		// the versions can be symlinks to other folders.
+		path := filepath.Join(base, fi.Name())
+		if !isDir(path) {
+			continue
+		}
+
+		greatest, dir = v, path
+	}
+
+	return dir, greatest != nil
+}
+
+// evalSharedFolder returns the given folder with its symlinks resolved, or as
+// it is if they can't be, e.g. because it does not exist.
+func evalSharedFolder(dir string) string {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return dir
+	}
+	return resolved
+}
+
+// sharedFingerprintFile is the name of the file in the folder of every
+// installed version with the fingerprint of the shared folder it was built
+// with, so it's still known once docsrv restarts.
+const sharedFingerprintFile = ".docsrv-shared.json"
+
+// sharedFingerprint identifies the contents of the shared folder a version
+// was built with.
+type sharedFingerprint struct {
+	// hash is the SHA-256 of the paths and contents of the files of the
+	// folder, in hex.
+	hash string
+	// modTime is the time of the newest file of the folder.
+	modTime time.Time
+}
+
+// fingerprintSharedFolder returns the fingerprint of the contents of the given
+// folder. The symlinks inside of it are not followed, only their targets are
+// fingerprinted.
+func fingerprintSharedFolder(dir string) (sharedFingerprint, error) {
+	var fp sharedFingerprint
+	h := sha256.New()
+	// Walk visits the files in lexical order, so the hash does not depend on
+	// the order of the entries on disk.
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if fi.ModTime().After(fp.modTime) {
+			fp.modTime = fi.ModTime()
+		}
+
+		switch {
+		case fi.IsDir():
+			fmt.Fprintf(h, "d %s\x00", filepath.ToSlash(rel))
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "l %s %s\x00", filepath.ToSlash(rel), target)
+		case fi.Mode().IsRegular():
+			fmt.Fprintf(h, "f %s %d\x00", filepath.ToSlash(rel), fi.Size())
+			return hashFile(h, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return sharedFingerprint{}, wrap(err, "could not fingerprint shared folder %s", dir)
+	}
+
+	fp.hash = hex.EncodeToString(h.Sum(nil))
+	return fp, nil
+}
+
+// sharedFingerprintJSON is the fingerprint of a shared folder as it's written
+// in sharedFingerprintFile.
+type sharedFingerprintJSON struct {
+	Hash    string    `json:"hash"`
+	ModTime time.Time `json:"mod-time"`
+}
+
+// writeSharedFingerprint writes the given fingerprint to the folder of an
+// installed version.
+func writeSharedFingerprint(dir string, fp sharedFingerprint) error {
+	data, err := json.Marshal(sharedFingerprintJSON{fp.hash, fp.modTime})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, sharedFingerprintFile), data)
+}
+
+// readSharedFingerprint returns the fingerprint written to the folder of an
+// installed version. Will also report whether or not there is any.
+func readSharedFingerprint(dir string) (sharedFingerprint, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, sharedFingerprintFile))
+	if err != nil {
+		return sharedFingerprint{}, false
+	}
+
+	var fp sharedFingerprintJSON
+	if err := json.Unmarshal(data, &fp); err != nil || fp.Hash == "" {
+		return sharedFingerprint{}, false
+	}
+	return sharedFingerprint{fp.Hash, fp.ModTime}, true
+}
+
+// hashFile writes the contents of the given file to the given hash.
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// withSharedFingerprint returns the build with the fingerprint of the shared
+// folder it will be built with. If the folder can't be fingerprinted, the
+// fingerprint is left empty, and the build will fail later or use the
+// fallback theme.
+func (c buildConfig) withSharedFingerprint() buildConfig {
+	c.sharedFingerprint = sharedFingerprint{}
+	dir, err := c.resolveSharedFolder()
+	if err != nil || dir == "" || !isDir(dir) {
+		return c
+	}
+
+	fp, err := fingerprintSharedFolder(dir)
+	if err != nil {
+		c.log().Warnf("building without a shared fingerprint: %s", err)
+		return c
+	}
+
+	c.sharedFingerprint = fp
+	return c
+}
@@ -0,0 +1,101 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSharedFolder(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-shared-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	tmpDir, err = filepath.EvalSymlinks(tmpDir)
+	require.NoError(err)
+
+	for _, dir := range []string{"v1.0.0", "v1.2.0", "v2.0.0", "bar/foo/v2.1.0", "bar/baz"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpDir, dir), 0755))
+	}
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "v1.5.0"), nil, 0644))
+	require.NoError(os.Symlink(filepath.Join(tmpDir, "v2.0.0"), filepath.Join(tmpDir, "current")))
+
+	resolve := func(owner, project, version string) (string, error) {
+		return buildConfig{
+			owner:         owner,
+			project:       project,
+			sharedFolder:  tmpDir,
+			sharedVersion: version,
+		}.resolveSharedFolder()
+	}
+
+	cases := []struct {
+		owner, project, version string
+		expected                string
+	}{
+		{"bar", "qux", "", tmpDir},
+		{"bar", "foo", "", filepath.Join(tmpDir, "bar/foo")},
+		{"bar", "qux", "^1.0", filepath.Join(tmpDir, "v1.2.0")},
+		{"bar", "qux", "~1.0.0", filepath.Join(tmpDir, "v1.0.0")},
+		{"bar", "foo", "^2.0", filepath.Join(tmpDir, "bar/foo/v2.1.0")},
+		// the versions of the shared folder are used if the project has none
+		{"bar", "foo", "^1.0", filepath.Join(tmpDir, "v1.2.0")},
+		{"bar", "baz", "^2.0", filepath.Join(tmpDir, "v2.0.0")},
+	}
+
+	for _, c := range cases {
+		folder, err := resolve(c.owner, c.project, c.version)
+		require.NoError(err, "%s/%s %s", c.owner, c.project, c.version)
+		require.Equal(c.expected, folder, "%s/%s %s", c.owner, c.project, c.version)
+	}
+
+	_, err = resolve("bar", "qux", "^3.0")
+	require.Error(err)
+	require.IsType(&sharedFolderError{}, err)
+	require.Contains(err.Error(), `no version that satisfies "^3.0"`)
+
+	// symlinks are resolved
+	folder, err := buildConfig{sharedFolder: filepath.Join(tmpDir, "current")}.resolveSharedFolder()
+	require.NoError(err)
+	require.Equal(filepath.Join(tmpDir, "v2.0.0"), folder)
+
+	folder, err = buildConfig{}.resolveSharedFolder()
+	require.NoError(err)
+	require.Equal("", folder)
+}
+
+func TestFingerprintSharedFolder(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-shared-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(os.MkdirAll(filepath.Join(tmpDir, "css"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "css", "style.css"), []byte("body {}"), 0644))
+	require.NoError(os.Symlink("css/style.css", filepath.Join(tmpDir, "style.css")))
+
+	fp, err := fingerprintSharedFolder(tmpDir)
+	require.NoError(err)
+	require.Len(fp.hash, 64)
+	require.False(fp.modTime.IsZero())
+
+	same, err := fingerprintSharedFolder(tmpDir)
+	require.NoError(err)
+	require.Equal(fp.hash, same.hash)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "css", "style.css"), []byte("body {color: red}"), 0644))
+	changed, err := fingerprintSharedFolder(tmpDir)
+	require.NoError(err)
+	require.NotEqual(fp.hash, changed.hash)
+
+	require.NoError(os.Remove(filepath.Join(tmpDir, "style.css")))
+	removed, err := fingerprintSharedFolder(tmpDir)
+	require.NoError(err)
+	require.NotEqual(changed.hash, removed.hash)
+
+	_, err = fingerprintSharedFolder(filepath.Join(tmpDir, "missing"))
+	require.Error(err)
+}
@@ -0,0 +1,296 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// stateFile is the name of the file in the base folder with the state
+	// of the hosts and their installed versions.
+	stateFile = ".docsrv-state.json"
+	// statePath is the path of the API to get and resync the state.
+	statePath = "/api/state"
+)
+
+// stateManifest describes the hosts served by docsrv and the versions
+// installed on disk for each one of them, so the webserver in front of docsrv
+// can validate its root folders.
+type stateManifest struct {
+	GeneratedAt time.Time `json:"generated-at"`
+	Builder     string    `json:"builder"`
+	// Layout is the template of the folders where the versions are
+	// installed.
+	Layout string      `json:"layout"`
+	Hosts  []hostState `json:"hosts"`
+	// Quarantined are the versions that will not be built until an
+	// administrator releases them, restored when docsrv starts.
+	Quarantined []*quarantinedVersion `json:"quarantined,omitempty"`
+	// MinVersions are the minimum versions of the projects set at runtime,
+	// restored when docsrv starts.
+	MinVersions []*minVersionOverride `json:"min-versions,omitempty"`
+}
+
+// hostState is the state of a single host.
+type hostState struct {
+	Host       string `json:"host"`
+	Repository string `json:"repository"`
+	// Root is the folder the webserver serves the host from.
+	Root string `json:"root"`
+	// Target is the folder of the project, where Root should link to.
+	Target string `json:"target"`
+	// Linked reports whether or not Root is a symlink to Target.
+	Linked   bool           `json:"linked"`
+	Versions []versionState `json:"versions"`
+}
+
+// versionState is the state of a version installed on disk. The build
+// details are only known for the versions built since docsrv started.
+type versionState struct {
+	Version string     `json:"version"`
+	Path    string     `json:"path"`
+	BuiltAt *time.Time `json:"built-at"`
+	SHA     *string    `json:"sha"`
+	// SharedFingerprint is the fingerprint of the contents of the shared
+	// folder the version was built with, if known.
+	SharedFingerprint *string `json:"shared-fingerprint,omitempty"`
+}
+
+// stateManifest returns the current state of the hosts of the given config,
+// including their aliases, from the contents of the base folder.
+func (s *Service) stateManifest(conf Config) *stateManifest {
+	hosts := conf.servedHosts()
+
+	manifest := &stateManifest{
+		GeneratedAt: time.Now(),
+		Builder:     s.builder,
+		Layout:      s.opts.Layout,
+		Hosts:       make([]hostState, 0, len(hosts)),
+		Quarantined: s.quarantine.all(),
+		MinVersions: s.index.minVersionOverridesList(),
+	}
+
+	for _, host := range hosts {
+		owner, project, ok := conf.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		root := s.hostFolder(host)
+		target := s.projectFolder(owner, project)
+		link, _ := os.Readlink(root)
+		manifest.Hosts = append(manifest.Hosts, hostState{
+			Host:       host,
+			Repository: repositoryKey(owner, project),
+			Root:       root,
+			Target:     target,
+			Linked:     link == s.hostLinkTarget(host, owner, project),
+			Versions:   s.versionsOnDisk(owner, project),
+		})
+	}
+
+	return manifest
+}
+
+// versionsOnDisk returns the state of the versions of the given project
+// installed on disk.
+func (s *Service) versionsOnDisk(owner, project string) []versionState {
+	versions := make([]versionState, 0)
+	entries, _ := ioutil.ReadDir(s.projectFolder(owner, project))
+	for _, e := range entries {
+		// hidden folders are rebuilds in progress
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		v := versionState{
+			Version: e.Name(),
+			Path:    s.versionFolder(owner, project, e.Name()),
+		}
+
+		if conf, ok := s.index.installation(owner, project, e.Name()); ok {
+			builtAt := conf.builtAt
+			v.BuiltAt = &builtAt
+			if conf.sha != "" {
+				sha := conf.sha
+				v.SHA = &sha
+			}
+			if conf.sharedFingerprint.hash != "" {
+				fp := conf.sharedFingerprint.hash
+				v.SharedFingerprint = &fp
+			}
+		}
+
+		// the fingerprints of the versions built before docsrv started are
+		// kept in their folders.
+		if v.SharedFingerprint == nil {
+			if fp, ok := readSharedFingerprint(v.Path); ok {
+				v.SharedFingerprint = &fp.hash
+			}
+		}
+
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// readStateFile reads the state manifest written to the base folder, if
+// there is one.
+func (s *Service) readStateFile() (*stateManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.opts.BaseFolder, stateFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest stateManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, wrap(err, "invalid state manifest")
+	}
+
+	return &manifest, nil
+}
+
+// restoreState restores the state kept in the state manifest of the base
+// folder that is not on disk otherwise, such as the quarantined versions and
+// the minimum versions set at runtime.
+func (s *Service) restoreState() {
+	if s.opts.BaseFolder == "" {
+		return
+	}
+
+	manifest, err := s.readStateFile()
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logrus.Errorf("could not restore state: %s", err)
+		return
+	}
+
+	for _, v := range manifest.Quarantined {
+		s.quarantine.add(v)
+	}
+
+	for _, o := range manifest.MinVersions {
+		if min := newVersion(o.Version); min != nil {
+			s.index.setMinVersion(o.Owner, o.Project, min)
+		}
+	}
+}
+
+// writeState writes the state manifest to the base folder. The file is
+// replaced atomically, so readers never see a partial manifest. Errors are
+// logged, since the docs are served anyway.
+func (s *Service) writeState() {
+	if s.opts.BaseFolder == "" {
+		return
+	}
+
+	s.stateMut.Lock()
+	defer s.stateMut.Unlock()
+
+	if err := s.writeStateFile(s.stateManifest(s.config())); err != nil {
+		logrus.Errorf("could not write state manifest: %s", err)
+	}
+}
+
+func (s *Service) writeStateFile(manifest *stateManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(s.opts.BaseFolder, stateFile), data)
+}
+
+// writeFileAtomic writes the given data to the file at the given path,
+// creating its folder if needed. The file is replaced atomically, so readers
+// never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0740); err != nil {
+		return wrap(err, "error creating folder of %s", path)
+	}
+
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".")
+	if err != nil {
+		return wrap(err, "error creating temporary file of %s", path)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return wrap(err, "error writing temporary file of %s", path)
+	}
+
+	if err := f.Close(); err != nil {
+		return wrap(err, "error writing temporary file of %s", path)
+	}
+
+	// the webserver and its sidecars may run as other users.
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return wrap(err, "error setting permissions of %s", path)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// resyncState forgets the installed versions that are no longer on disk,
+// links the folders of all the hosts to the folders of their projects and
+// writes the state manifest again.
+func (s *Service) resyncState() {
+	conf := s.config()
+	for host := range conf {
+		owner, project, ok := conf.ProjectForHost(host)
+		if !ok {
+			continue
+		}
+
+		for _, version := range s.index.installedVersions(owner, project) {
+			if !isDir(s.versionFolder(owner, project, version)) {
+				logrus.WithFields(logrus.Fields{
+					"project": project,
+					"owner":   owner,
+					"version": version,
+				}).Warn("installed version is missing on disk, it will be built again")
+				s.index.uninstall(owner, project, version)
+				s.search.remove(owner, project, version)
+			}
+		}
+	}
+
+	// the state is written once the hosts are linked.
+	s.LinkHosts()
+}
+
+// manageState is an HTTP handler that outputs the state manifest of all the
+// hosts or, with a POST request, resyncs it with the contents of the base
+// folder first. Only available to administrators.
+func (s *Service) manageState(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.resyncState()
+		requestLog(r).Info("state resynced")
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.writeJSON(w, s.stateManifest(s.config())); err != nil {
+		requestLog(r).Errorf("error serving state: %s", err)
+		s.internalError(w, r)
+	}
+}
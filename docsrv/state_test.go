@@ -0,0 +1,93 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateManifest(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.setSHA("bar", "foo", "v1.0.0", "1234")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":  ProjectConfig{Repository: "bar/foo"},
+		"docs.baz": ProjectConfig{Repository: "baz/docs"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	srv.LinkHosts()
+	manifest := readStateFile(t, tmpDir)
+	require.Len(manifest.Hosts, 2)
+	require.Equal("docs.baz", manifest.Hosts[0].Host)
+	require.Equal("foo.bar", manifest.Hosts[1].Host)
+	require.True(manifest.Hosts[1].Linked)
+	require.Equal(filepath.Join(tmpDir, "foo.bar"), manifest.Hosts[1].Root)
+	require.Equal(filepath.Join(tmpDir, "bar", "foo"), manifest.Hosts[1].Target)
+	require.Empty(manifest.Hosts[1].Versions)
+
+	// versions built before a restart are on disk, but not in the index
+	old := filepath.Join(tmpDir, "bar", "foo", "v0.9.0")
+	require.NoError(os.MkdirAll(old, 0755))
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+	manifest = readStateFile(t, tmpDir)
+	versions := manifest.Hosts[1].Versions
+	require.Len(versions, 2)
+	require.Equal("v0.9.0", versions[0].Version)
+	require.Equal(old, versions[0].Path)
+	require.Nil(versions[0].BuiltAt)
+	require.Nil(versions[0].SHA)
+	require.Equal("v1.0.0", versions[1].Version)
+	require.NotNil(versions[1].BuiltAt)
+	require.Equal("1234", *versions[1].SHA)
+
+	// the docs were removed behind the back of docsrv
+	require.NoError(os.RemoveAll(filepath.Join(tmpDir, "bar", "foo", "v1.0.0")))
+	require.NoError(os.Remove(filepath.Join(tmpDir, "foo.bar")))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/state?token=admin", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &manifest))
+	require.False(manifest.Hosts[1].Linked)
+	require.True(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/state?token=admin", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &manifest))
+	require.True(manifest.Hosts[1].Linked)
+	require.Len(manifest.Hosts[1].Versions, 1)
+	require.False(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+	require.Equal(manifest.Hosts, readStateFile(t, tmpDir).Hosts)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "http://foo.bar/api/state", nil))
+	require.Equal(http.StatusForbidden, w.Code)
+}
+
+func readStateFile(t *testing.T, baseFolder string) *stateManifest {
+	data, err := ioutil.ReadFile(filepath.Join(baseFolder, stateFile))
+	require.NoError(t, err)
+
+	var manifest stateManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	return &manifest
+}
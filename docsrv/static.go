@@ -0,0 +1,111 @@
+package docsrv
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errorsFolder is the folder inside the base folder that contains the error
+// pages and their assets.
+const errorsFolder = "errors"
+
+// serveStatic serves the requested file from the base folder if static file
+// serving is enabled and the file exists, following the same rules the
+// webserver in front of docsrv would. Will report whether or not the request
+// was served.
+func (s *Service) serveStatic(w http.ResponseWriter, r *http.Request) bool {
+	if !s.opts.ServeStatic {
+		return false
+	}
+
+	host := stripPort(r.Host)
+	upath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && upath != "/" {
+		upath += "/"
+	}
+
+	candidates := []string{
+		filepath.Join(s.opts.BaseFolder, host, filepath.FromSlash(upath)),
+		filepath.Join(s.opts.BaseFolder, errorsFolder, filepath.FromSlash(upath)),
+	}
+
+	for _, file := range candidates {
+		if serveFile(w, r, file) {
+			return true
+		}
+	}
+
+	// the error pages could not be found, so serve a minimal version of them
+	// instead of letting the request go through and redirect to themselves.
+	switch upath {
+	case "/404/":
+		httpError(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return true
+	case "/500/":
+		httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return true
+	}
+
+	return false
+}
+
+// serveFile serves the given file, the index.html file inside it if it's a
+// directory or the file with the .html extension if it does not exist. Will
+// report whether or not any of them was found and served.
+func serveFile(w http.ResponseWriter, r *http.Request, file string) bool {
+	fi, err := os.Stat(file)
+	if err == nil && fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			url := localURL(r, r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				url += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, url, http.StatusMovedPermanently)
+			return true
+		}
+
+		file = filepath.Join(file, "index.html")
+		fi, err = os.Stat(file)
+	} else if os.IsNotExist(err) {
+		file += ".html"
+		fi, err = os.Stat(file)
+	}
+
+	if err != nil || fi.IsDir() {
+		return false
+	}
+
+	name := fi.Name()
+	if precompressedExtensions[strings.ToLower(filepath.Ext(file))] {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if variant, encoding, vfi := precompressedVariant(r, file); vfi != nil {
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Set("Content-Type", contentType(file))
+			file, fi = variant, vfi
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// http.ServeContent handles the Range requests, but resuming a download
+	// with If-Range requires a strong validator more precise than the
+	// modification time, which only has one second resolution.
+	w.Header().Set("ETag", fileETag(fi))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+	return true
+}
+
+// fileETag returns a strong entity tag for the given file derived from its
+// modification time and size, so it changes whenever the file is replaced by
+// a rebuild.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
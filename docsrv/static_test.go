@@ -0,0 +1,136 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeStatic(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"foo.bar.baz/v1.0.0/index.html":   "<h1>index</h1>",
+		"foo.bar.baz/v1.0.0/guide.html":   "<h1>guide</h1>",
+		"foo.bar.baz/v1.0.0/css/main.css": "body { color: red; }",
+		"errors/404/index.html":           "<h1>not found</h1>",
+		"secret.txt":                      "secret",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	fetcher := newMockFetcher()
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar.baz": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.ServeStatic = true
+
+	cases := []struct {
+		url         string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"http://foo.bar.baz/v1.0.0/", http.StatusOK, "<h1>index</h1>", "text/html; charset=utf-8"},
+		{"http://foo.bar.baz/v1.0.0/guide", http.StatusOK, "<h1>guide</h1>", "text/html; charset=utf-8"},
+		{"http://foo.bar.baz/v1.0.0/css/main.css?v=1234", http.StatusOK, "body { color: red; }", "text/css; charset=utf-8"},
+		{"http://foo.bar.baz/404/", http.StatusOK, "<h1>not found</h1>", "text/html; charset=utf-8"},
+		{"http://foo.bar.baz/500/", http.StatusInternalServerError, "Internal Server Error\n", "text/plain; charset=utf-8"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", c.url, nil)
+		require.NoError(err, c.url)
+
+		srv.ServeHTTP(w, req)
+		require.Equal(c.status, w.Code, c.url)
+		require.Equal(c.body, w.Body.String(), c.url)
+		require.Equal(c.contentType, w.Header().Get("Content-Type"), c.url)
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar.baz/v1.0.0", nil)
+	require.NoError(err)
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusMovedPermanently, w.Code)
+	require.Equal("/v1.0.0/", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "http://foo.bar.baz/v1.0.0/css/main.css", nil)
+	require.NoError(err)
+	req.Header.Set("Range", "bytes=0-3")
+	srv.ServeHTTP(w, req)
+	require.Equal(http.StatusPartialContent, w.Code)
+	require.Equal("body", w.Body.String())
+
+	// files outside the host folder are never served
+	assertNotFound(t, srv, "http://foo.bar.baz/../secret.txt")
+
+	// not existing files go through docsrv
+	assertNotFound(t, srv, "http://foo.bar.baz/v2.0.0/")
+}
+
+func TestServeStatic_Resume(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "foo.bar", "v1.0.0", "dataset.csv")
+	require.NoError(os.MkdirAll(filepath.Dir(file), 0755))
+	require.NoError(ioutil.WriteFile(file, []byte("0123456789"), 0644))
+
+	srv := newTestSrv(newMockFetcher(), Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.ServeStatic = true
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://foo.bar/v1.0.0/dataset.csv", nil)
+		require.NoError(err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(nil)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("bytes", w.Header().Get("Accept-Ranges"))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(etag)
+
+	w = get(map[string]string{"Range": "bytes=4-", "If-Range": etag})
+	require.Equal(http.StatusPartialContent, w.Code)
+	require.Equal("456789", w.Body.String())
+	require.Equal("bytes 4-9/10", w.Header().Get("Content-Range"))
+
+	w = get(map[string]string{"If-None-Match": etag})
+	require.Equal(http.StatusNotModified, w.Code)
+
+	// the file changed since the download started, so it starts over
+	require.NoError(ioutil.WriteFile(file, []byte("9876543210!"), 0644))
+	w = get(map[string]string{"Range": "bytes=4-", "If-Range": etag})
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("9876543210!", w.Body.String())
+	require.NotEqual(etag, w.Header().Get("ETag"))
+}
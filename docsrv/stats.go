@@ -0,0 +1,238 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsPath is the path of the API with the disk usage and builds of the
+// projects.
+const statsPath = "/api/stats"
+
+// projectStats are the disk usage and builds of a project.
+type projectStats struct {
+	Repository string   `json:"repository"`
+	Hosts      []string `json:"hosts"`
+	// RefreshedAt is the last time the releases of the project were
+	// indexed, if ever.
+	RefreshedAt *time.Time `json:"refreshed-at"`
+	// DiskUsage is the size in bytes of all the installed versions.
+	DiskUsage int64 `json:"disk-usage"`
+	// LastBuiltAt and LastBuildDuration describe the most recent build
+	// since docsrv started, if any.
+	LastBuiltAt       *time.Time     `json:"last-built-at"`
+	LastBuildDuration *float64       `json:"last-build-duration"`
+	Versions          []versionStats `json:"versions"`
+	// SkippedTags are the tags of the releases that are not served because
+	// they are not versions of the version scheme of the project.
+	SkippedTags []string `json:"skipped-tags"`
+}
+
+// versionStats are the disk usage and build of a version installed on disk.
+// The build details are only known for the versions built since docsrv
+// started.
+type versionStats struct {
+	Version       string     `json:"version"`
+	DiskUsage     int64      `json:"disk-usage"`
+	BuiltAt       *time.Time `json:"built-at"`
+	BuildDuration *float64   `json:"build-duration"`
+	// Orphaned reports whether the release of the version was deleted
+	// upstream.
+	Orphaned bool `json:"orphaned"`
+}
+
+// projectsStats returns the stats of all the configured projects sorted by
+// repository.
+func (s *Service) projectsStats() []projectStats {
+	conf := s.config()
+	seen := make(map[string]bool)
+	var repositories []string
+	for _, projectConf := range conf {
+		if !seen[projectConf.Repository] {
+			seen[projectConf.Repository] = true
+			repositories = append(repositories, projectConf.Repository)
+		}
+	}
+	sort.Strings(repositories)
+
+	stats := make([]projectStats, 0, len(repositories))
+	for _, repository := range repositories {
+		owner, project, ok := splitRepository(repository)
+		if !ok {
+			continue
+		}
+
+		stats = append(stats, s.projectStats(conf, owner, project))
+	}
+	return stats
+}
+
+// projectStats returns the stats of the given project.
+func (s *Service) projectStats(conf Config, owner, project string) projectStats {
+	stats := projectStats{
+		Repository:  newKey(owner, project),
+		Hosts:       conf.HostsForProject(owner, project),
+		Versions:    make([]versionStats, 0),
+		SkippedTags: make([]string, 0),
+	}
+
+	if tags := s.index.skippedTagsForProject(owner, project); len(tags) > 0 {
+		stats.SkippedTags = tags
+	}
+
+	if t, ok := s.index.lastRefresh(owner, project); ok {
+		stats.RefreshedAt = &t
+	}
+
+	orphaned := make(map[string]bool)
+	for _, version := range s.index.orphanedForProject(owner, project) {
+		orphaned[version] = true
+	}
+
+	for _, v := range s.versionsOnDisk(owner, project) {
+		vs := versionStats{
+			Version:   v.Version,
+			DiskUsage: dirSize(v.Path),
+			BuiltAt:   v.BuiltAt,
+			Orphaned:  orphaned[v.Version],
+		}
+
+		if installed, ok := s.index.installation(owner, project, v.Version); ok && installed.buildDuration > 0 {
+			duration := installed.buildDuration.Seconds()
+			vs.BuildDuration = &duration
+			if stats.LastBuiltAt == nil || installed.builtAt.After(*stats.LastBuiltAt) {
+				stats.LastBuiltAt = v.BuiltAt
+				stats.LastBuildDuration = &duration
+			}
+		}
+
+		stats.DiskUsage += vs.DiskUsage
+		stats.Versions = append(stats.Versions, vs)
+	}
+
+	return stats
+}
+
+// ownerDiskUsage returns the size in bytes of the installed versions of all
+// the configured projects of the given owner. It's checked before every
+// build, so the sizes of the versions are not computed again unless their
+// folders changed.
+func (s *Service) ownerDiskUsage(owner string) int64 {
+	var size int64
+	seen := make(map[string]bool)
+	for _, conf := range s.config() {
+		o, project, ok := splitRepository(conf.Repository)
+		if !ok || o != owner || seen[project] {
+			continue
+		}
+
+		seen[project] = true
+		entries, _ := ioutil.ReadDir(s.projectFolder(owner, project))
+		for _, e := range entries {
+			// hidden folders are rebuilds in progress
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			size += s.sizes.size(s.versionFolder(owner, project, e.Name()), e.ModTime())
+		}
+	}
+	return size
+}
+
+// folderSizes caches the sizes of the folders of the installed versions.
+// They are updated when the versions are installed or deleted, and computed
+// again when their folders are replaced otherwise, such as by another
+// instance sharing the base folder.
+type folderSizes struct {
+	mut   sync.Mutex
+	sizes map[string]folderSize
+}
+
+// folderSize is the size of a folder with the given modification time.
+type folderSize struct {
+	modTime time.Time
+	size    int64
+}
+
+func newFolderSizes() *folderSizes {
+	return &folderSizes{sizes: make(map[string]folderSize)}
+}
+
+// size returns the size in bytes of the given folder, with the given
+// modification time, computing it if it's not cached or the folder changed.
+func (f *folderSizes) size(path string, modTime time.Time) int64 {
+	f.mut.Lock()
+	cached, ok := f.sizes[path]
+	f.mut.Unlock()
+	if ok && cached.modTime.Equal(modTime) {
+		return cached.size
+	}
+
+	size := dirSize(path)
+	f.mut.Lock()
+	f.sizes[path] = folderSize{modTime, size}
+	f.mut.Unlock()
+	return size
+}
+
+// update computes again the size of the given folder.
+func (f *folderSizes) update(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		f.forget(path)
+		return
+	}
+
+	size := dirSize(path)
+	f.mut.Lock()
+	f.sizes[path] = folderSize{fi.ModTime(), size}
+	f.mut.Unlock()
+}
+
+// forget removes the size of the given folder, which was deleted.
+func (f *folderSizes) forget(path string) {
+	f.mut.Lock()
+	delete(f.sizes, path)
+	f.mut.Unlock()
+}
+
+// dirSize returns the size in bytes of all the files in the given folder.
+// Symlinks are not followed.
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// serveStats is an HTTP handler that will output the disk usage of the
+// installed versions of all the projects, their last builds and the last
+// time they were refreshed. Only available to administrators.
+func (s *Service) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.writeJSON(w, s.projectsStats()); err != nil {
+		requestLog(r).Errorf("error serving stats: %s", err)
+		s.internalError(w, r)
+	}
+}
@@ -0,0 +1,105 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeStats(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "nightly", url)
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar":  ProjectConfig{Repository: "bar/foo"},
+		"foo2.bar": ProjectConfig{Repository: "bar/foo"},
+		"baz.bar":  ProjectConfig{Repository: "bar/baz"},
+	})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+	srv.opts.RefreshToken = "admin"
+
+	// versions built before a restart have no build details
+	old := filepath.Join(tmpDir, "bar", "foo", "v0.9.0")
+	require.NoError(os.MkdirAll(old, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(old, "index.html"), []byte("12345"), 0644))
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://foo.bar/v1.0.0/", nil))
+	require.True(srv.index.isInstalled("bar", "foo", "v1.0.0"))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/stats?token=admin", nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	var stats []projectStats
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Len(stats, 2)
+
+	require.Equal("bar/baz", stats[0].Repository)
+	require.Nil(stats[0].RefreshedAt)
+	require.Empty(stats[0].Versions)
+	require.Equal([]string{}, stats[0].SkippedTags)
+
+	foo := stats[1]
+	require.Equal("bar/foo", foo.Repository)
+	require.Equal([]string{"foo.bar", "foo2.bar"}, foo.Hosts)
+	require.NotNil(foo.RefreshedAt)
+	require.Equal([]string{"nightly"}, foo.SkippedTags)
+	require.Len(foo.Versions, 2)
+
+	require.Equal("v0.9.0", foo.Versions[0].Version)
+	require.Equal(int64(5), foo.Versions[0].DiskUsage)
+	require.Nil(foo.Versions[0].BuiltAt)
+	require.Nil(foo.Versions[0].BuildDuration)
+
+	require.Equal("v1.0.0", foo.Versions[1].Version)
+	require.True(foo.Versions[1].DiskUsage > 0)
+	require.NotNil(foo.Versions[1].BuildDuration)
+	require.Equal(foo.Versions[1].BuiltAt.Unix(), foo.LastBuiltAt.Unix())
+	require.Equal(*foo.Versions[1].BuildDuration, *foo.LastBuildDuration)
+	require.Equal(foo.Versions[0].DiskUsage+foo.Versions[1].DiskUsage, foo.DiskUsage)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/api/stats", nil))
+	require.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestOwnerDiskUsage(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	srv := newTestSrv(newMockFetcher(), Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+
+	folder := srv.versionFolder("bar", "foo", "v1.0.0")
+	require.NoError(os.MkdirAll(filepath.Join(folder, "css"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(folder, "index.html"), []byte("12345"), 0644))
+	require.Equal(int64(5), srv.ownerDiskUsage("bar"))
+
+	// the size is cached until the folder of the version changes
+	require.NoError(ioutil.WriteFile(filepath.Join(folder, "css", "style.css"), []byte("123"), 0644))
+	require.Equal(int64(5), srv.ownerDiskUsage("bar"))
+
+	srv.markInstalled(buildConfig{owner: "bar", project: "foo", version: "v1.0.0", destination: folder})
+	require.Equal(int64(8), srv.ownerDiskUsage("bar"))
+
+	require.NoError(srv.deleteVersion("bar", "foo", "v1.0.0"))
+	require.Equal(int64(0), srv.ownerDiskUsage("bar"))
+	require.Equal(int64(0), srv.ownerDiskUsage("baz"))
+}
@@ -0,0 +1,117 @@
+package docsrv
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	versionStatusPrefix = "/api/versions/"
+	versionStatusSuffix = "/status"
+)
+
+// versionStatusInfo is the build status of a version.
+type versionStatusInfo struct {
+	Version        string     `json:"version"`
+	Installed      bool       `json:"installed"`
+	BuiltAt        *time.Time `json:"built-at"`
+	Builder        *string    `json:"builder"`
+	SHA            *string    `json:"sha"`
+	RebuildPending bool       `json:"rebuild-pending"`
+	// LastFailure is the last failed build of the version since it was
+	// last built, if any.
+	LastFailure *buildFailure `json:"last-failure"`
+}
+
+// builderName returns the name of this docsrv instance.
+func builderName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// isVersionStatusPath reports whether the given path is the one of the status
+// of a version, i.e. /api/versions/${VERSION}/status.
+func isVersionStatusPath(path string) bool {
+	_, ok := versionFromStatusPath(path)
+	return ok
+}
+
+// versionFromStatusPath returns the version in the given status path.
+func versionFromStatusPath(path string) (string, bool) {
+	if !strings.HasPrefix(path, versionStatusPrefix) || !strings.HasSuffix(path, versionStatusSuffix) {
+		return "", false
+	}
+
+	version := strings.TrimSuffix(strings.TrimPrefix(path, versionStatusPrefix), versionStatusSuffix)
+	if version == "" || strings.Contains(version, "/") {
+		return "", false
+	}
+	return version, true
+}
+
+// versionStatus is an HTTP handler that will output a JSON with the build
+// status of a version: whether or not it's installed, when and by which
+// instance it was built, the commit it was built from and whether or not it's
+// going to be rebuilt, so release tooling can wait for the docs to be live.
+func (s *Service) versionStatus(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	version, _ := versionFromStatusPath(r.URL.Path)
+	status, ok := s.versionStatusInfo(owner, project, version)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := s.writeJSON(w, status); err != nil {
+		log.Errorf("error serving version status: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+// versionStatusInfo returns the build status of the given version. Will also
+// report whether or not the version exists.
+func (s *Service) versionStatusInfo(owner, project, version string) (*versionStatusInfo, bool) {
+	release := s.index.get(owner, project, version)
+	conf, installed := s.index.installation(owner, project, version)
+	if release == nil && !installed {
+		return nil, false
+	}
+
+	status := &versionStatusInfo{Version: version, Installed: installed}
+	if failure, ok := s.failures.get(owner, project, version); ok {
+		status.LastFailure = failure
+	}
+
+	if !installed {
+		return status, true
+	}
+
+	status.BuiltAt = &conf.builtAt
+	status.Builder = &conf.builder
+	if conf.sha != "" {
+		status.SHA = &conf.sha
+	}
+
+	_, rebuilding := s.rebuilding.Load(newKey(owner, project, version))
+	outdated := release != nil && release.sha != "" && release.sha != conf.sha
+	status.RebuildPending = rebuilding || outdated
+	return status, true
+}
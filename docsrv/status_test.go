@@ -0,0 +1,85 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionStatus(t *testing.T) {
+	require := require.New(t)
+	url, close := tarGzServer()
+	defer close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", url)
+	fetcher.add("bar", "foo", "v2.0.0", url)
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "bar/foo"}})
+	srv.opts.BaseFolder = tmpDir
+	srv.opts.SharedFolder = testSharedFolder
+
+	assertRedirect(t, srv, "http://foo.bar/v1.0.0/", "http://foo.bar/v1.0.0/")
+
+	status := getVersionStatus(t, srv, "http://foo.bar/api/versions/v1.0.0/status")
+	require.Equal("v1.0.0", status.Version)
+	require.True(status.Installed)
+	require.NotNil(status.BuiltAt)
+	require.False(status.BuiltAt.IsZero())
+	require.Equal(builderName(), *status.Builder)
+	require.Nil(status.SHA)
+	require.False(status.RebuildPending)
+
+	status = getVersionStatus(t, srv, "http://foo.bar/api/versions/v2.0.0/status")
+	require.Equal(&versionStatusInfo{Version: "v2.0.0"}, status)
+
+	// installed version whose source has changed
+	srv.index.install(buildConfig{owner: "bar", project: "foo", version: "master", sha: "abc"})
+	srv.index.add("bar", "foo", &release{tag: "master", sha: "def"})
+	status = getVersionStatus(t, srv, "http://foo.bar/api/versions/master/status")
+	require.Equal("abc", *status.SHA)
+	require.True(status.RebuildPending)
+
+	assertNotFound(t, srv, "http://foo.bar/api/versions/v3.0.0/status")
+}
+
+func getVersionStatus(t *testing.T, handler http.Handler, url string) *versionStatusInfo {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var status versionStatusInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return &status
+}
+
+func TestVersionFromStatusPath(t *testing.T) {
+	cases := []struct {
+		path    string
+		version string
+		ok      bool
+	}{
+		{"/api/versions/v1.0.0/status", "v1.0.0", true},
+		{"/api/versions//status", "", false},
+		{"/api/versions/v1.0.0/foo/status", "", false},
+		{"/api/versions/v1.0.0", "", false},
+		{"/v1.0.0/status", "", false},
+	}
+
+	for _, c := range cases {
+		version, ok := versionFromStatusPath(c.path)
+		require.Equal(t, c.version, version, c.path)
+		require.Equal(t, c.ok, ok, c.path)
+	}
+}
@@ -0,0 +1,128 @@
+package docsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// usageStats are the counters of the usage of the service since they were
+// last reported.
+type usageStats struct {
+	requests      int64
+	errors        int64
+	builds        int64
+	buildFailures int64
+}
+
+// countRequest counts a request served with the given response.
+func (u *usageStats) countRequest(w *statusRecorder) {
+	atomic.AddInt64(&u.requests, 1)
+	if w.status >= 500 {
+		atomic.AddInt64(&u.errors, 1)
+	}
+}
+
+// countBuild counts a build that finished with the given error.
+func (u *usageStats) countBuild(err error) {
+	atomic.AddInt64(&u.builds, 1)
+	if err != nil {
+		atomic.AddInt64(&u.buildFailures, 1)
+	}
+}
+
+// usageReport contains the anonymous aggregate stats of the usage of an
+// instance during a period of time. It contains no host names, projects or
+// any other data that could identify the instance or its users.
+type usageReport struct {
+	Instance      string  `json:"instance"`
+	Period        float64 `json:"period"`
+	Hosts         int     `json:"hosts"`
+	Projects      int     `json:"projects"`
+	Installed     int     `json:"installed"`
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	ErrorRate     float64 `json:"error-rate"`
+	Builds        int64   `json:"builds"`
+	BuildFailures int64   `json:"build-failures"`
+	BuildsPerDay  float64 `json:"builds-per-day"`
+}
+
+// usageReport returns the report of the usage of the service during the
+// given period and resets the counters.
+func (s *Service) usageReport(instance string, period time.Duration) *usageReport {
+	config := s.config()
+	projects := make(map[string]struct{})
+	for _, conf := range config {
+		projects[conf.Repository] = struct{}{}
+	}
+
+	report := &usageReport{
+		Instance:      instance,
+		Period:        period.Seconds(),
+		Hosts:         len(config),
+		Projects:      len(projects),
+		Installed:     s.index.installedCount(),
+		Requests:      atomic.SwapInt64(&s.stats.requests, 0),
+		Errors:        atomic.SwapInt64(&s.stats.errors, 0),
+		Builds:        atomic.SwapInt64(&s.stats.builds, 0),
+		BuildFailures: atomic.SwapInt64(&s.stats.buildFailures, 0),
+	}
+
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+	}
+
+	if days := period.Hours() / 24; days > 0 {
+		report.BuildsPerDay = float64(report.Builds) / days
+	}
+
+	return report
+}
+
+// ReportUsage sends the anonymous aggregate stats of the usage of the service
+// to the given URL every interval until the given context is cancelled. The
+// instance is identified by a random ID that changes on every restart.
+func (s *Service) ReportUsage(ctx context.Context, url string, interval time.Duration) {
+	instance := newID()
+	client := &http.Client{Timeout: 30 * time.Second}
+	last := time.Now()
+	for {
+		select {
+		case <-time.After(interval):
+			now := time.Now()
+			report := s.usageReport(instance, now.Sub(last))
+			last = now
+
+			if err := sendUsageReport(client, url, report); err != nil {
+				logrus.Warnf("unable to send usage report: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sendUsageReport(client *http.Client, url string, report *usageReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package docsrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportUsage(t *testing.T) {
+	require := require.New(t)
+
+	reports := make(chan *usageReport, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report usageReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err == nil {
+			reports <- &report
+		}
+	}))
+	defer server.Close()
+
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "bar/foo"},
+		"baz.bar": ProjectConfig{Repository: "bar/foo"},
+		"qux.bar": ProjectConfig{Repository: "bar/qux"},
+	})
+	srv.index.install(buildConfig{owner: "bar", project: "foo", version: "v1.0.0"})
+
+	assertRedirect(t, srv, "http://foo.bar/latest/", "http://foo.bar/v1.0.0/")
+	assertNotFound(t, srv, "http://foo.bar/v2.0.0/")
+	srv.stats.countBuild(nil)
+	srv.stats.countBuild(&ErrBuildFailed{})
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://foo.bar/v1.0.0/", nil)
+	require.NoError(err)
+	srv.internalError(w, req)
+	srv.stats.countRequest(&statusRecorder{ResponseWriter: w, status: w.Code})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ReportUsage(ctx, server.URL, 10*time.Millisecond)
+
+	var report *usageReport
+	select {
+	case report = <-reports:
+	case <-time.After(time.Second):
+		require.FailNow("no usage report was sent")
+	}
+
+	require.Len(report.Instance, 16)
+	require.True(report.Period > 0)
+	require.Equal(3, report.Hosts)
+	require.Equal(2, report.Projects)
+	require.Equal(1, report.Installed)
+	require.Equal(int64(3), report.Requests)
+	require.Equal(int64(1), report.Errors)
+	require.InDelta(1.0/3, report.ErrorRate, 0.001)
+	require.Equal(int64(2), report.Builds)
+	require.Equal(int64(1), report.BuildFailures)
+	require.True(report.BuildsPerDay > 0)
+
+	// counters are reset after every report
+	select {
+	case report = <-reports:
+	case <-time.After(time.Second):
+		require.FailNow("no usage report was sent")
+	}
+	require.Equal(int64(0), report.Requests)
+	require.Equal(int64(0), report.Builds)
+}
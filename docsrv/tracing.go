@@ -0,0 +1,131 @@
+package docsrv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// sampleRand returns a random number in [0.0, 1.0) to decide whether a trace
+// is sampled. It's a variable so it can be replaced in tests.
+var sampleRand = mathrand.Float64
+
+// requestTrace records the time spent in the operations performed to serve
+// a request.
+type requestTrace struct {
+	id    string
+	host  string
+	path  string
+	start time.Time
+
+	mut   sync.Mutex
+	spans []traceSpan
+	// build is true if the request triggered a build.
+	build bool
+}
+
+type traceSpan struct {
+	Name     string        `json:"name"`
+	Start    time.Duration `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+type traceKey struct{}
+
+// newID returns a new random identifier.
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startTrace starts the trace of the given request and returns the request
+// with the trace in its context. The trace has the same ID as the request.
+func startTrace(r *http.Request) (*http.Request, *requestTrace) {
+	t := &requestTrace{
+		id:    requestID(r),
+		host:  stripPort(r.Host),
+		path:  r.URL.Path,
+		start: time.Now(),
+	}
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, t)), t
+}
+
+// traceFromRequest returns the trace of the given request, if any.
+func traceFromRequest(r *http.Request) *requestTrace {
+	t, _ := r.Context().Value(traceKey{}).(*requestTrace)
+	return t
+}
+
+// startSpan starts a span with the given name in the trace of the request and
+// returns the function that ends it.
+func startSpan(r *http.Request, name string) func() {
+	t := traceFromRequest(r)
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		t.mut.Lock()
+		defer t.mut.Unlock()
+		t.spans = append(t.spans, traceSpan{
+			Name:     name,
+			Start:    start.Sub(t.start),
+			Duration: time.Since(start),
+		})
+	}
+}
+
+// markBuild marks the trace of the request as one of a request that
+// triggered a build.
+func markBuild(r *http.Request) {
+	if t := traceFromRequest(r); t != nil {
+		t.mut.Lock()
+		t.build = true
+		t.mut.Unlock()
+	}
+}
+
+// traceSampling returns the sample rate and whether or not build-triggering
+// requests are always sampled for the given host.
+func (s *Service) traceSampling(host string) (rate float64, builds bool) {
+	rate, builds = s.opts.TraceSampleRate, s.opts.TraceBuilds
+	if conf, ok := s.config()[host]; ok {
+		if conf.TraceSampleRate != nil {
+			rate = *conf.TraceSampleRate
+		}
+		if conf.TraceBuilds != nil {
+			builds = *conf.TraceBuilds
+		}
+	}
+	return rate, builds
+}
+
+// finishTrace ends the given trace and logs it if it's sampled. The decision
+// is made once the request has been served so that the requests that
+// triggered a build can always be sampled.
+func (s *Service) finishTrace(t *requestTrace) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	rate, builds := s.traceSampling(t.host)
+	if !(builds && t.build) && (rate <= 0 || sampleRand() >= rate) {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"trace_id": t.id,
+		"host":     t.host,
+		"path":     t.path,
+		"duration": time.Since(t.start),
+		"build":    t.build,
+		"spans":    t.spans,
+	}).Info("request trace")
+}
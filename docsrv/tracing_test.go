@@ -0,0 +1,102 @@
+package docsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// logHook records the messages logged with the standard logger.
+type logHook struct {
+	mut     sync.Mutex
+	entries []*logrus.Entry
+}
+
+func newLogHook() (*logHook, func()) {
+	h := new(logHook)
+	logrus.AddHook(h)
+	return h, func() {
+		logrus.StandardLogger().Hooks = make(logrus.LevelHooks)
+	}
+}
+
+func (h *logHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h *logHook) Fire(e *logrus.Entry) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.entries = append(h.entries, e)
+	return nil
+}
+
+func (h *logHook) AllEntries() []*logrus.Entry {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return append([]*logrus.Entry(nil), h.entries...)
+}
+
+func tracedRequests(t *testing.T, s *Service, requestURL string) int {
+	hook, reset := newLogHook()
+	defer reset()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", requestURL, nil)
+	require.NoError(t, err)
+	s.ServeHTTP(w, req)
+
+	var n int
+	for _, e := range hook.AllEntries() {
+		if e.Message == "request trace" && e.Level == logrus.InfoLevel {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTraceSampling(t *testing.T) {
+	require := require.New(t)
+	defer func(f func() float64) { sampleRand = f }(sampleRand)
+	sampleRand = func() float64 { return 0.5 }
+
+	url, close := tarGzServer()
+	defer close()
+
+	fetcher := newMockFetcher()
+	fetcher.add("src-d", "foo", "v1.0.0", url)
+	fetcher.add("src-d", "bar", "v1.0.0", url)
+
+	sampled := 0.6
+	notSampled := 0.4
+	traceBuilds := false
+	s := newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "src-d/foo", TraceSampleRate: &sampled},
+		"bar.bar": ProjectConfig{
+			Repository:      "src-d/bar",
+			TraceSampleRate: &notSampled,
+			TraceBuilds:     &traceBuilds,
+		},
+	})
+	baseFolder, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(baseFolder)
+	s.opts.BaseFolder = baseFolder
+	s.opts.SharedFolder = testSharedFolder
+
+	require.Equal(1, tracedRequests(t, s, "http://foo.bar/versions.json"))
+	require.Equal(0, tracedRequests(t, s, "http://bar.bar/versions.json"))
+	require.Equal(0, tracedRequests(t, s, "http://baz.bar/versions.json"))
+
+	// builds are always traced unless disabled for the host
+	s.opts.TraceBuilds = true
+	require.Equal(0, tracedRequests(t, s, "http://bar.bar/v1.0.0/"))
+
+	s.opts.Config["baz.bar"] = ProjectConfig{Repository: "src-d/foo"}
+	require.Equal(0, tracedRequests(t, s, "http://baz.bar/versions.json"))
+	require.Equal(1, tracedRequests(t, s, "http://baz.bar/v1.0.0/"))
+}
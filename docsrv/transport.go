@@ -0,0 +1,251 @@
+package docsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Validate returns an error if the options to reach GitHub are invalid: the
+// GitHub base URL, the proxy URL or the CA bundle.
+func (o Options) Validate() error {
+	if err := o.validateDefaultOwner(); err != nil {
+		return err
+	}
+
+	if err := o.validateGitHubApp(); err != nil {
+		return err
+	}
+
+	if o.GitHubBaseURL != "" {
+		if _, err := githubAPIURL(o.GitHubBaseURL); err != nil {
+			return err
+		}
+	}
+
+	if o.Layout != "" {
+		if err := ValidateLayout(o.Layout); err != nil {
+			return err
+		}
+	}
+
+	switch o.PublicScheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid public scheme %q, it must be http or https", o.PublicScheme)
+	}
+
+	if o.AuditLog != "" {
+		audit, err := openAuditLog(o.AuditLog)
+		if err != nil {
+			return err
+		}
+		audit.file.Close()
+	}
+
+	if o.AccessLog != "" {
+		access, err := openAccessLog(o.AccessLog, o.AccessLogFormat)
+		if err != nil {
+			return err
+		}
+		access.close()
+	}
+
+	if _, err := newBuildSandbox(o.BuildUser); err != nil {
+		return err
+	}
+
+	if _, err := newBuildCgroups(o.BuildCgroup, o.BuildMemoryLimit, o.BuildCPULimit); err != nil {
+		return err
+	}
+
+	if o.UpstreamURL != "" {
+		u, err := url.Parse(o.UpstreamURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid upstream URL: %q", o.UpstreamURL)
+		}
+
+		if o.RefreshToken == "" {
+			return fmt.Errorf("the refresh token of the upstream is required")
+		}
+	}
+
+	if o.OTLPEndpoint != "" {
+		u, err := url.Parse(o.OTLPEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint: %q", o.OTLPEndpoint)
+		}
+	}
+
+	_, err := newHTTPClient(o)
+	return err
+}
+
+// githubAPIURL returns the URL of the API of the GitHub Enterprise Server
+// instance with the given URL. If it has no path, the path of the API,
+// /api/v3/, is added to it.
+func githubAPIURL(baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid GitHub base URL: %q", baseURL)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api/v3/"
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	return u.String(), nil
+}
+
+// newHTTPClient returns the HTTP client used to reach GitHub and download the
+// sources of the versions, which goes through the proxy in the given options,
+// or the one in the HTTPS_PROXY and HTTP_PROXY environment variables if
+// there is none, and trusts the certificates in their CA bundle along with
+// the ones of the system.
+func newHTTPClient(opts Options) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.ProxyURL != "" {
+		u, err := url.Parse(opts.ProxyURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL: %q", opts.ProxyURL)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	var tlsConfig *tls.Config
+	if opts.CABundle != "" {
+		pool, err := loadCABundle(opts.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+	}
+
+	// same settings as http.DefaultTransport.
+	return &http.Client{Transport: &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}}, nil
+}
+
+// loadCABundle returns the certificates of the system along with the ones in
+// the given PEM file.
+func loadCABundle(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, wrap(err, "could not read CA bundle")
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+	}
+
+	return pool, nil
+}
+
+// withAuth returns a copy of the given client, or of http.DefaultClient if
+// it's nil, that authenticates with the given function the requests to the
+// given hosts. If there is no function, the client is returned as it is.
+func withAuth(client *http.Client, authenticate func(*http.Request) error, hosts ...string) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if authenticate == nil || len(hosts) == 0 {
+		return client
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	allowed := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		allowed[strings.ToLower(h)] = true
+	}
+
+	authenticated := *client
+	authenticated.Transport = &authTransport{authenticate: authenticate, hosts: allowed, base: base}
+	return &authenticated
+}
+
+// tokenAuth returns a function that authenticates the requests with the
+// tokens of the given source, or nil if there is no source.
+func tokenAuth(tokens oauth2.TokenSource) func(*http.Request) error {
+	if tokens == nil {
+		return nil
+	}
+
+	return func(req *http.Request) error {
+		token, err := tokens.Token()
+		if err != nil {
+			return err
+		}
+		token.SetAuthHeader(req)
+		return nil
+	}
+}
+
+// authTransport authenticates the requests to some hosts, and only to them,
+// so the credentials are never sent to the hosts the downloads are
+// redirected to, such as the storage of the assets.
+type authTransport struct {
+	authenticate func(*http.Request) error
+	hosts        map[string]bool
+	base         http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts[strings.ToLower(req.URL.Hostname())] || req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// the request given to a round tripper must not be modified.
+	authenticated := new(http.Request)
+	*authenticated = *req
+	authenticated.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authenticated.Header[k] = v
+	}
+
+	if err := t.authenticate(authenticated); err != nil {
+		return nil, wrap(err, "error authenticating request to %s", req.URL.Host)
+	}
+	return t.base.RoundTrip(authenticated)
+}
+
+// hostOf returns the host name of the given URL, or an empty string if it's
+// invalid.
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,125 @@
+package docsrv
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubAPIURL(t *testing.T) {
+	cases := []struct {
+		url      string
+		expected string
+	}{
+		{"https://github.example.com", "https://github.example.com/api/v3/"},
+		{"https://github.example.com/", "https://github.example.com/api/v3/"},
+		{"https://github.example.com/api/v3", "https://github.example.com/api/v3/"},
+		{"http://localhost:8080/custom/", "http://localhost:8080/custom/"},
+	}
+
+	for _, c := range cases {
+		url, err := githubAPIURL(c.url)
+		require.NoError(t, err, c.url)
+		require.Equal(t, c.expected, url, c.url)
+	}
+
+	for _, url := range []string{"github.example.com", "ftp://github.example.com", "://"} {
+		_, err := githubAPIURL(url)
+		require.Error(t, err, url)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	require := require.New(t)
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	invalidBundle := filepath.Join(tmpDir, "invalid.pem")
+	require.NoError(ioutil.WriteFile(invalidBundle, []byte("foo"), 0644))
+
+	require.NoError(Options{}.Validate())
+	require.NoError(Options{GitHubBaseURL: "https://github.example.com", ProxyURL: "http://proxy:3128"}.Validate())
+	require.Error(Options{GitHubBaseURL: "github.example.com"}.Validate())
+	require.Error(Options{ProxyURL: "proxy"}.Validate())
+	require.Error(Options{CABundle: filepath.Join(tmpDir, "missing.pem")}.Validate())
+	require.Error(Options{CABundle: invalidBundle}.Validate())
+	require.NoError(Options{PublicScheme: "https"}.Validate())
+	require.Error(Options{PublicScheme: "ftp"}.Validate())
+}
+
+func TestNewHTTPClient_CABundle(t *testing.T) {
+	require := require.New(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "docsrv-test-")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	bundle := filepath.Join(tmpDir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(ioutil.WriteFile(bundle, cert, 0644))
+
+	client, err := newHTTPClient(Options{})
+	require.NoError(err)
+	_, err = client.Get(server.URL)
+	require.Error(err)
+
+	client, err = newHTTPClient(Options{CABundle: bundle})
+	require.NoError(err)
+	resp, err := client.Get(server.URL)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	require := require.New(t)
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		fmt.Fprint(w, "ok")
+	}))
+	defer proxy.Close()
+
+	client, err := newHTTPClient(Options{ProxyURL: proxy.URL})
+	require.NoError(err)
+
+	require.NoError(download(client, "http://github.example.com/foo.tar.gz", filepath.Join(os.TempDir(), "docsrv-proxy-test")))
+	defer os.Remove(filepath.Join(os.TempDir(), "docsrv-proxy-test"))
+	require.Equal("http://github.example.com/foo.tar.gz", proxied)
+}
+
+func TestReleases_Enterprise(t *testing.T) {
+	require := require.New(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/repos/org/foo/releases", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("Bearer secret", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `[{"tag_name": "v1.0.0", "tarball_url": "https://github.example.com/tarball/v1.0.0"}]`)
+	})
+	mux.HandleFunc("/api/v3/repos/org/foo/tags", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"name": "v1.0.0", "commit": {"sha": "1234"}}]`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := newReleaseFetcher("secret", 0, server.URL, nil)
+	require.NoError(err)
+
+	releases, err := fetcher.releases("org", "foo", newVersion("v0.0.0"), nil)
+	require.NoError(err)
+	require.Len(releases, 1)
+	require.Equal("v1.0.0", releases[0].tag)
+	require.Equal("https://github.example.com/tarball/v1.0.0", releases[0].url)
+	require.Equal("1234", releases[0].sha)
+}
@@ -10,8 +10,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
-	"sort"
 	"testing"
 	"time"
 
@@ -31,11 +31,26 @@ func assertJSON(t *testing.T, handler http.Handler, requestURL string, expected
 	require.Equal(t, string(expectedJSON), w.Body.String())
 }
 
+// testSharedFolder is the shared folder used in all tests.
+var testSharedFolder string
+
+func TestMain(m *testing.M) {
+	var err error
+	testSharedFolder, err = ioutil.TempDir("", "docsrv-shared-")
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(testSharedFolder)
+	os.Exit(code)
+}
+
 const expectedDocsOutput = `%s
 %s
 %s
 %s
-/etc/shared
+%s
 true
 `
 
@@ -43,7 +58,7 @@ func assertMakefileOutput(t *testing.T, tmpDir, baseURL, project, owner, version
 	fp := filepath.Join(tmpDir, "out")
 	data, err := ioutil.ReadFile(fp)
 	require.NoError(t, err)
-	require.Equal(t, fmt.Sprintf(expectedDocsOutput, baseURL, owner, project, version), string(data))
+	require.Equal(t, fmt.Sprintf(expectedDocsOutput, baseURL, owner, project, version, testSharedFolder), string(data))
 }
 
 func assertNotFound(t *testing.T, handler http.Handler, requestURL string) {
@@ -77,14 +92,93 @@ func assertRedirect(t *testing.T, handler http.Handler, requestURL, expected str
 
 type mockFetcher struct {
 	projectReleases map[string]map[string]string
+	projectBranches map[string]*release
+	files           map[string][]byte
+	pullRequests    map[string]*mockPullRequest
+	prereleases     map[string]bool
+	shas            map[string]string
+	publishedAt     map[string]time.Time
+	notes           map[string]*release
+	commits         map[string]*release
+}
+
+type mockPullRequest struct {
+	release *release
+	open    bool
 }
 
 func newMockFetcher() *mockFetcher {
 	return &mockFetcher{
 		make(map[string]map[string]string),
+		make(map[string]*release),
+		make(map[string][]byte),
+		make(map[string]*mockPullRequest),
+		make(map[string]bool),
+		make(map[string]string),
+		make(map[string]time.Time),
+		make(map[string]*release),
+		make(map[string]*release),
+	}
+}
+
+func (m *mockFetcher) addPullRequest(owner, project string, number int, url, sha string, open bool) {
+	m.pullRequests[filepath.Join(owner, project, fmt.Sprint(number))] = &mockPullRequest{
+		&release{tag: pullRequestVersion(number), url: url, sha: sha, headRepository: owner + "/" + project},
+		open,
+	}
+}
+
+func (m *mockFetcher) pullRequest(owner, project string, number int) (*release, bool, error) {
+	pr, ok := m.pullRequests[filepath.Join(owner, project, fmt.Sprint(number))]
+	if !ok {
+		return nil, false, fmt.Errorf("pull request %d not found", number)
+	}
+
+	r := *pr.release
+	return &r, pr.open, nil
+}
+
+func (m *mockFetcher) addFile(owner, project, ref, path string, data []byte) {
+	m.files[filepath.Join(owner, project, ref, path)] = data
+}
+
+func (m *mockFetcher) file(owner, project, ref, path string) ([]byte, error) {
+	return m.files[filepath.Join(owner, project, ref, path)], nil
+}
+
+func (m *mockFetcher) addBranch(owner, project, name, url, sha string) {
+	m.projectBranches[filepath.Join(owner, project, name)] = &release{
+		tag: name,
+		url: url,
+		sha: sha,
 	}
 }
 
+func (m *mockFetcher) branch(owner, project, name string) (*release, error) {
+	b, ok := m.projectBranches[filepath.Join(owner, project, name)]
+	if !ok {
+		return nil, fmt.Errorf("branch %s not found", name)
+	}
+
+	r := *b
+	return &r, nil
+}
+
+// addCommit sets the commit the given ref of a project resolves to.
+func (m *mockFetcher) addCommit(owner, project, ref, url, sha string) {
+	m.commits[filepath.Join(owner, project, ref)] = &release{tag: ref, url: url, sha: sha}
+}
+
+func (m *mockFetcher) commit(owner, project, ref string) (*release, error) {
+	c, ok := m.commits[filepath.Join(owner, project, ref)]
+	if !ok {
+		return nil, wrap(ErrNotFound, "ref %s not found", ref)
+	}
+
+	r := *c
+	return &r, nil
+}
+
 func (m *mockFetcher) add(owner, project, version, url string) {
 	key := filepath.Join(owner, project)
 	if _, ok := m.projectReleases[key]; !ok {
@@ -94,29 +188,67 @@ func (m *mockFetcher) add(owner, project, version, url string) {
 	m.projectReleases[key][version] = url
 }
 
-func (m *mockFetcher) releases(owner, project string, minVersion *semver.Version) ([]*release, error) {
+func (m *mockFetcher) addPrerelease(owner, project, version, url string) {
+	m.add(owner, project, version, url)
+	m.prereleases[filepath.Join(owner, project, version)] = true
+}
+
+// setPublishedAt sets the time the given release was published.
+func (m *mockFetcher) setPublishedAt(owner, project, version string, t time.Time) {
+	m.publishedAt[filepath.Join(owner, project, version)] = t
+}
+
+// setNotes sets the name, notes and author of the given release.
+func (m *mockFetcher) setNotes(owner, project, version, name, notes, author string) {
+	m.notes[filepath.Join(owner, project, version)] = &release{name: name, notes: notes, author: author}
+}
+
+// setSHA sets the commit the tag of the given release points to.
+func (m *mockFetcher) setSHA(owner, project, version, sha string) {
+	m.shas[filepath.Join(owner, project, version)] = sha
+}
+
+func (m *mockFetcher) releases(owner, project string, minVersion *semver.Version, maxVersion *maxVersion) ([]*release, error) {
 	key := filepath.Join(owner, project)
 	if proj, ok := m.projectReleases[key]; ok {
 		var releases []*release
 		for v, url := range proj {
 			release := &release{
-				tag: v,
-				url: url,
+				tag:         v,
+				url:         url,
+				prerelease:  m.prereleases[filepath.Join(owner, project, v)],
+				sha:         m.shas[filepath.Join(owner, project, v)],
+				publishedAt: m.publishedAt[filepath.Join(owner, project, v)],
+			}
+
+			if notes, ok := m.notes[filepath.Join(owner, project, v)]; ok {
+				release.name = notes.name
+				release.notes = notes.notes
+				release.author = notes.author
+				release.htmlURL = fmt.Sprintf("https://github.com/%s/%s/releases/tag/%s", owner, project, v)
 			}
 
 			v := newVersion(release.tag)
-			if v != nil && v.LessThan(minVersion) {
+			if v != nil && (v.LessThan(minVersion) || maxVersion.excludes(v)) {
 				continue
 			}
 			releases = append(releases, release)
 		}
-		sort.Sort(byTag(releases))
+		sortReleases(releases, semverScheme{})
 		return releases, nil
 	}
 
 	return nil, nil
 }
 
+// checkRepository reports the repositories without releases as not found.
+func (m *mockFetcher) checkRepository(owner, project, token string) error {
+	if _, ok := m.projectReleases[filepath.Join(owner, project)]; !ok {
+		return wrap(ErrNotFound, "repository %s/%s not found", owner, project)
+	}
+	return nil
+}
+
 func newTestSrv(fetcher releaseFetcher, config Config) *Service {
 	srv := New(Options{Config: config})
 	srv.fetcher = fetcher
@@ -124,7 +256,14 @@ func newTestSrv(fetcher releaseFetcher, config Config) *Service {
 }
 
 func tarGzServer() (string, func()) {
-	server := httptest.NewServer(http.HandlerFunc(tarGzMakefileHandler))
+	return tarGzServerWithMakefile(testMakefile)
+}
+
+// tarGzServerWithMakefile serves a tarball containing the given Makefile.
+func tarGzServerWithMakefile(makefile string) (string, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tarGzMakefileHandler(w, makefile)
+	}))
 	return server.URL, server.Close
 }
 
@@ -139,7 +278,32 @@ docs:
 	echo "$(DOCSRV)" >> $$OUTPUT;
 `
 
-func tarGzMakefileHandler(w http.ResponseWriter, r *http.Request) {
+// tarGzServerWithFiles serves a tarball containing the given files, by path.
+func tarGzServerWithFiles(files map[string]string) (string, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+
+		tw := tar.NewWriter(gw)
+		defer tw.Close()
+
+		for name, content := range files {
+			err := tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0644,
+				Size:    int64(len(content)),
+				ModTime: time.Now(),
+			})
+			if err != nil {
+				return
+			}
+			io.WriteString(tw, content)
+		}
+	}))
+	return server.URL, server.Close
+}
+
+func tarGzMakefileHandler(w http.ResponseWriter, makefile string) {
 	gw := gzip.NewWriter(w)
 	defer gw.Close()
 
@@ -149,12 +313,12 @@ func tarGzMakefileHandler(w http.ResponseWriter, r *http.Request) {
 	err := tw.WriteHeader(&tar.Header{
 		Name:    "Makefile",
 		Mode:    0777,
-		Size:    int64(len([]byte(testMakefile))),
+		Size:    int64(len([]byte(makefile))),
 		ModTime: time.Now(),
 	})
 	if err != nil {
 		return
 	}
 
-	io.Copy(tw, bytes.NewBuffer([]byte(testMakefile)))
+	io.Copy(tw, bytes.NewBuffer([]byte(makefile)))
 }
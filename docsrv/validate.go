@@ -0,0 +1,469 @@
+package docsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Masterminds/semver"
+)
+
+// validateConfigPath is the path of the API to validate a candidate config
+// without applying it.
+const validateConfigPath = "/api/config/validate"
+
+// maxConfigSize is the maximum size of a config sent to be validated.
+const maxConfigSize = 1 << 20
+
+// ConfigError is a problem found in a config.
+type ConfigError struct {
+	// Host is the host whose config has the problem, if any.
+	Host string `json:"host,omitempty"`
+	// Field is the option of the host with the problem, if any, e.g.
+	// "min-version".
+	Field string `json:"field,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.Host == "":
+		return e.Message
+	case e.Field == "":
+		return fmt.Sprintf("%s: %s", e.Host, e.Message)
+	default:
+		return fmt.Sprintf("%s: invalid %s: %s", e.Host, e.Field, e.Message)
+	}
+}
+
+// Validate returns the problems found in the config, sorted by host: hosts
+// colliding with each other, invalid path prefixes and aliases, repositories
+// without the ${OWNER}/${PROJECT} format, invalid versions and patterns,
+// tokens that can not be read and invalid archives and build webhooks.
+func (c Config) Validate() []*ConfigError {
+	var hosts []string
+	for host := range c {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var errs []*ConfigError
+	normalized := make(map[string]string)
+	for _, host := range hosts {
+		key := normalizeHost(host)
+		if other, ok := normalized[key]; ok {
+			errs = append(errs, &ConfigError{
+				Host:    host,
+				Message: fmt.Sprintf("collides with host %s", other),
+			})
+		} else {
+			normalized[key] = host
+		}
+
+		if i := strings.IndexByte(host, '/'); i != -1 {
+			if err := c.validatePathPrefix(host[:i], host[i+1:]); err != "" {
+				errs = append(errs, &ConfigError{Host: host, Message: err})
+			}
+		}
+
+		errs = append(errs, c[host].validate(host)...)
+		errs = append(errs, c.validateAliases(host, hosts)...)
+		if err := c.validateQuota(host); err != "" {
+			errs = append(errs, &ConfigError{Host: host, Field: "quota", Message: err})
+		}
+	}
+
+	return errs
+}
+
+// validateQuota returns the problem of the quota of the given host, if any.
+func (c Config) validateQuota(host string) string {
+	quota := c[host].Quota
+	if quota == nil {
+		return ""
+	}
+
+	if quota.BuildsPerHour < 0 || quota.MaxDiskUsage < 0 || quota.MaxConcurrentBuilds < 0 {
+		return "the limits can not be negative"
+	}
+
+	owner, _, ok := splitRepository(c[host].Repository)
+	if !ok {
+		return ""
+	}
+
+	if other, _ := c.quotaHost(owner); *c[other].Quota != *quota {
+		return fmt.Sprintf("it's not the same as the quota of %s set in %s", owner, other)
+	}
+	return ""
+}
+
+// validateAliases returns the problems of the aliases of the given host,
+// which can be neither hosts of the config nor aliases of any other of the
+// given hosts.
+func (c Config) validateAliases(host string, hosts []string) []*ConfigError {
+	var errs []*ConfigError
+	for _, alias := range c[host].Aliases {
+		if err := c.aliasConflict(host, alias, hosts); err != "" {
+			errs = append(errs, &ConfigError{Host: host, Field: "aliases", Message: err})
+		}
+	}
+	return errs
+}
+
+// aliasConflict returns the problem of the given alias of the given host, if
+// it's one of the given hosts or an alias of any other of them.
+func (c Config) aliasConflict(host, alias string, hosts []string) string {
+	key := normalizeHost(alias)
+	for _, h := range hosts {
+		if normalizeHost(h) == key {
+			return fmt.Sprintf("%s is configured as a host", alias)
+		}
+
+		for _, other := range c[h].Aliases {
+			if h != host && normalizeHost(other) == key {
+				return fmt.Sprintf("%s is also an alias of %s", alias, h)
+			}
+		}
+	}
+	return ""
+}
+
+// validatePathPrefix returns the problem of the project served under the
+// given path prefix of the given host, if any.
+func (c Config) validatePathPrefix(host, prefix string) string {
+	if host == "" || prefix == "" || strings.Contains(prefix, "/") {
+		return "path prefixes must be a single path segment after the host, e.g. docs.example.com/project"
+	}
+
+	for h := range c {
+		if normalizeHost(h) == normalizeHost(host) {
+			return fmt.Sprintf("%s serves a project of its own, so it can not serve others under path prefixes", h)
+		}
+	}
+	return ""
+}
+
+func (c ProjectConfig) validate(host string) []*ConfigError {
+	var errs []*ConfigError
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{
+			Host:    host,
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if owner, project, ok := splitRepository(c.Repository); !ok || owner == "" || project == "" {
+		fail("repository", "%q does not have the format owner/project", c.Repository)
+	}
+
+	if c.DocsPath != "" && (path.IsAbs(c.DocsPath) || strings.Contains("/"+c.DocsPath+"/", "/../")) {
+		fail("docs-path", "%q is not a relative path inside the repository", c.DocsPath)
+	}
+
+	scheme, ok := newVersionScheme(c.VersionScheme)
+	if !ok {
+		fail("version-scheme", "unknown version scheme %q, it must be %q, %q or %q",
+			c.VersionScheme, SemverScheme, CalverScheme, LexicographicScheme)
+	}
+
+	if c.MinVersion != "" && !scheme.valid(c.MinVersion) {
+		if c.isSemver() {
+			fail("min-version", "%q is not a semantic version", c.MinVersion)
+		} else {
+			fail("min-version", "%q is not a version of the %s scheme", c.MinVersion, c.VersionScheme)
+		}
+	}
+
+	if c.DeprecateBefore != "" && !scheme.valid(c.DeprecateBefore) {
+		fail("deprecate-before", "%q is not a version of the %s scheme", c.DeprecateBefore, scheme)
+	}
+
+	if c.DefaultVersion != "" && !scheme.valid(c.DefaultVersion) && !c.hasBranch(c.DefaultVersion) {
+		fail("default-version", "%q is neither a version of the %s scheme nor a branch", c.DefaultVersion, scheme)
+	}
+
+	if c.MaxVersion != "" && !c.isSemver() {
+		fail("max-version", "it can only be used with the %s version scheme", SemverScheme)
+	} else if c.MaxVersion != "" && newVersion(c.MaxVersion) == nil {
+		fail("max-version", "%q is not a semantic version", c.MaxVersion)
+	}
+
+	if c.SharedVersion != "" {
+		if _, err := semver.NewConstraint(c.SharedVersion); err != nil {
+			fail("shared-version", "%q is not a valid version constraint", c.SharedVersion)
+		}
+	}
+
+	for _, kind := range c.OfflineBundles {
+		if kind != ZipBundle && kind != TarGzBundle && kind != PDFBundle {
+			fail("offline-bundles", "unknown kind of bundle %q, it must be %q, %q or %q",
+				kind, ZipBundle, TarGzBundle, PDFBundle)
+		}
+	}
+
+	for _, p := range c.ExcludeVersions {
+		if _, err := matchVersionPattern(p, ""); err != nil {
+			fail("exclude-versions", "pattern %q: %s", p, err)
+		}
+	}
+
+	for _, alias := range c.Aliases {
+		if alias == "" || strings.ContainsAny(alias, "/:") {
+			fail("aliases", "%q is not a host name without port nor path", alias)
+		}
+	}
+
+	// the branches are served and installed as versions, so they can not
+	// contain slashes, such as release/v1.
+	for _, branch := range c.Branches {
+		if branch == "" || strings.ContainsAny(branch, "/\\") || branch == "." || branch == ".." {
+			fail("branches", "%q can not be served as a version, it can not contain slashes", branch)
+		}
+	}
+
+	for _, version := range c.Preinstall {
+		if version == "" || strings.ContainsAny(version, "/\\") || version == "." || version == ".." {
+			fail("preinstall", "%q is not a valid version", version)
+		} else if !scheme.valid(version) && !c.hasBranch(version) {
+			fail("preinstall", "%q is neither a version of the %s scheme nor a branch", version, scheme)
+		}
+	}
+
+	if _, err := c.token(); err != nil {
+		fail("token", "%s", err)
+	}
+
+	if c.AssetPattern != "" {
+		if c.SourceAsset != "" {
+			fail("asset-pattern", "it can not be used with source-asset")
+		} else if _, err := matchVersionPattern(c.AssetPattern, ""); err != nil {
+			fail("asset-pattern", "pattern %q: %s", c.AssetPattern, err)
+		}
+	}
+
+	switch c.Archive {
+	case "", TarballArchive, ZipballArchive:
+	default:
+		fail("archive", "%q is not %s or %s", c.Archive, TarballArchive, ZipballArchive)
+	}
+
+	switch c.Provider {
+	case "", GitHubProvider, BitbucketProvider:
+	default:
+		fail("provider", "%q is not %s or %s", c.Provider, GitHubProvider, BitbucketProvider)
+	}
+
+	if c.Auth != nil {
+		for _, err := range c.Auth.validate() {
+			fail("auth", "%s", err)
+		}
+	}
+
+	switch c.DeletedReleases {
+	case "", OrphanDeletedReleases, EvictDeletedReleases:
+	default:
+		fail("deleted-releases", "%q is not %s or %s", c.DeletedReleases, OrphanDeletedReleases, EvictDeletedReleases)
+	}
+
+	for _, name := range sortedKeys(c.BuildEnv) {
+		if !envNameRegexp.MatchString(name) {
+			fail("build-env", "%q is not a valid variable name", name)
+		} else if reservedBuildEnv[name] {
+			fail("build-env", "%s is set by docsrv", name)
+		}
+	}
+
+	for _, hook := range c.BuildWebhooks {
+		if err := hook.validate(); err != nil {
+			fail("build-webhooks", "%s", err)
+		}
+	}
+
+	return errs
+}
+
+// validate returns the problems of the authentication config: unknown
+// providers and OIDC providers without the endpoints, issuer and client ID
+// needed to verify the ID tokens of the users.
+func (c *AuthConfig) validate() []string {
+	switch c.Provider {
+	case "", GitHubAuth:
+		return nil
+	case OIDCAuth:
+	default:
+		return []string{fmt.Sprintf("unknown provider %q, it must be %s or %s", c.Provider, GitHubAuth, OIDCAuth)}
+	}
+
+	var errs []string
+	for _, opt := range []struct{ name, value string }{
+		{"client-id", c.ClientID},
+		{"auth-url", c.AuthURL},
+		{"token-url", c.TokenURL},
+		{"issuer", c.Issuer},
+		{"jwks-url", c.JWKSURL},
+	} {
+		if opt.value == "" {
+			errs = append(errs, fmt.Sprintf("%s is required by the %s provider", opt.name, OIDCAuth))
+		}
+	}
+	return errs
+}
+
+// repositoryChecker is implemented by the release fetchers that can check
+// whether a repository can be reached.
+type repositoryChecker interface {
+	// checkRepository returns an error if the given repository does not
+	// exist or can not be accessed with the given token, or the global one
+	// if it's empty.
+	checkRepository(owner, project, token string) error
+}
+
+func (g *githubFetcher) checkRepository(owner, project, token string) error {
+	client := g.client
+	if token != "" {
+		var err error
+		client, err = newGitHubClient(token, g.baseURL, g.httpClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _, err := client.Repositories.Get(context.Background(), owner, project)
+	if err != nil {
+		return wrap(githubError(err), "error getting repository %s/%s", owner, project)
+	}
+	return nil
+}
+
+// checkRepositories returns a problem for every repository of the given config
+// that can not be reached with its token. Repositories are checked once,
+// the hosts with problems in their repository or token are skipped.
+func (s *Service) checkRepositories(c Config, errs []*ConfigError) []*ConfigError {
+	skip := make(map[string]bool)
+	for _, err := range errs {
+		if err.Field == "repository" || err.Field == "token" {
+			skip[err.Host] = true
+		}
+	}
+
+	var hosts []string
+	for host := range c {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var result []*ConfigError
+	checked := make(map[string]bool)
+	for _, host := range hosts {
+		if skip[host] {
+			continue
+		}
+
+		conf := c[host]
+		checker, ok := s.providerFetcher(conf.provider()).(repositoryChecker)
+		if !ok {
+			continue
+		}
+
+		token, _ := conf.token()
+		key := conf.provider() + ":" + conf.Repository + "#" + token
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		owner, project, _ := splitRepository(conf.Repository)
+		if err := checker.checkRepository(owner, project, token); err != nil {
+			msg := fmt.Sprintf("%s can not be reached: %s", conf.Repository, err)
+			if Cause(err) == ErrNotFound {
+				msg = fmt.Sprintf("%s does not exist or can not be accessed with the configured token", conf.Repository)
+			}
+			result = append(result, &ConfigError{Host: host, Field: "repository", Message: msg})
+		}
+	}
+
+	return result
+}
+
+// configValidation is the response of the config validation API.
+type configValidation struct {
+	Valid  bool           `json:"valid"`
+	Errors []*ConfigError `json:"errors"`
+}
+
+// validateConfig is an HTTP handler that validates the TOML config in the body
+// of a POST request without applying it, also checking that its
+// repositories can be reached with their tokens. Responds with the problems
+// found and a 422 status if there are any. Only available to administrators.
+func (s *Service) validateConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigSize+1))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		httpError(w, r, fmt.Sprintf("error reading config: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(data) > maxConfigSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var errs []*ConfigError
+	var config Config
+	if err := toml.Unmarshal(data, &config); err != nil {
+		errs = append(errs, &ConfigError{Message: fmt.Sprintf("invalid TOML: %s", err)})
+	} else if len(config) == 0 {
+		errs = append(errs, &ConfigError{Message: "there are no hosts configured"})
+	} else {
+		errs = config.Validate()
+		if landing := s.opts.LandingHost; landing != "" {
+			for host := range config {
+				if normalizeHost(host) == normalizeHost(landing) {
+					errs = append(errs, &ConfigError{Host: host, Message: "is the landing host"})
+				}
+			}
+		}
+		errs = append(errs, s.checkRepositories(config, errs)...)
+	}
+
+	resp := configValidation{Valid: len(errs) == 0, Errors: errs}
+	if resp.Errors == nil {
+		resp.Errors = []*ConfigError{}
+	}
+
+	log := requestLog(r).WithField("valid", resp.Valid)
+	log.Infof("config validated, %d errors found", len(errs))
+
+	if !resp.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	if err := s.writeJSON(w, resp); err != nil {
+		log.Errorf("error serving config validation: %s", err)
+	}
+}
@@ -0,0 +1,228 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	require := require.New(t)
+	errs := Config{
+		"foo.bar":  {Repository: "bar/foo", MinVersion: "v1.0.0", MaxVersion: "v2"},
+		"Foo.bar":  {Repository: "bar/foo"},
+		"baz.bar":  {Repository: "baz", MinVersion: "latest", ExcludeVersions: []string{"["}, Preinstall: []string{"../v1"}},
+		"qux.bar":  {Repository: "bar/qux", Archive: "rar", TokenFile: "/missing/token", AssetPattern: "/(/"},
+		"quux.bar": {Repository: "bar/quux", SourceAsset: "docs.tar.gz", AssetPattern: "docs-*", DeletedReleases: "keep"},
+	}.Validate()
+
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	require.Equal([]string{
+		`baz.bar: invalid repository: "baz" does not have the format owner/project`,
+		`baz.bar: invalid min-version: "latest" is not a semantic version`,
+		`baz.bar: invalid exclude-versions: pattern "[": syntax error in pattern`,
+		`baz.bar: invalid preinstall: "../v1" is not a valid version`,
+		`foo.bar: collides with host Foo.bar`,
+		`quux.bar: invalid asset-pattern: it can not be used with source-asset`,
+		`quux.bar: invalid deleted-releases: "keep" is not orphan or evict`,
+		`qux.bar: invalid token: open /missing/token: no such file or directory`,
+		"qux.bar: invalid asset-pattern: pattern \"/(/\": error parsing regexp: missing closing ): `(`",
+		`qux.bar: invalid archive: "rar" is not tarball or zipball`,
+	}, messages)
+
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo"}}.Validate())
+}
+
+func TestConfigValidateQuota(t *testing.T) {
+	require := require.New(t)
+	quota := &QuotaConfig{BuildsPerHour: 10, MaxConcurrentBuilds: 2}
+	config := Config{
+		"foo.bar": {Repository: "bar/foo", Quota: quota},
+		"baz.bar": {Repository: "bar/baz"},
+		"qux.bar": {Repository: "bar/qux", Quota: &QuotaConfig{BuildsPerHour: 10, MaxConcurrentBuilds: 2}},
+		"foo.baz": {Repository: "baz/foo", Quota: &QuotaConfig{BuildsPerHour: -1}},
+	}
+	require.Equal(quota, config.QuotaForOwner("bar"))
+	require.Nil(config.QuotaForOwner("qux"))
+
+	var messages []string
+	for _, err := range config.Validate() {
+		messages = append(messages, err.Error())
+	}
+	require.Equal([]string{
+		`foo.baz: invalid quota: the limits can not be negative`,
+	}, messages)
+
+	config["qux.bar"] = ProjectConfig{Repository: "bar/qux", Quota: &QuotaConfig{BuildsPerHour: 5}}
+	messages = nil
+	for _, err := range config.Validate() {
+		messages = append(messages, err.Error())
+	}
+	require.Equal([]string{
+		`foo.baz: invalid quota: the limits can not be negative`,
+		`qux.bar: invalid quota: it's not the same as the quota of bar set in foo.bar`,
+	}, messages)
+}
+
+func requestConfigValidation(t *testing.T, srv *Service, method, url, body string, expected int) configValidation {
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+	require.Equal(t, expected, w.Code)
+
+	var resp configValidation
+	if expected == http.StatusOK || expected == http.StatusUnprocessableEntity {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return resp
+}
+
+func TestValidateConfigAPI(t *testing.T) {
+	require := require.New(t)
+	fetcher := newMockFetcher()
+	fetcher.add("bar", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": {Repository: "bar/foo"}})
+	srv.opts.RefreshToken = "admin"
+	srv.opts.LandingHost = "docs.bar"
+
+	url := "http://foo.bar/api/config/validate?token=admin"
+	valid := `
+["foo.bar"]
+repository = "bar/foo"
+min-version = "v1.0.0"
+
+["foo2.bar"]
+repository = "bar/foo"
+`
+
+	resp := requestConfigValidation(t, srv, "POST", url, valid, http.StatusOK)
+	require.Equal(configValidation{Valid: true, Errors: []*ConfigError{}}, resp)
+
+	invalid := `
+["baz.bar"]
+repository = "bar/baz"
+
+["qux.bar"]
+repository = "qux"
+
+["docs.bar"]
+repository = "bar/foo"
+max-version = "next"
+`
+
+	resp = requestConfigValidation(t, srv, "POST", url, invalid, http.StatusUnprocessableEntity)
+	require.False(resp.Valid)
+	require.Equal([]*ConfigError{
+		{Host: "docs.bar", Field: "max-version", Message: `"next" is not a semantic version`},
+		{Host: "qux.bar", Field: "repository", Message: `"qux" does not have the format owner/project`},
+		{Host: "docs.bar", Message: "is the landing host"},
+		{Host: "baz.bar", Field: "repository", Message: "bar/baz does not exist or can not be accessed with the configured token"},
+	}, resp.Errors)
+
+	resp = requestConfigValidation(t, srv, "POST", url, "[foo", http.StatusUnprocessableEntity)
+	require.Len(resp.Errors, 1)
+	require.Contains(resp.Errors[0].Message, "invalid TOML")
+
+	resp = requestConfigValidation(t, srv, "POST", url, "", http.StatusUnprocessableEntity)
+	require.Equal("there are no hosts configured", resp.Errors[0].Message)
+
+	requestConfigValidation(t, srv, "GET", url, "", http.StatusMethodNotAllowed)
+	requestConfigValidation(t, srv, "POST", "http://foo.bar/api/config/validate", valid, http.StatusForbidden)
+
+	// the current config is not changed
+	require.Equal(Config{"foo.bar": {Repository: "bar/foo"}}, srv.config())
+}
+
+func TestConfigValidate_DocsPath(t *testing.T) {
+	require := require.New(t)
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", DocsPath: "services/foo/docs"}}.Validate())
+
+	for _, docsPath := range []string{"/docs", "../docs", "docs/../../foo"} {
+		errs := Config{"foo.bar": {Repository: "bar/foo", DocsPath: docsPath}}.Validate()
+		require.Len(errs, 1, docsPath)
+		require.Equal("docs-path", errs[0].Field)
+	}
+}
+
+func TestConfigValidate_OfflineBundles(t *testing.T) {
+	require := require.New(t)
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", OfflineBundles: []string{ZipBundle, TarGzBundle, PDFBundle}}}.Validate())
+
+	errs := Config{"foo.bar": {Repository: "bar/foo", OfflineBundles: []string{"epub"}}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("offline-bundles", errs[0].Field)
+}
+
+func TestConfigValidate_VersionScheme(t *testing.T) {
+	require := require.New(t)
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", VersionScheme: CalverScheme, MinVersion: "2021.04"}}.Validate())
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", VersionScheme: LexicographicScheme, MinVersion: "release-5"}}.Validate())
+
+	errs := Config{"foo.bar": {Repository: "bar/foo", VersionScheme: "date"}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("version-scheme", errs[0].Field)
+
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", Provider: BitbucketProvider}}.Validate())
+	errs = Config{"foo.bar": {Repository: "bar/foo", Provider: "gitlab"}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("provider", errs[0].Field)
+
+	errs = Config{"foo.bar": {
+		Repository:    "bar/foo",
+		VersionScheme: CalverScheme,
+		MinVersion:    "april",
+		MaxVersion:    "2022",
+	}}.Validate()
+	require.Len(errs, 2)
+	require.Equal(`"april" is not a version of the calver scheme`, errs[0].Message)
+	require.Equal("max-version", errs[1].Field)
+
+	errs = Config{"foo.bar": {Repository: "bar/foo", DeprecateBefore: "latest"}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("deprecate-before", errs[0].Field)
+
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", DefaultVersion: "v1.0.0"}}.Validate())
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", DefaultVersion: "master", Branches: []string{"master"}}}.Validate())
+	errs = Config{"foo.bar": {Repository: "bar/foo", DefaultVersion: "master"}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("default-version", errs[0].Field)
+
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", Preinstall: []string{"v1.0.0", "master"}, Branches: []string{"master"}}}.Validate())
+	errs = Config{"foo.bar": {Repository: "bar/foo", Preinstall: []string{"master"}}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("preinstall", errs[0].Field)
+
+	errs = Config{"foo.bar": {Repository: "bar/foo", Branches: []string{"master", "release/v1"}}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("branches", errs[0].Field)
+}
+
+func TestConfigValidate_SharedVersion(t *testing.T) {
+	require := require.New(t)
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", SharedVersion: "^2.0"}}.Validate())
+
+	errs := Config{"foo.bar": {Repository: "bar/foo", SharedVersion: "two"}}.Validate()
+	require.Len(errs, 1)
+	require.Equal("shared-version", errs[0].Field)
+}
+
+func TestConfigValidate_BuildEnv(t *testing.T) {
+	require := require.New(t)
+	require.Empty(Config{"foo.bar": {Repository: "bar/foo", BuildEnv: map[string]string{"THEME": "dark"}}}.Validate())
+
+	errs := Config{"foo.bar": {Repository: "bar/foo", BuildEnv: map[string]string{
+		"1THEME":   "dark",
+		"BASE_URL": "http://foo.bar/",
+	}}}.Validate()
+	require.Len(errs, 2)
+	require.Equal("build-env", errs[0].Field)
+	require.Equal(`"1THEME" is not a valid variable name`, errs[0].Message)
+	require.Equal("BASE_URL is set by docsrv", errs[1].Message)
+}
@@ -0,0 +1,248 @@
+package docsrv
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// versionsV2Path is the path of the list of versions with the v2 schema.
+const versionsV2Path = "/versions/v2.json"
+
+// versionFilter selects the versions listed by the versions endpoints.
+type versionFilter struct {
+	// major is the major version of the listed releases. Branches have no
+	// version, so they are not listed if it's set.
+	major *int64
+	// limit is the maximum number of versions listed. 0 means no limit.
+	limit int
+	// descending lists the newest releases first.
+	descending bool
+	// prereleases enables listing the prereleases.
+	prereleases bool
+	// withoutBranches leaves out the branches, which are not releases.
+	withoutBranches bool
+}
+
+// defaultVersionFilter lists all the versions from the oldest to the newest.
+var defaultVersionFilter = versionFilter{prereleases: true}
+
+// parseVersionFilter returns the filter in the "major", "limit", "order" and
+// "include-prereleases" parameters of the given query string.
+func parseVersionFilter(q url.Values) (versionFilter, error) {
+	f := defaultVersionFilter
+	if v := q.Get("major"); v != "" {
+		major, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || major < 0 {
+			return f, fmt.Errorf("invalid major version: %q", v)
+		}
+		f.major = &major
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return f, fmt.Errorf("invalid limit: %q", v)
+		}
+		f.limit = limit
+	}
+
+	switch order := q.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		f.descending = true
+	default:
+		return f, fmt.Errorf("invalid order: %q", order)
+	}
+
+	if v := q.Get("include-prereleases"); v != "" {
+		prereleases, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid include-prereleases: %q", v)
+		}
+		f.prereleases = prereleases
+	}
+
+	return f, nil
+}
+
+// filteredReleases returns the releases of the project in the requested host
+// that pass the given filter, in the order of the filter, followed by its
+// branches.
+func (s *Service) filteredReleases(r *http.Request, owner, project string, f versionFilter) []*release {
+	releases := s.releasesForHost(r.Host, owner, project)
+	result := make([]*release, 0, len(releases))
+	for _, rel := range releases {
+		if !f.prereleases && rel.prerelease {
+			continue
+		}
+
+		if f.major != nil {
+			v := newVersion(rel.tag)
+			if v == nil || v.Major() != *f.major {
+				continue
+			}
+		}
+
+		result = append(result, rel)
+	}
+
+	if f.descending {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+
+	if f.major == nil && !f.withoutBranches {
+		result = append(result, s.index.branchesForProject(owner, project)...)
+	}
+
+	if f.limit > 0 && len(result) > f.limit {
+		result = result[:f.limit]
+	}
+
+	return result
+}
+
+// releasedAt returns the time the given release was published, or nil if it's
+// not known.
+func releasedAt(r *release) *time.Time {
+	if r.publishedAt.IsZero() {
+		return nil
+	}
+
+	publishedAt := r.publishedAt
+	return &publishedAt
+}
+
+// versionInfoV2 is a version in the list of versions with the v2 schema.
+type versionInfoV2 struct {
+	Version    string     `json:"version"`
+	URL        string     `json:"url"`
+	Prerelease bool       `json:"prerelease"`
+	Installed  bool       `json:"installed"`
+	ReleasedAt *time.Time `json:"released-at"`
+}
+
+// listVersionsV2 is an HTTP handler that will output a JSON with the versions
+// of a project with the v2 schema, which includes when they were released,
+// whether or not they are prereleases and whether or not their docs are
+// installed. Accepts the same filters as listVersions.
+func (s *Service) listVersionsV2(w http.ResponseWriter, r *http.Request) {
+	owner, project, ok := s.projectForHost(r.Host)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	log := projectLog(r, owner, project)
+
+	filter, err := parseVersionFilter(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.ensureIndexed(r.URL.Query().Get("token"), owner, project); err != nil {
+		log.Errorf("error indexing project: %s", err)
+		s.handleError(w, r, err)
+		return
+	}
+
+	releases := s.filteredReleases(r, owner, project, filter)
+	versions := make([]versionInfoV2, 0, len(releases))
+	for _, rel := range releases {
+		versions = append(versions, versionInfoV2{
+			Version:    rel.tag,
+			URL:        urlFor(r, rel.tag, ""),
+			Prerelease: rel.prerelease,
+			Installed:  s.index.isInstalled(owner, project, rel.tag),
+			ReleasedAt: releasedAt(rel),
+		})
+	}
+
+	if err := s.writeVersions(w, r, owner, project, versions); err != nil {
+		log.Errorf("error serving project versions: %s", err)
+		s.internalError(w, r)
+	}
+}
+
+const (
+	// refreshedAtHeader is the header with the time the releases of the
+	// project were last refreshed.
+	refreshedAtHeader = "X-Docsrv-Refreshed-At"
+	// refreshErrorHeader is the header with the reason the last refresh of
+	// the releases of the project failed, if it did.
+	refreshErrorHeader = "X-Docsrv-Refresh-Error"
+)
+
+// versionsMeta is the state of the list of versions of a project, so the
+// clients can warn that it may be stale.
+type versionsMeta struct {
+	// RefreshedAt is the last time the releases were refreshed.
+	RefreshedAt *time.Time `json:"refreshed-at"`
+	// Stale reports whether the last refresh failed, so the list may be
+	// missing the newest releases.
+	Stale bool `json:"stale"`
+	// RefreshError is the reason the last refresh failed, if it did.
+	RefreshError string `json:"refresh-error,omitempty"`
+	// RefreshFailedAt is the time the last refresh failed, if it did.
+	RefreshFailedAt *time.Time `json:"refresh-failed-at,omitempty"`
+}
+
+// versionsWithMeta is the list of versions along with their state, served
+// with the "meta" query string parameter.
+type versionsWithMeta struct {
+	Meta     versionsMeta `json:"meta"`
+	Versions interface{}  `json:"versions"`
+}
+
+// versionsMeta returns the state of the list of versions of the given
+// project.
+func (s *Service) versionsMeta(owner, project string) versionsMeta {
+	var meta versionsMeta
+	if t, ok := s.index.lastRefresh(owner, project); ok {
+		meta.RefreshedAt = &t
+	}
+
+	if f, ok := s.index.lastRefreshFailure(owner, project); ok {
+		meta.Stale = true
+		meta.RefreshError = refreshErrorMessage(f.err)
+		meta.RefreshFailedAt = &f.at
+	}
+	return meta
+}
+
+// refreshErrorMessage returns the reason of the given refresh error that can
+// be shown to the users, without the details of the request that failed.
+func refreshErrorMessage(err error) string {
+	cause := Cause(err)
+	if _, ok := cause.(*ErrRateLimited); ok {
+		return "GitHub API rate limit exceeded"
+	}
+
+	if cause == ErrNotFound {
+		return "repository not found"
+	}
+	return "GitHub could not be reached"
+}
+
+// writeVersions writes the given list of versions of the given project with
+// the headers of its state and, if the "meta" query string parameter is
+// true, along with the state itself.
+func (s *Service) writeVersions(w http.ResponseWriter, r *http.Request, owner, project string, versions interface{}) error {
+	meta := s.versionsMeta(owner, project)
+	if meta.RefreshedAt != nil {
+		w.Header().Set(refreshedAtHeader, meta.RefreshedAt.UTC().Format(time.RFC3339))
+	}
+	if meta.Stale {
+		w.Header().Set(refreshErrorHeader, meta.RefreshError)
+	}
+
+	if withMeta, _ := strconv.ParseBool(r.URL.Query().Get("meta")); withMeta {
+		return s.writeJSON(w, versionsWithMeta{meta, versions})
+	}
+	return s.writeJSON(w, versions)
+}
@@ -0,0 +1,126 @@
+package docsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newVersionsTestSrv() *Service {
+	fetcher := newMockFetcher()
+	fetcher.add("org", "foo", "v1.0.0", "")
+	fetcher.add("org", "foo", "v1.1.0", "")
+	fetcher.add("org", "foo", "v2.0.0", "")
+	fetcher.addPrerelease("org", "foo", "v2.1.0-beta.1", "")
+	fetcher.addBranch("org", "foo", "master", "", "1234")
+	fetcher.setPublishedAt("org", "foo", "v2.0.0", time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC))
+	return newTestSrv(fetcher, Config{
+		"foo.bar": ProjectConfig{Repository: "org/foo", Prereleases: true, Branches: []string{"master"}},
+	})
+}
+
+func TestListVersions_Filters(t *testing.T) {
+	srv := newVersionsTestSrv()
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"v1.0.0", "v1.1.0", "v2.0.0", "v2.1.0-beta.1", "master"}},
+		{"?major=1", []string{"v1.0.0", "v1.1.0"}},
+		{"?major=2&include-prereleases=false", []string{"v2.0.0"}},
+		{"?order=desc", []string{"v2.1.0-beta.1", "v2.0.0", "v1.1.0", "v1.0.0", "master"}},
+		{"?order=desc&limit=2&include-prereleases=false", []string{"v2.0.0", "v1.1.0"}},
+		{"?major=3", []string{}},
+	}
+
+	releasedAt := time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		expected := make([]*version, 0, len(c.expected))
+		for _, v := range c.expected {
+			version := &version{Text: v, URL: "http://foo.bar/" + v, Prerelease: v == "v2.1.0-beta.1"}
+			if v == "v2.0.0" {
+				version.ReleasedAt = &releasedAt
+			}
+			expected = append(expected, version)
+		}
+		assertJSON(t, srv, "http://foo.bar/versions.json"+c.query, expected)
+	}
+
+	for _, query := range []string{"?major=v2", "?limit=-1", "?order=newest", "?include-prereleases=maybe"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/versions.json"+query, nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestListVersionsV2(t *testing.T) {
+	srv := newVersionsTestSrv()
+	require.NoError(t, srv.indexProject("org", "foo"))
+	srv.index.install(buildConfig{owner: "org", project: "foo", version: "v2.0.0"})
+
+	releasedAt := time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC)
+	assertJSON(t, srv, "http://foo.bar/versions/v2.json", []versionInfoV2{
+		{"v1.0.0", "http://foo.bar/v1.0.0", false, false, nil},
+		{"v1.1.0", "http://foo.bar/v1.1.0", false, false, nil},
+		{"v2.0.0", "http://foo.bar/v2.0.0", false, true, &releasedAt},
+		{"v2.1.0-beta.1", "http://foo.bar/v2.1.0-beta.1", true, false, nil},
+		{"master", "http://foo.bar/master", false, false, nil},
+	})
+
+	assertJSON(t, srv, "http://foo.bar/versions/v2.json?major=2&order=desc&limit=1", []versionInfoV2{
+		{"v2.1.0-beta.1", "http://foo.bar/v2.1.0-beta.1", true, false, nil},
+	})
+}
+
+func TestListVersions_Meta(t *testing.T) {
+	require := require.New(t)
+	fetcher := &rateLimitedFetcher{mockFetcher: newMockFetcher()}
+	fetcher.add("org", "foo", "v1.0.0", "")
+	srv := newTestSrv(fetcher, Config{"foo.bar": ProjectConfig{Repository: "org/foo"}})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar/versions.json", nil))
+	require.Equal(http.StatusOK, w.Code)
+	refreshedAt, err := time.Parse(time.RFC3339, w.Header().Get(refreshedAtHeader))
+	require.NoError(err)
+	require.WithinDuration(time.Now(), refreshedAt, time.Minute)
+	require.Empty(w.Header().Get(refreshErrorHeader))
+
+	fetcher.reset = time.Now().Add(time.Hour)
+	require.Error(srv.refreshProject(newKey("org", "foo")))
+
+	for _, path := range []string{"/versions.json", versionsV2Path} {
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "http://foo.bar"+path+"?meta=true", nil))
+		require.Equal(http.StatusOK, w.Code, path)
+		require.Equal("GitHub API rate limit exceeded", w.Header().Get(refreshErrorHeader), path)
+
+		var resp struct {
+			Meta     versionsMeta      `json:"meta"`
+			Versions []json.RawMessage `json:"versions"`
+		}
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &resp), path)
+		require.True(resp.Meta.Stale, path)
+		require.Equal("GitHub API rate limit exceeded", resp.Meta.RefreshError, path)
+		require.NotNil(resp.Meta.RefreshedAt, path)
+		require.NotNil(resp.Meta.RefreshFailedAt, path)
+		require.Len(resp.Versions, 1, path)
+	}
+
+	fetcher.reset = time.Now()
+	srv.rateLimits.limit("", time.Now().Add(-time.Second))
+	require.NoError(srv.refreshProject(newKey("org", "foo")))
+	require.False(srv.versionsMeta("org", "foo").Stale)
+}
+
+func TestRefreshErrorMessage(t *testing.T) {
+	require := require.New(t)
+	require.Equal("repository not found", refreshErrorMessage(wrap(ErrNotFound, "error listing releases")))
+	require.Equal("GitHub could not be reached", refreshErrorMessage(errors.New("dial tcp: i/o timeout")))
+}